@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	defaultConfigPath = "config.yaml"
+	configPathEnv     = config.EnvPrefix + "CONFIG"
+)
+
+type configSource struct {
+	flags     *flag.FlagSet
+	path      string
+	overrides config.Overrides
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configSource {
+	source := &configSource{flags: flags, path: defaultConfigPath}
+	if path, ok := os.LookupEnv(configPathEnv); ok {
+		source.path = path
+	}
+	flags.StringVar(&source.path, "config", source.path, "Path to config file, empty to configure only from flags and "+config.EnvPrefix+"* environment variables")
+	source.overrides = config.RegisterFlags(flags)
+	return source
+}
+
+func (s *configSource) explicit() bool {
+	if _, ok := os.LookupEnv(configPathEnv); ok {
+		return true
+	}
+	explicit := false
+	s.flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	return explicit
+}
+
+func (s *configSource) resolvedPath() string {
+	if !s.explicit() {
+		if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+			return ""
+		}
+	}
+	return s.path
+}
+
+func (s *configSource) load() (config.Config, error) {
+	return config.Load(s.resolvedPath(), s.overrides)
+}
+
+func (s *configSource) describe() string {
+	if path := s.resolvedPath(); path != "" {
+		return path
+	}
+	return "environment and flags"
+}
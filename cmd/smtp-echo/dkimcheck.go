@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+	"github.com/danthegoodman1/smtp_echo/internal/resolver"
+)
+
+const dkimCheckTimeout = 10 * time.Second
+
+func dnsResolver(cfg config.Config) mailauth.Resolver {
+	if cfg.DNS == nil {
+		return net.DefaultResolver
+	}
+	return resolver.New(resolver.Options{
+		Servers:       cfg.DNS.Servers,
+		TLS:           cfg.DNS.TLS,
+		TLSServerName: cfg.DNS.TLSServerName,
+		Timeout:       cfg.DNS.Timeout,
+		CacheSize:     cfg.DNS.CacheSize,
+		MaxTTL:        cfg.DNS.MaxTTL,
+	})
+}
+
+func checkDKIMRecords(cfg config.Config, logger *log.Logger, strict bool) error {
+	sections := map[string]*config.DKIMConfig{"dkim": cfg.DKIM}
+	for name, identity := range cfg.Reply.Identities {
+		sections["reply.identities."+name+".dkim"] = identity.DKIM
+	}
+	names := make([]string, 0, len(sections))
+	for name, section := range sections {
+		if section != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dkimCheckTimeout)
+	defer cancel()
+	resolver := dnsResolver(cfg)
+	var failures []string
+	for _, name := range names {
+		section := sections[name]
+		keys, err := dkimkeys.Load(section)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		key, ok := dkimkeys.Active(keys, time.Now())
+		if !ok {
+			continue
+		}
+		result := dkimkeys.Check(ctx, resolver, section.Domain, key)
+		switch result.Status {
+		case dkimkeys.CheckOK:
+			logger.Printf("dkim dns check passed %s selector=%q record=%s", name, result.Selector, result.RecordName)
+		case dkimkeys.CheckError:
+			logger.Printf("WARNING: dkim dns check could not look up %s for %s: %s", result.RecordName, name, result.Detail)
+		default:
+			logger.Printf("WARNING: dkim dns check %s for %s: %s: %s; replies will fail DKIM verification until the record is fixed", result.Status, name, result.RecordName, result.Detail)
+			failures = append(failures, fmt.Sprintf("%s (%s)", result.RecordName, result.Status))
+		}
+	}
+	if strict && len(failures) > 0 {
+		return fmt.Errorf("dkim dns check failed for %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+)
+
+func runEchoFile(args []string) error {
+	flags := flag.NewFlagSet("echo-file", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	from := flags.String("from", "", "Envelope sender (default the Return-Path or From header)")
+	to := flags.String("to", "", "Comma-separated envelope recipients (default the Delivered-To or X-Original-To headers, then To and Cc, then reply.from_address)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("echo-file: usage: smtp-echo echo-file [-config config.yaml] [-from addr] [-to addr,...] <message.eml|->")
+	}
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	var raw []byte
+	if path := flags.Arg(0); path == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("echo-file: %w", err)
+	}
+	if cfg.MaxMessageBytes > 0 && int64(len(raw)) > cfg.MaxMessageBytes {
+		return fmt.Errorf("echo-file: message is %d bytes, over max_message_bytes %d", len(raw), cfg.MaxMessageBytes)
+	}
+	msg := fileMessage(cfg, raw, *from, *to)
+
+	logger := log.New(os.Stderr, "", log.LstdFlags|log.LUTC)
+	processor, messageStore, closeProcessor, err := newOfflineProcessor(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer closeProcessor()
+	backend := echo.NewBackend(cfg, processor, messageStore, logger)
+	if cfg.Archive != nil {
+		archiveWriter, err := archive.Open(*cfg.Archive)
+		if err != nil {
+			return err
+		}
+		backend.UseArchive(archiveWriter)
+	}
+	if cfg.Quarantine != nil {
+		dir, err := quarantine.Open(*cfg.Quarantine)
+		if err != nil {
+			return err
+		}
+		backend.UseQuarantine(dir)
+	}
+
+	err = backend.Ingest(context.Background(), msg)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if abandoned, drainErr := backend.Drain(drainCtx); drainErr != nil {
+		logger.Printf("drain: %v (abandoned=%d)", drainErr, abandoned)
+	}
+	if err != nil {
+		return fmt.Errorf("echo-file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "echo-file: echoed message from %s to %s\n", msg.EnvelopeFrom, strings.Join(msg.Recipients, ", "))
+	return nil
+}
+
+func fileMessage(cfg config.Config, raw []byte, from string, to string) echo.InboundMessage {
+	msg := echo.MessageFromRaw(raw, addressOf(cfg.Reply.FromAddress))
+	if from != "" {
+		msg.EnvelopeFrom = from
+	}
+	if to != "" {
+		msg.Recipients = nil
+		for _, recipient := range strings.Split(to, ",") {
+			msg.Recipients = append(msg.Recipients, strings.TrimSpace(recipient))
+		}
+	}
+	return msg
+}
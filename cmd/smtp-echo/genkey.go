@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+)
+
+func runDKIMGenkey(args []string) error {
+	flags := flag.NewFlagSet("dkim-genkey", flag.ExitOnError)
+	domain := flags.String("domain", "", "Signing domain (dkim.domain)")
+	selector := flags.String("selector", "", "DKIM selector (dkim.selector)")
+	out := flags.String("out", "dkim-private.pem", "Path to write the private key")
+	bits := flags.Int("bits", 2048, "RSA key size")
+	flags.Parse(args)
+
+	if *domain == "" || *selector == "" {
+		return errors.New("dkim-genkey: -domain and -selector are required")
+	}
+	if *bits < 1024 {
+		return errors.New("dkim-genkey: -bits must be >= 1024")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return fmt.Errorf("generate rsa key: %w", err)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encode private key: %w", err)
+	}
+	record, err := dkimkeys.TXTValue(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create private key file: %w", err)
+	}
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: private}); err != nil {
+		file.Close()
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+
+	fmt.Printf("wrote private key to %s\n\n", *out)
+	fmt.Printf("publish this TXT record:\n\n%s._domainkey.%s. IN TXT %s\n", *selector, *domain,
+		txtStrings(record))
+	fmt.Printf("\nand add to config.yaml:\n\ndkim:\n  domain: %q\n  selector: %q\n  private_key_path: %q\n", *domain, *selector, *out)
+	return nil
+}
+
+func txtStrings(value string) string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "( " + strings.Join(parts, " ") + " )"
+}
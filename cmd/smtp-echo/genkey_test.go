@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRunDKIMGenkey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "dkim.pem")
+	output, err := captureStdout(t, func() error {
+		return runDKIMGenkey([]string{"-domain", "example.com", "-selector", "s1", "-bits", "1024", "-out", keyPath})
+	})
+	if err != nil {
+		t.Fatalf("runDKIMGenkey() error = %v", err)
+	}
+
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("private key file = %q, want a PKCS#8 PEM block", data)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKCS8PrivateKey() error = %v", err)
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("private key type = %T, want *rsa.PrivateKey", parsed)
+	}
+
+	record := regexp.MustCompile(`(?m)^s1\._domainkey\.example\.com\. IN TXT (.+)$`).FindStringSubmatch(output)
+	if record == nil {
+		t.Fatalf("runDKIMGenkey() output = %q, want the TXT record", output)
+	}
+	var value strings.Builder
+	for _, part := range regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(record[1], -1) {
+		value.WriteString(part[1])
+	}
+	encoded, ok := strings.CutPrefix(value.String(), "v=DKIM1; k=rsa; p=")
+	if !ok {
+		t.Fatalf("TXT record = %q, want v=DKIM1 with an rsa key", value.String())
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decode TXT public key: %v", err)
+	}
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey() error = %v", err)
+	}
+	if !private.PublicKey.Equal(public) {
+		t.Fatal("TXT record public key does not match the private key")
+	}
+
+	_, snippet, ok := strings.Cut(output, "and add to config.yaml:\n\n")
+	if !ok {
+		t.Fatalf("runDKIMGenkey() output = %q, want a config snippet", output)
+	}
+	path := writeTestConfig(t, testConfig+snippet)
+	validated, err := captureStdout(t, func() error {
+		return runValidateConfig([]string{"-config", path})
+	})
+	if err != nil {
+		t.Fatalf("runValidateConfig() with the generated snippet error = %v", err)
+	}
+	if !strings.Contains(validated, "dkim domain=example.com selector=s1 keys=1") {
+		t.Fatalf("runValidateConfig() output = %q, want the generated key", validated)
+	}
+
+	if err := runDKIMGenkey([]string{"-domain", "example.com", "-selector", "s1", "-bits", "1024", "-out", keyPath}); err == nil {
+		t.Fatal("runDKIMGenkey() over an existing key error = nil, want an error")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/admin"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+)
+
+type dkimKeyring struct {
+	source *configSource
+	reload func() error
+}
+
+func (k *dkimKeyring) config() (*config.DKIMConfig, error) {
+	cfg, err := k.source.load()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DKIM == nil {
+		return nil, errors.New("dkim is not configured")
+	}
+	return cfg.DKIM, nil
+}
+
+func (k *dkimKeyring) Keys() ([]admin.DKIMKey, error) {
+	cfg, err := k.config()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := dkimkeys.Load(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active, _ := dkimkeys.Active(keys, now)
+	described := make([]admin.DKIMKey, 0, len(keys))
+	for _, key := range keys {
+		entry, err := describeKey(cfg.Domain, key, activeStatus(key, active, now))
+		if err != nil {
+			return nil, err
+		}
+		described = append(described, entry)
+	}
+	return described, nil
+}
+
+func (k *dkimKeyring) Rotate() (admin.DKIMKey, error) {
+	cfg, err := k.config()
+	if err != nil {
+		return admin.DKIMKey{}, err
+	}
+	key, err := dkimkeys.Rotate(cfg, time.Now())
+	if err != nil {
+		return admin.DKIMKey{}, err
+	}
+	if err := k.reload(); err != nil {
+		return admin.DKIMKey{}, err
+	}
+	return describeKey(cfg.Domain, key, keyStatus(key, time.Now()))
+}
+
+func (k *dkimKeyring) Check(ctx context.Context) ([]admin.DKIMCheck, error) {
+	cfg, err := k.source.load()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DKIM == nil {
+		return nil, errors.New("dkim is not configured")
+	}
+	keys, err := dkimkeys.Load(cfg.DKIM)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := dnsResolver(cfg)
+	now := time.Now()
+	active, _ := dkimkeys.Active(keys, now)
+	checks := make([]admin.DKIMCheck, 0, len(keys))
+	for _, key := range keys {
+		status := activeStatus(key, active, now)
+		if status == "expired" {
+			continue
+		}
+		result := dkimkeys.Check(ctx, resolver, cfg.DKIM.Domain, key)
+		checks = append(checks, admin.DKIMCheck{
+			Selector:   key.Selector,
+			KeyStatus:  status,
+			RecordName: result.RecordName,
+			Status:     result.Status,
+			Detail:     result.Detail,
+		})
+	}
+	return checks, nil
+}
+
+func activeStatus(key dkimkeys.Key, active dkimkeys.Key, now time.Time) string {
+	if key.Path == active.Path && key.Selector == active.Selector {
+		return "active"
+	}
+	return keyStatus(key, now)
+}
+
+func keyStatus(key dkimkeys.Key, now time.Time) string {
+	switch {
+	case !key.NotBefore.IsZero() && now.Before(key.NotBefore):
+		return "pending"
+	case !key.NotAfter.IsZero() && !now.Before(key.NotAfter):
+		return "expired"
+	default:
+		return "standby"
+	}
+}
+
+func describeKey(domain string, key dkimkeys.Key, status string) (admin.DKIMKey, error) {
+	value, err := key.RecordValue()
+	if err != nil {
+		return admin.DKIMKey{}, err
+	}
+	described := admin.DKIMKey{
+		Selector:    key.Selector,
+		Status:      status,
+		RecordName:  key.RecordName(domain),
+		RecordValue: value,
+	}
+	if !key.NotBefore.IsZero() {
+		described.NotBefore = &key.NotBefore
+	}
+	if !key.NotAfter.IsZero() {
+		described.NotAfter = &key.NotAfter
+	}
+	return described, nil
+}
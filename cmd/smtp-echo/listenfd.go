@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const systemdFirstFD = 3
+
+type fdList []int
+
+func (l *fdList) String() string {
+	values := make([]string, len(*l))
+	for i, fd := range *l {
+		values[i] = strconv.Itoa(fd)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *fdList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		fd, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid file descriptor %q", field)
+		}
+		*l = append(*l, fd)
+	}
+	return nil
+}
+
+type inheritedSockets struct {
+	listeners []net.Listener
+}
+
+func inheritSockets(fds []int) (*inheritedSockets, error) {
+	fds = append(systemdFDs(), fds...)
+	sockets := &inheritedSockets{}
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			sockets.close()
+			return nil, fmt.Errorf("inherited file descriptor %d: %w", fd, err)
+		}
+		sockets.listeners = append(sockets.listeners, listener)
+	}
+	return sockets, nil
+}
+
+func systemdFDs() []int {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	fds := make([]int, count)
+	for i := range fds {
+		fds[i] = systemdFirstFD + i
+	}
+	return fds
+}
+
+func (s *inheritedSockets) take(addr string) net.Listener {
+	for i, listener := range s.listeners {
+		if addrMatches(addr, listener.Addr()) {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+func (s *inheritedSockets) unused() error {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	addrs := make([]string, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr().String()
+	}
+	s.close()
+	return fmt.Errorf("inherited sockets match no configured listener: %s", strings.Join(addrs, ", "))
+}
+
+func (s *inheritedSockets) close() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+}
+
+func addrMatches(configured string, actual net.Addr) bool {
+	tcpAddr, ok := actual.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(configured)
+	if err != nil {
+		return false
+	}
+	if number, err := net.LookupPort("tcp", port); err != nil || number != tcpAddr.Port {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		for _, candidate := range ips {
+			if candidate.Equal(tcpAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return ip.Equal(tcpAddr.IP) || (ip.IsUnspecified() && tcpAddr.IP.IsUnspecified())
+}
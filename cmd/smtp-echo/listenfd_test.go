@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFDList_Set(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   fdList
+		err    bool
+	}{
+		{name: "single", values: []string{"3"}, want: fdList{3}},
+		{name: "comma separated", values: []string{"3, 4,5"}, want: fdList{3, 4, 5}},
+		{name: "repeated flag", values: []string{"3", "7"}, want: fdList{3, 7}},
+		{name: "negative", values: []string{"-1"}, err: true},
+		{name: "not a number", values: []string{"three"}, err: true},
+		{name: "empty field", values: []string{"3,"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var list fdList
+			var err error
+			for _, value := range tt.values {
+				if err = list.Set(value); err != nil {
+					break
+				}
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Set(%q) error = nil, want an error", tt.values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set(%q) error = %v", tt.values, err)
+			}
+			if !reflect.DeepEqual(list, tt.want) {
+				t.Fatalf("Set(%q) = %v, want %v", tt.values, list, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemdFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []int
+	}{
+		{name: "unset"},
+		{name: "two sockets", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2", "LISTEN_FDNAMES": "smtp:submission"}, want: []int{3, 4}},
+		{name: "other process", env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}},
+		{name: "invalid pid", env: map[string]string{"LISTEN_PID": "self", "LISTEN_FDS": "2"}},
+		{name: "zero sockets", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0"}},
+		{name: "invalid count", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "many"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if got := systemdFDs(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("systemdFDs() = %v, want %v", got, tt.want)
+			}
+			for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				if _, ok := os.LookupEnv(name); ok {
+					t.Fatalf("systemdFDs() left %s set", name)
+				}
+			}
+		})
+	}
+}
+
+func TestAddrMatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		actual     net.Addr
+		want       bool
+	}{
+		{name: "any host", configured: ":2525", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525}, want: true},
+		{name: "same ip", configured: "127.0.0.1:2525", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525}, want: true},
+		{name: "other ip", configured: "127.0.0.2:2525", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525}},
+		{name: "other port", configured: "127.0.0.1:2526", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525}},
+		{name: "unspecified", configured: "0.0.0.0:25", actual: &net.TCPAddr{IP: net.IPv6unspecified, Port: 25}, want: true},
+		{name: "ipv6", configured: "[::1]:25", actual: &net.TCPAddr{IP: net.IPv6loopback, Port: 25}, want: true},
+		{name: "named port", configured: "127.0.0.1:smtp", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}, want: true},
+		{name: "host name", configured: "localhost:25", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}, want: true},
+		{name: "missing port", configured: "127.0.0.1", actual: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}},
+		{name: "not tcp", configured: ":25", actual: &net.UnixAddr{Name: "/tmp/smtp.sock", Net: "unix"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addrMatches(tt.configured, tt.actual); got != tt.want {
+				t.Fatalf("addrMatches(%q, %v) = %t, want %t", tt.configured, tt.actual, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,79 +1,67 @@
 package main
 
 import (
-	"context"
-	"errors"
-	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"strings"
+)
 
-	"github.com/emersion/go-smtp"
+const usage = `usage: smtp-echo <command> [flags]
 
-	"github.com/danthegoodman1/smtp_echo/internal/config"
-	"github.com/danthegoodman1/smtp_echo/internal/echo"
-)
+commands:
+  serve            run the echo server (default)
+  validate-config  check a config file and the files it references
+  send-test        send a test message to an echo server and wait for the reply
+  selftest         run the server on loopback and check that it echoes a message
+  dkim-genkey      generate a DKIM key pair and print the DNS TXT record
+  preflight        check hostname, PTR, SPF and DMARC records for deliverability
+  queue inspect    list replies waiting in the persistent queue
+  quarantine       list, show, or retry messages that failed permanently
+  replay           run the reply pipeline on a stored message or a message file
+  echo-file        feed a message file or stdin through the full inbound pipeline
+
+Run "smtp-echo <command> -h" for command flags.
+`
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	configPath := flag.String("config", "config.yaml", "Path to config file")
-	flag.Parse()
-
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		return err
+func run(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
 	}
 
-	logger := log.New(os.Stdout, "", log.LstdFlags|log.LUTC)
-	replier, err := echo.NewReplier(cfg, logger)
-	if err != nil {
-		return err
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return runServe(args)
+	case "validate-config":
+		return runValidateConfig(args)
+	case "send-test":
+		return runSendTest(args)
+	case "selftest":
+		return runSelftest(args)
+	case "dkim-genkey":
+		return runDKIMGenkey(args)
+	case "preflight":
+		return runPreflight(args)
+	case "queue":
+		return runQueue(args)
+	case "quarantine":
+		return runQuarantine(args)
+	case "replay":
+		return runReplay(args)
+	case "echo-file":
+		return runEchoFile(args)
+	case "help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", command)
 	}
-	backend := echo.NewBackend(replier, logger)
-
-	server := smtp.NewServer(backend)
-	server.Addr = cfg.ListenAddr
-	server.Domain = cfg.Hostname
-	server.ReadTimeout = cfg.ReadTimeout
-	server.WriteTimeout = cfg.WriteTimeout
-	server.MaxMessageBytes = cfg.MaxMessageBytes
-	server.ErrorLog = logger
-
-	logger.Printf("starting smtp echo server on %s", cfg.ListenAddr)
-
-	serverErr := make(chan error, 1)
-	go func() {
-		serverErr <- server.ListenAndServe()
-	}()
-
-	shutdownSignal, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stopSignals()
-
-	select {
-	case err := <-serverErr:
-		if errors.Is(err, smtp.ErrServerClosed) {
-			return nil
-		}
-		return fmt.Errorf("smtp server exited: %w", err)
-	case <-shutdownSignal.Done():
-	}
-
-	logger.Println("shutdown signal received")
-
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
-		return fmt.Errorf("shutdown smtp server: %w", err)
-	}
-
-	return nil
 }
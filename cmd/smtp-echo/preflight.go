@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/preflight"
+)
+
+const preflightTimeout = 30 * time.Second
+
+type ipList []net.IP
+
+func (l *ipList) String() string {
+	values := make([]string, len(*l))
+	for i, ip := range *l {
+		values[i] = ip.String()
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *ipList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field))
+		if ip == nil {
+			return fmt.Errorf("invalid ip address %q", field)
+		}
+		*l = append(*l, ip)
+	}
+	return nil
+}
+
+func runPreflight(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	var egress ipList
+	flags.Var(&egress, "egress-ip", "Public address replies leave from (repeatable, default delivery.source_ipv4/ipv6 or the hostname's addresses)")
+	flags.Parse(args)
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	report := preflight.Run(ctx, dnsResolver(cfg), preflightInput(cfg, egress))
+
+	for _, check := range report.Checks {
+		fmt.Printf("%-4s %-16s %s\n", strings.ToUpper(check.Status), check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Printf("     %-16s fix: %s\n", "", check.Fix)
+		}
+	}
+	if report.Failed() {
+		return fmt.Errorf("preflight failed: replies from %s are likely to be rejected or filtered as spam", cfg.Hostname)
+	}
+	return nil
+}
+
+func runStartupPreflight(cfg config.Config, logger *log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	report := preflight.Run(ctx, dnsResolver(cfg), preflightInput(cfg, nil))
+	for _, check := range report.Checks {
+		if check.Status == preflight.StatusPass {
+			continue
+		}
+		logger.Printf("WARNING: preflight %s %s: %s; fix: %s", check.Name, check.Status, check.Detail, check.Fix)
+	}
+}
+
+func preflightInput(cfg config.Config, egress []net.IP) preflight.Input {
+	input := preflight.Input{
+		Hostname:   cfg.Hostname,
+		MailFrom:   addressOf(cfg.Reply.MailFrom),
+		FromDomain: domainOf(addressOf(cfg.Reply.FromAddress)),
+		EgressIPs:  egress,
+		EHLOName:   cfg.Delivery.EHLOName,
+		EHLONames:  make(map[string]string),
+	}
+	if cfg.DKIM != nil {
+		input.DKIMDomain = cfg.DKIM.Domain
+	}
+	var sources []string
+	if cfg.Delivery.SourcePool != nil {
+		for _, address := range cfg.Delivery.SourcePool.Addresses {
+			sources = append(sources, address.IP)
+			if address.EHLOName != "" {
+				input.EHLONames[net.ParseIP(address.IP).String()] = address.EHLOName
+			}
+		}
+	}
+	sources = append(sources, cfg.Delivery.SourceIPv4, cfg.Delivery.SourceIPv6)
+	if len(input.EgressIPs) == 0 {
+		for _, source := range sources {
+			if ip := net.ParseIP(source); ip != nil {
+				input.EgressIPs = append(input.EgressIPs, ip)
+			}
+		}
+	}
+	return input
+}
+
+func addressOf(value string) string {
+	address, err := mail.ParseAddress(value)
+	if err != nil {
+		return value
+	}
+	return address.Address
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+const quarantineUsage = "quarantine: usage: smtp-echo quarantine list|show|retry [-config config.yaml] [flags] [id...]"
+
+func runQuarantine(args []string) error {
+	if len(args) == 0 {
+		return errors.New(quarantineUsage)
+	}
+	switch args[0] {
+	case "list":
+		return runQuarantineList(args[1:])
+	case "show":
+		return runQuarantineShow(args[1:])
+	case "retry":
+		return runQuarantineRetry(args[1:])
+	default:
+		return errors.New(quarantineUsage)
+	}
+}
+
+func openQuarantine(cfg config.Config) (*quarantine.Dir, error) {
+	if cfg.Quarantine == nil {
+		return nil, errors.New("quarantine: the quarantine section is not configured")
+	}
+	return quarantine.Open(*cfg.Quarantine)
+}
+
+func runQuarantineList(args []string) error {
+	flags := flag.NewFlagSet("quarantine list", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	asJSON := flags.Bool("json", false, "Print entries as JSON")
+	flags.Parse(args)
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	dir, err := openQuarantine(cfg)
+	if err != nil {
+		return err
+	}
+	entries, err := dir.List()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string]any{"entries": entries})
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tQUARANTINED\tSTATUS\tFROM\tRECIPIENTS\tSIZE\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			entry.ID, entry.QuarantinedAt.Format(time.RFC3339), entry.Status, entry.EnvelopeFrom, strings.Join(entry.Recipients, ","), entry.Size, entry.Error)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d quarantined messages\n", len(entries))
+	return nil
+}
+
+func runQuarantineShow(args []string) error {
+	flags := flag.NewFlagSet("quarantine show", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	raw := flags.Bool("raw", false, "Print only the raw message")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("quarantine: usage: smtp-echo quarantine show [-config config.yaml] [-raw] <id>")
+	}
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	dir, err := openQuarantine(cfg)
+	if err != nil {
+		return err
+	}
+	entry, message, err := dir.Get(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if !*raw {
+		fmt.Printf("ID:          %s\n", entry.ID)
+		fmt.Printf("Quarantined: %s\n", entry.QuarantinedAt.Format(time.RFC3339))
+		if entry.MessageID != 0 {
+			fmt.Printf("Message:     %d\n", entry.MessageID)
+		}
+		fmt.Printf("From:        %s\n", entry.EnvelopeFrom)
+		fmt.Printf("Recipients:  %s\n", strings.Join(entry.Recipients, ", "))
+		fmt.Printf("Size:        %d bytes\n", entry.Size)
+		fmt.Printf("Status:      %s\n", entry.Status)
+		fmt.Printf("Error:       %s\n\n", entry.Error)
+	}
+	_, err = os.Stdout.Write(message)
+	return err
+}
+
+func runQuarantineRetry(args []string) error {
+	flags := flag.NewFlagSet("quarantine retry", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	all := flags.Bool("all", false, "Retry every quarantined message")
+	flags.Parse(args)
+	if *all == (flags.NArg() > 0) {
+		return errors.New("quarantine: usage: smtp-echo quarantine retry [-config config.yaml] -all | <id>...")
+	}
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	dir, err := openQuarantine(cfg)
+	if err != nil {
+		return err
+	}
+	ids := flags.Args()
+	if *all {
+		entries, err := dir.List()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags|log.LUTC)
+	processor, _, closeProcessor, err := newOfflineProcessor(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer closeProcessor()
+
+	failed := 0
+	for _, id := range ids {
+		entry, raw, err := dir.Get(id)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := processingContext(cfg)
+		err = processor.Echo(ctx, echo.QuarantinedMessage(entry, raw))
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("%s failed: %v\n", id, err)
+			continue
+		}
+		if err := dir.Remove(id); err != nil {
+			return err
+		}
+		fmt.Printf("%s echoed\n", id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("quarantine: %d of %d messages failed again and were kept", failed, len(ids))
+	}
+	return nil
+}
+
+func newOfflineProcessor(cfg config.Config, logger *log.Logger) (echo.Processor, store.Store, func(), error) {
+	var messageStore store.Store
+	if cfg.Store != nil {
+		var err error
+		messageStore, err = store.Open(*cfg.Store)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	closeStore := func() {
+		if messageStore != nil {
+			messageStore.Close()
+		}
+	}
+
+	suppressions, err := suppression.Open(suppressionConfig(cfg))
+	if err != nil {
+		closeStore()
+		return nil, nil, nil, err
+	}
+	replier, err := echo.NewReplier(cfg, messageStore, logger)
+	if err != nil {
+		closeStore()
+		return nil, nil, nil, err
+	}
+	replier.UseSuppressions(suppressions)
+	processor, err := echo.NewProcessor(cfg, replier)
+	if err != nil {
+		closeStore()
+		return nil, nil, nil, err
+	}
+	return processor, messageStore, func() {
+		if closer, ok := processor.(io.Closer); ok {
+			closer.Close()
+		}
+		closeStore()
+	}, nil
+}
+
+func processingContext(cfg config.Config) (context.Context, context.CancelFunc) {
+	if cfg.ProcessingTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cfg.ProcessingTimeout)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/queue"
+)
+
+func runQueue(args []string) error {
+	if len(args) == 0 || args[0] != "inspect" {
+		return errors.New("queue: usage: smtp-echo queue inspect [-config config.yaml] [-json]")
+	}
+
+	flags := flag.NewFlagSet("queue inspect", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	asJSON := flags.Bool("json", false, "Print entries as JSON")
+	flags.Parse(args[1:])
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	if cfg.Queue == nil {
+		return errors.New("queue: the queue section is not configured")
+	}
+
+	journal, err := queue.Open(*cfg.Queue)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	entries, err := journal.Entries(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string]any{"entries": entries})
+	}
+
+	now := time.Now()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tMESSAGE\tDUE\tSTATE\tFROM\tRECIPIENTS\tSIZE")
+	for _, entry := range entries {
+		state := "waiting"
+		if !entry.ClaimedAt.IsZero() {
+			state = "claimed"
+		} else if !entry.DueAt.After(now) {
+			state = "due"
+		}
+		fmt.Fprintf(writer, "%d\t%d\t%s\t%s\t%s\t%s\t%d\n",
+			entry.ID, entry.MessageID, entry.DueAt.Format(time.RFC3339), state, entry.EnvelopeFrom, strings.Join(entry.Recipients, ","), entry.Size)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d queued replies\n", len(entries))
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "Print the replies that would be sent instead of delivering them")
+	from := flags.String("from", "", "Envelope sender for a message file (default its Return-Path or From header)")
+	to := flags.String("to", "", "Comma-separated envelope recipients for a message file (default its Delivered-To or X-Original-To headers, then To and Cc, then reply.from_address)")
+	verbose := flags.Bool("v", false, "Log reply activity to stderr")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("replay: usage: smtp-echo replay [-config config.yaml] [-dry-run] [-from addr] [-to addr,...] <message id|file>")
+	}
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	msg, err := replayMessage(cfg, flags.Arg(0), *from, *to)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags|log.LUTC)
+	var processor echo.Processor
+	var replies []capturedReply
+	if *dryRun {
+		dryRunConfig(&cfg)
+		replierLogger := logger
+		if !*verbose {
+			replierLogger = nil
+		}
+		replier, err := echo.NewReplier(cfg, nil, replierLogger)
+		if err != nil {
+			return err
+		}
+		defer replier.Close()
+		replier.UseDelivery(func(_ context.Context, from string, to string, message []byte) error {
+			replies = append(replies, capturedReply{from: from, to: to, message: append([]byte(nil), message...)})
+			return nil
+		})
+		processor = replier
+	} else {
+		var closeProcessor func()
+		processor, _, closeProcessor, err = newOfflineProcessor(cfg, logger)
+		if err != nil {
+			return err
+		}
+		defer closeProcessor()
+	}
+
+	ctx, cancel := processingContext(cfg)
+	defer cancel()
+	if err := processor.Echo(ctx, msg); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+
+	if !*dryRun {
+		fmt.Printf("replay: echoed message from %s to %s\n", msg.EnvelopeFrom, strings.Join(msg.Recipients, ", "))
+		return nil
+	}
+	if len(replies) == 0 {
+		fmt.Println("replay: no reply would be sent")
+		return nil
+	}
+	for _, reply := range replies {
+		fmt.Printf("--- reply from <%s> to <%s>, %d bytes\n", reply.from, reply.to, len(reply.message))
+		os.Stdout.Write(reply.message)
+		if !bytes.HasSuffix(reply.message, []byte("\n")) {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+func dryRunConfig(cfg *config.Config) {
+	cfg.Reply.Digest = nil
+	if cfg.Forward != nil {
+		forward := *cfg.Forward
+		forward.Relay = ""
+		cfg.Forward = &forward
+	}
+}
+
+func replayMessage(cfg config.Config, arg string, from string, to string) (echo.InboundMessage, error) {
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		if _, statErr := os.Stat(arg); statErr != nil {
+			return storedReplayMessage(cfg, id)
+		}
+	}
+
+	raw, err := os.ReadFile(arg)
+	if err != nil {
+		return echo.InboundMessage{}, fmt.Errorf("replay: %w", err)
+	}
+	return fileMessage(cfg, raw, from, to), nil
+}
+
+func storedReplayMessage(cfg config.Config, id int64) (echo.InboundMessage, error) {
+	if cfg.Store == nil {
+		return echo.InboundMessage{}, fmt.Errorf("replay: %d is not a file and the store section is not configured", id)
+	}
+	messageStore, err := store.Open(*cfg.Store)
+	if err != nil {
+		return echo.InboundMessage{}, err
+	}
+	defer messageStore.Close()
+
+	stored, err := messageStore.GetMessage(context.Background(), id)
+	if err != nil {
+		return echo.InboundMessage{}, fmt.Errorf("replay: message %d: %w", id, err)
+	}
+	msg := echo.InboundMessage{
+		ID:           stored.ID,
+		EnvelopeFrom: stored.EnvelopeFrom,
+		Recipients:   stored.Recipients,
+		Data:         stored.Raw,
+		ReceivedAt:   stored.ReceivedAt,
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", stored.RemoteAddr); err == nil && stored.RemoteAddr != "" {
+		msg.RemoteAddr = addr
+	}
+	return msg, nil
+}
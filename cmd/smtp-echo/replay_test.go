@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+func TestRunReplay(t *testing.T) {
+	dir := t.TempDir()
+	outbox := filepath.Join(dir, "outbox")
+	storePath := filepath.Join(dir, "messages.db")
+	path := writeTestConfig(t, testConfig+"delivery:\n  mode: file\n  output_dir: "+strconv.Quote(outbox)+"\nstore:\n  driver: sqlite\n  path: "+strconv.Quote(storePath)+"\n")
+
+	messageStore, err := store.Open(config.StoreConfig{Driver: "sqlite", Path: storePath})
+	if err != nil {
+		t.Fatalf("store.Open() error = %v", err)
+	}
+	id, err := messageStore.SaveMessage(context.Background(), store.Message{
+		ReceivedAt:   time.Now(),
+		RemoteAddr:   "192.0.2.10:40000",
+		EnvelopeFrom: "stored@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Subject:      "stored",
+		Raw:          []byte("From: stored@example.net\r\nTo: echo@example.com\r\nSubject: stored\r\nMessage-ID: <stored@example.net>\r\n\r\nfrom the store\r\n"),
+	})
+	messageStore.Close()
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+
+	file := filepath.Join(dir, "message.eml")
+	if err := os.WriteFile(file, []byte("From: file@example.net\r\nTo: echo@example.com\r\nSubject: from a file\r\nMessage-ID: <file@example.net>\r\n\r\nfrom a file\r\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	outboxFiles := func() []string {
+		entries, err := os.ReadDir(outbox)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("ReadDir() error = %v", err)
+		}
+		var replies []string
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(outbox, entry.Name()))
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			replies = append(replies, string(data))
+		}
+		return replies
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		output  string
+		replies int
+		reply   string
+	}{
+		{
+			name:    "dry run",
+			args:    []string{"-dry-run", file},
+			output:  "--- reply from <bounce@example.com> to <file@example.net>",
+			replies: 0,
+		},
+		{
+			name:    "stored message",
+			args:    []string{strconv.FormatInt(id, 10)},
+			output:  "replay: echoed message from stored@example.net to echo@example.com\n",
+			replies: 1,
+			reply:   "Subject: Re: stored",
+		},
+		{
+			name:    "message file",
+			args:    []string{"-to", "echo@example.com", file},
+			output:  "replay: echoed message from file@example.net to echo@example.com\n",
+			replies: 2,
+			reply:   "Subject: Re: from a file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := captureStdout(t, func() error {
+				return runReplay(append([]string{"-config", path}, tt.args...))
+			})
+			if err != nil {
+				t.Fatalf("runReplay() error = %v", err)
+			}
+			if !strings.Contains(output, tt.output) {
+				t.Fatalf("runReplay() output = %q, want %q", output, tt.output)
+			}
+			replies := outboxFiles()
+			if len(replies) != tt.replies {
+				t.Fatalf("outbox has %d replies, want %d", len(replies), tt.replies)
+			}
+			if tt.reply == "" {
+				return
+			}
+			for _, reply := range replies {
+				if strings.Contains(reply, tt.reply) {
+					return
+				}
+			}
+			t.Fatalf("outbox replies = %q, want one with %q", replies, tt.reply)
+		})
+	}
+
+	if err := runReplay([]string{"-config", path, "999"}); err == nil {
+		t.Fatal("runReplay() with an unknown message id error = nil, want an error")
+	}
+}
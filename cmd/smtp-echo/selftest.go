@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/pkg/echoserver"
+)
+
+type capturedReply struct {
+	from    string
+	to      string
+	message []byte
+}
+
+func runSelftest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	to := flags.String("to", "", "Echo recipient address (default reply.from_address)")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long to wait for the reply")
+	verbose := flags.Bool("v", false, "Log server activity to stderr")
+	flags.Parse(args)
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	selftestConfig(&cfg)
+	if *to == "" {
+		*to = cfg.Reply.FromAddress
+	}
+
+	replies := make(chan capturedReply, 16)
+	options := []echoserver.Option{
+		echoserver.WithConfig(cfg),
+		echoserver.WithListenAddr("127.0.0.1:0"),
+		echoserver.WithDelivery(func(_ context.Context, from string, to string, message []byte) error {
+			select {
+			case replies <- capturedReply{from: from, to: to, message: append([]byte(nil), message...)}:
+			default:
+			}
+			return nil
+		}),
+	}
+	if *verbose {
+		options = append(options, echoserver.WithLogger(log.New(os.Stderr, "", log.LstdFlags|log.LUTC)))
+	}
+	server, err := echoserver.New(options...)
+	if err != nil {
+		return fmt.Errorf("selftest: %w", err)
+	}
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("selftest: %w", err)
+	}
+	defer server.Close()
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("generate message id: %w", err)
+	}
+	from := "smtp-echo-selftest@" + cfg.Hostname
+	messageID := fmt.Sprintf("smtp-echo-selftest-%s@%s", hex.EncodeToString(token), cfg.Hostname)
+
+	started := time.Now()
+	if err := sendTestMessage(server.Addr(), from, *to, messageID, false, false); err != nil {
+		return fmt.Errorf("selftest: %w", err)
+	}
+
+	deadline := time.After(*timeout)
+	for {
+		select {
+		case reply := <-replies:
+			reader, err := mail.CreateReader(bytes.NewReader(reply.message))
+			if err != nil {
+				return fmt.Errorf("selftest: parse reply: %w", err)
+			}
+			if reply.to != from || !isReplyTo(&reader.Header, messageID) {
+				continue
+			}
+			subject, _ := reader.Header.Subject()
+			fmt.Printf("selftest: ok, %s echoed <%s> from %s after %s: %s\n", *to, messageID, reply.from, time.Since(started).Round(time.Millisecond), subject)
+			return nil
+		case <-deadline:
+			return fmt.Errorf("selftest: no reply to <%s> within %s", messageID, *timeout)
+		}
+	}
+}
+
+func selftestConfig(cfg *config.Config) {
+	cfg.Listeners = nil
+	cfg.Auth = nil
+	cfg.Admin = nil
+	cfg.IMAP = nil
+	cfg.Store = nil
+	cfg.Queue = nil
+	cfg.Archive = nil
+	cfg.Tracing = nil
+	cfg.Webhooks = nil
+	cfg.Rules = nil
+	cfg.RateLimit = nil
+	cfg.Greylist = nil
+	cfg.Reputation = nil
+	cfg.DNSBL = nil
+	cfg.Helo = nil
+	cfg.RDNS = nil
+	cfg.SenderVerify = nil
+	cfg.Chaos = nil
+	cfg.Suppression = nil
+	cfg.Reports = nil
+	cfg.Forward = nil
+	cfg.Reply.Delay = 0
+	cfg.Reply.Jitter = 0
+	cfg.Reply.Digest = nil
+}
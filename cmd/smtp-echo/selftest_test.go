@@ -0,0 +1,25 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRunSelftest(t *testing.T) {
+	path := writeTestConfig(t, testConfig+"rules:\n  - match: \"echo@\"\n    action: \"drop\"\n")
+	output, err := captureStdout(t, func() error {
+		return runSelftest([]string{"-config", path, "-timeout", "10s"})
+	})
+	if err != nil {
+		t.Fatalf("runSelftest() error = %v", err)
+	}
+	want := regexp.MustCompile(`^selftest: ok, echo@example\.com echoed <smtp-echo-selftest-[0-9a-f]+@echo\.example\.com> from bounce@example\.com after \S+: Re: smtp-echo send-test\n$`)
+	if !want.MatchString(output) {
+		t.Fatalf("runSelftest() output = %q, want the captured reply", output)
+	}
+
+	invalid := writeTestConfig(t, "hostname: echo.example.com\n")
+	if err := runSelftest([]string{"-config", invalid}); err == nil {
+		t.Fatal("runSelftest() with an invalid config error = nil, want an error")
+	}
+}
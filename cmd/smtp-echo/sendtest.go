@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+)
+
+func runSendTest(args []string) error {
+	flags := flag.NewFlagSet("send-test", flag.ExitOnError)
+	server := flags.String("server", "localhost:25", "Echo server address")
+	from := flags.String("from", "", "Envelope sender; the reply is sent here")
+	to := flags.String("to", "", "Echo recipient address")
+	listen := flags.String("listen", "", "Address to receive the reply on, e.g. :25 on the sender domain's MX (empty: send only)")
+	timeout := flags.Duration("timeout", 2*time.Minute, "How long to wait for the reply")
+	startTLS := flags.Bool("starttls", false, "Use STARTTLS when sending the test message")
+	insecure := flags.Bool("insecure", false, "Skip certificate verification for STARTTLS")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" {
+		return errors.New("send-test: -from and -to are required")
+	}
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("generate message id: %w", err)
+	}
+	messageID := fmt.Sprintf("smtp-echo-test-%s@%s", hex.EncodeToString(token), domainOf(*from))
+
+	var replies chan *mail.Header
+	if *listen != "" {
+		sink, err := startReplySink(*listen)
+		if err != nil {
+			return err
+		}
+		defer sink.server.Close()
+		replies = sink.replies
+	}
+
+	started := time.Now()
+	if err := sendTestMessage(*server, *from, *to, messageID, *startTLS, *insecure); err != nil {
+		return err
+	}
+	fmt.Printf("sent test message <%s> to %s via %s\n", messageID, *to, *server)
+	if replies == nil {
+		return nil
+	}
+
+	deadline := time.After(*timeout)
+	for {
+		select {
+		case header := <-replies:
+			if !isReplyTo(header, messageID) {
+				continue
+			}
+			subject, _ := header.Subject()
+			fmt.Printf("received reply after %s: %s\n", time.Since(started).Round(time.Millisecond), subject)
+			return nil
+		case <-deadline:
+			return fmt.Errorf("send-test: no reply to <%s> within %s", messageID, *timeout)
+		}
+	}
+}
+
+func sendTestMessage(addr string, from string, to string, messageID string, startTLS bool, insecure bool) error {
+	var client *smtp.Client
+	var err error
+	if startTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		client, err = smtp.DialStartTLS(addr, &tls.Config{ServerName: host, InsecureSkipVerify: insecure})
+	} else {
+		client, err = smtp.Dial(addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	defer client.Close()
+
+	var header mail.Header
+	header.SetDate(time.Now())
+	header.SetAddressList("From", []*mail.Address{{Address: from}})
+	header.SetAddressList("To", []*mail.Address{{Address: to}})
+	header.SetSubject("smtp-echo send-test")
+	header.SetMessageID(messageID)
+
+	var message strings.Builder
+	writer, err := mail.CreateSingleInlineWriter(&message, header)
+	if err != nil {
+		return fmt.Errorf("build test message: %w", err)
+	}
+	io.WriteString(writer, "This is a test message from smtp-echo send-test.\r\n")
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("build test message: %w", err)
+	}
+
+	if err := client.SendMail(from, []string{to}, strings.NewReader(message.String())); err != nil {
+		return fmt.Errorf("send test message: %w", err)
+	}
+	return client.Quit()
+}
+
+func isReplyTo(header *mail.Header, messageID string) bool {
+	if inReplyTo, err := header.MsgIDList("In-Reply-To"); err == nil {
+		for _, id := range inReplyTo {
+			if id == messageID {
+				return true
+			}
+		}
+	}
+	references, _ := header.MsgIDList("References")
+	for _, id := range references {
+		if id == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+func domainOf(address string) string {
+	if _, domain, ok := strings.Cut(address, "@"); ok && domain != "" {
+		return domain
+	}
+	return "localhost"
+}
+
+type replySink struct {
+	server  *smtp.Server
+	replies chan *mail.Header
+}
+
+func startReplySink(addr string) (*replySink, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for reply on %s: %w", addr, err)
+	}
+	sink := &replySink{replies: make(chan *mail.Header, 16)}
+	sink.server = smtp.NewServer(sink)
+	sink.server.Domain = "smtp-echo-send-test"
+	go sink.server.Serve(listener)
+	return sink, nil
+}
+
+func (s *replySink) NewSession(*smtp.Conn) (smtp.Session, error) {
+	return &replySinkSession{sink: s}, nil
+}
+
+type replySinkSession struct {
+	sink *replySink
+}
+
+func (s *replySinkSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *replySinkSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (s *replySinkSession) Reset()                               {}
+func (s *replySinkSession) Logout() error                        { return nil }
+
+func (s *replySinkSession) Data(r io.Reader) error {
+	reader, err := mail.CreateReader(r)
+	if err != nil {
+		return fmt.Errorf("parse reply: %w", err)
+	}
+	header := reader.Header
+	io.Copy(io.Discard, r)
+	select {
+	case s.sink.replies <- &header:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/pkg/echoserver"
+)
+
+func TestRunSendTest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	sinkAddr := listener.Addr().String()
+	listener.Close()
+
+	server, err := echoserver.New(
+		echoserver.WithHostname("echo.example.com"),
+		echoserver.WithListenAddr("127.0.0.1:0"),
+		echoserver.WithReplyFrom("echo@example.com", "bounce@example.com"),
+		echoserver.WithDelivery(func(_ context.Context, from string, to string, message []byte) error {
+			client, err := smtp.Dial(sinkAddr)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			if err := client.SendMail(from, []string{to}, bytes.NewReader(message)); err != nil {
+				return err
+			}
+			return client.Quit()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("echoserver.New() error = %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Close()
+
+	output, err := captureStdout(t, func() error {
+		return runSendTest([]string{"-server", server.Addr(), "-from", "tester@example.net", "-to", "echo@example.com", "-listen", sinkAddr, "-timeout", "10s"})
+	})
+	if err != nil {
+		t.Fatalf("runSendTest() error = %v", err)
+	}
+	if !strings.Contains(output, "sent test message <smtp-echo-test-") || !strings.Contains(output, "received reply after") || !strings.Contains(output, "Re: smtp-echo send-test") {
+		t.Fatalf("runSendTest() output = %q, want the sent message and its reply", output)
+	}
+
+	if err := runSendTest([]string{"-server", server.Addr(), "-to", "echo@example.com"}); err == nil {
+		t.Fatal("runSendTest() without -from error = nil, want an error")
+	}
+}
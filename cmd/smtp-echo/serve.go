@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/admin"
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/imapserver"
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+	"github.com/danthegoodman1/smtp_echo/internal/queue"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+	"github.com/danthegoodman1/smtp_echo/internal/tracing"
+)
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	var listenFDs fdList
+	flags.Var(&listenFDs, "listen-fd", "Serve on an inherited listening socket (repeatable file descriptor number)")
+	strictDKIM := flags.Bool("strict-dkim", false, "Refuse to start when a DKIM DNS record is missing or does not match the private key")
+	skipPreflight := flags.Bool("skip-preflight", false, "Skip the hostname, PTR, SPF and DMARC DNS checks at startup")
+	dryRun := flags.Bool("dry-run", false, "Build, sign, log and store replies without sending them (same as -delivery.mode none)")
+	flags.Parse(args)
+	if *dryRun {
+		source.overrides["delivery.mode"] = config.DeliveryModeNone
+	}
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+
+	inherited, err := inheritSockets(listenFDs)
+	if err != nil {
+		return err
+	}
+	defer inherited.close()
+
+	logOutput := io.Writer(os.Stdout)
+	if cfg.Delivery.Mode == config.DeliveryModeStdout {
+		logOutput = os.Stderr
+	}
+	logger := log.New(logOutput, "", log.LstdFlags|log.LUTC)
+
+	if cfg.Tracing != nil {
+		shutdownTracing, err := tracing.Setup(context.Background(), *cfg.Tracing)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				logger.Printf("flush traces: %v", err)
+			}
+		}()
+		logger.Printf("exporting traces to %s", cfg.Tracing.Endpoint)
+	}
+
+	if err := checkDKIMRecords(cfg, logger, *strictDKIM); err != nil {
+		return err
+	}
+	switch cfg.Delivery.Mode {
+	case config.DeliveryModeNone:
+		logger.Printf("delivery.mode is %q: replies are built and stored but not sent", cfg.Delivery.Mode)
+	case config.DeliveryModeStdout:
+		logger.Printf("delivery.mode is %q: replies are written to stdout as JSON lines", cfg.Delivery.Mode)
+	case config.DeliveryModeFile:
+		logger.Printf("delivery.mode is %q: replies are written to %s", cfg.Delivery.Mode, cfg.Delivery.OutputDir)
+	}
+	if !*skipPreflight {
+		runStartupPreflight(cfg, logger)
+	}
+
+	var messageStore store.Store
+	if cfg.Store != nil {
+		messageStore, err = store.Open(*cfg.Store)
+		if err != nil {
+			return err
+		}
+		defer messageStore.Close()
+
+		if cfg.Store.Retention > 0 {
+			pruneCtx, stopPruner := context.WithCancel(context.Background())
+			defer stopPruner()
+			go store.RunPruner(pruneCtx, messageStore, cfg.Store.Retention, cfg.Store.PruneInterval, logger)
+		}
+	}
+
+	suppressions, err := suppression.Open(suppressionConfig(cfg))
+	if err != nil {
+		return err
+	}
+
+	var reportCollector *reports.Collector
+	if cfg.Reports != nil {
+		reportCollector, err = reports.Open(*cfg.Reports)
+		if err != nil {
+			return err
+		}
+	}
+
+	var reputationTracker *reputation.Tracker
+	if cfg.Reputation != nil {
+		reputationTracker, err = reputation.Open(context.Background(), *cfg.Reputation, messageStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	var archiveWriter *archive.Writer
+	if cfg.Archive != nil {
+		archiveWriter, err = archive.Open(*cfg.Archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	replier, err := echo.NewReplier(cfg, messageStore, logger)
+	if err != nil {
+		return err
+	}
+	replier.UseSuppressions(suppressions)
+	replier.UseReports(reportCollector)
+	replier.UseArchive(archiveWriter)
+	processor, err := echo.NewProcessor(cfg, replier)
+	if err != nil {
+		return err
+	}
+	backend := echo.NewBackend(cfg, processor, messageStore, logger)
+	backend.UseArchive(archiveWriter)
+	backend.UseReputation(reputationTracker)
+	if cfg.Quarantine != nil {
+		dir, err := quarantine.Open(*cfg.Quarantine)
+		if err != nil {
+			return err
+		}
+		backend.UseQuarantine(dir)
+	}
+	if cfg.Queue != nil {
+		journal, err := queue.Open(*cfg.Queue)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		backend.UseQueue(journal)
+
+		resumed, err := backend.ResumeQueue(context.Background())
+		if err != nil {
+			return fmt.Errorf("resume queue: %w", err)
+		}
+		if resumed > 0 {
+			logger.Printf("resumed %d queued replies from %s", resumed, cfg.Queue.Path)
+		}
+	}
+
+	var tlsConfig, imapTLSConfig *tls.Config
+	if cfg.TLS != nil {
+		tlsConfig, err = echo.NewTLSConfig(*cfg.TLS)
+		if err != nil {
+			return err
+		}
+		imapTLSConfig = &tls.Config{Certificates: tlsConfig.Certificates}
+	}
+
+	serverErr := make(chan error, len(cfg.Listeners)+2)
+	servers := make([]*smtp.Server, 0, len(cfg.Listeners))
+	statuses := newListenerStatuses(cfg.Listeners)
+	sockets := make([]net.Listener, len(cfg.Listeners))
+	for i, listener := range cfg.Listeners {
+		sockets[i] = inherited.take(listener.Addr)
+	}
+	var adminSocket, imapSocket net.Listener
+	if cfg.Admin != nil {
+		adminSocket = inherited.take(cfg.Admin.ListenAddr)
+	}
+	if cfg.IMAP != nil {
+		imapSocket = inherited.take(cfg.IMAP.ListenAddr)
+	}
+	if err := inherited.unused(); err != nil {
+		return err
+	}
+
+	var bound []net.Listener
+	for i, listener := range cfg.Listeners {
+		server := echo.NewSMTPServer(cfg, listener, backend, tlsConfig, logger)
+		servers = append(servers, server)
+
+		wasInherited := sockets[i] != nil
+		socket, err := bind(listener.Addr, sockets[i])
+		if err != nil {
+			return err
+		}
+		bound = append(bound, socket)
+		netListener, err := echo.WrapListener(listener, socket, tlsConfig, server)
+		if err != nil {
+			return err
+		}
+
+		logger.Printf("starting smtp echo server on %s (tls=%s proxy_protocol=%t xclient=%t inherited=%t)", listener.Addr, listener.TLSMode, listener.ProxyProtocol, listener.XClient, wasInherited)
+		statuses.set(i, true, nil)
+		go func(i int, listener config.ListenerConfig) {
+			err := server.Serve(netListener)
+			statuses.set(i, false, err)
+			serverErr <- fmt.Errorf("smtp server on %s: %w", listener.Addr, err)
+		}(i, listener)
+	}
+
+	var adminServer *admin.Server
+	if cfg.Admin != nil {
+		reload := func() error {
+			reloaded, err := source.load()
+			if err != nil {
+				return err
+			}
+			reloadedReplier, err := echo.NewReplier(reloaded, messageStore, logger)
+			if err != nil {
+				return err
+			}
+			if err := suppressions.Configure(suppressionConfig(reloaded)); err != nil {
+				return err
+			}
+			reloadedReplier.UseSuppressions(suppressions)
+			if reportCollector != nil && reloaded.Reports != nil {
+				reportCollector.Configure(*reloaded.Reports)
+			}
+			reloadedReplier.UseReports(reportCollector)
+			if reputationTracker != nil && reloaded.Reputation != nil {
+				reputationTracker.Configure(*reloaded.Reputation)
+			}
+			reloadedReplier.UseArchive(archiveWriter)
+			reloadedProcessor, err := echo.NewProcessor(reloaded, reloadedReplier)
+			if err != nil {
+				return err
+			}
+			backend.Reload(reloaded, reloadedProcessor)
+			return nil
+		}
+
+		health := func() admin.Health {
+			return healthReport(backend.Health(), statuses.snapshot())
+		}
+
+		var keyring admin.DKIMKeyring
+		if cfg.DKIM != nil {
+			keyring = &dkimKeyring{source: source, reload: reload}
+		}
+
+		adminSocket, err = bind(cfg.Admin.ListenAddr, adminSocket)
+		if err != nil {
+			return err
+		}
+		bound = append(bound, adminSocket)
+
+		adminServer = admin.NewServer(*cfg.Admin, backend.Activity(), reload, health, logger)
+		adminServer.UseSuppressions(suppressions)
+		adminServer.UseStore(messageStore)
+		adminServer.UseReports(reportCollector)
+		adminServer.UseDKIM(keyring)
+		adminServer.UseReputation(reputationTracker)
+		logger.Printf("starting admin http server on %s", cfg.Admin.ListenAddr)
+		go func() {
+			if err := adminServer.Serve(adminSocket); err != nil {
+				serverErr <- fmt.Errorf("admin http server: %w", err)
+			}
+		}()
+	}
+
+	var imapServer *imapserver.Server
+	if cfg.IMAP != nil {
+		imapSocket, err = bind(cfg.IMAP.ListenAddr, imapSocket)
+		if err != nil {
+			return err
+		}
+		bound = append(bound, imapSocket)
+
+		imapServer = imapserver.NewServer(*cfg.IMAP, messageStore, imapTLSConfig, logger)
+		logger.Printf("starting imap server on %s", cfg.IMAP.ListenAddr)
+		go func() {
+			if err := imapServer.Serve(imapSocket); err != nil {
+				serverErr <- fmt.Errorf("imap server: %w", err)
+			}
+		}()
+	}
+
+	var socketServer *echo.SocketServer
+	if cfg.Ingest != nil {
+		socket, err := echo.ListenSocket(*cfg.Ingest)
+		if err != nil {
+			return err
+		}
+		socketServer = echo.NewSocketServer(cfg, backend)
+		logger.Printf("starting ingest socket on %s", cfg.Ingest.Socket)
+		go func() {
+			if err := socketServer.Serve(socket); err != nil {
+				serverErr <- fmt.Errorf("ingest socket: %w", err)
+			}
+		}()
+	}
+
+	shutdownSignal, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	upgrade := make(chan os.Signal, 1)
+	if upgradeSignal != nil {
+		signal.Notify(upgrade, upgradeSignal)
+		defer signal.Stop(upgrade)
+	}
+	notifyReady()
+
+wait:
+	for {
+		select {
+		case err := <-serverErr:
+			if errors.Is(err, smtp.ErrServerClosed) {
+				return nil
+			}
+			return err
+		case <-shutdownSignal.Done():
+			logger.Printf("shutdown signal received, draining for up to %s", cfg.ShutdownTimeout)
+			break wait
+		case <-upgrade:
+			logger.Printf("upgrade signal received, starting new process")
+			pid, err := startUpgrade(args, bound)
+			if err != nil {
+				logger.Printf("upgrade failed, still serving: %v", err)
+				continue
+			}
+			logger.Printf("upgrade: new process pid=%d is serving, draining for up to %s", pid, cfg.ShutdownTimeout)
+			break wait
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	statuses.drain()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *smtp.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+				logger.Printf("shutdown smtp server %s: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+	if socketServer != nil {
+		if err := socketServer.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("shutdown ingest socket: %v", err)
+		}
+	}
+
+	abandoned, err := backend.Drain(shutdownCtx)
+	if err != nil {
+		logger.Printf("drain: %v", err)
+	}
+	logger.Printf("drain finished abandoned=%d", abandoned)
+
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("shutdown admin http server: %v", err)
+		}
+	}
+	if imapServer != nil {
+		if err := imapServer.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("shutdown imap server: %v", err)
+		}
+	}
+
+	return nil
+}
+
+type listenerStatuses struct {
+	mu       sync.Mutex
+	statuses []admin.ListenerStatus
+}
+
+func newListenerStatuses(listeners []config.ListenerConfig) *listenerStatuses {
+	statuses := make([]admin.ListenerStatus, len(listeners))
+	for i, listener := range listeners {
+		statuses[i] = admin.ListenerStatus{Addr: listener.Addr, TLSMode: listener.TLSMode}
+	}
+	return &listenerStatuses{statuses: statuses}
+}
+
+func (l *listenerStatuses) set(i int, serving bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.statuses[i].Serving = serving
+	if serving {
+		l.statuses[i].Error = ""
+	} else if err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+		l.statuses[i].Error = err.Error()
+	}
+}
+
+func (l *listenerStatuses) drain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.statuses {
+		l.statuses[i].Serving = false
+		l.statuses[i].Error = "draining"
+	}
+}
+
+func (l *listenerStatuses) snapshot() []admin.ListenerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]admin.ListenerStatus(nil), l.statuses...)
+}
+
+func suppressionConfig(cfg config.Config) config.SuppressionConfig {
+	if cfg.Suppression == nil {
+		return config.SuppressionConfig{}
+	}
+	return *cfg.Suppression
+}
+
+func healthReport(health echo.Health, listeners []admin.ListenerStatus) admin.Health {
+	report := admin.Health{
+		Listeners:            listeners,
+		QueueBacklog:         health.QueueBacklog,
+		InFlight:             health.InFlight,
+		DeliveriesWaiting:    health.DeliveriesWaiting,
+		MaxBacklog:           health.MaxBacklog,
+		BacklogRejected:      health.BacklogRejected,
+		DuplicatesSuppressed: health.DuplicatesSuppressed,
+		Timeouts:             health.Timeouts,
+		DKIM:                 admin.DKIMStatus{Status: "disabled"},
+	}
+	if health.DKIM.Enabled {
+		report.DKIM = admin.DKIMStatus{Status: "loaded", Domain: health.DKIM.Domain, Selector: health.DKIM.Selector}
+	}
+	if !health.LastDelivery.IsZero() {
+		report.LastDelivery = &health.LastDelivery
+	}
+	if health.DNSCache != nil {
+		report.DNSCache = &admin.DNSCacheStatus{Hits: health.DNSCache.Hits, Misses: health.DNSCache.Misses, Entries: health.DNSCache.Entries}
+	}
+	return report
+}
+
+func bind(addr string, inherited net.Listener) (net.Listener, error) {
+	if inherited != nil {
+		return inherited, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	readyFDEnv     = "SMTP_ECHO_READY_FD"
+	upgradeTimeout = 30 * time.Second
+)
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+func startUpgrade(args []string, sockets []net.Listener) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("find executable: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(sockets)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	fds := make([]string, 0, len(sockets))
+	for _, socket := range sockets {
+		listener, ok := socket.(fileListener)
+		if !ok {
+			return 0, fmt.Errorf("listener %s cannot be passed to a new process", socket.Addr())
+		}
+		file, err := listener.File()
+		if err != nil {
+			return 0, fmt.Errorf("dup listener %s: %w", socket.Addr(), err)
+		}
+		files = append(files, file)
+		fds = append(fds, strconv.Itoa(systemdFirstFD+len(files)-1))
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("create ready pipe: %w", err)
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	childArgs := withoutListenFDs(args)
+	if len(fds) > 0 {
+		childArgs = append(childArgs, "-listen-fd", strings.Join(fds, ","))
+	}
+	cmd := exec.Command(executable, append([]string{"serve"}, childArgs...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), readyFDEnv+"="+strconv.Itoa(systemdFirstFD+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start new process: %w", err)
+	}
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	signaled := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(ready, buf); err != nil {
+			signaled <- errors.New("new process exited before it was ready")
+			return
+		}
+		signaled <- nil
+	}()
+
+	select {
+	case err := <-signaled:
+		if err != nil {
+			return 0, err
+		}
+		return cmd.Process.Pid, nil
+	case err := <-exited:
+		return 0, fmt.Errorf("new process exited: %v", err)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process not ready after %s", upgradeTimeout)
+	}
+}
+
+func withoutListenFDs(args []string) []string {
+	filtered := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") {
+			filtered = append(filtered, args[i])
+			continue
+		}
+		if name == "listen-fd" {
+			i++
+			continue
+		}
+		if strings.HasPrefix(name, "listen-fd=") {
+			continue
+		}
+		filtered = append(filtered, args[i])
+	}
+	return filtered
+}
+
+func notifyReady() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	if file == nil {
+		return
+	}
+	file.Write([]byte{1})
+	file.Close()
+}
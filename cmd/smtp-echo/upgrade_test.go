@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const upgradeChildEnv = "SMTP_ECHO_TEST_UPGRADE_CHILD"
+
+type upgradeChildReport struct {
+	Args  []string `json:"args"`
+	Addrs []string `json:"addrs"`
+}
+
+func TestMain(m *testing.M) {
+	if report := os.Getenv(upgradeChildEnv); report != "" {
+		os.Exit(runUpgradeChild(report))
+	}
+	os.Exit(m.Run())
+}
+
+func runUpgradeChild(report string) int {
+	if report == "exit" {
+		return 3
+	}
+	result := upgradeChildReport{Args: os.Args[1:]}
+	for i, arg := range os.Args {
+		if arg != "-listen-fd" || i+1 == len(os.Args) {
+			continue
+		}
+		for _, field := range strings.Split(os.Args[i+1], ",") {
+			fd, err := strconv.Atoi(field)
+			if err != nil {
+				return 2
+			}
+			listener, err := net.FileListener(os.NewFile(uintptr(fd), "listen-fd"))
+			if err != nil {
+				return 2
+			}
+			result.Addrs = append(result.Addrs, listener.Addr().String())
+		}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return 2
+	}
+	if err := os.WriteFile(report, data, 0o600); err != nil {
+		return 2
+	}
+	notifyReady()
+	time.Sleep(time.Minute)
+	return 0
+}
+
+func TestWithoutListenFDs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "none", args: []string{"-config", "config.yaml"}, want: []string{"-config", "config.yaml"}},
+		{name: "separate value", args: []string{"-listen-fd", "3,4", "-config", "config.yaml"}, want: []string{"-config", "config.yaml"}},
+		{name: "inline value", args: []string{"-config", "config.yaml", "-listen-fd=3"}, want: []string{"-config", "config.yaml"}},
+		{name: "double dash", args: []string{"--listen-fd", "3", "--listen-fd=4", "-hostname=echo.example.com"}, want: []string{"-hostname=echo.example.com"}},
+		{name: "positional value kept", args: []string{"-config", "listen-fd"}, want: []string{"-config", "listen-fd"}},
+		{name: "other flag with prefix", args: []string{"-listen-fds=3"}, want: []string{"-listen-fds=3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withoutListenFDs(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("withoutListenFDs(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartUpgrade(t *testing.T) {
+	sockets := make([]net.Listener, 2)
+	addrs := make([]string, len(sockets))
+	for i := range sockets {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		defer listener.Close()
+		sockets[i] = listener
+		addrs[i] = listener.Addr().String()
+	}
+	report := filepath.Join(t.TempDir(), "report.json")
+	t.Setenv(upgradeChildEnv, report)
+
+	pid, err := startUpgrade([]string{"-config", "config.yaml", "-listen-fd", "9"}, sockets)
+	if err != nil {
+		t.Fatalf("startUpgrade() error = %v", err)
+	}
+	if pid <= 0 || pid == os.Getpid() {
+		t.Fatalf("startUpgrade() pid = %d, want the new process", pid)
+	}
+	if process, err := os.FindProcess(pid); err == nil {
+		defer process.Kill()
+	}
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var got upgradeChildReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode child report: %v", err)
+	}
+	wantArgs := []string{"serve", "-config", "config.yaml", "-listen-fd", "3,4"}
+	if !reflect.DeepEqual(got.Args, wantArgs) {
+		t.Fatalf("child args = %q, want %q", got.Args, wantArgs)
+	}
+	if !reflect.DeepEqual(got.Addrs, addrs) {
+		t.Fatalf("child listeners = %q, want %q", got.Addrs, addrs)
+	}
+}
+
+func TestStartUpgrade_ExitBeforeReady(t *testing.T) {
+	t.Setenv(upgradeChildEnv, "exit")
+	if _, err := startUpgrade(nil, nil); err == nil {
+		t.Fatal("startUpgrade() error = nil, want the child's early exit")
+	}
+}
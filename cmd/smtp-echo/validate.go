@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+func runValidateConfig(args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	source := addConfigFlags(flags)
+	flags.Parse(args)
+
+	cfg, err := source.load()
+	if err != nil {
+		return err
+	}
+	if cfg.TLS != nil {
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return fmt.Errorf("load tls certificate: %w", err)
+		}
+	}
+	if _, err := echo.NewReplier(cfg, nil, nil); err != nil {
+		return err
+	}
+	if _, err := suppression.Open(suppressionConfig(cfg)); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: ok\n", source.describe())
+	for _, listener := range cfg.Listeners {
+		fmt.Printf("  listener %s tls=%s proxy_protocol=%t\n", listener.Addr, listener.TLSMode, listener.ProxyProtocol)
+	}
+	fmt.Printf("  reply mode=%s from=%s\n", cfg.Reply.Mode, cfg.Reply.FromAddress)
+	if cfg.DKIM != nil {
+		keys, err := dkimkeys.Load(cfg.DKIM)
+		if err != nil {
+			return err
+		}
+		active, _ := dkimkeys.Active(keys, time.Now())
+		fmt.Printf("  dkim domain=%s selector=%s keys=%d\n", cfg.DKIM.Domain, active.Selector, len(keys))
+	}
+	return nil
+}
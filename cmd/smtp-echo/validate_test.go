@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = "hostname: echo.example.com\nreply:\n  from_address: echo@example.com\n  mail_from: bounce@example.com\n"
+
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe() error = %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, reader)
+		output <- buf.String()
+	}()
+	err = run()
+	os.Stdout = stdout
+	writer.Close()
+	return <-output, err
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestRunValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		output string
+		err    string
+	}{
+		{
+			name:   "valid",
+			config: testConfig,
+			output: "reply mode=echo from=echo@example.com",
+		},
+		{
+			name:   "invalid setting",
+			config: "hostname: echo.example.com\nreply:\n  from_address: echo@example.com\n",
+			err:    "mail_from",
+		},
+		{
+			name:   "missing certificate",
+			config: testConfig + "tls:\n  cert_file: /nonexistent/cert.pem\n  key_file: /nonexistent/key.pem\n",
+			err:    "load tls certificate",
+		},
+		{
+			name:   "malformed yaml",
+			config: "hostname: [echo.example.com\n",
+			err:    "config",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.config)
+			output, err := captureStdout(t, func() error {
+				return runValidateConfig([]string{"-config", path})
+			})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("runValidateConfig() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runValidateConfig() error = %v", err)
+			}
+			if !strings.HasPrefix(output, path+": ok\n") || !strings.Contains(output, tt.output) {
+				t.Fatalf("runValidateConfig() output = %q, want ok and %q", output, tt.output)
+			}
+		})
+	}
+}
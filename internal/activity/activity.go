@@ -0,0 +1,90 @@
+package activity
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusEchoed         = "echoed"
+	StatusFailed         = "failed"
+	StatusRateLimited    = "rate_limited"
+	StatusBacklogged     = "backlogged"
+	StatusTooLarge       = "too_large"
+	StatusPoorReputation = "poor_reputation"
+)
+
+type Entry struct {
+	Time         time.Time `json:"time"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	EnvelopeFrom string    `json:"envelope_from"`
+	Recipients   []string  `json:"recipients,omitempty"`
+	Bytes        int       `json:"bytes"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type Log struct {
+	mu       sync.Mutex
+	entries  []Entry
+	next     int
+	full     bool
+	inFlight atomic.Int64
+}
+
+func NewLog(size int) *Log {
+	if size <= 0 {
+		size = 1
+	}
+	return &Log{entries: make([]Entry, size)}
+}
+
+func (l *Log) Record(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func (l *Log) Recent(limit int, status string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+
+	result := make([]Entry, 0, count)
+	for i := 0; i < count; i++ {
+		entry := l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if status != "" && entry.Status != status {
+			continue
+		}
+		result = append(result, entry)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
+
+func (l *Log) Begin() func() {
+	l.inFlight.Add(1)
+	return func() {
+		l.inFlight.Add(-1)
+	}
+}
+
+func (l *Log) InFlight() int64 {
+	return l.inFlight.Load()
+}
@@ -0,0 +1,375 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+type Server struct {
+	httpServer   *http.Server
+	token        string
+	activity     *activity.Log
+	reload       func() error
+	health       func() Health
+	suppressions *suppression.List
+	messages     store.Store
+	reports      *reports.Collector
+	keyring      DKIMKeyring
+	reputation   *reputation.Tracker
+	logger       *log.Logger
+}
+
+type DKIMKeyring interface {
+	Keys() ([]DKIMKey, error)
+	Rotate() (DKIMKey, error)
+	Check(ctx context.Context) ([]DKIMCheck, error)
+}
+
+type DKIMKey struct {
+	Selector    string     `json:"selector"`
+	Status      string     `json:"status"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	RecordName  string     `json:"record_name"`
+	RecordValue string     `json:"record_value"`
+}
+
+type DKIMCheck struct {
+	Selector   string `json:"selector"`
+	KeyStatus  string `json:"key_status"`
+	RecordName string `json:"record_name"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+type Health struct {
+	Listeners            []ListenerStatus `json:"listeners"`
+	QueueBacklog         int              `json:"queue_backlog"`
+	InFlight             int64            `json:"in_flight"`
+	DeliveriesWaiting    int              `json:"deliveries_waiting"`
+	MaxBacklog           int              `json:"max_backlog"`
+	BacklogRejected      int64            `json:"backlog_rejected"`
+	DuplicatesSuppressed int64            `json:"duplicates_suppressed"`
+	Timeouts             map[string]int64 `json:"timeouts"`
+	DKIM                 DKIMStatus       `json:"dkim"`
+	LastDelivery         *time.Time       `json:"last_successful_delivery"`
+	DNSCache             *DNSCacheStatus  `json:"dns_cache,omitempty"`
+}
+
+type DNSCacheStatus struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+type ListenerStatus struct {
+	Addr    string `json:"addr"`
+	TLSMode string `json:"tls_mode"`
+	Serving bool   `json:"serving"`
+	Error   string `json:"error,omitempty"`
+}
+
+type DKIMStatus struct {
+	Status   string `json:"status"`
+	Domain   string `json:"domain,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+func (h Health) ready() bool {
+	if len(h.Listeners) == 0 {
+		return false
+	}
+	for _, listener := range h.Listeners {
+		if !listener.Serving {
+			return false
+		}
+	}
+	return true
+}
+
+func NewServer(cfg config.AdminConfig, activityLog *activity.Log, reload func() error, health func() Health, logger *log.Logger) *Server {
+	s := &Server{
+		token:    cfg.Token,
+		activity: activityLog,
+		reload:   reload,
+		health:   health,
+		logger:   logger,
+	}
+	s.httpServer = &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+func (s *Server) UseSuppressions(list *suppression.List) {
+	s.suppressions = list
+}
+
+func (s *Server) UseStore(messages store.Store) {
+	s.messages = messages
+}
+
+func (s *Server) UseReports(collector *reports.Collector) {
+	s.reports = collector
+}
+
+func (s *Server) UseDKIM(keyring DKIMKeyring) {
+	s.keyring = keyring
+}
+
+func (s *Server) UseReputation(tracker *reputation.Tracker) {
+	s.reputation = tracker
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /activity", s.handleActivity)
+	mux.HandleFunc("GET /failures", s.handleFailures)
+	mux.HandleFunc("GET /queue", s.handleQueue)
+	mux.HandleFunc("GET /health", s.handleHealth)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /suppressions", s.handleListSuppressions)
+	mux.HandleFunc("POST /suppressions", s.handleAddSuppression)
+	mux.HandleFunc("DELETE /suppressions", s.handleRemoveSuppression)
+	mux.HandleFunc("GET /reputation", s.handleListReputation)
+	mux.HandleFunc("DELETE /reputation", s.handleUnblockReputation)
+	mux.HandleFunc("GET /messages", s.handleListMessages)
+	mux.HandleFunc("GET /messages/{id}", s.handleGetMessage)
+	mux.HandleFunc("GET /messages/{id}/raw", s.handleGetRawMessage)
+	mux.HandleFunc("DELETE /messages/{id}", s.handleDeleteMessage)
+	mux.HandleFunc("GET /reports", s.handleListReports)
+	mux.HandleFunc("GET /reports/{id}", s.handleGetReport)
+	mux.HandleFunc("GET /dkim/keys", s.handleListDKIMKeys)
+	mux.HandleFunc("POST /dkim/rotate", s.handleRotateDKIM)
+	mux.HandleFunc("GET /dkim/check", s.handleCheckDKIM)
+
+	probes := http.NewServeMux()
+	probes.HandleFunc("GET /healthz", s.handleHealthz)
+	probes.HandleFunc("GET /readyz", s.handleReadyz)
+	probes.Handle("/", s.requireToken(mux))
+	return probes
+}
+
+func (s *Server) ListenAndServe() error {
+	err := s.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	err := s.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="smtp-echo"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": s.activity.Recent(queryLimit(r), r.URL.Query().Get("status")),
+	})
+}
+
+func (s *Server) handleFailures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": s.activity.Recent(queryLimit(r), activity.StatusFailed),
+	})
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, _ *http.Request) {
+	health := s.health()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"in_flight":          s.activity.InFlight(),
+		"queue_backlog":      health.QueueBacklog,
+		"deliveries_waiting": health.DeliveriesWaiting,
+		"backlog":            health.QueueBacklog + health.DeliveriesWaiting,
+		"max_backlog":        health.MaxBacklog,
+		"backlog_rejected":   health.BacklogRejected,
+	})
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	health := s.health()
+	response := probeResponse{Status: "ready", Listeners: make([]probeListener, 0, len(health.Listeners))}
+	for _, listener := range health.Listeners {
+		response.Listeners = append(response.Listeners, probeListener{Serving: listener.Serving})
+	}
+	if !health.ready() {
+		response.Status = "not_ready"
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	health := s.health()
+	status := "ready"
+	if !health.ready() {
+		status = "not_ready"
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: status, Health: health})
+}
+
+type probeResponse struct {
+	Status    string          `json:"status"`
+	Listeners []probeListener `json:"listeners,omitempty"`
+}
+
+type probeListener struct {
+	Serving bool `json:"serving"`
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Health
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, _ *http.Request) {
+	if err := s.reload(); err != nil {
+		if s.logger != nil {
+			s.logger.Printf("admin config reload failed: %v", err)
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if s.logger != nil {
+		s.logger.Println("admin config reload succeeded")
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (s *Server) handleListDKIMKeys(w http.ResponseWriter, _ *http.Request) {
+	if s.keyring == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "dkim is not configured"})
+		return
+	}
+	keys, err := s.keyring.Keys()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (s *Server) handleRotateDKIM(w http.ResponseWriter, _ *http.Request) {
+	if s.keyring == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "dkim is not configured"})
+		return
+	}
+	key, err := s.keyring.Rotate()
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Printf("admin dkim rotation failed: %v", err)
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if s.logger != nil {
+		s.logger.Printf("admin dkim rotation created selector=%q", key.Selector)
+	}
+	writeJSON(w, http.StatusCreated, key)
+}
+
+func (s *Server) handleCheckDKIM(w http.ResponseWriter, r *http.Request) {
+	if s.keyring == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "dkim is not configured"})
+		return
+	}
+	checks, err := s.keyring.Check(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"checks": checks})
+}
+
+func (s *Server) handleListSuppressions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": s.suppressions.Entries(),
+	})
+}
+
+func (s *Server) handleAddSuppression(w http.ResponseWriter, r *http.Request) {
+	var entry suppression.Entry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json body"})
+		return
+	}
+	entry.Source = suppression.SourceAdmin
+	entry.CreatedAt = time.Time{}
+	added, err := s.suppressions.Add(entry)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, added)
+}
+
+func (s *Server) handleRemoveSuppression(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	err := s.suppressions.Remove(query.Get("type"), query.Get("value"))
+	switch {
+	case errors.Is(err, suppression.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, suppression.ErrConfigEntry):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+	}
+}
+
+func queryLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return 50
+	}
+	return limit
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,423 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+func TestHandler_RequiresBearerToken(t *testing.T) {
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/queue", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q status = %d, want %d", header, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestHandler_ActivityFailuresAndReload(t *testing.T) {
+	activityLog := activity.NewLog(4)
+	activityLog.Record(activity.Entry{EnvelopeFrom: "ok@example.net", Status: activity.StatusEchoed})
+	activityLog.Record(activity.Entry{EnvelopeFrom: "bad@example.net", Status: activity.StatusFailed, Error: "delivery failed"})
+
+	reloadErr := errors.New("parse config yaml: boom")
+	server := NewServer(config.AdminConfig{Token: "secret"}, activityLog, func() error { return reloadErr }, func() Health { return Health{} }, nil)
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	var activityResp struct {
+		Entries []activity.Entry `json:"entries"`
+	}
+	rec := do(http.MethodGet, "/activity")
+	if err := json.Unmarshal(rec.Body.Bytes(), &activityResp); err != nil {
+		t.Fatalf("decode /activity: %v", err)
+	}
+	if len(activityResp.Entries) != 2 || activityResp.Entries[0].EnvelopeFrom != "bad@example.net" {
+		t.Fatalf("/activity entries = %#v, want newest first", activityResp.Entries)
+	}
+
+	rec = do(http.MethodGet, "/failures")
+	if err := json.Unmarshal(rec.Body.Bytes(), &activityResp); err != nil {
+		t.Fatalf("decode /failures: %v", err)
+	}
+	if len(activityResp.Entries) != 1 || activityResp.Entries[0].Error != "delivery failed" {
+		t.Fatalf("/failures entries = %#v, want only the failed entry", activityResp.Entries)
+	}
+
+	rec = do(http.MethodPost, "/reload")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("/reload status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	rec = do(http.MethodGet, "/reload")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /reload status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandler_HealthAndReadiness(t *testing.T) {
+	health := Health{
+		Listeners:    []ListenerStatus{{Addr: ":25", TLSMode: "starttls", Serving: true}},
+		QueueBacklog: 2,
+		DKIM:         DKIMStatus{Status: "loaded", Domain: "example.com", Selector: "s1"},
+	}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return health }, nil)
+
+	get := func(path string, token string) (int, map[string]any) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode %s: %v", path, err)
+		}
+		return rec.Code, body
+	}
+
+	code, body := get("/readyz", "")
+	if code != http.StatusOK || body["status"] != "ready" {
+		t.Fatalf("/readyz = %d %v, want ready without a token", code, body)
+	}
+	if _, ok := body["queue_backlog"]; ok {
+		t.Fatalf("/readyz = %v, want only the status and listener states", body)
+	}
+	listeners, _ := body["listeners"].([]any)
+	if len(listeners) != 1 || listeners[0].(map[string]any)["serving"] != true || listeners[0].(map[string]any)["addr"] != nil {
+		t.Fatalf("/readyz listeners = %v, want one serving listener without its address", body["listeners"])
+	}
+
+	code, body = get("/health", "")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("/health without a token = %d %v, want 401", code, body)
+	}
+	code, body = get("/health", "secret")
+	if code != http.StatusOK || body["status"] != "ready" || body["queue_backlog"] != float64(2) {
+		t.Fatalf("/health = %d %v, want the full report", code, body)
+	}
+
+	health.Listeners[0].Serving = false
+	health.Listeners[0].Error = "listener closed"
+	code, body = get("/readyz", "")
+	if code != http.StatusServiceUnavailable || body["status"] != "not_ready" {
+		t.Fatalf("/readyz with stopped listener = %d %v, want 503", code, body)
+	}
+
+	code, body = get("/healthz", "")
+	if code != http.StatusOK || len(body) != 1 || body["status"] != "ok" {
+		t.Fatalf("/healthz = %d %v, want only the status", code, body)
+	}
+}
+
+func TestHandler_Suppressions(t *testing.T) {
+	list, err := suppression.Open(config.SuppressionConfig{Domains: []string{"blocked.example"}})
+	if err != nil {
+		t.Fatalf("suppression.Open() error = %v", err)
+	}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	server.UseSuppressions(list)
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/suppressions", `{"type":"address","value":"user@example.net","reason":"asked"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /suppressions status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/suppressions", `{"type":"regex","value":"("}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST /suppressions invalid regex status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	var listResp struct {
+		Entries []suppression.Entry `json:"entries"`
+	}
+	rec := do(http.MethodGet, "/suppressions", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("decode /suppressions: %v", err)
+	}
+	if len(listResp.Entries) != 2 {
+		t.Fatalf("/suppressions entries = %#v, want config and admin entries", listResp.Entries)
+	}
+
+	if rec := do(http.MethodDelete, "/suppressions?type=domain&value=blocked.example", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("DELETE config entry status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec := do(http.MethodDelete, "/suppressions?type=address&value=user@example.net", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE admin entry status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := do(http.MethodDelete, "/suppressions?type=address&value=user@example.net", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("DELETE missing entry status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandler_Messages(t *testing.T) {
+	messages := store.NewMemory()
+	raw := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: Hello\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi there\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=doc.pdf\r\n\r\nPDF\r\n" +
+		"--b--\r\n"
+	id, err := messages.SaveMessage(context.Background(), store.Message{
+		ReceivedAt:   time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Subject:      "Hello",
+		Size:         len(raw),
+		Raw:          []byte(raw),
+	})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	server.UseStore(messages)
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	var listResp struct {
+		Messages []store.Message `json:"messages"`
+	}
+	rec := do(http.MethodGet, "/messages?from=sender&since=2024-03-01T00:00:00Z")
+	if err := json.Unmarshal(rec.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("decode /messages: %v", err)
+	}
+	if len(listResp.Messages) != 1 || listResp.Messages[0].ID != id {
+		t.Fatalf("/messages = %#v, want the stored message", listResp.Messages)
+	}
+	if rec := do(http.MethodGet, "/messages?until=2024-03-01T00:00:00Z"); !strings.Contains(rec.Body.String(), `"messages":[]`) {
+		t.Fatalf("/messages?until body = %s, want empty list", rec.Body)
+	}
+	if rec := do(http.MethodGet, "/messages?since=yesterday"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("/messages invalid since status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	var parsed parsedMessage
+	rec = do(http.MethodGet, "/messages/1")
+	if err := json.Unmarshal(rec.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("decode /messages/1: %v", err)
+	}
+	if parsed.Text != "hi there" || len(parsed.Attachments) != 1 || parsed.Attachments[0].Filename != "doc.pdf" || len(parsed.Headers) != 5 {
+		t.Fatalf("/messages/1 = %#v, want parsed text, headers and attachment", parsed)
+	}
+
+	rec = do(http.MethodGet, "/messages/1/raw")
+	if rec.Body.String() != raw || rec.Header().Get("Content-Type") != "message/rfc822" {
+		t.Fatalf("/messages/1/raw = %q (%s), want raw message", rec.Body, rec.Header().Get("Content-Type"))
+	}
+
+	if rec := do(http.MethodDelete, "/messages/1"); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /messages/1 status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := do(http.MethodGet, "/messages/1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET deleted message status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+type fakeKeyring struct {
+	keys []DKIMKey
+}
+
+func (k *fakeKeyring) Keys() ([]DKIMKey, error) {
+	return k.keys, nil
+}
+
+func (k *fakeKeyring) Rotate() (DKIMKey, error) {
+	key := DKIMKey{Selector: "s2", Status: "pending", RecordName: "s2._domainkey.example.com", RecordValue: "v=DKIM1; k=rsa; p=AAAA"}
+	k.keys = append(k.keys, key)
+	return key, nil
+}
+
+func (k *fakeKeyring) Check(context.Context) ([]DKIMCheck, error) {
+	checks := make([]DKIMCheck, 0, len(k.keys))
+	for _, key := range k.keys {
+		checks = append(checks, DKIMCheck{Selector: key.Selector, KeyStatus: key.Status, RecordName: key.RecordName, Status: "mismatch", Detail: "published key does not match the private key"})
+	}
+	return checks, nil
+}
+
+func TestHandler_DKIMKeys(t *testing.T) {
+	keyring := &fakeKeyring{keys: []DKIMKey{{Selector: "s1", Status: "active", RecordName: "s1._domainkey.example.com"}}}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	server.UseDKIM(keyring)
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/dkim/rotate")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("/dkim/rotate status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var rotated DKIMKey
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); err != nil {
+		t.Fatalf("decode /dkim/rotate: %v", err)
+	}
+	if rotated.Selector != "s2" || rotated.RecordValue == "" {
+		t.Fatalf("/dkim/rotate = %#v, want the new key and its record", rotated)
+	}
+
+	var listResp struct {
+		Keys []DKIMKey `json:"keys"`
+	}
+	rec = do(http.MethodGet, "/dkim/keys")
+	if err := json.Unmarshal(rec.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("decode /dkim/keys: %v", err)
+	}
+	if len(listResp.Keys) != 2 || listResp.Keys[0].Status != "active" || listResp.Keys[1].Status != "pending" {
+		t.Fatalf("/dkim/keys = %#v, want active and pending keys", listResp.Keys)
+	}
+
+	var checkResp struct {
+		Checks []DKIMCheck `json:"checks"`
+	}
+	rec = do(http.MethodGet, "/dkim/check")
+	if err := json.Unmarshal(rec.Body.Bytes(), &checkResp); err != nil {
+		t.Fatalf("decode /dkim/check: %v", err)
+	}
+	if rec.Code != http.StatusOK || len(checkResp.Checks) != 2 || checkResp.Checks[0].Status != "mismatch" || checkResp.Checks[0].KeyStatus != "active" {
+		t.Fatalf("/dkim/check = %d %#v, want a check per key", rec.Code, checkResp.Checks)
+	}
+
+	disabled := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	req := httptest.NewRequest(http.MethodGet, "/dkim/keys", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	disabled.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("/dkim/keys without dkim status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandler_Reports(t *testing.T) {
+	collector, err := reports.Open(config.ReportsConfig{})
+	if err != nil {
+		t.Fatalf("reports.Open() error = %v", err)
+	}
+	for _, report := range []reports.Report{
+		{Kind: reports.KindDMARC, Domain: "example.com", Total: 7, Failed: 2},
+		{Kind: reports.KindTLSRPT, Domain: "example.com", Total: 10},
+	} {
+		if _, err := collector.Add(report); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	server.UseReports(collector)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	var listResp struct {
+		Reports []reports.Report `json:"reports"`
+	}
+	rec := do("/reports?kind=dmarc")
+	if err := json.Unmarshal(rec.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("decode /reports: %v", err)
+	}
+	if len(listResp.Reports) != 1 || listResp.Reports[0].ID != 1 || listResp.Reports[0].Failed != 2 {
+		t.Fatalf("/reports?kind=dmarc = %#v, want the dmarc report", listResp.Reports)
+	}
+	var report reports.Report
+	rec = do("/reports/2")
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode /reports/2: %v", err)
+	}
+	if report.Kind != reports.KindTLSRPT || report.Total != 10 {
+		t.Fatalf("/reports/2 = %#v, want the tls report", report)
+	}
+	if rec := do("/reports/9"); rec.Code != http.StatusNotFound {
+		t.Fatalf("/reports/9 status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandler_Reputation(t *testing.T) {
+	ctx := context.Background()
+	tracker, err := reputation.Open(ctx, config.ReputationConfig{Window: time.Hour, MinEvents: 2, TempfailScore: 50, BlockScore: 20, BlockDuration: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("reputation.Open() error = %v", err)
+	}
+	for _, event := range []reputation.Event{reputation.EventAuthFailure, reputation.EventAuthFailure} {
+		if _, _, err := tracker.Record(ctx, reputation.TypeIP, "192.0.2.1", event); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	if _, _, err := tracker.Record(ctx, reputation.TypeSender, "sender@example.net", reputation.EventMessage); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	server := NewServer(config.AdminConfig{Token: "secret"}, activity.NewLog(4), func() error { return nil }, func() Health { return Health{} }, nil)
+	server.UseReputation(tracker)
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	var listResp struct {
+		Entries []reputation.Entry `json:"entries"`
+	}
+	rec := do(http.MethodGet, "/reputation?status=blocked")
+	if err := json.Unmarshal(rec.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("decode /reputation: %v", err)
+	}
+	if len(listResp.Entries) != 1 || listResp.Entries[0].Value != "192.0.2.1" || listResp.Entries[0].AuthFailures != 2 || listResp.Entries[0].BlockedUntil.IsZero() {
+		t.Fatalf("/reputation?status=blocked = %#v, want the blocked ip", listResp.Entries)
+	}
+
+	if rec := do(http.MethodDelete, "/reputation?type=ip&value=192.0.2.1"); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /reputation status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/reputation?type=ip&value=192.0.2.1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("DELETE /reputation missing entry status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if got := tracker.Check(reputation.TypeIP, "192.0.2.1"); got.Status != reputation.StatusOK {
+		t.Fatalf("Check() after unblock = %+v, want ok", got)
+	}
+}
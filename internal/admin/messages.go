@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type messageHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type messageAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+type parsedMessage struct {
+	store.Message
+	Headers     []messageHeader     `json:"headers"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []messageAttachment `json:"attachments,omitempty"`
+	ParseError  string              `json:"parse_error,omitempty"`
+}
+
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	values := r.URL.Query()
+	query := store.Query{
+		From:      values.Get("from"),
+		Recipient: values.Get("to"),
+		Subject:   values.Get("subject"),
+		Limit:     queryLimit(r),
+	}
+	var err error
+	if query.Since, err = queryTime(values.Get("since")); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp"})
+		return
+	}
+	if query.Until, err = queryTime(values.Get("until")); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "until must be an RFC 3339 timestamp"})
+		return
+	}
+	if offset, err := strconv.Atoi(values.Get("offset")); err == nil && offset > 0 {
+		query.Offset = offset
+	}
+
+	messages, err := s.messages.SearchMessages(r.Context(), query)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if messages == nil {
+		messages = []store.Message{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"messages": messages})
+}
+
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.loadMessage(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, parseMessage(msg))
+}
+
+func (s *Server) handleGetRawMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.loadMessage(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": strconv.FormatInt(msg.ID, 10) + ".eml"}))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(msg.Raw)
+}
+
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return
+	}
+	err = s.messages.DeleteMessage(r.Context(), id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
+
+func (s *Server) requireStore(w http.ResponseWriter) bool {
+	if s.messages == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "message store is not enabled"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) loadMessage(w http.ResponseWriter, r *http.Request) (store.Message, bool) {
+	if !s.requireStore(w) {
+		return store.Message{}, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid message id"})
+		return store.Message{}, false
+	}
+	msg, err := s.messages.GetMessage(r.Context(), id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return store.Message{}, false
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return store.Message{}, false
+	}
+	return msg, true
+}
+
+func queryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseMessage(msg store.Message) parsedMessage {
+	parsed := parsedMessage{Message: msg, Headers: []messageHeader{}}
+	reader, err := mail.CreateReader(bytes.NewReader(msg.Raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		parsed.ParseError = err.Error()
+		return parsed
+	}
+	defer reader.Close()
+
+	fields := reader.Header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		parsed.Headers = append(parsed.Headers, messageHeader{Name: fields.Key(), Value: value})
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			parsed.ParseError = err.Error()
+			break
+		}
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			parsed.ParseError = err.Error()
+			break
+		}
+
+		switch header := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := header.ContentType()
+			switch {
+			case strings.EqualFold(contentType, "text/html") && parsed.HTML == "":
+				parsed.HTML = string(body)
+			case (contentType == "" || strings.EqualFold(contentType, "text/plain")) && parsed.Text == "":
+				parsed.Text = string(body)
+			default:
+				parsed.Attachments = append(parsed.Attachments, messageAttachment{ContentType: contentType, Size: len(body)})
+			}
+		case *mail.AttachmentHeader:
+			contentType, _, _ := header.ContentType()
+			filename, _ := header.Filename()
+			parsed.Attachments = append(parsed.Attachments, messageAttachment{Filename: filename, ContentType: contentType, Size: len(body)})
+		}
+	}
+	return parsed
+}
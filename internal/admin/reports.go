@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+)
+
+func (s *Server) handleListReports(w http.ResponseWriter, r *http.Request) {
+	if !s.requireReports(w) {
+		return
+	}
+	values := r.URL.Query()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reports": s.reports.List(reports.Query{
+			Kind:   values.Get("kind"),
+			Domain: values.Get("domain"),
+			Limit:  queryLimit(r),
+		}),
+	})
+}
+
+func (s *Server) handleGetReport(w http.ResponseWriter, r *http.Request) {
+	if !s.requireReports(w) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid report id"})
+		return
+	}
+	report, ok := s.reports.Get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "report not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) requireReports(w http.ResponseWriter) bool {
+	if s.reports == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "reports are not enabled"})
+		return false
+	}
+	return true
+}
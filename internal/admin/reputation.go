@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+)
+
+func (s *Server) handleListReputation(w http.ResponseWriter, r *http.Request) {
+	if !s.requireReputation(w) {
+		return
+	}
+	query := r.URL.Query()
+	entries := []reputation.Entry{}
+	for _, entry := range s.reputation.Entries() {
+		if repType := query.Get("type"); repType != "" && entry.Type != repType {
+			continue
+		}
+		if status := query.Get("status"); status != "" && entry.Status != status {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if limit := queryLimit(r); len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+func (s *Server) handleUnblockReputation(w http.ResponseWriter, r *http.Request) {
+	if !s.requireReputation(w) {
+		return
+	}
+	query := r.URL.Query()
+	err := s.reputation.Unblock(r.Context(), query.Get("type"), query.Get("value"))
+	switch {
+	case errors.Is(err, reputation.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		if s.logger != nil {
+			s.logger.Printf("admin reset reputation %s=%q", query.Get("type"), query.Get("value"))
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unblocked"})
+	}
+}
+
+func (s *Server) requireReputation(w http.ResponseWriter) bool {
+	if s.reputation == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "reputation is not enabled"})
+		return false
+	}
+	return true
+}
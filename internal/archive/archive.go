@@ -0,0 +1,245 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	FolderInbound = "inbound"
+	FolderReplies = "replies"
+)
+
+type Writer struct {
+	mu        sync.Mutex
+	format    string
+	dir       string
+	replies   bool
+	maxSize   int64
+	retention time.Duration
+	hostname  string
+	sizes     map[string]int64
+	sequence  atomic.Int64
+	now       func() time.Time
+}
+
+func Open(cfg config.ArchiveConfig) (*Writer, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	w := &Writer{
+		format:    cfg.Format,
+		dir:       cfg.Path,
+		replies:   cfg.Replies,
+		maxSize:   cfg.MaxSize,
+		retention: cfg.Retention,
+		hostname:  strings.NewReplacer("/", "_", ":", "_").Replace(hostname),
+		sizes:     make(map[string]int64),
+		now:       time.Now,
+	}
+	if err := os.MkdirAll(w.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	for _, folder := range []string{FolderInbound, FolderReplies} {
+		size, err := w.currentSize(folder)
+		if err != nil {
+			return nil, err
+		}
+		w.sizes[folder] = size
+	}
+	if err := w.prune(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) ArchiveReplies() bool {
+	return w != nil && w.replies
+}
+
+func (w *Writer) Write(folder string, sender string, at time.Time, message io.Reader) error {
+	if w == nil {
+		return nil
+	}
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return fmt.Errorf("read message for archive: %w", err)
+	}
+	if at.IsZero() {
+		at = w.now()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.sizes[folder] > 0 && w.sizes[folder]+int64(len(data)) > w.maxSize {
+		if err := w.rotate(folder); err != nil {
+			return err
+		}
+	}
+
+	var written int64
+	switch w.format {
+	case config.ArchiveFormatMbox:
+		written, err = w.appendMbox(folder, sender, at, data)
+	default:
+		written, err = w.deliverMaildir(folder, at, data)
+	}
+	if err != nil {
+		return err
+	}
+	w.sizes[folder] += written
+	return nil
+}
+
+func (w *Writer) currentPath(folder string) string {
+	if w.format == config.ArchiveFormatMbox {
+		return filepath.Join(w.dir, folder+".mbox")
+	}
+	return filepath.Join(w.dir, folder)
+}
+
+func (w *Writer) currentSize(folder string) (int64, error) {
+	path := w.currentPath(folder)
+	if w.format == config.ArchiveFormatMbox {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("stat archive %s: %w", path, err)
+		}
+		return info.Size(), nil
+	}
+
+	var total int64
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(path, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read archive %s: %w", path, err)
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+	}
+	return total, nil
+}
+
+func (w *Writer) appendMbox(folder string, sender string, at time.Time, data []byte) (int64, error) {
+	file, err := os.OpenFile(w.currentPath(folder), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return 0, fmt.Errorf("open mbox: %w", err)
+	}
+	defer file.Close()
+
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", strings.ReplaceAll(sender, " ", "_"), at.UTC().Format(time.ANSIC))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString("\n")
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("write mbox: %w", err)
+	}
+	return int64(buf.Len()), nil
+}
+
+func (w *Writer) deliverMaildir(folder string, at time.Time, data []byte) (int64, error) {
+	root := w.currentPath(folder)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0o750); err != nil {
+			return 0, fmt.Errorf("create maildir: %w", err)
+		}
+	}
+
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", at.Unix(), at.Nanosecond()/1000, os.Getpid(), w.sequence.Add(1), w.hostname, len(data))
+	tmpPath := filepath.Join(root, "tmp", name)
+	if err := os.WriteFile(tmpPath, data, 0o640); err != nil {
+		return 0, fmt.Errorf("write maildir message: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(root, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("deliver maildir message: %w", err)
+	}
+	return int64(len(data)), nil
+}
+
+func (w *Writer) rotate(folder string) error {
+	current := w.currentPath(folder)
+	base := folder + "-" + w.now().UTC().Format("20060102T150405")
+	suffix := ""
+	if w.format == config.ArchiveFormatMbox {
+		suffix = ".mbox"
+	}
+	rotated := filepath.Join(w.dir, base+suffix)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = filepath.Join(w.dir, base+"."+strconv.Itoa(i)+suffix)
+	}
+	if err := os.Rename(current, rotated); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate archive %s: %w", current, err)
+	}
+	w.sizes[folder] = 0
+	return w.prune()
+}
+
+func (w *Writer) prune() error {
+	if w.retention <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("read archive dir: %w", err)
+	}
+	cutoff := w.now().Add(-w.retention)
+	var expired []string
+	for _, entry := range entries {
+		if !isRotated(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		expired = append(expired, entry.Name())
+	}
+	for _, name := range expired {
+		if err := os.RemoveAll(filepath.Join(w.dir, name)); err != nil {
+			return fmt.Errorf("remove expired archive %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func isRotated(name string) bool {
+	return strings.HasPrefix(name, FolderInbound+"-") || strings.HasPrefix(name, FolderReplies+"-")
+}
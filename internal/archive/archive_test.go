@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func TestWriter_MboxQuotingAndRotation(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := Open(config.ArchiveConfig{Format: config.ArchiveFormatMbox, Path: dir, MaxSize: 200, Retention: time.Hour})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	writer.now = func() time.Time { return now }
+
+	message := "Subject: hi\r\n\r\nFrom the top\r\n>From quoted\r\nbye\r\n"
+	if err := writer.Write(FolderInbound, "sender@example.com", now, strings.NewReader(message)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "inbound.mbox"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	want := "From sender@example.com Fri Jan  2 03:04:05 2026\nSubject: hi\n\n>From the top\n>>From quoted\nbye\n\n"
+	if string(data) != want {
+		t.Fatalf("mbox = %q, want %q", data, want)
+	}
+
+	if err := writer.Write(FolderInbound, "", now, strings.NewReader(strings.Repeat("x", 190))); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "inbound-20260102T030405.mbox")); err != nil {
+		t.Fatalf("rotated mbox missing: %v", err)
+	}
+
+	rotated := filepath.Join(dir, "inbound-20260102T030405.mbox")
+	old := now.Add(-2 * time.Hour)
+	if err := os.Chtimes(rotated, old, old); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+	if err := writer.Write(FolderInbound, "", now, strings.NewReader(strings.Repeat("y", 190))); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Fatalf("expired archive still present: %v", err)
+	}
+}
+
+func TestWriter_Maildir(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := Open(config.ArchiveConfig{Format: config.ArchiveFormatMaildir, Path: dir, Replies: true})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !writer.ArchiveReplies() {
+		t.Fatalf("ArchiveReplies() = false, want true")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := writer.Write(FolderReplies, "echo@example.com", time.Now(), strings.NewReader("Subject: reply\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, FolderReplies, "new"))
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("maildir new entries = %d, want 2", len(entries))
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, FolderReplies, "tmp")); len(tmp) != 0 {
+		t.Fatalf("maildir tmp entries = %d, want 0", len(tmp))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, FolderReplies, "new", entries[0].Name()))
+	if err != nil || string(data) != "Subject: reply\r\n\r\nbody\r\n" {
+		t.Fatalf("maildir message = %q, %v", data, err)
+	}
+
+	var nilWriter *Writer
+	if err := nilWriter.Write(FolderInbound, "", time.Now(), strings.NewReader("x")); err != nil {
+		t.Fatalf("nil Write() error = %v", err)
+	}
+}
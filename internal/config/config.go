@@ -3,104 +3,2127 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/mail"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goccy/go-yaml"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type Config struct {
-	ListenAddr      string        `yaml:"listen_addr"`
-	Hostname        string        `yaml:"hostname"`
-	ReadTimeout     time.Duration `yaml:"read_timeout"`
-	WriteTimeout    time.Duration `yaml:"write_timeout"`
-	MaxMessageBytes int64         `yaml:"max_message_bytes"`
-	Reply           ReplyConfig   `yaml:"reply"`
-	DKIM            *DKIMConfig   `yaml:"dkim"`
+	ListenAddr        string                    `yaml:"listen_addr"`
+	Listeners         []ListenerConfig          `yaml:"listeners"`
+	Hostname          string                    `yaml:"hostname"`
+	ReadTimeout       time.Duration             `yaml:"read_timeout"`
+	WriteTimeout      time.Duration             `yaml:"write_timeout"`
+	ShutdownTimeout   time.Duration             `yaml:"shutdown_timeout"`
+	ProcessingTimeout time.Duration             `yaml:"processing_timeout"`
+	MaxMessageBytes   int64                     `yaml:"max_message_bytes"`
+	SpoolThreshold    int64                     `yaml:"spool_threshold"`
+	SpoolDir          string                    `yaml:"spool_dir"`
+	Processor         string                    `yaml:"processor"`
+	GRPC              *GRPCConfig               `yaml:"grpc"`
+	Reply             ReplyConfig               `yaml:"reply"`
+	Delivery          DeliveryConfig            `yaml:"delivery"`
+	DKIM              *DKIMConfig               `yaml:"dkim"`
+	RateLimit         *RateLimitConfig          `yaml:"rate_limit"`
+	Limits            *LimitsConfig             `yaml:"limits"`
+	Recipients        *RecipientsConfig         `yaml:"recipients"`
+	Greylist          *GreylistConfig           `yaml:"greylist"`
+	Reputation        *ReputationConfig         `yaml:"reputation"`
+	Dedup             *DedupConfig              `yaml:"dedup"`
+	SenderVerify      *SenderVerifyConfig       `yaml:"sender_verify"`
+	DNSBL             *DNSBLConfig              `yaml:"dnsbl"`
+	Helo              *HeloConfig               `yaml:"helo"`
+	RDNS              *RDNSConfig               `yaml:"rdns"`
+	Chaos             *ChaosConfig              `yaml:"chaos"`
+	DNS               *DNSConfig                `yaml:"dns"`
+	Suppression       *SuppressionConfig        `yaml:"suppression"`
+	Reports           *ReportsConfig            `yaml:"reports"`
+	Forward           *ForwardConfig            `yaml:"forward"`
+	Admin             *AdminConfig              `yaml:"admin"`
+	Store             *StoreConfig              `yaml:"store"`
+	Queue             *QueueConfig              `yaml:"queue"`
+	Tracing           *TracingConfig            `yaml:"tracing"`
+	Responses         *ResponsesConfig          `yaml:"responses"`
+	Archive           *ArchiveConfig            `yaml:"archive"`
+	Quarantine        *QuarantineConfig         `yaml:"quarantine"`
+	Ingest            *IngestConfig             `yaml:"ingest"`
+	IMAP              *IMAPConfig               `yaml:"imap"`
+	Webhooks          []WebhookConfig           `yaml:"webhooks"`
+	TLS               *TLSConfig                `yaml:"tls"`
+	Auth              *AuthConfig               `yaml:"auth"`
+	Rules             []RuleConfig              `yaml:"rules"`
+	Filters           map[string][]FilterConfig `yaml:"filters"`
 }
 
+type ListenerConfig struct {
+	Addr              string   `yaml:"addr"`
+	Hostname          string   `yaml:"hostname"`
+	TLSMode           string   `yaml:"tls_mode"`
+	MaxMessageBytes   int64    `yaml:"max_message_bytes"`
+	ProxyProtocol     bool     `yaml:"proxy_protocol"`
+	ProxyTrusted      []string `yaml:"proxy_trusted"`
+	XClient           bool     `yaml:"xclient"`
+	XClientTrusted    []string `yaml:"xclient_trusted"`
+	DisableExtensions []string `yaml:"disable_extensions"`
+}
+
+const (
+	TLSModeNone     = "none"
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "implicit"
+)
+
+const (
+	ExtensionSize                = "SIZE"
+	ExtensionDSN                 = "DSN"
+	ExtensionEnhancedStatusCodes = "ENHANCEDSTATUSCODES"
+	ExtensionPipelining          = "PIPELINING"
+	ExtensionChunking            = "CHUNKING"
+)
+
 type ReplyConfig struct {
-	FromAddress string `yaml:"from_address"`
-	MailFrom    string `yaml:"mail_from"`
-	FromName    string `yaml:"from_name"`
+	FromAddress        string                         `yaml:"from_address"`
+	MailFrom           string                         `yaml:"mail_from"`
+	FromName           string                         `yaml:"from_name"`
+	Mode               string                         `yaml:"mode"`
+	DMARCHeader        bool                           `yaml:"dmarc_header"`
+	CopyReceived       bool                           `yaml:"copy_received"`
+	Sequence           bool                           `yaml:"sequence"`
+	AttachOriginal     bool                           `yaml:"attach_original"`
+	HeaderDump         bool                           `yaml:"header_dump"`
+	TLSDiagnostics     bool                           `yaml:"tls_diagnostics"`
+	Checksums          bool                           `yaml:"checksums"`
+	ChecksumDetails    bool                           `yaml:"checksum_details"`
+	MaxBodyBytes       int64                          `yaml:"max_body_bytes"`
+	OversizePolicy     string                         `yaml:"oversize_policy"`
+	TooLargeSummary    bool                           `yaml:"too_large_summary"`
+	ParseFailure       string                         `yaml:"parse_failure"`
+	PreserveCharset    bool                           `yaml:"preserve_charset"`
+	FallbackCharset    string                         `yaml:"fallback_charset"`
+	TransferEncoding   string                         `yaml:"transfer_encoding"`
+	Bounce             string                         `yaml:"bounce"`
+	CC                 []string                       `yaml:"cc"`
+	BCC                []string                       `yaml:"bcc"`
+	MaxRecipients      int                            `yaml:"max_recipients"`
+	Headers            map[string]string              `yaml:"headers"`
+	PassthroughHeaders []string                       `yaml:"passthrough_headers"`
+	Compliance         *ComplianceConfig              `yaml:"compliance"`
+	Delay              time.Duration                  `yaml:"delay"`
+	Jitter             time.Duration                  `yaml:"jitter"`
+	SanitizeHTML       *SanitizeHTMLConfig            `yaml:"sanitize_html"`
+	Digest             *DigestConfig                  `yaml:"digest"`
+	VERP               *VERPConfig                    `yaml:"verp"`
+	Template           *ReplyTemplateConfig           `yaml:"template"`
+	Script             *ReplyScriptConfig             `yaml:"script"`
+	Exec               *ReplyExecConfig               `yaml:"exec"`
+	Identities         map[string]ReplyIdentityConfig `yaml:"identities"`
+}
+
+type ReplyIdentityConfig struct {
+	FromAddress string      `yaml:"from_address"`
+	FromName    string      `yaml:"from_name"`
+	MailFrom    string      `yaml:"mail_from"`
+	DKIM        *DKIMConfig `yaml:"dkim"`
+}
+
+type SanitizeHTMLConfig struct {
+	AllowExternalImages bool `yaml:"allow_external_images"`
+}
+
+type ComplianceConfig struct {
+	ListID            string `yaml:"list_id"`
+	UnsubscribeMailto string `yaml:"unsubscribe_mailto"`
+	UnsubscribeURL    string `yaml:"unsubscribe_url"`
+	OneClick          bool   `yaml:"one_click"`
+	FeedbackID        string `yaml:"feedback_id"`
+}
+
+type VERPConfig struct {
+	Scheme    string `yaml:"scheme"`
+	Separator string `yaml:"separator"`
+	Secret    string `yaml:"secret"`
+}
+
+type DigestConfig struct {
+	Window      time.Duration `yaml:"window"`
+	MaxMessages int           `yaml:"max_messages"`
+}
+
+type ReplyTemplateConfig struct {
+	Text string `yaml:"text"`
+	HTML string `yaml:"html"`
+}
+
+type ReplyScriptConfig struct {
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type ReplyExecConfig struct {
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const (
+	ReplyModeEcho     = "echo"
+	ReplyModeReport   = "report"
+	ReplyModeReplyAll = "reply_all"
+)
+
+const (
+	OversizeTruncate  = "truncate"
+	OversizeSummarize = "summarize"
+	OversizeReject    = "reject"
+)
+
+const (
+	ParseFailureReject     = "reject"
+	ParseFailureDiagnostic = "diagnostic"
+	ParseFailureRaw        = "raw"
+	ParseFailureDrop       = "drop"
+)
+
+const (
+	TransferEncodingAuto            = "auto"
+	TransferEncodingQuotedPrintable = "quoted-printable"
+	TransferEncodingBase64          = "base64"
+	TransferEncoding8Bit            = "8bit"
+)
+
+const (
+	VERPSchemeRecipient = "recipient"
+	VERPSchemeReplyID   = "reply_id"
+)
+
+var ReservedReplyHeaders = []string{
+	"Date",
+	"From",
+	"To",
+	"Cc",
+	"Bcc",
+	"Subject",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"DKIM-Signature",
+}
+
+const (
+	BounceModeLog = "log"
+	BounceModeDSN = "dsn"
+)
+
+type DeliveryConfig struct {
+	Mode               string             `yaml:"mode"`
+	OutputDir          string             `yaml:"output_dir"`
+	MTASTS             bool               `yaml:"mta_sts"`
+	DANE               bool               `yaml:"dane"`
+	TLSPolicy          string             `yaml:"tls_policy"`
+	MinTLSVersion      string             `yaml:"min_tls_version"`
+	CAFile             string             `yaml:"ca_file"`
+	InsecureSkipVerify bool               `yaml:"insecure_skip_verify"`
+	IPFamily           string             `yaml:"ip_family"`
+	ConnectTimeout     time.Duration      `yaml:"connect_timeout"`
+	FallbackDelay      time.Duration      `yaml:"fallback_delay"`
+	SourceIPv4         string             `yaml:"source_ipv4"`
+	SourceIPv6         string             `yaml:"source_ipv6"`
+	SourceInterface    string             `yaml:"source_interface"`
+	SourcePool         *SourcePoolConfig  `yaml:"source_pool"`
+	EHLOName           string             `yaml:"ehlo_name"`
+	Proxy              string             `yaml:"proxy"`
+	DomainOverrides    map[string]string  `yaml:"domain_overrides"`
+	Pool               *PoolConfig        `yaml:"pool"`
+	Retry              *RetryConfig       `yaml:"retry"`
+	Concurrency        *ConcurrencyConfig `yaml:"concurrency"`
+}
+
+type SourcePoolConfig struct {
+	Selection string                `yaml:"selection"`
+	Addresses []SourceAddressConfig `yaml:"addresses"`
+}
+
+type SourceAddressConfig struct {
+	IP       string `yaml:"ip"`
+	EHLOName string `yaml:"ehlo_name"`
+}
+
+const (
+	SourceSelectionRoundRobin = "round_robin"
+	SourceSelectionDomain     = "domain"
+)
+
+type PoolConfig struct {
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxMessages    int           `yaml:"max_messages"`
+	MaxIdlePerHost int           `yaml:"max_idle_per_host"`
+}
+
+type ConcurrencyConfig struct {
+	Max       int `yaml:"max"`
+	PerDomain int `yaml:"per_domain"`
+}
+
+type RetryConfig struct {
+	AttemptsPerHost  int             `yaml:"attempts_per_host"`
+	AttemptDelay     time.Duration   `yaml:"attempt_delay"`
+	Schedule         []time.Duration `yaml:"schedule"`
+	PermanentFailure string          `yaml:"permanent_failure"`
+	SkipFailedHosts  time.Duration   `yaml:"skip_failed_hosts"`
+}
+
+const (
+	PermanentFailureFail     = "fail"
+	PermanentFailureNextHost = "next_host"
+	PermanentFailureRetry    = "retry"
+)
+
+const (
+	DeliveryModeSMTP   = "smtp"
+	DeliveryModeNone   = "none"
+	DeliveryModeStdout = "stdout"
+	DeliveryModeFile   = "file"
+)
+
+const (
+	TLSPolicyOpportunistic = "opportunistic"
+	TLSPolicyRequire       = "require"
+	TLSPolicyNone          = "none"
+)
+
+const (
+	IPFamilyDual = "dual"
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+type DKIMConfig struct {
+	Domain            string          `yaml:"domain"`
+	Selector          string          `yaml:"selector"`
+	Identifier        string          `yaml:"identifier"`
+	PrivateKeyPath    string          `yaml:"private_key_path"`
+	PrivateKey        string          `yaml:"private_key"`
+	PrivateKeyEnv     string          `yaml:"private_key_env"`
+	PrivateKeyCommand []string        `yaml:"private_key_command"`
+	Passphrase        string          `yaml:"passphrase"`
+	Keys              []DKIMKeyConfig `yaml:"keys"`
+	KeyDir            string          `yaml:"key_dir"`
+	RotationDelay     time.Duration   `yaml:"rotation_delay"`
+	Headers           []string        `yaml:"headers"`
+	Canonicalization  string          `yaml:"canonicalization"`
+	Expiry            time.Duration   `yaml:"expiry"`
+	BodyLength        int64           `yaml:"body_length"`
+}
+
+const (
+	DKIMCanonicalizationSimple  = "simple"
+	DKIMCanonicalizationRelaxed = "relaxed"
+)
+
+type DKIMKeyConfig struct {
+	Selector       string    `yaml:"selector"`
+	PrivateKeyPath string    `yaml:"private_key_path"`
+	NotBefore      time.Time `yaml:"not_before"`
+	NotAfter       time.Time `yaml:"not_after"`
+}
+
+type RateLimitConfig struct {
+	PerIP     *RateLimit `yaml:"per_ip"`
+	PerSender *RateLimit `yaml:"per_sender"`
+	Global    *RateLimit `yaml:"global"`
+}
+
+type RateLimit struct {
+	Rate  int           `yaml:"rate"`
+	Per   time.Duration `yaml:"per"`
+	Burst int           `yaml:"burst"`
+}
+
+type LimitsConfig struct {
+	MaxConnections      int           `yaml:"max_connections"`
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	BannerTimeout       time.Duration `yaml:"banner_timeout"`
+	CommandTimeout      time.Duration `yaml:"command_timeout"`
+	DataTimeout         time.Duration `yaml:"data_timeout"`
+	MaxSessionDuration  time.Duration `yaml:"max_session_duration"`
+	MaxRecipients       int           `yaml:"max_recipients"`
+	MaxBacklog          int           `yaml:"max_backlog"`
+}
+
+type RecipientsConfig struct {
+	Mode           string   `yaml:"mode"`
+	Addresses      []string `yaml:"addresses"`
+	Domains        []string `yaml:"domains"`
+	PlusAddressing bool     `yaml:"plus_addressing"`
+	TagSeparator   string   `yaml:"tag_separator"`
+}
+
+const (
+	RecipientModeAny      = "any"
+	RecipientModeStrict   = "strict"
+	RecipientModeCatchAll = "catch_all"
+)
+
+type GreylistConfig struct {
+	Delay  time.Duration `yaml:"delay"`
+	Window time.Duration `yaml:"window"`
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+type ReputationConfig struct {
+	Window        time.Duration `yaml:"window"`
+	MinEvents     int           `yaml:"min_events"`
+	TempfailScore int           `yaml:"tempfail_score"`
+	BlockScore    int           `yaml:"block_score"`
+	BlockDuration time.Duration `yaml:"block_duration"`
+	MaxEntries    int           `yaml:"max_entries"`
+}
+
+type DedupConfig struct {
+	Key        string        `yaml:"key"`
+	Window     time.Duration `yaml:"window"`
+	MaxEntries int           `yaml:"max_entries"`
+}
+
+const (
+	DedupKeyMessageID = "message_id"
+	DedupKeyBodyHash  = "body_hash"
+)
+
+type SenderVerifyConfig struct {
+	Probe    bool          `yaml:"probe"`
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type DNSBLConfig struct {
+	Zones    []string      `yaml:"zones"`
+	Policy   string        `yaml:"policy"`
+	Tag      string        `yaml:"tag"`
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+const (
+	DNSBLPolicyLog    = "log"
+	DNSBLPolicyTag    = "tag"
+	DNSBLPolicyReject = "reject"
+)
+
+type HeloConfig struct {
+	Checks  []string      `yaml:"checks"`
+	Policy  string        `yaml:"policy"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const (
+	HeloCheckFQDN     = "fqdn"
+	HeloCheckResolves = "resolves"
+	HeloCheckNotSelf  = "not_self"
+	HeloCheckNotIP    = "not_ip"
+)
+
+const (
+	HeloPolicyLog    = "log"
+	HeloPolicyReject = "reject"
+)
+
+type RDNSConfig struct {
+	Policy  string        `yaml:"policy"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const (
+	RDNSPolicyLog            = "log"
+	RDNSPolicyRejectMissing  = "reject_missing"
+	RDNSPolicyRejectMismatch = "reject_mismatch"
+)
+
+type ChaosConfig struct {
+	MailError     float64       `yaml:"mail_error"`
+	RcptError     float64       `yaml:"rcpt_error"`
+	DataError     float64       `yaml:"data_error"`
+	Permanent     float64       `yaml:"permanent"`
+	Slow          float64       `yaml:"slow"`
+	SlowDelay     time.Duration `yaml:"slow_delay"`
+	Drop          float64       `yaml:"drop"`
+	ReplyDelay    float64       `yaml:"reply_delay"`
+	MaxReplyDelay time.Duration `yaml:"max_reply_delay"`
+}
+
+type DNSConfig struct {
+	Servers       []string      `yaml:"servers"`
+	TLS           bool          `yaml:"tls"`
+	TLSServerName string        `yaml:"tls_server_name"`
+	Timeout       time.Duration `yaml:"timeout"`
+	CacheSize     int           `yaml:"cache_size"`
+	MaxTTL        time.Duration `yaml:"max_ttl"`
+}
+
+type SuppressionConfig struct {
+	Path            string   `yaml:"path"`
+	Addresses       []string `yaml:"addresses"`
+	Domains         []string `yaml:"domains"`
+	Patterns        []string `yaml:"patterns"`
+	BounceThreshold int      `yaml:"bounce_threshold"`
+}
+
+type ForwardConfig struct {
+	To        []string `yaml:"to"`
+	Mode      string   `yaml:"mode"`
+	MailFrom  string   `yaml:"mail_from"`
+	Relay     string   `yaml:"relay"`
+	Username  string   `yaml:"username"`
+	Password  string   `yaml:"password"`
+	TLSPolicy string   `yaml:"tls_policy"`
+}
+
+const (
+	ForwardModeCopy = "copy"
+	ForwardModeOnly = "only"
+)
+
+type ReportsConfig struct {
+	Addresses  []string `yaml:"addresses"`
+	Path       string   `yaml:"path"`
+	MaxReports int      `yaml:"max_reports"`
+}
+
+type AdminConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	Token      string `yaml:"token"`
+}
+
+type StoreConfig struct {
+	Driver        string        `yaml:"driver"`
+	Path          string        `yaml:"path"`
+	Retention     time.Duration `yaml:"retention"`
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+type QueueConfig struct {
+	Path         string        `yaml:"path"`
+	ClaimTimeout time.Duration `yaml:"claim_timeout"`
+}
+
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio float64           `yaml:"sample_ratio"`
+}
+
+type ResponsesConfig struct {
+	Banner   string            `yaml:"banner"`
+	Messages map[string]string `yaml:"messages"`
+}
+
+const (
+	ResponseAuthRequired             = "auth_required"
+	ResponseGreylisted               = "greylisted"
+	ResponseRateLimited              = "rate_limited"
+	ResponseServerBusy               = "server_busy"
+	ResponseTooManyConnections       = "too_many_connections"
+	ResponseTooManyConnectionsFromIP = "too_many_connections_from_ip"
+	ResponseTooManyRecipients        = "too_many_recipients"
+	ResponseSenderMalformed          = "sender_malformed"
+	ResponseSenderNoMailHost         = "sender_no_mail_host"
+	ResponseSenderNullMX             = "sender_null_mx"
+	ResponseSenderUnavailable        = "sender_unavailable"
+	ResponseProcessorUnavailable     = "processor_unavailable"
+	ResponseProcessingFailed         = "processing_failed"
+	ResponseProcessingTimeout        = "processing_timeout"
+	ResponseShuttingDown             = "shutting_down"
+	ResponseClientCertRequired       = "client_cert_required"
+	ResponseRecipientUnknown         = "recipient_unknown"
+	ResponseBacklogFull              = "backlog_full"
+	ResponseMessageTooLarge          = "message_too_large"
+	ResponseReputationTempfail       = "reputation_tempfail"
+	ResponseReputationBlocked        = "reputation_blocked"
+	ResponseDNSBLListed              = "dnsbl_listed"
+	ResponseHeloRejected             = "helo_rejected"
+	ResponseRDNSFailed               = "rdns_failed"
+)
+
+var ResponseNames = []string{
+	ResponseAuthRequired,
+	ResponseGreylisted,
+	ResponseRateLimited,
+	ResponseServerBusy,
+	ResponseTooManyConnections,
+	ResponseTooManyConnectionsFromIP,
+	ResponseTooManyRecipients,
+	ResponseSenderMalformed,
+	ResponseSenderNoMailHost,
+	ResponseSenderNullMX,
+	ResponseSenderUnavailable,
+	ResponseProcessorUnavailable,
+	ResponseProcessingFailed,
+	ResponseProcessingTimeout,
+	ResponseShuttingDown,
+	ResponseClientCertRequired,
+	ResponseRecipientUnknown,
+	ResponseBacklogFull,
+	ResponseMessageTooLarge,
+	ResponseReputationTempfail,
+	ResponseReputationBlocked,
+	ResponseDNSBLListed,
+	ResponseHeloRejected,
+	ResponseRDNSFailed,
+}
+
+var headerNamePattern = regexp.MustCompile(`^[!-9;-~]+$`)
+
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+type ArchiveConfig struct {
+	Format    string        `yaml:"format"`
+	Path      string        `yaml:"path"`
+	Replies   bool          `yaml:"replies"`
+	MaxSize   int64         `yaml:"max_size"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type QuarantineConfig struct {
+	Path string `yaml:"path"`
+}
+
+type IngestConfig struct {
+	Socket     string `yaml:"socket"`
+	SocketMode string `yaml:"socket_mode"`
+}
+
+const (
+	ArchiveFormatMaildir = "maildir"
+	ArchiveFormatMbox    = "mbox"
+)
+
+const (
+	ProcessorEcho = "echo"
+	ProcessorGRPC = "grpc"
+)
+
+type GRPCConfig struct {
+	Target        string        `yaml:"target"`
+	Timeout       time.Duration `yaml:"timeout"`
+	TLS           bool          `yaml:"tls"`
+	TLSServerName string        `yaml:"tls_server_name"`
+}
+
+type IMAPConfig struct {
+	ListenAddr    string `yaml:"listen_addr"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	AllowInsecure bool   `yaml:"allow_insecure"`
+}
+
+type RuleConfig struct {
+	Match        string          `yaml:"match"`
+	Sender       string          `yaml:"sender"`
+	Subject      string          `yaml:"subject"`
+	MinSize      int64           `yaml:"min_size"`
+	MaxSize      int64           `yaml:"max_size"`
+	Auth         *RuleAuthConfig `yaml:"auth"`
+	Connection   *RuleConnConfig `yaml:"connection"`
+	Action       string          `yaml:"action"`
+	Delay        time.Duration   `yaml:"delay"`
+	Code         int             `yaml:"code"`
+	EnhancedCode string          `yaml:"enhanced_code"`
+	Message      string          `yaml:"message"`
+	Filters      []string        `yaml:"filters"`
+	Tag          string          `yaml:"tag"`
+	ForwardTo    []string        `yaml:"forward_to"`
+}
+
+type RuleAuthConfig struct {
+	SPF   string `yaml:"spf"`
+	DKIM  string `yaml:"dkim"`
+	DMARC string `yaml:"dmarc"`
+}
+
+type RuleConnConfig struct {
+	RemoteIP      []string `yaml:"remote_ip"`
+	Helo          string   `yaml:"helo"`
+	TLS           *bool    `yaml:"tls"`
+	Authenticated *bool    `yaml:"authenticated"`
+}
+
+const (
+	RuleActionEcho    = "echo"
+	RuleActionReject  = "reject"
+	RuleActionDrop    = "drop"
+	RuleActionDelay   = "delay"
+	RuleActionBounce  = "bounce"
+	RuleActionFilter  = "filter"
+	RuleActionTag     = "tag"
+	RuleActionForward = "forward"
+)
+
+var ruleAuthResults = []string{"none", "pass", "fail", "softfail", "neutral", "temperror", "permerror"}
+
+type FilterConfig struct {
+	Type        string `yaml:"type"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	Text        string `yaml:"text"`
+}
+
+const (
+	FilterUppercase   = "uppercase"
+	FilterReverse     = "reverse"
+	FilterROT13       = "rot13"
+	FilterReplace     = "replace"
+	FilterStripQuotes = "strip_quotes"
+	FilterFooter      = "footer"
+)
+
+type WebhookConfig struct {
+	URL         string        `yaml:"url"`
+	Secret      string        `yaml:"secret"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+type TLSConfig struct {
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	RequestClientCert bool   `yaml:"request_client_cert"`
+	ClientAuth        string `yaml:"client_auth"`
+	ClientCAFile      string `yaml:"client_ca_file"`
+}
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+type AuthConfig struct {
+	Required      bool       `yaml:"required"`
+	AllowInsecure bool       `yaml:"allow_insecure"`
+	Users         []AuthUser `yaml:"users"`
+}
+
+type AuthUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:        ":25",
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		ShutdownTimeout:   10 * time.Second,
+		ProcessingTimeout: 5 * time.Minute,
+		MaxMessageBytes:   10 * 1024 * 1024,
+		SpoolThreshold:    1024 * 1024,
+		Processor:         ProcessorEcho,
+		Reply: ReplyConfig{
+			Mode: ReplyModeEcho,
+		},
+		Delivery: DeliveryConfig{
+			Mode:           DeliveryModeSMTP,
+			MTASTS:         true,
+			DANE:           true,
+			TLSPolicy:      TLSPolicyOpportunistic,
+			MinTLSVersion:  "1.2",
+			IPFamily:       IPFamilyDual,
+			ConnectTimeout: 30 * time.Second,
+			FallbackDelay:  300 * time.Millisecond,
+		},
+	}
+}
+
+func Load(path string, flags Overrides) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config: %w", err)
+		}
+
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("parse config yaml: %w", err)
+		}
+	}
+	if err := envOverrides().apply(&cfg, EnvName); err != nil {
+		return Config{}, err
+	}
+	if err := flags.apply(&cfg, func(path string) string { return "-" + path }); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Prepare(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) Prepare() error {
+	c.applyDefaults()
+	return c.validate()
+}
+
+func (c *Config) applyDefaults() {
+	if c.TLS != nil && c.TLS.ClientAuth == "" {
+		c.TLS.ClientAuth = ClientAuthNone
+		if c.TLS.RequestClientCert || c.TLS.ClientCAFile != "" {
+			c.TLS.ClientAuth = ClientAuthRequest
+		}
+	}
+	if len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{{Addr: c.ListenAddr}}
+	}
+	if c.Ingest != nil && c.Ingest.SocketMode == "" {
+		c.Ingest.SocketMode = "0660"
+	}
+	for i := range c.Listeners {
+		if c.Listeners[i].TLSMode == "" {
+			c.Listeners[i].TLSMode = TLSModeNone
+			if c.TLS != nil {
+				c.Listeners[i].TLSMode = TLSModeStartTLS
+			}
+		}
+		if c.Listeners[i].MaxMessageBytes == 0 {
+			c.Listeners[i].MaxMessageBytes = c.MaxMessageBytes
+		}
+		for j, extension := range c.Listeners[i].DisableExtensions {
+			c.Listeners[i].DisableExtensions[j] = strings.ToUpper(extension)
+		}
+	}
+	for i := range c.Webhooks {
+		if c.Webhooks[i].Timeout == 0 {
+			c.Webhooks[i].Timeout = 10 * time.Second
+		}
+		if c.Webhooks[i].MaxAttempts == 0 {
+			c.Webhooks[i].MaxAttempts = 3
+		}
+	}
+	for i := range c.Rules {
+		if c.Rules[i].Action == RuleActionReject && c.Rules[i].Code == 0 {
+			c.Rules[i].Code = 550
+		}
+	}
+	if c.Delivery.SourcePool != nil && c.Delivery.SourcePool.Selection == "" {
+		c.Delivery.SourcePool.Selection = SourceSelectionRoundRobin
+	}
+	if c.Delivery.Pool != nil {
+		if c.Delivery.Pool.IdleTimeout == 0 {
+			c.Delivery.Pool.IdleTimeout = 30 * time.Second
+		}
+		if c.Delivery.Pool.MaxMessages == 0 {
+			c.Delivery.Pool.MaxMessages = 100
+		}
+	}
+	if c.Delivery.Retry != nil {
+		if c.Delivery.Retry.AttemptsPerHost == 0 {
+			c.Delivery.Retry.AttemptsPerHost = 1
+		}
+		if c.Delivery.Retry.PermanentFailure == "" {
+			c.Delivery.Retry.PermanentFailure = PermanentFailureNextHost
+		}
+	}
+	if c.Recipients != nil {
+		if c.Recipients.Mode == "" {
+			c.Recipients.Mode = RecipientModeAny
+		}
+		if c.Recipients.TagSeparator == "" {
+			c.Recipients.TagSeparator = "+"
+		}
+	}
+	if c.Greylist != nil {
+		if c.Greylist.Delay == 0 {
+			c.Greylist.Delay = 5 * time.Minute
+		}
+		if c.Greylist.Window == 0 {
+			c.Greylist.Window = 24 * time.Hour
+		}
+		if c.Greylist.Expiry == 0 {
+			c.Greylist.Expiry = 30 * 24 * time.Hour
+		}
+	}
+	if c.Reputation != nil {
+		if c.Reputation.Window == 0 {
+			c.Reputation.Window = 24 * time.Hour
+		}
+		if c.Reputation.MinEvents == 0 {
+			c.Reputation.MinEvents = 10
+		}
+		if c.Reputation.TempfailScore == 0 {
+			c.Reputation.TempfailScore = 50
+		}
+		if c.Reputation.BlockScore == 0 {
+			c.Reputation.BlockScore = 20
+		}
+		if c.Reputation.BlockDuration == 0 {
+			c.Reputation.BlockDuration = 24 * time.Hour
+		}
+		if c.Reputation.MaxEntries == 0 {
+			c.Reputation.MaxEntries = 100000
+		}
+	}
+	if c.Forward != nil {
+		if c.Forward.Mode == "" {
+			c.Forward.Mode = ForwardModeCopy
+		}
+		if c.Forward.MailFrom == "" {
+			c.Forward.MailFrom = c.Reply.MailFrom
+		}
+		if c.Forward.TLSPolicy == "" {
+			c.Forward.TLSPolicy = c.Delivery.TLSPolicy
+		}
+	}
+	if c.Reports != nil && c.Reports.MaxReports == 0 {
+		c.Reports.MaxReports = 1000
+	}
+	if c.Dedup != nil {
+		if c.Dedup.Key == "" {
+			c.Dedup.Key = DedupKeyMessageID
+		}
+		if c.Dedup.Window == 0 {
+			c.Dedup.Window = time.Hour
+		}
+		if c.Dedup.MaxEntries == 0 {
+			c.Dedup.MaxEntries = 100000
+		}
+	}
+	if c.DKIM != nil && c.DKIM.RotationDelay == 0 {
+		c.DKIM.RotationDelay = 24 * time.Hour
+	}
+	if c.Chaos != nil {
+		if c.Chaos.SlowDelay == 0 {
+			c.Chaos.SlowDelay = 5 * time.Second
+		}
+		if c.Chaos.MaxReplyDelay == 0 {
+			c.Chaos.MaxReplyDelay = 5 * time.Minute
+		}
+	}
+	if c.SenderVerify != nil {
+		if c.SenderVerify.Timeout == 0 {
+			c.SenderVerify.Timeout = 10 * time.Second
+		}
+		if c.SenderVerify.CacheTTL == 0 {
+			c.SenderVerify.CacheTTL = 10 * time.Minute
+		}
+	}
+	if c.DNSBL != nil {
+		if c.DNSBL.Policy == "" {
+			c.DNSBL.Policy = DNSBLPolicyLog
+		}
+		if c.DNSBL.Tag == "" {
+			c.DNSBL.Tag = "dnsbl"
+		}
+		if c.DNSBL.Timeout == 0 {
+			c.DNSBL.Timeout = 2 * time.Second
+		}
+		if c.DNSBL.CacheTTL == 0 {
+			c.DNSBL.CacheTTL = time.Hour
+		}
+	}
+	if c.Helo != nil {
+		if len(c.Helo.Checks) == 0 {
+			c.Helo.Checks = []string{HeloCheckFQDN, HeloCheckResolves, HeloCheckNotSelf, HeloCheckNotIP}
+		}
+		if c.Helo.Policy == "" {
+			c.Helo.Policy = HeloPolicyLog
+		}
+		if c.Helo.Timeout == 0 {
+			c.Helo.Timeout = 5 * time.Second
+		}
+	}
+	if c.RDNS != nil {
+		if c.RDNS.Policy == "" {
+			c.RDNS.Policy = RDNSPolicyLog
+		}
+		if c.RDNS.Timeout == 0 {
+			c.RDNS.Timeout = 5 * time.Second
+		}
+	}
+	if c.DNS != nil {
+		if c.DNS.Timeout == 0 {
+			c.DNS.Timeout = 5 * time.Second
+		}
+		if c.DNS.CacheSize == 0 {
+			c.DNS.CacheSize = 10000
+		}
+		if c.DNS.MaxTTL == 0 {
+			c.DNS.MaxTTL = time.Hour
+		}
+	}
+	if c.Store != nil {
+		if c.Store.Driver == "" {
+			c.Store.Driver = "sqlite"
+		}
+		if c.Store.PruneInterval == 0 {
+			c.Store.PruneInterval = time.Hour
+		}
+	}
+	if c.Tracing != nil {
+		if c.Tracing.ServiceName == "" {
+			c.Tracing.ServiceName = "smtp-echo"
+		}
+		if c.Tracing.SampleRatio == 0 {
+			c.Tracing.SampleRatio = 1
+		}
+	}
+	if c.Queue != nil && c.Queue.ClaimTimeout == 0 {
+		c.Queue.ClaimTimeout = 10 * time.Minute
+	}
+	if c.Reply.Mode == ReplyModeReplyAll && c.Reply.MaxRecipients == 0 {
+		c.Reply.MaxRecipients = 10
+	}
+	if c.Reply.MaxBodyBytes > 0 && c.Reply.OversizePolicy == "" {
+		c.Reply.OversizePolicy = OversizeTruncate
+	}
+	if c.Reply.ParseFailure == "" {
+		c.Reply.ParseFailure = ParseFailureReject
+	}
+	if c.Reply.TransferEncoding == "" {
+		c.Reply.TransferEncoding = TransferEncodingAuto
+	}
+	if c.Reply.VERP != nil {
+		if c.Reply.VERP.Scheme == "" {
+			c.Reply.VERP.Scheme = VERPSchemeRecipient
+		}
+		if c.Reply.VERP.Separator == "" {
+			c.Reply.VERP.Separator = "+"
+		}
+	}
+	if c.Reply.Script != nil && c.Reply.Script.Timeout == 0 {
+		c.Reply.Script.Timeout = time.Second
+	}
+	if c.Reply.Exec != nil && c.Reply.Exec.Timeout == 0 {
+		c.Reply.Exec.Timeout = 5 * time.Second
+	}
+	if c.GRPC != nil && c.GRPC.Timeout == 0 {
+		c.GRPC.Timeout = 10 * time.Second
+	}
+	if c.Archive != nil && c.Archive.Format == "" {
+		c.Archive.Format = ArchiveFormatMaildir
+	}
 }
 
-type DKIMConfig struct {
-	Domain         string `yaml:"domain"`
-	Selector       string `yaml:"selector"`
-	Identifier     string `yaml:"identifier"`
-	PrivateKeyPath string `yaml:"private_key_path"`
-}
+func (c Config) validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listen_addr is required")
+	}
+	if c.Hostname == "" {
+		return errors.New("hostname is required")
+	}
+	if c.ReadTimeout <= 0 {
+		return errors.New("read_timeout must be > 0")
+	}
+	if c.WriteTimeout <= 0 {
+		return errors.New("write_timeout must be > 0")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be > 0")
+	}
+	if c.ProcessingTimeout < 0 {
+		return errors.New("processing_timeout must be >= 0")
+	}
+	if c.MaxMessageBytes <= 0 {
+		return errors.New("max_message_bytes must be > 0")
+	}
+	if c.SpoolThreshold < 0 {
+		return errors.New("spool_threshold must be >= 0")
+	}
+	for i, listener := range c.Listeners {
+		if listener.Addr == "" {
+			return fmt.Errorf("listeners[%d].addr is required", i)
+		}
+		switch listener.TLSMode {
+		case TLSModeNone:
+		case TLSModeStartTLS, TLSModeImplicit:
+			if c.TLS == nil {
+				return fmt.Errorf("listeners[%d].tls_mode %q requires a tls section", i, listener.TLSMode)
+			}
+		default:
+			return fmt.Errorf("listeners[%d].tls_mode must be one of %q, %q, or %q", i, TLSModeNone, TLSModeStartTLS, TLSModeImplicit)
+		}
+		if listener.MaxMessageBytes <= 0 {
+			return fmt.Errorf("listeners[%d].max_message_bytes must be > 0", i)
+		}
+		if !validEHLOName(listener.Hostname) {
+			return fmt.Errorf("listeners[%d].hostname %q must be a host name without spaces", i, listener.Hostname)
+		}
+		if len(listener.ProxyTrusted) > 0 && !listener.ProxyProtocol {
+			return fmt.Errorf("listeners[%d].proxy_trusted requires proxy_protocol", i)
+		}
+		for _, trusted := range listener.ProxyTrusted {
+			if _, _, err := net.ParseCIDR(trusted); err != nil && net.ParseIP(trusted) == nil {
+				return fmt.Errorf("listeners[%d].proxy_trusted entry %q is not an ip or cidr", i, trusted)
+			}
+		}
+		if len(listener.XClientTrusted) > 0 && !listener.XClient {
+			return fmt.Errorf("listeners[%d].xclient_trusted requires xclient", i)
+		}
+		if listener.XClient && len(listener.XClientTrusted) == 0 {
+			return fmt.Errorf("listeners[%d].xclient requires xclient_trusted", i)
+		}
+		if listener.XClient && listener.TLSMode == TLSModeImplicit {
+			return fmt.Errorf("listeners[%d].xclient is not supported with implicit tls", i)
+		}
+		for _, trusted := range listener.XClientTrusted {
+			if _, _, err := net.ParseCIDR(trusted); err != nil && net.ParseIP(trusted) == nil {
+				return fmt.Errorf("listeners[%d].xclient_trusted entry %q is not an ip or cidr", i, trusted)
+			}
+		}
+		for _, extension := range listener.DisableExtensions {
+			switch extension {
+			case ExtensionDSN, ExtensionChunking:
+			case ExtensionSize, ExtensionEnhancedStatusCodes, ExtensionPipelining:
+				if listener.TLSMode == TLSModeImplicit {
+					return fmt.Errorf("listeners[%d].disable_extensions %s is not supported with implicit tls", i, extension)
+				}
+			default:
+				return fmt.Errorf("listeners[%d].disable_extensions entry %q must be one of %q, %q, %q, %q, or %q", i, extension, ExtensionSize, ExtensionDSN, ExtensionEnhancedStatusCodes, ExtensionPipelining, ExtensionChunking)
+			}
+		}
+	}
+	if c.Reply.FromAddress == "" {
+		return errors.New("reply.from_address is required")
+	}
+	if c.Reply.MailFrom == "" {
+		return errors.New("reply.mail_from is required")
+	}
+
+	if _, err := mail.ParseAddress(c.Reply.FromAddress); err != nil {
+		return fmt.Errorf("reply.from_address invalid: %w", err)
+	}
+	if _, err := mail.ParseAddress(c.Reply.MailFrom); err != nil {
+		return fmt.Errorf("reply.mail_from invalid: %w", err)
+	}
+	for i, address := range c.Reply.CC {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("reply.cc[%d] invalid: %w", i, err)
+		}
+	}
+	for i, address := range c.Reply.BCC {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("reply.bcc[%d] invalid: %w", i, err)
+		}
+	}
+	for name, value := range c.Reply.Headers {
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("reply.headers[%q] is not a valid header name", name)
+		}
+		if slices.ContainsFunc(ReservedReplyHeaders, func(reserved string) bool { return strings.EqualFold(reserved, name) }) {
+			return fmt.Errorf("reply.headers[%q] cannot replace a header the reply sets itself", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("reply.headers[%q] must be a single line", name)
+		}
+	}
+	if err := validateCompliance(c.Reply.Compliance); err != nil {
+		return err
+	}
+	for i, pattern := range c.Reply.PassthroughHeaders {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" || strings.ContainsAny(pattern, ": ") {
+			return fmt.Errorf("reply.passthrough_headers[%d] %q is not a valid header name pattern", i, pattern)
+		}
+	}
+	switch c.Reply.Mode {
+	case ReplyModeEcho, ReplyModeReport, ReplyModeReplyAll:
+	default:
+		return fmt.Errorf("reply.mode must be one of %q, %q, or %q", ReplyModeEcho, ReplyModeReport, ReplyModeReplyAll)
+	}
+	if c.Reply.MaxRecipients < 0 {
+		return errors.New("reply.max_recipients must be >= 0")
+	}
+	switch c.Processor {
+	case ProcessorEcho:
+	case ProcessorGRPC:
+		if c.GRPC == nil {
+			return errors.New("grpc section is required when processor is grpc")
+		}
+	default:
+		return fmt.Errorf("processor must be one of %q or %q", ProcessorEcho, ProcessorGRPC)
+	}
+	if c.GRPC != nil {
+		if c.GRPC.Target == "" {
+			return errors.New("grpc.target is required when grpc section is present")
+		}
+		if c.GRPC.Timeout <= 0 {
+			return errors.New("grpc.timeout must be > 0")
+		}
+	}
+	if c.Reply.Delay < 0 {
+		return errors.New("reply.delay must be >= 0")
+	}
+	if c.Reply.Jitter < 0 {
+		return errors.New("reply.jitter must be >= 0")
+	}
+	if c.Reply.Digest != nil {
+		if c.Reply.Digest.Window <= 0 {
+			return errors.New("reply.digest.window must be > 0")
+		}
+		if c.Reply.Digest.MaxMessages < 0 {
+			return errors.New("reply.digest.max_messages must be >= 0")
+		}
+	}
+	if c.Reply.VERP != nil {
+		switch c.Reply.VERP.Scheme {
+		case VERPSchemeRecipient:
+		case VERPSchemeReplyID:
+			if c.Store == nil {
+				return errors.New("store section is required when reply.verp.scheme is reply_id")
+			}
+		default:
+			return fmt.Errorf("reply.verp.scheme must be one of %q or %q", VERPSchemeRecipient, VERPSchemeReplyID)
+		}
+		if len(c.Reply.VERP.Separator) != 1 || strings.ContainsAny(c.Reply.VERP.Separator, "@=<> ") {
+			return errors.New("reply.verp.separator must be a single character other than @, =, <, >, or space")
+		}
+		if len(c.Reply.VERP.Secret) < 16 {
+			return errors.New("reply.verp.secret must be at least 16 characters")
+		}
+	}
+	if c.Reply.MaxBodyBytes < 0 {
+		return errors.New("reply.max_body_bytes must be >= 0")
+	}
+	switch c.Reply.OversizePolicy {
+	case "", OversizeTruncate, OversizeSummarize, OversizeReject:
+	default:
+		return fmt.Errorf("reply.oversize_policy must be one of %q, %q, or %q", OversizeTruncate, OversizeSummarize, OversizeReject)
+	}
+	switch c.Reply.ParseFailure {
+	case "", ParseFailureReject, ParseFailureDiagnostic, ParseFailureRaw, ParseFailureDrop:
+	default:
+		return fmt.Errorf("reply.parse_failure must be one of %q, %q, %q, or %q", ParseFailureReject, ParseFailureDiagnostic, ParseFailureRaw, ParseFailureDrop)
+	}
+	if c.Reply.FallbackCharset != "" {
+		if _, err := htmlindex.Get(c.Reply.FallbackCharset); err != nil {
+			return fmt.Errorf("reply.fallback_charset %q is not a supported charset", c.Reply.FallbackCharset)
+		}
+	}
+	switch c.Reply.TransferEncoding {
+	case "", TransferEncodingAuto, TransferEncodingQuotedPrintable, TransferEncodingBase64, TransferEncoding8Bit:
+	default:
+		return fmt.Errorf("reply.transfer_encoding must be one of %q, %q, %q, or %q", TransferEncodingAuto, TransferEncodingQuotedPrintable, TransferEncodingBase64, TransferEncoding8Bit)
+	}
+	switch c.Reply.Bounce {
+	case "", BounceModeLog, BounceModeDSN:
+	default:
+		return fmt.Errorf("reply.bounce must be one of %q or %q", BounceModeLog, BounceModeDSN)
+	}
+	if c.Reply.Template != nil {
+		if c.Reply.Template.Text == "" && c.Reply.Template.HTML == "" {
+			return errors.New("reply.template.text or reply.template.html is required when reply.template section is present")
+		}
+		if c.Reply.Template.Text != "" {
+			if _, err := os.Stat(c.Reply.Template.Text); err != nil {
+				return fmt.Errorf("reply.template.text invalid: %w", err)
+			}
+		}
+		if c.Reply.Template.HTML != "" {
+			if _, err := os.Stat(c.Reply.Template.HTML); err != nil {
+				return fmt.Errorf("reply.template.html invalid: %w", err)
+			}
+		}
+	}
+
+	if c.Reply.Script != nil {
+		if c.Reply.Script.Path == "" {
+			return errors.New("reply.script.path is required when reply.script section is present")
+		}
+		if _, err := os.Stat(c.Reply.Script.Path); err != nil {
+			return fmt.Errorf("reply.script.path invalid: %w", err)
+		}
+		if c.Reply.Script.Timeout <= 0 {
+			return errors.New("reply.script.timeout must be > 0")
+		}
+	}
+	if c.Reply.Exec != nil {
+		if len(c.Reply.Exec.Command) == 0 || c.Reply.Exec.Command[0] == "" {
+			return errors.New("reply.exec.command is required when reply.exec section is present")
+		}
+		if _, err := exec.LookPath(c.Reply.Exec.Command[0]); err != nil {
+			return fmt.Errorf("reply.exec.command invalid: %w", err)
+		}
+		if c.Reply.Exec.Timeout <= 0 {
+			return errors.New("reply.exec.timeout must be > 0")
+		}
+	}
+	for key, identity := range c.Reply.Identities {
+		name := fmt.Sprintf("reply.identities[%q]", key)
+		if strings.TrimSpace(key) == "" || strings.ContainsAny(key, " \t") || strings.HasSuffix(key, "@") {
+			return fmt.Errorf("%s key must be an email address or domain", name)
+		}
+		if identity.FromAddress == "" {
+			return fmt.Errorf("%s.from_address is required", name)
+		}
+		if _, err := mail.ParseAddress(identity.FromAddress); err != nil {
+			return fmt.Errorf("%s.from_address invalid: %w", name, err)
+		}
+		if identity.MailFrom != "" {
+			if _, err := mail.ParseAddress(identity.MailFrom); err != nil {
+				return fmt.Errorf("%s.mail_from invalid: %w", name, err)
+			}
+		}
+		if identity.DKIM != nil {
+			if err := validateDKIM(name+".dkim", identity.DKIM); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch c.Delivery.Mode {
+	case DeliveryModeSMTP, DeliveryModeNone, DeliveryModeStdout:
+	case DeliveryModeFile:
+		if c.Delivery.OutputDir == "" {
+			return errors.New("delivery.output_dir is required when delivery.mode is file")
+		}
+	default:
+		return fmt.Errorf("delivery.mode must be one of %q, %q, %q, or %q", DeliveryModeSMTP, DeliveryModeNone, DeliveryModeStdout, DeliveryModeFile)
+	}
+	switch c.Delivery.TLSPolicy {
+	case TLSPolicyOpportunistic, TLSPolicyRequire, TLSPolicyNone:
+	default:
+		return fmt.Errorf("delivery.tls_policy must be one of %q, %q, or %q", TLSPolicyOpportunistic, TLSPolicyRequire, TLSPolicyNone)
+	}
+	switch c.Delivery.MinTLSVersion {
+	case "1.0", "1.1", "1.2", "1.3":
+	default:
+		return errors.New("delivery.min_tls_version must be one of 1.0, 1.1, 1.2, or 1.3")
+	}
+	if c.Delivery.CAFile != "" {
+		if _, err := os.Stat(c.Delivery.CAFile); err != nil {
+			return fmt.Errorf("delivery.ca_file invalid: %w", err)
+		}
+	}
+	switch c.Delivery.IPFamily {
+	case IPFamilyDual, IPFamilyIPv4, IPFamilyIPv6:
+	default:
+		return fmt.Errorf("delivery.ip_family must be one of %q, %q, or %q", IPFamilyDual, IPFamilyIPv4, IPFamilyIPv6)
+	}
+	if c.Delivery.ConnectTimeout <= 0 {
+		return errors.New("delivery.connect_timeout must be > 0")
+	}
+	if c.Delivery.FallbackDelay < 0 {
+		return errors.New("delivery.fallback_delay must be >= 0")
+	}
+	if c.Delivery.SourceIPv4 != "" {
+		if ip := net.ParseIP(c.Delivery.SourceIPv4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("delivery.source_ipv4 %q is not an ipv4 address", c.Delivery.SourceIPv4)
+		}
+	}
+	if c.Delivery.SourceIPv6 != "" {
+		if ip := net.ParseIP(c.Delivery.SourceIPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("delivery.source_ipv6 %q is not an ipv6 address", c.Delivery.SourceIPv6)
+		}
+	}
+	if c.Delivery.Pool != nil {
+		if c.Delivery.Pool.IdleTimeout <= 0 {
+			return errors.New("delivery.pool.idle_timeout must be > 0")
+		}
+		if c.Delivery.Pool.MaxMessages < 0 {
+			return errors.New("delivery.pool.max_messages must be >= 0")
+		}
+		if c.Delivery.Pool.MaxIdlePerHost < 0 {
+			return errors.New("delivery.pool.max_idle_per_host must be >= 0")
+		}
+	}
+	if c.Delivery.Retry != nil {
+		if c.Delivery.Retry.AttemptsPerHost < 0 {
+			return errors.New("delivery.retry.attempts_per_host must be >= 0")
+		}
+		if c.Delivery.Retry.AttemptDelay < 0 {
+			return errors.New("delivery.retry.attempt_delay must be >= 0")
+		}
+		for i, delay := range c.Delivery.Retry.Schedule {
+			if delay <= 0 {
+				return fmt.Errorf("delivery.retry.schedule[%d] must be > 0", i)
+			}
+		}
+		switch c.Delivery.Retry.PermanentFailure {
+		case "", PermanentFailureFail, PermanentFailureNextHost, PermanentFailureRetry:
+		default:
+			return fmt.Errorf("delivery.retry.permanent_failure must be one of %q, %q, or %q", PermanentFailureFail, PermanentFailureNextHost, PermanentFailureRetry)
+		}
+		if c.Delivery.Retry.SkipFailedHosts < 0 {
+			return errors.New("delivery.retry.skip_failed_hosts must be >= 0")
+		}
+	}
+	if c.Delivery.Concurrency != nil {
+		if c.Delivery.Concurrency.Max < 0 {
+			return errors.New("delivery.concurrency.max must be >= 0")
+		}
+		if c.Delivery.Concurrency.PerDomain < 0 {
+			return errors.New("delivery.concurrency.per_domain must be >= 0")
+		}
+		if c.Delivery.Concurrency.Max == 0 && c.Delivery.Concurrency.PerDomain == 0 {
+			return errors.New("delivery.concurrency requires max or per_domain")
+		}
+		if c.Delivery.Concurrency.Max > 0 && c.Delivery.Concurrency.PerDomain > c.Delivery.Concurrency.Max {
+			return errors.New("delivery.concurrency.per_domain must be <= delivery.concurrency.max")
+		}
+	}
+	if c.Delivery.SourceInterface != "" && (c.Delivery.SourceIPv4 != "" || c.Delivery.SourceIPv6 != "") {
+		return errors.New("delivery.source_interface cannot be combined with delivery.source_ipv4 or delivery.source_ipv6")
+	}
+	if !validEHLOName(c.Delivery.EHLOName) {
+		return fmt.Errorf("delivery.ehlo_name %q must be a host name without spaces", c.Delivery.EHLOName)
+	}
+	if pool := c.Delivery.SourcePool; pool != nil {
+		switch pool.Selection {
+		case SourceSelectionRoundRobin, SourceSelectionDomain:
+		default:
+			return fmt.Errorf("delivery.source_pool.selection must be one of %q or %q", SourceSelectionRoundRobin, SourceSelectionDomain)
+		}
+		if len(pool.Addresses) == 0 {
+			return errors.New("delivery.source_pool.addresses is required when delivery.source_pool is set")
+		}
+		if c.Delivery.SourceIPv4 != "" || c.Delivery.SourceIPv6 != "" || c.Delivery.SourceInterface != "" {
+			return errors.New("delivery.source_pool cannot be combined with delivery.source_ipv4, delivery.source_ipv6, or delivery.source_interface")
+		}
+		seen := make(map[string]bool, len(pool.Addresses))
+		for i, address := range pool.Addresses {
+			ip := net.ParseIP(address.IP)
+			if ip == nil {
+				return fmt.Errorf("delivery.source_pool.addresses[%d].ip %q is not an ip address", i, address.IP)
+			}
+			if seen[ip.String()] {
+				return fmt.Errorf("delivery.source_pool.addresses[%d].ip %q is listed twice", i, address.IP)
+			}
+			seen[ip.String()] = true
+			if !validEHLOName(address.EHLOName) {
+				return fmt.Errorf("delivery.source_pool.addresses[%d].ehlo_name %q must be a host name without spaces", i, address.EHLOName)
+			}
+		}
+	}
+	for pattern, target := range c.Delivery.DomainOverrides {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("delivery.domain_overrides pattern %q is invalid: %w", pattern, err)
+		}
+		if target == "" {
+			return fmt.Errorf("delivery.domain_overrides[%q] must be a host or host:port", pattern)
+		}
+		if _, port, err := net.SplitHostPort(target); err == nil && port == "" {
+			return fmt.Errorf("delivery.domain_overrides[%q] has an empty port", pattern)
+		}
+	}
+	if c.Delivery.Proxy != "" {
+		proxyURL, err := url.Parse(c.Delivery.Proxy)
+		if err != nil {
+			return fmt.Errorf("delivery.proxy invalid: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return errors.New("delivery.proxy scheme must be one of socks5, socks5h, or http")
+		}
+		if proxyURL.Host == "" {
+			return errors.New("delivery.proxy must include a host")
+		}
+		if c.Delivery.SourceIPv4 != "" || c.Delivery.SourceIPv6 != "" || c.Delivery.SourceInterface != "" || c.Delivery.SourcePool != nil {
+			return errors.New("delivery.proxy cannot be combined with delivery source addresses")
+		}
+	}
+
+	if c.DKIM != nil {
+		if err := validateDKIM("dkim", c.DKIM); err != nil {
+			return err
+		}
+	}
 
-func Load(path string) (Config, error) {
-	cfg := Config{
-		ListenAddr:      ":25",
-		ReadTimeout:     30 * time.Second,
-		WriteTimeout:    30 * time.Second,
-		MaxMessageBytes: 10 * 1024 * 1024,
+	if c.RateLimit != nil {
+		limits := []struct {
+			name  string
+			limit *RateLimit
+		}{
+			{"per_ip", c.RateLimit.PerIP},
+			{"per_sender", c.RateLimit.PerSender},
+			{"global", c.RateLimit.Global},
+		}
+		for _, entry := range limits {
+			name, limit := entry.name, entry.limit
+			if limit == nil {
+				continue
+			}
+			if limit.Rate <= 0 {
+				return fmt.Errorf("rate_limit.%s.rate must be > 0", name)
+			}
+			if limit.Per <= 0 {
+				return fmt.Errorf("rate_limit.%s.per must be > 0", name)
+			}
+			if limit.Burst < 0 {
+				return fmt.Errorf("rate_limit.%s.burst must be >= 0", name)
+			}
+		}
 	}
 
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return Config{}, fmt.Errorf("read config: %w", err)
+	if c.Limits != nil {
+		if c.Limits.MaxConnections < 0 {
+			return errors.New("limits.max_connections must be >= 0")
+		}
+		if c.Limits.MaxConnectionsPerIP < 0 {
+			return errors.New("limits.max_connections_per_ip must be >= 0")
+		}
+		if c.Limits.IdleTimeout < 0 {
+			return errors.New("limits.idle_timeout must be >= 0")
+		}
+		if c.Limits.BannerTimeout < 0 {
+			return errors.New("limits.banner_timeout must be >= 0")
+		}
+		if c.Limits.CommandTimeout < 0 {
+			return errors.New("limits.command_timeout must be >= 0")
+		}
+		if c.Limits.DataTimeout < 0 {
+			return errors.New("limits.data_timeout must be >= 0")
+		}
+		if c.Limits.MaxSessionDuration < 0 {
+			return errors.New("limits.max_session_duration must be >= 0")
+		}
+		if c.Limits.MaxRecipients < 0 {
+			return errors.New("limits.max_recipients must be >= 0")
+		}
+		if c.Limits.MaxBacklog < 0 {
+			return errors.New("limits.max_backlog must be >= 0")
+		}
 	}
 
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return Config{}, fmt.Errorf("parse config yaml: %w", err)
+	if c.Recipients != nil {
+		switch c.Recipients.Mode {
+		case RecipientModeAny:
+		case RecipientModeStrict:
+			if len(c.Recipients.Addresses) == 0 {
+				return errors.New("recipients.addresses is required when recipients.mode is strict")
+			}
+		case RecipientModeCatchAll:
+			if len(c.Recipients.Domains) == 0 {
+				return errors.New("recipients.domains is required when recipients.mode is catch_all")
+			}
+		default:
+			return fmt.Errorf("recipients.mode must be one of %q, %q, or %q", RecipientModeAny, RecipientModeStrict, RecipientModeCatchAll)
+		}
+		for _, address := range c.Recipients.Addresses {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return fmt.Errorf("recipients.addresses %q is invalid: %w", address, err)
+			}
+		}
+		for _, domain := range c.Recipients.Domains {
+			if domain == "" || strings.ContainsAny(domain, "@ ") {
+				return fmt.Errorf("recipients.domains %q is not a domain", domain)
+			}
+		}
+		if strings.ContainsAny(c.Recipients.TagSeparator, "@ ") {
+			return fmt.Errorf("recipients.tag_separator %q must not contain @ or spaces", c.Recipients.TagSeparator)
+		}
 	}
 
-	if err := cfg.validate(); err != nil {
-		return Config{}, err
+	if c.Greylist != nil {
+		if c.Greylist.Delay < 0 {
+			return errors.New("greylist.delay must be >= 0")
+		}
+		if c.Greylist.Window <= c.Greylist.Delay {
+			return errors.New("greylist.window must be greater than greylist.delay")
+		}
+		if c.Greylist.Expiry <= 0 {
+			return errors.New("greylist.expiry must be > 0")
+		}
 	}
 
-	return cfg, nil
-}
+	if c.Reputation != nil {
+		if c.Reputation.Window <= 0 {
+			return errors.New("reputation.window must be > 0")
+		}
+		if c.Reputation.MinEvents <= 0 {
+			return errors.New("reputation.min_events must be > 0")
+		}
+		if c.Reputation.TempfailScore < 0 || c.Reputation.TempfailScore > 100 {
+			return errors.New("reputation.tempfail_score must be between 0 and 100")
+		}
+		if c.Reputation.BlockScore < 0 || c.Reputation.BlockScore > c.Reputation.TempfailScore {
+			return errors.New("reputation.block_score must be between 0 and reputation.tempfail_score")
+		}
+		if c.Reputation.BlockDuration <= 0 {
+			return errors.New("reputation.block_duration must be > 0")
+		}
+		if c.Reputation.MaxEntries < 0 {
+			return errors.New("reputation.max_entries must be >= 0")
+		}
+	}
 
-func (c Config) validate() error {
-	if c.ListenAddr == "" {
-		return errors.New("listen_addr is required")
+	if c.Dedup != nil {
+		switch c.Dedup.Key {
+		case DedupKeyMessageID, DedupKeyBodyHash:
+		default:
+			return fmt.Errorf("dedup.key must be one of %q or %q", DedupKeyMessageID, DedupKeyBodyHash)
+		}
+		if c.Dedup.Window <= 0 {
+			return errors.New("dedup.window must be > 0")
+		}
+		if c.Dedup.MaxEntries < 0 {
+			return errors.New("dedup.max_entries must be >= 0")
+		}
 	}
-	if c.Hostname == "" {
-		return errors.New("hostname is required")
+
+	if c.Chaos != nil {
+		probabilities := []struct {
+			name  string
+			value float64
+		}{
+			{"mail_error", c.Chaos.MailError},
+			{"rcpt_error", c.Chaos.RcptError},
+			{"data_error", c.Chaos.DataError},
+			{"permanent", c.Chaos.Permanent},
+			{"slow", c.Chaos.Slow},
+			{"drop", c.Chaos.Drop},
+			{"reply_delay", c.Chaos.ReplyDelay},
+		}
+		for _, probability := range probabilities {
+			if probability.value < 0 || probability.value > 1 {
+				return fmt.Errorf("chaos.%s must be between 0 and 1", probability.name)
+			}
+		}
+		if c.Chaos.SlowDelay < 0 {
+			return errors.New("chaos.slow_delay must be >= 0")
+		}
+		if c.Chaos.MaxReplyDelay < 0 {
+			return errors.New("chaos.max_reply_delay must be >= 0")
+		}
 	}
-	if c.ReadTimeout <= 0 {
-		return errors.New("read_timeout must be > 0")
+
+	if c.SenderVerify != nil {
+		if c.SenderVerify.Timeout <= 0 {
+			return errors.New("sender_verify.timeout must be > 0")
+		}
+		if c.SenderVerify.CacheTTL < 0 {
+			return errors.New("sender_verify.cache_ttl must be >= 0")
+		}
 	}
-	if c.WriteTimeout <= 0 {
-		return errors.New("write_timeout must be > 0")
+
+	if c.DNSBL != nil {
+		if len(c.DNSBL.Zones) == 0 {
+			return errors.New("dnsbl.zones is required when dnsbl section is present")
+		}
+		for _, zone := range c.DNSBL.Zones {
+			if zone == "" || strings.ContainsAny(zone, "@ /") {
+				return fmt.Errorf("dnsbl.zones %q is not a domain", zone)
+			}
+		}
+		switch c.DNSBL.Policy {
+		case DNSBLPolicyLog, DNSBLPolicyTag, DNSBLPolicyReject:
+		default:
+			return fmt.Errorf("dnsbl.policy must be one of %q, %q, or %q", DNSBLPolicyLog, DNSBLPolicyTag, DNSBLPolicyReject)
+		}
+		if c.DNSBL.Timeout <= 0 {
+			return errors.New("dnsbl.timeout must be > 0")
+		}
+		if c.DNSBL.CacheTTL < 0 {
+			return errors.New("dnsbl.cache_ttl must be >= 0")
+		}
 	}
-	if c.MaxMessageBytes <= 0 {
-		return errors.New("max_message_bytes must be > 0")
+
+	if c.Helo != nil {
+		for _, check := range c.Helo.Checks {
+			switch check {
+			case HeloCheckFQDN, HeloCheckResolves, HeloCheckNotSelf, HeloCheckNotIP:
+			default:
+				return fmt.Errorf("helo.checks entry %q must be one of %q, %q, %q, or %q", check, HeloCheckFQDN, HeloCheckResolves, HeloCheckNotSelf, HeloCheckNotIP)
+			}
+		}
+		switch c.Helo.Policy {
+		case HeloPolicyLog, HeloPolicyReject:
+		default:
+			return fmt.Errorf("helo.policy must be %q or %q", HeloPolicyLog, HeloPolicyReject)
+		}
+		if c.Helo.Timeout <= 0 {
+			return errors.New("helo.timeout must be > 0")
+		}
 	}
-	if c.Reply.FromAddress == "" {
-		return errors.New("reply.from_address is required")
+
+	if c.RDNS != nil {
+		switch c.RDNS.Policy {
+		case RDNSPolicyLog, RDNSPolicyRejectMissing, RDNSPolicyRejectMismatch:
+		default:
+			return fmt.Errorf("rdns.policy must be one of %q, %q, or %q", RDNSPolicyLog, RDNSPolicyRejectMissing, RDNSPolicyRejectMismatch)
+		}
+		if c.RDNS.Timeout <= 0 {
+			return errors.New("rdns.timeout must be > 0")
+		}
 	}
-	if c.Reply.MailFrom == "" {
-		return errors.New("reply.mail_from is required")
+
+	if c.DNS != nil {
+		if len(c.DNS.Servers) == 0 {
+			return errors.New("dns.servers is required when dns section is present")
+		}
+		if c.DNS.TLS && c.DNS.TLSServerName == "" {
+			return errors.New("dns.tls_server_name is required when dns.tls is true")
+		}
+		if c.DNS.Timeout <= 0 {
+			return errors.New("dns.timeout must be > 0")
+		}
+		if c.DNS.CacheSize < 0 {
+			return errors.New("dns.cache_size must be >= 0")
+		}
+		if c.DNS.MaxTTL < 0 {
+			return errors.New("dns.max_ttl must be >= 0")
+		}
 	}
 
-	if _, err := mail.ParseAddress(c.Reply.FromAddress); err != nil {
-		return fmt.Errorf("reply.from_address invalid: %w", err)
+	if c.Suppression != nil {
+		for _, pattern := range c.Suppression.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("suppression.patterns %q is invalid: %w", pattern, err)
+			}
+		}
+		if c.Suppression.BounceThreshold < 0 {
+			return errors.New("suppression.bounce_threshold must be >= 0")
+		}
 	}
-	if _, err := mail.ParseAddress(c.Reply.MailFrom); err != nil {
-		return fmt.Errorf("reply.mail_from invalid: %w", err)
+
+	if c.Forward != nil {
+		if err := validateForward(*c.Forward); err != nil {
+			return err
+		}
 	}
 
-	if c.DKIM != nil {
-		if c.DKIM.Domain == "" {
-			return errors.New("dkim.domain is required when dkim section is present")
+	if c.Reports != nil {
+		if len(c.Reports.Addresses) == 0 {
+			return errors.New("reports.addresses is required when reports section is present")
+		}
+		for _, address := range c.Reports.Addresses {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return fmt.Errorf("reports.addresses %q is invalid: %w", address, err)
+			}
+		}
+		if c.Reports.MaxReports < 0 {
+			return errors.New("reports.max_reports must be >= 0")
+		}
+	}
+
+	if c.Admin != nil {
+		if c.Admin.ListenAddr == "" {
+			return errors.New("admin.listen_addr is required when admin section is present")
+		}
+		if c.Admin.Token == "" {
+			return errors.New("admin.token is required when admin section is present")
+		}
+	}
+
+	if c.Tracing != nil {
+		if c.Tracing.Endpoint == "" {
+			return errors.New("tracing.endpoint is required when tracing section is present")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			return errors.New("tracing.sample_ratio must be between 0 and 1")
+		}
+	}
+	if c.Responses != nil {
+		if strings.ContainsAny(c.Responses.Banner, "\r\n") {
+			return errors.New("responses.banner must be a single line")
+		}
+		for name, message := range c.Responses.Messages {
+			if !slices.Contains(ResponseNames, name) {
+				return fmt.Errorf("responses.messages has unknown response %q", name)
+			}
+			if message == "" || strings.ContainsAny(message, "\r\n") {
+				return fmt.Errorf("responses.messages.%s must be a single non-empty line", name)
+			}
+		}
+	}
+	if c.Queue != nil {
+		if c.Queue.Path == "" {
+			return errors.New("queue.path is required when queue section is present")
+		}
+		if c.Queue.ClaimTimeout <= 0 {
+			return errors.New("queue.claim_timeout must be > 0")
+		}
+	}
+	if c.Store != nil {
+		switch c.Store.Driver {
+		case "sqlite":
+			if c.Store.Path == "" {
+				return errors.New("store.path is required for the sqlite driver")
+			}
+		case "memory":
+		default:
+			return fmt.Errorf("store.driver %q is not supported: use sqlite or memory", c.Store.Driver)
+		}
+		if c.Store.Retention < 0 {
+			return errors.New("store.retention must be >= 0")
+		}
+		if c.Store.PruneInterval <= 0 {
+			return errors.New("store.prune_interval must be > 0")
+		}
+	}
+
+	if c.Archive != nil {
+		switch c.Archive.Format {
+		case ArchiveFormatMaildir, ArchiveFormatMbox:
+		default:
+			return fmt.Errorf("archive.format %q is not supported: use maildir or mbox", c.Archive.Format)
+		}
+		if c.Archive.Path == "" {
+			return errors.New("archive.path is required when archive section is present")
+		}
+		if c.Archive.MaxSize < 0 {
+			return errors.New("archive.max_size must be >= 0")
+		}
+		if c.Archive.Retention < 0 {
+			return errors.New("archive.retention must be >= 0")
+		}
+	}
+	if c.Quarantine != nil && c.Quarantine.Path == "" {
+		return errors.New("quarantine.path is required when quarantine section is present")
+	}
+
+	if c.Ingest != nil {
+		if c.Ingest.Socket == "" {
+			return errors.New("ingest.socket is required when ingest section is present")
+		}
+		if mode, err := strconv.ParseUint(c.Ingest.SocketMode, 8, 32); err != nil || mode > 0o777 {
+			return errors.New("ingest.socket_mode must be an octal permission such as \"0660\"")
+		}
+	}
+
+	if c.IMAP != nil {
+		if c.IMAP.ListenAddr == "" {
+			return errors.New("imap.listen_addr is required when imap section is present")
+		}
+		if c.IMAP.Username == "" {
+			return errors.New("imap.username is required when imap section is present")
+		}
+		if c.IMAP.Password == "" {
+			return errors.New("imap.password is required when imap section is present")
+		}
+		if c.Store == nil {
+			return errors.New("store section is required when imap section is present")
+		}
+	}
+
+	for i, webhook := range c.Webhooks {
+		parsed, err := url.Parse(webhook.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("webhooks[%d].url must be an absolute http(s) url", i)
+		}
+		if webhook.Timeout < 0 {
+			return fmt.Errorf("webhooks[%d].timeout must be >= 0", i)
+		}
+		if webhook.MaxAttempts < 0 {
+			return fmt.Errorf("webhooks[%d].max_attempts must be >= 0", i)
+		}
+	}
+
+	for i, rule := range c.Rules {
+		if rule.Match == "" && rule.Sender == "" && rule.Subject == "" && rule.MinSize == 0 && rule.MaxSize == 0 && rule.Auth == nil && rule.Connection == nil {
+			return fmt.Errorf("rules[%d] requires match, sender, subject, min_size, max_size, auth, or connection", i)
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return fmt.Errorf("rules[%d].match is not a valid pattern: %w", i, err)
+		}
+		if _, err := path.Match(rule.Sender, ""); err != nil {
+			return fmt.Errorf("rules[%d].sender is not a valid pattern: %w", i, err)
+		}
+		if _, err := regexp.Compile(rule.Subject); err != nil {
+			return fmt.Errorf("rules[%d].subject is invalid: %w", i, err)
+		}
+		if rule.MinSize < 0 || rule.MaxSize < 0 {
+			return fmt.Errorf("rules[%d].min_size and max_size must be >= 0", i)
+		}
+		if rule.MaxSize > 0 && rule.MaxSize < rule.MinSize {
+			return fmt.Errorf("rules[%d].max_size must be >= min_size", i)
+		}
+		if rule.Auth != nil {
+			for name, result := range map[string]string{"spf": rule.Auth.SPF, "dkim": rule.Auth.DKIM, "dmarc": rule.Auth.DMARC} {
+				if result != "" && !slices.Contains(ruleAuthResults, strings.TrimPrefix(result, "!")) {
+					return fmt.Errorf("rules[%d].auth.%s must be one of %q, optionally prefixed with \"!\"", i, name, ruleAuthResults)
+				}
+			}
+			if rule.Auth.SPF == "" && rule.Auth.DKIM == "" && rule.Auth.DMARC == "" {
+				return fmt.Errorf("rules[%d].auth requires spf, dkim, or dmarc", i)
+			}
+		}
+		if conn := rule.Connection; conn != nil {
+			if len(conn.RemoteIP) == 0 && conn.Helo == "" && conn.TLS == nil && conn.Authenticated == nil {
+				return fmt.Errorf("rules[%d].connection requires remote_ip, helo, tls, or authenticated", i)
+			}
+			for _, entry := range conn.RemoteIP {
+				if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+					return fmt.Errorf("rules[%d].connection.remote_ip entry %q is not an ip or cidr", i, entry)
+				}
+			}
+			if _, err := path.Match(conn.Helo, ""); err != nil {
+				return fmt.Errorf("rules[%d].connection.helo is not a valid pattern: %w", i, err)
+			}
+		}
+		switch rule.Action {
+		case RuleActionReject:
+			if rule.Code < 400 || rule.Code > 599 {
+				return fmt.Errorf("rules[%d].code must be between 400 and 599", i)
+			}
+			if rule.EnhancedCode != "" && (!enhancedCodePattern.MatchString(rule.EnhancedCode) || !strings.HasPrefix(rule.EnhancedCode, fmt.Sprintf("%d.", rule.Code/100))) {
+				return fmt.Errorf("rules[%d].enhanced_code must be a status code like %d.1.1 in the same class as code", i, rule.Code/100)
+			}
+		case RuleActionFilter:
+			if len(rule.Filters) == 0 {
+				return fmt.Errorf("rules[%d].filters is required when action is %q", i, RuleActionFilter)
+			}
+		case RuleActionTag:
+			if rule.Tag == "" {
+				return fmt.Errorf("rules[%d].tag is required when action is %q", i, RuleActionTag)
+			}
+		case RuleActionForward:
+			if len(rule.ForwardTo) == 0 {
+				return fmt.Errorf("rules[%d].forward_to is required when action is %q", i, RuleActionForward)
+			}
+			for _, address := range rule.ForwardTo {
+				if _, err := mail.ParseAddress(address); err != nil {
+					return fmt.Errorf("rules[%d].forward_to %q is invalid: %w", i, address, err)
+				}
+			}
+		case RuleActionEcho, RuleActionDrop, RuleActionDelay, RuleActionBounce:
+		default:
+			return fmt.Errorf("rules[%d].action must be one of %q, %q, %q, %q, %q, %q, %q or %q", i, RuleActionEcho, RuleActionReject, RuleActionDrop, RuleActionDelay, RuleActionBounce, RuleActionFilter, RuleActionTag, RuleActionForward)
+		}
+		if rule.Tag != "" && rule.Action != RuleActionTag {
+			return fmt.Errorf("rules[%d].tag is only allowed when action is %q", i, RuleActionTag)
+		}
+		if strings.ContainsAny(rule.Tag, "\r\n") {
+			return fmt.Errorf("rules[%d].tag must be a single line", i)
+		}
+		if len(rule.ForwardTo) > 0 && rule.Action != RuleActionForward {
+			return fmt.Errorf("rules[%d].forward_to is only allowed when action is %q", i, RuleActionForward)
+		}
+		if rule.Delay < 0 {
+			return fmt.Errorf("rules[%d].delay must be >= 0", i)
+		}
+		if len(rule.Filters) > 0 && rule.Action != RuleActionFilter && rule.Action != RuleActionDelay {
+			return fmt.Errorf("rules[%d].filters is only allowed when action is %q or %q", i, RuleActionFilter, RuleActionDelay)
+		}
+		for _, name := range rule.Filters {
+			if _, ok := c.Filters[name]; !ok {
+				return fmt.Errorf("rules[%d].filters %q is not defined in filters", i, name)
+			}
+		}
+	}
+
+	for name, chain := range c.Filters {
+		if name == "" || name != strings.ToLower(name) {
+			return fmt.Errorf("filters %q must be a non-empty lowercase name", name)
 		}
-		if c.DKIM.Selector == "" {
-			return errors.New("dkim.selector is required when dkim section is present")
+		if len(chain) == 0 {
+			return fmt.Errorf("filters.%s must have at least one filter", name)
 		}
-		if c.DKIM.PrivateKeyPath == "" {
-			return errors.New("dkim.private_key_path is required when dkim section is present")
+		for i, filter := range chain {
+			switch filter.Type {
+			case FilterUppercase, FilterReverse, FilterROT13, FilterStripQuotes:
+			case FilterReplace:
+				if filter.Pattern == "" {
+					return fmt.Errorf("filters.%s[%d].pattern is required when type is %q", name, i, FilterReplace)
+				}
+				if _, err := regexp.Compile(filter.Pattern); err != nil {
+					return fmt.Errorf("filters.%s[%d].pattern is invalid: %w", name, i, err)
+				}
+			case FilterFooter:
+				if filter.Text == "" {
+					return fmt.Errorf("filters.%s[%d].text is required when type is %q", name, i, FilterFooter)
+				}
+			default:
+				return fmt.Errorf("filters.%s[%d].type must be one of %q, %q, %q, %q, %q, or %q", name, i, FilterUppercase, FilterReverse, FilterROT13, FilterReplace, FilterStripQuotes, FilterFooter)
+			}
 		}
-		if _, err := os.Stat(c.DKIM.PrivateKeyPath); err != nil {
-			return fmt.Errorf("dkim.private_key_path invalid: %w", err)
+	}
+
+	if c.TLS != nil {
+		if c.TLS.CertFile == "" {
+			return errors.New("tls.cert_file is required when tls section is present")
+		}
+		if c.TLS.KeyFile == "" {
+			return errors.New("tls.key_file is required when tls section is present")
+		}
+		switch c.TLS.ClientAuth {
+		case "", ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+		default:
+			return fmt.Errorf("tls.client_auth must be one of %q, %q, or %q", ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+		}
+		if c.TLS.ClientCAFile != "" && c.TLS.ClientAuth == ClientAuthNone {
+			return errors.New("tls.client_ca_file requires tls.client_auth request or require")
+		}
+	}
+
+	if c.Auth != nil {
+		if len(c.Auth.Users) == 0 {
+			return errors.New("auth.users is required when auth section is present")
+		}
+		for i, user := range c.Auth.Users {
+			if user.Username == "" {
+				return fmt.Errorf("auth.users[%d].username is required", i)
+			}
+			if user.Password == "" {
+				return fmt.Errorf("auth.users[%d].password is required", i)
+			}
+		}
+		if c.TLS == nil && !c.Auth.AllowInsecure {
+			return errors.New("auth requires a tls section unless auth.allow_insecure is true")
+		}
+	}
+
+	return nil
+}
+
+func validateDKIM(name string, cfg *DKIMConfig) error {
+	if cfg.Domain == "" {
+		return fmt.Errorf("%s.domain is required when %s section is present", name, name)
+	}
+	sources := 0
+	for _, set := range []bool{cfg.PrivateKeyPath != "", cfg.PrivateKey != "", cfg.PrivateKeyEnv != "", len(cfg.PrivateKeyCommand) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("%s.private_key_path, private_key, private_key_env, and private_key_command are mutually exclusive", name)
+	}
+	if len(cfg.Keys) == 0 && cfg.KeyDir == "" {
+		if cfg.Selector == "" {
+			return fmt.Errorf("%s.selector is required when %s section is present", name, name)
+		}
+		if sources == 0 {
+			return fmt.Errorf("%s.private_key_path, private_key, private_key_env, or private_key_command is required when %s section is present", name, name)
+		}
+	}
+	if sources > 0 && cfg.Selector == "" {
+		return fmt.Errorf("%s.selector is required when a %s private key is set", name, name)
+	}
+	if cfg.PrivateKeyPath != "" {
+		if _, err := os.Stat(cfg.PrivateKeyPath); err != nil {
+			return fmt.Errorf("%s.private_key_path invalid: %w", name, err)
+		}
+	}
+	if cfg.PrivateKeyEnv != "" && os.Getenv(cfg.PrivateKeyEnv) == "" {
+		return fmt.Errorf("%s.private_key_env: environment variable %s is not set", name, cfg.PrivateKeyEnv)
+	}
+	for i, key := range cfg.Keys {
+		if key.Selector == "" {
+			return fmt.Errorf("%s.keys[%d].selector is required", name, i)
+		}
+		if key.PrivateKeyPath == "" {
+			return fmt.Errorf("%s.keys[%d].private_key_path is required", name, i)
+		}
+		if _, err := os.Stat(key.PrivateKeyPath); err != nil {
+			return fmt.Errorf("%s.keys[%d].private_key_path invalid: %w", name, i, err)
+		}
+		if !key.NotBefore.IsZero() && !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore) {
+			return fmt.Errorf("%s.keys[%d].not_after must be after not_before", name, i)
+		}
+	}
+	if cfg.KeyDir != "" {
+		if info, err := os.Stat(cfg.KeyDir); err != nil {
+			return fmt.Errorf("%s.key_dir invalid: %w", name, err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s.key_dir must be a directory", name)
 		}
 	}
+	if cfg.RotationDelay < 0 {
+		return fmt.Errorf("%s.rotation_delay must be >= 0", name)
+	}
+	if len(cfg.Headers) > 0 && !slices.ContainsFunc(cfg.Headers, func(header string) bool { return strings.EqualFold(header, "From") }) {
+		return fmt.Errorf("%s.headers must include From", name)
+	}
+	if cfg.Canonicalization != "" {
+		header, body, _ := strings.Cut(cfg.Canonicalization, "/")
+		for _, value := range []string{header, body} {
+			if value != "" && value != DKIMCanonicalizationSimple && value != DKIMCanonicalizationRelaxed {
+				return fmt.Errorf("%s.canonicalization must be %q or %q for the header and body, such as %q", name, DKIMCanonicalizationSimple, DKIMCanonicalizationRelaxed, "relaxed/simple")
+			}
+		}
+	}
+	if cfg.Expiry < 0 {
+		return fmt.Errorf("%s.expiry must be >= 0", name)
+	}
+	if cfg.BodyLength < 0 {
+		return fmt.Errorf("%s.body_length must be >= 0", name)
+	}
+	return nil
+}
+
+func validateCompliance(cfg *ComplianceConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.ListID == "" && cfg.UnsubscribeMailto == "" && cfg.UnsubscribeURL == "" && cfg.FeedbackID == "" {
+		return errors.New("reply.compliance requires list_id, unsubscribe_mailto, unsubscribe_url, or feedback_id")
+	}
+	for name, value := range map[string]string{"list_id": cfg.ListID, "feedback_id": cfg.FeedbackID, "unsubscribe_url": cfg.UnsubscribeURL} {
+		if strings.ContainsAny(value, "\r\n<>") {
+			return fmt.Errorf("reply.compliance.%s must be a single line without angle brackets", name)
+		}
+	}
+	if cfg.UnsubscribeMailto != "" {
+		if _, err := mail.ParseAddress(cfg.UnsubscribeMailto); err != nil {
+			return fmt.Errorf("reply.compliance.unsubscribe_mailto invalid: %w", err)
+		}
+	}
+	if cfg.UnsubscribeURL != "" {
+		parsed, err := url.Parse(strings.ReplaceAll(cfg.UnsubscribeURL, "{recipient}", "recipient"))
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return errors.New("reply.compliance.unsubscribe_url must be an http or https URL")
+		}
+		if cfg.OneClick && parsed.Scheme != "https" {
+			return errors.New("reply.compliance.unsubscribe_url must use https when one_click is true")
+		}
+	} else if cfg.OneClick {
+		return errors.New("reply.compliance.unsubscribe_url is required when one_click is true")
+	}
+	return nil
+}
 
+func validateForward(cfg ForwardConfig) error {
+	if len(cfg.To) == 0 {
+		return errors.New("forward.to is required when forward section is present")
+	}
+	for _, address := range cfg.To {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("forward.to %q is invalid: %w", address, err)
+		}
+	}
+	switch cfg.Mode {
+	case ForwardModeCopy, ForwardModeOnly:
+	default:
+		return fmt.Errorf("forward.mode must be one of %q or %q", ForwardModeCopy, ForwardModeOnly)
+	}
+	if _, err := mail.ParseAddress(cfg.MailFrom); err != nil {
+		return fmt.Errorf("forward.mail_from invalid: %w", err)
+	}
+	if cfg.Relay != "" {
+		if _, _, err := net.SplitHostPort(cfg.Relay); err != nil {
+			return fmt.Errorf("forward.relay must be host:port: %w", err)
+		}
+	} else if cfg.Username != "" {
+		return errors.New("forward.relay is required when forward.username is set")
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return errors.New("forward.username and forward.password must be set together")
+	}
+	switch cfg.TLSPolicy {
+	case TLSPolicyOpportunistic, TLSPolicyRequire, TLSPolicyNone:
+	default:
+		return fmt.Errorf("forward.tls_policy must be one of %q, %q, or %q", TLSPolicyOpportunistic, TLSPolicyRequire, TLSPolicyNone)
+	}
+	if cfg.Username != "" && cfg.TLSPolicy != TLSPolicyRequire {
+		return fmt.Errorf("forward.tls_policy must be %q when forward.username is set", TLSPolicyRequire)
+	}
 	return nil
 }
+
+func validEHLOName(name string) bool {
+	return !strings.ContainsAny(name, " \t\r\n")
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+const EnvPrefix = "SMTP_ECHO_"
+
+type Overrides map[string]string
+
+type overrideField struct {
+	path string
+	typ  reflect.Type
+}
+
+func configFields() []overrideField {
+	var fields []overrideField
+	var walk func(prefix string, typ reflect.Type)
+	walk = func(prefix string, typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			structField := typ.Field(i)
+			name, _, _ := strings.Cut(structField.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			field := overrideField{path: prefix + name, typ: structField.Type}
+			fields = append(fields, field)
+			if section := derefType(field.typ); section.Kind() == reflect.Struct && section.PkgPath() == typ.PkgPath() {
+				walk(field.path+".", section)
+			}
+		}
+	}
+	walk("", reflect.TypeOf(Config{}))
+	return fields
+}
+
+func derefType(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Pointer {
+		return typ.Elem()
+	}
+	return typ
+}
+
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+func envOverrides() Overrides {
+	overrides := Overrides{}
+	for _, field := range configFields() {
+		if value := os.Getenv(EnvName(field.path)); value != "" {
+			overrides[field.path] = value
+		}
+	}
+	return overrides
+}
+
+type overrideFlag struct {
+	overrides Overrides
+	path      string
+	isBool    bool
+}
+
+func (f *overrideFlag) String() string {
+	if f == nil || f.overrides == nil {
+		return ""
+	}
+	return f.overrides[f.path]
+}
+
+func (f *overrideFlag) Set(value string) error {
+	f.overrides[f.path] = value
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func RegisterFlags(flags *flag.FlagSet) Overrides {
+	overrides := Overrides{}
+	for _, field := range configFields() {
+		flags.Var(&overrideFlag{overrides: overrides, path: field.path, isBool: field.typ.Kind() == reflect.Bool},
+			field.path, fmt.Sprintf("Set %s (overrides %s and the config file)", field.path, EnvName(field.path)))
+	}
+	return overrides
+}
+
+func (o Overrides) apply(cfg *Config, source func(path string) string) error {
+	fields := configFields()
+	sort.SliceStable(fields, func(i, j int) bool {
+		return strings.Count(fields[i].path, ".") < strings.Count(fields[j].path, ".")
+	})
+	for _, field := range fields {
+		raw, ok := o[field.path]
+		if !ok {
+			continue
+		}
+		value, err := overrideValue(field.typ, raw)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", source(field.path), err)
+		}
+		keys := strings.Split(field.path, ".")
+		for i := len(keys) - 1; i >= 0; i-- {
+			value = map[string]any{keys[i]: value}
+		}
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", source(field.path), err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return fmt.Errorf("parse %s: %w", source(field.path), err)
+		}
+	}
+	return nil
+}
+
+func overrideValue(typ reflect.Type, raw string) (any, error) {
+	switch derefType(typ).Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Slice:
+		elem := typ.Elem()
+		if (elem.Kind() == reflect.String || elem == reflect.TypeOf(time.Duration(0))) && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			var values []any
+			for _, value := range strings.Split(raw, ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+			return values, nil
+		}
+	}
+
+	var value any
+	if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad_Overrides(t *testing.T) {
+	const base = "hostname: yaml.example.com\nreply:\n  from_address: echo@example.com\n  mail_from: bounce@example.com\n"
+	required := map[string]string{
+		"SMTP_ECHO_HOSTNAME":           "env.example.com",
+		"SMTP_ECHO_REPLY_FROM_ADDRESS": "echo@example.com",
+		"SMTP_ECHO_REPLY_MAIL_FROM":    "bounce@example.com",
+	}
+
+	tests := []struct {
+		name  string
+		yaml  string
+		env   map[string]string
+		flags []string
+		got   func(Config) any
+		want  any
+		err   string
+	}{
+		{
+			name: "yaml",
+			yaml: base,
+			got:  func(cfg Config) any { return cfg.Hostname },
+			want: "yaml.example.com",
+		},
+		{
+			name: "env over yaml",
+			yaml: base,
+			env:  map[string]string{"SMTP_ECHO_HOSTNAME": "env.example.com"},
+			got:  func(cfg Config) any { return cfg.Hostname },
+			want: "env.example.com",
+		},
+		{
+			name:  "flag over env",
+			yaml:  base,
+			env:   map[string]string{"SMTP_ECHO_HOSTNAME": "env.example.com"},
+			flags: []string{"-hostname=flag.example.com"},
+			got:   func(cfg Config) any { return cfg.Hostname },
+			want:  "flag.example.com",
+		},
+		{
+			name: "no config file",
+			env:  required,
+			got:  func(cfg Config) any { return []any{cfg.Hostname, cfg.ReadTimeout} },
+			want: []any{"env.example.com", Default().ReadTimeout},
+		},
+		{
+			name: "duration",
+			yaml: base,
+			env:  map[string]string{"SMTP_ECHO_READ_TIMEOUT": "90s"},
+			got:  func(cfg Config) any { return cfg.ReadTimeout },
+			want: 90 * time.Second,
+		},
+		{
+			name:  "bool flag without value",
+			yaml:  base,
+			flags: []string{"-reply.dmarc_header"},
+			got:   func(cfg Config) any { return cfg.Reply.DMARCHeader },
+			want:  true,
+		},
+		{
+			name: "bool env over yaml",
+			yaml: base + "  dmarc_header: true\n",
+			env:  map[string]string{"SMTP_ECHO_REPLY_DMARC_HEADER": "false"},
+			got:  func(cfg Config) any { return cfg.Reply.DMARCHeader },
+			want: false,
+		},
+		{
+			name: "comma separated slice",
+			yaml: base,
+			env:  map[string]string{"SMTP_ECHO_DNSBL_ZONES": "bl.example.org, , zen.example.org"},
+			got:  func(cfg Config) any { return cfg.DNSBL.Zones },
+			want: []string{"bl.example.org", "zen.example.org"},
+		},
+		{
+			name:  "yaml list slice",
+			yaml:  base,
+			flags: []string{"-dns.servers=[192.0.2.53:53, 198.51.100.53:53]"},
+			got:   func(cfg Config) any { return cfg.DNS.Servers },
+			want:  []string{"192.0.2.53:53", "198.51.100.53:53"},
+		},
+		{
+			name: "duration slice",
+			yaml: base,
+			env:  map[string]string{"SMTP_ECHO_DELIVERY_RETRY_SCHEDULE": "1m,10m"},
+			got:  func(cfg Config) any { return cfg.Delivery.Retry.Schedule },
+			want: []time.Duration{time.Minute, 10 * time.Minute},
+		},
+		{
+			name: "nested field keeps yaml siblings",
+			yaml: base + "dns:\n  servers: [\"192.0.2.53:53\"]\n  timeout: 2s\n",
+			env:  map[string]string{"SMTP_ECHO_DNS_TIMEOUT": "5s"},
+			got:  func(cfg Config) any { return []any{cfg.DNS.Servers, cfg.DNS.Timeout} },
+			want: []any{[]string{"192.0.2.53:53"}, 5 * time.Second},
+		},
+		{
+			name: "invalid env value",
+			yaml: base,
+			env:  map[string]string{"SMTP_ECHO_READ_TIMEOUT": "soon"},
+			err:  "SMTP_ECHO_READ_TIMEOUT",
+		},
+		{
+			name: "xclient without trusted networks",
+			yaml: base + "listeners:\n  - addr: \":2525\"\n    xclient: true\n",
+			err:  "xclient_trusted",
+		},
+		{
+			name:  "invalid flag value",
+			yaml:  base,
+			flags: []string{"-max_message_bytes=lots"},
+			err:   "-max_message_bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if tt.yaml != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+			}
+			flags := flag.NewFlagSet("smtp-echo", flag.ContinueOnError)
+			overrides := RegisterFlags(flags)
+			if err := flags.Parse(tt.flags); err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			cfg, err := Load(path, overrides)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() error = %v, want one naming %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if got := tt.got(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Load() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package dane
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	UsageDANETA = 2
+	UsageDANEEE = 3
+
+	SelectorCert = 0
+	SelectorSPKI = 1
+
+	MatchingFull   = 0
+	MatchingSHA256 = 1
+	MatchingSHA512 = 2
+)
+
+type Record struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+type Resolver interface {
+	LookupTLSA(ctx context.Context, host string, port int) ([]Record, error)
+}
+
+type DNSResolver struct {
+	servers []string
+	client  *dns.Client
+}
+
+func NewSystemResolver() (*DNSResolver, error) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("read resolv.conf: %w", err)
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return NewDNSResolver(servers), nil
+}
+
+func NewDNSResolver(servers []string) *DNSResolver {
+	return NewDNSResolverWithClient(servers, &dns.Client{Timeout: 5 * time.Second})
+}
+
+func NewDNSResolverWithClient(servers []string, client *dns.Client) *DNSResolver {
+	return &DNSResolver{
+		servers: servers,
+		client:  client,
+	}
+}
+
+func (r *DNSResolver) LookupTLSA(ctx context.Context, host string, port int) ([]Record, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(fmt.Sprintf("_%d._tcp.%s", port, strings.TrimSuffix(host, "."))), dns.TypeTLSA)
+	query.SetEdns0(4096, true)
+	query.AuthenticatedData = true
+
+	var lastErr error = errors.New("no dns servers configured")
+	for _, server := range r.servers {
+		response, _, err := r.client.ExchangeContext(ctx, query, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch response.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			lastErr = fmt.Errorf("tlsa lookup: %s", dns.RcodeToString[response.Rcode])
+			continue
+		}
+		if !response.AuthenticatedData {
+			return nil, nil
+		}
+
+		var records []Record
+		for _, answer := range response.Answer {
+			tlsa, ok := answer.(*dns.TLSA)
+			if !ok {
+				continue
+			}
+			data, err := hex.DecodeString(tlsa.Certificate)
+			if err != nil {
+				continue
+			}
+			records = append(records, Record{
+				Usage:        tlsa.Usage,
+				Selector:     tlsa.Selector,
+				MatchingType: tlsa.MatchingType,
+				Data:         data,
+			})
+		}
+		return usableRecords(records), nil
+	}
+	return nil, lastErr
+}
+
+func usableRecords(records []Record) []Record {
+	usable := records[:0]
+	for _, record := range records {
+		if record.Usage == UsageDANETA || record.Usage == UsageDANEEE {
+			usable = append(usable, record)
+		}
+	}
+	return usable
+}
+
+func Verify(records []Record, serverName string, state tls.ConnectionState) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("dane: no peer certificates")
+	}
+
+	for _, record := range records {
+		switch record.Usage {
+		case UsageDANEEE:
+			if record.matches(certs[0]) {
+				return nil
+			}
+		case UsageDANETA:
+			for i, cert := range certs[1:] {
+				if !record.matches(cert) {
+					continue
+				}
+				if verifyChain(certs[0], certs[1:i+1], cert, serverName) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("dane: no tlsa record matches the peer certificate")
+}
+
+func (r Record) matches(cert *x509.Certificate) bool {
+	var selected []byte
+	switch r.Selector {
+	case SelectorCert:
+		selected = cert.Raw
+	case SelectorSPKI:
+		selected = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case MatchingFull:
+		return bytes.Equal(selected, r.Data)
+	case MatchingSHA256:
+		sum := sha256.Sum256(selected)
+		return bytes.Equal(sum[:], r.Data)
+	case MatchingSHA512:
+		sum := sha512.Sum512(selected)
+		return bytes.Equal(sum[:], r.Data)
+	default:
+		return false
+	}
+}
+
+func verifyChain(leaf *x509.Certificate, intermediates []*x509.Certificate, anchor *x509.Certificate, serverName string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	pool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: pool,
+	})
+	return err
+}
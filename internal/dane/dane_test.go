@@ -0,0 +1,78 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	leafCert, _ := x509.ParseCertificate(leafDER)
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leafCert, caCert}}
+	leafSPKI := sha256.Sum256(leafCert.RawSubjectPublicKeyInfo)
+	caSPKI := sha256.Sum256(caCert.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name       string
+		records    []Record
+		serverName string
+		wantErr    bool
+	}{
+		{"dane-ee spki sha256", []Record{{UsageDANEEE, SelectorSPKI, MatchingSHA256, leafSPKI[:]}}, "ignored.example", false},
+		{"dane-ee full cert", []Record{{UsageDANEEE, SelectorCert, MatchingFull, leafCert.Raw}}, "mx.example.com", false},
+		{"dane-ta", []Record{{UsageDANETA, SelectorSPKI, MatchingSHA256, caSPKI[:]}}, "mx.example.com", false},
+		{"dane-ta wrong name", []Record{{UsageDANETA, SelectorSPKI, MatchingSHA256, caSPKI[:]}}, "other.example.com", true},
+		{"no match", []Record{{UsageDANEEE, SelectorSPKI, MatchingSHA256, caSPKI[:]}}, "mx.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.records, tt.serverName, state)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
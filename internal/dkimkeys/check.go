@@ -0,0 +1,109 @@
+package dkimkeys
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	CheckOK       = "ok"
+	CheckMissing  = "missing"
+	CheckMismatch = "mismatch"
+	CheckError    = "error"
+)
+
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type CheckResult struct {
+	Selector   string
+	RecordName string
+	Status     string
+	Detail     string
+}
+
+func Check(ctx context.Context, resolver TXTResolver, domain string, key Key) CheckResult {
+	result := CheckResult{Selector: key.Selector, RecordName: key.RecordName(domain)}
+	records, err := resolver.LookupTXT(ctx, result.RecordName)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		result.Status = CheckMissing
+		result.Detail = "no TXT record published"
+		return result
+	}
+	if err != nil {
+		result.Status = CheckError
+		result.Detail = err.Error()
+		return result
+	}
+
+	var published []string
+	for _, record := range records {
+		tags := parseRecordTags(record)
+		if version, ok := tags["v"]; ok && version != "DKIM1" {
+			continue
+		}
+		if p, ok := tags["p"]; ok {
+			published = append(published, p)
+		}
+	}
+	if len(published) == 0 {
+		result.Status = CheckMissing
+		result.Detail = "no DKIM key record published"
+		return result
+	}
+
+	result.Status = CheckMismatch
+	for _, value := range published {
+		if value == "" {
+			result.Detail = "published key is revoked (empty p=)"
+			continue
+		}
+		public, err := parsePublicKey(value)
+		if err != nil {
+			result.Detail = "published key is invalid: " + err.Error()
+			continue
+		}
+		if matches(key.Signer.Public(), public) {
+			result.Status = CheckOK
+			result.Detail = ""
+			return result
+		}
+		result.Detail = "published key does not match the private key"
+	}
+	return result
+}
+
+func parseRecordTags(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, field := range strings.Split(record, ";") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+func parsePublicKey(value string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if public, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return public, nil
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+func matches(private crypto.PublicKey, published crypto.PublicKey) bool {
+	comparable, ok := private.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && comparable.Equal(published)
+}
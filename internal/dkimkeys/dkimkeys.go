@@ -0,0 +1,275 @@
+package dkimkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const commandTimeout = 30 * time.Second
+
+const (
+	headerSelector  = "DKIM-Selector"
+	headerNotBefore = "DKIM-Not-Before"
+	headerNotAfter  = "DKIM-Not-After"
+)
+
+type Key struct {
+	Selector  string
+	Path      string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Signer    crypto.Signer
+}
+
+func (k Key) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	return k.NotAfter.IsZero() || t.Before(k.NotAfter)
+}
+
+func (k Key) RecordName(domain string) string {
+	return k.Selector + "._domainkey." + domain
+}
+
+func (k Key) RecordValue() (string, error) {
+	return TXTValue(k.Signer.Public())
+}
+
+func TXTValue(public crypto.PublicKey) (string, error) {
+	encoded, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", fmt.Errorf("encode public key: %w", err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+func Load(cfg *config.DKIMConfig) ([]Key, error) {
+	var keys []Key
+	data, source, err := readPrivateKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		signer, _, err := ParseSigner(data, cfg.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("dkim key from %s: %w", source, err)
+		}
+		keys = append(keys, Key{Selector: cfg.Selector, Path: source, Signer: signer})
+	}
+	for _, keyCfg := range cfg.Keys {
+		signer, _, err := LoadSigner(keyCfg.PrivateKeyPath, cfg.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, Key{
+			Selector:  keyCfg.Selector,
+			Path:      keyCfg.PrivateKeyPath,
+			NotBefore: keyCfg.NotBefore,
+			NotAfter:  keyCfg.NotAfter,
+			Signer:    signer,
+		})
+	}
+	if cfg.KeyDir != "" {
+		dirKeys, err := loadDir(cfg.KeyDir, cfg.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, dirKeys...)
+	}
+	return keys, nil
+}
+
+func readPrivateKey(cfg *config.DKIMConfig) ([]byte, string, error) {
+	switch {
+	case cfg.PrivateKeyPath != "":
+		data, err := os.ReadFile(cfg.PrivateKeyPath)
+		return data, cfg.PrivateKeyPath, err
+	case cfg.PrivateKey != "":
+		return []byte(cfg.PrivateKey), "private_key", nil
+	case cfg.PrivateKeyEnv != "":
+		value := os.Getenv(cfg.PrivateKeyEnv)
+		if value == "" {
+			return nil, "", fmt.Errorf("dkim private key environment variable %s is not set", cfg.PrivateKeyEnv)
+		}
+		return []byte(value), "$" + cfg.PrivateKeyEnv, nil
+	case len(cfg.PrivateKeyCommand) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		command := exec.CommandContext(ctx, cfg.PrivateKeyCommand[0], cfg.PrivateKeyCommand[1:]...)
+		command.Stderr = &stderr
+		data, err := command.Output()
+		if err != nil {
+			return nil, "", fmt.Errorf("run dkim private key command %s: %w: %s", cfg.PrivateKeyCommand[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return data, "command " + cfg.PrivateKeyCommand[0], nil
+	default:
+		return nil, "", nil
+	}
+}
+
+func loadDir(dir string, passphrase string) ([]Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("list dkim key dir: %w", err)
+	}
+	sort.Strings(paths)
+
+	keys := make([]Key, 0, len(paths))
+	for _, path := range paths {
+		signer, headers, err := LoadSigner(path, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		key := Key{
+			Selector: strings.TrimSuffix(filepath.Base(path), ".pem"),
+			Path:     path,
+			Signer:   signer,
+		}
+		if selector := headers[headerSelector]; selector != "" {
+			key.Selector = selector
+		}
+		if key.NotBefore, err = parseHeaderTime(headers, headerNotBefore); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if key.NotAfter, err = parseHeaderTime(headers, headerNotAfter); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseHeaderTime(headers map[string]string, name string) (time.Time, error) {
+	value := headers[name]
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s header: %w", name, err)
+	}
+	return parsed, nil
+}
+
+func Active(keys []Key, now time.Time) (Key, bool) {
+	var active Key
+	found := false
+	for _, key := range keys {
+		if !key.ValidAt(now) {
+			continue
+		}
+		if !found || !key.NotBefore.Before(active.NotBefore) {
+			active = key
+			found = true
+		}
+	}
+	return active, found
+}
+
+func Rotate(cfg *config.DKIMConfig, now time.Time) (Key, error) {
+	if cfg.KeyDir == "" {
+		return Key{}, errors.New("dkim.key_dir is required for key rotation")
+	}
+	if err := os.MkdirAll(cfg.KeyDir, 0o700); err != nil {
+		return Key{}, fmt.Errorf("create dkim key dir: %w", err)
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return Key{}, fmt.Errorf("generate rsa key: %w", err)
+	}
+	encoded, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return Key{}, fmt.Errorf("encode private key: %w", err)
+	}
+
+	key := Key{
+		Selector:  "s" + now.UTC().Format("20060102150405"),
+		NotBefore: now.Add(cfg.RotationDelay).UTC().Truncate(time.Second),
+		Signer:    private,
+	}
+	key.Path = filepath.Join(cfg.KeyDir, key.Selector+".pem")
+	block := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: encoded,
+		Headers: map[string]string{
+			headerSelector:  key.Selector,
+			headerNotBefore: key.NotBefore.Format(time.RFC3339),
+		},
+	}
+
+	file, err := os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return Key{}, fmt.Errorf("create dkim key file: %w", err)
+	}
+	if err := pem.Encode(file, block); err != nil {
+		file.Close()
+		return Key{}, fmt.Errorf("write dkim key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return Key{}, fmt.Errorf("write dkim key: %w", err)
+	}
+	return key, nil
+}
+
+func LoadSigner(path string, passphrase string) (crypto.Signer, map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, headers, err := ParseSigner(data, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, headers, nil
+}
+
+func ParseSigner(data []byte, passphrase string) (crypto.Signer, map[string]string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("failed to decode pem block")
+	}
+	block, err := decryptBlock(block, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid PKCS#1 RSA private key: %w", err)
+		}
+		return key, block.Headers, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid PKCS#8 private key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported PKCS#8 key type %T: use RSA private key", key)
+		}
+		return rsaKey, block.Headers, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported PEM block type %q: expected RSA PRIVATE KEY or PRIVATE KEY", block.Type)
+	}
+}
@@ -0,0 +1,53 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
+)
+
+func (b *Backend) UseArchive(writer *archive.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.archive = writer
+}
+
+func (b *Backend) archiveStage(next Processor) Processor {
+	writer := b.archive
+	if writer == nil {
+		return next
+	}
+
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		if err := b.archiveMessage(writer, msg); err != nil {
+			b.logf("archive inbound message from=%q: %v", msg.EnvelopeFrom, err)
+		}
+		return next.Echo(ctx, msg)
+	})
+}
+
+func (b *Backend) archiveMessage(writer *archive.Writer, msg InboundMessage) error {
+	body, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return writer.Write(archive.FolderInbound, msg.EnvelopeFrom, msg.ReceivedAt, body)
+}
+
+func (r *Replier) UseArchive(writer *archive.Writer) {
+	if writer.ArchiveReplies() {
+		r.archive = writer
+	}
+}
+
+func (r *Replier) archiveReply(sender string, message []byte) {
+	if r.archive == nil {
+		return
+	}
+	if err := r.archive.Write(archive.FolderReplies, sender, time.Now(), bytes.NewReader(message)); err != nil && r.logger != nil {
+		r.logger.Printf("archive reply from=%q: %v", sender, err)
+	}
+}
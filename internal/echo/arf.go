@@ -0,0 +1,123 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+type feedbackReport struct {
+	feedbackType      string
+	userAgent         string
+	reportingMTA      string
+	sourceIP          string
+	originalMailFrom  string
+	complainant       string
+	originalTo        string
+	originalMessageID string
+}
+
+func isFeedbackReport(header mail.Header) bool {
+	mediaType, params, err := header.ContentType()
+	return err == nil && strings.EqualFold(mediaType, "multipart/report") && strings.EqualFold(params["report-type"], "feedback-report")
+}
+
+func (r *Replier) handleFeedbackReport(ctx context.Context, msg InboundMessage) error {
+	report, err := parseFeedbackReport(msg)
+	if err != nil && r.logger != nil {
+		r.logger.Printf("parse feedback report for message %d: %v", msg.ID, err)
+	}
+
+	match := inboundBounce{originalMessageID: report.originalMessageID}
+	if verp, ok := r.matchBounceAddress([]string{report.originalMailFrom}); ok {
+		match.recipient = verp.recipient
+		match.replyID = verp.replyID
+	}
+	replyID, replyRecipient, matched := r.matchBouncedReply(ctx, match)
+	if replyID != 0 && match.recipient != "" {
+		matched = true
+	}
+	complainant := replyRecipient
+	if !matched {
+		replyID = 0
+		complainant = report.complainant
+		if complainant == "" {
+			complainant = report.originalTo
+		}
+	}
+
+	if r.logger != nil {
+		r.logger.Printf("feedback report message_id=%d type=%s complainant=%q reply_id=%d matched=%t reporter=%q source_ip=%s",
+			msg.ID, displayOrUnknown(report.feedbackType), complainant, replyID, matched, report.userAgent, displayOrUnknown(report.sourceIP))
+	}
+	if !matched {
+		return nil
+	}
+	update := store.ReplyUpdate{
+		Status:     store.ReplyStatusComplained,
+		StatusCode: report.feedbackType,
+		RemoteHost: report.reportingMTA,
+		Error:      fmt.Sprintf("feedback report in message %d", msg.ID),
+	}
+	if err := r.store.UpdateReplyStatus(ctx, replyID, update); err != nil && r.logger != nil {
+		r.logger.Printf("store reply status for reply %d: %v", replyID, err)
+	}
+	if strings.EqualFold(report.feedbackType, "not-spam") || r.suppressions == nil {
+		return nil
+	}
+	if _, err := r.suppressions.Add(suppression.Entry{
+		Type:   suppression.TypeAddress,
+		Value:  complainant,
+		Reason: fmt.Sprintf("%s complaint in message %d", displayOrUnknown(report.feedbackType), msg.ID),
+		Source: suppression.SourceComplaint,
+	}); err != nil {
+		return fmt.Errorf("record complaint: %w", err)
+	}
+	return nil
+}
+
+func parseFeedbackReport(msg InboundMessage) (feedbackReport, error) {
+	var report feedbackReport
+	data, err := msg.Open()
+	if err != nil {
+		return report, err
+	}
+	defer data.Close()
+
+	entity, err := message.Read(data)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return report, fmt.Errorf("read feedback report: %w", err)
+	}
+
+	err = entity.Walk(func(_ []int, part *message.Entity, _ error) error {
+		mediaType, _, _ := part.Header.ContentType()
+		switch strings.ToLower(mediaType) {
+		case "message/feedback-report":
+			fields, _ := textproto.ReadHeader(bufio.NewReader(part.Body))
+			report.feedbackType = strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type")))
+			report.userAgent = strings.TrimSpace(fields.Get("User-Agent"))
+			report.reportingMTA = typedValue(fields.Get("Reporting-MTA"))
+			report.sourceIP = strings.TrimSpace(fields.Get("Source-IP"))
+			report.originalMailFrom = normalizeRecipientAddress(fields.Get("Original-Mail-From"))
+			if rcpt := fields.Get("Original-Rcpt-To"); rcpt != "" {
+				report.complainant = normalizeRecipientAddress(typedValue(rcpt))
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			header, _ := textproto.ReadHeader(bufio.NewReader(part.Body))
+			report.originalMessageID = strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+			if to, err := mail.ParseAddressList(header.Get("To")); err == nil && len(to) == 1 {
+				report.originalTo = to[0].Address
+			}
+		}
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,112 @@
+package echo
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+)
+
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+type credentials struct {
+	required bool
+	users    map[string]string
+}
+
+func newCredentials(cfg *config.AuthConfig) *credentials {
+	if cfg == nil {
+		return nil
+	}
+
+	users := make(map[string]string, len(cfg.Users))
+	for _, user := range cfg.Users {
+		users[user.Username] = user.Password
+	}
+	return &credentials{required: cfg.Required, users: users}
+}
+
+func (c *credentials) verify(username string, password string) bool {
+	expected, ok := c.users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+func (s *session) AuthMechanisms() []string {
+	if s.backend.credentials() == nil {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	creds := s.backend.credentials()
+	if creds == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+
+	authenticate := func(username string, password string) error {
+		if !creds.verify(username, password) {
+			if s.backend.logger != nil {
+				s.backend.logger.Printf("authentication failed user=%q remote=%s", username, addrString(s.remoteAddr()))
+			}
+			s.recordReputation("", reputation.EventAuthFailure)
+			return smtp.ErrAuthFailed
+		}
+		s.authUser = username
+		return nil
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity string, username string, password string) error {
+			if identity != "" && identity != username {
+				return smtp.ErrAuthFailed
+			}
+			return authenticate(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: authenticate}, nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+}
+
+type loginServer struct {
+	authenticate func(username string, password string) error
+	username     string
+	step         int
+}
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch l.step {
+	case 0:
+		l.step++
+		if response != nil {
+			l.username = string(response)
+			l.step++
+			return []byte("Password:"), false, nil
+		}
+		return []byte("Username:"), false, nil
+	case 1:
+		l.username = string(response)
+		l.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		l.step++
+		return nil, true, l.authenticate(l.username, string(bytes.TrimRight(response, "\x00")))
+	default:
+		return nil, true, errors.New("unexpected LOGIN response")
+	}
+}
@@ -0,0 +1,85 @@
+package echo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type bodyDigest struct {
+	size   int64
+	sha256 string
+}
+
+func digestBody(msg InboundMessage) (bodyDigest, error) {
+	data, err := msg.Open()
+	if err != nil {
+		return bodyDigest{}, err
+	}
+	defer data.Close()
+
+	reader := bufio.NewReader(data)
+	if _, err := textproto.ReadHeader(reader); err != nil {
+		return bodyDigest{}, fmt.Errorf("read message header: %w", err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return bodyDigest{}, fmt.Errorf("hash message body: %w", err)
+	}
+	return bodyDigest{size: size, sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (r *Replier) checkBodySize(msg InboundMessage) (*bodyDigest, error) {
+	if r.maxBodyBytes <= 0 {
+		return nil, nil
+	}
+	digest, err := digestBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	if digest.size <= r.maxBodyBytes {
+		return nil, nil
+	}
+	if r.oversizePolicy == config.OversizeReject {
+		return nil, &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      fmt.Sprintf("Message body of %d bytes exceeds the %d byte echo limit", digest.size, r.maxBodyBytes),
+		}
+	}
+	return &digest, nil
+}
+
+func limitBody(body replyBody, digest bodyDigest, limit int64, policy string) replyBody {
+	summary := fmt.Sprintf("Original body size: %d bytes\nOriginal body SHA-256: %s\n", digest.size, digest.sha256)
+	if policy == config.OversizeSummarize {
+		return replyBody{Plain: fmt.Sprintf("The message body is larger than the %d byte echo limit and was not echoed.\n\n%s", limit, summary)}
+	}
+
+	limited := replyBody{Plain: truncateUTF8(body.Plain, limit)}
+	if int64(len(body.HTML)) <= limit {
+		limited.HTML = body.HTML
+	}
+	limited.Plain += fmt.Sprintf("\n\n[Truncated to %d bytes]\n%s", limit, summary)
+	return limited
+}
+
+func truncateUTF8(value string, limit int64) string {
+	if int64(len(value)) <= limit {
+		return value
+	}
+	end := int(limit)
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
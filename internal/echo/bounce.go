@@ -0,0 +1,243 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type deliveryAttempt struct {
+	host string
+	err  error
+}
+
+type deliveryError struct {
+	recipient string
+	lookupErr error
+	attempts  []deliveryAttempt
+}
+
+func (e *deliveryError) Error() string {
+	var attemptErrors []string
+	if e.lookupErr != nil {
+		attemptErrors = append(attemptErrors, "mx lookup: "+e.lookupErr.Error())
+	}
+	for _, attempt := range e.attempts {
+		attemptErrors = append(attemptErrors, fmt.Sprintf("%s: %v", attempt.host, attempt.err))
+	}
+	return fmt.Sprintf("delivery failed for %s: %s", e.recipient, strings.Join(attemptErrors, " | "))
+}
+
+func (e *deliveryError) lastAttempt() (deliveryAttempt, bool) {
+	if len(e.attempts) == 0 {
+		return deliveryAttempt{}, false
+	}
+	return e.attempts[len(e.attempts)-1], true
+}
+
+func deliveryStatusCode(err error) string {
+	var deliveryErr *deliveryError
+	if errors.As(err, &deliveryErr) {
+		if attempt, ok := deliveryErr.lastAttempt(); ok {
+			err = attempt.err
+		}
+	}
+
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return "4.4.1"
+	}
+	code := smtpErr.EnhancedCode
+	if code[0] == 2 || code[0] == 4 || code[0] == 5 {
+		return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+	}
+	if smtpErr.Code >= 500 {
+		return "5.0.0"
+	}
+	return "4.0.0"
+}
+
+func deliveryRemoteHost(err error) string {
+	var deliveryErr *deliveryError
+	if !errors.As(err, &deliveryErr) {
+		return ""
+	}
+	attempt, _ := deliveryErr.lastAttempt()
+	return attempt.host
+}
+
+func deliveryDiagnostic(err error) string {
+	var deliveryErr *deliveryError
+	if errors.As(err, &deliveryErr) {
+		if attempt, ok := deliveryErr.lastAttempt(); ok {
+			err = attempt.err
+		}
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return fmt.Sprintf("smtp; %d %s %s", smtpErr.Code, deliveryStatusCode(smtpErr), smtpErr.Message)
+	}
+	return "x-unix; " + err.Error()
+}
+
+func (r *Replier) handleBounce(ctx context.Context, msg InboundMessage, recipient string, replyMessage []byte, deliveryErr error) error {
+	switch r.bounce {
+	case config.BounceModeLog:
+		r.logBounce(msg, recipient, deliveryErr)
+		return nil
+	case config.BounceModeDSN:
+		r.logBounce(msg, recipient, deliveryErr)
+		r.sendDSN(ctx, msg, recipient, replyMessage, deliveryErr, fmt.Sprintf("The echo reply to <%s> could not be delivered.", recipient))
+		return nil
+	default:
+		return deliveryErr
+	}
+}
+
+func (r *Replier) logBounce(msg InboundMessage, recipient string, deliveryErr error) {
+	if r.logger == nil {
+		return
+	}
+	r.logger.Printf("bounce message_id=%d sender=%q recipient=%q status=%s remote_host=%q error=%q",
+		msg.ID, msg.EnvelopeFrom, recipient, deliveryStatusCode(deliveryErr), deliveryRemoteHost(deliveryErr), deliveryErr.Error())
+}
+
+func (r *Replier) Bounce(ctx context.Context, msg InboundMessage, recipient string, reason error) error {
+	r.logBounce(msg, recipient, reason)
+	undelivered, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	r.sendDSN(ctx, msg, recipient, undelivered, reason, fmt.Sprintf("Your message to <%s> could not be delivered.", recipient))
+	return nil
+}
+
+func (r *Replier) sendDSN(ctx context.Context, msg InboundMessage, recipient string, undelivered []byte, deliveryErr error, description string) {
+	sender := normalizeRecipientAddress(msg.EnvelopeFrom)
+	if sender == "" {
+		if r.logger != nil {
+			r.logger.Printf("skip dsn for message %d: null envelope sender", msg.ID)
+		}
+		return
+	}
+	if r.suppressed(sender) {
+		return
+	}
+
+	dsn, err := r.buildDSN(sender, recipient, msg.ReceivedAt, undelivered, deliveryErr, description)
+	if err == nil {
+		dsn, err = signMessage(r.dkim, dsn)
+	}
+	if err != nil {
+		if r.logger != nil {
+			r.logger.Printf("build dsn for message %d: %v", msg.ID, err)
+		}
+		return
+	}
+
+	r.archiveReply("", dsn)
+	dsnID := r.recordReply(ctx, msg.ID, store.ReplyKindDSN, sender, dsn)
+	release, err := r.waitForSlot(ctx, sender)
+	if err == nil {
+		err = r.bounceFn(ctx, sender, dsn)
+		release()
+	}
+	if err != nil {
+		r.recordReplyStatus(ctx, dsnID, store.ReplyStatusFailed, err)
+		if r.logger != nil {
+			r.logger.Printf("deliver dsn to=%q: %v", sender, err)
+		}
+		return
+	}
+	r.recordReplyStatus(ctx, dsnID, store.ReplyStatusDelivered, nil)
+	r.markDelivered()
+}
+
+func (r *Replier) buildDSN(to string, failedRecipient string, arrival time.Time, undelivered []byte, deliveryErr error, description string) ([]byte, error) {
+	if arrival.IsZero() {
+		arrival = time.Now().UTC()
+	}
+
+	var header mail.Header
+	header.SetDate(time.Now().UTC())
+	header.SetSubject("Delivery Status Notification (Failure)")
+	header.SetAddressList("From", []*mail.Address{{Name: "Mail Delivery System", Address: r.mailFrom}})
+	header.SetAddressList("To", []*mail.Address{{Address: to}})
+	header.Set("Auto-Submitted", "auto-replied")
+	header.SetContentType("multipart/report", map[string]string{"report-type": "delivery-status"})
+	if err := header.GenerateMessageIDWithHostname(r.hostname); err != nil {
+		if generateErr := header.GenerateMessageID(); generateErr != nil {
+			return nil, fmt.Errorf("generate message-id: %w", generateErr)
+		}
+	}
+
+	var buf bytes.Buffer
+	writer, err := message.CreateWriter(&buf, header.Header)
+	if err != nil {
+		return nil, fmt.Errorf("create dsn writer: %w", err)
+	}
+
+	statusCode := deliveryStatusCode(deliveryErr)
+	human := fmt.Sprintf("%s\r\n\r\nStatus: %s\r\nError: %s\r\n", description, statusCode, deliveryErr.Error())
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", r.hostname)
+	fmt.Fprintf(&status, "Arrival-Date: %s\r\n", arrival.Format(time.RFC1123Z))
+	status.WriteString("\r\n")
+	fmt.Fprintf(&status, "Final-Recipient: rfc822; %s\r\n", failedRecipient)
+	status.WriteString("Action: failed\r\n")
+	fmt.Fprintf(&status, "Status: %s\r\n", statusCode)
+	if remoteHost := deliveryRemoteHost(deliveryErr); remoteHost != "" {
+		fmt.Fprintf(&status, "Remote-MTA: dns; %s\r\n", remoteHost)
+	}
+	fmt.Fprintf(&status, "Diagnostic-Code: %s\r\n", strings.Join(strings.Fields(deliveryDiagnostic(deliveryErr)), " "))
+	fmt.Fprintf(&status, "Last-Attempt-Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+
+	parts := []struct {
+		contentType string
+		params      map[string]string
+		body        string
+	}{
+		{"text/plain", map[string]string{"charset": "utf-8"}, human},
+		{"message/delivery-status", nil, status.String()},
+		{"text/rfc822-headers", nil, messageHeaders(undelivered)},
+	}
+	for _, part := range parts {
+		var partHeader message.Header
+		partHeader.SetContentType(part.contentType, part.params)
+		partWriter, err := writer.CreatePart(partHeader)
+		if err != nil {
+			return nil, fmt.Errorf("create dsn %s part: %w", part.contentType, err)
+		}
+		if _, err := io.WriteString(partWriter, part.body); err != nil {
+			return nil, fmt.Errorf("write dsn %s part: %w", part.contentType, err)
+		}
+		if err := partWriter.Close(); err != nil {
+			return nil, fmt.Errorf("close dsn %s part: %w", part.contentType, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("close dsn writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func messageHeaders(message []byte) string {
+	if idx := bytes.Index(message, []byte("\r\n\r\n")); idx >= 0 {
+		return string(message[:idx+2])
+	}
+	return string(message)
+}
@@ -0,0 +1,123 @@
+package echo
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errChaosDropped = errors.New("chaos: connection dropped during DATA")
+
+type chaos struct {
+	mailError     float64
+	rcptError     float64
+	dataError     float64
+	permanent     float64
+	slow          float64
+	slowDelay     time.Duration
+	drop          float64
+	replyDelay    float64
+	maxReplyDelay time.Duration
+	roll          func() float64
+}
+
+func newChaos(cfg *config.ChaosConfig) *chaos {
+	if cfg == nil {
+		return nil
+	}
+	return &chaos{
+		mailError:     cfg.MailError,
+		rcptError:     cfg.RcptError,
+		dataError:     cfg.DataError,
+		permanent:     cfg.Permanent,
+		slow:          cfg.Slow,
+		slowDelay:     cfg.SlowDelay,
+		drop:          cfg.Drop,
+		replyDelay:    cfg.ReplyDelay,
+		maxReplyDelay: cfg.MaxReplyDelay,
+		roll:          rand.Float64,
+	}
+}
+
+func (c *chaos) hit(probability float64) bool {
+	return c != nil && probability > 0 && c.roll() < probability
+}
+
+func (c *chaos) delaysReplies() bool {
+	return c != nil && c.replyDelay > 0 && c.maxReplyDelay > 0
+}
+
+func (c *chaos) nextReplyDelay() time.Duration {
+	if !c.delaysReplies() || !c.hit(c.replyDelay) {
+		return 0
+	}
+	return rand.N(c.maxReplyDelay + 1)
+}
+
+func (c *chaos) errorRate(command string) float64 {
+	switch command {
+	case "MAIL":
+		return c.mailError
+	case "RCPT":
+		return c.rcptError
+	case "DATA":
+		return c.dataError
+	}
+	return 0
+}
+
+func (c *chaos) commandError(command string) error {
+	if !c.hit(c.errorRate(command)) {
+		return nil
+	}
+	if c.hit(c.permanent) {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+			Message:      "Chaos: injected permanent failure at " + command,
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Chaos: injected temporary failure at " + command,
+	}
+}
+
+func (b *Backend) chaosMode() *chaos {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.chaos
+}
+
+func (s *session) injectChaos(command string) error {
+	c := s.backend.chaosMode()
+	if c == nil {
+		return nil
+	}
+	if c.hit(c.slow) {
+		s.backend.logf("chaos slowed %s remote=%s delay=%s", command, addrString(s.remoteAddr()), c.slowDelay)
+		time.Sleep(c.slowDelay)
+	}
+	if err := c.commandError(command); err != nil {
+		s.backend.logf("chaos failed %s remote=%s: %v", command, addrString(s.remoteAddr()), err)
+		return err
+	}
+	return nil
+}
+
+func (s *session) injectDrop(r io.Reader) error {
+	c := s.backend.chaosMode()
+	if c == nil || s.conn == nil || !c.hit(c.drop) {
+		return nil
+	}
+	io.CopyN(io.Discard, r, rand.Int64N(4096)+1)
+	s.backend.logf("chaos dropped connection during DATA remote=%s", addrString(s.remoteAddr()))
+	s.conn.Close()
+	return errChaosDropped
+}
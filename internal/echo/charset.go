@@ -0,0 +1,71 @@
+package echo
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func partCharset(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(params["charset"])
+}
+
+func knownCharset(charset string) bool {
+	if message.CharsetReader == nil {
+		return isUTF8Charset(charset)
+	}
+	_, err := message.CharsetReader(charset, strings.NewReader(""))
+	return err == nil
+}
+
+func isUTF8Charset(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+func decodeFallback(data []byte, charset string) (string, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", fmt.Errorf("fallback charset %q: %w", charset, err)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("decode with fallback charset %q: %w", charset, err)
+	}
+	return string(decoded), nil
+}
+
+func encodeCharset(text string, charset string) ([]byte, string) {
+	if isUTF8Charset(charset) {
+		return []byte(text), "utf-8"
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return []byte(text), "utf-8"
+	}
+	encoded, err := encoding.NewEncoder().String(text)
+	if err != nil {
+		return []byte(text), "utf-8"
+	}
+	return []byte(encoded), charset
+}
+
+func charsetHeaders(body replyBody) []headerField {
+	switch {
+	case body.FallbackCharset != "":
+		return []headerField{{"X-Echo-Original-Charset", body.Charset + "; decoded-as=" + body.FallbackCharset}}
+	case body.Charset != "":
+		return []headerField{{"X-Echo-Original-Charset", body.Charset}}
+	}
+	return nil
+}
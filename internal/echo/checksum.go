@@ -0,0 +1,72 @@
+package echo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+func checksumHeaders(msg InboundMessage, details bool) []headerField {
+	data, err := msg.Open()
+	if err != nil {
+		return nil
+	}
+	defer data.Close()
+
+	raw := sha256.New()
+	tee := io.TeeReader(data, raw)
+	entity, err := message.Read(tee)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil
+	}
+	topType := mediaTypeOf(entity.Header)
+
+	var parts []headerField
+	entity.Walk(func(path []int, part *message.Entity, _ error) error {
+		mediaType := mediaTypeOf(part.Header)
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		sum := sha256.New()
+		size, _ := io.Copy(sum, part.Body)
+		parts = append(parts, headerField{"X-Echo-Checksum", formatChecksum(partSection(path), sum.Sum(nil), size, mediaType, details)})
+		return nil
+	})
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil
+	}
+
+	fields := []headerField{{"X-Echo-Checksum", formatChecksum("message", raw.Sum(nil), msg.Size(), topType, details)}}
+	return append(fields, parts...)
+}
+
+func mediaTypeOf(header message.Header) string {
+	mediaType, _, _ := header.ContentType()
+	if mediaType == "" {
+		return "text/plain"
+	}
+	return mediaType
+}
+
+func formatChecksum(part string, sum []byte, size int64, mediaType string, details bool) string {
+	values := []string{"part=" + part, "sha256=" + hex.EncodeToString(sum)}
+	if details {
+		values = append(values, "size="+strconv.FormatInt(size, 10), "type="+mediaType)
+	}
+	return strings.Join(values, "; ")
+}
+
+func partSection(path []int) string {
+	if len(path) == 0 {
+		return "1"
+	}
+	sections := make([]string, len(path))
+	for i, index := range path {
+		sections[i] = strconv.Itoa(index + 1)
+	}
+	return strings.Join(sections, ".")
+}
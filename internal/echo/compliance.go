@@ -0,0 +1,99 @@
+package echo
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+type complianceHeaders struct {
+	listID            string
+	unsubscribeMailto string
+	unsubscribeURL    string
+	oneClick          bool
+	feedbackID        string
+}
+
+func newComplianceHeaders(cfg *config.ComplianceConfig) *complianceHeaders {
+	if cfg == nil {
+		return nil
+	}
+	listID := cfg.ListID
+	if listID != "" {
+		listID = "<" + listID + ">"
+	}
+	return &complianceHeaders{
+		listID:            listID,
+		unsubscribeMailto: strings.ToLower(cfg.UnsubscribeMailto),
+		unsubscribeURL:    cfg.UnsubscribeURL,
+		oneClick:          cfg.OneClick,
+		feedbackID:        cfg.FeedbackID,
+	}
+}
+
+func (c *complianceHeaders) fields(recipient string) []headerField {
+	if c == nil {
+		return nil
+	}
+	var fields []headerField
+	var unsubscribe []string
+	if c.unsubscribeMailto != "" {
+		unsubscribe = append(unsubscribe, "<mailto:"+c.unsubscribeMailto+"?subject=unsubscribe>")
+	}
+	if c.unsubscribeURL != "" {
+		unsubscribe = append(unsubscribe, "<"+strings.ReplaceAll(c.unsubscribeURL, "{recipient}", url.QueryEscape(recipient))+">")
+	}
+	if len(unsubscribe) > 0 {
+		fields = append(fields, headerField{"List-Unsubscribe", strings.Join(unsubscribe, ", ")})
+	}
+	if c.oneClick {
+		fields = append(fields, headerField{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	if c.listID != "" {
+		fields = append(fields, headerField{"List-Id", c.listID})
+	}
+	if c.feedbackID != "" {
+		fields = append(fields, headerField{"Feedback-ID", c.feedbackID})
+	}
+	return fields
+}
+
+func (c *complianceHeaders) isUnsubscribe(recipients []string) bool {
+	if c == nil || c.unsubscribeMailto == "" {
+		return false
+	}
+	for _, recipient := range recipients {
+		if strings.EqualFold(normalizeRecipientAddress(recipient), c.unsubscribeMailto) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replier) handleUnsubscribe(msg InboundMessage) error {
+	sender := normalizeRecipientAddress(msg.EnvelopeFrom)
+	if sender == "" {
+		return nil
+	}
+	if r.suppressions == nil {
+		if r.logger != nil {
+			r.logger.Printf("unsubscribe from=%q ignored: no suppression list configured", sender)
+		}
+		return nil
+	}
+	if _, err := r.suppressions.Add(suppression.Entry{
+		Type:   suppression.TypeAddress,
+		Value:  sender,
+		Reason: fmt.Sprintf("unsubscribe request message %d", msg.ID),
+		Source: suppression.SourceUnsubscribe,
+	}); err != nil {
+		return fmt.Errorf("record unsubscribe: %w", err)
+	}
+	if r.logger != nil {
+		r.logger.Printf("unsubscribed %q", sender)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type replyCopy struct {
+	kind    string
+	address string
+}
+
+func (r *Replier) configureCopies(cfg config.ReplyConfig) error {
+	for _, address := range cfg.CC {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("parse reply cc %q: %w", address, err)
+		}
+		r.cc = append(r.cc, parsed)
+		r.copies = append(r.copies, replyCopy{kind: store.ReplyKindCC, address: parsed.Address})
+	}
+	for _, address := range cfg.BCC {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("parse reply bcc %q: %w", address, err)
+		}
+		r.copies = append(r.copies, replyCopy{kind: store.ReplyKindBCC, address: parsed.Address})
+	}
+	return nil
+}
+
+func (r *Replier) sendCopies(ctx context.Context, msg InboundMessage, identity replyIdentity, replyMessage []byte, replyAll []replyCopy) {
+	for _, replyCopy := range slices.Concat(r.copies, replyAll) {
+		replyID := r.recordReply(ctx, msg.ID, replyCopy.kind, replyCopy.address, replyMessage)
+		if err := r.deliver(ctx, r.verp.envelopeSender(identity.mailFrom, replyCopy.address, replyID), replyCopy.address, replyMessage); err != nil {
+			r.recordReplyStatus(ctx, replyID, store.ReplyStatusFailed, err)
+			if r.logger != nil {
+				r.logger.Printf("reply %s copy failed to=%q: %v", replyCopy.kind, replyCopy.address, err)
+			}
+			continue
+		}
+		r.recordReplyStatus(ctx, replyID, store.ReplyStatusDelivered, nil)
+		if r.logger != nil {
+			r.logger.Printf("sent reply %s copy to=%q bytes=%d", replyCopy.kind, replyCopy.address, len(replyMessage))
+		}
+	}
+}
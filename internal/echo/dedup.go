@@ -0,0 +1,156 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type dedupCache struct {
+	mu         sync.Mutex
+	key        string
+	window     time.Duration
+	maxEntries int
+	seen       map[string]time.Time
+	order      []dedupEntry
+	suppressed atomic.Int64
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupCache(cfg *config.DedupConfig) *dedupCache {
+	if cfg == nil {
+		return nil
+	}
+	cache := &dedupCache{seen: make(map[string]time.Time)}
+	cache.configure(cfg)
+	return cache
+}
+
+func reconfigureDedup(cache *dedupCache, cfg *config.DedupConfig) *dedupCache {
+	if cfg == nil || cache == nil {
+		return newDedupCache(cfg)
+	}
+	cache.configure(cfg)
+	return cache
+}
+
+func (c *dedupCache) configure(cfg *config.DedupConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = cfg.Key
+	c.window = cfg.Window
+	c.maxEntries = cfg.MaxEntries
+}
+
+func (c *dedupCache) reserve(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now, 0)
+	if seen, ok := c.seen[key]; ok && now.Sub(seen) < c.window {
+		return false
+	}
+	c.prune(now, 1)
+	c.seen[key] = now
+	c.order = append(c.order, dedupEntry{key: key, seen: now})
+	return true
+}
+
+func (c *dedupCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, key)
+}
+
+func (c *dedupCache) prune(now time.Time, adding int) {
+	drop := 0
+	for _, entry := range c.order {
+		expired := now.Sub(entry.seen) >= c.window
+		if !expired && (c.maxEntries == 0 || len(c.order)-drop+adding <= c.maxEntries) {
+			break
+		}
+		if seen, ok := c.seen[entry.key]; ok && seen.Equal(entry.seen) {
+			delete(c.seen, entry.key)
+		}
+		drop++
+	}
+	if drop > 0 {
+		clear(c.order[:drop])
+		c.order = c.order[drop:]
+	}
+}
+
+func (c *dedupCache) messageKey(msg InboundMessage) string {
+	r, err := msg.Open()
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	c.mu.Lock()
+	keyType := c.key
+	c.mu.Unlock()
+
+	sender := strings.ToLower(msg.EnvelopeFrom)
+	whole := sha256.New()
+	io.WriteString(whole, sender+"\x00")
+	reader := bufio.NewReader(io.TeeReader(r, whole))
+	header, headerErr := textproto.ReadHeader(reader)
+	if keyType == config.DedupKeyMessageID {
+		if id := strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>"); id != "" {
+			return "message_id:" + sender + ":" + id
+		}
+	}
+	body := sha256.New()
+	io.WriteString(body, sender+"\x00")
+	n, err := io.Copy(body, reader)
+	if err != nil {
+		return ""
+	}
+	if headerErr != nil || n == 0 {
+		return "body_hash:" + hex.EncodeToString(whole.Sum(nil))
+	}
+	return "body_hash:" + hex.EncodeToString(body.Sum(nil))
+}
+
+func (b *Backend) dedupStage(next Processor) Processor {
+	cache := b.dedup
+	if cache == nil {
+		return next
+	}
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		key := cache.messageKey(msg)
+		if key == "" {
+			return next.Echo(ctx, msg)
+		}
+		if !cache.reserve(key, time.Now()) {
+			cache.suppressed.Add(1)
+			b.logf("duplicate message id=%d from=%q key=%s: reply suppressed", msg.ID, msg.EnvelopeFrom, key)
+			return nil
+		}
+		err := next.Echo(ctx, msg)
+		if err != nil {
+			cache.forget(key)
+		}
+		return err
+	})
+}
+
+func (c *dedupCache) suppressedCount() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.suppressed.Load()
+}
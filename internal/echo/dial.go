@@ -0,0 +1,356 @@
+package echo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const startTLSTimeout = 5 * time.Minute
+
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type outboundDialer struct {
+	resolver       ipResolver
+	family         string
+	connectTimeout time.Duration
+	fallbackDelay  time.Duration
+	sourceIPv4     net.IP
+	sourceIPv6     net.IP
+	sources        *sourcePool
+	proxy          *outboundProxy
+}
+
+type sourcePool struct {
+	selection string
+	ipv4      []net.IP
+	ipv6      []net.IP
+	ehloNames map[string]string
+	next      *atomic.Uint64
+}
+
+func newOutboundDialer(cfg config.DeliveryConfig, resolver ipResolver) (outboundDialer, error) {
+	dialer := outboundDialer{
+		resolver:       resolver,
+		family:         cfg.IPFamily,
+		connectTimeout: cfg.ConnectTimeout,
+		fallbackDelay:  cfg.FallbackDelay,
+		sourceIPv4:     net.ParseIP(cfg.SourceIPv4),
+		sourceIPv6:     net.ParseIP(cfg.SourceIPv6),
+	}
+	if dialer.family == "" {
+		dialer.family = config.IPFamilyDual
+	}
+	if dialer.connectTimeout <= 0 {
+		dialer.connectTimeout = 30 * time.Second
+	}
+	proxy, err := newOutboundProxy(cfg.Proxy, dialer.connectTimeout)
+	if err != nil {
+		return outboundDialer{}, err
+	}
+	dialer.proxy = proxy
+
+	if cfg.SourcePool != nil {
+		pool := &sourcePool{
+			selection: cfg.SourcePool.Selection,
+			ehloNames: make(map[string]string),
+			next:      new(atomic.Uint64),
+		}
+		for _, address := range cfg.SourcePool.Addresses {
+			ip := net.ParseIP(address.IP)
+			if ip.To4() != nil {
+				pool.ipv4 = append(pool.ipv4, ip)
+			} else {
+				pool.ipv6 = append(pool.ipv6, ip)
+			}
+			if address.EHLOName != "" {
+				pool.ehloNames[ip.String()] = address.EHLOName
+			}
+		}
+		dialer.sources = pool
+	}
+
+	if cfg.SourceInterface != "" {
+		iface, err := net.InterfaceByName(cfg.SourceInterface)
+		if err != nil {
+			return outboundDialer{}, fmt.Errorf("delivery.source_interface: %w", err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return outboundDialer{}, fmt.Errorf("delivery.source_interface addresses: %w", err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil && dialer.sourceIPv4 == nil {
+				dialer.sourceIPv4 = ipNet.IP
+			} else if ipNet.IP.To4() == nil && dialer.sourceIPv6 == nil {
+				dialer.sourceIPv6 = ipNet.IP
+			}
+		}
+		if dialer.sourceIPv4 == nil && dialer.sourceIPv6 == nil {
+			return outboundDialer{}, fmt.Errorf("delivery.source_interface %s has no usable addresses", cfg.SourceInterface)
+		}
+	}
+	return dialer, nil
+}
+
+func (d outboundDialer) forDomain(domain string) outboundDialer {
+	if d.sources == nil {
+		return d
+	}
+	var index uint64
+	if d.sources.selection == config.SourceSelectionDomain {
+		hash := fnv.New32a()
+		hash.Write([]byte(strings.ToLower(domain)))
+		index = uint64(hash.Sum32())
+	} else {
+		index = d.sources.next.Add(1) - 1
+	}
+	if len(d.sources.ipv4) > 0 {
+		d.sourceIPv4 = d.sources.ipv4[index%uint64(len(d.sources.ipv4))]
+	}
+	if len(d.sources.ipv6) > 0 {
+		d.sourceIPv6 = d.sources.ipv6[index%uint64(len(d.sources.ipv6))]
+	}
+	return d
+}
+
+func (d outboundDialer) sourceKey() string {
+	if d.sources == nil {
+		return ""
+	}
+	var parts []string
+	for _, ip := range []net.IP{d.sourceIPv4, d.sourceIPv6} {
+		if ip != nil {
+			parts = append(parts, ip.String())
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d outboundDialer) ehloName(conn net.Conn, fallback string) string {
+	if d.sources == nil || conn == nil {
+		return fallback
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return fallback
+	}
+	if name, ok := d.sources.ehloNames[local.IP.String()]; ok {
+		return name
+	}
+	return fallback
+}
+
+func (d outboundDialer) dial(ctx context.Context, host string, port string) (net.Conn, error) {
+	if d.proxy != nil && d.proxy.remoteResolve {
+		return d.proxy.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy != nil {
+		return d.dialProxy(ctx, ips, port)
+	}
+	return d.race(ctx, ips, port)
+}
+
+func (d outboundDialer) dialProxy(ctx context.Context, ips []net.IP, port string) (net.Conn, error) {
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.proxy.dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (d outboundDialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IP{ip}
+	} else {
+		resolved, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.IP)
+		}
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			if d.family != config.IPFamilyIPv6 && d.canSource(ip) {
+				v4 = append(v4, ip)
+			}
+		} else if d.family != config.IPFamilyIPv4 && d.canSource(ip) {
+			v6 = append(v6, ip)
+		}
+	}
+
+	ordered := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("resolve %s: no %s addresses", host, d.family)
+	}
+	return ordered, nil
+}
+
+func (d outboundDialer) canSource(ip net.IP) bool {
+	if d.sourceIPv4 == nil && d.sourceIPv6 == nil {
+		return true
+	}
+	if ip.To4() != nil {
+		return d.sourceIPv4 != nil
+	}
+	return d.sourceIPv6 != nil
+}
+
+func (d outboundDialer) race(ctx context.Context, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialIP(ctx, ip, port)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	fallback := time.NewTimer(d.fallbackDelay)
+	defer fallback.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(ips) {
+				start()
+				fallback.Reset(d.fallbackDelay)
+			}
+		case <-fallback.C:
+			if next < len(ips) {
+				start()
+				fallback.Reset(d.fallbackDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (d outboundDialer) dialIP(ctx context.Context, ip net.IP, port string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.connectTimeout}
+	source := d.sourceIPv6
+	if ip.To4() != nil {
+		source = d.sourceIPv4
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+}
+
+type greetedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *greetedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func startTLS(conn net.Conn, name string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(startTLSTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	text := textproto.NewConn(conn)
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		return nil, fmt.Errorf("read greeting: %w", err)
+	}
+	_, extensions, err := smtpCommand(text, 250, "EHLO %s", name)
+	if err != nil {
+		return nil, fmt.Errorf("ehlo: %w", err)
+	}
+	if !hasSMTPExtension(extensions, "STARTTLS") {
+		return nil, errors.New("server doesn't support STARTTLS")
+	}
+	if _, _, err := smtpCommand(text, 220, "STARTTLS"); err != nil {
+		return nil, fmt.Errorf("starttls: %w", err)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	greeting, _, _ = strings.Cut(greeting, "\n")
+	return &greetedConn{Conn: tlsConn, reader: io.MultiReader(strings.NewReader("220 "+greeting+"\r\n"), tlsConn)}, nil
+}
+
+func smtpCommand(text *textproto.Conn, expectCode int, format string, args ...any) (int, string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
+}
+
+func hasSMTPExtension(extensions string, name string) bool {
+	lines := strings.Split(extensions, "\n")
+	for _, line := range lines[1:] {
+		if keyword, _, _ := strings.Cut(strings.TrimSpace(line), " "); strings.EqualFold(keyword, name) {
+			return true
+		}
+	}
+	return false
+}
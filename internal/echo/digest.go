@@ -0,0 +1,204 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type digestEntry struct {
+	messageID  int64
+	subject    string
+	receivedAt time.Time
+	size       int64
+	sha256     string
+}
+
+type digestBatch struct {
+	recipient string
+	identity  replyIdentity
+	entries   []digestEntry
+	timer     *time.Timer
+}
+
+type digestQueue struct {
+	mu          sync.Mutex
+	window      time.Duration
+	maxMessages int
+	owner       *Replier
+	batches     map[string]*digestBatch
+	wg          sync.WaitGroup
+}
+
+func newDigestQueue(cfg *config.DigestConfig, owner *Replier) *digestQueue {
+	if cfg == nil {
+		return nil
+	}
+	return &digestQueue{window: cfg.Window, maxMessages: cfg.MaxMessages, owner: owner, batches: make(map[string]*digestBatch)}
+}
+
+func (q *digestQueue) current() *Replier {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.owner
+}
+
+func handOffDigests(previous Processor, next Processor) {
+	old, reloaded := processorReplier(previous), processorReplier(next)
+	if old == nil || reloaded == nil || old.digest == nil || reloaded.digest == nil || old.digest == reloaded.digest {
+		return
+	}
+	q := old.digest
+	q.mu.Lock()
+	q.window = reloaded.digest.window
+	q.maxMessages = reloaded.digest.maxMessages
+	q.owner = reloaded
+	q.mu.Unlock()
+	reloaded.digest = q
+}
+
+func processorReplier(processor Processor) *Replier {
+	switch p := processor.(type) {
+	case *Replier:
+		return p
+	case *grpcProcessor:
+		return p.Replier
+	}
+	return nil
+}
+
+func (r *Replier) addToDigest(msg InboundMessage, header mail.Header, recipient string) {
+	entry := digestEntry{messageID: msg.ID, receivedAt: msg.ReceivedAt, size: msg.Size()}
+	entry.subject, _ = header.Subject()
+	if digest, err := digestBody(msg); err == nil {
+		entry.sha256 = digest.sha256
+	}
+
+	key := strings.ToLower(recipient)
+	q := r.digest
+	q.mu.Lock()
+	batch := q.batches[key]
+	if batch == nil {
+		batch = &digestBatch{recipient: recipient, identity: r.identityFor(msg.Recipients)}
+		batch.timer = time.AfterFunc(q.window, func() { q.current().flushDigest(key, batch) })
+		q.batches[key] = batch
+	}
+	batch.entries = append(batch.entries, entry)
+	full := q.maxMessages > 0 && len(batch.entries) >= q.maxMessages
+	owner := q.owner
+	q.mu.Unlock()
+
+	if full {
+		owner.flushDigest(key, batch)
+	}
+}
+
+func (r *Replier) flushDigest(key string, batch *digestBatch) {
+	q := r.digest
+	q.mu.Lock()
+	if q.batches[key] != batch {
+		q.mu.Unlock()
+		return
+	}
+	delete(q.batches, key)
+	batch.timer.Stop()
+	q.wg.Add(1)
+	q.mu.Unlock()
+
+	defer q.wg.Done()
+	r.sendDigest(context.Background(), batch)
+}
+
+func (r *Replier) flushDigests() {
+	if r.digest == nil {
+		return
+	}
+	q := r.digest
+	q.mu.Lock()
+	if q.owner != r {
+		q.mu.Unlock()
+		return
+	}
+	pending := make(map[string]*digestBatch, len(q.batches))
+	for key, batch := range q.batches {
+		pending[key] = batch
+	}
+	q.mu.Unlock()
+
+	for key, batch := range pending {
+		r.flushDigest(key, batch)
+	}
+	q.wg.Wait()
+}
+
+func (r *Replier) sendDigest(ctx context.Context, batch *digestBatch) {
+	body := replyBody{Plain: formatDigest(batch)}
+	meta := threadMetadata{ReplySubject: "Echo digest: " + countMessages(len(batch.entries))}
+	replyMessage, err := r.buildReplyMessage(batch.identity, batch.recipient, body, meta, nil, nil)
+	if err == nil {
+		replyMessage, err = signMessage(batch.identity.dkim, replyMessage)
+	}
+	if err != nil {
+		if r.logger != nil {
+			r.logger.Printf("build echo digest to=%q: %v", batch.recipient, err)
+		}
+		return
+	}
+
+	r.archiveReply(batch.identity.mailFrom, replyMessage)
+	replyIDs := make([]int64, 0, len(batch.entries))
+	for _, entry := range batch.entries {
+		replyIDs = append(replyIDs, r.recordReply(ctx, entry.messageID, store.ReplyKindDigest, batch.recipient, replyMessage))
+	}
+	err = r.deliver(ctx, r.verp.envelopeSender(batch.identity.mailFrom, batch.recipient, replyIDs[0]), batch.recipient, replyMessage)
+	status := store.ReplyStatusDelivered
+	if err != nil {
+		status = store.ReplyStatusFailed
+	}
+	for _, replyID := range replyIDs {
+		r.recordReplyStatus(ctx, replyID, status, err)
+	}
+	if err != nil {
+		r.recordHardBounce(batch.recipient, err)
+		if r.logger != nil {
+			r.logger.Printf("deliver echo digest to=%q messages=%d: %v", batch.recipient, len(batch.entries), err)
+		}
+		return
+	}
+	r.suppressions.RecordDelivery(batch.recipient)
+	r.markDelivered()
+
+	if r.logger != nil {
+		r.logger.Printf("sent echo digest to=%q messages=%d bytes=%d", batch.recipient, len(batch.entries), len(replyMessage))
+	}
+}
+
+func formatDigest(batch *digestBatch) string {
+	var digest strings.Builder
+	digest.WriteString("SMTP Echo digest\n\n")
+	fmt.Fprintf(&digest, "Batched %s from %s into this reply.\n", countMessages(len(batch.entries)), batch.recipient)
+	for i, entry := range batch.entries {
+		writeReportSection(&digest, fmt.Sprintf("Message %d", i+1))
+		writeReportField(&digest, "Subject", displayOrNone(entry.subject))
+		if !entry.receivedAt.IsZero() {
+			writeReportField(&digest, "Received at", entry.receivedAt.Format(time.RFC3339))
+		}
+		writeReportField(&digest, "Size", fmt.Sprintf("%d bytes", entry.size))
+		writeReportField(&digest, "Body SHA-256", displayOrNone(entry.sha256))
+	}
+	return digest.String()
+}
+
+func countMessages(n int) string {
+	if n == 1 {
+		return "1 message"
+	}
+	return fmt.Sprintf("%d messages", n)
+}
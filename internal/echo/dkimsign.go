@@ -0,0 +1,156 @@
+package echo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var dkimWhitespace = regexp.MustCompile(`[ \t]+`)
+
+func signWithBodyLength(message []byte, options *dkim.SignOptions, limit int64, now time.Time) ([]byte, error) {
+	header, body := splitDKIMMessage(message)
+	canonicalBody := canonicalizeDKIMBody(body, options.BodyCanonicalization)
+	if int64(len(canonicalBody)) > limit {
+		canonicalBody = canonicalBody[:limit]
+	}
+	bodyHash := sha256.Sum256(canonicalBody)
+
+	tags := [][2]string{
+		{"v", "1"},
+		{"a", "rsa-sha256"},
+		{"c", string(options.HeaderCanonicalization) + "/" + string(options.BodyCanonicalization)},
+		{"d", options.Domain},
+		{"s", options.Selector},
+		{"t", strconv.FormatInt(now.Unix(), 10)},
+	}
+	if !options.Expiration.IsZero() {
+		tags = append(tags, [2]string{"x", strconv.FormatInt(options.Expiration.Unix(), 10)})
+	}
+	if options.Identifier != "" {
+		tags = append(tags, [2]string{"i", options.Identifier})
+	}
+	tags = append(tags,
+		[2]string{"l", strconv.Itoa(len(canonicalBody))},
+		[2]string{"h", strings.Join(options.HeaderKeys, ":")},
+		[2]string{"bh", base64.StdEncoding.EncodeToString(bodyHash[:])},
+	)
+
+	hasher := sha256.New()
+	fields := splitDKIMHeaderFields(header)
+	used := make(map[string]int)
+	for _, key := range options.HeaderKeys {
+		if field, ok := pickDKIMHeaderField(fields, key, used); ok {
+			hasher.Write([]byte(canonicalizeDKIMHeader(field, options.HeaderCanonicalization)))
+		}
+	}
+	unsigned := formatDKIMSignature(tags, "")
+	hasher.Write([]byte(strings.TrimRight(canonicalizeDKIMHeader(unsigned, options.HeaderCanonicalization), "\r\n")))
+
+	signature, err := options.Signer.Sign(rand.Reader, hasher.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	signed := formatDKIMSignature(tags, base64.StdEncoding.EncodeToString(signature)) + "\r\n"
+	return append([]byte(signed), message...), nil
+}
+
+func splitDKIMMessage(message []byte) ([]byte, []byte) {
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	if end < 0 {
+		return message, nil
+	}
+	return message[:end+2], message[end+4:]
+}
+
+func splitDKIMHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func pickDKIMHeaderField(fields []string, key string, used map[string]int) (string, bool) {
+	key = strings.ToLower(key)
+	skip := used[key]
+	for i := len(fields) - 1; i >= 0; i-- {
+		name, _, _ := strings.Cut(fields[i], ":")
+		if strings.ToLower(strings.TrimSpace(name)) != key {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		used[key]++
+		return fields[i], true
+	}
+	return "", false
+}
+
+func canonicalizeDKIMHeader(field string, canonicalization dkim.Canonicalization) string {
+	if canonicalization != dkim.CanonicalizationRelaxed {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(dkimWhitespace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+func canonicalizeDKIMBody(body []byte, canonicalization dkim.Canonicalization) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canonicalization == dkim.CanonicalizationRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(dkimWhitespace.ReplaceAllString(line, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canonicalization == dkim.CanonicalizationRelaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func formatDKIMSignature(tags [][2]string, signature string) string {
+	var field strings.Builder
+	field.WriteString("DKIM-Signature:")
+	lineLength := field.Len()
+	for _, tag := range tags {
+		item := " " + tag[0] + "=" + tag[1] + ";"
+		if lineLength+len(item) > 76 {
+			field.WriteString("\r\n")
+			lineLength = 0
+		}
+		field.WriteString(item)
+		lineLength += len(item)
+	}
+	field.WriteString("\r\n b=")
+	for len(signature) > 72 {
+		field.WriteString(signature[:72] + "\r\n ")
+		signature = signature[72:]
+	}
+	field.WriteString(signature)
+	return field.String()
+}
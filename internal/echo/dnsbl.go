@@ -0,0 +1,215 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/miekg/dns"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+var errDNSBLListed = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Client host is listed on a DNS blocklist",
+}
+
+type DNSBLResult struct {
+	Zone   string   `json:"zone"`
+	Listed bool     `json:"listed"`
+	Codes  []string `json:"codes,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type dnsblPolicy struct {
+	zones    []string
+	policy   string
+	tag      string
+	timeout  time.Duration
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	cache    map[string]dnsblVerdict
+}
+
+type dnsblVerdict struct {
+	results []DNSBLResult
+	expires time.Time
+}
+
+func newDNSBLPolicy(cfg *config.DNSBLConfig) *dnsblPolicy {
+	if cfg == nil {
+		return nil
+	}
+	return &dnsblPolicy{
+		zones:    cfg.Zones,
+		policy:   cfg.Policy,
+		tag:      cfg.Tag,
+		timeout:  cfg.Timeout,
+		cacheTTL: cfg.CacheTTL,
+		cache:    make(map[string]dnsblVerdict),
+	}
+}
+
+func (p *dnsblPolicy) cached(ip string, now time.Time) ([]DNSBLResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	verdict, ok := p.cache[ip]
+	if ok && now.After(verdict.expires) {
+		delete(p.cache, ip)
+		return nil, false
+	}
+	return verdict.results, ok
+}
+
+func (p *dnsblPolicy) remember(ip string, results []DNSBLResult, now time.Time) {
+	if p.cacheTTL <= 0 {
+		return
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			return
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, verdict := range p.cache {
+		if now.After(verdict.expires) {
+			delete(p.cache, key)
+		}
+	}
+	p.cache[ip] = dnsblVerdict{results: results, expires: now.Add(p.cacheTTL)}
+}
+
+func (p *dnsblPolicy) check(ctx context.Context, resolver mailauth.Resolver, ip net.IP) []DNSBLResult {
+	key := ip.String()
+	now := time.Now()
+	if results, ok := p.cached(key, now); ok {
+		return results
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	results := make([]DNSBLResult, len(p.zones))
+	var wg sync.WaitGroup
+	for i, zone := range p.zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = lookupDNSBL(ctx, resolver, ip, zone)
+		}()
+	}
+	wg.Wait()
+	p.remember(key, results, now)
+	return results
+}
+
+func lookupDNSBL(ctx context.Context, resolver mailauth.Resolver, ip net.IP, zone string) DNSBLResult {
+	result := DNSBLResult{Zone: zone}
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	reverse = strings.TrimSuffix(strings.TrimSuffix(reverse, "in-addr.arpa."), "ip6.arpa.")
+	name := reverse + strings.TrimSuffix(zone, ".")
+
+	addrs, err := resolver.LookupIPAddr(ctx, name)
+	if isDNSNotFound(err) {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, addr := range addrs {
+		code := addr.IP.To4()
+		if code == nil || code[0] != 127 {
+			continue
+		}
+		if code[1] == 255 && code[2] == 255 {
+			result.Error = fmt.Sprintf("query refused with %s", code)
+			return result
+		}
+		result.Codes = append(result.Codes, code.String())
+	}
+	if len(result.Codes) == 0 {
+		return result
+	}
+	result.Listed = true
+	if reasons, err := resolver.LookupTXT(ctx, name); err == nil {
+		result.Reason = strings.Join(reasons, "; ")
+	}
+	return result
+}
+
+func (b *Backend) dnsblPolicy() *dnsblPolicy {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.dnsbl
+}
+
+func (s *session) checkDNSBL() error {
+	policy := s.backend.dnsblPolicy()
+	if policy == nil {
+		return nil
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return nil
+	}
+	if s.dnsblIP != ip.String() {
+		s.dnsblIP = ip.String()
+		s.dnsbl = policy.check(s.context(), s.backend.dnsResolver(), ip)
+		for _, result := range s.dnsbl {
+			switch {
+			case result.Listed:
+				s.backend.logf("dnsbl listed remote=%s zone=%q codes=%s reason=%q", addrString(s.remoteAddr()), result.Zone, strings.Join(result.Codes, ","), result.Reason)
+			case result.Error != "":
+				s.backend.logf("dnsbl lookup failed remote=%s zone=%q: %s", addrString(s.remoteAddr()), result.Zone, result.Error)
+			}
+		}
+	}
+	if policy.policy == config.DNSBLPolicyReject && s.authUser == "" && dnsblListed(s.dnsbl) {
+		return errDNSBLListed
+	}
+	return nil
+}
+
+func (s *session) dnsblTag() string {
+	policy := s.backend.dnsblPolicy()
+	if policy == nil || policy.policy != config.DNSBLPolicyTag || !dnsblListed(s.dnsbl) {
+		return ""
+	}
+	return policy.tag
+}
+
+func dnsblListed(results []DNSBLResult) bool {
+	for _, result := range results {
+		if result.Listed {
+			return true
+		}
+	}
+	return false
+}
+
+func formatDNSBLResult(result DNSBLResult) string {
+	switch {
+	case result.Error != "":
+		return "error (" + result.Error + ")"
+	case !result.Listed:
+		return "not listed"
+	}
+	value := "listed (" + strings.Join(result.Codes, ", ") + ")"
+	if result.Reason != "" {
+		value += " " + result.Reason
+	}
+	return value
+}
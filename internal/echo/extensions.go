@@ -0,0 +1,53 @@
+package echo
+
+import (
+	"io"
+	"slices"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func filteredExtensions(listener config.ListenerConfig) []string {
+	if listener.TLSMode == config.TLSModeImplicit {
+		return nil
+	}
+	var filtered []string
+	for _, extension := range listener.DisableExtensions {
+		if extension != config.ExtensionDSN {
+			filtered = append(filtered, extension)
+		}
+	}
+	return filtered
+}
+
+func newChunkingDisabled(listeners []config.ListenerConfig) map[string]bool {
+	disabled := make(map[string]bool)
+	for _, listener := range listeners {
+		if slices.Contains(listener.DisableExtensions, config.ExtensionChunking) {
+			disabled[listener.Addr] = true
+		}
+	}
+	return disabled
+}
+
+func transferCommand(r io.Reader) string {
+	if _, ok := r.(*io.PipeReader); ok {
+		return TransferBDAT
+	}
+	return TransferData
+}
+
+func (s *session) checkChunking(r io.Reader) error {
+	if s.conn == nil {
+		return nil
+	}
+	if transferCommand(r) != TransferBDAT {
+		return nil
+	}
+	s.backend.mu.RLock()
+	defer s.backend.mu.RUnlock()
+	if s.backend.chunkingDisabled[s.conn.Server().Addr] {
+		return errChunkingDisabled
+	}
+	return nil
+}
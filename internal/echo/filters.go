@@ -0,0 +1,158 @@
+package echo
+
+import (
+	"fmt"
+	stdhtml "html"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type bodyFilter func(replyBody) replyBody
+
+var (
+	blockquotePattern  = regexp.MustCompile(`(?is)<blockquote[^>]*>.*?</blockquote>`)
+	attributionPattern = regexp.MustCompile(`^On .+ wrote:\s*$`)
+	bodyClosePattern   = regexp.MustCompile(`(?i)</body>`)
+)
+
+func newBodyFilters(cfg map[string][]config.FilterConfig) (map[string][]bodyFilter, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	filters := make(map[string][]bodyFilter, len(cfg))
+	for name, chain := range cfg {
+		for i, filterCfg := range chain {
+			filter, err := newBodyFilter(filterCfg)
+			if err != nil {
+				return nil, fmt.Errorf("filters.%s[%d]: %w", name, i, err)
+			}
+			filters[name] = append(filters[name], filter)
+		}
+	}
+	return filters, nil
+}
+
+func newBodyFilter(cfg config.FilterConfig) (bodyFilter, error) {
+	switch cfg.Type {
+	case config.FilterUppercase:
+		return textFilter(strings.ToUpper), nil
+	case config.FilterReverse:
+		return textFilter(reverseLines), nil
+	case config.FilterROT13:
+		return textFilter(rot13), nil
+	case config.FilterReplace:
+		pattern, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile pattern: %w", err)
+		}
+		return textFilter(func(text string) string {
+			return pattern.ReplaceAllString(text, cfg.Replacement)
+		}), nil
+	case config.FilterStripQuotes:
+		return stripQuotes, nil
+	case config.FilterFooter:
+		return footerFilter(cfg.Text), nil
+	}
+	return nil, fmt.Errorf("unknown filter type %q", cfg.Type)
+}
+
+func (r *Replier) filterBody(msg InboundMessage, body replyBody) replyBody {
+	names := msg.Filters
+	if tag := strings.ToLower(msg.Tag); tag != "" && !slices.Contains(names, tag) {
+		names = append(slices.Clone(names), tag)
+	}
+	for _, name := range names {
+		for _, filter := range r.filters[name] {
+			body = filter(body)
+		}
+	}
+	return body
+}
+
+func textFilter(fn func(string) string) bodyFilter {
+	return func(body replyBody) replyBody {
+		body.Plain = fn(body.Plain)
+		body.HTML = mapHTMLText(body.HTML, fn)
+		return body
+	}
+}
+
+func mapHTMLText(input string, fn func(string) string) string {
+	if input == "" {
+		return ""
+	}
+	var output strings.Builder
+	last := 0
+	for _, tag := range htmlTagPattern.FindAllStringIndex(input, -1) {
+		output.WriteString(stdhtml.EscapeString(fn(stdhtml.UnescapeString(input[last:tag[0]]))))
+		output.WriteString(input[tag[0]:tag[1]])
+		last = tag[1]
+	}
+	output.WriteString(stdhtml.EscapeString(fn(stdhtml.UnescapeString(input[last:]))))
+	return output.String()
+}
+
+func reverseLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line, cr := strings.CutSuffix(line, "\r")
+		runes := []rune(line)
+		slices.Reverse(runes)
+		lines[i] = string(runes)
+		if cr {
+			lines[i] += "\r"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func rot13(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return 'a' + (r-'a'+13)%26
+		case r >= 'A' && r <= 'Z':
+			return 'A' + (r-'A'+13)%26
+		}
+		return r
+	}, text)
+}
+
+func stripQuotes(body replyBody) replyBody {
+	lines := strings.Split(body.Plain, "\n")
+	kept := lines[:0]
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		if attributionPattern.MatchString(line) && i+1 < len(lines) && strings.HasPrefix(lines[i+1], ">") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	body.Plain = strings.Join(kept, "\n")
+	body.HTML = blockquotePattern.ReplaceAllString(body.HTML, "")
+	return body
+}
+
+func footerFilter(text string) bodyFilter {
+	return func(body replyBody) replyBody {
+		if body.Plain != "" && !strings.HasSuffix(body.Plain, "\n") {
+			body.Plain += "\n"
+		}
+		body.Plain += "\n" + text + "\n"
+		if body.HTML != "" {
+			footer := "<p>" + stdhtml.EscapeString(text) + "</p>"
+			if loc := bodyClosePattern.FindAllStringIndex(body.HTML, -1); len(loc) > 0 {
+				end := loc[len(loc)-1][0]
+				body.HTML = body.HTML[:end] + footer + body.HTML[end:]
+			} else {
+				body.HTML += footer
+			}
+		}
+		return body
+	}
+}
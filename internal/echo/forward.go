@@ -0,0 +1,124 @@
+package echo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type forwarding struct {
+	to          []string
+	only        bool
+	mailFrom    string
+	relayHost   string
+	relayPort   string
+	username    string
+	password    string
+	requirement tlsRequirement
+}
+
+func newForwarding(cfg *config.ForwardConfig) *forwarding {
+	if cfg == nil {
+		return nil
+	}
+	f := &forwarding{
+		to:       cfg.To,
+		only:     cfg.Mode == config.ForwardModeOnly,
+		mailFrom: cfg.MailFrom,
+		username: cfg.Username,
+		password: cfg.Password,
+	}
+	if cfg.Relay != "" {
+		f.relayHost, f.relayPort, _ = net.SplitHostPort(cfg.Relay)
+	}
+	switch cfg.TLSPolicy {
+	case config.TLSPolicyRequire:
+		f.requirement = tlsRequirement{source: "forward.tls_policy"}
+	case config.TLSPolicyNone:
+		f.requirement = tlsRequirement{plaintext: true}
+	}
+	return f
+}
+
+func (r *Replier) forwardAll(ctx context.Context, msg InboundMessage) (bool, error) {
+	if r.forward == nil {
+		return false, nil
+	}
+	err := r.Forward(ctx, msg, r.forward.to)
+	if r.forward.only {
+		return true, err
+	}
+	if err != nil && r.logger != nil {
+		r.logger.Printf("forward message id=%d failed: %v", msg.ID, err)
+	}
+	return false, nil
+}
+
+func (r *Replier) Forward(ctx context.Context, msg InboundMessage, recipients []string) error {
+	original, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from := r.mailFrom
+	if r.forward != nil {
+		from = r.forward.mailFrom
+	}
+	var errs []error
+	for _, recipient := range recipients {
+		replyID := r.recordReply(ctx, msg.ID, store.ReplyKindForward, recipient, original)
+		if err := r.deliverForward(ctx, from, recipient, original); err != nil {
+			r.recordReplyStatus(ctx, replyID, store.ReplyStatusFailed, err)
+			errs = append(errs, fmt.Errorf("forward to %s: %w", recipient, err))
+			continue
+		}
+		r.recordReplyStatus(ctx, replyID, store.ReplyStatusDelivered, nil)
+		if r.logger != nil {
+			r.logger.Printf("forwarded message id=%d to=%q bytes=%d", msg.ID, recipient, len(original))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Replier) deliverForward(ctx context.Context, from string, recipient string, message []byte) error {
+	if r.forward == nil || r.forward.relayHost == "" || !r.sendsMail() {
+		return r.deliver(ctx, from, recipient, message)
+	}
+	release, err := r.waitForSlot(ctx, recipient)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	relay := r.forward
+	dialer := r.dialer.forDomain(relay.relayHost)
+	client, secure, err := dialSMTPClient(func() (net.Conn, error) {
+		return dialer.dial(ctx, relay.relayHost, relay.relayPort)
+	}, func(conn net.Conn) string {
+		return dialer.ehloName(conn, r.ehloName)
+	}, r.clientTLSConfig(relay.relayHost, relay.requirement), relay.requirement)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if relay.username != "" {
+		if !secure {
+			return errors.New("relay auth refused without tls")
+		}
+		if err := client.Auth(sasl.NewPlainClient("", relay.username, relay.password)); err != nil {
+			return fmt.Errorf("relay auth: %w", err)
+		}
+	}
+	if err := sendMail(client, from, recipient, message); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	if err := client.Quit(); err != nil {
+		return fmt.Errorf("quit smtp session: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package echo
+
+import (
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/greylist"
+)
+
+var errGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+func newGreylist(cfg *config.GreylistConfig) *greylist.List {
+	if cfg == nil {
+		return nil
+	}
+	return greylist.New(cfg.Delay, cfg.Window, cfg.Expiry)
+}
+
+func reconfigureGreylist(list *greylist.List, cfg *config.GreylistConfig) *greylist.List {
+	if cfg == nil || list == nil {
+		return newGreylist(cfg)
+	}
+	list.Configure(cfg.Delay, cfg.Window, cfg.Expiry)
+	return list
+}
+
+func (s *session) checkGreylist(recipient string) error {
+	list := s.backend.greylisting()
+	ip := s.remoteIP()
+	if list == nil || ip == nil || s.authUser != "" {
+		return nil
+	}
+	if list.Allow(ip.String(), s.envelopeFrom, recipient) {
+		return nil
+	}
+	s.backend.logf("greylisted remote=%s from=%q to=%q", addrString(s.remoteAddr()), s.envelopeFrom, recipient)
+	return errGreylisted
+}
@@ -0,0 +1,184 @@
+package echo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	processorv1 "github.com/danthegoodman1/smtp_echo/api/processor/v1"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errProcessorUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message processor unavailable, please try again later",
+}
+
+type grpcProcessor struct {
+	*Replier
+	conn    *grpcConn
+	client  processorv1.ProcessorClient
+	timeout time.Duration
+}
+
+type grpcConn struct {
+	*grpc.ClientConn
+	cfg  config.GRPCConfig
+	refs atomic.Int32
+}
+
+func (c *grpcConn) release() error {
+	if c.refs.Add(-1) > 0 {
+		return nil
+	}
+	return c.Close()
+}
+
+func NewProcessor(cfg config.Config, replier *Replier) (Processor, error) {
+	if cfg.Processor != config.ProcessorGRPC || cfg.GRPC == nil {
+		return replier, nil
+	}
+
+	transport := insecure.NewCredentials()
+	if cfg.GRPC.TLS {
+		transport = grpccredentials.NewTLS(&tls.Config{ServerName: cfg.GRPC.TLSServerName})
+	}
+	clientConn, err := grpc.NewClient(cfg.GRPC.Target, grpc.WithTransportCredentials(transport))
+	if err != nil {
+		return nil, fmt.Errorf("create grpc processor client: %w", err)
+	}
+	conn := &grpcConn{ClientConn: clientConn, cfg: *cfg.GRPC}
+	conn.refs.Store(1)
+	return &grpcProcessor{
+		Replier: replier,
+		conn:    conn,
+		client:  processorv1.NewProcessorClient(conn),
+		timeout: cfg.GRPC.Timeout,
+	}, nil
+}
+
+func reuseProcessorConn(previous Processor, next Processor) {
+	old, ok := previous.(*grpcProcessor)
+	if !ok {
+		return
+	}
+	reloaded, ok := next.(*grpcProcessor)
+	if !ok || reloaded.conn == old.conn || reloaded.conn.cfg != old.conn.cfg {
+		return
+	}
+	reloaded.conn.release()
+	old.conn.refs.Add(1)
+	reloaded.conn = old.conn
+	reloaded.client = old.client
+}
+
+func (p *grpcProcessor) Echo(ctx context.Context, msg InboundMessage) error {
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	request := &processorv1.ProcessRequest{
+		Id:           msg.ID,
+		ReceivedAt:   timestamppb.New(msg.ReceivedAt),
+		RemoteAddr:   addrString(msg.RemoteAddr),
+		Helo:         msg.Helo,
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		AuthUser:     msg.AuthUser,
+		Tls:          msg.TLS != nil,
+		Raw:          raw,
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	response, err := p.client.Process(callCtx, request)
+	if err != nil {
+		if p.logger != nil {
+			p.logger.Printf("grpc processor from=%q: %v", msg.EnvelopeFrom, err)
+		}
+		return errProcessorUnavailable
+	}
+
+	switch response.GetAction() {
+	case processorv1.Action_ACTION_ECHO:
+		return p.Replier.Echo(ctx, msg)
+	case processorv1.Action_ACTION_DROP:
+		if p.logger != nil {
+			p.logger.Printf("grpc processor dropped message id=%d from=%q", msg.ID, msg.EnvelopeFrom)
+		}
+		return nil
+	case processorv1.Action_ACTION_REJECT:
+		return rejectError(int(response.GetRejectCode()), response.GetRejectEnhancedCode(), response.GetRejectMessage())
+	case processorv1.Action_ACTION_REPLY:
+		identity := p.identityFor(msg.Recipients)
+		var errs []error
+		for _, reply := range response.GetReplies() {
+			recipient := reply.GetRecipient()
+			if recipient == "" {
+				recipient = msg.EnvelopeFrom
+			}
+			if recipient == "" || p.suppressed(recipient) {
+				continue
+			}
+			if err := p.sendReply(ctx, msg, identity, recipient, reply.GetMessage()); err != nil {
+				errs = append(errs, fmt.Errorf("reply to %s: %w", recipient, err))
+			}
+		}
+		return errors.Join(errs...)
+	default:
+		return fmt.Errorf("grpc processor returned unknown action %d", response.GetAction())
+	}
+}
+
+func (p *grpcProcessor) Close() error {
+	err := p.conn.release()
+	if closeErr := p.Replier.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
+
+func rejectError(code int, enhancedCode string, message string) *smtp.SMTPError {
+	if code < 400 || code > 599 {
+		code = 550
+	}
+	enhanced := smtp.EnhancedCode{5, 7, 1}
+	if code < 500 {
+		enhanced = smtp.EnhancedCode{4, 7, 1}
+	}
+	if parsed, ok := parseEnhancedCode(enhancedCode); ok && parsed[0] == code/100 {
+		enhanced = parsed
+	}
+	if message == "" {
+		message = "Message rejected"
+	}
+	return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+}
+
+func parseEnhancedCode(value string) (smtp.EnhancedCode, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, false
+	}
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return smtp.EnhancedCode{}, false
+		}
+		code[i] = n
+	}
+	return code, true
+}
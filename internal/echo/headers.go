@@ -0,0 +1,64 @@
+package echo
+
+import (
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type replyHeaders struct {
+	static      []headerField
+	passthrough []string
+}
+
+func newReplyHeaders(cfg config.ReplyConfig) replyHeaders {
+	var headers replyHeaders
+	for name, value := range cfg.Headers {
+		headers.static = append(headers.static, headerField{name, value})
+	}
+	sort.Slice(headers.static, func(i, j int) bool {
+		return headers.static[i].key < headers.static[j].key
+	})
+	for _, pattern := range cfg.PassthroughHeaders {
+		headers.passthrough = append(headers.passthrough, strings.ToLower(pattern))
+	}
+	return headers
+}
+
+func reservedReplyHeader(name string) bool {
+	return slices.ContainsFunc(config.ReservedReplyHeaders, func(reserved string) bool {
+		return strings.EqualFold(reserved, name)
+	})
+}
+
+func (h replyHeaders) passthroughFields(header mail.Header) []headerField {
+	if len(h.passthrough) == 0 {
+		return nil
+	}
+	var fields []headerField
+	inbound := header.Fields()
+	for inbound.Next() {
+		key := inbound.Key()
+		if reservedReplyHeader(key) || !h.passes(key) {
+			continue
+		}
+		value := strings.NewReplacer("\r\n", "", "\n", "").Replace(inbound.Value())
+		fields = append(fields, headerField{key, value})
+	}
+	return fields
+}
+
+func (h replyHeaders) passes(key string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range h.passthrough {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
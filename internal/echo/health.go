@@ -0,0 +1,110 @@
+package echo
+
+import (
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+	"github.com/danthegoodman1/smtp_echo/internal/resolver"
+)
+
+type Health struct {
+	QueueBacklog         int
+	InFlight             int64
+	DeliveriesWaiting    int
+	MaxBacklog           int
+	BacklogRejected      int64
+	DuplicatesSuppressed int64
+	Timeouts             map[string]int64
+	DKIM                 DKIMStatus
+	LastDelivery         time.Time
+	DNSCache             *resolver.Stats
+}
+
+type DKIMStatus struct {
+	Enabled  bool
+	Domain   string
+	Selector string
+}
+
+type healthReporter interface {
+	dkimStatus() DKIMStatus
+	lastDelivery() time.Time
+	dnsCacheStats() *resolver.Stats
+	deliveriesWaiting() int
+}
+
+func (b *Backend) Health() Health {
+	b.mu.RLock()
+	processor := b.processor
+	last := b.lastDelivery
+	dedup := b.dedup
+	b.mu.RUnlock()
+
+	health := Health{
+		QueueBacklog:         b.queue.Len(),
+		InFlight:             b.activity.InFlight(),
+		LastDelivery:         last,
+		MaxBacklog:           b.conns.backlogLimit(),
+		BacklogRejected:      b.conns.backlogged.Load(),
+		DuplicatesSuppressed: dedup.suppressedCount(),
+		Timeouts:             b.conns.timeoutCounts(),
+	}
+	if reporter, ok := processor.(healthReporter); ok {
+		health.DKIM = reporter.dkimStatus()
+		health.DNSCache = reporter.dnsCacheStats()
+		health.DeliveriesWaiting = reporter.deliveriesWaiting()
+		if delivered := reporter.lastDelivery(); delivered.After(health.LastDelivery) {
+			health.LastDelivery = delivered
+		}
+	}
+	return health
+}
+
+func (b *Backend) backlog() int {
+	b.mu.RLock()
+	processor := b.processor
+	b.mu.RUnlock()
+	backlog := b.queue.Len()
+	if reporter, ok := processor.(healthReporter); ok {
+		backlog += reporter.deliveriesWaiting()
+	}
+	return backlog
+}
+
+func (r *Replier) dkimStatus() DKIMStatus {
+	if r.dkim == nil {
+		return DKIMStatus{}
+	}
+	status := DKIMStatus{Enabled: true, Domain: r.dkim.domain}
+	if key, ok := dkimkeys.Active(r.dkim.keys, time.Now()); ok {
+		status.Selector = key.Selector
+	}
+	return status
+}
+
+func (r *Replier) dnsCacheStats() *resolver.Stats {
+	if r.dnsCache == nil {
+		return nil
+	}
+	stats := r.dnsCache.Stats()
+	return &stats
+}
+
+func (r *Replier) deliveriesWaiting() int {
+	return r.scheduler.pending()
+}
+
+func (r *Replier) lastDelivery() time.Time {
+	delivered := r.delivered.Load()
+	if delivered == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, delivered).UTC()
+}
+
+func (r *Replier) markDelivered() {
+	if r.discardsReplies() {
+		return
+	}
+	r.delivered.Store(time.Now().UnixNano())
+}
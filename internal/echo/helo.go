@@ -0,0 +1,162 @@
+package echo
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errHeloRejected = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "HELO/EHLO name rejected",
+}
+
+type HeloCheck struct {
+	Name     string   `json:"name"`
+	Problems []string `json:"problems,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type heloPolicy struct {
+	checks    map[string]bool
+	policy    string
+	timeout   time.Duration
+	hostnames []string
+}
+
+func newHeloPolicy(cfg config.Config) *heloPolicy {
+	if cfg.Helo == nil {
+		return nil
+	}
+	policy := &heloPolicy{
+		checks:    make(map[string]bool),
+		policy:    cfg.Helo.Policy,
+		timeout:   cfg.Helo.Timeout,
+		hostnames: []string{normalizeHost(cfg.Hostname)},
+	}
+	for _, check := range cfg.Helo.Checks {
+		policy.checks[check] = true
+	}
+	for _, listener := range cfg.Listeners {
+		if listener.Hostname != "" {
+			policy.hostnames = append(policy.hostnames, normalizeHost(listener.Hostname))
+		}
+	}
+	return policy
+}
+
+func (b *Backend) heloPolicy() *heloPolicy {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.helo
+}
+
+func (s *session) checkHelo() error {
+	policy := s.backend.heloPolicy()
+	if policy == nil {
+		return nil
+	}
+	name := s.heloName()
+	if s.helo == nil || s.helo.Name != name {
+		s.helo = s.evaluateHelo(policy, name)
+		if len(s.helo.Problems) > 0 {
+			s.backend.logf("helo check failed remote=%s helo=%q problems=%q", addrString(s.remoteAddr()), name, strings.Join(s.helo.Problems, "; "))
+		}
+		if s.helo.Error != "" {
+			s.backend.logf("helo lookup failed remote=%s helo=%q: %s", addrString(s.remoteAddr()), name, s.helo.Error)
+		}
+	}
+	if policy.policy == config.HeloPolicyReject && s.authUser == "" && len(s.helo.Problems) > 0 {
+		return errHeloRejected
+	}
+	return nil
+}
+
+func (s *session) evaluateHelo(policy *heloPolicy, name string) *HeloCheck {
+	check := &HeloCheck{Name: name}
+	ip := heloAddress(name)
+	host := normalizeHost(name)
+
+	if policy.checks[config.HeloCheckNotIP] && ip != nil {
+		check.Problems = append(check.Problems, "is an IP address literal")
+	}
+	if policy.checks[config.HeloCheckFQDN] && ip == nil && !isFQDN(host) {
+		check.Problems = append(check.Problems, "is not a fully qualified domain name")
+	}
+	if policy.checks[config.HeloCheckNotSelf] && s.heloIsSelf(policy, host, ip) {
+		check.Problems = append(check.Problems, "matches this server")
+	}
+	if policy.checks[config.HeloCheckResolves] && ip == nil && host != "" {
+		ctx, cancel := context.WithTimeout(s.context(), policy.timeout)
+		defer cancel()
+		_, err := s.backend.dnsResolver().LookupIPAddr(ctx, host)
+		switch {
+		case isDNSNotFound(err):
+			check.Problems = append(check.Problems, "does not resolve")
+		case err != nil:
+			check.Error = err.Error()
+		}
+	}
+	return check
+}
+
+func (s *session) heloIsSelf(policy *heloPolicy, host string, ip net.IP) bool {
+	if ip != nil {
+		if s.conn == nil {
+			return false
+		}
+		return ip.Equal(remoteIP(s.conn.Conn().LocalAddr()))
+	}
+	for _, hostname := range policy.hostnames {
+		if host != "" && host == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func heloAddress(name string) net.IP {
+	literal := strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "ipv6:") {
+		literal = literal[5:]
+	}
+	return net.ParseIP(literal)
+}
+
+func isFQDN(host string) bool {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func normalizeHost(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func formatHeloCheck(check *HeloCheck) string {
+	switch {
+	case len(check.Problems) > 0:
+		return "fail (" + strings.Join(check.Problems, "; ") + ")"
+	case check.Error != "":
+		return "error (" + check.Error + ")"
+	}
+	return "pass"
+}
@@ -0,0 +1,214 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	hookMetadataEnv = "SMTP_ECHO_METADATA"
+	hookExitSkip    = 1
+	hookExitReject  = 2
+	hookStderrBytes = 512
+)
+
+type replyHook struct {
+	command []string
+	timeout time.Duration
+}
+
+type hookMetadata struct {
+	ID           int64     `json:"id,omitempty"`
+	EnvelopeFrom string    `json:"envelope_from"`
+	Recipients   []string  `json:"recipients"`
+	Tag          string    `json:"tag,omitempty"`
+	Sequence     int64     `json:"sequence,omitempty"`
+	Subject      string    `json:"subject"`
+	MessageID    string    `json:"message_id,omitempty"`
+	Size         int64     `json:"size"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	LocalAddr    string    `json:"local_addr,omitempty"`
+	Helo         string    `json:"helo,omitempty"`
+	AuthUser     string    `json:"auth_user,omitempty"`
+	TLS          bool      `json:"tls"`
+	ReceivedAt   time.Time `json:"received_at"`
+	Attempt      int       `json:"attempt,omitempty"`
+}
+
+type hookOutput struct {
+	Subject string          `json:"subject"`
+	Body    *string         `json:"body"`
+	HTML    *string         `json:"html"`
+	Skip    bool            `json:"skip"`
+	Reject  json.RawMessage `json:"reject"`
+}
+
+func newReplyHook(cfg *config.ReplyExecConfig) *replyHook {
+	if cfg == nil {
+		return nil
+	}
+	return &replyHook{command: cfg.Command, timeout: cfg.Timeout}
+}
+
+func (h *replyHook) run(ctx context.Context, msg InboundMessage, header mail.Header) (scriptResult, error) {
+	subject, _ := header.Subject()
+	messageID, _ := header.MessageID()
+	metadata, err := json.Marshal(hookMetadata{
+		ID:           msg.ID,
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Tag:          msg.Tag,
+		Sequence:     msg.Sequence,
+		Subject:      subject,
+		MessageID:    messageID,
+		Size:         msg.Size(),
+		RemoteAddr:   addrString(msg.RemoteAddr),
+		LocalAddr:    addrString(msg.LocalAddr),
+		Helo:         msg.Helo,
+		AuthUser:     msg.AuthUser,
+		TLS:          msg.TLS != nil,
+		ReceivedAt:   msg.ReceivedAt,
+		Attempt:      msg.Attempt,
+	})
+	if err != nil {
+		return scriptResult{}, fmt.Errorf("encode reply hook metadata: %w", err)
+	}
+	stdin, err := msg.Open()
+	if err != nil {
+		return scriptResult{}, err
+	}
+	defer stdin.Close()
+
+	hookCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, h.command[0], h.command[1:]...)
+	cmd.Env = append(os.Environ(), hookMetadataEnv+"="+string(metadata))
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		return scriptResult{}, fmt.Errorf("reply hook %s cancelled: %w", h.command[0], ctx.Err())
+	case hookCtx.Err() != nil:
+		return scriptResult{}, fmt.Errorf("reply hook %s timed out after %s", h.command[0], h.timeout)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return parseHookOutput(h.command[0], stdout.Bytes())
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == hookExitSkip:
+		return scriptResult{skip: true}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == hookExitReject:
+		message, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+		return scriptResult{reject: rejectError(0, "", strings.TrimSpace(message))}, nil
+	}
+	return scriptResult{}, fmt.Errorf("run reply hook %s: %w: %s", h.command[0], err, hookStderr(stderr.Bytes()))
+}
+
+func parseHookOutput(name string, stdout []byte) (scriptResult, error) {
+	if len(bytes.TrimSpace(stdout)) == 0 {
+		return scriptResult{}, nil
+	}
+	var output hookOutput
+	if err := json.Unmarshal(stdout, &output); err != nil {
+		return scriptResult{}, fmt.Errorf("reply hook %s printed invalid JSON: %w", name, err)
+	}
+	result := scriptResult{
+		skip:        output.Skip,
+		subject:     output.Subject,
+		replaceBody: output.Body != nil || output.HTML != nil,
+	}
+	if output.HTML != nil {
+		result.body.HTML = *output.HTML
+	}
+	if output.Body != nil {
+		result.body.Plain = *output.Body
+	} else {
+		result.body.Plain = htmlToText(result.body.HTML)
+	}
+
+	if len(output.Reject) == 0 {
+		return result, nil
+	}
+	var reject any
+	if err := json.Unmarshal(output.Reject, &reject); err != nil {
+		return scriptResult{}, fmt.Errorf("reply hook %s printed invalid reject: %w", name, err)
+	}
+	switch reject := reject.(type) {
+	case string:
+		result.reject = rejectError(0, "", reject)
+	case bool:
+		if reject {
+			result.reject = rejectError(0, "", "")
+		}
+	case map[string]any:
+		code, _ := reject["code"].(float64)
+		enhancedCode, _ := reject["enhanced_code"].(string)
+		message, _ := reject["message"].(string)
+		result.reject = rejectError(int(code), enhancedCode, message)
+	}
+	return result, nil
+}
+
+func hookStderr(stderr []byte) string {
+	stderr = bytes.TrimSpace(stderr)
+	if len(stderr) > hookStderrBytes {
+		stderr = stderr[:hookStderrBytes]
+	}
+	if len(stderr) == 0 {
+		return "no output"
+	}
+	return strings.ReplaceAll(string(stderr), "\n", " ")
+}
+
+func (r *Replier) runReplyHooks(ctx context.Context, msg InboundMessage, header mail.Header, original replyBody, recipient string) (scriptResult, error) {
+	var result scriptResult
+	if r.script != nil {
+		scripted, err := r.script.run(ctx, msg, header, original)
+		if err != nil {
+			return scriptResult{}, err
+		}
+		if scripted.skip && scripted.reject == nil && r.logger != nil {
+			r.logger.Printf("reply script skipped reply to=%q", recipient)
+		}
+		if scripted.skip || scripted.reject != nil {
+			return scripted, nil
+		}
+		result = scripted
+	}
+	if r.hook != nil {
+		hooked, err := r.hook.run(ctx, msg, header)
+		if err != nil {
+			return scriptResult{}, err
+		}
+		if hooked.skip && hooked.reject == nil && r.logger != nil {
+			r.logger.Printf("reply hook skipped reply to=%q", recipient)
+		}
+		if hooked.skip || hooked.reject != nil {
+			return hooked, nil
+		}
+		if hooked.subject != "" {
+			result.subject = hooked.subject
+		}
+		if hooked.replaceBody {
+			result.body = hooked.body
+			result.replaceBody = true
+		}
+	}
+	return result, nil
+}
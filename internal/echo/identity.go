@@ -0,0 +1,66 @@
+package echo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type replyIdentity struct {
+	fromAddress string
+	fromName    string
+	mailFrom    string
+	dkim        *dkimSigner
+}
+
+func (r *Replier) configureIdentities(identities map[string]config.ReplyIdentityConfig) error {
+	if len(identities) == 0 {
+		return nil
+	}
+
+	r.identities = make(map[string]replyIdentity, len(identities))
+	for key, cfg := range identities {
+		identity := r.defaultIdentity()
+		identity.fromAddress = cfg.FromAddress
+		if cfg.FromName != "" {
+			identity.fromName = cfg.FromName
+		}
+		if cfg.MailFrom != "" {
+			identity.mailFrom = cfg.MailFrom
+		}
+		if cfg.DKIM != nil {
+			signer, err := newDKIMSigner(cfg.DKIM)
+			if err != nil {
+				return fmt.Errorf("reply identity %q: %w", key, err)
+			}
+			identity.dkim = signer
+		}
+		r.identities[strings.ToLower(strings.TrimSpace(key))] = identity
+	}
+	return nil
+}
+
+func (r *Replier) defaultIdentity() replyIdentity {
+	return replyIdentity{
+		fromAddress: r.fromAddress,
+		fromName:    r.fromName,
+		mailFrom:    r.mailFrom,
+		dkim:        r.dkim,
+	}
+}
+
+func (r *Replier) identityFor(recipients []string) replyIdentity {
+	for _, recipient := range recipients {
+		address := strings.ToLower(normalizeRecipientAddress(recipient))
+		if identity, ok := r.identities[address]; ok {
+			return identity
+		}
+		if at := strings.LastIndexByte(address, '@'); at >= 0 {
+			if identity, ok := r.identities[address[at+1:]]; ok {
+				return identity
+			}
+		}
+	}
+	return r.defaultIdentity()
+}
@@ -0,0 +1,174 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type inboundBounce struct {
+	recipient         string
+	status            string
+	diagnostic        string
+	remoteHost        string
+	originalMessageID string
+	replyID           int64
+}
+
+func (r *Replier) bounceAddresses() []string {
+	addresses := []string{r.mailFrom}
+	for _, identity := range r.identities {
+		addresses = append(addresses, identity.mailFrom)
+	}
+	return addresses
+}
+
+func (r *Replier) matchBounceAddress(recipients []string) (verpAddress, bool) {
+	for _, recipient := range recipients {
+		address := strings.ToLower(normalizeRecipientAddress(recipient))
+		for _, bounceAddress := range r.bounceAddresses() {
+			if decoded, ok := r.verp.decode(address, strings.ToLower(bounceAddress)); ok {
+				return decoded, true
+			}
+		}
+	}
+	return verpAddress{}, false
+}
+
+func (r *Replier) handleInboundBounce(ctx context.Context, msg InboundMessage, verp verpAddress) error {
+	bounce, err := parseInboundBounce(msg)
+	if err != nil && r.logger != nil {
+		r.logger.Printf("parse bounce for message %d: %v", msg.ID, err)
+	}
+	if verp.recipient != "" {
+		bounce.recipient = verp.recipient
+	}
+	bounce.replyID = verp.replyID
+
+	replyID, replyRecipient, matched := r.matchBouncedReply(ctx, bounce)
+	if bounce.recipient == "" || (matched && verp.recipient == "") {
+		bounce.recipient = replyRecipient
+	}
+	if bounce.recipient == "" {
+		if r.logger != nil {
+			r.logger.Printf("ignore bounce message_id=%d sender=%q: no failed recipient", msg.ID, msg.EnvelopeFrom)
+		}
+		return nil
+	}
+
+	if r.logger != nil {
+		r.logger.Printf("inbound bounce message_id=%d recipient=%q status=%s reply_id=%d diagnostic=%q",
+			msg.ID, bounce.recipient, displayOrUnknown(bounce.status), replyID, bounce.diagnostic)
+	}
+	if replyID != 0 {
+		update := store.ReplyUpdate{
+			Status:     store.ReplyStatusBounced,
+			StatusCode: bounce.status,
+			RemoteHost: bounce.remoteHost,
+			Error:      bounce.diagnostic,
+		}
+		if err := r.store.UpdateReplyStatus(ctx, replyID, update); err != nil && r.logger != nil {
+			r.logger.Printf("store reply status for reply %d: %v", replyID, err)
+		}
+	}
+	if verp.recipient == "" && !matched {
+		if r.logger != nil {
+			r.logger.Printf("bounce message_id=%d for %q matches no reply, not counted", msg.ID, bounce.recipient)
+		}
+		return nil
+	}
+	status := bounce.status
+	if status == "" {
+		status = "5.0.0"
+	}
+	r.recordBounceStatus(bounce.recipient, status)
+	return nil
+}
+
+func (r *Replier) matchBouncedReply(ctx context.Context, bounce inboundBounce) (int64, string, bool) {
+	if r.store == nil {
+		return 0, "", false
+	}
+	var queries []store.ReplyQuery
+	if bounce.replyID != 0 {
+		queries = append(queries, store.ReplyQuery{ID: bounce.replyID})
+	}
+	if bounce.originalMessageID != "" {
+		queries = append(queries, store.ReplyQuery{HeaderMessageID: bounce.originalMessageID})
+	}
+	trusted := len(queries)
+	if bounce.recipient != "" {
+		queries = append(queries, store.ReplyQuery{Recipient: bounce.recipient})
+	}
+	for i, query := range queries {
+		reply, err := r.store.FindReply(ctx, query)
+		if err == nil {
+			return reply.ID, reply.Recipient, i < trusted
+		}
+		if !errors.Is(err, store.ErrNotFound) && r.logger != nil {
+			r.logger.Printf("find bounced reply for %q: %v", bounce.recipient, err)
+		}
+	}
+	return 0, "", false
+}
+
+func parseInboundBounce(msg InboundMessage) (inboundBounce, error) {
+	var bounce inboundBounce
+	data, err := msg.Open()
+	if err != nil {
+		return bounce, err
+	}
+	defer data.Close()
+
+	entity, err := message.Read(data)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return bounce, fmt.Errorf("read bounce: %w", err)
+	}
+
+	err = entity.Walk(func(_ []int, part *message.Entity, _ error) error {
+		mediaType, _, _ := part.Header.ContentType()
+		switch strings.ToLower(mediaType) {
+		case "message/delivery-status", "message/global-delivery-status":
+			return parseDeliveryStatus(part.Body, &bounce)
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+			header, _ := textproto.ReadHeader(bufio.NewReader(part.Body))
+			bounce.originalMessageID = strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+		}
+		return nil
+	})
+	return bounce, err
+}
+
+func parseDeliveryStatus(body io.Reader, bounce *inboundBounce) error {
+	reader := bufio.NewReader(body)
+	for {
+		fields, err := textproto.ReadHeader(reader)
+		if value := fields.Get("Final-Recipient"); value != "" && bounce.recipient == "" {
+			bounce.recipient = normalizeRecipientAddress(typedValue(value))
+			bounce.status = strings.TrimSpace(fields.Get("Status"))
+			bounce.diagnostic = strings.Join(strings.Fields(fields.Get("Diagnostic-Code")), " ")
+			bounce.remoteHost = typedValue(fields.Get("Remote-MTA"))
+		}
+		if err != nil {
+			return nil
+		}
+		if _, err := reader.Peek(1); err != nil {
+			return nil
+		}
+	}
+}
+
+func typedValue(value string) string {
+	if _, typed, ok := strings.Cut(value, ";"); ok {
+		value = typed
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,235 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errEmptyMessage = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Message is empty",
+}
+
+func MessageFromRaw(raw []byte, defaultRecipient string) InboundMessage {
+	msg := InboundMessage{Data: raw, ReceivedAt: time.Now().UTC()}
+
+	var header mail.Header
+	if reader, err := mail.CreateReader(bytes.NewReader(raw)); err == nil {
+		header = reader.Header
+	}
+	for _, field := range []string{"Return-Path", "From"} {
+		if addresses, err := header.AddressList(field); err == nil && len(addresses) > 0 {
+			msg.EnvelopeFrom = addresses[0].Address
+			break
+		}
+	}
+	for _, fields := range [][]string{{"Delivered-To", "X-Original-To"}, {"To", "Cc"}} {
+		for _, field := range fields {
+			for _, value := range header.Values(field) {
+				addresses, _ := mail.ParseAddressList(value)
+				for _, address := range addresses {
+					msg.Recipients = append(msg.Recipients, address.Address)
+				}
+			}
+		}
+		if len(msg.Recipients) > 0 {
+			break
+		}
+	}
+	if len(msg.Recipients) == 0 && defaultRecipient != "" {
+		msg.Recipients = []string{defaultRecipient}
+	}
+	return msg
+}
+
+func (b *Backend) Ingest(ctx context.Context, msg InboundMessage) error {
+	if len(msg.Recipients) == 0 {
+		return errNoRecipients
+	}
+	policy := b.recipientPolicy()
+	for _, recipient := range msg.Recipients {
+		tag, err := policy.check(recipient)
+		if err != nil {
+			b.logf("rejected ingested message from=%q to=%q", msg.EnvelopeFrom, recipient)
+			return err
+		}
+		if msg.Tag == "" {
+			msg.Tag = tag
+		}
+	}
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now().UTC()
+	}
+	msg.Sequence = b.sequences.next(msg.EnvelopeFrom)
+
+	processor, release := b.acquire()
+	defer release()
+	done := b.activity.Begin()
+	defer done()
+
+	entry := activity.Entry{
+		Time:         msg.ReceivedAt,
+		RemoteAddr:   addrString(msg.RemoteAddr),
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Bytes:        int(msg.Size()),
+		Status:       activity.StatusEchoed,
+	}
+	ctx, span := tracer.Start(ctx, "echo.ingest", messageAttributes(msg))
+	ctx, cancel := b.processingContext(ctx)
+	defer cancel()
+	err := processor.Echo(ctx, msg)
+	endSpan(span, err)
+	if err != nil {
+		err = processingError(ctx, err)
+		entry.Status = activity.StatusFailed
+		entry.Error = err.Error()
+		b.activity.Record(entry)
+		if isPermanentFailure(err) {
+			b.quarantineMessage(msg, err)
+		}
+		return err
+	}
+	b.activity.Record(entry)
+	b.logf("ingested message from=%q recipients=%d bytes=%d", msg.EnvelopeFrom, len(msg.Recipients), msg.Size())
+	return nil
+}
+
+type SocketServer struct {
+	backend          *Backend
+	maxBytes         int64
+	readTimeout      time.Duration
+	defaultRecipient string
+	mu               sync.Mutex
+	listener         net.Listener
+	conns            sync.WaitGroup
+}
+
+func NewSocketServer(cfg config.Config, backend *Backend) *SocketServer {
+	server := &SocketServer{
+		backend:          backend,
+		maxBytes:         cfg.MaxMessageBytes,
+		readTimeout:      cfg.ReadTimeout,
+		defaultRecipient: cfg.Reply.FromAddress,
+	}
+	if address, err := mail.ParseAddress(cfg.Reply.FromAddress); err == nil {
+		server.defaultRecipient = address.Address
+	}
+	return server
+}
+
+func ListenSocket(cfg config.IngestConfig) (net.Listener, error) {
+	mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse ingest socket mode: %w", err)
+	}
+	if info, err := os.Lstat(cfg.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(cfg.Socket); err != nil {
+			return nil, fmt.Errorf("remove stale ingest socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("listen on ingest socket: %w", err)
+	}
+	if err := os.Chmod(cfg.Socket, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("set ingest socket mode: %w", err)
+	}
+	return listener, nil
+}
+
+func (s *SocketServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.conns.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *SocketServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SocketServer) handle(conn net.Conn) {
+	defer s.conns.Done()
+	defer conn.Close()
+
+	err := s.receive(conn)
+	response := "250 2.0.0 Message echoed"
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		errors.As(s.backend.respond(err), &smtpErr)
+		response = fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2], smtpErr.Message)
+	}
+	if s.readTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.readTimeout))
+	}
+	fmt.Fprintf(conn, "%s\r\n", response)
+}
+
+func (s *SocketServer) receive(conn net.Conn) error {
+	if s.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+	}
+	reader := io.Reader(conn)
+	if s.maxBytes > 0 {
+		reader = io.LimitReader(conn, s.maxBytes+1)
+	}
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("read ingested message: %w", err)
+	}
+	if s.maxBytes > 0 && int64(len(raw)) > s.maxBytes {
+		s.backend.logf("ingested message too large limit=%d", s.maxBytes)
+		io.Copy(io.Discard, conn)
+		return errMessageTooLarge
+	}
+	if len(raw) == 0 {
+		return errEmptyMessage
+	}
+
+	msg := MessageFromRaw(raw, s.defaultRecipient)
+	msg.LocalAddr = conn.LocalAddr()
+	return s.backend.Ingest(s.backend.ctx, msg)
+}
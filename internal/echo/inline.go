@@ -0,0 +1,62 @@
+package echo
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var cidPattern = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+type inlinePart struct {
+	contentID   string
+	contentType string
+	filename    string
+	data        []byte
+}
+
+func inlineContentID(value string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "<"), ">")
+}
+
+func inlineFilename(disposition string, contentType string) string {
+	if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+func relatedParts(html string, parts []inlinePart, messageID string) (string, []inlinePart) {
+	if html == "" || len(parts) == 0 {
+		return html, nil
+	}
+	byID := make(map[string]inlinePart, len(parts))
+	for _, part := range parts {
+		byID[part.contentID] = part
+	}
+	renamed := make(map[string]string)
+	var related []inlinePart
+	html = cidPattern.ReplaceAllStringFunc(html, func(match string) string {
+		id := match[len("cid:"):]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		if contentID, ok := renamed[id]; ok {
+			return "cid:" + contentID
+		}
+		part, ok := byID[id]
+		if !ok {
+			return match
+		}
+		part.contentID = fmt.Sprintf("part%d.%s", len(related)+1, messageID)
+		renamed[id] = part.contentID
+		related = append(related, part)
+		return "cid:" + part.contentID
+	})
+	return html, related
+}
@@ -0,0 +1,197 @@
+package echo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/danthegoodman1/smtp_echo/internal/queue"
+)
+
+type journaledMessage struct {
+	RemoteAddr  string        `json:"remote_addr,omitempty"`
+	LocalAddr   string        `json:"local_addr,omitempty"`
+	Tag         string        `json:"tag,omitempty"`
+	Sequence    int64         `json:"sequence,omitempty"`
+	Attempt     int           `json:"attempt,omitempty"`
+	Filters     []string      `json:"filters,omitempty"`
+	Helo        string        `json:"helo,omitempty"`
+	AuthUser    string        `json:"auth_user,omitempty"`
+	TLSMode     string        `json:"tls_mode,omitempty"`
+	ReceivedAt  time.Time     `json:"received_at"`
+	ConnectedAt time.Time     `json:"connected_at,omitzero"`
+	SMTPUTF8    bool          `json:"smtputf8,omitempty"`
+	BodyType    string        `json:"body_type,omitempty"`
+	Transfer    string        `json:"transfer,omitempty"`
+	DSN         DSNParams     `json:"dsn"`
+	DNSBL       []DNSBLResult `json:"dnsbl,omitempty"`
+	HeloCheck   *HeloCheck    `json:"helo_check,omitempty"`
+	RDNS        *RDNSResult   `json:"rdns,omitempty"`
+}
+
+func (b *Backend) UseQueue(journal *queue.Journal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.journal = journal
+}
+
+func (b *Backend) journalDelayed(journal *queue.Journal, msg InboundMessage, due time.Time) int64 {
+	if journal == nil {
+		return 0
+	}
+	id, err := addJournalEntry(journal, msg, due)
+	if err != nil {
+		b.logf("journal delayed message id=%d: %v", msg.ID, err)
+		return 0
+	}
+	return id
+}
+
+func addJournalEntry(journal *queue.Journal, msg InboundMessage, due time.Time) (int64, error) {
+	raw, err := msg.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	metadata, err := encodeMetadata(msg)
+	if err != nil {
+		return 0, err
+	}
+	return journal.Add(context.Background(), queue.Entry{
+		DueAt:        due,
+		MessageID:    msg.ID,
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Metadata:     metadata,
+		Raw:          raw,
+	})
+}
+
+func encodeMetadata(msg InboundMessage) (json.RawMessage, error) {
+	metadata, err := json.Marshal(journaledMessage{
+		RemoteAddr:  addrString(msg.RemoteAddr),
+		LocalAddr:   addrString(msg.LocalAddr),
+		Tag:         msg.Tag,
+		Sequence:    msg.Sequence,
+		Attempt:     msg.Attempt,
+		Filters:     msg.Filters,
+		Helo:        msg.Helo,
+		AuthUser:    msg.AuthUser,
+		TLSMode:     msg.TLSMode,
+		ReceivedAt:  msg.ReceivedAt,
+		ConnectedAt: msg.ConnectedAt,
+		SMTPUTF8:    msg.SMTPUTF8,
+		BodyType:    msg.BodyType,
+		Transfer:    msg.Transfer,
+		DSN:         msg.DSN,
+		DNSBL:       msg.DNSBL,
+		HeloCheck:   msg.HeloCheck,
+		RDNS:        msg.RDNS,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+func (b *Backend) runDelayed(journal *queue.Journal, entryID int64, msg InboundMessage, origin trace.SpanContext) {
+	if journal != nil && entryID != 0 {
+		claimed, err := journal.Claim(context.Background(), entryID, time.Now())
+		if err != nil {
+			b.logf("claim queued message id=%d: %v", msg.ID, err)
+		} else if !claimed {
+			return
+		}
+		defer func() {
+			if err := journal.Remove(context.Background(), entryID); err != nil {
+				b.logf("remove queued message id=%d: %v", msg.ID, err)
+			}
+		}()
+	}
+
+	next, release := b.afterRules()
+	defer release()
+	ctx, span := tracer.Start(b.ctx, "smtp.delayed_message", messageAttributes(msg), trace.WithLinks(trace.Link{SpanContext: origin}))
+	ctx, cancel := b.processingContext(ctx)
+	defer cancel()
+	err := next.Echo(ctx, msg)
+	endSpan(span, err)
+	if err != nil {
+		b.logf("delayed echo for message %d: %v", msg.ID, err)
+		b.quarantineMessage(msg, err)
+	}
+}
+
+func (b *Backend) ResumeQueue(ctx context.Context) (int, error) {
+	b.mu.RLock()
+	journal := b.journal
+	b.mu.RUnlock()
+	if journal == nil {
+		return 0, nil
+	}
+
+	entries, err := journal.Entries(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		msg := journalEntryMessage(entry)
+		entryID := entry.ID
+		delay := journal.ReadyAt(entry).Sub(now)
+		b.logf("resumed queued message id=%d delay=%s", msg.ID, max(delay, 0))
+		b.queue.schedule(delay, func() {
+			b.runDelayed(journal, entryID, msg, trace.SpanContext{})
+		})
+	}
+	return len(entries), nil
+}
+
+func (b *Backend) afterRules() (Processor, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stages := append([]Middleware{b.retryStage, b.webhookStage}, b.middleware...)
+	return Chain(b.processor, stages...), b.users.acquire()
+}
+
+func journalEntryMessage(entry queue.Entry) InboundMessage {
+	return decodeMetadata(InboundMessage{
+		ID:           entry.MessageID,
+		EnvelopeFrom: entry.EnvelopeFrom,
+		Recipients:   entry.Recipients,
+		Data:         entry.Raw,
+	}, entry.Metadata)
+}
+
+func decodeMetadata(msg InboundMessage, raw json.RawMessage) InboundMessage {
+	var metadata journaledMessage
+	json.Unmarshal(raw, &metadata)
+
+	msg.Tag = metadata.Tag
+	msg.Sequence = metadata.Sequence
+	msg.Attempt = metadata.Attempt
+	msg.Filters = metadata.Filters
+	msg.Helo = metadata.Helo
+	msg.AuthUser = metadata.AuthUser
+	msg.TLSMode = metadata.TLSMode
+	msg.ReceivedAt = metadata.ReceivedAt
+	msg.ConnectedAt = metadata.ConnectedAt
+	msg.SMTPUTF8 = metadata.SMTPUTF8
+	msg.BodyType = metadata.BodyType
+	msg.Transfer = metadata.Transfer
+	msg.DSN = metadata.DSN
+	msg.DNSBL = metadata.DNSBL
+	msg.HeloCheck = metadata.HeloCheck
+	msg.RDNS = metadata.RDNS
+	if addr, err := net.ResolveTCPAddr("tcp", metadata.RemoteAddr); err == nil && metadata.RemoteAddr != "" {
+		msg.RemoteAddr = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", metadata.LocalAddr); err == nil && metadata.LocalAddr != "" {
+		msg.LocalAddr = addr
+	}
+	return msg
+}
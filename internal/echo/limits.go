@@ -0,0 +1,225 @@
+package echo
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/timeouts"
+)
+
+var (
+	errTooManyConnections = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections, try again later",
+	}
+	errTooManyConnectionsFromIP = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections from your address, try again later",
+	}
+	errTooManyRecipients = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients",
+	}
+	errBacklogFull = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Too many messages waiting to be processed, try again later",
+	}
+)
+
+type connectionLimits struct {
+	mu            sync.Mutex
+	maxTotal      int
+	maxPerIP      int
+	idleTimeout   time.Duration
+	timeouts      timeouts.Limits
+	maxRecipients int
+	maxBacklog    int
+	total         int
+	perIP         map[string]int
+	timedOut      map[string]int64
+	backlogged    atomic.Int64
+}
+
+func newConnectionLimits(cfg *config.LimitsConfig) *connectionLimits {
+	limits := &connectionLimits{perIP: make(map[string]int), timedOut: make(map[string]int64)}
+	limits.configure(cfg)
+	return limits
+}
+
+func (l *connectionLimits) configure(cfg *config.LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg == nil {
+		cfg = &config.LimitsConfig{}
+	}
+	l.maxTotal = cfg.MaxConnections
+	l.maxPerIP = cfg.MaxConnectionsPerIP
+	l.idleTimeout = cfg.IdleTimeout
+	l.timeouts = timeouts.Limits{
+		Banner:  cfg.BannerTimeout,
+		Command: cfg.CommandTimeout,
+		Data:    cfg.DataTimeout,
+		Session: cfg.MaxSessionDuration,
+	}
+	l.maxRecipients = cfg.MaxRecipients
+	l.maxBacklog = cfg.MaxBacklog
+}
+
+func (l *connectionLimits) acquire(ip net.IP) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return errTooManyConnections
+	}
+	key := ""
+	if ip != nil {
+		key = ip.String()
+	}
+	if l.maxPerIP > 0 && key != "" && l.perIP[key] >= l.maxPerIP {
+		return errTooManyConnectionsFromIP
+	}
+
+	l.total++
+	if key != "" {
+		l.perIP[key]++
+	}
+	return nil
+}
+
+func (l *connectionLimits) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	if l.perIP[key] <= 1 {
+		delete(l.perIP, key)
+		return
+	}
+	l.perIP[key]--
+}
+
+func (l *connectionLimits) sessionLimits() (time.Duration, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.idleTimeout, l.maxRecipients
+}
+
+func (l *connectionLimits) timeoutLimits() timeouts.Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.timeouts
+}
+
+func (l *connectionLimits) recordTimeout(phase string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timedOut[phase]++
+}
+
+func (l *connectionLimits) timeoutCounts() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := map[string]int64{
+		timeouts.PhaseBanner:  0,
+		timeouts.PhaseCommand: 0,
+		timeouts.PhaseData:    0,
+		timeouts.PhaseIdle:    0,
+		timeouts.PhaseSession: 0,
+	}
+	for phase, count := range l.timedOut {
+		counts[phase] = count
+	}
+	return counts
+}
+
+func (l *connectionLimits) checkBacklog(backlog int) error {
+	l.mu.Lock()
+	maxBacklog := l.maxBacklog
+	l.mu.Unlock()
+	if maxBacklog > 0 && backlog >= maxBacklog {
+		l.backlogged.Add(1)
+		return errBacklogFull
+	}
+	return nil
+}
+
+func (l *connectionLimits) backlogLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxBacklog
+}
+
+func (l *connectionLimits) active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+func (s *session) startIdleTimer(timeout time.Duration) {
+	if timeout <= 0 || s.conn == nil {
+		return
+	}
+	s.idleTimeout = timeout
+	s.idle = time.AfterFunc(timeout, func() {
+		s.conn.Conn().SetReadDeadline(time.Now())
+	})
+}
+
+func (s *session) touch() {
+	if s.idle != nil {
+		s.idle.Reset(s.idleTimeout)
+	}
+}
+
+func (s *session) pauseIdleTimer() {
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+}
+
+func (b *Backend) recordTimeout(conn net.Conn, phase string) {
+	b.conns.recordTimeout(phase)
+	b.logf("session timed out remote=%s phase=%s", addrString(conn.RemoteAddr()), phase)
+}
+
+func (s *session) beginData() func() {
+	if s.conn == nil {
+		return func() {}
+	}
+	conn, ok := timeouts.FromConn(s.conn.Conn())
+	if !ok {
+		return func() {}
+	}
+	conn.BeginData()
+	return conn.EndData
+}
+
+func (s *session) checkBacklog(from string) error {
+	backlog := s.backend.backlog()
+	if err := s.backend.conns.checkBacklog(backlog); err != nil {
+		s.backend.activity.Record(activity.Entry{
+			RemoteAddr:   addrString(s.remoteAddr()),
+			EnvelopeFrom: from,
+			Status:       activity.StatusBacklogged,
+			Error:        err.Error(),
+		})
+		s.backend.logf("backlog full from=%q ip=%q backlog=%d", from, s.remoteIP(), backlog)
+		return err
+	}
+	return nil
+}
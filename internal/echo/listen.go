@@ -0,0 +1,166 @@
+package echo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/pires/go-proxyproto"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/extensions"
+	"github.com/danthegoodman1/smtp_echo/internal/timeouts"
+	"github.com/danthegoodman1/smtp_echo/internal/xclient"
+)
+
+func NewSMTPServer(cfg config.Config, listener config.ListenerConfig, backend *Backend, tlsConfig *tls.Config, logger *log.Logger) *smtp.Server {
+	server := smtp.NewServer(backend)
+	server.Addr = listener.Addr
+	hostname := cfg.Hostname
+	if listener.Hostname != "" {
+		hostname = listener.Hostname
+	}
+	server.Domain = hostname
+	if cfg.Responses != nil && cfg.Responses.Banner != "" {
+		server.Domain = hostname + " " + cfg.Responses.Banner
+	}
+	server.ReadTimeout = cfg.ReadTimeout
+	server.WriteTimeout = cfg.WriteTimeout
+	server.MaxMessageBytes = listener.MaxMessageBytes
+	server.ErrorLog = logger
+	server.EnableDSN = !slices.Contains(listener.DisableExtensions, config.ExtensionDSN)
+	server.EnableSMTPUTF8 = true
+
+	if listener.TLSMode != config.TLSModeNone {
+		server.TLSConfig = tlsConfig
+	}
+	if cfg.Auth != nil {
+		server.AllowInsecureAuth = cfg.Auth.AllowInsecure
+	}
+	return server
+}
+
+func WrapListener(cfg config.ListenerConfig, listener net.Listener, tlsConfig *tls.Config, server *smtp.Server) (net.Listener, error) {
+	if cfg.ProxyProtocol {
+		policy, err := proxyPolicy(cfg.ProxyTrusted)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = &proxyproto.Listener{Listener: listener, Policy: policy}
+	}
+
+	if backend, ok := server.Backend.(*Backend); ok {
+		listener = &timeouts.Listener{Listener: listener, Limits: backend.conns.timeoutLimits, OnTimeout: backend.recordTimeout}
+	}
+
+	if disabled := filteredExtensions(cfg); len(disabled) > 0 {
+		listener = &extensions.Listener{Listener: listener, Disabled: disabled}
+	}
+
+	if cfg.XClient {
+		networks, err := trustedNetworks("xclient_trusted", cfg.XClientTrusted)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		xclientListener := &xclient.Listener{Listener: listener, Greeting: server.Domain}
+		if len(networks) > 0 {
+			xclientListener.Trusted = func(addr net.Addr) bool {
+				return networksContain(networks, addr)
+			}
+		}
+		listener = xclientListener
+	}
+
+	if cfg.TLSMode == config.TLSModeImplicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls client ca file: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls client ca file %s contains no certificates", cfg.ClientCAFile)
+		}
+	}
+	switch {
+	case cfg.ClientAuth == config.ClientAuthRequire && tlsConfig.ClientCAs != nil:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case cfg.ClientAuth == config.ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case tlsConfig.ClientCAs != nil:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case cfg.ClientAuth == config.ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	return tlsConfig, nil
+}
+
+func proxyPolicy(trusted []string) (proxyproto.PolicyFunc, error) {
+	if len(trusted) == 0 {
+		return func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		}, nil
+	}
+
+	networks, err := trustedNetworks("proxy_trusted", trusted)
+	if err != nil {
+		return nil, err
+	}
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if networksContain(networks, upstream) {
+			return proxyproto.REQUIRE, nil
+		}
+		return proxyproto.IGNORE, nil
+	}, nil
+}
+
+func trustedNetworks(option string, trusted []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range trusted {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s %q: %w", option, entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func networksContain(networks []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package echo
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/emersion/go-message/textproto"
+)
+
+const base64LineWidth = 76
+
+func prepareTextPart(header *textproto.Header, mediaType string, text string, charset string, encoding string) ([]byte, string) {
+	data, charset := encodeCharset(text, charset)
+	if encoding == "" || encoding == config.TransferEncodingAuto {
+		encoding = chooseTransferEncoding(data)
+	}
+	if encoding == config.TransferEncoding8Bit {
+		data = normalizeLineEndings(data)
+	}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": charset}))
+	header.Set("Content-Transfer-Encoding", encoding)
+	return data, encoding
+}
+
+func chooseTransferEncoding(data []byte) string {
+	nonASCII := 0
+	for _, b := range data {
+		if b >= 0x80 || b == 0 {
+			nonASCII++
+		}
+	}
+	if nonASCII*3 > len(data) {
+		return config.TransferEncodingBase64
+	}
+	return config.TransferEncodingQuotedPrintable
+}
+
+func normalizeLineEndings(data []byte) []byte {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return []byte(strings.ReplaceAll(text, "\n", "\r\n"))
+}
+
+func writePartBody(w io.Writer, data []byte, encoding string) error {
+	switch encoding {
+	case config.TransferEncodingBase64:
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > base64LineWidth {
+			if _, err := io.WriteString(w, encoded[:base64LineWidth]+"\r\n"); err != nil {
+				return err
+			}
+			encoded = encoded[base64LineWidth:]
+		}
+		_, err := io.WriteString(w, encoded+"\r\n")
+		return err
+	case config.TransferEncoding8Bit:
+		_, err := w.Write(data)
+		return err
+	}
+	encoder := quotedprintable.NewWriter(w)
+	if _, err := encoder.Write(data); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
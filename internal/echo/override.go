@@ -0,0 +1,46 @@
+package echo
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+type domainOverride struct {
+	pattern string
+	host    string
+	port    string
+}
+
+func newDomainOverrides(overrides map[string]string) []domainOverride {
+	parsed := make([]domainOverride, 0, len(overrides))
+	for pattern, target := range overrides {
+		override := domainOverride{pattern: strings.ToLower(pattern), host: strings.Trim(target, "[]"), port: "25"}
+		if host, port, err := net.SplitHostPort(target); err == nil {
+			override.host, override.port = host, port
+		}
+		parsed = append(parsed, override)
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		iWild, jWild := strings.ContainsAny(parsed[i].pattern, "*?["), strings.ContainsAny(parsed[j].pattern, "*?[")
+		if iWild != jWild {
+			return !iWild
+		}
+		if len(parsed[i].pattern) != len(parsed[j].pattern) {
+			return len(parsed[i].pattern) > len(parsed[j].pattern)
+		}
+		return parsed[i].pattern < parsed[j].pattern
+	})
+	return parsed
+}
+
+func matchDomainOverride(overrides []domainOverride, domain string) (domainOverride, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, override := range overrides {
+		if ok, _ := path.Match(override.pattern, domain); ok {
+			return override, true
+		}
+	}
+	return domainOverride{}, false
+}
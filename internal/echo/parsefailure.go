@@ -0,0 +1,93 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func (r *Replier) handleParseFailure(ctx context.Context, msg InboundMessage, parseErr error) error {
+	reason := strings.Join(strings.Fields(parseErr.Error()), " ")
+	switch r.parseFailure {
+	case config.ParseFailureDrop:
+		if r.logger != nil {
+			r.logger.Printf("dropped unparseable message from=%q: %s", msg.EnvelopeFrom, reason)
+		}
+		return nil
+	case config.ParseFailureDiagnostic, config.ParseFailureRaw:
+	default:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message could not be parsed: " + reason,
+		}
+	}
+
+	recipient := normalizeRecipientAddress(msg.EnvelopeFrom)
+	if recipient == "" {
+		if r.logger != nil {
+			r.logger.Printf("dropped unparseable message with null sender: %s", reason)
+		}
+		return nil
+	}
+	if r.suppressed(recipient) {
+		return nil
+	}
+
+	_, buildSpan := tracer.Start(ctx, "echo.build")
+	defer buildSpan.End()
+
+	body := replyBody{Plain: fmt.Sprintf("Your message could not be parsed, so it was not echoed.\n\nError: %s\nSize: %d bytes\n", reason, msg.Size())}
+	if r.parseFailure == config.ParseFailureRaw {
+		raw, err := r.readRawBody(msg)
+		if err != nil {
+			return err
+		}
+		body.Plain += "\nThe unparsed message follows.\n\n" + raw
+	}
+
+	extraHeader := []headerField{
+		{"Received", formatReceived(msg, r.hostname)},
+		{"X-Echo-Parse-Error", reason},
+	}
+	extraHeader = append(extraHeader, tagHeaders(msg.Tag)...)
+	extraHeader = append(extraHeader, r.sequenceHeaders(msg)...)
+	extraHeader = append(extraHeader, dsnHeaders(msg.DSN)...)
+	extraHeader = append(extraHeader, traceHeaders(ctx)...)
+
+	identity := r.identityFor(msg.Recipients)
+	meta := threadMetadata{ReplySubject: "Could not parse your message", References: r.threadReferences(msg, nil)}
+	replyMessage, err := r.buildReplyMessage(identity, recipient, body, meta, extraHeader, nil)
+	if err != nil {
+		return err
+	}
+	buildSpan.End()
+	return r.sendReply(ctx, msg, identity, recipient, replyMessage)
+}
+
+func (r *Replier) readRawBody(msg InboundMessage) (string, error) {
+	data, err := msg.Open()
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	var reader io.Reader = data
+	if r.maxBodyBytes > 0 {
+		reader = io.LimitReader(data, r.maxBodyBytes+1)
+	}
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("read unparsed message: %w", err)
+	}
+	body := string(raw)
+	if r.maxBodyBytes > 0 && int64(len(raw)) > r.maxBodyBytes {
+		body = truncateUTF8(body, r.maxBodyBytes) + fmt.Sprintf("\n\n[Truncated to %d bytes]\n", r.maxBodyBytes)
+	}
+	return strings.ReplaceAll(body, "\r\n", "\n"), nil
+}
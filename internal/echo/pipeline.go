@@ -0,0 +1,70 @@
+package echo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Processor interface {
+	Echo(ctx context.Context, msg InboundMessage) error
+}
+
+type ProcessorFunc func(ctx context.Context, msg InboundMessage) error
+
+func (f ProcessorFunc) Echo(ctx context.Context, msg InboundMessage) error {
+	return f(ctx, msg)
+}
+
+type Middleware func(next Processor) Processor
+
+func Chain(processor Processor, middleware ...Middleware) Processor {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		processor = middleware[i](processor)
+	}
+	return processor
+}
+
+func (b *Backend) storeStage(next Processor) Processor {
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		if msg.ID == 0 {
+			msg.ID = b.storeMessage(msg)
+		}
+		return next.Echo(ctx, msg)
+	})
+}
+
+func (b *Backend) webhookStage(next Processor) Processor {
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		err := next.Echo(ctx, msg)
+		var deferred *deferredDelivery
+		if !errors.As(err, &deferred) {
+			b.notifyWebhooks(msg, err)
+		}
+		return err
+	})
+}
+
+func (b *Backend) retryStage(next Processor) Processor {
+	journal := b.journal
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		err := next.Echo(ctx, msg)
+		var deferred *deferredDelivery
+		if !errors.As(err, &deferred) {
+			return err
+		}
+
+		msg.Attempt++
+		b.logf("retrying message id=%d attempt=%d delay=%s: %v", msg.ID, msg.Attempt, deferred.delay, deferred.err)
+		msg.retain()
+		entryID := b.journalDelayed(journal, msg, time.Now().Add(deferred.delay))
+		origin := trace.SpanContextFromContext(ctx)
+		b.queue.schedule(deferred.delay, func() {
+			defer msg.release()
+			b.runDelayed(journal, entryID, msg, origin)
+		})
+		return nil
+	})
+}
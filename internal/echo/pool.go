@@ -0,0 +1,137 @@
+package echo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type pooledClient struct {
+	client   *smtp.Client
+	messages int
+	timer    *time.Timer
+}
+
+type connPool struct {
+	mu          sync.Mutex
+	idle        map[string][]*pooledClient
+	idleTimeout time.Duration
+	maxMessages int
+	maxIdle     int
+	closed      bool
+}
+
+func newConnPool(cfg *config.PoolConfig) *connPool {
+	if cfg == nil {
+		return nil
+	}
+	return &connPool{
+		idle:        make(map[string][]*pooledClient),
+		idleTimeout: cfg.IdleTimeout,
+		maxMessages: cfg.MaxMessages,
+		maxIdle:     cfg.MaxIdlePerHost,
+	}
+}
+
+func poolKey(host string, requirement tlsRequirement) string {
+	key := host + "|" + requirement.source
+	if requirement.plaintext {
+		key += "|plain"
+	}
+	return key
+}
+
+func (p *connPool) get(key string) *pooledClient {
+	if p == nil {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		clients := p.idle[key]
+		if len(clients) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		pooled := clients[len(clients)-1]
+		p.idle[key] = clients[:len(clients)-1]
+		pooled.timer.Stop()
+		p.mu.Unlock()
+
+		if err := pooled.client.Reset(); err == nil {
+			return pooled
+		}
+		pooled.client.Close()
+	}
+}
+
+func (p *connPool) put(key string, pooled *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || (p.maxMessages > 0 && pooled.messages >= p.maxMessages) ||
+		(p.maxIdle > 0 && len(p.idle[key]) >= p.maxIdle) {
+		go pooled.client.Quit()
+		return
+	}
+	p.idle[key] = append(p.idle[key], pooled)
+	pooled.timer = time.AfterFunc(p.idleTimeout, func() {
+		if p.remove(key, pooled) {
+			pooled.client.Quit()
+		}
+	})
+}
+
+func (p *connPool) remove(key string, pooled *pooledClient) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clients := p.idle[key]
+	for i, candidate := range clients {
+		if candidate == pooled {
+			p.idle[key] = append(clients[:i], clients[i+1:]...)
+			if len(p.idle[key]) == 0 {
+				delete(p.idle, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (p *connPool) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*pooledClient)
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs []error
+	for _, clients := range idle {
+		for _, pooled := range clients {
+			pooled.timer.Stop()
+			if err := pooled.client.Quit(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *connPool) size() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := 0
+	for _, clients := range p.idle {
+		total += len(clients)
+	}
+	return total
+}
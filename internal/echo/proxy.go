@@ -0,0 +1,119 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type contextDialer interface {
+	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+type outboundProxy struct {
+	dialer        contextDialer
+	remoteResolve bool
+}
+
+func newOutboundProxy(rawURL string, connectTimeout time.Duration) (*outboundProxy, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("delivery.proxy: %w", err)
+	}
+
+	forward := &net.Dialer{Timeout: connectTimeout}
+	switch proxyURL.Scheme {
+	case "http":
+		return &outboundProxy{dialer: newHTTPConnectDialer(proxyURL, forward), remoteResolve: true}, nil
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, fmt.Errorf("delivery.proxy: %w", err)
+		}
+		contextual, ok := dialer.(contextDialer)
+		if !ok {
+			return nil, fmt.Errorf("delivery.proxy: %s dialer does not support contexts", proxyURL.Scheme)
+		}
+		return &outboundProxy{dialer: contextual, remoteResolve: proxyURL.Scheme == "socks5h"}, nil
+	default:
+		return nil, fmt.Errorf("delivery.proxy: unsupported scheme %q", proxyURL.Scheme)
+	}
+}
+
+type httpConnectDialer struct {
+	addr          string
+	authorization string
+	forward       *net.Dialer
+}
+
+func newHTTPConnectDialer(proxyURL *url.URL, forward *net.Dialer) *httpConnectDialer {
+	dialer := &httpConnectDialer{addr: proxyURL.Host, forward: forward}
+	if proxyURL.Port() == "" {
+		dialer.addr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		dialer.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password))
+	}
+	return dialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", d.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if d.forward.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.forward.Timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write proxy connect: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read proxy connect response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect to %s: %s", addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,55 @@
+package echo
+
+import (
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+)
+
+func (b *Backend) UseQuarantine(dir *quarantine.Dir) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quarantine = dir
+}
+
+func (b *Backend) quarantineMessage(msg InboundMessage, failure error) {
+	b.mu.RLock()
+	dir := b.quarantine
+	b.mu.RUnlock()
+	if dir == nil {
+		return
+	}
+
+	raw, err := msg.Bytes()
+	if err != nil {
+		b.logf("quarantine message id=%d: %v", msg.ID, err)
+		return
+	}
+	metadata, err := encodeMetadata(msg)
+	if err != nil {
+		b.logf("quarantine message id=%d: %v", msg.ID, err)
+		return
+	}
+	entry, err := dir.Add(quarantine.Entry{
+		Error:        failure.Error(),
+		Status:       deliveryStatusCode(failure),
+		MessageID:    msg.ID,
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Metadata:     metadata,
+	}, raw)
+	if err != nil {
+		b.logf("quarantine message id=%d: %v", msg.ID, err)
+		return
+	}
+	b.logf("quarantined message id=%d as %s: %v", msg.ID, entry.ID, failure)
+}
+
+func QuarantinedMessage(entry quarantine.Entry, raw []byte) InboundMessage {
+	msg := decodeMetadata(InboundMessage{
+		ID:           entry.MessageID,
+		EnvelopeFrom: entry.EnvelopeFrom,
+		Recipients:   entry.Recipients,
+		Data:         raw,
+	}, entry.Metadata)
+	msg.Attempt = 0
+	return msg
+}
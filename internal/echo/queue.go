@@ -0,0 +1,95 @@
+package echo
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type replyDelay struct {
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func newReplyDelay(cfg config.ReplyConfig) replyDelay {
+	return replyDelay{delay: cfg.Delay, jitter: cfg.Jitter}
+}
+
+func (d replyDelay) disabled() bool {
+	return d.delay <= 0 && d.jitter <= 0
+}
+
+func (d replyDelay) next() time.Duration {
+	if d.jitter <= 0 {
+		return d.delay
+	}
+	return d.delay + rand.N(d.jitter+1)
+}
+
+type delayQueue struct {
+	mu      sync.Mutex
+	entries map[*delayedReply]struct{}
+	wg      sync.WaitGroup
+}
+
+type delayedReply struct {
+	timer *time.Timer
+	fn    func()
+}
+
+func (q *delayQueue) schedule(delay time.Duration, fn func()) {
+	entry := &delayedReply{fn: fn}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.entries == nil {
+		q.entries = make(map[*delayedReply]struct{})
+	}
+	q.entries[entry] = struct{}{}
+	q.wg.Add(1)
+	entry.timer = time.AfterFunc(delay, func() { q.run(entry) })
+}
+
+func (q *delayQueue) run(entry *delayedReply) {
+	defer q.wg.Done()
+	defer func() {
+		q.mu.Lock()
+		delete(q.entries, entry)
+		q.mu.Unlock()
+	}()
+	entry.fn()
+}
+
+func (q *delayQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for entry := range q.entries {
+		if entry.timer.Stop() {
+			go q.run(entry)
+		}
+	}
+}
+
+func (q *delayQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *delayQueue) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
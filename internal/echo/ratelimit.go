@@ -0,0 +1,90 @@
+package echo
+
+import (
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/ratelimit"
+)
+
+var (
+	errRateLimitedSender = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Rate limit exceeded, try again later",
+	}
+	errRateLimitedGlobal = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Server is receiving too much mail, try again later",
+	}
+)
+
+type rateLimits struct {
+	perIP     *ratelimit.Limiter
+	perSender *ratelimit.Limiter
+	global    *ratelimit.Limiter
+	cfg       config.RateLimitConfig
+}
+
+func newRateLimits(cfg *config.RateLimitConfig) rateLimits {
+	return reconfigureRateLimits(rateLimits{}, cfg)
+}
+
+func reconfigureRateLimits(limits rateLimits, cfg *config.RateLimitConfig) rateLimits {
+	if cfg == nil {
+		return rateLimits{}
+	}
+	return rateLimits{
+		perIP:     reconfigureLimiter(limits.perIP, limits.cfg.PerIP, cfg.PerIP),
+		perSender: reconfigureLimiter(limits.perSender, limits.cfg.PerSender, cfg.PerSender),
+		global:    reconfigureLimiter(limits.global, limits.cfg.Global, cfg.Global),
+		cfg:       *cfg,
+	}
+}
+
+func reconfigureLimiter(limiter *ratelimit.Limiter, previous *config.RateLimit, cfg *config.RateLimit) *ratelimit.Limiter {
+	if cfg == nil {
+		return nil
+	}
+	if limiter != nil && previous != nil && *previous == *cfg {
+		return limiter
+	}
+	return ratelimit.New(cfg.Rate, cfg.Per, cfg.Burst)
+}
+
+func (l rateLimits) checkMail(ip net.IP, from string) error {
+	if l.perIP != nil && ip != nil && !l.perIP.Allow(ip.String()) {
+		return errRateLimitedSender
+	}
+	if l.perSender != nil && !l.perSender.Allow(strings.ToLower(from)) {
+		if l.perIP != nil && ip != nil {
+			l.perIP.Refund(ip.String())
+		}
+		return errRateLimitedSender
+	}
+	return nil
+}
+
+func (l rateLimits) checkData() error {
+	if l.global != nil && !l.global.Allow("") {
+		return errRateLimitedGlobal
+	}
+	return nil
+}
+
+func (s *session) recordRateLimited(from string, err error) {
+	s.backend.activity.Record(activity.Entry{
+		RemoteAddr:   addrString(s.remoteAddr()),
+		EnvelopeFrom: from,
+		Status:       activity.StatusRateLimited,
+		Error:        err.Error(),
+	})
+	if s.backend.logger != nil {
+		s.backend.logger.Printf("rate limited from=%q ip=%q: %v", from, s.remoteIP(), err)
+	}
+}
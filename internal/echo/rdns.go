@@ -0,0 +1,142 @@
+package echo
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+const rdnsMaxNames = 10
+
+var errRDNSFailed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 25},
+	Message:      "Reverse DNS validation failed",
+}
+
+const (
+	RDNSStatusConfirmed = "confirmed"
+	RDNSStatusMismatch  = "mismatch"
+	RDNSStatusMissing   = "missing"
+	RDNSStatusError     = "error"
+)
+
+type RDNSResult struct {
+	Status    string   `json:"status"`
+	Names     []string `json:"names,omitempty"`
+	Confirmed string   `json:"confirmed,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type rdnsPolicy struct {
+	policy  string
+	timeout time.Duration
+}
+
+func newRDNSPolicy(cfg *config.RDNSConfig) *rdnsPolicy {
+	if cfg == nil {
+		return nil
+	}
+	return &rdnsPolicy{policy: cfg.Policy, timeout: cfg.Timeout}
+}
+
+func checkRDNS(ctx context.Context, resolver mailauth.Resolver, ip net.IP) RDNSResult {
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if isDNSNotFound(err) || (err == nil && len(names) == 0) {
+		return RDNSResult{Status: RDNSStatusMissing}
+	}
+	if err != nil {
+		return RDNSResult{Status: RDNSStatusError, Error: err.Error()}
+	}
+	if len(names) > rdnsMaxNames {
+		names = names[:rdnsMaxNames]
+	}
+	result := RDNSResult{Status: RDNSStatusMismatch}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		result.Names = append(result.Names, name)
+		if result.Confirmed != "" {
+			continue
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil && !isDNSNotFound(err) {
+			result.Error = err.Error()
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				result.Confirmed = name
+				break
+			}
+		}
+	}
+	switch {
+	case result.Confirmed != "":
+		result.Status = RDNSStatusConfirmed
+		result.Error = ""
+	case result.Error != "":
+		result.Status = RDNSStatusError
+	}
+	return result
+}
+
+func (b *Backend) rdnsPolicy() *rdnsPolicy {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rdns
+}
+
+func (s *session) checkRDNS() error {
+	policy := s.backend.rdnsPolicy()
+	if policy == nil {
+		return nil
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return nil
+	}
+	if s.rdnsIP != ip.String() {
+		ctx, cancel := context.WithTimeout(s.context(), policy.timeout)
+		result := checkRDNS(ctx, s.backend.dnsResolver(), ip)
+		cancel()
+		s.rdns = &result
+		s.rdnsIP = ip.String()
+		if result.Error != "" {
+			s.backend.logf("rdns lookup failed remote=%s names=%q: %s", addrString(s.remoteAddr()), strings.Join(result.Names, ","), result.Error)
+		} else {
+			s.backend.logf("rdns remote=%s status=%s names=%q", addrString(s.remoteAddr()), result.Status, strings.Join(result.Names, ","))
+		}
+	}
+	if s.authUser != "" {
+		return nil
+	}
+	switch {
+	case policy.policy == config.RDNSPolicyRejectMissing && s.rdns.Status == RDNSStatusMissing:
+		return errRDNSFailed
+	case policy.policy == config.RDNSPolicyRejectMismatch && (s.rdns.Status == RDNSStatusMissing || s.rdns.Status == RDNSStatusMismatch):
+		return errRDNSFailed
+	}
+	return nil
+}
+
+func formatRDNSResult(result *RDNSResult) string {
+	switch result.Status {
+	case RDNSStatusConfirmed:
+		return result.Confirmed + " (forward-confirmed)"
+	case RDNSStatusMismatch:
+		return strings.Join(result.Names, ", ") + " (does not resolve back to the client address)"
+	case RDNSStatusMissing:
+		return "none (no PTR record)"
+	}
+	value := "error (" + result.Error + ")"
+	if len(result.Names) > 0 {
+		value = strings.Join(result.Names, ", ") + " " + value
+	}
+	return value
+}
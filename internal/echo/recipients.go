@@ -0,0 +1,75 @@
+package echo
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errRecipientUnknown = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient address rejected: user unknown",
+}
+
+type recipientPolicy struct {
+	mode      string
+	addresses map[string]bool
+	domains   map[string]bool
+	plus      bool
+	separator string
+}
+
+func newRecipientPolicy(cfg *config.RecipientsConfig) *recipientPolicy {
+	if cfg == nil {
+		return nil
+	}
+	policy := &recipientPolicy{
+		mode:      cfg.Mode,
+		addresses: make(map[string]bool, len(cfg.Addresses)),
+		domains:   make(map[string]bool, len(cfg.Domains)),
+		plus:      cfg.PlusAddressing,
+		separator: cfg.TagSeparator,
+	}
+	for _, address := range cfg.Addresses {
+		policy.addresses[strings.ToLower(normalizeRecipientAddress(address))] = true
+	}
+	for _, domain := range cfg.Domains {
+		policy.domains[strings.ToLower(strings.TrimSuffix(domain, "."))] = true
+	}
+	return policy
+}
+
+func (p *recipientPolicy) check(recipient string) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	local, domain, _ := strings.Cut(normalizeRecipientAddress(recipient), "@")
+	var tag string
+	if p.plus && p.separator != "" {
+		if base, value, ok := strings.Cut(local, p.separator); ok && base != "" {
+			local, tag = base, value
+		}
+	}
+
+	switch p.mode {
+	case config.RecipientModeStrict:
+		if !p.addresses[strings.ToLower(local+"@"+domain)] {
+			return "", errRecipientUnknown
+		}
+	case config.RecipientModeCatchAll:
+		if !p.domains[strings.ToLower(domain)] {
+			return "", errRecipientUnknown
+		}
+	}
+	return tag, nil
+}
+
+func tagHeaders(tag string) []headerField {
+	if tag == "" {
+		return nil
+	}
+	return []headerField{{"X-Echo-Tag", tag}}
+}
@@ -1,87 +1,407 @@
 package echo
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"crypto"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	stdhtml "html"
 	"io"
 	"log"
 	"mime"
 	"net"
-	"os"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/emersion/go-message"
 	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/idna"
 
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
 	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/dane"
+	"github.com/danthegoodman1/smtp_echo/internal/dkimkeys"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+	"github.com/danthegoodman1/smtp_echo/internal/mtasts"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+	"github.com/danthegoodman1/smtp_echo/internal/resolver"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
 )
 
 type Replier struct {
-	hostname    string
-	fromAddress string
-	mailFrom    string
-	fromName    string
-	logger      *log.Logger
-	deliverFn   func(ctx context.Context, to string, message []byte) error
-	dkimOptions *dkim.SignOptions
+	hostname         string
+	ehloName         string
+	fromAddress      string
+	mailFrom         string
+	fromName         string
+	mode             string
+	deliveryMode     string
+	output           *replyOutput
+	dmarcHeader      bool
+	copyReceived     bool
+	attachOriginal   bool
+	headerDump       bool
+	tlsDiagnostics   bool
+	checksums        bool
+	checksumDetails  bool
+	maxBodyBytes     int64
+	oversizePolicy   string
+	parseFailure     string
+	preserveCharset  bool
+	fallbackCharset  string
+	transferEncoding string
+	bounce           string
+	cc               []*mail.Address
+	copies           []replyCopy
+	maxRecipients    int
+	headers          replyHeaders
+	compliance       *complianceHeaders
+	forward          *forwarding
+	sanitizer        *htmlSanitizer
+	digest           *digestQueue
+	filters          map[string][]bodyFilter
+	templates        *replyTemplates
+	script           *replyScript
+	hook             *replyHook
+	logger           *log.Logger
+	resolver         mailauth.Resolver
+	dnsCache         *resolver.Resolver
+	store            store.Store
+	deliverFn        func(ctx context.Context, from string, to string, message []byte) error
+	bounceFn         func(ctx context.Context, to string, message []byte) error
+	mtaSTS           *mtasts.Fetcher
+	tlsa             dane.Resolver
+	outbound         outboundTLS
+	dialer           outboundDialer
+	pool             *connPool
+	retry            *retryPolicy
+	scheduler        *deliveryScheduler
+	verp             *verpEncoding
+	overrides        []domainOverride
+	suppressions     *suppression.List
+	reports          *reports.Collector
+	reportAddresses  []string
+	archive          *archive.Writer
+	dkim             *dkimSigner
+	identities       map[string]replyIdentity
+	senderVerify     *senderVerification
+	delivered        atomic.Int64
 }
 
-func NewReplier(cfg config.Config, logger *log.Logger) (*Replier, error) {
+func newDNSCache(cfg *config.DNSConfig) *resolver.Resolver {
+	return resolver.New(resolver.Options{
+		Servers:       cfg.Servers,
+		TLS:           cfg.TLS,
+		TLSServerName: cfg.TLSServerName,
+		Timeout:       cfg.Timeout,
+		CacheSize:     cfg.CacheSize,
+		MaxTTL:        cfg.MaxTTL,
+	})
+}
+
+func newDNSResolver(cfg *config.DNSConfig) mailauth.Resolver {
+	if cfg == nil {
+		return net.DefaultResolver
+	}
+	return newDNSCache(cfg)
+}
+
+func NewReplier(cfg config.Config, st store.Store, logger *log.Logger) (*Replier, error) {
 	replier := &Replier{
-		hostname:    cfg.Hostname,
-		fromAddress: cfg.Reply.FromAddress,
-		mailFrom:    cfg.Reply.MailFrom,
-		fromName:    cfg.Reply.FromName,
-		logger:      logger,
+		hostname:         cfg.Hostname,
+		ehloName:         cfg.Hostname,
+		fromAddress:      cfg.Reply.FromAddress,
+		mailFrom:         cfg.Reply.MailFrom,
+		fromName:         cfg.Reply.FromName,
+		mode:             cfg.Reply.Mode,
+		deliveryMode:     cfg.Delivery.Mode,
+		senderVerify:     newSenderVerification(cfg.SenderVerify),
+		dmarcHeader:      cfg.Reply.DMARCHeader,
+		copyReceived:     cfg.Reply.CopyReceived,
+		attachOriginal:   cfg.Reply.AttachOriginal,
+		headerDump:       cfg.Reply.HeaderDump,
+		tlsDiagnostics:   cfg.Reply.TLSDiagnostics,
+		checksums:        cfg.Reply.Checksums,
+		checksumDetails:  cfg.Reply.ChecksumDetails,
+		maxBodyBytes:     cfg.Reply.MaxBodyBytes,
+		oversizePolicy:   cfg.Reply.OversizePolicy,
+		parseFailure:     cfg.Reply.ParseFailure,
+		preserveCharset:  cfg.Reply.PreserveCharset,
+		fallbackCharset:  cfg.Reply.FallbackCharset,
+		transferEncoding: cfg.Reply.TransferEncoding,
+		bounce:           cfg.Reply.Bounce,
+		maxRecipients:    cfg.Reply.MaxRecipients,
+		headers:          newReplyHeaders(cfg.Reply),
+		compliance:       newComplianceHeaders(cfg.Reply.Compliance),
+		reportAddresses:  reportAddresses(cfg.Reports),
+		forward:          newForwarding(cfg.Forward),
+		logger:           logger,
+		resolver:         net.DefaultResolver,
+		store:            st,
+	}
+	if cfg.DNS != nil {
+		replier.dnsCache = newDNSCache(cfg.DNS)
+		replier.resolver = replier.dnsCache
+	}
+	if cfg.Delivery.EHLOName != "" {
+		replier.ehloName = cfg.Delivery.EHLOName
+	}
+	if err := replier.configureTransport(cfg.Delivery); err != nil {
+		return nil, err
+	}
+	if err := replier.configureOutboundTLS(cfg.Delivery); err != nil {
+		return nil, err
+	}
+	dialer, err := newOutboundDialer(cfg.Delivery, replier.resolver)
+	if err != nil {
+		return nil, err
 	}
-	replier.deliverFn = replier.deliverDirect
+	replier.dialer = dialer
+	replier.pool = newConnPool(cfg.Delivery.Pool)
+	replier.retry = newRetryPolicy(cfg.Delivery.Retry)
+	replier.scheduler = newDeliveryScheduler(cfg.Delivery.Concurrency)
+	replier.verp = newVERPEncoding(cfg.Reply.VERP)
+	replier.overrides = newDomainOverrides(cfg.Delivery.DomainOverrides)
 	if err := replier.configureDKIM(cfg.DKIM); err != nil {
 		return nil, err
 	}
+	if err := replier.configureIdentities(cfg.Reply.Identities); err != nil {
+		return nil, err
+	}
+	if err := replier.configureCopies(cfg.Reply); err != nil {
+		return nil, err
+	}
+	replier.sanitizer = newHTMLSanitizer(cfg.Reply.SanitizeHTML)
+	replier.digest = newDigestQueue(cfg.Reply.Digest, replier)
+	filters, err := newBodyFilters(cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+	replier.filters = filters
+	templates, err := loadReplyTemplates(cfg.Reply.Template)
+	if err != nil {
+		return nil, err
+	}
+	replier.templates = templates
+	script, err := loadReplyScript(cfg.Reply.Script)
+	if err != nil {
+		return nil, err
+	}
+	replier.script = script
+	replier.hook = newReplyHook(cfg.Reply.Exec)
 	return replier, nil
 }
 
 func (r *Replier) Echo(ctx context.Context, msg InboundMessage) error {
-	reader, err := mail.CreateReader(bytes.NewReader(msg.Data))
+	data, err := msg.Open()
 	if err != nil {
-		return fmt.Errorf("parse inbound message: %w", err)
+		return err
+	}
+	defer data.Close()
+
+	_, parseSpan := tracer.Start(ctx, "echo.parse")
+	defer parseSpan.End()
+	reader, err := mail.CreateReader(data)
+	if err != nil && (!message.IsUnknownCharset(err) || r.fallbackCharset == "") {
+		endSpan(parseSpan, err)
+		return r.handleParseFailure(ctx, msg, err)
+	}
+	if r.isReportAddress(msg.Recipients) {
+		parseSpan.End()
+		return r.handleAggregateReport(msg)
+	}
+	if isFeedbackReport(reader.Header) {
+		parseSpan.End()
+		return r.handleFeedbackReport(ctx, msg)
+	}
+	if verp, ok := r.matchBounceAddress(msg.Recipients); ok {
+		parseSpan.End()
+		return r.handleInboundBounce(ctx, msg, verp)
+	}
+	if r.compliance.isUnsubscribe(msg.Recipients) {
+		parseSpan.End()
+		return r.handleUnsubscribe(msg)
+	}
+
+	if forwarded, err := r.forwardAll(ctx, msg); forwarded || err != nil {
+		return err
 	}
 
 	recipient, err := selectReplyRecipient(msg.EnvelopeFrom, reader.Header)
 	if err != nil {
 		return err
 	}
+	if r.suppressed(recipient) {
+		return nil
+	}
+	if r.digest != nil {
+		r.addToDigest(msg, reader.Header, recipient)
+		return nil
+	}
+	oversize, err := r.checkBodySize(msg)
+	if err != nil {
+		return err
+	}
+
+	var results mailauth.Results
+	if r.mode == config.ReplyModeReport || r.dmarcHeader || r.templates != nil {
+		authCtx, authSpan := tracer.Start(ctx, "echo.authenticate")
+		results = r.checkAuthentication(authCtx, msg, reader.Header)
+		authSpan.End()
+	}
 
-	body, err := readReplyBody(reader, msg.Data)
+	extraHeader := []headerField{{"Received", formatReceived(msg, r.hostname)}}
+	if r.copyReceived {
+		for _, value := range reader.Header.Values("Received") {
+			extraHeader = append(extraHeader, headerField{"X-Original-Received", strings.Join(strings.Fields(value), " ")})
+		}
+	}
+	if r.dmarcHeader {
+		extraHeader = append(extraHeader, headerField{"X-Echo-DMARC", formatDMARCHeader(results)})
+	}
+	if r.tlsDiagnostics {
+		extraHeader = append(extraHeader, headerField{"X-Echo-TLS", formatTLSHeader(msg)})
+	}
+	if r.checksums {
+		extraHeader = append(extraHeader, checksumHeaders(msg, r.checksumDetails)...)
+	}
+	extraHeader = append(extraHeader, tagHeaders(msg.Tag)...)
+	extraHeader = append(extraHeader, r.sequenceHeaders(msg)...)
+	extraHeader = append(extraHeader, dsnHeaders(msg.DSN)...)
+	if msg.Transfer != "" {
+		extraHeader = append(extraHeader, headerField{"X-Echo-Transfer", msg.Transfer})
+	}
+	extraHeader = append(extraHeader, traceHeaders(ctx)...)
+	extraHeader = append(extraHeader, r.headers.passthroughFields(reader.Header)...)
+
+	var original replyBody
+	if r.mode != config.ReplyModeReport || r.templates != nil || r.script != nil || r.hook != nil {
+		original, err = readReplyBody(reader, msg, r.fallbackCharset)
+		if message.IsUnknownCharset(err) {
+			endSpan(parseSpan, err)
+			return r.handleParseFailure(ctx, msg, err)
+		}
+		if err != nil {
+			return err
+		}
+		if oversize != nil {
+			original = limitBody(original, *oversize, r.maxBodyBytes, r.oversizePolicy)
+		}
+		original = r.sanitizer.sanitize(original)
+		original = r.filterBody(msg, original)
+		extraHeader = append(extraHeader, charsetHeaders(original)...)
+	}
+	parseSpan.End()
+
+	_, buildSpan := tracer.Start(ctx, "echo.build")
+	defer buildSpan.End()
+
+	scripted, err := r.runReplyHooks(ctx, msg, reader.Header, original, recipient)
 	if err != nil {
 		return err
 	}
+	if scripted.reject != nil {
+		return scripted.reject
+	}
+	if scripted.skip {
+		return nil
+	}
+
+	body := original
+	if r.mode == config.ReplyModeReport {
+		body = r.buildReport(msg, reader.Header, results)
+	}
+	if r.templates != nil {
+		report := ""
+		if r.mode == config.ReplyModeReport {
+			report = body.Plain
+		}
+		body, err = r.templates.render(newTemplateData(msg, reader.Header, original, results, report))
+		if err != nil {
+			return err
+		}
+	}
+
+	if scripted.replaceBody {
+		body = scripted.body
+	}
+
+	if r.headerDump {
+		body = prependHeaderDump(body, reader.Header)
+	}
+	if r.tlsDiagnostics && r.mode != config.ReplyModeReport {
+		body = prependTLSSection(body, msg)
+	}
+
+	var attachment io.Reader
+	if r.attachOriginal && oversize == nil {
+		original, err := msg.Open()
+		if err != nil {
+			return err
+		}
+		defer original.Close()
+		attachment = original
+	}
+
+	if body.Charset == "" {
+		body.Charset = original.Charset
+	}
+	if body.Inline == nil {
+		body.Inline = original.Inline
+	}
 
+	identity := r.identityFor(msg.Recipients)
 	meta := extractThreadMetadata(reader.Header)
-	replyMessage, err := r.buildReplyMessage(recipient, body, meta)
+	meta.References = r.threadReferences(msg, meta.References)
+	meta.ReplySubject = scripted.subject
+	replyAll := r.replyAllRecipients(msg, reader.Header, recipient)
+	meta.ReplyAllTo, meta.ReplyAllCc = replyAll.to, replyAll.cc
+	replyMessage, err := r.buildReplyMessage(identity, recipient, body, meta, extraHeader, attachment)
 	if err != nil {
 		return err
 	}
-	replyMessage, err = r.signMessage(replyMessage)
+	buildSpan.End()
+	return r.sendReply(ctx, msg, identity, recipient, replyMessage, replyAll.copies...)
+}
+
+func (r *Replier) sendReply(ctx context.Context, msg InboundMessage, identity replyIdentity, recipient string, replyMessage []byte, replyAll ...replyCopy) error {
+	replyMessage, err := signMessage(identity.dkim, replyMessage)
 	if err != nil {
 		return err
 	}
 
-	if err := r.deliverFn(ctx, recipient, replyMessage); err != nil {
-		return err
+	r.archiveReply(identity.mailFrom, replyMessage)
+	if msg.Attempt == 0 {
+		defer r.sendCopies(ctx, msg, identity, replyMessage, replyAll)
+	}
+
+	replyID := r.recordReply(ctx, msg.ID, store.ReplyKindEcho, recipient, replyMessage)
+	err = r.deliver(ctx, r.verp.envelopeSender(identity.mailFrom, recipient, replyID), recipient, replyMessage)
+	if err != nil {
+		r.recordReplyStatus(ctx, replyID, store.ReplyStatusFailed, err)
+		if delay, ok := r.retry.nextDelay(msg.Attempt, err); ok {
+			return &deferredDelivery{delay: delay, err: err}
+		}
+		r.recordHardBounce(recipient, err)
+		return r.handleBounce(ctx, msg, recipient, replyMessage, err)
 	}
+	r.recordReplyStatus(ctx, replyID, store.ReplyStatusDelivered, nil)
+	r.suppressions.RecordDelivery(recipient)
+	r.markDelivered()
 
 	if r.logger != nil {
 		r.logger.Printf("sent echo reply to=%q bytes=%d", recipient, len(replyMessage))
@@ -90,96 +410,236 @@ func (r *Replier) Echo(ctx context.Context, msg InboundMessage) error {
 	return nil
 }
 
+func (r *Replier) deliver(ctx context.Context, from string, recipient string, message []byte) error {
+	deliverCtx, span := tracer.Start(ctx, "echo.deliver",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("smtp.rcpt_to", recipient), attribute.Int("smtp_echo.reply_size", len(message))))
+	release, err := r.waitForSlot(deliverCtx, recipient)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer release()
+	err = r.deliverFn(deliverCtx, from, recipient, message)
+	endSpan(span, err)
+	return err
+}
+
+func (r *Replier) waitForSlot(ctx context.Context, recipient string) (func(), error) {
+	if r.scheduler == nil {
+		return func() {}, nil
+	}
+	started := time.Now()
+	release, err := r.scheduler.acquire(ctx, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("wait for delivery slot: %w", err)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("smtp_echo.delivery_wait_ms", time.Since(started).Milliseconds()))
+	return release, nil
+}
+
+func (r *Replier) UseDelivery(deliver func(ctx context.Context, from string, to string, message []byte) error) {
+	r.deliverFn = deliver
+	r.bounceFn = func(ctx context.Context, to string, message []byte) error {
+		return deliver(ctx, "", to, message)
+	}
+}
+
+func (r *Replier) recordReply(ctx context.Context, messageID int64, kind string, recipient string, message []byte) int64 {
+	if r.store == nil || messageID == 0 {
+		return 0
+	}
+	id, err := r.store.SaveReply(ctx, store.Reply{
+		MessageID:       messageID,
+		HeaderMessageID: headerMessageID(message),
+		Kind:            kind,
+		Recipient:       recipient,
+		Size:            len(message),
+		Raw:             message,
+		Status:          store.ReplyStatusPending,
+	})
+	if err != nil && r.logger != nil {
+		r.logger.Printf("store reply for message %d: %v", messageID, err)
+	}
+	return id
+}
+
+func headerMessageID(message []byte) string {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+}
+
+func (r *Replier) recordReplyStatus(ctx context.Context, replyID int64, status string, deliveryErr error) {
+	if r.store == nil || replyID == 0 {
+		return
+	}
+	if status == store.ReplyStatusDelivered && r.discardsReplies() {
+		status = store.ReplyStatusNotSent
+	}
+	update := store.ReplyUpdate{Status: status}
+	if deliveryErr != nil {
+		update.Error = deliveryErr.Error()
+		update.StatusCode = deliveryStatusCode(deliveryErr)
+		update.RemoteHost = deliveryRemoteHost(deliveryErr)
+	}
+	if err := r.store.UpdateReplyStatus(ctx, replyID, update); err != nil && r.logger != nil {
+		r.logger.Printf("store reply status for reply %d: %v", replyID, err)
+	}
+}
+
 func (r *Replier) configureDKIM(cfg *config.DKIMConfig) error {
 	if cfg == nil {
 		return nil
 	}
 
-	signer, err := loadSignerFromPEM(cfg.PrivateKeyPath)
+	signer, err := newDKIMSigner(cfg)
 	if err != nil {
-		return fmt.Errorf("load dkim private key: %w", err)
-	}
-
-	r.dkimOptions = &dkim.SignOptions{
-		Domain:     cfg.Domain,
-		Selector:   cfg.Selector,
-		Identifier: cfg.Identifier,
-		Signer:     signer,
-		HeaderKeys: []string{
-			"From",
-			"To",
-			"Subject",
-			"Date",
-			"Message-ID",
-			"In-Reply-To",
-			"References",
-			"MIME-Version",
-			"Content-Type",
-		},
+		return err
 	}
+	r.dkim = signer
 
 	if r.logger != nil {
-		r.logger.Printf("dkim signing enabled domain=%q selector=%q", cfg.Domain, cfg.Selector)
+		selector := ""
+		if key, ok := dkimkeys.Active(signer.keys, time.Now()); ok {
+			selector = key.Selector
+		}
+		r.logger.Printf("dkim signing enabled domain=%q selector=%q keys=%d", cfg.Domain, selector, len(signer.keys))
 	}
 	return nil
 }
 
-func (r *Replier) signMessage(message []byte) ([]byte, error) {
-	if r.dkimOptions == nil {
-		return message, nil
-	}
+var defaultDKIMHeaders = []string{
+	"From",
+	"To",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+	"List-Id",
+	"Feedback-ID",
+}
 
-	var signed bytes.Buffer
-	if err := dkim.Sign(&signed, bytes.NewReader(message), r.dkimOptions); err != nil {
-		return nil, fmt.Errorf("sign dkim: %w", err)
-	}
-	return signed.Bytes(), nil
+type dkimSigner struct {
+	domain                 string
+	identifier             string
+	keys                   []dkimkeys.Key
+	headerKeys             []string
+	headerCanonicalization dkim.Canonicalization
+	bodyCanonicalization   dkim.Canonicalization
+	expiry                 time.Duration
+	bodyLength             int64
 }
 
-func loadSignerFromPEM(path string) (crypto.Signer, error) {
-	data, err := os.ReadFile(path)
+func newDKIMSigner(cfg *config.DKIMConfig) (*dkimSigner, error) {
+	keys, err := dkimkeys.Load(cfg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("load dkim private key: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("load dkim private key: no keys found")
+	}
+	headerKeys := defaultDKIMHeaders
+	if len(cfg.Headers) > 0 {
+		headerKeys = cfg.Headers
+	}
+	headerCanonicalization, bodyCanonicalization := parseDKIMCanonicalization(cfg.Canonicalization)
+	return &dkimSigner{
+		domain:                 cfg.Domain,
+		identifier:             cfg.Identifier,
+		keys:                   keys,
+		headerKeys:             headerKeys,
+		headerCanonicalization: headerCanonicalization,
+		bodyCanonicalization:   bodyCanonicalization,
+		expiry:                 cfg.Expiry,
+		bodyLength:             cfg.BodyLength,
+	}, nil
+}
+
+func parseDKIMCanonicalization(value string) (dkim.Canonicalization, dkim.Canonicalization) {
+	header, body, _ := strings.Cut(value, "/")
+	headerCanonicalization := dkim.Canonicalization(header)
+	if headerCanonicalization == "" {
+		headerCanonicalization = dkim.CanonicalizationSimple
+	}
+	bodyCanonicalization := dkim.Canonicalization(body)
+	if bodyCanonicalization == "" {
+		bodyCanonicalization = dkim.CanonicalizationSimple
+	}
+	return headerCanonicalization, bodyCanonicalization
+}
+
+func (s *dkimSigner) options(now time.Time) (*dkim.SignOptions, error) {
+	key, ok := dkimkeys.Active(s.keys, now)
+	if !ok {
+		return nil, fmt.Errorf("no dkim key for %s is valid at %s", s.domain, now.UTC().Format(time.RFC3339))
+	}
+	options := &dkim.SignOptions{
+		Domain:                 s.domain,
+		Selector:               key.Selector,
+		Identifier:             s.identifier,
+		Signer:                 key.Signer,
+		HeaderCanonicalization: s.headerCanonicalization,
+		BodyCanonicalization:   s.bodyCanonicalization,
+		HeaderKeys:             s.headerKeys,
+	}
+	if s.expiry > 0 {
+		options.Expiration = now.Add(s.expiry)
 	}
+	return options, nil
+}
 
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode pem block")
+func signMessage(signer *dkimSigner, message []byte) ([]byte, error) {
+	if signer == nil {
+		return message, nil
 	}
 
-	switch block.Type {
-	case "RSA PRIVATE KEY":
-		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("invalid PKCS#1 RSA private key: %w", err)
-		}
-		return key, nil
-	case "PRIVATE KEY":
-		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	now := time.Now()
+	options, err := signer.options(now)
+	if err != nil {
+		return nil, fmt.Errorf("sign dkim: %w", err)
+	}
+	if signer.bodyLength > 0 {
+		signed, err := signWithBodyLength(message, options, signer.bodyLength, now)
 		if err != nil {
-			return nil, fmt.Errorf("invalid PKCS#8 private key: %w", err)
-		}
-		rsaKey, ok := key.(*rsa.PrivateKey)
-		if !ok {
-			return nil, fmt.Errorf("unsupported PKCS#8 key type %T: use RSA private key", key)
+			return nil, fmt.Errorf("sign dkim: %w", err)
 		}
-		return rsaKey, nil
-	case "ENCRYPTED PRIVATE KEY":
-		return nil, fmt.Errorf("encrypted private keys are not supported")
-	default:
-		return nil, fmt.Errorf("unsupported PEM block type %q: expected RSA PRIVATE KEY or PRIVATE KEY", block.Type)
+		return signed, nil
 	}
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(message), options); err != nil {
+		return nil, fmt.Errorf("sign dkim: %w", err)
+	}
+	return signed.Bytes(), nil
 }
 
 type threadMetadata struct {
-	Subject    string
-	MessageID  string
-	References []string
+	Subject      string
+	ReplySubject string
+	MessageID    string
+	References   []string
+	ReplyAllTo   []*mail.Address
+	ReplyAllCc   []*mail.Address
+}
+
+type headerField struct {
+	key   string
+	value string
 }
 
 type replyBody struct {
-	Plain string
-	HTML  string
+	Plain           string
+	HTML            string
+	Charset         string
+	FallbackCharset string
+	Inline          []inlinePart
 }
 
 func extractThreadMetadata(header mail.Header) threadMetadata {
@@ -247,19 +707,36 @@ func normalizeRecipientAddress(value string) string {
 	return ""
 }
 
-func readReplyBody(reader *mail.Reader, originalData []byte) (replyBody, error) {
+func readReplyBody(reader *mail.Reader, msg InboundMessage, fallbackCharset string) (replyBody, error) {
 	var plainSegments []string
 	var htmlSegments []string
+	var charset, usedFallback string
+	var inline []inlinePart
 
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
+		if err != nil && (!message.IsUnknownCharset(err) || fallbackCharset == "") {
 			return replyBody{}, fmt.Errorf("read message part: %w", err)
 		}
 
+		mediaType := normalizeMediaType(part.Header.Get("Content-Type"))
+		if contentID := inlineContentID(part.Header.Get("Content-Id")); contentID != "" && !strings.HasPrefix(mediaType, "text/") {
+			partBytes, err := io.ReadAll(part.Body)
+			if err != nil {
+				return replyBody{}, fmt.Errorf("read inline part body: %w", err)
+			}
+			inline = append(inline, inlinePart{
+				contentID:   contentID,
+				contentType: part.Header.Get("Content-Type"),
+				filename:    inlineFilename(part.Header.Get("Content-Disposition"), part.Header.Get("Content-Type")),
+				data:        partBytes,
+			})
+			continue
+		}
+
 		contentDisposition := strings.ToLower(part.Header.Get("Content-Disposition"))
 		if strings.HasPrefix(contentDisposition, "attachment") {
 			continue
@@ -273,21 +750,42 @@ func readReplyBody(reader *mail.Reader, originalData []byte) (replyBody, error)
 			continue
 		}
 
-		switch normalizeMediaType(part.Header.Get("Content-Type")) {
-		case "", "text/plain":
-			plainSegments = append(plainSegments, string(partBytes))
-		case "text/html":
-			htmlSegments = append(htmlSegments, string(partBytes))
+		if mediaType != "" && mediaType != "text/plain" && mediaType != "text/html" {
+			continue
+		}
+		text := string(partBytes)
+		if partCharset := partCharset(part.Header.Get("Content-Type")); partCharset != "" {
+			if !knownCharset(partCharset) {
+				if fallbackCharset == "" {
+					return replyBody{}, fmt.Errorf("read message part: unknown charset %q", partCharset)
+				}
+				text, err = decodeFallback(partBytes, fallbackCharset)
+				if err != nil {
+					return replyBody{}, err
+				}
+				usedFallback = fallbackCharset
+			}
+			if charset == "" {
+				charset = partCharset
+			}
+		}
+		if mediaType == "text/html" {
+			htmlSegments = append(htmlSegments, text)
+		} else {
+			plainSegments = append(plainSegments, text)
 		}
 	}
 
 	body := replyBody{
-		Plain: strings.Join(plainSegments, "\n\n"),
-		HTML:  strings.Join(htmlSegments, "\n\n"),
+		Plain:           strings.Join(plainSegments, "\n\n"),
+		HTML:            strings.Join(htmlSegments, "\n\n"),
+		Charset:         charset,
+		FallbackCharset: usedFallback,
+		Inline:          inline,
 	}
 
 	if body.Plain == "" && body.HTML == "" {
-		rawBody := extractRawBody(originalData)
+		rawBody := msg.rawBody()
 		switch normalizeMediaType(reader.Header.Get("Content-Type")) {
 		case "text/html":
 			body.HTML = rawBody
@@ -334,13 +832,13 @@ func extractRawBody(data []byte) string {
 	return ""
 }
 
-func (r *Replier) buildReplyMessage(recipient string, body replyBody, meta threadMetadata) ([]byte, error) {
-	fromAddress, err := mail.ParseAddress(r.fromAddress)
+func (r *Replier) buildReplyMessage(identity replyIdentity, recipient string, body replyBody, meta threadMetadata, extraHeader []headerField, attachment io.Reader) ([]byte, error) {
+	fromAddress, err := mail.ParseAddress(identity.fromAddress)
 	if err != nil {
 		return nil, fmt.Errorf("invalid configured from_address: %w", err)
 	}
-	if r.fromName != "" {
-		fromAddress.Name = r.fromName
+	if identity.fromName != "" {
+		fromAddress.Name = identity.fromName
 	}
 
 	parsedRecipient, err := mail.ParseAddress(recipient)
@@ -352,12 +850,18 @@ func (r *Replier) buildReplyMessage(recipient string, body replyBody, meta threa
 	if subject == "" {
 		subject = "Re:"
 	}
+	if meta.ReplySubject != "" {
+		subject = meta.ReplySubject
+	}
 
 	var header mail.Header
 	header.SetDate(time.Now().UTC())
 	header.SetSubject(subject)
 	header.SetAddressList("From", []*mail.Address{fromAddress})
-	header.SetAddressList("To", []*mail.Address{{Address: parsedRecipient.Address}})
+	header.SetAddressList("To", append([]*mail.Address{{Address: parsedRecipient.Address}}, meta.ReplyAllTo...))
+	if cc := slices.Concat(r.cc, meta.ReplyAllCc); len(cc) > 0 {
+		header.SetAddressList("Cc", cc)
+	}
 	if meta.MessageID != "" {
 		header.SetMsgIDList("In-Reply-To", []string{meta.MessageID})
 	}
@@ -365,80 +869,139 @@ func (r *Replier) buildReplyMessage(recipient string, body replyBody, meta threa
 		header.SetMsgIDList("References", meta.References)
 	}
 
+	staticHeader := slices.Concat(r.compliance.fields(parsedRecipient.Address), r.headers.static)
+	for i := len(staticHeader) - 1; i >= 0; i-- {
+		header.Add(staticHeader[i].key, staticHeader[i].value)
+	}
+	for i := len(extraHeader) - 1; i >= 0; i-- {
+		header.Add(extraHeader[i].key, extraHeader[i].value)
+	}
+
 	if err := header.GenerateMessageIDWithHostname(r.hostname); err != nil {
 		if generateErr := header.GenerateMessageID(); generateErr != nil {
 			return nil, fmt.Errorf("generate message-id: %w", generateErr)
 		}
 	}
 
-	var buf bytes.Buffer
+	messageID, _ := header.MessageID()
 	plainBody := body.Plain
-	htmlBody := body.HTML
+	htmlBody, inline := relatedParts(body.HTML, body.Inline, messageID)
 	if plainBody == "" && htmlBody == "" {
 		plainBody = "\n"
 	}
+	charset := ""
+	if r.preserveCharset {
+		charset = body.Charset
+	}
 
-	if htmlBody == "" {
-		inlineWriter, err := mail.CreateSingleInlineWriter(&buf, header)
-		if err != nil {
-			return nil, fmt.Errorf("create reply writer: %w", err)
+	var buf bytes.Buffer
+	header.Set("MIME-Version", "1.0")
+	if htmlBody == "" && attachment == nil {
+		data, encoding := prepareTextPart(&header.Header.Header, "text/plain", plainBody, charset, r.transferEncoding)
+		if err := textproto.WriteHeader(&buf, header.Header.Header); err != nil {
+			return nil, fmt.Errorf("write reply header: %w", err)
 		}
-		if _, err := io.WriteString(inlineWriter, plainBody); err != nil {
+		if err := writePartBody(&buf, data, encoding); err != nil {
 			return nil, fmt.Errorf("write reply body: %w", err)
 		}
-		if err := inlineWriter.Close(); err != nil {
-			return nil, fmt.Errorf("close reply writer: %w", err)
-		}
 		return buf.Bytes(), nil
 	}
 
-	if plainBody == "" {
+	if plainBody == "" && htmlBody != "" {
 		plainBody = htmlToText(htmlBody)
 		if plainBody == "" {
 			plainBody = "\n"
 		}
 	}
 
-	writer, err := mail.CreateWriter(&buf, header)
-	if err != nil {
-		return nil, fmt.Errorf("create multipart reply writer: %w", err)
+	mixed := textproto.NewMultipartWriter(&buf)
+	header.SetContentType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()})
+	if err := textproto.WriteHeader(&buf, header.Header.Header); err != nil {
+		return nil, fmt.Errorf("write reply header: %w", err)
+	}
+
+	alternativeBody := &struct{ io.Writer }{}
+	alternative := textproto.NewMultipartWriter(alternativeBody)
+	var alternativeHeader textproto.Header
+	alternativeHeader.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternative.Boundary()}))
+	container := mixed
+	var related *textproto.MultipartWriter
+	if len(inline) > 0 {
+		relatedBody := &struct{ io.Writer }{}
+		related = textproto.NewMultipartWriter(relatedBody)
+		var relatedHeader textproto.Header
+		relatedHeader.Set("Content-Type", mime.FormatMediaType("multipart/related", map[string]string{"type": "multipart/alternative", "boundary": related.Boundary()}))
+		relatedBody.Writer, err = mixed.CreatePart(relatedHeader)
+		if err != nil {
+			return nil, fmt.Errorf("create related writer: %w", err)
+		}
+		container = related
 	}
-
-	inlineWriter, err := writer.CreateInline()
+	alternativeBody.Writer, err = container.CreatePart(alternativeHeader)
 	if err != nil {
 		return nil, fmt.Errorf("create inline writer: %w", err)
 	}
 
-	var plainHeader mail.InlineHeader
-	plainHeader.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
-	plainPart, err := inlineWriter.CreatePart(plainHeader)
-	if err != nil {
-		return nil, fmt.Errorf("create plain part: %w", err)
-	}
-	if _, err := io.WriteString(plainPart, plainBody); err != nil {
-		return nil, fmt.Errorf("write plain part: %w", err)
-	}
-	if err := plainPart.Close(); err != nil {
-		return nil, fmt.Errorf("close plain part: %w", err)
-	}
-
-	var htmlHeader mail.InlineHeader
-	htmlHeader.SetContentType("text/html", map[string]string{"charset": "utf-8"})
-	htmlPart, err := inlineWriter.CreatePart(htmlHeader)
-	if err != nil {
-		return nil, fmt.Errorf("create html part: %w", err)
+	textParts := []struct {
+		mediaType string
+		text      string
+	}{{"text/plain", plainBody}, {"text/html", htmlBody}}
+	for _, textPart := range textParts {
+		if textPart.text == "" {
+			continue
+		}
+		var partHeader textproto.Header
+		partHeader.Set("Content-Disposition", "inline")
+		data, encoding := prepareTextPart(&partHeader, textPart.mediaType, textPart.text, charset, r.transferEncoding)
+		partWriter, err := alternative.CreatePart(partHeader)
+		if err != nil {
+			return nil, fmt.Errorf("create %s part: %w", textPart.mediaType, err)
+		}
+		if err := writePartBody(partWriter, data, encoding); err != nil {
+			return nil, fmt.Errorf("write %s part: %w", textPart.mediaType, err)
+		}
 	}
-	if _, err := io.WriteString(htmlPart, htmlBody); err != nil {
-		return nil, fmt.Errorf("write html part: %w", err)
+	if err := alternative.Close(); err != nil {
+		return nil, fmt.Errorf("close inline writer: %w", err)
 	}
-	if err := htmlPart.Close(); err != nil {
-		return nil, fmt.Errorf("close html part: %w", err)
+	if related != nil {
+		for _, part := range inline {
+			var partHeader textproto.Header
+			partHeader.Set("Content-Type", part.contentType)
+			partHeader.Set("Content-Id", "<"+part.contentID+">")
+			disposition := "inline"
+			if part.filename != "" {
+				disposition = mime.FormatMediaType("inline", map[string]string{"filename": part.filename})
+			}
+			partHeader.Set("Content-Disposition", disposition)
+			partHeader.Set("Content-Transfer-Encoding", config.TransferEncodingBase64)
+			partWriter, err := related.CreatePart(partHeader)
+			if err != nil {
+				return nil, fmt.Errorf("create inline part %s: %w", part.contentID, err)
+			}
+			if err := writePartBody(partWriter, part.data, config.TransferEncodingBase64); err != nil {
+				return nil, fmt.Errorf("write inline part %s: %w", part.contentID, err)
+			}
+		}
+		if err := related.Close(); err != nil {
+			return nil, fmt.Errorf("close related writer: %w", err)
+		}
 	}
 
-	if err := inlineWriter.Close(); err != nil {
-		return nil, fmt.Errorf("close inline writer: %w", err)
+	if attachment != nil {
+		var attachmentHeader textproto.Header
+		attachmentHeader.Set("Content-Type", "message/rfc822")
+		attachmentHeader.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "original.eml"}))
+		attachmentHeader.Set("Content-Transfer-Encoding", "8bit")
+		attachmentPart, err := mixed.CreatePart(attachmentHeader)
+		if err != nil {
+			return nil, fmt.Errorf("create original message part: %w", err)
+		}
+		if _, err := io.Copy(attachmentPart, attachment); err != nil {
+			return nil, fmt.Errorf("write original message part: %w", err)
+		}
 	}
-	if err := writer.Close(); err != nil {
+	if err := mixed.Close(); err != nil {
 		return nil, fmt.Errorf("close multipart writer: %w", err)
 	}
 
@@ -456,7 +1019,11 @@ func normalizeReplySubject(subject string) string {
 	return "Re: " + trimmed
 }
 
-func (r *Replier) deliverDirect(ctx context.Context, to string, message []byte) error {
+func (r *Replier) deliverNullSender(ctx context.Context, to string, message []byte) error {
+	return r.deliverFrom(ctx, "", to, message)
+}
+
+func (r *Replier) deliverFrom(ctx context.Context, from string, to string, message []byte) error {
 	parsedRecipient, err := mail.ParseAddress(to)
 	if err != nil {
 		return fmt.Errorf("parse recipient: %w", err)
@@ -467,7 +1034,18 @@ func (r *Replier) deliverDirect(ctx context.Context, to string, message []byte)
 		return err
 	}
 
-	mxRecords, lookupErr := net.DefaultResolver.LookupMX(ctx, domain)
+	if override, ok := matchDomainOverride(r.overrides, domain); ok {
+		deliveryErr := &deliveryError{recipient: parsedRecipient.Address}
+		err := r.tryHost(ctx, net.JoinHostPort(override.host, override.port), deliveryErr, func() error {
+			return r.sendToHost(ctx, override.host, override.port, from, parsedRecipient.Address, message, r.policyRequirement())
+		})
+		if err != nil {
+			return deliveryErr
+		}
+		return nil
+	}
+
+	mxRecords, lookupErr := r.resolver.LookupMX(ctx, domain)
 	targetHosts := make([]string, 0, len(mxRecords))
 	if lookupErr == nil && len(mxRecords) > 0 {
 		sort.Slice(mxRecords, func(i, j int) bool {
@@ -480,26 +1058,33 @@ func (r *Replier) deliverDirect(ctx context.Context, to string, message []byte)
 		targetHosts = append(targetHosts, domain)
 	}
 
-	var attemptErrors []string
-	if lookupErr != nil {
-		attemptErrors = append(attemptErrors, "mx lookup: "+lookupErr.Error())
-	}
-
-	for _, host := range targetHosts {
+	policy := r.lookupMTASTS(ctx, domain)
+	deliveryErr := &deliveryError{recipient: parsedRecipient.Address, lookupErr: lookupErr}
+	for _, host := range r.retry.usableHosts(targetHosts) {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
 
-		if err := r.sendToHost(host, parsedRecipient.Address, message); err != nil {
-			attemptErrors = append(attemptErrors, fmt.Sprintf("%s: %v", host, err))
+		requirement, err := r.outboundTLS(ctx, host, policy)
+		if err != nil {
+			recordAttempt(ctx, host, err)
+			deliveryErr.attempts = append(deliveryErr.attempts, deliveryAttempt{host: host, err: err})
 			continue
 		}
-		return nil
+		err = r.tryHost(ctx, host, deliveryErr, func() error {
+			return r.sendToHost(ctx, host, "25", from, parsedRecipient.Address, message, requirement)
+		})
+		if err == nil {
+			return nil
+		}
+		if r.retry.stopAfter(err) {
+			break
+		}
 	}
 
-	return fmt.Errorf("delivery failed for %s: %s", parsedRecipient.Address, strings.Join(attemptErrors, " | "))
+	return deliveryErr
 }
 
 func normalizeMXHost(host string) string {
@@ -511,28 +1096,62 @@ func addressDomain(address string) (string, error) {
 	if atIndex <= 0 || atIndex == len(address)-1 {
 		return "", fmt.Errorf("recipient address missing domain: %q", address)
 	}
-	return address[atIndex+1:], nil
+	domain := address[atIndex+1:]
+	if isASCII(domain) {
+		return domain, nil
+	}
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("convert domain %q to ascii: %w", domain, err)
+	}
+	return asciiDomain, nil
 }
 
-func (r *Replier) sendToHost(host string, recipient string, message []byte) error {
-	address := net.JoinHostPort(host, "25")
+func (r *Replier) sendToHost(ctx context.Context, host string, port string, from string, recipient string, message []byte, requirement tlsRequirement) error {
+	domain, _ := addressDomain(recipient)
+	dialer := r.dialer.forDomain(domain)
+	key := poolKey(net.JoinHostPort(host, port), requirement)
+	if source := dialer.sourceKey(); source != "" {
+		key += "|from=" + source
+	}
+	if pooled := r.pool.get(key); pooled != nil {
+		err := sendMail(pooled.client, from, recipient, message)
+		if err == nil {
+			pooled.messages++
+			r.pool.put(key, pooled)
+			return nil
+		}
+		pooled.client.Close()
+		var stale *mailCommandError
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &stale) && errors.As(err, &smtpErr) {
+			return fmt.Errorf("send mail: %w", err)
+		}
+	}
+
+	dial := func() (net.Conn, error) {
+		return dialer.dial(ctx, host, port)
+	}
 
-	client, _, err := dialSMTPClient(address, host)
+	ehloName := func(conn net.Conn) string {
+		return dialer.ehloName(conn, r.ehloName)
+	}
+	client, _, err := dialSMTPClient(dial, ehloName, r.clientTLSConfig(host, requirement), requirement)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	if r.hostname != "" {
-		if err := client.Hello(r.hostname); err != nil {
-			return fmt.Errorf("helo/ehlo failed: %w", err)
-		}
+	if err := sendMail(client, from, recipient, message); err != nil {
+		client.Close()
+		return fmt.Errorf("send mail: %w", err)
 	}
 
-	if err := client.SendMail(r.mailFrom, []string{recipient}, bytes.NewReader(message)); err != nil {
-		return fmt.Errorf("send mail: %w", err)
+	if r.pool != nil {
+		r.pool.put(key, &pooledClient{client: client, messages: 1})
+		return nil
 	}
 
+	defer client.Close()
 	if err := client.Quit(); err != nil {
 		return fmt.Errorf("quit smtp session: %w", err)
 	}
@@ -540,23 +1159,91 @@ func (r *Replier) sendToHost(host string, recipient string, message []byte) erro
 	return nil
 }
 
-func dialSMTPClient(address string, host string) (*smtp.Client, bool, error) {
-	tlsConfig := &tls.Config{
-		ServerName: host,
-		MinVersion: tls.VersionTLS12,
+func sendMail(client *smtp.Client, from string, recipient string, message []byte) error {
+	opts := &smtp.MailOptions{UTF8: needsSMTPUTF8(from, recipient, message)}
+	if err := client.Mail(from, opts); err != nil {
+		return &mailCommandError{err: err}
 	}
+	if err := client.Rcpt(recipient, nil); err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		data.Close()
+		return err
+	}
+	return data.Close()
+}
+
+type mailCommandError struct {
+	err error
+}
+
+func (e *mailCommandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mailCommandError) Unwrap() error {
+	return e.err
+}
+
+func needsSMTPUTF8(from string, recipient string, message []byte) bool {
+	return !isASCII(from) || !isASCII(recipient) || !isASCII(messageHeaders(message))
+}
 
-	tlsClient, tlsErr := smtp.DialStartTLS(address, tlsConfig)
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Replier) Close() error {
+	r.flushDigests()
+	return r.pool.Close()
+}
+
+func dialSMTPClient(dial func() (net.Conn, error), ehloName func(net.Conn) string, tlsConfig *tls.Config, requirement tlsRequirement) (*smtp.Client, bool, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, false, fmt.Errorf("dial failed: %w", err)
+	}
+	name := ehloName(conn)
+	if name == "" {
+		name = "localhost"
+	}
+	if requirement.plaintext {
+		return helloClient(conn, name, false)
+	}
+
+	tlsConn, tlsErr := startTLS(conn, name, tlsConfig)
 	if tlsErr == nil {
-		return tlsClient, true, nil
+		return helloClient(tlsConn, name, true)
+	}
+	conn.Close()
+	if requirement.source != "" {
+		return nil, false, fmt.Errorf("starttls required by %s: %w", requirement.source, tlsErr)
 	}
 
-	plainClient, plainErr := smtp.Dial(address)
-	if plainErr != nil {
-		return nil, false, fmt.Errorf("starttls failed (%v), plain failed (%w)", tlsErr, plainErr)
+	conn, err = dial()
+	if err != nil {
+		return nil, false, fmt.Errorf("starttls failed (%v), plain failed (%w)", tlsErr, err)
 	}
+	return helloClient(conn, name, false)
+}
 
-	return plainClient, false, nil
+func helloClient(conn net.Conn, name string, secure bool) (*smtp.Client, bool, error) {
+	client := smtp.NewClient(conn)
+	if err := client.Hello(name); err != nil {
+		client.Close()
+		return nil, false, fmt.Errorf("helo/ehlo failed: %w", err)
+	}
+	return client, secure, nil
 }
 
 func containsString(values []string, target string) bool {
@@ -1,23 +1,51 @@
 package echo
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 
+	processorv1 "github.com/danthegoodman1/smtp_echo/api/processor/v1"
 	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
 )
 
 func TestReplierEcho_EnvelopeRecipientAndThreadHeaders(t *testing.T) {
@@ -30,14 +58,14 @@ func TestReplierEcho_EnvelopeRecipientAndThreadHeaders(t *testing.T) {
 		},
 	}
 
-	replier, err := NewReplier(cfg, log.New(io.Discard, "", 0))
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
 	if err != nil {
 		t.Fatalf("NewReplier() error = %v", err)
 	}
 
 	var deliveredTo string
 	var deliveredMessage []byte
-	replier.deliverFn = func(_ context.Context, to string, message []byte) error {
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
 		deliveredTo = to
 		deliveredMessage = append([]byte(nil), message...)
 		return nil
@@ -105,7 +133,7 @@ func TestReplierEcho_EnvelopeRecipientAndThreadHeaders(t *testing.T) {
 		t.Fatalf("References = %#v, want [root@example.net message-1@example.net]", references)
 	}
 
-	body, err := readReplyBody(reader, deliveredMessage)
+	body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
 	if err != nil {
 		t.Fatalf("readReplyBody() error = %v", err)
 	}
@@ -202,7 +230,7 @@ func TestReadReplyBody_PrefersPlainTextPart(t *testing.T) {
 		t.Fatalf("CreateReader() error = %v", err)
 	}
 
-	body, err := readReplyBody(reader, []byte(inbound))
+	body, err := readReplyBody(reader, InboundMessage{Data: []byte(inbound)}, "")
 	if err != nil {
 		t.Fatalf("readReplyBody() error = %v", err)
 	}
@@ -236,7 +264,7 @@ func TestReadReplyBody_HTMLFallbackStripsMarkup(t *testing.T) {
 		t.Fatalf("CreateReader() error = %v", err)
 	}
 
-	body, err := readReplyBody(reader, []byte(inbound))
+	body, err := readReplyBody(reader, InboundMessage{Data: []byte(inbound)}, "")
 	if err != nil {
 		t.Fatalf("readReplyBody() error = %v", err)
 	}
@@ -258,13 +286,13 @@ func TestReplierEcho_MultipartReplyContainsPlainAndHTML(t *testing.T) {
 		},
 	}
 
-	replier, err := NewReplier(cfg, log.New(io.Discard, "", 0))
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
 	if err != nil {
 		t.Fatalf("NewReplier() error = %v", err)
 	}
 
 	var deliveredMessage []byte
-	replier.deliverFn = func(_ context.Context, _ string, message []byte) error {
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
 		deliveredMessage = append([]byte(nil), message...)
 		return nil
 	}
@@ -342,13 +370,13 @@ func TestReplierEcho_DKIMSignatureAddedWhenEnabled(t *testing.T) {
 		},
 	}
 
-	replier, err := NewReplier(cfg, log.New(io.Discard, "", 0))
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
 	if err != nil {
 		t.Fatalf("NewReplier() error = %v", err)
 	}
 
 	var deliveredMessage []byte
-	replier.deliverFn = func(_ context.Context, _ string, message []byte) error {
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
 		deliveredMessage = append([]byte(nil), message...)
 		return nil
 	}
@@ -374,6 +402,89 @@ func TestReplierEcho_DKIMSignatureAddedWhenEnabled(t *testing.T) {
 	}
 }
 
+func TestReplierEcho_DKIMOptions(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	keyPath := t.TempDir() + "/dkim-private.pem"
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	if err := os.WriteFile(keyPath, privateKeyPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	verifyOptions := &dkim.VerifyOptions{LookupTXT: func(string) ([]string, error) {
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKey)}, nil
+	}}
+
+	sign := func(dkimCfg config.DKIMConfig) []byte {
+		t.Helper()
+		dkimCfg.Domain = "mailtest.example.com"
+		dkimCfg.Selector = "s1"
+		dkimCfg.PrivateKeyPath = keyPath
+		cfg := config.Config{
+			Hostname: "mailtest.example.com",
+			Reply: config.ReplyConfig{
+				FromAddress: "echo@mailtest.example.com",
+				MailFrom:    "bounce@mailtest.example.com",
+			},
+			DKIM: &dkimCfg,
+		}
+		replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("NewReplier() error = %v", err)
+		}
+		var delivered []byte
+		replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+			delivered = append([]byte(nil), message...)
+			return nil
+		}
+		inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: dkim  options\r\n\r\nhello   there \r\n\r\n\r\n"
+		if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+		return delivered
+	}
+
+	signed := sign(config.DKIMConfig{
+		Headers:          []string{"From", "Subject", "Date"},
+		Canonicalization: "relaxed/relaxed",
+		Expiry:           time.Hour,
+	})
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), verifyOptions)
+	if err != nil || len(verifications) != 1 {
+		t.Fatalf("VerifyWithOptions() = %v, %v, want one signature", verifications, err)
+	}
+	verification := verifications[0]
+	if verification.Err != nil {
+		t.Fatalf("signature error = %v, want valid signature", verification.Err)
+	}
+	if !slices.Equal(verification.HeaderKeys, []string{"From", "Subject", "Date"}) {
+		t.Fatalf("signed headers = %v, want configured headers", verification.HeaderKeys)
+	}
+	if until := time.Until(verification.Expiration); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("expiration in %s, want about 1h", until)
+	}
+	if !strings.Contains(string(signed), "c=relaxed/relaxed;") {
+		t.Fatalf("signature missing relaxed canonicalization:\n%s", signed)
+	}
+
+	for _, canonicalization := range []string{"simple/simple", "relaxed/relaxed"} {
+		signed = sign(config.DKIMConfig{Canonicalization: canonicalization, BodyLength: 10})
+		header, _, _ := strings.Cut(string(signed), "\r\n b=")
+		if !strings.Contains(header, " l=10;") || !strings.Contains(header, "c="+canonicalization+";") {
+			t.Fatalf("signature header = %q, want l=10 and c=%s", header, canonicalization)
+		}
+		verifications, err = dkim.VerifyWithOptions(bytes.NewReader(signed), verifyOptions)
+		if err != nil || len(verifications) != 1 || verifications[0].Err == nil || !strings.Contains(verifications[0].Err.Error(), "body length") {
+			t.Fatalf("VerifyWithOptions() = %v, %v, want the body length tag to be seen", verifications, err)
+		}
+	}
+}
+
 func TestNewReplier_DKIMRejectsNonRSAKey(t *testing.T) {
 	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -408,7 +519,7 @@ func TestNewReplier_DKIMRejectsNonRSAKey(t *testing.T) {
 		},
 	}
 
-	_, err = NewReplier(cfg, log.New(io.Discard, "", 0))
+	_, err = NewReplier(cfg, nil, log.New(io.Discard, "", 0))
 	if err == nil {
 		t.Fatalf("NewReplier() expected error for non-RSA DKIM key")
 	}
@@ -416,3 +527,3399 @@ func TestNewReplier_DKIMRejectsNonRSAKey(t *testing.T) {
 		t.Fatalf("NewReplier() error = %q, expected RSA guidance", err)
 	}
 }
+
+type notFoundResolver struct{}
+
+func (notFoundResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (notFoundResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (notFoundResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (notFoundResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestReplierEcho_ReportMode(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Mode:        config.ReplyModeReport,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.resolver = notFoundResolver{}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := strings.Join([]string{
+		"Received: from client.example.net (client.example.net [192.0.2.10]) by mx.example.com",
+		"From: sender@example.net",
+		"To: echo@example.com",
+		"Subject: report me",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="report-boundary"`,
+		"",
+		"--report-boundary",
+		`Content-Type: text/plain; charset="UTF-8"`,
+		"",
+		"secret body text",
+		"--report-boundary",
+		`Content-Type: text/html; charset="UTF-8"`,
+		"",
+		"<p>secret body text</p>",
+		"--report-boundary--",
+		"",
+	}, "\r\n")
+
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000},
+		Helo:         "client.example.net",
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
+	if err != nil {
+		t.Fatalf("readReplyBody() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"MAIL FROM:      sender@example.net",
+		"RCPT TO:        echo@example.com",
+		"Client address: 192.0.2.10:40000",
+		"HELO/EHLO:      client.example.net",
+		"TLS:            none (plaintext)",
+		"SPF:            none (example.net)",
+		"DKIM:           none: no signatures",
+		"DMARC:          none (example.net)",
+		"1. from client.example.net",
+		"multipart/alternative",
+		"  text/plain; charset=UTF-8 16 bytes",
+		"  text/html; charset=UTF-8",
+	} {
+		if !strings.Contains(body.Plain, want) {
+			t.Fatalf("report missing %q, got:\n%s", want, body.Plain)
+		}
+	}
+	if body.HTML != "" {
+		t.Fatalf("report reply should be plain text only, got html: %q", body.HTML)
+	}
+}
+
+func TestReplierEcho_DMARCHeader(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Mode:        config.ReplyModeEcho,
+			DMARCHeader: true,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.resolver = notFoundResolver{}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: dmarc\r\n\r\nhello\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000},
+		Helo:         "client.example.net",
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	want := "result=none; domain=example.net; spf=none; spf-aligned=no; dkim=none; dkim-aligned=no"
+	if got := reader.Header.Get("X-Echo-DMARC"); got != want {
+		t.Fatalf("X-Echo-DMARC = %q, want %q", got, want)
+	}
+}
+
+func TestReplierEcho_BounceDSN(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Mode:        config.ReplyModeEcho,
+			Bounce:      config.BounceModeDSN,
+		},
+	}
+
+	messageStore := store.NewMemory()
+	replier, err := NewReplier(cfg, messageStore, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.deliverFn = func(_ context.Context, _ string, to string, _ []byte) error {
+		return &deliveryError{recipient: to, attempts: []deliveryAttempt{{
+			host: "mx.example.net",
+			err:  &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+		}}}
+	}
+	var dsnRecipient string
+	var dsnMessage []byte
+	replier.bounceFn = func(_ context.Context, to string, message []byte) error {
+		dsnRecipient = to
+		dsnMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: bounce me\r\n\r\nhello\r\n"
+	messageID, err := messageStore.SaveMessage(context.Background(), store.Message{EnvelopeFrom: "sender@example.net"})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(context.Background(), InboundMessage{
+		ID:           messageID,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v, want bounce handled", err)
+	}
+
+	if dsnRecipient != "sender@example.net" {
+		t.Fatalf("dsn recipient = %q, want sender@example.net", dsnRecipient)
+	}
+	for _, want := range []string{
+		"multipart/report",
+		"report-type=delivery-status",
+		"Final-Recipient: rfc822; sender@example.net",
+		"Status: 5.1.1",
+		"Remote-MTA: dns; mx.example.net",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user",
+		"Subject: Re: bounce me",
+	} {
+		if !bytes.Contains(dsnMessage, []byte(want)) {
+			t.Fatalf("dsn missing %q, got:\n%s", want, dsnMessage)
+		}
+	}
+
+	stored, err := messageStore.GetMessage(context.Background(), messageID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if len(stored.Replies) != 2 {
+		t.Fatalf("stored replies = %#v, want echo and dsn", stored.Replies)
+	}
+	if echoReply := stored.Replies[0]; echoReply.Status != store.ReplyStatusFailed || echoReply.StatusCode != "5.1.1" || echoReply.RemoteHost != "mx.example.net" {
+		t.Fatalf("echo reply = %#v, want failed 5.1.1 via mx.example.net", echoReply)
+	}
+	if dsnReply := stored.Replies[1]; dsnReply.Kind != store.ReplyKindDSN || dsnReply.Status != store.ReplyStatusDelivered {
+		t.Fatalf("dsn reply = %#v, want delivered dsn", dsnReply)
+	}
+}
+
+func TestReplierEcho_TemplateBody(t *testing.T) {
+	dir := t.TempDir()
+	textPath := dir + "/reply.txt"
+	htmlPath := dir + "/reply.html"
+	if err := os.WriteFile(textPath, []byte("You wrote {{.Subject}} from {{.Sender}}:\n{{.Body}}\nSPF: {{.Auth.SPF.Result}}\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(htmlPath, []byte("<p>{{.Body}}</p>"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Mode:        config.ReplyModeEcho,
+			Template:    &config.ReplyTemplateConfig{Text: textPath, HTML: htmlPath},
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.resolver = notFoundResolver{}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: templated\r\n\r\n<b>hi</b>\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000},
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
+	if err != nil {
+		t.Fatalf("readReplyBody() error = %v", err)
+	}
+	for _, want := range []string{"You wrote templated from sender@example.net:", "<b>hi</b>", "SPF: none"} {
+		if !strings.Contains(body.Plain, want) {
+			t.Fatalf("plain body = %q, want it to contain %q", body.Plain, want)
+		}
+	}
+	if !strings.Contains(body.HTML, "<p>&lt;b&gt;hi&lt;/b&gt;") {
+		t.Fatalf("html body = %q, want escaped original body", body.HTML)
+	}
+}
+
+func TestDialSMTPClient_RequiredTLSRefusesPlaintext(t *testing.T) {
+	_, addr := startTestServer(t, config.Config{}, &recordingProcessor{})
+	tlsConfig := &tls.Config{ServerName: "127.0.0.1", MinVersion: tls.VersionTLS12}
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	ehloName := func(net.Conn) string { return "" }
+	if _, _, err := dialSMTPClient(dial, ehloName, tlsConfig, tlsRequirement{source: "delivery.tls_policy"}); err == nil || !strings.Contains(err.Error(), "starttls required by delivery.tls_policy") {
+		t.Fatalf("dialSMTPClient() required error = %v, want starttls required", err)
+	}
+
+	client, usedTLS, err := dialSMTPClient(dial, ehloName, tlsConfig, tlsRequirement{})
+	if err != nil {
+		t.Fatalf("dialSMTPClient() opportunistic error = %v", err)
+	}
+	defer client.Close()
+	if usedTLS {
+		t.Fatalf("dialSMTPClient() usedTLS = true, want plaintext fallback")
+	}
+}
+
+func TestDialSMTPClient_EHLONameBeforeStartTLS(t *testing.T) {
+	var mu sync.Mutex
+	var greetings []string
+	backend := NewBackend(config.Config{}, &recordingProcessor{}, nil, nil)
+	server := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		mu.Lock()
+		greetings = append(greetings, c.Hostname())
+		mu.Unlock()
+		return backend.NewSession(c)
+	}))
+	server.Domain = "mx.example.net"
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.net")}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	}
+	ehloName := func(net.Conn) string { return "out.example.com" }
+	client, usedTLS, err := dialSMTPClient(dial, ehloName, &tls.Config{InsecureSkipVerify: true}, tlsRequirement{source: "delivery.tls_policy"})
+	if err != nil {
+		t.Fatalf("dialSMTPClient() error = %v", err)
+	}
+	defer client.Close()
+	if !usedTLS {
+		t.Fatalf("dialSMTPClient() usedTLS = false, want STARTTLS")
+	}
+	if err := client.SendMail("bounce@example.com", []string{"sender@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() over STARTTLS error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(greetings, []string{"out.example.com", "out.example.com"}) {
+		t.Fatalf("EHLO names = %v, want out.example.com before and after STARTTLS", greetings)
+	}
+}
+
+func TestReplierEcho_ReceivedHeaders(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:  "echo@example.com",
+			MailFrom:     "bounce@example.com",
+			Mode:         config.ReplyModeEcho,
+			CopyReceived: true,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := strings.Join([]string{
+		"Received: from relay2.example.net by mx.example.com; Mon, 1 Jan 2024 10:00:02 +0000",
+		"Received: from client.example.net by relay2.example.net; Mon, 1 Jan 2024 10:00:01 +0000",
+		"From: sender@example.net",
+		"To: echo@example.com",
+		"Subject: trace",
+		"",
+		"hello",
+		"",
+	}, "\r\n")
+	if err := replier.Echo(context.Background(), InboundMessage{
+		ID:           7,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000},
+		Helo:         "relay2.example.net",
+		TLS:          &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		AuthUser:     "tester",
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	received := reader.Header.Get("Received")
+	wantPrefix := "from relay2.example.net ([192.0.2.10]) by echo.example.com (smtp-echo) with ESMTPSA (TLS 1.3 TLS_AES_128_GCM_SHA256) id 7 for <echo@example.com>; "
+	if !strings.HasPrefix(received, wantPrefix) {
+		t.Fatalf("Received = %q, want prefix %q", received, wantPrefix)
+	}
+
+	original := reader.Header.Values("X-Original-Received")
+	if len(original) != 2 || !strings.HasPrefix(original[0], "from relay2.example.net") || !strings.HasPrefix(original[1], "from client.example.net") {
+		t.Fatalf("X-Original-Received = %#v, want inbound chain in order", original)
+	}
+}
+
+func TestReplierEcho_AttachOriginal(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:    "echo@example.com",
+			MailFrom:       "bounce@example.com",
+			AttachOriginal: true,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := strings.Join([]string{
+		"Received: from client.example.net by relay.example.net; Mon, 1 Jan 2024 10:00:01 +0000",
+		"From: sender@example.net",
+		"To: echo@example.com",
+		"Subject: attach",
+		"X-Custom: kept",
+		"",
+		"hello",
+		"",
+	}, "\r\n")
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Data:         []byte(inbound),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	var plain, attached string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		switch header := part.Header.(type) {
+		case *mail.InlineHeader:
+			plain = string(content)
+		case *mail.AttachmentHeader:
+			if mediaType, _, _ := header.ContentType(); mediaType != "message/rfc822" {
+				t.Fatalf("attachment Content-Type = %q, want message/rfc822", mediaType)
+			}
+			attached = string(content)
+		}
+	}
+	if !strings.Contains(plain, "hello") {
+		t.Fatalf("reply plain body = %q, want echoed body", plain)
+	}
+	if attached != inbound {
+		t.Fatalf("attached original = %q, want the raw inbound message", attached)
+	}
+}
+
+func TestReplierEcho_HeaderDump(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			HeaderDump:  true,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := strings.Join([]string{
+		"Received: from client.example.net by relay.example.net; Mon, 1 Jan 2024 10:00:01 +0000",
+		"From: sender@example.net",
+		"To: echo@example.com",
+		"Subject: headers",
+		"X-Mailer: <test & mailer>",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"Plain part",
+		"--b",
+		"Content-Type: text/html",
+		"",
+		"<p>HTML part</p>",
+		"--b--",
+		"",
+	}, "\r\n")
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Data:         []byte(inbound),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
+	if err != nil {
+		t.Fatalf("readReplyBody() error = %v", err)
+	}
+	for _, want := range []string{"Received: from client.example.net by relay.example.net;", "X-Mailer: <test & mailer>", "MIME-Version: 1.0"} {
+		if !strings.Contains(body.Plain, want) {
+			t.Fatalf("reply plain body missing %q, got:\n%s", want, body.Plain)
+		}
+	}
+	if !strings.HasSuffix(strings.TrimSpace(body.Plain), "Plain part") {
+		t.Fatalf("reply plain body should end with the echoed body, got:\n%s", body.Plain)
+	}
+	if !strings.Contains(body.HTML, "X-Mailer: &lt;test &amp; mailer&gt;") || !strings.HasSuffix(strings.TrimSpace(body.HTML), "<p>HTML part</p>") {
+		t.Fatalf("reply html body = %q, want escaped header dump before the echoed html", body.HTML)
+	}
+}
+
+type staticIPResolver []net.IPAddr
+
+func (r staticIPResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return r, nil
+}
+
+func TestOutboundDialer_InterleavesFamiliesAndFallsBack(t *testing.T) {
+	resolver := staticIPResolver{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+	dialer, err := newOutboundDialer(config.DeliveryConfig{}, resolver)
+	if err != nil {
+		t.Fatalf("newOutboundDialer() error = %v", err)
+	}
+	ips, err := dialer.lookup(context.Background(), "mx.example.com")
+	if err != nil {
+		t.Fatalf("lookup() error = %v", err)
+	}
+	if got := fmt.Sprint(ips); got != "[2001:db8::1 192.0.2.1 192.0.2.2]" {
+		t.Fatalf("lookup() = %s, want ipv6 first then interleaved", got)
+	}
+
+	dialer.family = config.IPFamilyIPv4
+	if ips, _ := dialer.lookup(context.Background(), "mx.example.com"); len(ips) != 2 || ips[0].To4() == nil {
+		t.Fatalf("lookup() with ip_family ipv4 = %v, want only ipv4", ips)
+	}
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dialer = outboundDialer{connectTimeout: time.Second, fallbackDelay: time.Second}
+	conn, err := dialer.race(context.Background(), []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}, port)
+	if err != nil {
+		t.Fatalf("race() error = %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != listener.Addr().String() {
+		t.Fatalf("race() connected to %s, want fallback to %s", got, listener.Addr())
+	}
+}
+
+func TestOutboundDialer_SourcePool(t *testing.T) {
+	pool := &config.SourcePoolConfig{
+		Selection: config.SourceSelectionRoundRobin,
+		Addresses: []config.SourceAddressConfig{
+			{IP: "127.0.0.2", EHLOName: "mx2.example.com"},
+			{IP: "127.0.0.3"},
+		},
+	}
+	dialer, err := newOutboundDialer(config.DeliveryConfig{SourcePool: pool}, net.DefaultResolver)
+	if err != nil {
+		t.Fatalf("newOutboundDialer() error = %v", err)
+	}
+	first, second := dialer.forDomain("example.net").sourceKey(), dialer.forDomain("example.net").sourceKey()
+	if first != "127.0.0.2" || second != "127.0.0.3" {
+		t.Fatalf("round_robin sources = %s, %s, want 127.0.0.2 then 127.0.0.3", first, second)
+	}
+
+	pool.Selection = config.SourceSelectionDomain
+	dialer, err = newOutboundDialer(config.DeliveryConfig{SourcePool: pool}, net.DefaultResolver)
+	if err != nil {
+		t.Fatalf("newOutboundDialer() error = %v", err)
+	}
+	pinned := dialer.forDomain("example.net").sourceKey()
+	for i := 0; i < 5; i++ {
+		if got := dialer.forDomain("EXAMPLE.net").sourceKey(); got != pinned {
+			t.Fatalf("domain sources = %s then %s, want the domain pinned to one address", pinned, got)
+		}
+	}
+
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, config.Config{}, processor)
+	host, port, _ := net.SplitHostPort(addr)
+	pool.Selection = config.SourceSelectionRoundRobin
+	replier, err := NewReplier(config.Config{
+		Hostname: "echo.example.com",
+		Delivery: config.DeliveryConfig{SourcePool: pool, EHLOName: "out.example.com"},
+	}, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	message := []byte("Subject: hi\r\n\r\nbody\r\n")
+	for i := 0; i < 2; i++ {
+		if err := replier.sendToHost(context.Background(), host, port, "echo@example.com", "sender@example.net", message, tlsRequirement{plaintext: true}); err != nil {
+			t.Fatalf("sendToHost() error = %v", err)
+		}
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 2 {
+		t.Fatalf("processed messages = %d, want 2", len(processor.messages))
+	}
+	for i, want := range []struct{ ip, helo string }{{"127.0.0.2", "mx2.example.com"}, {"127.0.0.3", "out.example.com"}} {
+		msg := processor.messages[i]
+		remote, _, _ := net.SplitHostPort(msg.RemoteAddr.String())
+		if remote != want.ip || msg.Helo != want.helo {
+			t.Fatalf("message %d from %s helo %q, want %s helo %q", i, remote, msg.Helo, want.ip, want.helo)
+		}
+	}
+}
+
+func TestConnPool_ReusesAndRetires(t *testing.T) {
+	_, addr := startTestServer(t, config.Config{}, &recordingProcessor{})
+	pool := newConnPool(&config.PoolConfig{IdleTimeout: 100 * time.Millisecond, MaxMessages: 2})
+	defer pool.Close()
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	key := poolKey("127.0.0.1", tlsRequirement{})
+	pool.put(key, &pooledClient{client: client, messages: 1})
+
+	pooled := pool.get(key)
+	if pooled == nil || pooled.client != client {
+		t.Fatalf("get() = %v, want the pooled client", pooled)
+	}
+	if err := pooled.client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() on reused client error = %v", err)
+	}
+	pooled.messages++
+	pool.put(key, pooled)
+	if pool.size() != 0 {
+		t.Fatalf("pool size = %d after max_messages, want the client retired", pool.size())
+	}
+
+	client, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	pool.put(key, &pooledClient{client: client, messages: 1})
+	time.Sleep(300 * time.Millisecond)
+	if pool.size() != 0 || pool.get(key) != nil {
+		t.Fatalf("pool size = %d after idle_timeout, want 0", pool.size())
+	}
+}
+
+type staleSession struct {
+	server *staleServer
+	mails  int
+}
+
+type staleServer struct {
+	mu          sync.Mutex
+	connections int
+	delivered   int
+	stale       bool
+}
+
+func (s *staleSession) Mail(string, *smtp.MailOptions) error {
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.mails++
+	if s.server.stale && s.mails > 1 {
+		return &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 4, 2}, Message: "Idle too long"}
+	}
+	return nil
+}
+
+func (s *staleSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (s *staleSession) Reset()                               {}
+func (s *staleSession) Logout() error                        { return nil }
+
+func (s *staleSession) Data(r io.Reader) error {
+	io.Copy(io.Discard, r)
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.server.delivered++
+	return nil
+}
+
+func TestReplierSendToHost_RedialsStalePooledConnection(t *testing.T) {
+	stub := &staleServer{}
+	server := smtp.NewServer(smtp.BackendFunc(func(*smtp.Conn) (smtp.Session, error) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		stub.connections++
+		return &staleSession{server: stub}, nil
+	}))
+	server.Domain = "mx.example.net"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	replier, err := NewReplier(config.Config{
+		Hostname: "echo.example.com",
+		Delivery: config.DeliveryConfig{Pool: &config.PoolConfig{IdleTimeout: time.Minute, MaxMessages: 10}},
+	}, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	defer replier.Close()
+	send := func() error {
+		return replier.sendToHost(context.Background(), host, port, "echo@example.com", "sender@example.net", []byte("Subject: hi\r\n\r\nbody\r\n"), tlsRequirement{plaintext: true})
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("sendToHost() error = %v", err)
+	}
+	stub.mu.Lock()
+	stub.stale = true
+	stub.mu.Unlock()
+	if err := send(); err != nil {
+		t.Fatalf("sendToHost() over a pooled connection refusing MAIL error = %v, want a redial", err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.connections != 2 || stub.delivered != 2 {
+		t.Fatalf("connections = %d, delivered = %d, want 2 and 2", stub.connections, stub.delivered)
+	}
+}
+
+func TestSendMail_PropagatesSMTPUTF8(t *testing.T) {
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, config.Config{}, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	message := []byte("To: =?utf-8?q?J=C3=B8rgen?= <jørgen@example.net>\r\nSubject: utf8\r\n\r\nhéllo\r\n")
+	if err := sendMail(client, "jørgen@example.net", "echo@example.com", message); err != nil {
+		t.Fatalf("sendMail() error = %v", err)
+	}
+	if err := sendMail(client, "sender@example.net", "echo@example.com", []byte("Subject: ascii\r\n\r\nhéllo\r\n")); err != nil {
+		t.Fatalf("sendMail() error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 2 {
+		t.Fatalf("processed messages = %d, want 2", len(processor.messages))
+	}
+	first, second := processor.messages[0], processor.messages[1]
+	if !first.SMTPUTF8 || first.EnvelopeFrom != "jørgen@example.net" || first.BodyType != "8BITMIME" {
+		t.Fatalf("first message SMTPUTF8 = %t, from = %q, body = %q, want SMTPUTF8 with the utf-8 sender", first.SMTPUTF8, first.EnvelopeFrom, first.BodyType)
+	}
+	if second.SMTPUTF8 {
+		t.Fatalf("second message SMTPUTF8 = true, want false for ascii envelope and headers")
+	}
+	if got := formatReceived(first, "echo.example.com"); !strings.Contains(got, " with UTF8SMTP ") {
+		t.Fatalf("formatReceived() = %q, want UTF8SMTP protocol", got)
+	}
+
+	if domain, err := addressDomain("user@bücher.example"); err != nil || domain != "xn--bcher-kva.example" {
+		t.Fatalf("addressDomain() = %q, %v, want punycode domain", domain, err)
+	}
+}
+
+func TestOutboundDialer_HTTPConnectProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "220 mx.example.com ESMTP\r\n")
+	}()
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer proxyListener.Close()
+	requested := make(chan string, 1)
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requested <- req.Method + " " + req.Host + " " + req.Header.Get("Proxy-Authorization")
+		upstream, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(conn, upstream)
+	}()
+
+	dialer, err := newOutboundDialer(config.DeliveryConfig{
+		ConnectTimeout: time.Second,
+		Proxy:          "http://user:pass@" + proxyListener.Addr().String(),
+	}, staticIPResolver{})
+	if err != nil {
+		t.Fatalf("newOutboundDialer() error = %v", err)
+	}
+	conn, err := dialer.dial(context.Background(), "mx.example.com", "25")
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	if got := <-requested; got != "CONNECT mx.example.com:25 Basic dXNlcjpwYXNz" {
+		t.Fatalf("proxy request = %q, want CONNECT to the unresolved mx host with credentials", got)
+	}
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || greeting != "220 mx.example.com ESMTP\r\n" {
+		t.Fatalf("greeting = %q, %v, want the upstream banner through the proxy", greeting, err)
+	}
+}
+
+func TestReplierDeliver_DomainOverrides(t *testing.T) {
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, config.Config{}, processor)
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Delivery: config.DeliveryConfig{
+			TLSPolicy: config.TLSPolicyNone,
+			DomainOverrides: map[string]string{
+				"*.test.local":    addr,
+				"mail.test.local": "127.0.0.1:1",
+			},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	if override, ok := matchDomainOverride(replier.overrides, "Mail.Test.Local"); !ok || override.port != "1" {
+		t.Fatalf("matchDomainOverride() = %+v, %t, want the exact domain before the wildcard", override, ok)
+	}
+	if _, ok := matchDomainOverride(replier.overrides, "example.com"); ok {
+		t.Fatalf("matchDomainOverride(example.com) matched, want no override")
+	}
+
+	if err := replier.deliverFn(context.Background(), replier.mailFrom, "user@ci.test.local", []byte("Subject: override\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("deliver() error = %v", err)
+	}
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 || processor.messages[0].Recipients[0] != "user@ci.test.local" {
+		t.Fatalf("processed messages = %#v, want the reply delivered to the override host", processor.messages)
+	}
+}
+
+type stubProcessorServer struct {
+	processorv1.UnimplementedProcessorServer
+	response *processorv1.ProcessResponse
+	request  *processorv1.ProcessRequest
+}
+
+func (s *stubProcessorServer) Process(_ context.Context, request *processorv1.ProcessRequest) (*processorv1.ProcessResponse, error) {
+	s.request = request
+	return s.response, nil
+}
+
+func TestGRPCProcessor_Actions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	stub := &stubProcessorServer{}
+	server := grpc.NewServer()
+	processorv1.RegisterProcessorServer(server, stub)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	cfg := config.Config{
+		Hostname:  "echo.example.com",
+		Processor: config.ProcessorGRPC,
+		GRPC:      &config.GRPCConfig{Target: listener.Addr().String(), Timeout: 5 * time.Second},
+		Reply:     config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered []string
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+		delivered = append(delivered, to+"|"+string(message))
+		return nil
+	}
+	processor, err := NewProcessor(cfg, replier)
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+	defer processor.(io.Closer).Close()
+
+	msg := InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender@example.net\r\nSubject: Hi\r\n\r\nhello\r\n"),
+	}
+
+	stub.response = &processorv1.ProcessResponse{
+		Action:  processorv1.Action_ACTION_REPLY,
+		Replies: []*processorv1.Reply{{Message: []byte("Subject: custom\r\n\r\ncustom reply\r\n")}},
+	}
+	if err := processor.Echo(context.Background(), msg); err != nil {
+		t.Fatalf("Echo(reply) error = %v", err)
+	}
+	if len(delivered) != 1 || !strings.HasPrefix(delivered[0], "sender@example.net|Subject: custom") {
+		t.Fatalf("delivered = %q, want the custom reply", delivered)
+	}
+	if stub.request.GetEnvelopeFrom() != "sender@example.net" || !strings.Contains(string(stub.request.GetRaw()), "hello") {
+		t.Fatalf("request = %v, want envelope and raw message", stub.request)
+	}
+
+	stub.response = &processorv1.ProcessResponse{Action: processorv1.Action_ACTION_DROP}
+	if err := processor.Echo(context.Background(), msg); err != nil || len(delivered) != 1 {
+		t.Fatalf("Echo(drop) error = %v delivered = %d, want nothing sent", err, len(delivered))
+	}
+
+	stub.response = &processorv1.ProcessResponse{Action: processorv1.Action_ACTION_REJECT, RejectCode: 451, RejectEnhancedCode: "4.7.0", RejectMessage: "try later"}
+	var smtpErr *smtp.SMTPError
+	if err := processor.Echo(context.Background(), msg); !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 0}) {
+		t.Fatalf("Echo(reject) error = %v, want 451 4.7.0", err)
+	}
+
+	stub.response = &processorv1.ProcessResponse{}
+	if err := processor.Echo(context.Background(), msg); err != nil || len(delivered) != 2 || !strings.Contains(delivered[1], "Subject: Re: Hi") {
+		t.Fatalf("Echo(echo) error = %v delivered = %d, want built-in echo reply", err, len(delivered))
+	}
+
+	server.Stop()
+	if err := processor.Echo(context.Background(), msg); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Echo(unavailable) error = %v, want 451", err)
+	}
+}
+
+type blockingProcessorServer struct {
+	processorv1.UnimplementedProcessorServer
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingProcessorServer) Process(context.Context, *processorv1.ProcessRequest) (*processorv1.ProcessResponse, error) {
+	s.started <- struct{}{}
+	<-s.unblock
+	return &processorv1.ProcessResponse{Action: processorv1.Action_ACTION_DROP}, nil
+}
+
+func TestBackend_ReloadDuringGRPCProcess(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	stub := &blockingProcessorServer{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	server := grpc.NewServer()
+	processorv1.RegisterProcessorServer(server, stub)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	cfg := config.Config{
+		Hostname:  "echo.example.com",
+		Processor: config.ProcessorGRPC,
+		GRPC:      &config.GRPCConfig{Target: listener.Addr().String(), Timeout: 5 * time.Second},
+		Reply:     config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+	}
+	newProcessor := func(cfg config.Config) *grpcProcessor {
+		replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("NewReplier() error = %v", err)
+		}
+		processor, err := NewProcessor(cfg, replier)
+		if err != nil {
+			t.Fatalf("NewProcessor() error = %v", err)
+		}
+		return processor.(*grpcProcessor)
+	}
+	first := newProcessor(cfg)
+	backend := NewBackend(cfg, first, nil, log.New(io.Discard, "", 0))
+
+	pipeline, release := backend.acquire()
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Data: []byte("Subject: hi\r\n\r\nbody\r\n")})
+	}()
+	<-stub.started
+
+	second := newProcessor(cfg)
+	backend.Reload(cfg, second)
+	if second.conn != first.conn {
+		t.Fatal("Reload() with unchanged grpc settings opened a new connection")
+	}
+	changed := cfg
+	changed.GRPC = &config.GRPCConfig{Target: cfg.GRPC.Target, Timeout: 10 * time.Second}
+	third := newProcessor(changed)
+	backend.Reload(changed, third)
+	defer third.Close()
+	if third.conn == first.conn {
+		t.Fatal("Reload() with changed grpc settings kept the old connection")
+	}
+	if state := first.conn.GetState(); state == connectivity.Shutdown {
+		t.Fatal("Reload() closed the grpc connection under an in-flight call")
+	}
+
+	close(stub.unblock)
+	if err := <-result; err != nil {
+		t.Fatalf("Echo() during reload error = %v", err)
+	}
+	release()
+	if state := first.conn.GetState(); state != connectivity.Shutdown {
+		t.Fatalf("grpc connection state = %s after the last caller finished, want shutdown", state)
+	}
+}
+
+func TestReplierEcho_Script(t *testing.T) {
+	scriptPath := filepath.Join(t.TempDir(), "reply.lua")
+	script := `
+function handle(msg)
+  if msg.headers["x-action"] == "reject" then
+    return { reject = { code = 550, enhanced_code = "5.7.1", message = "blocked by script" } }
+  end
+  if string.find(msg.body, "unsubscribe") then
+    return { skip = true }
+  end
+  return { subject = "Scripted for " .. msg.envelope_from, body = "recipients=" .. #msg.recipients .. " subject=" .. msg.subject }
+end
+`
+	if err := os.WriteFile(scriptPath, []byte(script), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Script:      &config.ReplyScriptConfig{Path: scriptPath, Timeout: time.Second},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered [][]byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		delivered = append(delivered, message)
+		return nil
+	}
+
+	echo := func(extraHeader string, body string) error {
+		return replier.Echo(context.Background(), InboundMessage{
+			EnvelopeFrom: "sender@example.net",
+			Recipients:   []string{"echo@example.com"},
+			Data:         []byte("From: sender@example.net\r\nSubject: Hello\r\n" + extraHeader + "\r\n" + body + "\r\n"),
+		})
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := echo("X-Action: reject\r\n", "hi"); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Message != "blocked by script" {
+		t.Fatalf("Echo(reject) error = %v, want 550 from script", err)
+	}
+	if err := echo("", "please unsubscribe me"); err != nil || len(delivered) != 0 {
+		t.Fatalf("Echo(skip) error = %v delivered = %d, want no reply", err, len(delivered))
+	}
+	if err := echo("", "hi"); err != nil || len(delivered) != 1 {
+		t.Fatalf("Echo() error = %v delivered = %d, want one reply", err, len(delivered))
+	}
+	reply := string(delivered[0])
+	if !strings.Contains(reply, "Subject: Scripted for sender@example.net") || !strings.Contains(reply, "recipients=3D1 subject=3DHello") {
+		t.Fatalf("reply = %q, want scripted subject and body", reply)
+	}
+
+	if err := os.WriteFile(scriptPath, []byte("function handle(msg) while true do end end"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	cfg.Reply.Script.Timeout = 50 * time.Millisecond
+	looping, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	looping.deliverFn = replier.deliverFn
+	if err := looping.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte("Subject: x\r\n\r\nhi\r\n")}); err == nil {
+		t.Fatalf("Echo(looping script) error = nil, want timeout error")
+	}
+}
+
+func TestReplierEcho_ScriptBodyFields(t *testing.T) {
+	scriptPath := filepath.Join(t.TempDir(), "reply.lua")
+	script := `
+function handle(msg)
+  local action = msg.headers["x-action"]
+  if action == "clear" then
+    return { body = "" }
+  elseif action == "html" then
+    return { html = "<p>Scripted html</p>" }
+  end
+  return { subject = "Scripted subject" }
+end
+`
+	if err := os.WriteFile(scriptPath, []byte(script), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	replier, err := NewReplier(config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Script:      &config.ReplyScriptConfig{Path: scriptPath, Timeout: time.Second},
+		},
+	}, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered string
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		delivered = string(message)
+		return nil
+	}
+
+	tests := []struct {
+		action  string
+		want    []string
+		notWant []string
+	}{
+		{action: "clear", notWant: []string{"original text", "text/html"}},
+		{action: "html", want: []string{"text/html", "<p>Scripted html</p>", "\r\n\r\nScripted html"}, notWant: []string{"original text"}},
+		{action: "subject only", want: []string{"Subject: Scripted subject", "original text"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			err := replier.Echo(context.Background(), InboundMessage{
+				EnvelopeFrom: "sender@example.net",
+				Recipients:   []string{"echo@example.com"},
+				Data:         []byte("From: sender@example.net\r\nSubject: Hello\r\nX-Action: " + tt.action + "\r\n\r\noriginal text\r\n"),
+			})
+			if err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(delivered, want) {
+					t.Fatalf("reply = %q, want %q", delivered, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(delivered, notWant) {
+					t.Fatalf("reply = %q, want no %q", delivered, notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestReplierEcho_ExecHook(t *testing.T) {
+	dir := t.TempDir()
+	hookPath := filepath.Join(dir, "hook.sh")
+	hook := `#!/bin/sh
+printf '%s' "$SMTP_ECHO_METADATA" > "$0.metadata"
+cat > "$0.stdin"
+case "$(grep '^X-Action:' "$0.stdin" | tr -d '\r')" in
+  "X-Action: skip") exit 1 ;;
+  "X-Action: veto") echo "Not echoed today"; exit 2 ;;
+  "X-Action: reject") echo '{"reject":{"code":451,"enhanced_code":"4.7.0","message":"later"}}' ;;
+  "X-Action: crash") echo "hook exploded" >&2; exit 3 ;;
+  "X-Action: sleep") sleep 5 ;;
+  *) echo '{"subject":"Hooked","body":"from the hook"}' ;;
+esac
+`
+	if err := os.WriteFile(hookPath, []byte(hook), 0o700); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Exec:        &config.ReplyExecConfig{Command: []string{hookPath}, Timeout: time.Second},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered [][]byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		delivered = append(delivered, message)
+		return nil
+	}
+	echo := func(action string) error {
+		return replier.Echo(context.Background(), InboundMessage{
+			ID:           42,
+			EnvelopeFrom: "sender@example.net",
+			Recipients:   []string{"echo+run@example.com"},
+			Tag:          "run",
+			Data:         []byte("From: sender@example.net\r\nSubject: Hello\r\nX-Action: " + action + "\r\n\r\nhi\r\n"),
+		})
+	}
+
+	if err := echo("none"); err != nil || len(delivered) != 1 {
+		t.Fatalf("Echo() error = %v delivered = %d, want one reply", err, len(delivered))
+	}
+	if reply := string(delivered[0]); !strings.Contains(reply, "Subject: Hooked") || !strings.Contains(reply, "from the hook") {
+		t.Fatalf("reply = %q, want hook subject and body", reply)
+	}
+	stdin, err := os.ReadFile(hookPath + ".stdin")
+	if err != nil || !strings.Contains(string(stdin), "X-Action: none\r\n\r\nhi") {
+		t.Fatalf("hook stdin = %q, %v, want the raw message", stdin, err)
+	}
+	data, err := os.ReadFile(hookPath + ".metadata")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var metadata hookMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("Unmarshal() metadata error = %v", err)
+	}
+	if metadata.ID != 42 || metadata.EnvelopeFrom != "sender@example.net" || metadata.Tag != "run" || metadata.Subject != "Hello" ||
+		!slices.Equal(metadata.Recipients, []string{"echo+run@example.com"}) {
+		t.Fatalf("metadata = %+v, want the message envelope", metadata)
+	}
+
+	if err := echo("skip"); err != nil || len(delivered) != 1 {
+		t.Fatalf("Echo(skip) error = %v delivered = %d, want no reply", err, len(delivered))
+	}
+	var smtpErr *smtp.SMTPError
+	if err := echo("veto"); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Message != "Not echoed today" {
+		t.Fatalf("Echo(veto) error = %v, want 550 with the hook output", err)
+	}
+	if err := echo("reject"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 0}) {
+		t.Fatalf("Echo(reject) error = %v, want 451 4.7.0 from the hook JSON", err)
+	}
+	if err := echo("crash"); err == nil || !strings.Contains(err.Error(), "hook exploded") {
+		t.Fatalf("Echo(crash) error = %v, want the hook stderr", err)
+	}
+
+	cfg.Reply.Exec.Timeout = 100 * time.Millisecond
+	replier, err = NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	if err := echo("sleep"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Echo(sleep) error = %v, want timeout error", err)
+	}
+
+	cfg.Reply.Exec.Timeout = time.Minute
+	replier, err = NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = replier.Echo(ctx, InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte("Subject: Hello\r\nX-Action: sleep\r\n\r\nhi\r\n")})
+	if !errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Echo(sleep) with a cancelled context error = %v, want a cancellation rather than a timeout", err)
+	}
+	if len(delivered) != 1 {
+		t.Fatalf("delivered = %d, want only the first reply", len(delivered))
+	}
+}
+
+func TestReplierEcho_Identities(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	keyPath := t.TempDir() + "/support-dkim.pem"
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	if err := os.WriteFile(keyPath, privateKeyPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			FromName:    "Echo Bot",
+			Identities: map[string]config.ReplyIdentityConfig{
+				"Support@Example.com": {
+					FromAddress: "support@example.com",
+					FromName:    "Support",
+					MailFrom:    "support-bounce@example.com",
+					DKIM:        &config.DKIMConfig{Domain: "example.com", Selector: "support", PrivateKeyPath: keyPath},
+				},
+				"brand.example": {FromAddress: "hello@brand.example"},
+			},
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var deliveredFrom string
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, from string, _ string, message []byte) error {
+		deliveredFrom = from
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	tests := []struct {
+		recipients []string
+		from       string
+		header     string
+		signed     bool
+	}{
+		{[]string{"support@example.com"}, "support-bounce@example.com", `From: "Support" <support@example.com>`, true},
+		{[]string{"other@example.com", "sales@brand.example"}, "bounce@example.com", `From: "Echo Bot" <hello@brand.example>`, false},
+		{[]string{"other@example.com"}, "bounce@example.com", `From: "Echo Bot" <echo@example.com>`, false},
+	}
+	for _, tt := range tests {
+		inbound := "From: sender@example.net\r\nTo: " + tt.recipients[0] + "\r\nSubject: identity\r\n\r\nhello\r\n"
+		if err := replier.Echo(context.Background(), InboundMessage{
+			EnvelopeFrom: "sender@example.net",
+			Recipients:   tt.recipients,
+			Data:         []byte(inbound),
+		}); err != nil {
+			t.Fatalf("Echo(%v) error = %v", tt.recipients, err)
+		}
+		if deliveredFrom != tt.from {
+			t.Fatalf("Echo(%v) mail from = %q, want %q", tt.recipients, deliveredFrom, tt.from)
+		}
+		if !strings.Contains(string(deliveredMessage), tt.header) {
+			t.Fatalf("Echo(%v) reply missing %q:\n%s", tt.recipients, tt.header, deliveredMessage)
+		}
+		if signed := strings.Contains(string(deliveredMessage), "s=support;"); signed != tt.signed {
+			t.Fatalf("Echo(%v) signed with identity key = %t, want %t", tt.recipients, signed, tt.signed)
+		}
+	}
+}
+
+func TestReplierEcho_TLSDiagnostics(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:    "echo@example.com",
+			MailFrom:       "bounce@example.com",
+			TLSDiagnostics: true,
+		},
+	}
+
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	clientCert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "client.example.net"},
+		Issuer:   pkix.Name{CommonName: "Test CA"},
+		NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: tls\r\n\r\nhello\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Data:         []byte(inbound),
+		TLSMode:      config.TLSModeStartTLS,
+		TLS: &tls.ConnectionState{
+			Version:          tls.VersionTLS13,
+			CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+			ServerName:       "mx.example.com",
+			PeerCertificates: []*x509.Certificate{clientCert},
+		},
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	want := `mode=starttls; version=TLSv1.3; cipher=TLS_AES_128_GCM_SHA256; sni=mx.example.com; resumed=no; client-cert="CN=client.example.net"`
+	if got := reader.Header.Get("X-Echo-TLS"); got != want {
+		t.Fatalf("X-Echo-TLS = %q, want %q", got, want)
+	}
+	body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
+	if err != nil {
+		t.Fatalf("readReplyBody() error = %v", err)
+	}
+	for _, want := range []string{"Mode:           STARTTLS", "Version:        TLSv1.3", "Cert issuer:    CN=Test CA", "Cert expires:   2030-01-01T00:00:00Z", "Cert SHA-256:   e3b0c442", "Cert verified:  no"} {
+		if !strings.Contains(body.Plain, want) {
+			t.Fatalf("reply body missing %q, got:\n%s", want, body.Plain)
+		}
+	}
+	if !strings.HasSuffix(strings.TrimSpace(body.Plain), "hello") {
+		t.Fatalf("reply body should end with the echoed body, got:\n%s", body.Plain)
+	}
+
+	deliveredMessage = nil
+	if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	reader, err = mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	if got := reader.Header.Get("X-Echo-TLS"); got != "none" {
+		t.Fatalf("plaintext X-Echo-TLS = %q, want none", got)
+	}
+}
+
+func TestReplierEcho_MaxBodyBytes(t *testing.T) {
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: big\r\n\r\n" + strings.Repeat("é", 40)
+	sum := sha256.Sum256([]byte(strings.Repeat("é", 40)))
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		policy  string
+		want    []string
+		wantErr int
+	}{
+		{config.OversizeTruncate, []string{strings.Repeat("é", 5) + "\r\n\r\n[Truncated to 11 bytes]", "Original body size: 80 bytes", digest}, 0},
+		{config.OversizeSummarize, []string{"larger than the 11 byte echo limit", "Original body SHA-256: " + digest}, 0},
+		{config.OversizeReject, nil, 552},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress:    "echo@example.com",
+					MailFrom:       "bounce@example.com",
+					MaxBodyBytes:   11,
+					OversizePolicy: tt.policy,
+				},
+			}
+			replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+			var deliveredMessage []byte
+			replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+				deliveredMessage = append([]byte(nil), message...)
+				return nil
+			}
+
+			err = replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)})
+			if tt.wantErr != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantErr || deliveredMessage != nil {
+					t.Fatalf("Echo() error = %v, want %d and no reply", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+			reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+			if err != nil {
+				t.Fatalf("CreateReader() error = %v", err)
+			}
+			body, err := readReplyBody(reader, InboundMessage{Data: deliveredMessage}, "")
+			if err != nil {
+				t.Fatalf("readReplyBody() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body.Plain, want) {
+					t.Fatalf("reply body missing %q, got:\n%s", want, body.Plain)
+				}
+			}
+		})
+	}
+}
+
+func TestReplierEcho_ChecksumHeaders(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:     "echo@example.com",
+			MailFrom:        "bounce@example.com",
+			Checksums:       true,
+			ChecksumDetails: true,
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := strings.Join([]string{
+		"From: sender@example.net",
+		"To: echo@example.com",
+		"Subject: checksums",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"hello",
+		"--b",
+		"Content-Type: application/octet-stream",
+		"Content-Transfer-Encoding: base64",
+		"Content-Disposition: attachment; filename=data.bin",
+		"",
+		"AAECAw==",
+		"--b--",
+		"",
+	}, "\r\n")
+	if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	checksum := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	got := reader.Header.Values("X-Echo-Checksum")
+	want := []string{
+		"part=message; sha256=" + checksum([]byte(inbound)) + fmt.Sprintf("; size=%d; type=multipart/mixed", len(inbound)),
+		"part=1; sha256=" + checksum([]byte("hello")) + "; size=5; type=text/plain",
+		"part=2; sha256=" + checksum([]byte{0, 1, 2, 3}) + "; size=4; type=application/octet-stream",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("X-Echo-Checksum = %q, want %q", got, want)
+	}
+}
+
+func TestReplierEcho_TraceIDHeader(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	ctx, span := tracer.Start(context.Background(), "smtp.message")
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: trace\r\n\r\nhello\r\n"
+	if err := replier.Echo(ctx, InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	span.End()
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	if got, want := reader.Header.Get("X-Echo-Trace-Id"), span.SpanContext().TraceID().String(); got != want {
+		t.Fatalf("X-Echo-Trace-Id = %q, want %q", got, want)
+	}
+
+	ended := map[string]bool{}
+	for _, recorded := range recorder.Ended() {
+		if recorded.SpanContext().TraceID() != span.SpanContext().TraceID() {
+			t.Fatalf("span %q trace = %s, want %s", recorded.Name(), recorded.SpanContext().TraceID(), span.SpanContext().TraceID())
+		}
+		ended[recorded.Name()] = true
+	}
+	for _, name := range []string{"echo.parse", "echo.build", "echo.deliver"} {
+		if !ended[name] {
+			t.Fatalf("span %q not recorded, got %v", name, ended)
+		}
+	}
+}
+
+func TestReplier_ReplyTooLarge(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:     "echo@example.com",
+			MailFrom:        "bounce@example.com",
+			TooLargeSummary: true,
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var deliveredTo string
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+		deliveredTo = to
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	head := "Subject: quarterly export\r\nMessage-ID: <export@example.net>\r\n\r\nfirst bytes of a huge bo"
+	msg := InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Data: []byte(head)}
+	if err := replier.replyTooLarge(context.Background(), msg, 1024); err != nil {
+		t.Fatalf("replyTooLarge() error = %v", err)
+	}
+	if deliveredTo != "sender@example.net" {
+		t.Fatalf("reply delivered to %q, want envelope sender", deliveredTo)
+	}
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	if got := reader.Header.Get("Subject"); got != "Your message was too large" {
+		t.Fatalf("Subject = %q, want too large subject", got)
+	}
+	if got := reader.Header.Get("In-Reply-To"); got != "<export@example.net>" {
+		t.Fatalf("In-Reply-To = %q, want original Message-ID", got)
+	}
+	if got := reader.Header.Get("X-Echo-Too-Large"); got != "limit=1024" {
+		t.Fatalf("X-Echo-Too-Large = %q, want limit=1024", got)
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart() error = %v", err)
+	}
+	body, err := io.ReadAll(part.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !strings.Contains(string(body), "1024 byte limit") || !strings.Contains(string(body), "Subject: quarterly export") || strings.Contains(string(body), "huge bo") {
+		t.Fatalf("reply body = %q, want limit and subject without the message body", body)
+	}
+
+	deliveredMessage = nil
+	if err := replier.replyTooLarge(context.Background(), InboundMessage{Data: []byte(head)}, 1024); err != nil || deliveredMessage != nil {
+		t.Fatalf("replyTooLarge() for a null sender = %v, delivered %t, want no reply", err, deliveredMessage != nil)
+	}
+}
+
+func TestReplierEcho_ParseFailurePolicy(t *testing.T) {
+	inbound := "From: sender@example.net\r\nnot a header line\r\n\r\nunparsed body\r\n"
+	tests := []struct {
+		policy    string
+		wantReply bool
+		wantRaw   bool
+	}{
+		{policy: config.ParseFailureReject},
+		{policy: config.ParseFailureDrop},
+		{policy: config.ParseFailureDiagnostic, wantReply: true},
+		{policy: config.ParseFailureRaw, wantReply: true, wantRaw: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress:  "echo@example.com",
+					MailFrom:     "bounce@example.com",
+					ParseFailure: tt.policy,
+				},
+			}
+			replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+			var deliveredMessage []byte
+			replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+				deliveredMessage = append([]byte(nil), message...)
+				return nil
+			}
+
+			err = replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)})
+			if tt.policy == config.ParseFailureReject {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) {
+					t.Fatalf("Echo() error = %v, want SMTP error", err)
+				}
+				if smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 6, 0}) {
+					t.Fatalf("Echo() error = %d %v, want 550 5.6.0", smtpErr.Code, smtpErr.EnhancedCode)
+				}
+				if strings.Contains(smtpErr.Message, "\n") {
+					t.Fatalf("Echo() error message %q contains a newline", smtpErr.Message)
+				}
+			} else if err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+			if !tt.wantReply {
+				if deliveredMessage != nil {
+					t.Fatalf("reply delivered, want none:\n%s", deliveredMessage)
+				}
+				return
+			}
+
+			reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+			if err != nil {
+				t.Fatalf("CreateReader() error = %v", err)
+			}
+			if got := reader.Header.Get("Subject"); got != "Could not parse your message" {
+				t.Fatalf("Subject = %q, want parse failure subject", got)
+			}
+			if got := reader.Header.Get("X-Echo-Parse-Error"); !strings.Contains(got, "malformed MIME header line") {
+				t.Fatalf("X-Echo-Parse-Error = %q, want malformed header error", got)
+			}
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("NextPart() error = %v", err)
+			}
+			body, err := io.ReadAll(part.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !strings.Contains(string(body), "could not be parsed") {
+				t.Fatalf("reply body = %q, want parse diagnostic", body)
+			}
+			if got := strings.Contains(string(body), "unparsed body"); got != tt.wantRaw {
+				t.Fatalf("reply body contains raw message = %t, want %t:\n%s", got, tt.wantRaw, body)
+			}
+		})
+	}
+}
+
+func TestReplierEcho_CCAndBCC(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Mode:        config.ReplyModeEcho,
+			CC:          []string{"QA Inbox <qa@example.com>"},
+			BCC:         []string{"audit@example.com", "archive@example.com"},
+		},
+	}
+
+	messageStore := store.NewMemory()
+	replier, err := NewReplier(cfg, messageStore, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	delivered := map[string][]byte{}
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+		if to == "audit@example.com" {
+			return errors.New("connection refused")
+		}
+		delivered[to] = append([]byte(nil), message...)
+		return nil
+	}
+
+	messageID, err := messageStore.SaveMessage(context.Background(), store.Message{EnvelopeFrom: "sender@example.net"})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: copy me\r\n\r\nhello\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{
+		ID:           messageID,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(inbound),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v, want copy failures ignored", err)
+	}
+
+	for _, to := range []string{"sender@example.net", "qa@example.com", "archive@example.com"} {
+		message, ok := delivered[to]
+		if !ok {
+			t.Fatalf("reply not delivered to %s, delivered = %v", to, delivered)
+		}
+		reader, err := mail.CreateReader(bytes.NewReader(message))
+		if err != nil {
+			t.Fatalf("CreateReader() error = %v", err)
+		}
+		if got := reader.Header.Get("Cc"); !strings.Contains(got, "qa@example.com") {
+			t.Fatalf("Cc = %q, want qa@example.com", got)
+		}
+		if got := reader.Header.Get("Bcc"); got != "" {
+			t.Fatalf("Bcc = %q, want no Bcc header", got)
+		}
+	}
+
+	stored, err := messageStore.GetMessage(context.Background(), messageID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	want := []struct {
+		kind      string
+		recipient string
+		status    string
+	}{
+		{store.ReplyKindEcho, "sender@example.net", store.ReplyStatusDelivered},
+		{store.ReplyKindCC, "qa@example.com", store.ReplyStatusDelivered},
+		{store.ReplyKindBCC, "audit@example.com", store.ReplyStatusFailed},
+		{store.ReplyKindBCC, "archive@example.com", store.ReplyStatusDelivered},
+	}
+	if len(stored.Replies) != len(want) {
+		t.Fatalf("stored replies = %#v, want %d", stored.Replies, len(want))
+	}
+	for i, w := range want {
+		got := stored.Replies[i]
+		if got.Kind != w.kind || got.Recipient != w.recipient || got.Status != w.status {
+			t.Fatalf("reply %d = %s %s %s, want %s %s %s", i, got.Kind, got.Recipient, got.Status, w.kind, w.recipient, w.status)
+		}
+	}
+}
+
+func TestReplierEcho_BodyFilters(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+		},
+		Filters: map[string][]config.FilterConfig{
+			"shout":   {{Type: config.FilterUppercase}, {Type: config.FilterFooter, Text: "-- filtered"}},
+			"reverse": {{Type: config.FilterReverse}},
+			"rot13":   {{Type: config.FilterROT13}},
+			"scrub":   {{Type: config.FilterReplace, Pattern: `\d{4}`, Replacement: "####"}},
+			"quotes":  {{Type: config.FilterStripQuotes}},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  InboundMessage
+		body replyBody
+		want replyBody
+	}{
+		{
+			name: "rule chain",
+			msg:  InboundMessage{Filters: []string{"shout"}},
+			body: replyBody{Plain: "hello\n", HTML: "<p>a &amp; b</p></body>"},
+			want: replyBody{Plain: "HELLO\n\n-- filtered\n", HTML: "<p>A &amp; B</p><p>-- filtered</p></body>"},
+		},
+		{
+			name: "tag",
+			msg:  InboundMessage{Tag: "Reverse"},
+			body: replyBody{Plain: "abc\r\nxyz\r\n"},
+			want: replyBody{Plain: "cba\r\nzyx\r\n"},
+		},
+		{
+			name: "rot13 and replace",
+			msg:  InboundMessage{Filters: []string{"rot13", "scrub"}},
+			body: replyBody{Plain: "Hello 1234"},
+			want: replyBody{Plain: "Uryyb ####"},
+		},
+		{
+			name: "strip quotes",
+			msg:  InboundMessage{Filters: []string{"quotes"}},
+			body: replyBody{Plain: "new text\nOn Mon, Jan 1, 2024, someone wrote:\n> old text\n", HTML: "<p>new</p><blockquote>old</blockquote>"},
+			want: replyBody{Plain: "new text\n", HTML: "<p>new</p>"},
+		},
+		{
+			name: "unknown tag",
+			msg:  InboundMessage{Tag: "run-42"},
+			body: replyBody{Plain: "unchanged"},
+			want: replyBody{Plain: "unchanged"},
+		},
+	}
+	for _, tt := range tests {
+		if got := replier.filterBody(tt.msg, tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: filterBody() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+	inbound := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: filter me\r\n\r\nround trip\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Filters:      []string{"shout"},
+		Data:         []byte(inbound),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if !bytes.Contains(deliveredMessage, []byte("ROUND TRIP")) || !bytes.Contains(deliveredMessage, []byte("-- filtered")) {
+		t.Fatalf("reply missing filtered body, got:\n%s", deliveredMessage)
+	}
+}
+
+func TestReplierEcho_SanitizeHTML(t *testing.T) {
+	html := `<html><head><script>alert(1)</script></head><body>` +
+		`<p onclick="track()">Hello <a href="javascript:alert(1)">link</a></p>` +
+		`<img src="https://tracker.example.net/pixel.gif" width="1" height="1">` +
+		`<img src="data:image/png;base64,iVBORw0KGgo=" alt="inline">` +
+		`</body></html>`
+	tests := []struct {
+		name           string
+		externalImages bool
+	}{
+		{name: "strip external images"},
+		{name: "allow external images", externalImages: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress:  "echo@example.com",
+					MailFrom:     "bounce@example.com",
+					SanitizeHTML: &config.SanitizeHTMLConfig{AllowExternalImages: tt.externalImages},
+				},
+			}
+			replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+
+			got := replier.sanitizer.sanitize(replyBody{Plain: "plain", HTML: html})
+			if got.Plain != "plain" {
+				t.Fatalf("sanitize() plain = %q, want unchanged", got.Plain)
+			}
+			for _, unwanted := range []string{"<script", "alert(1)", "onclick", "javascript:"} {
+				if strings.Contains(got.HTML, unwanted) {
+					t.Fatalf("sanitize() html = %q, want no %q", got.HTML, unwanted)
+				}
+			}
+			if !strings.Contains(got.HTML, "Hello") || !strings.Contains(got.HTML, `alt="inline"`) {
+				t.Fatalf("sanitize() html = %q, want text and inline image kept", got.HTML)
+			}
+			if gotTracker := strings.Contains(got.HTML, "tracker.example.net"); gotTracker != tt.externalImages {
+				t.Fatalf("sanitize() html = %q, external image kept = %t, want %t", got.HTML, gotTracker, tt.externalImages)
+			}
+		})
+	}
+}
+
+func TestReplierEcho_Charsets(t *testing.T) {
+	tests := []struct {
+		name            string
+		charset         string
+		preserve        bool
+		fallback        string
+		multipart       bool
+		wantErr         bool
+		wantReplyParam  string
+		wantOriginalHdr string
+	}{
+		{name: "utf-8 reply", charset: "iso-8859-1", wantReplyParam: "utf-8", wantOriginalHdr: "iso-8859-1"},
+		{name: "preserved", charset: "iso-8859-1", preserve: true, wantReplyParam: "iso-8859-1", wantOriginalHdr: "iso-8859-1"},
+		{name: "unknown rejected", charset: "x-bogus", wantErr: true},
+		{name: "unknown fallback", charset: "x-bogus", fallback: "windows-1252", wantReplyParam: "utf-8", wantOriginalHdr: "x-bogus; decoded-as=windows-1252"},
+		{name: "unknown multipart rejected", charset: "x-bogus", multipart: true, wantErr: true},
+		{name: "unknown multipart fallback", charset: "x-bogus", multipart: true, fallback: "windows-1252", wantReplyParam: "utf-8", wantOriginalHdr: "x-bogus; decoded-as=windows-1252"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress:     "echo@example.com",
+					MailFrom:        "bounce@example.com",
+					PreserveCharset: tt.preserve,
+					FallbackCharset: tt.fallback,
+				},
+			}
+			replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+			var deliveredMessage []byte
+			replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+				deliveredMessage = append([]byte(nil), message...)
+				return nil
+			}
+
+			inbound := "From: sender@example.net\r\nSubject: charset\r\nMIME-Version: 1.0\r\n" +
+				"Content-Type: text/plain; charset=" + tt.charset + "\r\n\r\ncaf\xe9\r\n"
+			if tt.multipart {
+				inbound = "From: sender@example.net\r\nSubject: charset\r\nMIME-Version: 1.0\r\n" +
+					"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n" +
+					"Content-Type: text/plain; charset=" + tt.charset + "\r\n\r\ncaf\xe9\r\n--b--\r\n"
+			}
+			err = replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)})
+			if tt.wantErr {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+					t.Fatalf("Echo() error = %v, want 550 parse failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+
+			reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+			if err != nil {
+				t.Fatalf("CreateReader() error = %v", err)
+			}
+			if got := reader.Header.Get("X-Echo-Original-Charset"); got != tt.wantOriginalHdr {
+				t.Fatalf("X-Echo-Original-Charset = %q, want %q", got, tt.wantOriginalHdr)
+			}
+			if _, params, _ := reader.Header.ContentType(); params["charset"] != tt.wantReplyParam {
+				t.Fatalf("reply charset = %q, want %q", params["charset"], tt.wantReplyParam)
+			}
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("NextPart() error = %v", err)
+			}
+			body, err := io.ReadAll(part.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !strings.Contains(string(body), "café") {
+				t.Fatalf("reply body = %q, want decoded café", body)
+			}
+		})
+	}
+}
+
+func TestReplierEcho_TransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		html     bool
+		want     string
+	}{
+		{name: "auto ascii", encoding: config.TransferEncodingAuto, body: "hello there", want: "quoted-printable"},
+		{name: "auto mostly non-ascii", encoding: config.TransferEncodingAuto, body: "привет мир", want: "base64"},
+		{name: "quoted-printable", encoding: config.TransferEncodingQuotedPrintable, body: "привет мир", want: "quoted-printable"},
+		{name: "base64", encoding: config.TransferEncodingBase64, body: "hello there", want: "base64"},
+		{name: "8bit", encoding: config.TransferEncoding8Bit, body: "café\nline", want: "8bit"},
+		{name: "8bit multipart", encoding: config.TransferEncoding8Bit, body: "café", html: true, want: "8bit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress:      "echo@example.com",
+					MailFrom:         "bounce@example.com",
+					TransferEncoding: tt.encoding,
+				},
+			}
+			replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+			var deliveredMessage []byte
+			replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+				deliveredMessage = append([]byte(nil), message...)
+				return nil
+			}
+
+			inbound := "From: sender@example.net\r\nSubject: encoding\r\nMIME-Version: 1.0\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n\r\n" + tt.body + "\r\n"
+			if tt.html {
+				inbound = "From: sender@example.net\r\nSubject: encoding\r\nMIME-Version: 1.0\r\n" +
+					"Content-Type: text/html; charset=utf-8\r\n\r\n<p>" + tt.body + "</p>\r\n"
+			}
+			if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+			if strings.Contains(string(deliveredMessage), "\r\r") || strings.Contains(strings.ReplaceAll(string(deliveredMessage), "\r\n", ""), "\n") {
+				t.Fatalf("reply = %q, want CRLF line endings only", deliveredMessage)
+			}
+
+			reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+			if err != nil {
+				t.Fatalf("CreateReader() error = %v", err)
+			}
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("NextPart() error = %v", err)
+				}
+				body, err := io.ReadAll(part.Body)
+				if err != nil {
+					t.Fatalf("ReadAll() error = %v", err)
+				}
+				if !strings.Contains(string(body), strings.SplitN(tt.body, "\n", 2)[0]) {
+					t.Fatalf("reply body = %q, want %q", body, tt.body)
+				}
+			}
+			if !strings.Contains(string(deliveredMessage), "Content-Transfer-Encoding: "+tt.want) {
+				t.Fatalf("reply = %q, want Content-Transfer-Encoding %s", deliveredMessage, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplierEcho_InlineImages(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:  "echo@example.com",
+			MailFrom:     "bounce@example.com",
+			SanitizeHTML: &config.SanitizeHTMLConfig{},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var deliveredMessage []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		deliveredMessage = append([]byte(nil), message...)
+		return nil
+	}
+
+	inbound := "From: sender@example.net\r\nSubject: logo\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; type=\"text/html\"; boundary=r\r\n\r\n" +
+		"--r\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p><img src=\"cid:logo@sender.example.net\"><img src=\"cid:logo@sender.example.net\"></p>\r\n" +
+		"--r\r\nContent-Type: image/png; name=logo.png\r\nContent-ID: <logo@sender.example.net>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\niVBORw0KGgo=\r\n" +
+		"--r\r\nContent-Type: image/gif\r\nContent-ID: <unused@sender.example.net>\r\n\r\nGIF89a\r\n--r--\r\n"
+	if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte(inbound)}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	reader, err := mail.CreateReader(bytes.NewReader(deliveredMessage))
+	if err != nil {
+		t.Fatalf("CreateReader() error = %v", err)
+	}
+	var html string
+	var images []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		switch mediaType := normalizeMediaType(part.Header.Get("Content-Type")); {
+		case mediaType == "text/html":
+			html = string(body)
+		case strings.HasPrefix(mediaType, "image/"):
+			if string(body) != "\x89PNG\r\n\x1a\n" {
+				t.Fatalf("inline image = %q, want decoded png signature", body)
+			}
+			images = append(images, inlineContentID(part.Header.Get("Content-Id")))
+		}
+	}
+	if len(images) != 1 || images[0] == "logo@sender.example.net" || !strings.HasSuffix(images[0], "@echo.example.com") {
+		t.Fatalf("inline Content-IDs = %v, want one regenerated id", images)
+	}
+	if strings.Count(html, "cid:"+images[0]) != 2 || strings.Contains(html, "sender.example.net") {
+		t.Fatalf("reply html = %q, want references rewritten to %s", html, images[0])
+	}
+	if !strings.Contains(string(deliveredMessage), "multipart/related") {
+		t.Fatalf("reply = %q, want multipart/related", deliveredMessage)
+	}
+}
+
+func TestReplierEcho_Digest(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Digest:      &config.DigestConfig{Window: time.Hour, MaxMessages: 3},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var mu sync.Mutex
+	delivered := map[string][]string{}
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[to] = append(delivered[to], string(message))
+		return nil
+	}
+	echo := func(sender string, subject string) {
+		t.Helper()
+		data := "From: " + sender + "\r\nSubject: " + subject + "\r\n\r\nbody of " + subject + "\r\n"
+		if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: sender, Data: []byte(data)}); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+	}
+
+	echo("first@example.net", "one")
+	echo("second@example.net", "solo")
+	echo("first@example.net", "two")
+	if len(delivered) != 0 {
+		t.Fatalf("delivered = %v, want replies held until the batch is full", delivered)
+	}
+	echo("first@example.net", "three")
+	if len(delivered["first@example.net"]) != 1 {
+		t.Fatalf("first sender replies = %d, want one digest after max_messages", len(delivered["first@example.net"]))
+	}
+	digest := delivered["first@example.net"][0]
+	for _, want := range []string{"Subject: Echo digest: 3 messages", "one", "two", "three", "Body SHA-256"} {
+		if !strings.Contains(digest, want) {
+			t.Fatalf("digest = %q, want %q", digest, want)
+		}
+	}
+
+	if err := replier.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(delivered["second@example.net"]) != 1 || !strings.Contains(delivered["second@example.net"][0], "Echo digest: 1 message\r\n") {
+		t.Fatalf("second sender replies = %v, want pending digest flushed on Close", delivered["second@example.net"])
+	}
+
+	cfg.Reply.Digest = &config.DigestConfig{Window: 20 * time.Millisecond}
+	replier, err = NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	done := make(chan string, 1)
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		done <- string(message)
+		return nil
+	}
+	echo("third@example.net", "timed")
+	select {
+	case message := <-done:
+		if !strings.Contains(message, "timed") {
+			t.Fatalf("digest = %q, want timed message listed", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("digest was not sent after the window elapsed")
+	}
+}
+
+func TestBackend_ReloadKeepsPendingDigests(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Digest:      &config.DigestConfig{Window: time.Hour, MaxMessages: 10},
+		},
+	}
+	var mu sync.Mutex
+	delivered := map[string][]string{}
+	newReplier := func() *Replier {
+		replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("NewReplier() error = %v", err)
+		}
+		replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[to] = append(delivered[to], string(message))
+			return nil
+		}
+		return replier
+	}
+	backend := NewBackend(cfg, newReplier(), nil, log.New(io.Discard, "", 0))
+	echo := func(subject string) {
+		t.Helper()
+		pipeline, release := backend.acquire()
+		defer release()
+		data := "From: sender@example.net\r\nSubject: " + subject + "\r\n\r\nbody\r\n"
+		if err := pipeline.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Data: []byte(data)}); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+	}
+
+	echo("before reload")
+	cfg.Reply.Digest = &config.DigestConfig{Window: time.Hour, MaxMessages: 2}
+	backend.Reload(cfg, newReplier())
+	mu.Lock()
+	if len(delivered) != 0 {
+		t.Fatalf("delivered = %v after reload, want the digest kept pending", delivered)
+	}
+	mu.Unlock()
+
+	echo("after reload")
+	mu.Lock()
+	defer mu.Unlock()
+	replies := delivered["sender@example.net"]
+	if len(replies) != 1 || !strings.Contains(replies[0], "Echo digest: 2 messages") || !strings.Contains(replies[0], "before reload") || !strings.Contains(replies[0], "after reload") {
+		t.Fatalf("replies = %q, want one digest with both messages at the reloaded max_messages", replies)
+	}
+}
+
+func TestReplierEcho_Sequence(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+		},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered []string
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		delivered = append(delivered, string(message))
+		return nil
+	}
+
+	for sequence := int64(1); sequence <= 2; sequence++ {
+		data := fmt.Sprintf("From: sender@example.net\r\nMessage-ID: <m%d@example.net>\r\nSubject: seq\r\n\r\nbody\r\n", sequence)
+		if err := replier.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net", Sequence: sequence, Data: []byte(data)}); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+	}
+
+	root := "<" + threadRoot("sender@example.net", "echo.example.com") + ">"
+	for i, reply := range delivered {
+		reader, err := mail.CreateReader(strings.NewReader(reply))
+		if err != nil {
+			t.Fatalf("CreateReader() error = %v", err)
+		}
+		if got := reader.Header.Get("X-Echo-Sequence"); got != fmt.Sprint(i+1) {
+			t.Fatalf("X-Echo-Sequence = %q, want %d", got, i+1)
+		}
+		if got := reader.Header.Get("X-Echo-Thread"); got != root {
+			t.Fatalf("X-Echo-Thread = %q, want %q", got, root)
+		}
+		if got := reader.Header.Get("References"); !strings.HasPrefix(got, root) || !strings.Contains(got, fmt.Sprintf("<m%d@example.net>", i+1)) {
+			t.Fatalf("References = %q, want thread root followed by the original Message-ID", got)
+		}
+	}
+}
+
+func TestReplierDeliver_RetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	responses := []error{}
+	attempts := 0
+	processor := ProcessorFunc(func(context.Context, InboundMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if len(responses) == 0 {
+			return nil
+		}
+		err := responses[0]
+		responses = responses[1:]
+		return err
+	})
+	_, addr := startTestServer(t, config.Config{}, processor)
+	deliver := func(retry config.RetryConfig, queued ...error) (int, error) {
+		t.Helper()
+		mu.Lock()
+		responses, attempts = queued, 0
+		mu.Unlock()
+		cfg := config.Config{
+			Hostname: "echo.example.com",
+			Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+			Delivery: config.DeliveryConfig{
+				TLSPolicy:       config.TLSPolicyNone,
+				DomainOverrides: map[string]string{"test.local": addr},
+				Retry:           &retry,
+			},
+		}
+		replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("NewReplier() error = %v", err)
+		}
+		err = replier.deliverFn(context.Background(), replier.mailFrom, "user@test.local", []byte("Subject: retry\r\n\r\nhello\r\n"))
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts, err
+	}
+
+	tempfail := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "try again"}
+	permfail := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "rejected"}
+	if got, err := deliver(config.RetryConfig{AttemptsPerHost: 3}, tempfail, tempfail); err != nil || got != 3 {
+		t.Fatalf("deliver(tempfail) attempts = %d, error = %v, want success on attempt 3", got, err)
+	}
+	if got, err := deliver(config.RetryConfig{AttemptsPerHost: 3}, permfail); err == nil || got != 1 {
+		t.Fatalf("deliver(permfail) attempts = %d, error = %v, want one attempt", got, err)
+	}
+	if got, err := deliver(config.RetryConfig{AttemptsPerHost: 2, PermanentFailure: config.PermanentFailureRetry}, permfail); err != nil || got != 2 {
+		t.Fatalf("deliver(permfail, retry) attempts = %d, error = %v, want success on attempt 2", got, err)
+	}
+
+	policy := newRetryPolicy(&config.RetryConfig{AttemptsPerHost: 1, SkipFailedHosts: time.Hour, Schedule: []time.Duration{time.Minute, 5 * time.Minute}})
+	policy.recordHost("mx1.example.net", permfail)
+	policy.recordHost("mx2.example.net", tempfail)
+	if got := policy.usableHosts([]string{"mx1.example.net", "mx2.example.net"}); !slices.Equal(got, []string{"mx2.example.net"}) {
+		t.Fatalf("usableHosts() = %v, want the hard-failed host skipped", got)
+	}
+	if got := policy.usableHosts([]string{"mx1.example.net"}); !slices.Equal(got, []string{"mx1.example.net"}) {
+		t.Fatalf("usableHosts() = %v, want all hosts when every host is skipped", got)
+	}
+	if delay, ok := policy.nextDelay(1, tempfail); !ok || delay != 5*time.Minute {
+		t.Fatalf("nextDelay(1, 4xx) = %s, %t, want 5m", delay, ok)
+	}
+	if _, ok := policy.nextDelay(2, tempfail); ok {
+		t.Fatal("nextDelay(2, 4xx) ok = true, want schedule exhausted")
+	}
+	if _, ok := policy.nextDelay(0, permfail); ok {
+		t.Fatal("nextDelay(0, 5xx) ok = true, want permanent failures not retried")
+	}
+}
+
+func TestReplierEcho_DeferredDelivery(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com", CC: []string{"qa@example.com"}},
+		Delivery: config.DeliveryConfig{Retry: &config.RetryConfig{Schedule: []time.Duration{time.Minute}}},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered []string
+	replier.deliverFn = func(_ context.Context, _ string, to string, _ []byte) error {
+		delivered = append(delivered, to)
+		if to == "sender@example.net" {
+			return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "try again"}
+		}
+		return nil
+	}
+	msg := InboundMessage{EnvelopeFrom: "sender@example.net", Data: []byte("From: sender@example.net\r\nSubject: retry\r\n\r\nbody\r\n")}
+
+	var deferred *deferredDelivery
+	if err := replier.Echo(context.Background(), msg); !errors.As(err, &deferred) || deferred.delay != time.Minute {
+		t.Fatalf("Echo() error = %v, want delivery deferred by 1m", err)
+	}
+	msg.Attempt = 1
+	if err := replier.Echo(context.Background(), msg); err == nil || errors.As(err, &deferred) {
+		t.Fatalf("Echo(attempt 1) error = %v, want final delivery failure", err)
+	}
+	if want := []string{"sender@example.net", "qa@example.com", "sender@example.net"}; !slices.Equal(delivered, want) {
+		t.Fatalf("deliveries = %v, want %v", delivered, want)
+	}
+}
+
+func TestReplierEcho_InboundBounce(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+	}
+	messageStore := store.NewMemory()
+	replier, err := NewReplier(cfg, messageStore, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	suppressions, err := suppression.Open(config.SuppressionConfig{BounceThreshold: 1})
+	if err != nil {
+		t.Fatalf("suppression.Open() error = %v", err)
+	}
+	replier.UseSuppressions(suppressions)
+	var sent [][]byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		sent = append(sent, message)
+		return nil
+	}
+
+	ctx := context.Background()
+	messageID, err := messageStore.SaveMessage(ctx, store.Message{EnvelopeFrom: "sender@example.net"})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(ctx, InboundMessage{
+		ID:           messageID,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender@example.net\r\nSubject: hello\r\n\r\nbody\r\n"),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies, want 1", len(sent))
+	}
+
+	dsn, err := replier.buildDSN("bounce@example.com", "sender@example.net", time.Now(), sent[0],
+		&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}, "Delivery failed.")
+	if err != nil {
+		t.Fatalf("buildDSN() error = %v", err)
+	}
+	bounceID, err := messageStore.SaveMessage(ctx, store.Message{})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(ctx, InboundMessage{ID: bounceID, Recipients: []string{"bounce@example.com"}, Data: dsn}); err != nil {
+		t.Fatalf("Echo(bounce) error = %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies, want the bounce not echoed", len(sent))
+	}
+
+	stored, err := messageStore.GetMessage(ctx, messageID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if reply := stored.Replies[0]; reply.Status != store.ReplyStatusBounced || reply.StatusCode != "5.1.1" || !strings.Contains(reply.Error, "No such user") {
+		t.Fatalf("reply = %#v, want bounced 5.1.1", reply)
+	}
+	if _, ok := suppressions.Match("sender@example.net"); !ok {
+		t.Fatalf("sender@example.net not suppressed after hard bounce")
+	}
+
+	forged, err := replier.buildDSN("bounce@example.com", "victim@example.org", time.Now(),
+		[]byte("From: echo@example.com\r\nTo: victim@example.org\r\nMessage-ID: <unknown@example.com>\r\n\r\nbody\r\n"),
+		&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}, "Delivery failed.")
+	if err != nil {
+		t.Fatalf("buildDSN() error = %v", err)
+	}
+	if err := replier.Echo(ctx, InboundMessage{Recipients: []string{"bounce@example.com"}, Data: forged}); err != nil {
+		t.Fatalf("Echo(unmatched bounce) error = %v", err)
+	}
+	if _, ok := suppressions.Match("victim@example.org"); ok || len(sent) != 1 {
+		t.Fatalf("unmatched bounce: suppressed = %t, sent = %d, want nothing suppressed or sent", ok, len(sent))
+	}
+
+	if err := replier.Echo(ctx, InboundMessage{
+		Recipients: []string{"bounce+other=example.org@example.com"},
+		Data:       []byte("From: MAILER-DAEMON@example.org\r\nSubject: Undeliverable\r\n\r\nno such user\r\n"),
+	}); err != nil {
+		t.Fatalf("Echo(unsigned verp bounce) error = %v", err)
+	}
+	if _, ok := suppressions.Match("other@example.org"); ok || len(sent) != 1 {
+		t.Fatalf("unsigned verp bounce: suppressed = %t, sent = %d, want nothing suppressed or sent", ok, len(sent))
+	}
+}
+
+func TestReplierEcho_VERPEnvelopeSender(t *testing.T) {
+	for _, tc := range []struct {
+		scheme   string
+		mailFrom string
+	}{
+		{config.VERPSchemeRecipient, "bounce-sender=example.net="},
+		{config.VERPSchemeReplyID, "bounce-r1="},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			cfg := config.Config{
+				Hostname: "echo.example.com",
+				Reply: config.ReplyConfig{
+					FromAddress: "echo@example.com",
+					MailFrom:    "bounce@example.com",
+					VERP:        &config.VERPConfig{Scheme: tc.scheme, Separator: "-", Secret: "0123456789abcdef"},
+				},
+			}
+			messageStore := store.NewMemory()
+			replier, err := NewReplier(cfg, messageStore, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatalf("NewReplier() error = %v", err)
+			}
+			suppressions, err := suppression.Open(config.SuppressionConfig{BounceThreshold: 1})
+			if err != nil {
+				t.Fatalf("suppression.Open() error = %v", err)
+			}
+			replier.UseSuppressions(suppressions)
+			var mailFrom string
+			replier.deliverFn = func(_ context.Context, from string, _ string, _ []byte) error {
+				mailFrom = from
+				return nil
+			}
+
+			ctx := context.Background()
+			messageID, err := messageStore.SaveMessage(ctx, store.Message{EnvelopeFrom: "sender@example.net"})
+			if err != nil {
+				t.Fatalf("SaveMessage() error = %v", err)
+			}
+			if err := replier.Echo(ctx, InboundMessage{
+				ID:           messageID,
+				EnvelopeFrom: "sender@example.net",
+				Data:         []byte("From: sender@example.net\r\nSubject: hello\r\n\r\nbody\r\n"),
+			}); err != nil {
+				t.Fatalf("Echo() error = %v", err)
+			}
+			if !strings.HasPrefix(mailFrom, tc.mailFrom) || len(mailFrom) != len(tc.mailFrom)+verpTagLength+len("@example.com") {
+				t.Fatalf("MAIL FROM = %q, want %q with a tag", mailFrom, tc.mailFrom)
+			}
+
+			forged := strings.Replace(mailFrom, "=", "=x", 1)
+			if strings.HasPrefix(tc.mailFrom, "bounce-r") {
+				forged = "bounce-r2=" + mailFrom[len(tc.mailFrom):]
+			}
+			if decoded, ok := replier.matchBounceAddress([]string{forged}); !ok || decoded != (verpAddress{}) {
+				t.Fatalf("matchBounceAddress(%q) = %+v, %t, want a bounce without a recipient", forged, decoded, ok)
+			}
+
+			if err := replier.Echo(ctx, InboundMessage{
+				Recipients: []string{mailFrom},
+				Data:       []byte("From: MAILER-DAEMON@example.net\r\nSubject: Undeliverable\r\n\r\nmailbox unavailable\r\n"),
+			}); err != nil {
+				t.Fatalf("Echo(bounce) error = %v", err)
+			}
+			stored, err := messageStore.GetMessage(ctx, messageID)
+			if err != nil {
+				t.Fatalf("GetMessage() error = %v", err)
+			}
+			if stored.Replies[0].Status != store.ReplyStatusBounced {
+				t.Fatalf("reply status = %q, want bounced", stored.Replies[0].Status)
+			}
+			if _, ok := suppressions.Match("sender@example.net"); !ok {
+				t.Fatalf("sender@example.net not suppressed after bounce")
+			}
+		})
+	}
+}
+
+func TestDeliveryScheduler_DomainLimitsAndFairness(t *testing.T) {
+	scheduler := newDeliveryScheduler(&config.ConcurrencyConfig{Max: 2, PerDomain: 1})
+	ctx := context.Background()
+
+	granted := make(chan string, 8)
+	acquire := func(name string, recipient string) chan func() {
+		releases := make(chan func(), 1)
+		go func() {
+			release, err := scheduler.acquire(ctx, recipient)
+			if err != nil {
+				t.Errorf("acquire(%s) error = %v", name, err)
+				return
+			}
+			granted <- name
+			releases <- release
+		}()
+		return releases
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-granted:
+			if got != want {
+				t.Fatalf("granted %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-granted:
+			t.Fatalf("granted %q, want it to wait", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	waitPending := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for scheduler.pending() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("pending() = %d, want %d", scheduler.pending(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	slowFirst := acquire("slow-1", "a@slow.example")
+	expect("slow-1")
+	slowSecond := acquire("slow-2", "b@Slow.Example")
+	waitPending(1)
+	expectNone()
+
+	fast := acquire("fast", "c@fast.example")
+	expect("fast")
+	other := acquire("other", "d@other.example")
+	waitPending(2)
+	expectNone()
+
+	(<-fast)()
+	expect("other")
+	(<-slowFirst)()
+	expect("slow-2")
+	(<-slowSecond)()
+	(<-other)()
+	waitPending(0)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	holds := []chan func(){acquire("hold-1", "a@one.example"), acquire("hold-2", "a@two.example")}
+	<-granted
+	<-granted
+	errs := make(chan error, 1)
+	go func() {
+		_, err := scheduler.acquire(cancelled, "a@three.example")
+		errs <- err
+	}()
+	waitPending(1)
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire() error = %v, want context.Canceled", err)
+	}
+	waitPending(0)
+	for _, hold := range holds {
+		(<-hold)()
+	}
+	after := acquire("after", "a@three.example")
+	expect("after")
+	(<-after)()
+}
+
+func TestReplierDeliver_ConcurrencyLimit(t *testing.T) {
+	replier, err := NewReplier(config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Delivery: config.DeliveryConfig{Concurrency: &config.ConcurrencyConfig{Max: 4, PerDomain: 2}},
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	replier.deliverFn = func(context.Context, string, string, []byte) error {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := replier.deliver(context.Background(), "bounce@example.com", fmt.Sprintf("user%d@example.net", i), []byte("reply")); err != nil {
+				t.Errorf("deliver() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Fatalf("peak concurrent deliveries to one domain = %d, want 2", peak)
+	}
+}
+
+func TestReplierEcho_ReplyAll(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:   "echo@example.com",
+			MailFrom:      "bounce@example.com",
+			Mode:          config.ReplyModeReplyAll,
+			CC:            []string{"audit@example.com"},
+			MaxRecipients: 4,
+		},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var mu sync.Mutex
+	delivered := map[string][]byte{}
+	replier.deliverFn = func(_ context.Context, _ string, to string, message []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[to] = message
+		return nil
+	}
+
+	err = replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo+group@example.com"},
+		Data: []byte("From: Sender <sender@example.net>\r\n" +
+			"To: echo+group@example.com, Alice <alice@example.org>, ECHO@example.com\r\n" +
+			"Cc: bob@example.org, audit@example.com, carol@example.org, dave@example.org\r\n" +
+			"Subject: group thread\r\n\r\nhello all\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	want := []string{"alice@example.org", "audit@example.com", "bob@example.org", "carol@example.org", "sender@example.net"}
+	got := slices.Sorted(maps.Keys(delivered))
+	if !slices.Equal(got, want) {
+		t.Fatalf("delivered to %v, want %v", got, want)
+	}
+	reply := string(delivered["sender@example.net"])
+	for _, header := range []string{
+		"To: <sender@example.net>, \"Alice\" <alice@example.org>",
+		"Cc: <audit@example.com>, <bob@example.org>, <carol@example.org>",
+	} {
+		if !strings.Contains(reply, header) {
+			t.Fatalf("reply missing %q:\n%s", header, reply)
+		}
+	}
+	if strings.Contains(reply, "dave@example.org") {
+		t.Fatalf("reply includes dave@example.org over max_recipients:\n%s", reply)
+	}
+	if !strings.Contains(reply, "hello all") {
+		t.Fatalf("reply does not echo the body:\n%s", reply)
+	}
+}
+
+func TestReplierEcho_CustomHeaders(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress:        "echo@example.com",
+			MailFrom:           "bounce@example.com",
+			Headers:            map[string]string{"X-Env": "staging", "X-Echo-Suite": "smoke"},
+			PassthroughHeaders: []string{"X-Test-*", "*-id"},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var reply []byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		reply = message
+		return nil
+	}
+
+	err = replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Data: []byte("From: sender@example.net\r\n" +
+			"Message-ID: <inbound@example.net>\r\n" +
+			"X-Test-Run: 42\r\n" +
+			"X-Test-Case: login\r\n flow\r\n" +
+			"X-Correlation-Id: abc-123\r\n" +
+			"X-Other: not copied\r\n" +
+			"Subject: hi\r\n\r\nbody\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(reply)))
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	for key, want := range map[string]string{
+		"X-Env":            "staging",
+		"X-Echo-Suite":     "smoke",
+		"X-Test-Run":       "42",
+		"X-Test-Case":      "login flow",
+		"X-Correlation-Id": "abc-123",
+		"X-Other":          "",
+	} {
+		if got := header.Get(key); got != want {
+			t.Fatalf("reply %s = %q, want %q", key, got, want)
+		}
+	}
+	if ids := header.Values("Message-Id"); len(ids) != 1 || strings.Contains(ids[0], "inbound@example.net") {
+		t.Fatalf("reply Message-Id = %q, want only the generated id", ids)
+	}
+
+	cfg = config.Default()
+	cfg.Hostname = "echo.example.com"
+	cfg.Reply.FromAddress, cfg.Reply.MailFrom = "echo@example.com", "bounce@example.com"
+	cfg.Reply.Headers = map[string]string{"subject": "override"}
+	if err := cfg.Prepare(); err == nil || !strings.Contains(err.Error(), "reply.headers") {
+		t.Fatalf("Prepare() with a reserved reply header error = %v, want reply.headers error", err)
+	}
+}
+
+func TestReplierEcho_ComplianceHeaders(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply: config.ReplyConfig{
+			FromAddress: "echo@example.com",
+			MailFrom:    "bounce@example.com",
+			Compliance: &config.ComplianceConfig{
+				ListID:            "echo.example.com",
+				UnsubscribeMailto: "unsubscribe@example.com",
+				UnsubscribeURL:    "https://example.com/unsubscribe?r={recipient}",
+				OneClick:          true,
+				FeedbackID:        "smoke:echo:example",
+			},
+		},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	suppressions, err := suppression.Open(config.SuppressionConfig{})
+	if err != nil {
+		t.Fatalf("suppression.Open() error = %v", err)
+	}
+	replier.UseSuppressions(suppressions)
+	var replies [][]byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		replies = append(replies, message)
+		return nil
+	}
+
+	inbound := InboundMessage{
+		EnvelopeFrom: "sender+tag@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender+tag@example.net\r\nSubject: hi\r\n\r\nbody\r\n"),
+	}
+	if err := replier.Echo(context.Background(), inbound); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if len(replies) != 1 {
+		t.Fatalf("replies = %d, want 1", len(replies))
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(replies[0])))
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+	for key, want := range map[string]string{
+		"List-Unsubscribe":      "<mailto:unsubscribe@example.com?subject=unsubscribe>, <https://example.com/unsubscribe?r=sender%2Btag%40example.net>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		"List-Id":               "<echo.example.com>",
+		"Feedback-ID":           "smoke:echo:example",
+	} {
+		if got := header.Get(key); got != want {
+			t.Fatalf("reply %s = %q, want %q", key, got, want)
+		}
+	}
+
+	err = replier.Echo(context.Background(), InboundMessage{
+		EnvelopeFrom: "sender+tag@example.net",
+		Recipients:   []string{"<Unsubscribe@example.com>"},
+		Data:         []byte("From: sender+tag@example.net\r\nSubject: unsubscribe\r\n\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Echo() unsubscribe error = %v", err)
+	}
+	if len(replies) != 1 {
+		t.Fatalf("replies after unsubscribe = %d, want 1", len(replies))
+	}
+	if entry, ok := suppressions.Match("sender+tag@example.net"); !ok || entry.Source != suppression.SourceUnsubscribe {
+		t.Fatalf("Match() = %+v, %t, want unsubscribe suppression", entry, ok)
+	}
+	if err := replier.Echo(context.Background(), inbound); err != nil {
+		t.Fatalf("Echo() after unsubscribe error = %v", err)
+	}
+	if len(replies) != 1 {
+		t.Fatalf("replies after suppression = %d, want 1", len(replies))
+	}
+
+	cfg = config.Default()
+	cfg.Hostname = "echo.example.com"
+	cfg.Reply.FromAddress, cfg.Reply.MailFrom = "echo@example.com", "bounce@example.com"
+	cfg.Reply.Compliance = &config.ComplianceConfig{UnsubscribeURL: "http://example.com/u", OneClick: true}
+	if err := cfg.Prepare(); err == nil || !strings.Contains(err.Error(), "https") {
+		t.Fatalf("Prepare() with one_click over http error = %v, want https error", err)
+	}
+}
+
+func TestReplierEcho_FeedbackReport(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+	}
+	messageStore := store.NewMemory()
+	replier, err := NewReplier(cfg, messageStore, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	suppressions, err := suppression.Open(config.SuppressionConfig{})
+	if err != nil {
+		t.Fatalf("suppression.Open() error = %v", err)
+	}
+	replier.UseSuppressions(suppressions)
+	var sent [][]byte
+	replier.deliverFn = func(_ context.Context, _ string, _ string, message []byte) error {
+		sent = append(sent, message)
+		return nil
+	}
+
+	ctx := context.Background()
+	messageID, err := messageStore.SaveMessage(ctx, store.Message{EnvelopeFrom: "sender@example.net"})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(ctx, InboundMessage{
+		ID:           messageID,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender@example.net\r\nSubject: hello\r\n\r\nbody\r\n"),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies, want 1", len(sent))
+	}
+	replyHeader, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(sent[0])))
+	if err != nil {
+		t.Fatalf("ReadHeader() error = %v", err)
+	}
+
+	report := "From: fbl@isp.example\r\n" +
+		"To: echo@example.com\r\n" +
+		"Subject: FW: hello\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=feedback-report; boundary=\"arf\"\r\n" +
+		"\r\n" +
+		"--arf\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is an email abuse report.\r\n" +
+		"--arf\r\n" +
+		"Content-Type: message/feedback-report\r\n" +
+		"\r\n" +
+		"Feedback-Type: abuse\r\n" +
+		"User-Agent: ISP-FBL/1.0\r\n" +
+		"Version: 1\r\n" +
+		"Source-IP: 192.0.2.1\r\n" +
+		"\r\n" +
+		"--arf\r\n" +
+		"Content-Type: text/rfc822-headers\r\n" +
+		"\r\n" +
+		"From: echo@example.com\r\n" +
+		"To: xxxxxx@example.net\r\n" +
+		"Message-ID: " + replyHeader.Get("Message-Id") + "\r\n" +
+		"\r\n" +
+		"--arf--\r\n"
+	complaintID, err := messageStore.SaveMessage(ctx, store.Message{})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(ctx, InboundMessage{
+		ID:           complaintID,
+		EnvelopeFrom: "fbl@isp.example",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte(report),
+	}); err != nil {
+		t.Fatalf("Echo(report) error = %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies, want the complaint not echoed", len(sent))
+	}
+
+	stored, err := messageStore.GetMessage(ctx, messageID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if reply := stored.Replies[0]; reply.Status != store.ReplyStatusComplained || reply.StatusCode != "abuse" {
+		t.Fatalf("reply = %#v, want complained abuse", reply)
+	}
+	if entry, ok := suppressions.Match("sender@example.net"); !ok || entry.Source != suppression.SourceComplaint {
+		t.Fatalf("Match(sender@example.net) = %+v, %t, want complaint suppression", entry, ok)
+	}
+	if _, ok := suppressions.Match("xxxxxx@example.net"); ok {
+		t.Fatalf("redacted address suppressed, want the matched reply recipient")
+	}
+
+	forged := strings.Replace(report, "Version: 1\r\n", "Version: 1\r\nOriginal-Rcpt-To: rfc822; victim@example.org\r\n", 1)
+	forged = strings.Replace(forged, replyHeader.Get("Message-Id"), "<unknown@example.com>", 1)
+	if err := replier.Echo(ctx, InboundMessage{EnvelopeFrom: "attacker@example.org", Recipients: []string{"echo@example.com"}, Data: []byte(forged)}); err != nil {
+		t.Fatalf("Echo(forged report) error = %v", err)
+	}
+	if _, ok := suppressions.Match("victim@example.org"); ok {
+		t.Fatalf("victim@example.org suppressed by a report that matches no reply")
+	}
+}
+
+func TestReplierEcho_AggregateReport(t *testing.T) {
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Reports:  &config.ReportsConfig{Addresses: []string{"tls-reports@example.com"}},
+	}
+	replier, err := NewReplier(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	collector, err := reports.Open(*cfg.Reports)
+	if err != nil {
+		t.Fatalf("reports.Open() error = %v", err)
+	}
+	replier.UseReports(collector)
+	var sent int
+	replier.deliverFn = func(context.Context, string, string, []byte) error {
+		sent++
+		return nil
+	}
+
+	err = replier.Echo(context.Background(), InboundMessage{
+		ID:           7,
+		EnvelopeFrom: "tlsrpt@mail.example.net",
+		Recipients:   []string{"<TLS-Reports@example.com>"},
+		Data: []byte("From: tlsrpt@mail.example.net\r\n" +
+			"Subject: Report Domain: example.com\r\n" +
+			"Content-Type: application/tlsrpt+json\r\n\r\n" +
+			`{"organization-name":"Example Net","report-id":"r1","policies":[{"policy":{"policy-type":"sts","policy-domain":"example.com"},` +
+			`"summary":{"total-successful-session-count":9,"total-failure-session-count":1},"failure-details":[{"result-type":"validation-failure","failed-session-count":1}]}]}`),
+	})
+	if err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if sent != 0 {
+		t.Fatalf("sent %d replies, want the report not echoed", sent)
+	}
+	stored := collector.List(reports.Query{})
+	if len(stored) != 1 || stored[0].MessageID != 7 || stored[0].OrgName != "Example Net" || stored[0].Failures["validation-failure"] != 1 {
+		t.Fatalf("reports = %+v, want the tls report from message 7", stored)
+	}
+}
+
+func TestReplierEcho_Forward(t *testing.T) {
+	var relayed []InboundMessage
+	var relayedData []string
+	relay := smtp.NewServer(NewBackend(config.Config{Auth: &config.AuthConfig{
+		Required: true,
+		Users:    []config.AuthUser{{Username: "relay", Password: "secret"}},
+	}}, ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		data, err := msg.Bytes()
+		relayed = append(relayed, msg)
+		relayedData = append(relayedData, string(data))
+		return err
+	}), nil, nil))
+	relay.Domain = "relay.example.com"
+	relay.TLSConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "relay.example.com")}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go relay.Serve(listener)
+	t.Cleanup(func() { relay.Close() })
+	relayAddr := listener.Addr().String()
+
+	original := "From: sender@example.net\r\nSubject: hello\r\nMessage-ID: <original@example.net>\r\n\r\nbody\r\n"
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Forward: &config.ForwardConfig{
+			To:        []string{"inbox@example.org"},
+			Mode:      config.ForwardModeOnly,
+			MailFrom:  "forwarder@example.com",
+			Relay:     relayAddr,
+			Username:  "relay",
+			Password:  "secret",
+			TLSPolicy: config.TLSPolicyRequire,
+		},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.outbound.insecureSkipVerify = true
+	var delivered []string
+	replier.deliverFn = func(_ context.Context, from string, to string, _ []byte) error {
+		delivered = append(delivered, from+" -> "+to)
+		return nil
+	}
+	inbound := InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Data: []byte(original)}
+	if err := replier.Echo(context.Background(), inbound); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if len(relayed) != 1 || relayed[0].EnvelopeFrom != "forwarder@example.com" || relayed[0].AuthUser != "relay" ||
+		!slices.Equal(relayed[0].Recipients, []string{"inbox@example.org"}) || relayedData[0] != original {
+		t.Fatalf("relayed messages = %#v %q, want the original forwarded to inbox@example.org", relayed, relayedData)
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("delivered = %v, want no echo in only mode", delivered)
+	}
+
+	cfg.Forward = &config.ForwardConfig{
+		To:        []string{"inbox@example.org"},
+		Mode:      config.ForwardModeCopy,
+		MailFrom:  "bounce@example.com",
+		TLSPolicy: config.TLSPolicyOpportunistic,
+	}
+	replier, err = NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.deliverFn = func(_ context.Context, from string, to string, _ []byte) error {
+		delivered = append(delivered, from+" -> "+to)
+		return nil
+	}
+	if err := replier.Echo(context.Background(), inbound); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	want := []string{"bounce@example.com -> inbox@example.org", "bounce@example.com -> sender@example.net"}
+	if !slices.Equal(delivered, want) {
+		t.Fatalf("delivered = %v, want %v", delivered, want)
+	}
+}
+
+func TestReplierEcho_ForwardAuthRequiresTLS(t *testing.T) {
+	relayed := 0
+	_, relayAddr := startTestServer(t, config.Config{Auth: &config.AuthConfig{
+		AllowInsecure: true,
+		Users:         []config.AuthUser{{Username: "relay", Password: "secret"}},
+	}}, ProcessorFunc(func(context.Context, InboundMessage) error {
+		relayed++
+		return nil
+	}))
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Forward: &config.ForwardConfig{
+			To:        []string{"inbox@example.org"},
+			Mode:      config.ForwardModeOnly,
+			MailFrom:  "forwarder@example.com",
+			Relay:     relayAddr,
+			Username:  "relay",
+			Password:  "secret",
+			TLSPolicy: config.TLSPolicyOpportunistic,
+		},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	inbound := InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Data: []byte("Subject: hello\r\n\r\nbody\r\n")}
+	if err := replier.Echo(context.Background(), inbound); err == nil || !strings.Contains(err.Error(), "relay auth refused without tls") {
+		t.Fatalf("Echo() error = %v, want relay auth refused over plaintext", err)
+	}
+	if relayed != 0 {
+		t.Fatalf("relayed %d messages, want none", relayed)
+	}
+}
+
+func TestReplierEcho_DeliveryModeNone(t *testing.T) {
+	relayed := 0
+	_, relayAddr := startTestServer(t, config.Config{}, ProcessorFunc(func(context.Context, InboundMessage) error {
+		relayed++
+		return nil
+	}))
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Delivery: config.DeliveryConfig{Mode: config.DeliveryModeNone},
+		Forward: &config.ForwardConfig{
+			To:        []string{"inbox@example.org"},
+			Mode:      config.ForwardModeCopy,
+			MailFrom:  "forwarder@example.com",
+			Relay:     relayAddr,
+			TLSPolicy: config.TLSPolicyNone,
+		},
+	}
+	messageStore := store.NewMemory()
+	var logs bytes.Buffer
+	replier, err := NewReplier(cfg, messageStore, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	messageID, err := messageStore.SaveMessage(context.Background(), store.Message{EnvelopeFrom: "sender@example.net"})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if err := replier.Echo(context.Background(), InboundMessage{
+		ID:           messageID,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender@example.net\r\nSubject: hello\r\n\r\nbody\r\n"),
+	}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	if relayed != 0 {
+		t.Fatalf("relayed = %d, want nothing sent to the forward relay", relayed)
+	}
+	stored, err := messageStore.GetMessage(context.Background(), messageID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if len(stored.Replies) != 2 {
+		t.Fatalf("stored replies = %#v, want forward and echo", stored.Replies)
+	}
+	for _, reply := range stored.Replies {
+		if reply.Status != store.ReplyStatusNotSent || !bytes.Contains(reply.Raw, []byte("body")) {
+			t.Fatalf("stored reply = %#v, want a built reply marked not_sent", reply)
+		}
+	}
+	if !strings.Contains(logs.String(), `not sending reply from="bounce@example.com" to="sender@example.net"`) {
+		t.Fatalf("logs = %q, want the discarded reply logged", logs.String())
+	}
+	if !replier.lastDelivery().IsZero() {
+		t.Fatalf("lastDelivery() = %v, want zero when nothing was sent", replier.lastDelivery())
+	}
+}
+
+func TestReplierEcho_DeliveryModeOutput(t *testing.T) {
+	inbound := InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("From: sender@example.net\r\nSubject: hello\r\n\r\nbody\r\n"),
+	}
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Delivery: config.DeliveryConfig{Mode: config.DeliveryModeStdout},
+	}
+
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var output bytes.Buffer
+	replier.output.w = &output
+	if err := replier.Echo(context.Background(), inbound); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("stdout = %q, want one JSON line", output.String())
+	}
+	var record replyRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if record.From != "bounce@example.com" || record.To != "sender@example.net" || record.Size != len(record.Message) ||
+		!strings.Contains(record.Message, "Subject: Re: hello") || record.Time.IsZero() {
+		t.Fatalf("record = %+v, want the reply with its envelope", record)
+	}
+	if replier.lastDelivery().IsZero() {
+		t.Fatal("lastDelivery() is zero, want the written reply counted")
+	}
+
+	cfg.Delivery = config.DeliveryConfig{Mode: config.DeliveryModeFile, OutputDir: filepath.Join(t.TempDir(), "replies")}
+	replier, err = NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	for range 2 {
+		if err := replier.Echo(context.Background(), inbound); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+	}
+	files, err := os.ReadDir(cfg.Delivery.OutputDir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("output dir has %d files, want one per reply", len(files))
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(cfg.Delivery.OutputDir, file.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if !strings.HasSuffix(file.Name(), ".eml") ||
+			!bytes.HasPrefix(data, []byte("Return-Path: <bounce@example.com>\r\nDelivered-To: sender@example.net\r\n")) ||
+			!bytes.Contains(data, []byte("Subject: Re: hello")) {
+			t.Fatalf("reply file %s = %q, want the reply with envelope headers", file.Name(), data)
+		}
+	}
+}
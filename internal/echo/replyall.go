@@ -0,0 +1,71 @@
+package echo
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+type replyAllRecipients struct {
+	to     []*mail.Address
+	cc     []*mail.Address
+	copies []replyCopy
+}
+
+func (r *Replier) replyAllRecipients(msg InboundMessage, header mail.Header, recipient string) replyAllRecipients {
+	var result replyAllRecipients
+	if r.mode != config.ReplyModeReplyAll {
+		return result
+	}
+
+	seen := map[string]bool{strings.ToLower(recipient): true}
+	for _, address := range r.bounceAddresses() {
+		seen[strings.ToLower(address)] = true
+	}
+	seen[strings.ToLower(r.fromAddress)] = true
+	for _, identity := range r.identities {
+		seen[strings.ToLower(identity.fromAddress)] = true
+	}
+	for _, address := range msg.Recipients {
+		seen[strings.ToLower(normalizeRecipientAddress(address))] = true
+	}
+	for _, replyCopy := range r.copies {
+		seen[strings.ToLower(replyCopy.address)] = true
+	}
+
+	dropped := 0
+	add := func(list *[]*mail.Address, keys ...string) {
+		for _, key := range keys {
+			addresses, err := header.AddressList(key)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				normalized := strings.ToLower(address.Address)
+				if normalized == "" || seen[normalized] {
+					continue
+				}
+				seen[normalized] = true
+				if r.suppressed(address.Address) {
+					continue
+				}
+				if r.maxRecipients > 0 && 1+len(result.copies) >= r.maxRecipients {
+					dropped++
+					continue
+				}
+				*list = append(*list, address)
+				result.copies = append(result.copies, replyCopy{kind: store.ReplyKindReplyAll, address: address.Address})
+			}
+		}
+	}
+	add(&result.to, "Reply-To", "From", "To")
+	add(&result.cc, "Cc")
+
+	if dropped > 0 && r.logger != nil {
+		r.logger.Printf("reply_all message %d: dropped %d recipients over reply.max_recipients=%d", msg.ID, dropped, r.maxRecipients)
+	}
+	return result
+}
@@ -0,0 +1,384 @@
+package echo
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	stdhtml "html"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+func (r *Replier) checkAuthentication(ctx context.Context, msg InboundMessage, header mail.Header) mailauth.Results {
+	input := mailauth.Input{
+		RemoteIP:   remoteIP(msg.RemoteAddr),
+		Helo:       msg.Helo,
+		MailFrom:   msg.EnvelopeFrom,
+		FromDomain: headerFromDomain(header),
+	}
+	if data, err := msg.Open(); err == nil {
+		defer data.Close()
+		input.Message = data
+	}
+	return mailauth.Check(ctx, r.resolver, input)
+}
+
+func (r *Replier) Authenticate(ctx context.Context, msg InboundMessage) mailauth.Results {
+	header := mail.Header{}
+	if data, err := msg.Open(); err == nil {
+		if reader, err := mail.CreateReader(data); err == nil {
+			header = reader.Header
+		}
+		data.Close()
+	}
+	return r.checkAuthentication(ctx, msg, header)
+}
+
+func (r *Replier) buildReport(msg InboundMessage, header mail.Header, results mailauth.Results) replyBody {
+	var report strings.Builder
+
+	report.WriteString("SMTP Echo diagnostic report\n")
+
+	writeReportSection(&report, "Envelope")
+	writeReportField(&report, "MAIL FROM", displayOrNone(msg.EnvelopeFrom))
+	for _, recipient := range msg.Recipients {
+		writeReportField(&report, "RCPT TO", recipient)
+	}
+	if msg.Tag != "" {
+		writeReportField(&report, "Tag", msg.Tag)
+	}
+	if msg.Sequence > 0 {
+		writeReportField(&report, "Sequence", fmt.Sprintf("%d", msg.Sequence))
+	}
+	if msg.RemoteAddr != nil {
+		writeReportField(&report, "Client address", msg.RemoteAddr.String())
+	}
+	if msg.ForwardedBy != nil {
+		writeReportField(&report, "Forwarded by", msg.ForwardedBy.String())
+	}
+	if msg.LocalAddr != nil {
+		writeReportField(&report, "Server address", msg.LocalAddr.String())
+	}
+	writeReportField(&report, "HELO/EHLO", displayOrNone(msg.Helo))
+	if msg.HeloCheck != nil {
+		writeReportField(&report, "HELO check", formatHeloCheck(msg.HeloCheck))
+	}
+	if !msg.ConnectedAt.IsZero() {
+		writeReportField(&report, "Connected at", msg.ConnectedAt.Format(time.RFC3339))
+	}
+	if !msg.ReceivedAt.IsZero() {
+		writeReportField(&report, "Received at", msg.ReceivedAt.Format(time.RFC3339))
+	}
+
+	if !msg.DSN.empty() {
+		writeReportSection(&report, "DSN parameters")
+		writeReportField(&report, "RET", displayOrNone(msg.DSN.Return))
+		writeReportField(&report, "ENVID", displayOrNone(msg.DSN.EnvelopeID))
+		for _, params := range msg.DSN.Recipients {
+			writeReportField(&report, "Recipient", formatRecipientDSN(params))
+		}
+	}
+
+	writeReportSection(&report, "Connection")
+	writeReportField(&report, "TLS", describeTLS(msg.TLS))
+	writeReportField(&report, "Authenticated", displayOrNone(msg.AuthUser))
+	if msg.RDNS != nil {
+		writeReportField(&report, "Reverse DNS", formatRDNSResult(msg.RDNS))
+	}
+	writeTLSSection(&report, msg)
+	if len(msg.DNSBL) > 0 {
+		writeReportSection(&report, "DNS blocklists")
+		for _, result := range msg.DNSBL {
+			writeReportField(&report, result.Zone, formatDNSBLResult(result))
+		}
+	}
+
+	writeReportSection(&report, "Message")
+	writeReportField(&report, "Size", fmt.Sprintf("%d bytes", msg.Size()))
+	if digest, err := digestBody(msg); err == nil {
+		writeReportField(&report, "Body size", fmt.Sprintf("%d bytes", digest.size))
+		writeReportField(&report, "Body SHA-256", digest.sha256)
+	}
+	writeReportField(&report, "Body type", displayOrNone(msg.BodyType))
+	writeReportField(&report, "SMTPUTF8", fmt.Sprintf("%t", msg.SMTPUTF8))
+	writeReportField(&report, "Transfer", displayOrNone(msg.Transfer))
+	if subject, err := header.Subject(); err == nil && subject != "" {
+		writeReportField(&report, "Subject", subject)
+	}
+	if messageID, err := header.MessageID(); err == nil && messageID != "" {
+		writeReportField(&report, "Message-ID", "<"+messageID+">")
+	}
+	writeReportField(&report, "From", displayOrNone(header.Get("From")))
+
+	writeReportSection(&report, "Authentication")
+	writeReportField(&report, "SPF", formatAuthResult(results.SPF.Result, results.SPF.Domain, results.SPF.Reason))
+	for _, result := range results.DKIM {
+		writeReportField(&report, "DKIM", formatAuthResult(result.Result, result.Domain, result.Reason))
+	}
+	dmarcDetail := results.DMARC.Reason
+	if results.DMARC.Policy != "" {
+		dmarcDetail = "p=" + results.DMARC.Policy + "; " + dmarcDetail
+	}
+	writeReportField(&report, "DMARC", formatAuthResult(results.DMARC.Result, results.DMARC.Domain, dmarcDetail))
+
+	writeReportSection(&report, "Received headers")
+	received := header.Values("Received")
+	if len(received) == 0 {
+		report.WriteString("  (none)\n")
+	}
+	for i, value := range received {
+		fmt.Fprintf(&report, "  %d. %s\n", i+1, strings.Join(strings.Fields(value), " "))
+	}
+
+	writeReportSection(&report, "MIME structure")
+	for _, line := range describeMIMEStructure(msg) {
+		report.WriteString("  " + line + "\n")
+	}
+
+	return replyBody{Plain: report.String()}
+}
+
+func dsnHeaders(params DSNParams) []headerField {
+	var fields []headerField
+	if params.Return != "" || params.EnvelopeID != "" {
+		var values []string
+		if params.Return != "" {
+			values = append(values, "ret="+params.Return)
+		}
+		if params.EnvelopeID != "" {
+			values = append(values, "envid="+params.EnvelopeID)
+		}
+		fields = append(fields, headerField{"X-Echo-DSN", strings.Join(values, "; ")})
+	}
+	for _, recipient := range params.Recipients {
+		fields = append(fields, headerField{"X-Echo-DSN-Recipient", formatRecipientDSN(recipient)})
+	}
+	return fields
+}
+
+func formatRecipientDSN(params RecipientDSN) string {
+	values := []string{"<" + params.Recipient + ">"}
+	if len(params.Notify) > 0 {
+		values = append(values, "notify="+strings.Join(params.Notify, ","))
+	}
+	if params.OriginalRecipient != "" {
+		values = append(values, "orcpt="+params.OriginalRecipient)
+	}
+	return strings.Join(values, "; ")
+}
+
+func prependHeaderDump(body replyBody, header mail.Header) replyBody {
+	var dump strings.Builder
+	dump.WriteString("Inbound headers\n")
+	dump.WriteString(strings.Repeat("-", len("Inbound headers")) + "\n")
+	fields := header.Fields()
+	for fields.Next() {
+		key := fields.Key()
+		if raw, err := fields.Raw(); err == nil {
+			if name, _, ok := strings.Cut(string(raw), ":"); ok {
+				key = strings.TrimSpace(name)
+			}
+		}
+		fmt.Fprintf(&dump, "%s: %s\n", key, strings.Join(strings.Fields(fields.Value()), " "))
+	}
+
+	body.Plain = dump.String() + "\n" + body.Plain
+	if body.HTML != "" {
+		body.HTML = "<pre>" + stdhtml.EscapeString(dump.String()) + "</pre>\n<hr>\n" + body.HTML
+	}
+	return body
+}
+
+func formatReceived(msg InboundMessage, hostname string) string {
+	var received strings.Builder
+	received.WriteString("from " + displayOrUnknown(msg.Helo))
+	if ip := remoteIP(msg.RemoteAddr); ip != nil {
+		received.WriteString(" ([" + ip.String() + "])")
+	}
+	received.WriteString(" by " + displayOrUnknown(hostname) + " (smtp-echo)")
+
+	protocol := "ESMTP"
+	if msg.SMTPUTF8 {
+		protocol = "UTF8SMTP"
+	}
+	if msg.TLS != nil {
+		protocol += "S"
+	}
+	if msg.AuthUser != "" {
+		protocol += "A"
+	}
+	received.WriteString(" with " + protocol)
+	if msg.TLS != nil {
+		fmt.Fprintf(&received, " (%s %s)", tls.VersionName(msg.TLS.Version), tls.CipherSuiteName(msg.TLS.CipherSuite))
+	}
+	if msg.ID != 0 {
+		fmt.Fprintf(&received, " id %d", msg.ID)
+	}
+	if len(msg.Recipients) == 1 {
+		received.WriteString(" for <" + msg.Recipients[0] + ">")
+	}
+
+	receivedAt := msg.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now().UTC()
+	}
+	received.WriteString("; " + receivedAt.Format(time.RFC1123Z))
+	return received.String()
+}
+
+func displayOrUnknown(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "unknown"
+	}
+	return value
+}
+
+func formatDMARCHeader(results mailauth.Results) string {
+	dkimResult := mailauth.ResultNone
+	for _, result := range results.DKIM {
+		if dkimResult == mailauth.ResultNone || result.Result == mailauth.ResultPass {
+			dkimResult = result.Result
+		}
+		if result.Result == mailauth.ResultPass {
+			break
+		}
+	}
+
+	fields := []string{"result=" + results.DMARC.Result}
+	if results.DMARC.Domain != "" {
+		fields = append(fields, "domain="+results.DMARC.Domain)
+	}
+	if results.DMARC.Policy != "" {
+		fields = append(fields, "policy="+results.DMARC.Policy)
+	}
+	fields = append(fields,
+		"spf="+results.SPF.Result,
+		"spf-aligned="+yesNo(results.DMARC.SPFAligned),
+		"dkim="+dkimResult,
+		"dkim-aligned="+yesNo(results.DMARC.DKIMAligned),
+	)
+	return strings.Join(fields, "; ")
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func writeReportSection(report *strings.Builder, title string) {
+	report.WriteString("\n" + title + "\n")
+	report.WriteString(strings.Repeat("-", len(title)) + "\n")
+}
+
+func writeReportField(report *strings.Builder, name string, value string) {
+	fmt.Fprintf(report, "  %-15s %s\n", name+":", value)
+}
+
+func displayOrNone(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "(none)"
+	}
+	return value
+}
+
+func formatAuthResult(result string, domain string, reason string) string {
+	formatted := result
+	if domain != "" {
+		formatted += " (" + domain + ")"
+	}
+	if reason != "" {
+		formatted += ": " + reason
+	}
+	return formatted
+}
+
+func describeTLS(state *tls.ConnectionState) string {
+	if state == nil {
+		return "none (plaintext)"
+	}
+	return fmt.Sprintf("%s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch typed := addr.(type) {
+	case *net.TCPAddr:
+		return typed.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func headerFromDomain(header mail.Header) string {
+	addresses, err := header.AddressList("From")
+	if err != nil || len(addresses) == 0 {
+		return ""
+	}
+	domain, err := addressDomain(addresses[0].Address)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
+
+func describeMIMEStructure(msg InboundMessage) []string {
+	data, err := msg.Open()
+	if err != nil {
+		return []string{"(unreadable: " + err.Error() + ")"}
+	}
+	defer data.Close()
+
+	entity, err := message.Read(data)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return []string{"(unparseable: " + err.Error() + ")"}
+	}
+
+	var lines []string
+	walkErr := entity.Walk(func(path []int, part *message.Entity, partErr error) error {
+		mediaType, params, _ := part.Header.ContentType()
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		line := strings.Repeat("  ", len(path)) + mediaType
+		if charset := params["charset"]; charset != "" {
+			line += "; charset=" + charset
+		}
+		if disposition, dispositionParams, err := part.Header.ContentDisposition(); err == nil && disposition != "" {
+			line += " [" + disposition
+			if filename := dispositionParams["filename"]; filename != "" {
+				line += ": " + filename
+			}
+			line += "]"
+		}
+		if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "" {
+			line += " (" + strings.ToLower(encoding) + ")"
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			size, _ := io.Copy(io.Discard, part.Body)
+			line += fmt.Sprintf(" %d bytes", size)
+		}
+		if partErr != nil {
+			line += " (warning: " + partErr.Error() + ")"
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if walkErr != nil {
+		lines = append(lines, "(error: "+walkErr.Error()+")")
+	}
+	return lines
+}
@@ -0,0 +1,65 @@
+package echo
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/reports"
+)
+
+func (r *Replier) UseReports(collector *reports.Collector) {
+	r.reports = collector
+}
+
+func reportAddresses(cfg *config.ReportsConfig) []string {
+	if cfg == nil {
+		return nil
+	}
+	addresses := make([]string, 0, len(cfg.Addresses))
+	for _, address := range cfg.Addresses {
+		addresses = append(addresses, strings.ToLower(normalizeRecipientAddress(address)))
+	}
+	return addresses
+}
+
+func (r *Replier) isReportAddress(recipients []string) bool {
+	for _, recipient := range recipients {
+		if slices.Contains(r.reportAddresses, strings.ToLower(normalizeRecipientAddress(recipient))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replier) handleAggregateReport(msg InboundMessage) error {
+	if r.reports == nil {
+		if r.logger != nil {
+			r.logger.Printf("aggregate report message_id=%d from=%q ignored: reports are not enabled", msg.ID, msg.EnvelopeFrom)
+		}
+		return nil
+	}
+	data, err := msg.Open()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	parsed, err := reports.Parse(data)
+	if err != nil && r.logger != nil {
+		r.logger.Printf("parse aggregate report message_id=%d from=%q: %v", msg.ID, msg.EnvelopeFrom, err)
+	}
+	for _, report := range parsed {
+		report.MessageID = msg.ID
+		report.From = msg.EnvelopeFrom
+		added, err := r.reports.Add(report)
+		if err != nil {
+			return err
+		}
+		if r.logger != nil {
+			r.logger.Printf("aggregate report id=%d kind=%s org=%q domain=%q total=%d failed=%d",
+				added.ID, added.Kind, added.OrgName, added.Domain, added.Total, added.Failed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package echo
+
+import (
+	"bufio"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+)
+
+var (
+	errReputationTempfail = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Sender reputation too low, try again later",
+	}
+	errReputationBlocked = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender blocked due to poor reputation",
+	}
+)
+
+type reputationSubject struct {
+	repType string
+	value   string
+}
+
+func (b *Backend) UseReputation(tracker *reputation.Tracker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reputation = tracker
+}
+
+func (b *Backend) reputationTracker() *reputation.Tracker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.reputation
+}
+
+func (s *session) reputationSubjects(from string) []reputationSubject {
+	var subjects []reputationSubject
+	if ip := s.remoteIP(); ip != nil {
+		subjects = append(subjects, reputationSubject{reputation.TypeIP, ip.String()})
+	}
+	if from != "" {
+		subjects = append(subjects, reputationSubject{reputation.TypeSender, from})
+	}
+	return subjects
+}
+
+func (s *session) checkReputation(from string) error {
+	tracker := s.backend.reputationTracker()
+	if tracker == nil || s.authUser != "" {
+		return nil
+	}
+	var worst reputation.Entry
+	var err error
+	for _, subject := range s.reputationSubjects(from) {
+		entry := tracker.Check(subject.repType, subject.value)
+		switch {
+		case entry.Status == reputation.StatusBlocked:
+			worst, err = entry, errReputationBlocked
+		case entry.Status == reputation.StatusTempfail && err == nil:
+			worst, err = entry, errReputationTempfail
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	s.backend.activity.Record(activity.Entry{
+		RemoteAddr:   addrString(s.remoteAddr()),
+		EnvelopeFrom: from,
+		Status:       activity.StatusPoorReputation,
+		Error:        err.Error(),
+	})
+	s.backend.logf("poor reputation remote=%s from=%q %s=%q score=%d status=%s", addrString(s.remoteAddr()), from, worst.Type, worst.Value, worst.Score, worst.Status)
+	return err
+}
+
+func (s *session) recordReputation(from string, events ...reputation.Event) {
+	tracker := s.backend.reputationTracker()
+	if tracker == nil {
+		return
+	}
+	for _, subject := range s.reputationSubjects(from) {
+		for _, event := range events {
+			entry, changed, err := tracker.Record(s.context(), subject.repType, subject.value, event)
+			if err != nil {
+				s.backend.logf("record reputation %s=%q: %v", subject.repType, subject.value, err)
+				continue
+			}
+			if changed {
+				s.backend.logf("reputation changed %s=%q score=%d status=%s", entry.Type, entry.Value, entry.Score, entry.Status)
+			}
+		}
+	}
+}
+
+func (s *session) recordMessageReputation(msg InboundMessage) {
+	if s.backend.reputationTracker() == nil {
+		return
+	}
+	events := []reputation.Event{reputation.EventMessage}
+	if !headerParses(msg) {
+		events = append(events, reputation.EventParseFailure)
+	}
+	s.recordReputation(msg.EnvelopeFrom, events...)
+}
+
+func headerParses(msg InboundMessage) bool {
+	data, err := msg.Open()
+	if err != nil {
+		return true
+	}
+	defer data.Close()
+	_, err = textproto.ReadHeader(bufio.NewReader(data))
+	return err == nil
+}
@@ -0,0 +1,99 @@
+package echo
+
+import (
+	"errors"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var (
+	errProcessingFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Local error in processing, try again later",
+	}
+	errProcessingTimeout = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Processing timed out, try again later",
+	}
+	errShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, try again later",
+	}
+	errNoRecipients = &smtp.SMTPError{
+		Code:         503,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "At least one recipient is required",
+	}
+	errChunkingDisabled = &smtp.SMTPError{
+		Code:         502,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "BDAT command not implemented",
+	}
+)
+
+var namedResponses = map[string]*smtp.SMTPError{
+	config.ResponseAuthRequired:             errAuthRequired,
+	config.ResponseGreylisted:               errGreylisted,
+	config.ResponseRateLimited:              errRateLimitedSender,
+	config.ResponseServerBusy:               errRateLimitedGlobal,
+	config.ResponseTooManyConnections:       errTooManyConnections,
+	config.ResponseTooManyConnectionsFromIP: errTooManyConnectionsFromIP,
+	config.ResponseTooManyRecipients:        errTooManyRecipients,
+	config.ResponseSenderMalformed:          errSenderSyntax,
+	config.ResponseSenderNoMailHost:         errSenderNoMailHost,
+	config.ResponseSenderNullMX:             errSenderNullMX,
+	config.ResponseSenderUnavailable:        errSenderUnavailable,
+	config.ResponseProcessorUnavailable:     errProcessorUnavailable,
+	config.ResponseProcessingFailed:         errProcessingFailed,
+	config.ResponseProcessingTimeout:        errProcessingTimeout,
+	config.ResponseShuttingDown:             errShuttingDown,
+	config.ResponseClientCertRequired:       errClientCertRequired,
+	config.ResponseRecipientUnknown:         errRecipientUnknown,
+	config.ResponseBacklogFull:              errBacklogFull,
+	config.ResponseMessageTooLarge:          errMessageTooLarge,
+	config.ResponseReputationTempfail:       errReputationTempfail,
+	config.ResponseReputationBlocked:        errReputationBlocked,
+	config.ResponseDNSBLListed:              errDNSBLListed,
+	config.ResponseHeloRejected:             errHeloRejected,
+	config.ResponseRDNSFailed:               errRDNSFailed,
+}
+
+type responseMessages map[*smtp.SMTPError]string
+
+func newResponseMessages(cfg *config.ResponsesConfig) responseMessages {
+	if cfg == nil || len(cfg.Messages) == 0 {
+		return nil
+	}
+	messages := make(responseMessages, len(cfg.Messages))
+	for name, message := range cfg.Messages {
+		if response, ok := namedResponses[name]; ok {
+			messages[response] = message
+		}
+	}
+	return messages
+}
+
+func (b *Backend) respond(err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		if b.logger != nil {
+			b.logger.Printf("smtp command failed: %v", err)
+		}
+		smtpErr = errProcessingFailed
+	}
+	b.mu.RLock()
+	message, ok := b.responses[smtpErr]
+	b.mu.RUnlock()
+	if !ok {
+		return smtpErr
+	}
+	return &smtp.SMTPError{Code: smtpErr.Code, EnhancedCode: smtpErr.EnhancedCode, Message: message}
+}
@@ -0,0 +1,134 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type retryPolicy struct {
+	attemptsPerHost  int
+	attemptDelay     time.Duration
+	schedule         []time.Duration
+	permanentFailure string
+	skipFailedHosts  time.Duration
+
+	mu          sync.Mutex
+	failedHosts map[string]time.Time
+}
+
+type deferredDelivery struct {
+	delay time.Duration
+	err   error
+}
+
+func (e *deferredDelivery) Error() string {
+	return fmt.Sprintf("delivery deferred, retrying in %s: %v", e.delay, e.err)
+}
+
+func (e *deferredDelivery) Unwrap() error {
+	return e.err
+}
+
+func newRetryPolicy(cfg *config.RetryConfig) *retryPolicy {
+	if cfg == nil {
+		return nil
+	}
+	return &retryPolicy{
+		attemptsPerHost:  max(cfg.AttemptsPerHost, 1),
+		attemptDelay:     cfg.AttemptDelay,
+		schedule:         cfg.Schedule,
+		permanentFailure: cfg.PermanentFailure,
+		skipFailedHosts:  cfg.SkipFailedHosts,
+		failedHosts:      make(map[string]time.Time),
+	}
+}
+
+func isPermanentFailure(err error) bool {
+	return strings.HasPrefix(deliveryStatusCode(err), "5.")
+}
+
+func (p *retryPolicy) retriesPermanent() bool {
+	return p != nil && p.permanentFailure == config.PermanentFailureRetry
+}
+
+func (p *retryPolicy) stopAfter(err error) bool {
+	return p != nil && p.permanentFailure == config.PermanentFailureFail && isPermanentFailure(err)
+}
+
+func (p *retryPolicy) nextDelay(attempt int, err error) (time.Duration, bool) {
+	if p == nil || attempt >= len(p.schedule) {
+		return 0, false
+	}
+	if isPermanentFailure(err) && !p.retriesPermanent() {
+		return 0, false
+	}
+	return p.schedule[attempt], true
+}
+
+func (p *retryPolicy) usableHosts(hosts []string) []string {
+	if p == nil || p.skipFailedHosts <= 0 {
+		return hosts
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	usable := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if failedAt, ok := p.failedHosts[host]; ok && now.Sub(failedAt) < p.skipFailedHosts {
+			continue
+		}
+		usable = append(usable, host)
+	}
+	if len(usable) == 0 {
+		return hosts
+	}
+	return usable
+}
+
+func (p *retryPolicy) recordHost(host string, err error) {
+	if p == nil || p.skipFailedHosts <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && isPermanentFailure(err) {
+		p.failedHosts[host] = time.Now()
+		return
+	}
+	delete(p.failedHosts, host)
+}
+
+func (r *Replier) tryHost(ctx context.Context, host string, deliveryErr *deliveryError, send func() error) error {
+	attempts := 1
+	var attemptDelay time.Duration
+	if r.retry != nil {
+		attempts = r.retry.attemptsPerHost
+		attemptDelay = r.retry.attemptDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := send()
+		recordAttempt(ctx, host, err)
+		if err == nil {
+			r.retry.recordHost(host, nil)
+			return nil
+		}
+		deliveryErr.attempts = append(deliveryErr.attempts, deliveryAttempt{host: host, err: err})
+		if attempt >= attempts || (isPermanentFailure(err) && !r.retry.retriesPermanent()) {
+			r.retry.recordHost(host, err)
+			return err
+		}
+
+		timer := time.NewTimer(attemptDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
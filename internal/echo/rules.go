@@ -0,0 +1,339 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+type routingRule struct {
+	pattern      string
+	sender       string
+	subject      *regexp.Regexp
+	minSize      int64
+	maxSize      int64
+	auth         *config.RuleAuthConfig
+	connection   *ruleConnection
+	action       string
+	tag          string
+	forwardTo    []string
+	delay        time.Duration
+	code         int
+	enhancedCode string
+	message      string
+	filters      []string
+}
+
+type ruleConnection struct {
+	networks      []*net.IPNet
+	helo          string
+	tls           *bool
+	authenticated *bool
+}
+
+type bouncer interface {
+	Bounce(ctx context.Context, msg InboundMessage, recipient string, reason error) error
+}
+
+type forwarder interface {
+	Forward(ctx context.Context, msg InboundMessage, recipients []string) error
+}
+
+type authenticator interface {
+	Authenticate(ctx context.Context, msg InboundMessage) mailauth.Results
+}
+
+func newRoutingRules(cfg []config.RuleConfig) []routingRule {
+	rules := make([]routingRule, 0, len(cfg))
+	for _, rule := range cfg {
+		var subject *regexp.Regexp
+		if rule.Subject != "" {
+			subject, _ = regexp.Compile(rule.Subject)
+		}
+		var connection *ruleConnection
+		if rule.Connection != nil {
+			networks, _ := trustedNetworks("connection.remote_ip", rule.Connection.RemoteIP)
+			connection = &ruleConnection{
+				networks:      networks,
+				helo:          strings.ToLower(rule.Connection.Helo),
+				tls:           rule.Connection.TLS,
+				authenticated: rule.Connection.Authenticated,
+			}
+		}
+		rules = append(rules, routingRule{
+			pattern:      addressPattern(rule.Match),
+			sender:       addressPattern(rule.Sender),
+			subject:      subject,
+			minSize:      rule.MinSize,
+			maxSize:      rule.MaxSize,
+			auth:         rule.Auth,
+			connection:   connection,
+			action:       rule.Action,
+			tag:          rule.Tag,
+			forwardTo:    rule.ForwardTo,
+			delay:        rule.Delay,
+			code:         rule.Code,
+			enhancedCode: rule.EnhancedCode,
+			message:      rule.Message,
+			filters:      rule.Filters,
+		})
+	}
+	return rules
+}
+
+func addressPattern(pattern string) string {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "@") {
+		pattern += "*"
+	}
+	return pattern
+}
+
+func matchAddress(pattern string, address string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, strings.ToLower(normalizeRecipientAddress(address)))
+	return ok
+}
+
+func (r routingRule) needsMessage() bool {
+	return r.subject != nil || r.minSize > 0 || r.maxSize > 0 || r.auth != nil
+}
+
+func (r routingRule) matchesEnvelope(sender string, recipient string) bool {
+	if normalizeRecipientAddress(recipient) == "" {
+		return false
+	}
+	return matchAddress(r.pattern, recipient) && matchAddress(r.sender, sender)
+}
+
+func (r routingRule) matchesConnection(msg *InboundMessage) bool {
+	conn := r.connection
+	if conn == nil {
+		return true
+	}
+	if len(conn.networks) > 0 && !networksContain(conn.networks, msg.RemoteAddr) {
+		return false
+	}
+	if conn.helo != "" {
+		if ok, _ := path.Match(conn.helo, strings.ToLower(msg.Helo)); !ok {
+			return false
+		}
+	}
+	if conn.tls != nil && *conn.tls != (msg.TLS != nil) {
+		return false
+	}
+	if conn.authenticated != nil && *conn.authenticated != (msg.AuthUser != "") {
+		return false
+	}
+	return true
+}
+
+func rcptRule(rules []routingRule, conn *InboundMessage, sender string, recipient string) (routingRule, bool) {
+	for _, rule := range rules {
+		if !rule.matchesEnvelope(sender, recipient) || !rule.matchesConnection(conn) {
+			continue
+		}
+		if rule.action == config.RuleActionTag {
+			continue
+		}
+		if rule.needsMessage() {
+			return routingRule{}, false
+		}
+		return rule, true
+	}
+	return routingRule{}, false
+}
+
+func (r routingRule) delayFor(recipient string) time.Duration {
+	if r.delay > 0 {
+		return r.delay
+	}
+	local, _, _ := strings.Cut(strings.ToLower(normalizeRecipientAddress(recipient)), "@")
+	local, _, _ = strings.Cut(local, "+")
+	delay, err := time.ParseDuration(strings.TrimPrefix(local, "delay-"))
+	if err != nil || delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+func (r routingRule) smtpError() *smtp.SMTPError {
+	code := r.code
+	if code == 0 {
+		code = 550
+	}
+	enhanced := smtp.EnhancedCode{5, 1, 1}
+	if code < 500 {
+		enhanced = smtp.EnhancedCode{4, 2, 1}
+	}
+	if parsed, ok := parseEnhancedCode(r.enhancedCode); ok {
+		enhanced = parsed
+	}
+	message := r.message
+	if message == "" {
+		message = "Mailbox does not exist"
+	}
+	return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+}
+
+type ruleFacts struct {
+	ctx     context.Context
+	msg     *InboundMessage
+	base    Processor
+	header  *mail.Header
+	results *mailauth.Results
+}
+
+func (f *ruleFacts) subject() string {
+	if f.header == nil {
+		f.header = &mail.Header{}
+		if data, err := f.msg.Open(); err == nil {
+			header, _ := textproto.ReadHeader(bufio.NewReader(data))
+			data.Close()
+			f.header = &mail.Header{Header: message.Header{Header: header}}
+		}
+	}
+	subject, _ := f.header.Subject()
+	return subject
+}
+
+func (f *ruleFacts) auth() mailauth.Results {
+	if f.results == nil {
+		f.results = &mailauth.Results{}
+		if checker, ok := f.base.(authenticator); ok {
+			*f.results = checker.Authenticate(f.ctx, *f.msg)
+		}
+	}
+	return *f.results
+}
+
+func (r routingRule) matchesMessage(facts *ruleFacts) bool {
+	size := facts.msg.Size()
+	if r.minSize > 0 && size < r.minSize || r.maxSize > 0 && size > r.maxSize {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(facts.subject()) {
+		return false
+	}
+	if r.auth != nil {
+		results := facts.auth()
+		if !matchAuthResult(r.auth.SPF, results.SPF.Result) || !matchAuthResult(r.auth.DKIM, dkimResult(results.DKIM)) || !matchAuthResult(r.auth.DMARC, results.DMARC.Result) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAuthResult(want string, got string) bool {
+	if want == "" {
+		return true
+	}
+	if got == "" {
+		got = mailauth.ResultNone
+	}
+	if negated, ok := strings.CutPrefix(want, "!"); ok {
+		return got != negated
+	}
+	return got == want
+}
+
+func dkimResult(results []mailauth.DKIMResult) string {
+	for _, result := range results {
+		if result.Result == mailauth.ResultPass {
+			return mailauth.ResultPass
+		}
+	}
+	if len(results) == 0 {
+		return mailauth.ResultNone
+	}
+	return results[0].Result
+}
+
+func firstRule(rules []routingRule, facts *ruleFacts) (routingRule, string, bool) {
+	msg := facts.msg
+	for _, recipient := range msg.Recipients {
+		for _, rule := range rules {
+			if !rule.matchesEnvelope(msg.EnvelopeFrom, recipient) || !rule.matchesConnection(msg) || !rule.matchesMessage(facts) {
+				continue
+			}
+			if rule.action == config.RuleActionTag {
+				msg.Tag = rule.tag
+				continue
+			}
+			return rule, recipient, true
+		}
+	}
+	return routingRule{}, "", false
+}
+
+func (b *Backend) ruleStage(next Processor) Processor {
+	rules := b.rules
+	base := b.processor
+	replyDelay := b.replyDelay
+	chaosMode := b.chaos
+	journal := b.journal
+	if len(rules) == 0 && replyDelay.disabled() && !chaosMode.delaysReplies() {
+		return next
+	}
+
+	return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+		delay := replyDelay.next() + chaosMode.nextReplyDelay()
+		if rule, recipient, ok := firstRule(rules, &ruleFacts{ctx: ctx, msg: &msg, base: base}); ok {
+			switch rule.action {
+			case config.RuleActionReject:
+				b.logf("rule rejected message id=%d recipient=%q", msg.ID, recipient)
+				return rule.smtpError()
+			case config.RuleActionDrop:
+				b.logf("rule dropped message id=%d recipient=%q", msg.ID, recipient)
+				return nil
+			case config.RuleActionDelay:
+				delay = rule.delayFor(recipient)
+				msg.Filters = rule.filters
+			case config.RuleActionFilter:
+				msg.Filters = rule.filters
+			case config.RuleActionBounce:
+				if bounce, ok := base.(bouncer); ok {
+					return bounce.Bounce(ctx, msg, recipient, rule.smtpError())
+				}
+			case config.RuleActionForward:
+				if forward, ok := base.(forwarder); ok {
+					return forward.Forward(ctx, msg, rule.forwardTo)
+				}
+			}
+		}
+		if delay <= 0 {
+			return next.Echo(ctx, msg)
+		}
+
+		b.logf("delayed message id=%d delay=%s", msg.ID, delay)
+		msg.retain()
+		entryID := b.journalDelayed(journal, msg, time.Now().Add(delay))
+		origin := trace.SpanContextFromContext(ctx)
+		b.queue.schedule(delay, func() {
+			defer msg.release()
+			b.runDelayed(journal, entryID, msg, origin)
+		})
+		return nil
+	})
+}
+
+func (b *Backend) logf(format string, args ...any) {
+	if b.logger != nil {
+		b.logger.Printf(format, args...)
+	}
+}
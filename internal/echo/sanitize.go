@@ -0,0 +1,37 @@
+package echo
+
+import (
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var externalImagePattern = regexp.MustCompile(`(?i)<img\b[^>]*\bsrc="(?:https?:)?//[^"]*"[^>]*>`)
+
+type htmlSanitizer struct {
+	policy         *bluemonday.Policy
+	externalImages bool
+}
+
+func newHTMLSanitizer(cfg *config.SanitizeHTMLConfig) *htmlSanitizer {
+	if cfg == nil {
+		return nil
+	}
+	policy := bluemonday.UGCPolicy()
+	policy.AllowDataURIImages()
+	policy.AllowURLSchemes("cid")
+	return &htmlSanitizer{policy: policy, externalImages: cfg.AllowExternalImages}
+}
+
+func (s *htmlSanitizer) sanitize(body replyBody) replyBody {
+	if s == nil || body.HTML == "" {
+		return body
+	}
+	body.HTML = s.policy.Sanitize(body.HTML)
+	if !s.externalImages {
+		body.HTML = externalImagePattern.ReplaceAllString(body.HTML, "")
+	}
+	return body
+}
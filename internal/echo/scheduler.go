@@ -0,0 +1,114 @@
+package echo
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type deliveryScheduler struct {
+	max       int
+	perDomain int
+
+	mu      sync.Mutex
+	active  int
+	domains map[string]int
+	waiting []*deliveryWaiter
+}
+
+type deliveryWaiter struct {
+	domain  string
+	ready   chan struct{}
+	granted bool
+}
+
+func newDeliveryScheduler(cfg *config.ConcurrencyConfig) *deliveryScheduler {
+	if cfg == nil {
+		return nil
+	}
+	return &deliveryScheduler{
+		max:       cfg.Max,
+		perDomain: cfg.PerDomain,
+		domains:   make(map[string]int),
+	}
+}
+
+func recipientDomain(recipient string) string {
+	_, domain, _ := strings.Cut(normalizeRecipientAddress(recipient), "@")
+	return strings.ToLower(domain)
+}
+
+func (s *deliveryScheduler) acquire(ctx context.Context, recipient string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	waiter := &deliveryWaiter{domain: recipientDomain(recipient), ready: make(chan struct{})}
+
+	s.mu.Lock()
+	s.waiting = append(s.waiting, waiter)
+	s.dispatch()
+	s.mu.Unlock()
+
+	release := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.active--
+		if s.domains[waiter.domain]--; s.domains[waiter.domain] <= 0 {
+			delete(s.domains, waiter.domain)
+		}
+		s.dispatch()
+	}
+
+	select {
+	case <-waiter.ready:
+		return sync.OnceFunc(release), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		granted := waiter.granted
+		if !granted {
+			for i, queued := range s.waiting {
+				if queued == waiter {
+					s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+					break
+				}
+			}
+			s.dispatch()
+		}
+		s.mu.Unlock()
+		if granted {
+			release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *deliveryScheduler) dispatch() {
+	remaining := s.waiting[:0]
+	for i, waiter := range s.waiting {
+		if s.max > 0 && s.active >= s.max {
+			remaining = append(remaining, s.waiting[i:]...)
+			break
+		}
+		if s.perDomain > 0 && s.domains[waiter.domain] >= s.perDomain {
+			remaining = append(remaining, waiter)
+			continue
+		}
+		s.active++
+		s.domains[waiter.domain]++
+		waiter.granted = true
+		close(waiter.ready)
+	}
+	clear(s.waiting[len(remaining):])
+	s.waiting = remaining
+}
+
+func (s *deliveryScheduler) pending() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
@@ -0,0 +1,172 @@
+package echo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const scriptHandler = "handle"
+
+type replyScript struct {
+	name    string
+	proto   *lua.FunctionProto
+	timeout time.Duration
+}
+
+type scriptResult struct {
+	skip        bool
+	reject      *smtp.SMTPError
+	subject     string
+	body        replyBody
+	replaceBody bool
+}
+
+func loadReplyScript(cfg *config.ReplyScriptConfig) (*replyScript, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	file, err := os.Open(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open reply script: %w", err)
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("parse reply script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("compile reply script: %w", err)
+	}
+	return &replyScript{name: cfg.Path, proto: proto, timeout: cfg.Timeout}, nil
+}
+
+func (s *replyScript) run(ctx context.Context, msg InboundMessage, header mail.Header, original replyBody) (scriptResult, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return scriptResult{}, fmt.Errorf("run reply script %s: %w", s.name, err)
+	}
+	handler, ok := L.GetGlobal(scriptHandler).(*lua.LFunction)
+	if !ok {
+		return scriptResult{}, fmt.Errorf("reply script %s does not define function %s", s.name, scriptHandler)
+	}
+	if err := L.CallByParam(lua.P{Fn: handler, NRet: 1, Protect: true}, scriptMessage(L, msg, header, original)); err != nil {
+		return scriptResult{}, fmt.Errorf("run reply script %s: %w", s.name, err)
+	}
+	returned := L.Get(-1)
+	L.Pop(1)
+
+	table, ok := returned.(*lua.LTable)
+	if !ok {
+		if returned != lua.LNil {
+			return scriptResult{}, fmt.Errorf("reply script %s returned %s, want a table or nil", s.name, returned.Type())
+		}
+		return scriptResult{}, nil
+	}
+	return parseScriptResult(table), nil
+}
+
+func scriptMessage(L *lua.LState, msg InboundMessage, header mail.Header, original replyBody) *lua.LTable {
+	recipients := L.NewTable()
+	for _, recipient := range msg.Recipients {
+		recipients.Append(lua.LString(recipient))
+	}
+
+	headers := L.NewTable()
+	fields := header.Fields()
+	for fields.Next() {
+		key := strings.ToLower(fields.Key())
+		if headers.RawGetString(key) != lua.LNil {
+			continue
+		}
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		headers.RawSetString(key, lua.LString(value))
+	}
+
+	subject, _ := header.Subject()
+	table := L.NewTable()
+	table.RawSetString("envelope_from", lua.LString(msg.EnvelopeFrom))
+	table.RawSetString("recipients", recipients)
+	table.RawSetString("tag", lua.LString(msg.Tag))
+	table.RawSetString("sequence", lua.LNumber(msg.Sequence))
+	table.RawSetString("remote_addr", lua.LString(addrString(msg.RemoteAddr)))
+	table.RawSetString("local_addr", lua.LString(addrString(msg.LocalAddr)))
+	table.RawSetString("helo", lua.LString(msg.Helo))
+	table.RawSetString("auth_user", lua.LString(msg.AuthUser))
+	table.RawSetString("tls", lua.LBool(msg.TLS != nil))
+	table.RawSetString("received_at", lua.LNumber(msg.ReceivedAt.Unix()))
+	table.RawSetString("size", lua.LNumber(msg.Size()))
+	table.RawSetString("subject", lua.LString(subject))
+	table.RawSetString("headers", headers)
+	table.RawSetString("body", lua.LString(original.Plain))
+	table.RawSetString("html", lua.LString(original.HTML))
+	return table
+}
+
+func parseScriptResult(table *lua.LTable) scriptResult {
+	plain, html := table.RawGetString("body"), table.RawGetString("html")
+	result := scriptResult{
+		skip:        lua.LVAsBool(table.RawGetString("skip")),
+		subject:     luaString(table.RawGetString("subject")),
+		body:        replyBody{Plain: luaString(plain), HTML: luaString(html)},
+		replaceBody: plain != lua.LNil || html != lua.LNil,
+	}
+	if plain == lua.LNil {
+		result.body.Plain = htmlToText(result.body.HTML)
+	}
+
+	switch reject := table.RawGetString("reject").(type) {
+	case lua.LString:
+		result.reject = rejectError(0, "", string(reject))
+	case *lua.LTable:
+		code, _ := reject.RawGetString("code").(lua.LNumber)
+		result.reject = rejectError(int(code), luaString(reject.RawGetString("enhanced_code")), luaString(reject.RawGetString("message")))
+	case lua.LBool:
+		if reject {
+			result.reject = rejectError(0, "", "")
+		}
+	}
+	return result
+}
+
+func luaString(value lua.LValue) string {
+	if value == lua.LNil {
+		return ""
+	}
+	return value.String()
+}
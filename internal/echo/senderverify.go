@@ -0,0 +1,239 @@
+package echo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var (
+	errSenderSyntax = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      "Sender address rejected: malformed address",
+	}
+	errSenderNoMailHost = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 8},
+		Message:      "Sender address rejected: domain has no MX or A records",
+	}
+	errSenderNullMX = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 27},
+		Message:      "Sender address rejected: domain does not accept mail",
+	}
+	errSenderUnavailable = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "Sender address verification temporarily unavailable",
+	}
+)
+
+type senderVerifier interface {
+	verifySender(ctx context.Context, address string) error
+}
+
+type senderVerification struct {
+	probe    bool
+	timeout  time.Duration
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	cache    map[string]senderVerdict
+}
+
+type senderVerdict struct {
+	err     error
+	expires time.Time
+}
+
+func newSenderVerification(cfg *config.SenderVerifyConfig) *senderVerification {
+	if cfg == nil {
+		return nil
+	}
+	return &senderVerification{
+		probe:    cfg.Probe,
+		timeout:  cfg.Timeout,
+		cacheTTL: cfg.CacheTTL,
+		cache:    make(map[string]senderVerdict),
+	}
+}
+
+func (v *senderVerification) cached(address string, now time.Time) (senderVerdict, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verdict, ok := v.cache[address]
+	if ok && now.After(verdict.expires) {
+		delete(v.cache, address)
+		return senderVerdict{}, false
+	}
+	return verdict, ok
+}
+
+func (v *senderVerification) remember(address string, err error, now time.Time) {
+	if v.cacheTTL <= 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, verdict := range v.cache {
+		if now.After(verdict.expires) {
+			delete(v.cache, key)
+		}
+	}
+	v.cache[address] = senderVerdict{err: err, expires: now.Add(v.cacheTTL)}
+}
+
+func (b *Backend) senderVerifier() senderVerifier {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	verifier, _ := b.processor.(senderVerifier)
+	return verifier
+}
+
+func (s *session) verifySender(from string) error {
+	verifier := s.backend.senderVerifier()
+	if verifier == nil || from == "" || s.authUser != "" {
+		return nil
+	}
+	err := verifier.verifySender(s.context(), from)
+	if err != nil {
+		s.backend.logf("sender verification failed remote=%s from=%q: %v", addrString(s.remoteAddr()), from, err)
+	}
+	return err
+}
+
+func (r *Replier) verifySender(ctx context.Context, address string) error {
+	if r.senderVerify == nil {
+		return nil
+	}
+
+	key := strings.ToLower(address)
+	now := time.Now()
+	if verdict, ok := r.senderVerify.cached(key, now); ok {
+		return verdict.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.senderVerify.timeout)
+	defer cancel()
+	err := r.checkSender(ctx, address)
+	var smtpErr *smtp.SMTPError
+	if err == nil || errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		r.senderVerify.remember(key, err, now)
+	}
+	return err
+}
+
+func (r *Replier) checkSender(ctx context.Context, address string) error {
+	domain, err := addressDomain(address)
+	if err != nil {
+		return errSenderSyntax
+	}
+
+	if override, ok := matchDomainOverride(r.overrides, domain); ok {
+		if !r.senderVerify.probe {
+			return nil
+		}
+		return r.probeSender(ctx, []string{override.host}, override.port, address)
+	}
+
+	hosts, err := r.senderMailHosts(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if !r.senderVerify.probe {
+		return nil
+	}
+	return r.probeSender(ctx, hosts, "25", address)
+}
+
+func (r *Replier) senderMailHosts(ctx context.Context, domain string) ([]string, error) {
+	mxRecords, err := r.resolver.LookupMX(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return nil, errSenderUnavailable
+	}
+	if len(mxRecords) == 1 && normalizeMXHost(mxRecords[0].Host) == "" {
+		return nil, errSenderNullMX
+	}
+	if len(mxRecords) > 0 {
+		sort.Slice(mxRecords, func(i, j int) bool {
+			return mxRecords[i].Pref < mxRecords[j].Pref
+		})
+		hosts := make([]string, 0, len(mxRecords))
+		for _, mxRecord := range mxRecords {
+			hosts = append(hosts, normalizeMXHost(mxRecord.Host))
+		}
+		return hosts, nil
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return nil, errSenderUnavailable
+	}
+	if len(addrs) == 0 {
+		return nil, errSenderNoMailHost
+	}
+	return []string{domain}, nil
+}
+
+func (r *Replier) probeSender(ctx context.Context, hosts []string, port string, address string) error {
+	for _, host := range hosts {
+		err := r.probeHost(ctx, host, port, address)
+		if err == nil {
+			return nil
+		}
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+				Message:      fmt.Sprintf("Sender address rejected: %s refused <%s>: %s", host, address, smtpErr.Message),
+			}
+		}
+		if r.logger != nil {
+			r.logger.Printf("sender probe host=%q from=%q inconclusive: %v", host, address, err)
+		}
+	}
+	return nil
+}
+
+func (r *Replier) probeHost(ctx context.Context, host string, port string, address string) error {
+	domain, _ := addressDomain(address)
+	dialer := r.dialer.forDomain(domain)
+	conn, err := dialer.dial(ctx, host, port)
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client := smtp.NewClient(conn)
+	defer client.Close()
+	if name := dialer.ehloName(conn, r.ehloName); name != "" {
+		if err := client.Hello(name); err != nil {
+			return fmt.Errorf("helo/ehlo failed: %w", err)
+		}
+	}
+	if err := client.Mail("", nil); err != nil {
+		return fmt.Errorf("mail from failed: %w", err)
+	}
+	if err := client.Rcpt(address, nil); err != nil {
+		return err
+	}
+	client.Quit()
+	return nil
+}
+
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,62 @@
+package echo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type senderSequences struct {
+	mu      sync.Mutex
+	enabled bool
+	counts  map[string]int64
+}
+
+func newSenderSequences(cfg config.ReplyConfig) *senderSequences {
+	sequences := &senderSequences{counts: make(map[string]int64)}
+	sequences.configure(cfg)
+	return sequences
+}
+
+func (s *senderSequences) configure(cfg config.ReplyConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = cfg.Sequence
+}
+
+func (s *senderSequences) next(sender string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return 0
+	}
+	key := strings.ToLower(sender)
+	s.counts[key]++
+	return s.counts[key]
+}
+
+func threadRoot(sender string, hostname string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(sender)))
+	return "thread." + hex.EncodeToString(sum[:8]) + "@" + hostname
+}
+
+func (r *Replier) sequenceHeaders(msg InboundMessage) []headerField {
+	if msg.Sequence == 0 {
+		return nil
+	}
+	return []headerField{
+		{"X-Echo-Sequence", strconv.FormatInt(msg.Sequence, 10)},
+		{"X-Echo-Thread", "<" + threadRoot(msg.EnvelopeFrom, r.hostname) + ">"},
+	}
+}
+
+func (r *Replier) threadReferences(msg InboundMessage, references []string) []string {
+	if msg.Sequence == 0 {
+		return references
+	}
+	return append([]string{threadRoot(msg.EnvelopeFrom, r.hostname)}, references...)
+}
@@ -1,91 +1,696 @@
 package echo
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/greylist"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+	"github.com/danthegoodman1/smtp_echo/internal/queue"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/webhook"
 )
 
 type InboundMessage struct {
+	ID           int64
 	EnvelopeFrom string
 	Recipients   []string
 	Data         []byte
+	RemoteAddr   net.Addr
+	LocalAddr    net.Addr
+	ForwardedBy  net.Addr
+	Tag          string
+	Sequence     int64
+	Attempt      int
+	Filters      []string
+	Helo         string
+	AuthUser     string
+	TLS          *tls.ConnectionState
+	TLSMode      string
+	ReceivedAt   time.Time
+	ConnectedAt  time.Time
+	SMTPUTF8     bool
+	BodyType     string
+	Transfer     string
+	DSN          DSNParams
+	DNSBL        []DNSBLResult
+	HeloCheck    *HeloCheck
+	RDNS         *RDNSResult
+	spool        *spoolFile
+}
+
+const (
+	TransferData = "DATA"
+	TransferBDAT = "BDAT"
+)
+
+type DSNParams struct {
+	Return     string
+	EnvelopeID string
+	Recipients []RecipientDSN
 }
 
-type Processor interface {
-	Echo(ctx context.Context, msg InboundMessage) error
+type RecipientDSN struct {
+	Recipient         string
+	Notify            []string
+	OriginalRecipient string
+}
+
+func (p DSNParams) empty() bool {
+	return p.Return == "" && p.EnvelopeID == "" && len(p.Recipients) == 0
 }
 
 type Backend struct {
+	mu                sync.RWMutex
+	processor         Processor
+	users             *processorUsers
+	middleware        []Middleware
+	limits            rateLimits
+	conns             *connectionLimits
+	recipients        *recipientPolicy
+	sequences         *senderSequences
+	greylist          *greylist.List
+	reputation        *reputation.Tracker
+	dnsbl             *dnsblPolicy
+	resolver          mailauth.Resolver
+	helo              *heloPolicy
+	rdns              *rdnsPolicy
+	dedup             *dedupCache
+	auth              *credentials
+	rules             []routingRule
+	queue             *delayQueue
+	replyDelay        replyDelay
+	spool             spoolConfig
+	tooLargeSummary   bool
+	implicitTLS       map[string]bool
+	chunkingDisabled  map[string]bool
+	requireClientCert bool
+	chaos             *chaos
+	lastDelivery      time.Time
+	activity          *activity.Log
+	store             store.Store
+	archive           *archive.Writer
+	quarantine        *quarantine.Dir
+	journal           *queue.Journal
+	timeout           time.Duration
+	responses         responseMessages
+	ctx               context.Context
+	cancel            context.CancelFunc
+	webhooks          *webhook.Notifier
+	logger            *log.Logger
+}
+
+func NewBackend(cfg config.Config, processor Processor, st store.Store, logger *log.Logger) *Backend {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Backend{
+		processor:         processor,
+		users:             newProcessorUsers(processor, logger),
+		timeout:           cfg.ProcessingTimeout,
+		responses:         newResponseMessages(cfg.Responses),
+		ctx:               ctx,
+		cancel:            cancel,
+		limits:            newRateLimits(cfg.RateLimit),
+		conns:             newConnectionLimits(cfg.Limits),
+		recipients:        newRecipientPolicy(cfg.Recipients),
+		sequences:         newSenderSequences(cfg.Reply),
+		greylist:          newGreylist(cfg.Greylist),
+		dnsbl:             newDNSBLPolicy(cfg.DNSBL),
+		resolver:          newDNSResolver(cfg.DNS),
+		helo:              newHeloPolicy(cfg),
+		rdns:              newRDNSPolicy(cfg.RDNS),
+		dedup:             newDedupCache(cfg.Dedup),
+		auth:              newCredentials(cfg.Auth),
+		rules:             newRoutingRules(cfg.Rules),
+		queue:             &delayQueue{},
+		replyDelay:        newReplyDelay(cfg.Reply),
+		spool:             newSpoolConfig(cfg),
+		tooLargeSummary:   cfg.Reply.TooLargeSummary,
+		implicitTLS:       newImplicitTLS(cfg.Listeners),
+		chunkingDisabled:  newChunkingDisabled(cfg.Listeners),
+		requireClientCert: cfg.TLS != nil && cfg.TLS.ClientAuth == config.ClientAuthRequire,
+		chaos:             newChaos(cfg.Chaos),
+		activity:          activity.NewLog(256),
+		store:             st,
+		webhooks:          webhook.NewNotifier(cfg.Webhooks, logger),
+		logger:            logger,
+	}
+}
+
+func (b *Backend) Activity() *activity.Log {
+	return b.activity
+}
+
+func (b *Backend) Reload(cfg config.Config, processor Processor) {
+	b.mu.Lock()
+	previous := b.users
+	defer previous.retire()
+	defer b.mu.Unlock()
+	if reporter, ok := b.processor.(healthReporter); ok && reporter.lastDelivery().After(b.lastDelivery) {
+		b.lastDelivery = reporter.lastDelivery()
+	}
+	reuseProcessorConn(b.processor, processor)
+	handOffDigests(b.processor, processor)
+	b.processor = processor
+	b.users = newProcessorUsers(processor, b.logger)
+	b.limits = reconfigureRateLimits(b.limits, cfg.RateLimit)
+	b.conns.configure(cfg.Limits)
+	b.recipients = newRecipientPolicy(cfg.Recipients)
+	b.greylist = reconfigureGreylist(b.greylist, cfg.Greylist)
+	b.dnsbl = newDNSBLPolicy(cfg.DNSBL)
+	b.resolver = newDNSResolver(cfg.DNS)
+	b.helo = newHeloPolicy(cfg)
+	b.rdns = newRDNSPolicy(cfg.RDNS)
+	b.dedup = reconfigureDedup(b.dedup, cfg.Dedup)
+	b.auth = newCredentials(cfg.Auth)
+	b.rules = newRoutingRules(cfg.Rules)
+	b.replyDelay = newReplyDelay(cfg.Reply)
+	b.sequences.configure(cfg.Reply)
+	b.spool = newSpoolConfig(cfg)
+	b.tooLargeSummary = cfg.Reply.TooLargeSummary
+	b.implicitTLS = newImplicitTLS(cfg.Listeners)
+	b.chunkingDisabled = newChunkingDisabled(cfg.Listeners)
+	b.requireClientCert = cfg.TLS != nil && cfg.TLS.ClientAuth == config.ClientAuthRequire
+	b.chaos = newChaos(cfg.Chaos)
+	b.timeout = cfg.ProcessingTimeout
+	b.responses = newResponseMessages(cfg.Responses)
+	b.webhooks.Configure(cfg.Webhooks)
+}
+
+func (b *Backend) Drain(ctx context.Context) (int, error) {
+	stop := context.AfterFunc(ctx, b.cancel)
+	defer stop()
+
+	b.queue.flush()
+	if err := b.queue.Wait(ctx); err != nil {
+		return b.queue.Len() + int(b.activity.InFlight()), fmt.Errorf("wait for delayed replies: %w", err)
+	}
+	if err := b.webhooks.Wait(ctx); err != nil {
+		return int(b.activity.InFlight()), fmt.Errorf("wait for pending webhooks: %w", err)
+	}
+
+	b.mu.RLock()
+	users := b.users
+	b.mu.RUnlock()
+	users.retire()
+	return int(b.activity.InFlight()), nil
+}
+
+type processorUsers struct {
 	processor Processor
 	logger    *log.Logger
+	mu        sync.Mutex
+	count     int
+	retired   bool
+	closed    bool
 }
 
-func NewBackend(processor Processor, logger *log.Logger) *Backend {
-	return &Backend{
-		processor: processor,
-		logger:    logger,
+func newProcessorUsers(processor Processor, logger *log.Logger) *processorUsers {
+	return &processorUsers{processor: processor, logger: logger}
+}
+
+func (u *processorUsers) acquire() func() {
+	u.mu.Lock()
+	u.count++
+	u.mu.Unlock()
+	var once sync.Once
+	return func() { once.Do(u.release) }
+}
+
+func (u *processorUsers) release() {
+	u.mu.Lock()
+	u.count--
+	u.mu.Unlock()
+	u.closeIfIdle()
+}
+
+func (u *processorUsers) retire() {
+	u.mu.Lock()
+	u.retired = true
+	u.mu.Unlock()
+	u.closeIfIdle()
+}
+
+func (u *processorUsers) closeIfIdle() {
+	u.mu.Lock()
+	idle := u.retired && u.count == 0 && !u.closed
+	if idle {
+		u.closed = true
+	}
+	u.mu.Unlock()
+	if idle {
+		closeProcessor(u.processor, u.logger)
 	}
 }
 
-func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &session{
-		backend: b,
-	}, nil
+func closeProcessor(processor Processor, logger *log.Logger) {
+	closer, ok := processor.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil && logger != nil {
+		logger.Printf("close processor: %v", err)
+	}
+}
+
+func (b *Backend) Use(middleware ...Middleware) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.middleware = append(b.middleware, middleware...)
+}
+
+func (b *Backend) acquire() (Processor, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stages := append([]Middleware{b.storeStage, b.archiveStage, b.dedupStage, b.ruleStage, b.retryStage, b.webhookStage}, b.middleware...)
+	return Chain(b.processor, stages...), b.users.acquire()
+}
+
+func (b *Backend) currentLimits() rateLimits {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.limits
+}
+
+func (b *Backend) dnsResolver() mailauth.Resolver {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.resolver
+}
+
+func (b *Backend) routingRules() []routingRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rules
+}
+
+func (b *Backend) spoolConfig() spoolConfig {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.spool
+}
+
+func (b *Backend) recipientPolicy() *recipientPolicy {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.recipients
+}
+
+func (b *Backend) greylisting() *greylist.List {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.greylist
+}
+
+func (b *Backend) credentials() *credentials {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.auth
+}
+
+func (b *Backend) NewSession(conn *smtp.Conn) (smtp.Session, error) {
+	s := &session{
+		backend:     b,
+		conn:        conn,
+		connectedAt: time.Now().UTC(),
+	}
+	ip := s.remoteIP()
+	if err := b.conns.acquire(ip); err != nil {
+		if b.logger != nil {
+			b.logger.Printf("connection refused remote=%s: %v", addrString(s.remoteAddr()), err)
+		}
+		return nil, b.respond(err)
+	}
+	s.ctx, s.cancel = context.WithCancel(b.ctx)
+	s.ctx, s.span = tracer.Start(s.ctx, "smtp.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", addrString(s.remoteAddr()))))
+	s.ip = ip
+	s.acquired = true
+
+	idleTimeout, _ := b.conns.sessionLimits()
+	s.startIdleTimer(idleTimeout)
+	return s, nil
 }
 
 type session struct {
 	backend      *Backend
+	conn         *smtp.Conn
+	ip           net.IP
+	connectedAt  time.Time
+	acquired     bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	span         trace.Span
+	idle         *time.Timer
+	idleTimeout  time.Duration
+	authUser     string
+	dnsbl        []DNSBLResult
+	dnsblIP      string
+	helo         *HeloCheck
+	rdns         *RDNSResult
+	rdnsIP       string
 	envelopeFrom string
 	recipients   []string
+	tag          string
+	smtpUTF8     bool
+	bodyType     string
+	dsn          DSNParams
 }
 
 func (s *session) Reset() {
 	s.envelopeFrom = ""
 	s.recipients = s.recipients[:0]
+	s.tag = ""
+	s.smtpUTF8 = false
+	s.bodyType = ""
+	s.dsn = DSNParams{}
 }
 
 func (s *session) Logout() error {
+	s.pauseIdleTimer()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.span != nil {
+		s.span.End()
+	}
+	if s.acquired {
+		s.backend.conns.release(s.ip)
+		s.acquired = false
+	}
 	return nil
 }
 
-func (s *session) Mail(from string, _ *smtp.MailOptions) error {
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return s.backend.respond(s.mail(from, opts))
+}
+
+func (s *session) mail(from string, opts *smtp.MailOptions) error {
+	if creds := s.backend.credentials(); creds != nil && creds.required && s.authUser == "" {
+		return errAuthRequired
+	}
+	if err := s.checkClientCert(); err != nil {
+		return err
+	}
+
+	s.touch()
+	if err := s.injectChaos("MAIL"); err != nil {
+		return err
+	}
+	if err := s.backend.currentLimits().checkMail(s.remoteIP(), from); err != nil {
+		s.recordRateLimited(from, err)
+		return err
+	}
+	if err := s.checkReputation(from); err != nil {
+		return err
+	}
+	if err := s.checkDNSBL(); err != nil {
+		return err
+	}
+	if err := s.checkHelo(); err != nil {
+		return err
+	}
+	if err := s.checkRDNS(); err != nil {
+		return err
+	}
+
+	if err := s.checkBacklog(from); err != nil {
+		return err
+	}
+	if err := s.verifySender(from); err != nil {
+		return err
+	}
+
 	s.envelopeFrom = from
 	s.recipients = s.recipients[:0]
+	s.tag = ""
+	s.smtpUTF8 = false
+	s.bodyType = ""
+	s.dsn = DSNParams{}
+	if opts != nil {
+		s.smtpUTF8 = opts.UTF8
+		s.bodyType = string(opts.Body)
+		s.dsn.Return = string(opts.Return)
+		s.dsn.EnvelopeID = opts.EnvelopeID
+	}
 	return nil
 }
 
-func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.backend.respond(s.rcpt(to, opts))
+}
+
+func (s *session) rcpt(to string, opts *smtp.RcptOptions) error {
+	s.touch()
+	if _, maxRecipients := s.backend.conns.sessionLimits(); maxRecipients > 0 && len(s.recipients) >= maxRecipients {
+		return errTooManyRecipients
+	}
+	tag, err := s.backend.recipientPolicy().check(to)
+	if err != nil {
+		s.backend.logf("rejected recipient remote=%s to=%q", addrString(s.remoteAddr()), to)
+		s.recordReputation(s.envelopeFrom, reputation.EventInvalidRecipient)
+		return err
+	}
+	var conn InboundMessage
+	s.applyConnection(&conn)
+	if rule, ok := rcptRule(s.backend.routingRules(), &conn, s.envelopeFrom, to); ok && rule.action == config.RuleActionReject {
+		return rule.smtpError()
+	}
+	if err := s.checkGreylist(to); err != nil {
+		return err
+	}
+	if err := s.injectChaos("RCPT"); err != nil {
+		return err
+	}
 	s.recipients = append(s.recipients, to)
+	if s.tag == "" {
+		s.tag = tag
+	}
+	if opts != nil && (len(opts.Notify) > 0 || opts.OriginalRecipient != "") {
+		params := RecipientDSN{Recipient: to}
+		for _, notify := range opts.Notify {
+			params.Notify = append(params.Notify, string(notify))
+		}
+		if opts.OriginalRecipient != "" {
+			params.OriginalRecipient = string(opts.OriginalRecipientType) + ";" + opts.OriginalRecipient
+		}
+		s.dsn.Recipients = append(s.dsn.Recipients, params)
+	}
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	return s.backend.respond(s.data(r))
+}
+
+func (s *session) data(r io.Reader) error {
 	if len(s.recipients) == 0 {
-		return fmt.Errorf("at least one recipient is required")
+		return errNoRecipients
+	}
+	if err := s.checkChunking(r); err != nil {
+		return err
 	}
+	if err := s.backend.currentLimits().checkData(); err != nil {
+		s.recordRateLimited(s.envelopeFrom, err)
+		return err
+	}
+	if err := s.injectChaos("DATA"); err != nil {
+		return err
+	}
+	if err := s.injectDrop(r); err != nil {
+		return err
+	}
+	processor, release := s.backend.acquire()
+	defer release()
+	done := s.backend.activity.Begin()
+	defer done()
+	s.pauseIdleTimer()
+	defer s.touch()
+	endData := s.beginData()
+	defer endData()
 
-	data, err := io.ReadAll(r)
+	var head *headCapture
+	body := r
+	if s.backend.summarizeTooLarge() {
+		head = &headCapture{r: r}
+		body = head
+	}
+	data, spool, err := s.backend.spoolConfig().read(body)
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		return s.rejectTooLarge(head)
+	}
 	if err != nil {
-		return fmt.Errorf("read message data: %w", err)
+		return err
 	}
 
 	msg := InboundMessage{
 		EnvelopeFrom: s.envelopeFrom,
 		Recipients:   append([]string(nil), s.recipients...),
+		Tag:          s.tag,
 		Data:         data,
+		ReceivedAt:   time.Now().UTC(),
+		SMTPUTF8:     s.smtpUTF8,
+		BodyType:     s.bodyType,
+		Transfer:     transferCommand(r),
+		DSN:          s.dsn,
+		spool:        spool,
+	}
+	msg.Sequence = s.backend.sequences.next(msg.EnvelopeFrom)
+	defer msg.release()
+	s.applyConnection(&msg)
+	if tag := s.dnsblTag(); tag != "" {
+		msg.Tag = tag
 	}
+	s.recordMessageReputation(msg)
 
-	if err := s.backend.processor.Echo(context.Background(), msg); err != nil {
-		return fmt.Errorf("process echo reply: %w", err)
+	entry := activity.Entry{
+		Time:         msg.ReceivedAt,
+		RemoteAddr:   addrString(msg.RemoteAddr),
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Bytes:        int(msg.Size()),
+		Status:       activity.StatusEchoed,
+	}
+	ctx, span := tracer.Start(s.context(), "smtp.message", messageAttributes(msg))
+	ctx, cancel := s.backend.processingContext(ctx)
+	defer cancel()
+	err = processor.Echo(ctx, msg)
+	endSpan(span, err)
+	if err != nil {
+		err = processingError(ctx, err)
+		entry.Status = activity.StatusFailed
+		entry.Error = err.Error()
+		s.backend.activity.Record(entry)
+		if isPermanentFailure(err) {
+			s.backend.quarantineMessage(msg, err)
+		}
+		return err
 	}
+	s.backend.activity.Record(entry)
 
 	if s.backend.logger != nil {
-		s.backend.logger.Printf("echoed message from=%q recipients=%d bytes=%d", s.envelopeFrom, len(s.recipients), len(data))
+		s.backend.logger.Printf("echoed message from=%q remote=%s recipients=%d bytes=%d", s.envelopeFrom, addrString(msg.RemoteAddr), len(s.recipients), msg.Size())
 	}
 
 	return nil
 }
+
+func (s *session) context() context.Context {
+	if s.ctx == nil {
+		return s.backend.ctx
+	}
+	return s.ctx
+}
+
+func (b *Backend) processingContext(parent context.Context) (context.Context, context.CancelFunc) {
+	b.mu.RLock()
+	timeout := b.timeout
+	b.mu.RUnlock()
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+func processingError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errProcessingTimeout
+	case ctx.Err() != nil:
+		return errShuttingDown
+	}
+	return err
+}
+
+func (s *session) applyConnection(msg *InboundMessage) {
+	msg.AuthUser = s.authUser
+	msg.ConnectedAt = s.connectedAt
+	msg.DNSBL = s.dnsbl
+	msg.HeloCheck = s.helo
+	msg.RDNS = s.rdns
+	if s.conn == nil {
+		return
+	}
+	msg.RemoteAddr = s.remoteAddr()
+	msg.LocalAddr = s.conn.Conn().LocalAddr()
+	msg.Helo = s.conn.Hostname()
+	s.applyForwarded(msg)
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		msg.TLS = &state
+		msg.TLSMode = s.backend.listenerTLSMode(s.conn.Server().Addr)
+	}
+}
+
+func (s *session) remoteAddr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Conn().RemoteAddr()
+}
+
+func (s *session) remoteIP() net.IP {
+	return remoteIP(s.remoteAddr())
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func (b *Backend) storeMessage(msg InboundMessage) int64 {
+	if b.store == nil {
+		return 0
+	}
+
+	raw, err := msg.Bytes()
+	if err != nil {
+		if b.logger != nil {
+			b.logger.Printf("store inbound message from=%q: %v", msg.EnvelopeFrom, err)
+		}
+		return 0
+	}
+
+	stored := store.Message{
+		ReceivedAt:   msg.ReceivedAt,
+		RemoteAddr:   addrString(msg.RemoteAddr),
+		EnvelopeFrom: msg.EnvelopeFrom,
+		Recipients:   msg.Recipients,
+		Size:         len(raw),
+		Raw:          raw,
+	}
+	if reader, err := mail.CreateReader(bytes.NewReader(raw)); err == nil {
+		stored.Subject, _ = reader.Header.Subject()
+		stored.MessageID, _ = reader.Header.MessageID()
+		reader.Close()
+	}
+
+	id, err := b.store.SaveMessage(context.Background(), stored)
+	if err != nil {
+		if b.logger != nil {
+			b.logger.Printf("store inbound message from=%q: %v", msg.EnvelopeFrom, err)
+		}
+		return 0
+	}
+	return id
+}
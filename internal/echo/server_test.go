@@ -0,0 +1,1938 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+	"github.com/danthegoodman1/smtp_echo/internal/quarantine"
+	"github.com/danthegoodman1/smtp_echo/internal/queue"
+	"github.com/danthegoodman1/smtp_echo/internal/reputation"
+	"github.com/danthegoodman1/smtp_echo/internal/webhook"
+	"github.com/danthegoodman1/smtp_echo/internal/xclient"
+)
+
+type recordingProcessor struct {
+	mu       sync.Mutex
+	messages []InboundMessage
+}
+
+func (p *recordingProcessor) Echo(_ context.Context, msg InboundMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func startTestServer(t *testing.T, cfg config.Config, processor Processor) (*smtp.Server, string) {
+	t.Helper()
+
+	server := smtp.NewServer(NewBackend(cfg, processor, nil, nil))
+	server.Domain = "mail.example.com"
+	server.AllowInsecureAuth = true
+	server.EnableDSN = true
+	server.EnableSMTPUTF8 = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, listener.Addr().String()
+}
+
+func TestSession_AuthRequired(t *testing.T) {
+	cfg := config.Config{Auth: &config.AuthConfig{
+		Required:      true,
+		AllowInsecure: true,
+		Users:         []config.AuthUser{{Username: "tester", Password: "secret"}},
+	}}
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, cfg, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("sender@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 530 {
+		t.Fatalf("Mail() before auth error = %v, want 530", err)
+	}
+	if err := client.Auth(sasl.NewLoginClient("tester", "wrong")); !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+		t.Fatalf("Auth(LOGIN) wrong password error = %v, want 535", err)
+	}
+	if err := client.Auth(sasl.NewPlainClient("", "tester", "secret")); err != nil {
+		t.Fatalf("Auth(PLAIN) error = %v", err)
+	}
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 || processor.messages[0].AuthUser != "tester" {
+		t.Fatalf("processed messages = %#v, want one from tester", processor.messages)
+	}
+}
+
+func TestBackend_UseMiddleware(t *testing.T) {
+	processor := &recordingProcessor{}
+	backend := NewBackend(config.Config{}, processor, nil, nil)
+
+	var order []string
+	stage := func(name string) Middleware {
+		return func(next Processor) Processor {
+			return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+				order = append(order, name)
+				msg.Recipients = append(msg.Recipients, name+"@example.com")
+				return next.Echo(ctx, msg)
+			})
+		}
+	}
+	backend.Use(stage("first"), stage("second"))
+
+	pipeline, release := backend.acquire()
+	defer release()
+	if err := pipeline.Echo(context.Background(), InboundMessage{EnvelopeFrom: "sender@example.net"}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if strings.Join(order, ",") != "first,second" {
+		t.Fatalf("middleware order = %v, want first,second", order)
+	}
+	if len(processor.messages) != 1 || len(processor.messages[0].Recipients) != 2 {
+		t.Fatalf("processed messages = %#v, want one message with recipients from both stages", processor.messages)
+	}
+
+	errRejected := errors.New("rejected by stage")
+	backend.Use(func(Processor) Processor {
+		return ProcessorFunc(func(context.Context, InboundMessage) error {
+			return errRejected
+		})
+	})
+	pipeline, release = backend.acquire()
+	defer release()
+	if err := pipeline.Echo(context.Background(), InboundMessage{}); !errors.Is(err, errRejected) {
+		t.Fatalf("Echo() error = %v, want short-circuit error", err)
+	}
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed messages = %d, want short-circuited stage to skip the processor", len(processor.messages))
+	}
+}
+
+func TestSession_RoutingRules(t *testing.T) {
+	cfg := config.Config{Rules: []config.RuleConfig{
+		{Match: "reject@", Action: config.RuleActionReject, Code: 550},
+		{Match: "noreply@", Action: config.RuleActionDrop},
+		{Match: "delay-*@", Action: config.RuleActionDelay},
+		{Match: "shout@", Action: config.RuleActionFilter, Filters: []string{"shout"}},
+	}}
+	processor := &recordingProcessor{}
+	server, addr := startTestServer(t, cfg, processor)
+	backend := server.Backend.(*Backend)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := client.Rcpt("Reject@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("Rcpt(reject@) error = %v, want 550", err)
+	}
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+
+	body := "Subject: hi\r\n\r\nbody\r\n"
+	if err := client.SendMail("sender@example.net", []string{"noreply@example.com"}, strings.NewReader(body)); err != nil {
+		t.Fatalf("SendMail(noreply@) error = %v", err)
+	}
+	if err := client.SendMail("sender@example.net", []string{"delay-1h@example.com"}, strings.NewReader(body)); err != nil {
+		t.Fatalf("SendMail(delay-1h@) error = %v", err)
+	}
+
+	processor.mu.Lock()
+	processed := len(processor.messages)
+	processor.mu.Unlock()
+	if processed != 0 {
+		t.Fatalf("processed messages = %d, want dropped and delayed messages to skip the processor", processed)
+	}
+	if got := backend.queue.Len(); got != 1 {
+		t.Fatalf("queue.Len() = %d, want 1", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	abandoned, err := backend.Drain(ctx)
+	if err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if abandoned != 0 {
+		t.Fatalf("Drain() abandoned = %d, want 0", abandoned)
+	}
+
+	if err := client.SendMail("sender@example.net", []string{"shout@example.com"}, strings.NewReader(body)); err != nil {
+		t.Fatalf("SendMail(shout@) error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 2 || processor.messages[0].Recipients[0] != "delay-1h@example.com" {
+		t.Fatalf("processed messages = %#v, want the delayed message flushed by Drain", processor.messages)
+	}
+	if filters := processor.messages[1].Filters; len(filters) != 1 || filters[0] != "shout" {
+		t.Fatalf("filter rule message filters = %v, want [shout]", filters)
+	}
+}
+
+type ruleProcessor struct {
+	recordingProcessor
+	forwarded []string
+}
+
+func (p *ruleProcessor) Forward(_ context.Context, _ InboundMessage, recipients []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forwarded = append(p.forwarded, recipients...)
+	return nil
+}
+
+func (p *ruleProcessor) Authenticate(_ context.Context, msg InboundMessage) mailauth.Results {
+	if strings.HasPrefix(msg.EnvelopeFrom, "spoof") {
+		return mailauth.Results{DMARC: mailauth.DMARCResult{Result: mailauth.ResultFail}}
+	}
+	return mailauth.Results{DMARC: mailauth.DMARCResult{Result: mailauth.ResultPass}}
+}
+
+func TestSession_RuleConditions(t *testing.T) {
+	cfg := config.Config{Rules: []config.RuleConfig{
+		{Sender: "banned@example.net", Action: config.RuleActionReject, Code: 550},
+		{Sender: "*@partner.example", Action: config.RuleActionTag, Tag: "partner"},
+		{Subject: `(?i)^\[spam\]`, Action: config.RuleActionReject, Code: 554, Message: "Spam not accepted"},
+		{MinSize: 2000, Action: config.RuleActionDrop},
+		{Auth: &config.RuleAuthConfig{DMARC: "fail"}, Action: config.RuleActionForward, ForwardTo: []string{"quarantine@example.org"}},
+		{Match: "*@example.com", Action: config.RuleActionEcho},
+	}}
+	processor := &ruleProcessor{}
+	_, addr := startTestServer(t, cfg, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("banned@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := client.Rcpt("echo@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("Rcpt() from banned sender error = %v, want 550", err)
+	}
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+
+	err = client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: [SPAM] buy now\r\n\r\nbody\r\n"))
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || smtpErr.Message != "Spam not accepted" {
+		t.Fatalf("SendMail(spam) error = %v, want 554 Spam not accepted", err)
+	}
+	for _, send := range []struct {
+		from string
+		body string
+	}{
+		{"someone@partner.example", "Subject: hello\r\n\r\nbody\r\n"},
+		{"sender@example.net", "Subject: big\r\n\r\n" + strings.Repeat("large body line\r\n", 200)},
+		{"spoof@example.net", "Subject: hello\r\n\r\nbody\r\n"},
+	} {
+		if err := client.SendMail(send.from, []string{"echo@example.com"}, strings.NewReader(send.body)); err != nil {
+			t.Fatalf("SendMail(%s) error = %v", send.from, err)
+		}
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 || processor.messages[0].Tag != "partner" {
+		t.Fatalf("processed messages = %#v, want only the tagged partner message", processor.messages)
+	}
+	if len(processor.forwarded) != 1 || processor.forwarded[0] != "quarantine@example.org" {
+		t.Fatalf("forwarded = %v, want [quarantine@example.org]", processor.forwarded)
+	}
+}
+
+func TestSession_ConnectionFacts(t *testing.T) {
+	plaintext := false
+	cfg := config.Config{Rules: []config.RuleConfig{
+		{Connection: &config.RuleConnConfig{Helo: "*.invalid"}, Action: config.RuleActionReject, Code: 550, Message: "Bad HELO"},
+		{Connection: &config.RuleConnConfig{RemoteIP: []string{"127.0.0.0/8"}, TLS: &plaintext}, Action: config.RuleActionTag, Tag: "local-plaintext"},
+		{Connection: &config.RuleConnConfig{RemoteIP: []string{"192.0.2.1"}}, Action: config.RuleActionDrop},
+	}}
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, cfg, processor)
+
+	send := func(helo string) error {
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("smtp.Dial() error = %v", err)
+		}
+		defer client.Close()
+		if err := client.Hello(helo); err != nil {
+			t.Fatalf("Hello() error = %v", err)
+		}
+		return client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := send("client.invalid"); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Message != "Bad HELO" {
+		t.Fatalf("SendMail() with rejected HELO error = %v, want 550 Bad HELO at RCPT", err)
+	}
+	if err := send("client.example.net"); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed messages = %d, want 1", len(processor.messages))
+	}
+	msg := processor.messages[0]
+	if msg.Tag != "local-plaintext" || msg.Helo != "client.example.net" {
+		t.Fatalf("message tag = %q, helo = %q, want connection rule tag and the client HELO", msg.Tag, msg.Helo)
+	}
+	if addrString(msg.LocalAddr) != addr || msg.ConnectedAt.IsZero() || msg.ConnectedAt.After(msg.ReceivedAt) {
+		t.Fatalf("message local addr = %v, connected at = %v, want %s before %v", msg.LocalAddr, msg.ConnectedAt, addr, msg.ReceivedAt)
+	}
+	if envelope := buildWebhookPayload(msg, nil).Envelope; envelope.LocalAddr != addr || envelope.Helo != "client.example.net" || envelope.TLS != nil {
+		t.Fatalf("webhook envelope = %+v, want local addr, helo, and no tls", envelope)
+	}
+}
+
+func TestSession_SpoolsLargeMessages(t *testing.T) {
+	cfg := config.Config{SpoolThreshold: 64, SpoolDir: t.TempDir()}
+	body := "Subject: big\r\n\r\n" + strings.Repeat("spooled line\r\n", 100)
+
+	var spooled bool
+	var content []byte
+	processor := ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		spooled = msg.Spooled()
+		data, err := msg.Open()
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		content, err = io.ReadAll(data)
+		return err
+	})
+	_, addr := startTestServer(t, cfg, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader(body)); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+	if !spooled || string(content) != body {
+		t.Fatalf("processed message spooled = %t, content = %d bytes, want the full spooled message", spooled, len(content))
+	}
+
+	entries, err := os.ReadDir(cfg.SpoolDir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("spool dir has %d files after processing, want 0", len(entries))
+	}
+}
+
+func TestSession_BDAT(t *testing.T) {
+	cfg := config.Config{SpoolThreshold: 64, SpoolDir: t.TempDir()}
+	first := "Subject: chunked\r\n\r\n" + strings.Repeat("first chunk\r\n", 10)
+	second := strings.Repeat("second chunk\r\n", 10)
+
+	var transfers []string
+	var spooled bool
+	var content []byte
+	processor := ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		transfers = append(transfers, msg.Transfer)
+		spooled = msg.Spooled()
+		var err error
+		content, err = msg.Bytes()
+		return err
+	})
+	_, addr := startTestServer(t, cfg, processor)
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	steps := []struct {
+		command string
+		code    int
+	}{
+		{"", 220},
+		{"EHLO client.example.net", 250},
+		{"MAIL FROM:<sender@example.net>", 250},
+		{"RCPT TO:<echo@example.com>", 250},
+		{fmt.Sprintf("BDAT %d\r\n%s", len(first), first), 250},
+		{fmt.Sprintf("BDAT %d LAST\r\n%s", len(second), second), 250},
+		{"MAIL FROM:<sender@example.net>", 250},
+		{"RCPT TO:<echo@example.com>", 250},
+		{"DATA", 354},
+		{"Subject: data\r\n\r\nbody\r\n.", 250},
+	}
+	for _, step := range steps {
+		if step.command != "" {
+			fmt.Fprintf(conn.W, "%s\r\n", strings.TrimSuffix(step.command, "\r\n"))
+			if err := conn.W.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q response error = %v", step.command, err)
+		}
+		if strings.HasPrefix(step.command, "BDAT") && strings.Contains(step.command, "LAST") {
+			if !spooled || string(content) != first+second {
+				t.Fatalf("BDAT message spooled = %t, content = %q, want both chunks spooled", spooled, content)
+			}
+		}
+	}
+	if strings.Join(transfers, ",") != "BDAT,DATA" {
+		t.Fatalf("transfers = %v, want BDAT then DATA", transfers)
+	}
+}
+
+func TestSession_ConnectionLimits(t *testing.T) {
+	cfg := config.Config{Limits: &config.LimitsConfig{
+		MaxConnectionsPerIP: 1,
+		IdleTimeout:         100 * time.Millisecond,
+		MaxRecipients:       1,
+	}}
+	_, addr := startTestServer(t, cfg, &recordingProcessor{})
+
+	first, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer first.Close()
+	if err := first.Hello("client.example.net"); err != nil {
+		t.Fatalf("Hello() error = %v", err)
+	}
+
+	second, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer second.Close()
+	var smtpErr *smtp.SMTPError
+	if err := second.Hello("client.example.net"); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("second Hello() error = %v, want 421", err)
+	}
+
+	if err := first.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	if err := first.Rcpt("echo@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error = %v", err)
+	}
+	if err := first.Rcpt("other@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 452 {
+		t.Fatalf("second Rcpt() error = %v, want 452", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if err := first.Noop(); err == nil {
+		t.Fatalf("Noop() after idle timeout error = nil, want closed session")
+	}
+}
+
+func TestBackend_ReplyDelay(t *testing.T) {
+	delay := replyDelay{delay: time.Second, jitter: 500 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		if got := delay.next(); got < time.Second || got > 1500*time.Millisecond {
+			t.Fatalf("replyDelay.next() = %s, want within [1s, 1.5s]", got)
+		}
+	}
+
+	processor := &recordingProcessor{}
+	backend := NewBackend(config.Config{Reply: config.ReplyConfig{Delay: time.Hour}}, processor, nil, nil)
+	pipeline, release := backend.acquire()
+	defer release()
+	if err := pipeline.Echo(context.Background(), InboundMessage{Recipients: []string{"echo@example.com"}}); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+	if len(processor.messages) != 0 || backend.queue.Len() != 1 {
+		t.Fatalf("processed = %d, queued = %d, want the reply queued", len(processor.messages), backend.queue.Len())
+	}
+
+	if _, err := backend.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed = %d after Drain(), want 1", len(processor.messages))
+	}
+}
+
+func TestBackend_QueueJournal(t *testing.T) {
+	journal, err := queue.Open(config.QueueConfig{Path: t.TempDir() + "/queue.db", ClaimTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("queue.Open() error = %v", err)
+	}
+	defer journal.Close()
+
+	cfg := config.Config{Reply: config.ReplyConfig{Delay: time.Hour}}
+	first := &recordingProcessor{}
+	backend := NewBackend(cfg, first, nil, nil)
+	backend.UseQueue(journal)
+	pipeline, release := backend.acquire()
+	defer release()
+	msg := InboundMessage{
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Data:         []byte("Subject: hi\r\n\r\nbody\r\n"),
+		RemoteAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 4000},
+		DSN:          DSNParams{EnvelopeID: "env-1"},
+	}
+	if err := pipeline.Echo(context.Background(), msg); err != nil {
+		t.Fatalf("Echo() error = %v", err)
+	}
+
+	second := &recordingProcessor{}
+	restarted := NewBackend(cfg, second, nil, nil)
+	restarted.UseQueue(journal)
+	resumed, err := restarted.ResumeQueue(context.Background())
+	if err != nil || resumed != 1 || restarted.queue.Len() != 1 {
+		t.Fatalf("ResumeQueue() = %d, %v (queued %d), want 1 journaled reply", resumed, err, restarted.queue.Len())
+	}
+
+	if _, err := restarted.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if len(second.messages) != 1 {
+		t.Fatalf("resumed processed = %d, want 1", len(second.messages))
+	}
+	got := second.messages[0]
+	if got.EnvelopeFrom != msg.EnvelopeFrom || string(got.Data) != string(msg.Data) || addrString(got.RemoteAddr) != "192.0.2.10:4000" || got.DSN.EnvelopeID != "env-1" {
+		t.Fatalf("resumed message = %#v, want the journaled message", got)
+	}
+
+	if _, err := backend.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if len(first.messages) != 0 {
+		t.Fatalf("original processed = %d, want 0 after the resumed process sent the reply", len(first.messages))
+	}
+	if entries, err := journal.Entries(context.Background()); err != nil || len(entries) != 0 {
+		t.Fatalf("Entries() = %d, %v, want an empty journal", len(entries), err)
+	}
+}
+
+func TestSession_Greylisting(t *testing.T) {
+	cfg := config.Config{Greylist: &config.GreylistConfig{Delay: 0, Window: time.Hour, Expiry: time.Hour}}
+	_, addr := startTestServer(t, cfg, &recordingProcessor{})
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := client.Rcpt("echo@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("first Rcpt() error = %v, want 451", err)
+	}
+	if err := client.Rcpt("echo@example.com", nil); err != nil {
+		t.Fatalf("retried Rcpt() error = %v", err)
+	}
+}
+
+func TestSession_Reputation(t *testing.T) {
+	cfg := config.Config{Recipients: &config.RecipientsConfig{Mode: config.RecipientModeStrict, Addresses: []string{"echo@example.com"}, TagSeparator: "+"}}
+	backend := NewBackend(cfg, &recordingProcessor{}, nil, nil)
+	tracker, err := reputation.Open(context.Background(), config.ReputationConfig{Window: time.Hour, MinEvents: 3, TempfailScore: 50, BlockScore: 20, BlockDuration: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("reputation.Open() error = %v", err)
+	}
+	backend.UseReputation(tracker)
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendMail("good@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+	if err := client.Mail("spammer@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	for _, recipient := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := client.Rcpt(recipient, nil); err == nil {
+			t.Fatalf("Rcpt(%q) error = nil, want unknown recipient", recipient)
+		}
+	}
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("spammer@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Fatalf("Mail() from blocked sender error = %v, want 550 5.7.1", err)
+	}
+	if err := client.Mail("other@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("Mail() from low reputation ip error = %v, want 451 4.7.1", err)
+	}
+	if entries := backend.Activity().Recent(10, activity.StatusPoorReputation); len(entries) != 2 {
+		t.Fatalf("activity entries = %#v, want both rejections", entries)
+	}
+
+	if err := tracker.Unblock(context.Background(), reputation.TypeIP, "127.0.0.1"); err != nil {
+		t.Fatalf("Unblock() error = %v", err)
+	}
+	if err := client.Mail("other@example.net", nil); err != nil {
+		t.Fatalf("Mail() after unblock error = %v", err)
+	}
+	if got := tracker.Check(reputation.TypeSender, "good@example.net"); got.Messages != 1 || got.Status != reputation.StatusOK {
+		t.Fatalf("Check(good sender) = %+v, want one message and ok", got)
+	}
+}
+
+func TestSession_DSNParameters(t *testing.T) {
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, config.Config{}, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("sender@example.net", &smtp.MailOptions{Return: smtp.DSNReturnHeaders, EnvelopeID: "env-1"}); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	rcptOpts := &smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "orig@example.com",
+	}
+	if err := client.Rcpt("echo@example.com", rcptOpts); err != nil {
+		t.Fatalf("Rcpt() error = %v", err)
+	}
+	if err := client.Rcpt("plain@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error = %v", err)
+	}
+	data, err := client.Data()
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if _, err := io.WriteString(data, "Subject: dsn\r\n\r\nbody\r\n"); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed messages = %d, want 1", len(processor.messages))
+	}
+	headers := dsnHeaders(processor.messages[0].DSN)
+	want := []headerField{
+		{"X-Echo-DSN", "ret=HDRS; envid=env-1"},
+		{"X-Echo-DSN-Recipient", "<echo@example.com>; notify=SUCCESS,FAILURE; orcpt=RFC822;orig@example.com"},
+	}
+	if fmt.Sprint(headers) != fmt.Sprint(want) {
+		t.Fatalf("dsnHeaders() = %v, want %v", headers, want)
+	}
+}
+
+func TestSession_SenderVerification(t *testing.T) {
+	_, mailbox := startTestServer(t, config.Config{Rules: []config.RuleConfig{
+		{Match: "missing@", Action: config.RuleActionReject, Code: 550},
+	}}, &recordingProcessor{})
+
+	cfg := config.Config{
+		Hostname:     "echo.example.com",
+		Reply:        config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com"},
+		Delivery:     config.DeliveryConfig{DomainOverrides: map[string]string{"probe.test": mailbox}},
+		SenderVerify: &config.SenderVerifyConfig{Probe: true, Timeout: 5 * time.Second, CacheTTL: time.Minute},
+	}
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	replier.resolver = notFoundResolver{}
+	_, addr := startTestServer(t, cfg, replier)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		from string
+		code int
+	}{
+		{"sender@probe.test", 0},
+		{"missing@probe.test", 550},
+		{"sender@nowhere.invalid", 550},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		err := client.Mail(tt.from, nil)
+		var smtpErr *smtp.SMTPError
+		switch {
+		case tt.code == 0 && err != nil:
+			t.Fatalf("Mail(%q) error = %v", tt.from, err)
+		case tt.code != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.code):
+			t.Fatalf("Mail(%q) error = %v, want %d", tt.from, err, tt.code)
+		}
+		if err := client.Reset(); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+	}
+	if _, ok := replier.senderVerify.cached("missing@probe.test", time.Now()); !ok {
+		t.Fatalf("cached(missing@probe.test) = false, want the rejection cached")
+	}
+}
+
+type smtpStep struct {
+	command string
+	code    int
+}
+
+func startCheckServer(t *testing.T, resolver mailauth.Resolver, configure func(*config.Config)) (*Backend, string, *[]byte) {
+	t.Helper()
+
+	cfg := config.Config{
+		Hostname: "echo.example.com",
+		Reply:    config.ReplyConfig{FromAddress: "echo@example.com", MailFrom: "bounce@example.com", Mode: config.ReplyModeReport},
+	}
+	configure(&cfg)
+	replier, err := NewReplier(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewReplier() error = %v", err)
+	}
+	var delivered []byte
+	replier.UseDelivery(func(_ context.Context, _ string, _ string, message []byte) error {
+		delivered = append([]byte(nil), message...)
+		return nil
+	})
+	backend := NewBackend(cfg, replier, nil, nil)
+	backend.resolver = resolver
+
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(&xclient.Listener{Listener: listener, Greeting: server.Domain})
+	t.Cleanup(func() { server.Close() })
+	return backend, listener.Addr().String(), &delivered
+}
+
+func runSMTPSteps(t *testing.T, addr string, steps []smtpStep) {
+	t.Helper()
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	for _, step := range append([]smtpStep{{"", 220}}, steps...) {
+		if step.command != "" {
+			if err := conn.PrintfLine("%s", step.command); err != nil {
+				t.Fatalf("PrintfLine(%q) error = %v", step.command, err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q response error = %v", step.command, err)
+		}
+	}
+}
+
+type dnsblResolver struct {
+	notFoundResolver
+	listed map[string]string
+}
+
+func (r dnsblResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if _, ok := r.listed[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}}, nil
+	}
+	return r.notFoundResolver.LookupIPAddr(ctx, host)
+}
+
+func (r dnsblResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if reason, ok := r.listed[name]; ok {
+		return []string{reason}, nil
+	}
+	return r.notFoundResolver.LookupTXT(ctx, name)
+}
+
+func TestSession_DNSBL(t *testing.T) {
+	resolver := dnsblResolver{listed: map[string]string{"1.0.0.127.bl.test": "Listed for testing"}}
+	dnsbl := func(policy string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.DNSBL = &config.DNSBLConfig{Zones: []string{"bl.test", "clean.test"}, Policy: policy, Tag: "listed", Timeout: time.Second, CacheTTL: time.Minute}
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		backend, addr, _ := startCheckServer(t, resolver, dnsbl(config.DNSBLPolicyReject))
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO client.example.net", 250},
+			{"MAIL FROM:<sender@example.net>", 554},
+		})
+		if results, ok := backend.dnsblPolicy().cached("127.0.0.1", time.Now()); !ok || len(results) != 2 || !results[0].Listed || results[1].Listed {
+			t.Fatalf("cached(127.0.0.1) = %+v, %t, want the listing cached", results, ok)
+		}
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		_, addr, _ := startCheckServer(t, resolver, dnsbl(config.DNSBLPolicyReject))
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO proxy.example.com", 250},
+			{"XFORWARD ADDR=192.0.2.1", 250},
+			{"MAIL FROM:<sender@example.net>", 250},
+			{"RSET", 250},
+			{"MAIL FROM:<sender@example.net>", 554},
+		})
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		_, addr, delivered := startCheckServer(t, resolver, dnsbl(config.DNSBLPolicyTag))
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("smtp.Dial() error = %v", err)
+		}
+		defer client.Close()
+		if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("SendMail() error = %v", err)
+		}
+		for _, want := range []string{"bl.test:        listed (127.0.0.2) Listed for testing", "clean.test:     not listed", "Tag:            listed"} {
+			if !strings.Contains(string(*delivered), want) {
+				t.Fatalf("report = %s, want %q", *delivered, want)
+			}
+		}
+	})
+}
+
+type heloResolver struct {
+	notFoundResolver
+	hosts []string
+}
+
+func (r heloResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if slices.Contains(r.hosts, host) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	return r.notFoundResolver.LookupIPAddr(ctx, host)
+}
+
+func TestSession_Helo(t *testing.T) {
+	resolver := heloResolver{hosts: []string{"mail.example.net"}}
+	helo := func(policy string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.Helo = &config.HeloConfig{
+				Checks:  []string{config.HeloCheckFQDN, config.HeloCheckResolves, config.HeloCheckNotSelf, config.HeloCheckNotIP},
+				Policy:  policy,
+				Timeout: time.Second,
+			}
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		_, addr, _ := startCheckServer(t, resolver, helo(config.HeloPolicyReject))
+		for _, name := range []string{"localhost", "Echo.Example.com.", "[127.0.0.1]", "nowhere.example.net"} {
+			runSMTPSteps(t, addr, []smtpStep{
+				{"EHLO " + name, 250},
+				{"MAIL FROM:<sender@example.net>", 550},
+			})
+		}
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO mail.example.net", 250},
+			{"MAIL FROM:<sender@example.net>", 250},
+		})
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		_, addr, _ := startCheckServer(t, resolver, helo(config.HeloPolicyReject))
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO mail.example.net", 250},
+			{"XFORWARD HELO=localhost", 250},
+			{"MAIL FROM:<sender@example.net>", 550},
+		})
+	})
+
+	t.Run("log", func(t *testing.T) {
+		_, addr, delivered := startCheckServer(t, resolver, helo(config.HeloPolicyLog))
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("smtp.Dial() error = %v", err)
+		}
+		defer client.Close()
+		if err := client.Hello("[127.0.0.1]"); err != nil {
+			t.Fatalf("Hello() error = %v", err)
+		}
+		if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("SendMail() error = %v", err)
+		}
+		for _, want := range []string{"HELO/EHLO:      [127.0.0.1]", "HELO check:     fail (is an IP address literal; matches this server)"} {
+			if !strings.Contains(string(*delivered), want) {
+				t.Fatalf("report = %s, want %q", *delivered, want)
+			}
+		}
+	})
+}
+
+type rdnsResolver struct {
+	notFoundResolver
+	ptr   map[string][]string
+	hosts map[string]string
+}
+
+func (r rdnsResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return r.notFoundResolver.LookupAddr(ctx, addr)
+}
+
+func (r rdnsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, ok := r.hosts[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return r.notFoundResolver.LookupIPAddr(ctx, host)
+}
+
+func TestSession_RDNS(t *testing.T) {
+	rdns := func(policy string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.RDNS = &config.RDNSConfig{Policy: policy, Timeout: time.Second}
+		}
+	}
+	mismatched := rdnsResolver{ptr: map[string][]string{"127.0.0.1": {"mail.example.net."}}, hosts: map[string]string{"mail.example.net": "192.0.2.1"}}
+	confirmed := rdnsResolver{ptr: map[string][]string{"127.0.0.1": {"other.example.net.", "mail.example.net."}}, hosts: map[string]string{"mail.example.net": "127.0.0.1"}}
+
+	for _, tt := range []struct {
+		policy   string
+		resolver rdnsResolver
+		code     int
+	}{
+		{config.RDNSPolicyRejectMissing, rdnsResolver{}, 550},
+		{config.RDNSPolicyRejectMissing, mismatched, 250},
+		{config.RDNSPolicyRejectMismatch, mismatched, 550},
+		{config.RDNSPolicyRejectMismatch, confirmed, 250},
+		{config.RDNSPolicyLog, rdnsResolver{}, 250},
+	} {
+		_, addr, _ := startCheckServer(t, tt.resolver, rdns(tt.policy))
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO client.example.net", 250},
+			{"MAIL FROM:<sender@example.net>", tt.code},
+		})
+	}
+
+	t.Run("forwarded", func(t *testing.T) {
+		_, addr, _ := startCheckServer(t, confirmed, rdns(config.RDNSPolicyRejectMissing))
+		runSMTPSteps(t, addr, []smtpStep{
+			{"EHLO proxy.example.com", 250},
+			{"MAIL FROM:<sender@example.net>", 250},
+			{"RSET", 250},
+			{"XFORWARD ADDR=192.0.2.1", 250},
+			{"MAIL FROM:<sender@example.net>", 550},
+		})
+	})
+
+	t.Run("report", func(t *testing.T) {
+		_, addr, delivered := startCheckServer(t, confirmed, rdns(config.RDNSPolicyRejectMismatch))
+		client, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("smtp.Dial() error = %v", err)
+		}
+		defer client.Close()
+		if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("SendMail() error = %v", err)
+		}
+		if want := "Reverse DNS:    mail.example.net (forward-confirmed)"; !strings.Contains(string(*delivered), want) {
+			t.Fatalf("report = %s, want %q", *delivered, want)
+		}
+	})
+}
+
+func TestSession_Chaos(t *testing.T) {
+	cfg := config.Config{Chaos: &config.ChaosConfig{MailError: 1, Permanent: 1}}
+	_, addr := startTestServer(t, cfg, &recordingProcessor{})
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("sender@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Fatalf("Mail() error = %v, want injected 554", err)
+	}
+
+	cfg = config.Config{Chaos: &config.ChaosConfig{RcptError: 1}}
+	_, addr = startTestServer(t, cfg, &recordingProcessor{})
+	client, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	if err := client.Rcpt("echo@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Rcpt() error = %v, want injected 451", err)
+	}
+
+	processor := &recordingProcessor{}
+	cfg = config.Config{Chaos: &config.ChaosConfig{Drop: 1}}
+	_, addr = startTestServer(t, cfg, processor)
+	client, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	body := "Subject: drop\r\n\r\n" + strings.Repeat("body line\r\n", 1000)
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader(body)); err == nil {
+		t.Fatalf("SendMail() error = nil, want dropped connection")
+	}
+	if err := client.Noop(); err == nil {
+		t.Fatalf("Noop() after drop error = nil, want closed connection")
+	}
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 0 {
+		t.Fatalf("processed = %d, want 0 after a dropped DATA", len(processor.messages))
+	}
+}
+
+func TestSession_ProcessingTimeout(t *testing.T) {
+	blocked := make(chan struct{}, 1)
+	processor := ProcessorFunc(func(ctx context.Context, _ InboundMessage) error {
+		blocked <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	_, addr := startTestServer(t, config.Config{ProcessingTimeout: 50 * time.Millisecond}, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	err = client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 0}) {
+		t.Fatalf("SendMail() error = %v, want 451 4.3.0 after the processing timeout", err)
+	}
+	select {
+	case <-blocked:
+	default:
+		t.Fatal("processor was not called")
+	}
+}
+
+func TestSession_Responses(t *testing.T) {
+	cfg := config.Config{
+		Limits: &config.LimitsConfig{MaxRecipients: 2},
+		Rules:  []config.RuleConfig{{Match: "blocked@", Action: config.RuleActionReject, Code: 550, EnhancedCode: "5.7.1", Message: "Policy rejection"}},
+		Responses: &config.ResponsesConfig{Messages: map[string]string{
+			config.ResponseTooManyRecipients: "Two recipients per message",
+			config.ResponseProcessingFailed:  "Echo is having trouble",
+		}},
+	}
+	processor := ProcessorFunc(func(context.Context, InboundMessage) error {
+		return errors.New("disk full")
+	})
+	_, addr := startTestServer(t, cfg, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := client.Rcpt("blocked@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Fatalf("Rcpt(blocked@) error = %v, want 550 5.7.1", err)
+	}
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		if err := client.Rcpt(to, nil); err != nil {
+			t.Fatalf("Rcpt(%s) error = %v", to, err)
+		}
+	}
+	if err := client.Rcpt("c@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 452 || smtpErr.Message != "Two recipients per message" {
+		t.Fatalf("Rcpt(c@) error = %v, want 452 with the configured message", err)
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if _, err := writer.Write([]byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	err = writer.Close()
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 0}) || smtpErr.Message != "Echo is having trouble" {
+		t.Fatalf("Close() error = %v, want 451 4.3.0 with the configured message", err)
+	}
+}
+
+func TestSession_ClientCertRequired(t *testing.T) {
+	cfg := config.Config{TLS: &config.TLSConfig{ClientAuth: config.ClientAuthRequire}}
+	processor := &recordingProcessor{}
+	server := smtp.NewServer(NewBackend(cfg, processor, nil, nil))
+	server.Domain = "mail.example.com"
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mail.example.com")}, ClientAuth: tls.RequestClientCert}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("sender@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 530 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 0}) {
+		t.Fatalf("plaintext Mail() error = %v, want 530 5.7.0", err)
+	}
+
+	client, err = smtp.DialStartTLS(listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{testCertificate(t, "client.example.net")}})
+	if err != nil {
+		t.Fatalf("smtp.DialStartTLS() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() with client certificate error = %v", err)
+	}
+}
+
+func testCertificate(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSession_XCLIENT(t *testing.T) {
+	processor := &recordingProcessor{}
+	server := smtp.NewServer(NewBackend(config.Config{}, processor, nil, nil))
+	server.Domain = "mail.example.com"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(&xclient.Listener{Listener: listener, Greeting: server.Domain})
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	steps := []struct {
+		command string
+		code    int
+	}{
+		{"", 220},
+		{"EHLO proxy.example.com", 250},
+		{"XCLIENT ADDR=203.0.113.7 PORT=2525 HELO=client.example.net LOGIN=tester", 220},
+		{"EHLO proxy.example.com", 250},
+		{"MAIL FROM:<sender@example.net>", 250},
+		{"RCPT TO:<echo@example.com>", 250},
+		{"DATA", 354},
+		{"Subject: hi\r\n\r\nbody\r\n.", 250},
+	}
+	for _, step := range steps {
+		if step.command != "" {
+			if err := conn.PrintfLine("%s", step.command); err != nil {
+				t.Fatalf("PrintfLine(%q) error = %v", step.command, err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q response error = %v", step.command, err)
+		}
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed messages = %d, want 1", len(processor.messages))
+	}
+	msg := processor.messages[0]
+	if got := addrString(msg.RemoteAddr); got != "203.0.113.7:2525" {
+		t.Fatalf("RemoteAddr = %q, want forwarded client address", got)
+	}
+	if msg.Helo != "client.example.net" || msg.AuthUser != "tester" {
+		t.Fatalf("Helo, AuthUser = %q, %q, want forwarded values", msg.Helo, msg.AuthUser)
+	}
+	if msg.ForwardedBy == nil || !strings.HasPrefix(msg.ForwardedBy.String(), "127.0.0.1:") {
+		t.Fatalf("ForwardedBy = %v, want proxy address", msg.ForwardedBy)
+	}
+}
+
+func TestWrapListener_ProxyProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trusted []string
+		header  string
+		remote  string
+	}{
+		{"trusted with header", []string{"127.0.0.1"}, "PROXY TCP4 203.0.113.7 192.0.2.25 4321 25\r\n", "203.0.113.7:4321"},
+		{"trusted without header", []string{"127.0.0.0/8"}, "", ""},
+		{"required without header", nil, "", ""},
+		{"untrusted with header", []string{"192.0.2.0/24"}, "PROXY TCP4 203.0.113.7 192.0.2.25 4321 25\r\n", "127.0.0.1:"},
+		{"untrusted with v2 header", []string{"192.0.2.0/24"}, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xcb\x00\x71\x07\xc0\x00\x02\x19\x10\xe1\x00\x19", "127.0.0.1:"},
+		{"untrusted without header", []string{"192.0.2.0/24"}, "", "127.0.0.1:"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			listenerCfg := config.ListenerConfig{
+				Addr:            "127.0.0.1:0",
+				TLSMode:         config.TLSModeNone,
+				MaxMessageBytes: 1 << 20,
+				ProxyProtocol:   true,
+				ProxyTrusted:    tt.trusted,
+			}
+			cfg := config.Config{Hostname: "mail.example.com", Listeners: []config.ListenerConfig{listenerCfg}}
+			processor := &recordingProcessor{}
+			server := NewSMTPServer(cfg, listenerCfg, NewBackend(cfg, processor, nil, nil), nil, log.New(io.Discard, "", 0))
+			socket, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("net.Listen() error = %v", err)
+			}
+			listener, err := WrapListener(listenerCfg, socket, nil, server)
+			if err != nil {
+				t.Fatalf("WrapListener() error = %v", err)
+			}
+			go server.Serve(listener)
+			t.Cleanup(func() { server.Close() })
+
+			raw, err := net.Dial("tcp", socket.Addr().String())
+			if err != nil {
+				t.Fatalf("net.Dial() error = %v", err)
+			}
+			defer raw.Close()
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(raw, tt.header+"EHLO client.example.net\r\n"); err != nil {
+				t.Fatalf("WriteString() error = %v", err)
+			}
+			conn := textproto.NewConn(raw)
+			if tt.remote == "" {
+				conn.ReadResponse(220)
+				if _, message, err := conn.ReadResponse(250); err == nil {
+					t.Fatalf("EHLO response = %q, want the connection refused without a PROXY header", message)
+				}
+				return
+			}
+
+			steps := []struct {
+				command string
+				code    int
+			}{
+				{"", 220},
+				{"", 250},
+				{"MAIL FROM:<sender@example.net>", 250},
+				{"RCPT TO:<echo@example.com>", 250},
+				{"DATA", 354},
+				{"Subject: hi\r\n\r\nbody\r\n.", 250},
+			}
+			for _, step := range steps {
+				if step.command != "" {
+					if err := conn.PrintfLine("%s", step.command); err != nil {
+						t.Fatalf("PrintfLine(%q) error = %v", step.command, err)
+					}
+				}
+				if _, _, err := conn.ReadResponse(step.code); err != nil {
+					t.Fatalf("%q response error = %v", step.command, err)
+				}
+			}
+
+			processor.mu.Lock()
+			defer processor.mu.Unlock()
+			if len(processor.messages) != 1 || !strings.HasPrefix(addrString(processor.messages[0].RemoteAddr), tt.remote) {
+				t.Fatalf("processed messages = %+v, want one from %s", processor.messages, tt.remote)
+			}
+		})
+	}
+}
+
+func TestSession_DisabledExtensions(t *testing.T) {
+	listenerCfg := config.ListenerConfig{
+		Addr:              "127.0.0.1:0",
+		TLSMode:           config.TLSModeNone,
+		MaxMessageBytes:   1 << 20,
+		DisableExtensions: []string{config.ExtensionDSN, config.ExtensionChunking},
+	}
+	cfg := config.Config{Hostname: "mail.example.com", Listeners: []config.ListenerConfig{listenerCfg}}
+	processor := &recordingProcessor{}
+	server := NewSMTPServer(cfg, listenerCfg, NewBackend(cfg, processor, nil, nil), nil, log.New(io.Discard, "", 0))
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	listener, err := WrapListener(listenerCfg, socket, nil, server)
+	if err != nil {
+		t.Fatalf("WrapListener() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := textproto.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("greeting error = %v", err)
+	}
+	conn.PrintfLine("EHLO client.example.net")
+	_, capabilities, err := conn.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO response error = %v", err)
+	}
+	if strings.Contains(capabilities, "DSN") || strings.Contains(capabilities, "CHUNKING") || !strings.Contains(capabilities, "SIZE 1048576") {
+		t.Fatalf("EHLO capabilities = %q, want SIZE without DSN or CHUNKING", capabilities)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.net> RET=FULL")
+	if _, _, err := conn.ReadResponse(504); err != nil {
+		t.Fatalf("MAIL with RET response error = %v, want 504", err)
+	}
+	conn.PrintfLine("MAIL FROM:<sender@example.net>")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("MAIL response error = %v", err)
+	}
+	conn.PrintfLine("RCPT TO:<echo@example.com>")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("RCPT response error = %v", err)
+	}
+	chunk := "Subject: bdat\r\n\r\nbody\r\n"
+	fmt.Fprintf(conn.W, "BDAT %d LAST\r\n%s", len(chunk), chunk)
+	conn.W.Flush()
+	if _, _, err := conn.ReadResponse(502); err != nil {
+		t.Fatalf("BDAT response error = %v, want 502", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 0 {
+		t.Fatalf("processed messages = %d, want BDAT rejected", len(processor.messages))
+	}
+}
+
+func TestSession_RecipientModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.RecipientsConfig
+		accepted []string
+		rejected []string
+		wantTag  string
+	}{
+		{
+			name:     "strict",
+			cfg:      config.RecipientsConfig{Mode: config.RecipientModeStrict, Addresses: []string{"echo@example.com"}, TagSeparator: "+"},
+			accepted: []string{"Echo@Example.com"},
+			rejected: []string{"echo+run-1@example.com", "other@example.com"},
+		},
+		{
+			name:     "catch_all",
+			cfg:      config.RecipientsConfig{Mode: config.RecipientModeCatchAll, Domains: []string{"example.com"}, TagSeparator: "+"},
+			accepted: []string{"anything@example.com"},
+			rejected: []string{"echo@example.net"},
+		},
+		{
+			name:     "plus_addressing",
+			cfg:      config.RecipientsConfig{Mode: config.RecipientModeStrict, Addresses: []string{"echo@example.com"}, PlusAddressing: true, TagSeparator: "+"},
+			accepted: []string{"echo@example.com", "echo+Run-42@example.com"},
+			rejected: []string{"other+run-42@example.com"},
+			wantTag:  "Run-42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processor := &recordingProcessor{}
+			_, addr := startTestServer(t, config.Config{Recipients: &tt.cfg}, processor)
+
+			client, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("smtp.Dial() error = %v", err)
+			}
+			defer client.Close()
+
+			if err := client.Mail("sender@example.net", nil); err != nil {
+				t.Fatalf("Mail() error = %v", err)
+			}
+			for _, recipient := range tt.rejected {
+				var smtpErr *smtp.SMTPError
+				if err := client.Rcpt(recipient, nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+					t.Fatalf("Rcpt(%q) error = %v, want 550 5.1.1", recipient, err)
+				}
+			}
+			for _, recipient := range tt.accepted {
+				if err := client.Rcpt(recipient, nil); err != nil {
+					t.Fatalf("Rcpt(%q) error = %v", recipient, err)
+				}
+			}
+			data, err := client.Data()
+			if err != nil {
+				t.Fatalf("Data() error = %v", err)
+			}
+			if _, err := io.WriteString(data, "Subject: tag\r\n\r\nbody\r\n"); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := data.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			processor.mu.Lock()
+			defer processor.mu.Unlock()
+			if len(processor.messages) != 1 {
+				t.Fatalf("processed messages = %d, want 1", len(processor.messages))
+			}
+			if got := processor.messages[0]; got.Tag != tt.wantTag || len(got.Recipients) != len(tt.accepted) {
+				t.Fatalf("message tag = %q recipients = %v, want tag %q and %v", got.Tag, got.Recipients, tt.wantTag, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestSession_SequenceNumbers(t *testing.T) {
+	processor := &recordingProcessor{}
+	_, addr := startTestServer(t, config.Config{Reply: config.ReplyConfig{Sequence: true}}, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	for _, sender := range []string{"first@example.net", "second@example.net", "First@example.net"} {
+		if err := client.SendMail(sender, []string{"echo@example.com"}, strings.NewReader("Subject: seq\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("SendMail(%q) error = %v", sender, err)
+		}
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	var got []int64
+	for _, msg := range processor.messages {
+		got = append(got, msg.Sequence)
+	}
+	if want := []int64{1, 1, 2}; !slices.Equal(got, want) {
+		t.Fatalf("sequences = %v, want %v", got, want)
+	}
+}
+
+func TestBackend_RetriesDeferredDelivery(t *testing.T) {
+	attempts := make(chan int, 3)
+	processor := ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		attempts <- msg.Attempt
+		if msg.Attempt < 2 {
+			return &deferredDelivery{delay: 10 * time.Millisecond, err: errors.New("451 try again")}
+		}
+		return nil
+	})
+	events := make(chan webhook.Payload, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decode webhook payload: %v", err)
+		}
+		events <- payload
+	}))
+	defer hook.Close()
+	_, addr := startTestServer(t, config.Config{Webhooks: []config.WebhookConfig{{URL: hook.URL, Timeout: time.Second, MaxAttempts: 1}}}, processor)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: retry\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() error = %v, want the message accepted while the reply is retried", err)
+	}
+	for want := 0; want <= 2; want++ {
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Fatalf("attempt = %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d was not retried", want)
+		}
+	}
+	select {
+	case payload := <-events:
+		if payload.Event != webhook.EventMessageEchoed {
+			t.Fatalf("webhook event = %q, want %q for the final attempt", payload.Event, webhook.EventMessageEchoed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not sent after the final attempt")
+	}
+	select {
+	case payload := <-events:
+		t.Fatalf("extra webhook %q, want one per message", payload.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSession_MaxBacklog(t *testing.T) {
+	processor := &recordingProcessor{}
+	backend := NewBackend(config.Config{
+		Reply:  config.ReplyConfig{Delay: time.Hour},
+		Limits: &config.LimitsConfig{MaxBacklog: 1},
+	}, processor, nil, nil)
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("sender@example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 1}) {
+		t.Fatalf("Mail() with a full backlog error = %v, want 451 4.3.1", err)
+	}
+	health := backend.Health()
+	if health.QueueBacklog != 1 || health.MaxBacklog != 1 || health.BacklogRejected != 1 {
+		t.Fatalf("Health() = %+v, want backlog 1 of 1 with one rejection", health)
+	}
+	if entries := backend.Activity().Recent(1, activity.StatusBacklogged); len(entries) != 1 {
+		t.Fatalf("backlogged activity entries = %d, want 1", len(entries))
+	}
+
+	if _, err := backend.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if err := client.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() after the backlog drained error = %v", err)
+	}
+}
+
+type tooLargeProcessor struct {
+	recordingProcessor
+	summaries []InboundMessage
+	limit     int64
+}
+
+func (p *tooLargeProcessor) replyTooLarge(_ context.Context, msg InboundMessage, limit int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.summaries = append(p.summaries, msg)
+	p.limit = limit
+	return nil
+}
+
+func TestSession_MessageTooLarge(t *testing.T) {
+	processor := &tooLargeProcessor{}
+	backend := NewBackend(config.Config{Reply: config.ReplyConfig{TooLargeSummary: true}}, processor, nil, nil)
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	server.MaxMessageBytes = 256
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	var smtpErr *smtp.SMTPError
+	if err := client.Mail("sender@example.net", &smtp.MailOptions{Size: 1024}); !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Fatalf("Mail() with SIZE over the limit error = %v, want 552 5.3.4", err)
+	}
+
+	body := "Subject: big one\r\nMessage-ID: <big@example.net>\r\n\r\n" + strings.Repeat("0123456789abcdef\r\n", 64)
+	err = client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader(body))
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) || smtpErr.Message != errMessageTooLarge.Message {
+		t.Fatalf("SendMail() with an oversized body error = %v, want %v", err, errMessageTooLarge)
+	}
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: small\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() after the oversized message error = %v", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.messages) != 1 {
+		t.Fatalf("processed messages = %d, want only the small one", len(processor.messages))
+	}
+	if len(processor.summaries) != 1 || processor.limit != 256 {
+		t.Fatalf("too large summaries = %d with limit %d, want 1 with limit 256", len(processor.summaries), processor.limit)
+	}
+	if summary := processor.summaries[0]; summary.EnvelopeFrom != "sender@example.net" || !strings.HasPrefix(string(summary.Data), "Subject: big one\r\n") {
+		t.Fatalf("summary message = %q from %q, want the start of the oversized message", summary.Data, summary.EnvelopeFrom)
+	}
+	if entries := backend.Activity().Recent(1, activity.StatusTooLarge); len(entries) != 1 {
+		t.Fatalf("too large activity entries = %d, want 1", len(entries))
+	}
+}
+
+func TestBackend_Quarantine(t *testing.T) {
+	failures := map[string]error{
+		"broken":  &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Message could not be parsed"},
+		"busy":    &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "try again"},
+		"delayed": errors.New("mx.example.net: connection refused"),
+	}
+	processor := ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		return failures[msg.Tag]
+	})
+	backend := NewBackend(config.Config{}, processor, nil, log.New(io.Discard, "", 0))
+	dir, err := quarantine.Open(config.QuarantineConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("quarantine.Open() error = %v", err)
+	}
+	backend.UseQuarantine(dir)
+
+	for _, tag := range []string{"broken", "busy"} {
+		msg := InboundMessage{EnvelopeFrom: "sender@example.net", Recipients: []string{"echo@example.com"}, Tag: tag, Data: []byte("Subject: " + tag + "\r\n\r\nbody\r\n")}
+		session := &session{backend: backend, envelopeFrom: msg.EnvelopeFrom, recipients: msg.Recipients, tag: tag}
+		if err := session.data(bytes.NewReader(msg.Data)); err == nil {
+			t.Fatalf("data() for %s error = nil, want failure", tag)
+		}
+	}
+	backend.runDelayed(nil, 0, InboundMessage{ID: 9, EnvelopeFrom: "late@example.net", Tag: "delayed", Data: []byte("Subject: late\r\n\r\nbody\r\n")}, trace.SpanContext{})
+
+	entries, err := dir.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("quarantined entries = %+v, want the permanent and the delayed failure", entries)
+	}
+	statuses := map[string]string{}
+	for _, entry := range entries {
+		entry, raw, err := dir.Get(entry.ID)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		msg := QuarantinedMessage(entry, raw)
+		statuses[msg.Tag] = entry.Status
+		if msg.Tag == "delayed" && (msg.ID != 9 || msg.EnvelopeFrom != "late@example.net" || string(msg.Data) != "Subject: late\r\n\r\nbody\r\n") {
+			t.Fatalf("QuarantinedMessage() = %+v, want the delayed message", msg)
+		}
+	}
+	if statuses["broken"] != "5.6.0" || statuses["delayed"] != "4.4.1" {
+		t.Fatalf("quarantined statuses = %v, want broken 5.6.0 and delayed 4.4.1", statuses)
+	}
+}
+
+func TestBackend_ReloadRateLimits(t *testing.T) {
+	limitsConfig := func(rate int) config.Config {
+		return config.Config{RateLimit: &config.RateLimitConfig{
+			PerIP:  &config.RateLimit{Rate: rate, Per: time.Hour, Burst: rate},
+			Global: &config.RateLimit{Rate: 100, Per: time.Hour, Burst: 100},
+		}}
+	}
+	processor := &recordingProcessor{}
+	backend := NewBackend(limitsConfig(1), processor, nil, nil)
+	ip := net.ParseIP("192.0.2.1")
+	limited := func() bool {
+		limits := backend.currentLimits()
+		return limits.checkMail(ip, "sender@example.net") != nil
+	}
+
+	if limited() {
+		t.Fatal("checkMail() limited the first message")
+	}
+	if !limited() {
+		t.Fatal("checkMail() allowed a second message over the per-IP limit")
+	}
+	backend.Reload(limitsConfig(1), processor)
+	if !limited() {
+		t.Fatal("checkMail() allowed a message after a reload with unchanged limits")
+	}
+	backend.Reload(limitsConfig(2), processor)
+	if limited() {
+		t.Fatal("checkMail() limited a message after the per-IP limit was raised")
+	}
+}
+
+func TestRateLimits_SenderRejectKeepsIPToken(t *testing.T) {
+	backend := NewBackend(config.Config{RateLimit: &config.RateLimitConfig{
+		PerIP:     &config.RateLimit{Rate: 2, Per: time.Hour, Burst: 2},
+		PerSender: &config.RateLimit{Rate: 1, Per: time.Hour, Burst: 1},
+	}}, &recordingProcessor{}, nil, nil)
+	limits := backend.currentLimits()
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := limits.checkMail(ip, "busy@example.net"); err != nil {
+		t.Fatalf("checkMail() first message error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := limits.checkMail(ip, "busy@example.net"); err == nil {
+			t.Fatal("checkMail() allowed a second message over the per-sender limit")
+		}
+	}
+	if err := limits.checkMail(ip, "other@example.net"); err != nil {
+		t.Fatalf("checkMail() after per-sender rejections error = %v, want the per-IP token kept", err)
+	}
+}
+
+func TestBackend_Dedup(t *testing.T) {
+	processor := &recordingProcessor{}
+	backend := NewBackend(config.Config{Dedup: &config.DedupConfig{Key: config.DedupKeyMessageID, Window: time.Hour, MaxEntries: 10}}, processor, nil, nil)
+	pipeline, release := backend.acquire()
+	defer release()
+
+	message := func(from string, data string) InboundMessage {
+		return InboundMessage{EnvelopeFrom: from, Recipients: []string{"echo@example.com"}, Data: []byte(data)}
+	}
+	first := message("sender@example.net", "Message-ID: <one@example.net>\r\nSubject: hi\r\n\r\nbody\r\n")
+	retransmitted := message("Sender@example.net", "Received: from relay\r\nMessage-ID: <one@example.net>\r\nSubject: hi\r\n\r\nbody\r\n")
+	otherSender := message("other@example.net", "Message-ID: <one@example.net>\r\nSubject: hi\r\n\r\nbody\r\n")
+	noID := message("sender@example.net", "Subject: hi\r\n\r\nsame body\r\n")
+	for _, msg := range []InboundMessage{first, retransmitted, otherSender, noID, noID} {
+		if err := pipeline.Echo(context.Background(), msg); err != nil {
+			t.Fatalf("Echo() error = %v", err)
+		}
+	}
+	if len(processor.messages) != 3 {
+		t.Fatalf("processed = %d, want 3 after suppressing two duplicates", len(processor.messages))
+	}
+	if got := backend.Health().DuplicatesSuppressed; got != 2 {
+		t.Fatalf("Health().DuplicatesSuppressed = %d, want 2", got)
+	}
+
+	failing := NewBackend(config.Config{Dedup: &config.DedupConfig{Key: config.DedupKeyBodyHash, Window: time.Hour}}, ProcessorFunc(func(context.Context, InboundMessage) error {
+		return errors.New("try again")
+	}), nil, nil)
+	failingPipeline, releaseFailing := failing.acquire()
+	defer releaseFailing()
+	for i := 0; i < 2; i++ {
+		if err := failingPipeline.Echo(context.Background(), first); err == nil {
+			t.Fatalf("Echo() attempt %d error = nil, want the processor error rather than a duplicate", i+1)
+		}
+	}
+
+	_, spool, err := spoolConfig{threshold: 8, dir: t.TempDir()}.read(strings.NewReader("Subject: spooled\r\n\r\nsame body\r\n"))
+	if err != nil {
+		t.Fatalf("read() error = %v", err)
+	}
+	bodyHash := newDedupCache(&config.DedupConfig{Key: config.DedupKeyBodyHash, Window: time.Hour})
+	spooled := InboundMessage{EnvelopeFrom: "sender@example.net", spool: spool}
+	if got, want := bodyHash.messageKey(spooled), bodyHash.messageKey(noID); got == "" || got != want {
+		t.Fatalf("messageKey(spooled) = %q, want %q from the same body in memory", got, want)
+	}
+	if got := bodyHash.messageKey(message("sender@example.net", "Subject: hi\r\n\r\nother body\r\n")); got == bodyHash.messageKey(noID) {
+		t.Fatalf("messageKey() = %q for a different body, want a different key", got)
+	}
+
+	cache := newDedupCache(&config.DedupConfig{Key: config.DedupKeyBodyHash, Window: time.Minute, MaxEntries: 2})
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		if !cache.reserve(key, now) {
+			t.Fatalf("reserve(%q) = false, want true", key)
+		}
+	}
+	if !cache.reserve("a", now) {
+		t.Fatal("reserve(a) = false after eviction by max_entries, want true")
+	}
+	if cache.reserve("c", now.Add(30*time.Second)) {
+		t.Fatal("reserve(c) = true within the window, want false")
+	}
+	if !cache.reserve("c", now.Add(2*time.Minute)) {
+		t.Fatal("reserve(c) = false after the window, want true")
+	}
+}
+
+func TestSocketServer(t *testing.T) {
+	var mu sync.Mutex
+	var received []InboundMessage
+	processor := ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, msg)
+		return nil
+	})
+	cfg := config.Config{
+		MaxMessageBytes: 256,
+		ReadTimeout:     5 * time.Second,
+		Reply:           config.ReplyConfig{FromAddress: "Echo <echo@example.com>"},
+	}
+	backend := NewBackend(cfg, processor, nil, log.New(io.Discard, "", 0))
+	socketPath := filepath.Join(t.TempDir(), "ingest.sock")
+	listener, err := ListenSocket(config.IngestConfig{Socket: socketPath, SocketMode: "0600"})
+	if err != nil {
+		t.Fatalf("ListenSocket() error = %v", err)
+	}
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode = %v, %v, want 0600", info, err)
+	}
+	server := NewSocketServer(cfg, backend)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	send := func(t *testing.T, message string) string {
+		t.Helper()
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, message); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		conn.(*net.UnixConn).CloseWrite()
+		response, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		return string(response)
+	}
+
+	tests := []struct {
+		name     string
+		message  string
+		response string
+		from     string
+		to       []string
+	}{
+		{
+			name:     "envelope headers",
+			message:  "Return-Path: <bounce@example.net>\r\nDelivered-To: echo+run1@example.com\r\nFrom: sender@example.net\r\nTo: other@example.org\r\nSubject: hi\r\n\r\nbody\r\n",
+			response: "250 2.0.0 Message echoed\r\n",
+			from:     "bounce@example.net",
+			to:       []string{"echo+run1@example.com"},
+		},
+		{
+			name:     "message headers",
+			message:  "From: sender@example.net\r\nTo: echo@example.com, other@example.org\r\nSubject: hi\r\n\r\nbody\r\n",
+			response: "250 2.0.0 Message echoed\r\n",
+			from:     "sender@example.net",
+			to:       []string{"echo@example.com", "other@example.org"},
+		},
+		{
+			name:     "default recipient",
+			message:  "From: sender@example.net\r\nSubject: hi\r\n\r\nbody\r\n",
+			response: "250 2.0.0 Message echoed\r\n",
+			from:     "sender@example.net",
+			to:       []string{"echo@example.com"},
+		},
+		{
+			name:     "empty",
+			response: "554 5.6.0 Message is empty\r\n",
+		},
+		{
+			name:     "too large",
+			message:  "From: sender@example.net\r\n\r\n" + strings.Repeat("x", 300),
+			response: "552 5.3.4 Message exceeds fixed maximum message size\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			received = nil
+			mu.Unlock()
+			if got := send(t, tt.message); got != tt.response {
+				t.Fatalf("response = %q, want %q", got, tt.response)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.from == "" {
+				if len(received) != 0 {
+					t.Fatalf("received = %+v, want nothing processed", received)
+				}
+				return
+			}
+			if len(received) != 1 || received[0].EnvelopeFrom != tt.from || !slices.Equal(received[0].Recipients, tt.to) ||
+				string(received[0].Data) != tt.message {
+				t.Fatalf("received = %+v, want from %q to %v", received, tt.from, tt.to)
+			}
+		})
+	}
+	if entries := backend.Activity().Recent(10, ""); len(entries) != 3 {
+		t.Fatalf("activity entries = %d, want one per echoed message", len(entries))
+	}
+}
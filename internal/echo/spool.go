@@ -0,0 +1,102 @@
+package echo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type spoolConfig struct {
+	threshold int64
+	dir       string
+}
+
+type spoolFile struct {
+	path string
+	size int64
+	refs atomic.Int32
+}
+
+func newSpoolConfig(cfg config.Config) spoolConfig {
+	return spoolConfig{threshold: cfg.SpoolThreshold, dir: cfg.SpoolDir}
+}
+
+func (c spoolConfig) read(r io.Reader) ([]byte, *spoolFile, error) {
+	data, err := io.ReadAll(io.LimitReader(r, c.threshold+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read message data: %w", err)
+	}
+	if int64(len(data)) <= c.threshold {
+		return data, nil, nil
+	}
+
+	file, err := os.CreateTemp(c.dir, "smtp-echo-*.eml")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create spool file: %w", err)
+	}
+	written, err := io.Copy(file, io.MultiReader(bytes.NewReader(data), r))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("spool message data: %w", err)
+	}
+
+	spool := &spoolFile{path: file.Name(), size: written}
+	spool.refs.Store(1)
+	return nil, spool, nil
+}
+
+func (m InboundMessage) Open() (io.ReadCloser, error) {
+	if m.spool == nil {
+		return io.NopCloser(bytes.NewReader(m.Data)), nil
+	}
+	file, err := os.Open(m.spool.path)
+	if err != nil {
+		return nil, fmt.Errorf("open spooled message: %w", err)
+	}
+	return file, nil
+}
+
+func (m InboundMessage) Bytes() ([]byte, error) {
+	if m.spool == nil {
+		return m.Data, nil
+	}
+	return os.ReadFile(m.spool.path)
+}
+
+func (m InboundMessage) Size() int64 {
+	if m.spool == nil {
+		return int64(len(m.Data))
+	}
+	return m.spool.size
+}
+
+func (m InboundMessage) Spooled() bool {
+	return m.spool != nil
+}
+
+func (m InboundMessage) rawBody() string {
+	data, err := m.Bytes()
+	if err != nil {
+		return ""
+	}
+	return extractRawBody(data)
+}
+
+func (m InboundMessage) retain() {
+	if m.spool != nil {
+		m.spool.refs.Add(1)
+	}
+}
+
+func (m InboundMessage) release() {
+	if m.spool != nil && m.spool.refs.Add(-1) == 0 {
+		os.Remove(m.spool.path)
+	}
+}
@@ -0,0 +1,39 @@
+package echo
+
+import (
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+func (r *Replier) UseSuppressions(list *suppression.List) {
+	r.suppressions = list
+}
+
+func (r *Replier) suppressed(recipient string) bool {
+	entry, ok := r.suppressions.Match(recipient)
+	if ok && r.logger != nil {
+		r.logger.Printf("suppressed reply to=%q type=%s value=%q source=%s", recipient, entry.Type, entry.Value, entry.Source)
+	}
+	return ok
+}
+
+func (r *Replier) recordHardBounce(recipient string, deliveryErr error) {
+	r.recordBounceStatus(recipient, deliveryStatusCode(deliveryErr))
+}
+
+func (r *Replier) recordBounceStatus(recipient string, status string) {
+	if !strings.HasPrefix(status, "5.") {
+		return
+	}
+	suppressed, err := r.suppressions.RecordBounce(recipient)
+	if r.logger == nil {
+		return
+	}
+	if err != nil {
+		r.logger.Printf("record hard bounce for %q: %v", recipient, err)
+	}
+	if suppressed {
+		r.logger.Printf("suppressing %q after repeated hard bounces", recipient)
+	}
+}
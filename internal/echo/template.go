@@ -0,0 +1,106 @@
+package echo
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+type replyTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+type templateData struct {
+	Subject    string
+	From       string
+	Sender     string
+	Recipients []string
+	Tag        string
+	Sequence   int64
+	Body       string
+	HTMLBody   string
+	Report     string
+	ReceivedAt time.Time
+	RemoteAddr string
+	LocalAddr  string
+	Helo       string
+	TLS        string
+	AuthUser   string
+	Auth       mailauth.Results
+}
+
+func loadReplyTemplates(cfg *config.ReplyTemplateConfig) (*replyTemplates, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	templates := &replyTemplates{}
+	if cfg.Text != "" {
+		parsed, err := texttemplate.New(filepath.Base(cfg.Text)).ParseFiles(cfg.Text)
+		if err != nil {
+			return nil, fmt.Errorf("parse reply text template: %w", err)
+		}
+		templates.text = parsed
+	}
+	if cfg.HTML != "" {
+		parsed, err := htmltemplate.New(filepath.Base(cfg.HTML)).ParseFiles(cfg.HTML)
+		if err != nil {
+			return nil, fmt.Errorf("parse reply html template: %w", err)
+		}
+		templates.html = parsed
+	}
+	return templates, nil
+}
+
+func newTemplateData(msg InboundMessage, header mail.Header, original replyBody, results mailauth.Results, report string) templateData {
+	data := templateData{
+		From:       header.Get("From"),
+		Sender:     msg.EnvelopeFrom,
+		Recipients: msg.Recipients,
+		Tag:        msg.Tag,
+		Sequence:   msg.Sequence,
+		Body:       original.Plain,
+		HTMLBody:   original.HTML,
+		Report:     report,
+		ReceivedAt: msg.ReceivedAt,
+		RemoteAddr: addrString(msg.RemoteAddr),
+		LocalAddr:  addrString(msg.LocalAddr),
+		Helo:       msg.Helo,
+		TLS:        describeTLS(msg.TLS),
+		AuthUser:   msg.AuthUser,
+		Auth:       results,
+	}
+	data.Subject, _ = header.Subject()
+	return data
+}
+
+func (t *replyTemplates) render(data templateData) (replyBody, error) {
+	var body replyBody
+	if t.text != nil {
+		var buf bytes.Buffer
+		if err := t.text.Execute(&buf, data); err != nil {
+			return replyBody{}, fmt.Errorf("render reply text template: %w", err)
+		}
+		body.Plain = buf.String()
+	}
+	if t.html != nil {
+		var buf bytes.Buffer
+		if err := t.html.Execute(&buf, data); err != nil {
+			return replyBody{}, fmt.Errorf("render reply html template: %w", err)
+		}
+		body.HTML = buf.String()
+	}
+	if body.Plain == "" && body.HTML != "" {
+		body.Plain = htmlToText(body.HTML)
+	}
+	return body, nil
+}
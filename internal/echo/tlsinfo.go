@@ -0,0 +1,167 @@
+package echo
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	stdhtml "html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var errClientCertRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Client certificate required, use STARTTLS with a certificate",
+}
+
+type reportField struct {
+	name  string
+	value string
+}
+
+func (b *Backend) listenerTLSMode(addr string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.implicitTLS[addr] {
+		return config.TLSModeImplicit
+	}
+	return config.TLSModeStartTLS
+}
+
+func (b *Backend) clientCertRequired() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.requireClientCert
+}
+
+func (s *session) checkClientCert() error {
+	if !s.backend.clientCertRequired() {
+		return nil
+	}
+	if s.conn != nil {
+		if state, ok := s.conn.TLSConnectionState(); ok && len(state.PeerCertificates) > 0 {
+			return nil
+		}
+	}
+	return errClientCertRequired
+}
+
+func newImplicitTLS(listeners []config.ListenerConfig) map[string]bool {
+	implicit := make(map[string]bool)
+	for _, listener := range listeners {
+		if listener.TLSMode == config.TLSModeImplicit {
+			implicit[listener.Addr] = true
+		}
+	}
+	return implicit
+}
+
+func tlsVersionName(version uint16) string {
+	return strings.ReplaceAll(tls.VersionName(version), " ", "v")
+}
+
+func describeTLSMode(mode string) string {
+	switch mode {
+	case config.TLSModeImplicit:
+		return "implicit TLS"
+	case config.TLSModeStartTLS:
+		return "STARTTLS"
+	}
+	return "TLS"
+}
+
+func tlsFields(msg InboundMessage) []reportField {
+	state := msg.TLS
+	if state == nil {
+		return []reportField{{"Mode", "none (plaintext)"}}
+	}
+
+	fields := []reportField{
+		{"Mode", describeTLSMode(msg.TLSMode)},
+		{"Version", tlsVersionName(state.Version)},
+		{"Cipher", tls.CipherSuiteName(state.CipherSuite)},
+		{"Server name", displayOrNone(state.ServerName)},
+		{"Resumed", yesNo(state.DidResume)},
+	}
+	if len(state.PeerCertificates) == 0 {
+		return append(fields, reportField{"Client cert", "(none)"})
+	}
+	cert := state.PeerCertificates[0]
+	fields = append(fields,
+		reportField{"Client cert", cert.Subject.String()},
+		reportField{"Cert issuer", cert.Issuer.String()},
+		reportField{"Cert expires", cert.NotAfter.UTC().Format(time.RFC3339)},
+		reportField{"Cert SHA-256", certFingerprint(cert)},
+		reportField{"Cert verified", describeCertVerification(state)},
+	)
+	for i, chainCert := range state.PeerCertificates[1:] {
+		fields = append(fields, reportField{"Chain cert " + strconv.Itoa(i+1), chainCert.Subject.String() + " (" + certFingerprint(chainCert) + ")"})
+	}
+	return fields
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func describeCertVerification(state *tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 {
+		return "no (not checked against a client CA)"
+	}
+	chain := state.VerifiedChains[0]
+	return "yes, issued by " + chain[len(chain)-1].Subject.String()
+}
+
+func formatTLSHeader(msg InboundMessage) string {
+	state := msg.TLS
+	if state == nil {
+		return "none"
+	}
+
+	mode := msg.TLSMode
+	if mode == "" {
+		mode = "tls"
+	}
+	values := []string{
+		"mode=" + mode,
+		"version=" + tlsVersionName(state.Version),
+		"cipher=" + tls.CipherSuiteName(state.CipherSuite),
+	}
+	if state.ServerName != "" {
+		values = append(values, "sni="+state.ServerName)
+	}
+	values = append(values, "resumed="+yesNo(state.DidResume))
+	if len(state.PeerCertificates) > 0 {
+		values = append(values, "client-cert="+strconv.Quote(state.PeerCertificates[0].Subject.String()))
+	} else {
+		values = append(values, "client-cert=none")
+	}
+	return strings.Join(values, "; ")
+}
+
+func writeTLSSection(report *strings.Builder, msg InboundMessage) {
+	writeReportSection(report, "TLS")
+	for _, field := range tlsFields(msg) {
+		writeReportField(report, field.name, field.value)
+	}
+}
+
+func prependTLSSection(body replyBody, msg InboundMessage) replyBody {
+	var section strings.Builder
+	writeTLSSection(&section, msg)
+	text := strings.TrimPrefix(section.String(), "\n")
+
+	body.Plain = text + "\n" + body.Plain
+	if body.HTML != "" {
+		body.HTML = "<pre>" + stdhtml.EscapeString(text) + "</pre>\n<hr>\n" + body.HTML
+	}
+	return body
+}
@@ -0,0 +1,147 @@
+package echo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/dane"
+	"github.com/danthegoodman1/smtp_echo/internal/mtasts"
+)
+
+type tlsRequirement struct {
+	source           string
+	plaintext        bool
+	verifyConnection func(tls.ConnectionState) error
+}
+
+type outboundTLS struct {
+	policy             string
+	minVersion         uint16
+	rootCAs            *x509.CertPool
+	insecureSkipVerify bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (r *Replier) configureOutboundTLS(cfg config.DeliveryConfig) error {
+	r.outbound = outboundTLS{
+		policy:             cfg.TLSPolicy,
+		minVersion:         tlsVersions[cfg.MinTLSVersion],
+		insecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if r.outbound.policy == "" {
+		r.outbound.policy = config.TLSPolicyOpportunistic
+	}
+	if r.outbound.minVersion == 0 {
+		r.outbound.minVersion = tls.VersionTLS12
+	}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("read delivery.ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("delivery.ca_file %s contains no pem certificates", cfg.CAFile)
+		}
+		r.outbound.rootCAs = pool
+	}
+
+	if cfg.MTASTS {
+		r.mtaSTS = mtasts.NewFetcher(r.resolver)
+	}
+	if cfg.DANE && r.dnsCache != nil {
+		r.tlsa = dane.NewDNSResolverWithClient(r.dnsCache.Servers(), r.dnsCache.Client())
+	} else if cfg.DANE {
+		resolver, err := dane.NewSystemResolver()
+		if err != nil {
+			if r.logger != nil {
+				r.logger.Printf("dane disabled: %v", err)
+			}
+			return nil
+		}
+		r.tlsa = resolver
+	}
+	return nil
+}
+
+func (r *Replier) clientTLSConfig(host string, requirement tlsRequirement) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		MinVersion:         r.outbound.minVersion,
+		RootCAs:            r.outbound.rootCAs,
+		InsecureSkipVerify: r.outbound.insecureSkipVerify && requirement.source != "mta-sts",
+	}
+	if requirement.verifyConnection != nil {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = requirement.verifyConnection
+	}
+	return tlsConfig
+}
+
+func (r *Replier) lookupMTASTS(ctx context.Context, domain string) *mtasts.Policy {
+	if r.mtaSTS == nil {
+		return nil
+	}
+	policy, err := r.mtaSTS.Lookup(ctx, domain)
+	if err != nil {
+		if r.logger != nil {
+			r.logger.Printf("mta-sts policy for %s unavailable: %v", domain, err)
+		}
+		return nil
+	}
+	return policy
+}
+
+func (r *Replier) outboundTLS(ctx context.Context, host string, policy *mtasts.Policy) (tlsRequirement, error) {
+	if r.tlsa != nil {
+		records, err := r.tlsa.LookupTLSA(ctx, host, 25)
+		if err != nil {
+			return tlsRequirement{}, fmt.Errorf("dane tlsa lookup: %w", err)
+		}
+		if len(records) > 0 {
+			return tlsRequirement{
+				source: "dane",
+				verifyConnection: func(state tls.ConnectionState) error {
+					return dane.Verify(records, host, state)
+				},
+			}, nil
+		}
+	}
+
+	if policy != nil {
+		switch policy.Mode {
+		case mtasts.ModeEnforce:
+			if !policy.Matches(host) {
+				return tlsRequirement{}, fmt.Errorf("mx host %s is not permitted by mta-sts policy", host)
+			}
+			return tlsRequirement{source: "mta-sts"}, nil
+		case mtasts.ModeTesting:
+			if !policy.Matches(host) && r.logger != nil {
+				r.logger.Printf("mta-sts testing: mx host %s is not listed in policy", host)
+			}
+		}
+	}
+
+	return r.policyRequirement(), nil
+}
+
+func (r *Replier) policyRequirement() tlsRequirement {
+	switch r.outbound.policy {
+	case config.TLSPolicyRequire:
+		return tlsRequirement{source: "delivery.tls_policy"}
+	case config.TLSPolicyNone:
+		return tlsRequirement{plaintext: true}
+	default:
+		return tlsRequirement{}
+	}
+}
@@ -0,0 +1,135 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+)
+
+const tooLargeHeadBytes = 64 * 1024
+
+var errMessageTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message exceeds fixed maximum message size",
+}
+
+type tooLargeReplier interface {
+	replyTooLarge(ctx context.Context, msg InboundMessage, limit int64) error
+}
+
+type headCapture struct {
+	r    io.Reader
+	head []byte
+}
+
+func (c *headCapture) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if room := tooLargeHeadBytes - len(c.head); room > 0 {
+		c.head = append(c.head, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+func (b *Backend) summarizeTooLarge() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tooLargeSummary
+}
+
+func (s *session) rejectTooLarge(head *headCapture) error {
+	var limit int64
+	if s.conn != nil {
+		limit = s.conn.Server().MaxMessageBytes
+	}
+	s.backend.activity.Record(activity.Entry{
+		Time:         time.Now().UTC(),
+		RemoteAddr:   addrString(s.remoteAddr()),
+		EnvelopeFrom: s.envelopeFrom,
+		Recipients:   append([]string(nil), s.recipients...),
+		Status:       activity.StatusTooLarge,
+		Error:        errMessageTooLarge.Error(),
+	})
+	s.backend.logf("message too large from=%q remote=%s limit=%d", s.envelopeFrom, addrString(s.remoteAddr()), limit)
+	if head == nil {
+		return errMessageTooLarge
+	}
+
+	s.backend.mu.RLock()
+	replier, ok := s.backend.processor.(tooLargeReplier)
+	s.backend.mu.RUnlock()
+	if !ok {
+		return errMessageTooLarge
+	}
+	msg := InboundMessage{
+		EnvelopeFrom: s.envelopeFrom,
+		Recipients:   append([]string(nil), s.recipients...),
+		Tag:          s.tag,
+		Data:         head.head,
+		ReceivedAt:   time.Now().UTC(),
+		SMTPUTF8:     s.smtpUTF8,
+		BodyType:     s.bodyType,
+		DSN:          s.dsn,
+	}
+	msg.Sequence = s.backend.sequences.next(msg.EnvelopeFrom)
+	s.applyConnection(&msg)
+
+	ctx, cancel := s.backend.processingContext(s.context())
+	defer cancel()
+	if err := replier.replyTooLarge(ctx, msg, limit); err != nil {
+		s.backend.logf("too large summary from=%q: %v", s.envelopeFrom, err)
+	}
+	return errMessageTooLarge
+}
+
+func (r *Replier) replyTooLarge(ctx context.Context, msg InboundMessage, limit int64) error {
+	recipient := normalizeRecipientAddress(msg.EnvelopeFrom)
+	if recipient == "" || r.suppressed(recipient) {
+		return nil
+	}
+
+	_, buildSpan := tracer.Start(ctx, "echo.build")
+	defer buildSpan.End()
+
+	var meta threadMetadata
+	var subject string
+	if header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg.Data))); err == nil {
+		meta = extractThreadMetadata(mail.Header{Header: message.Header{Header: header}})
+		subject = meta.Subject
+	}
+	meta.ReplySubject = "Your message was too large"
+	meta.References = r.threadReferences(msg, meta.References)
+
+	plain := fmt.Sprintf("Your message was larger than the %d byte limit of this server, so it was rejected with 552 5.3.4 and not echoed.\n", limit)
+	if subject != "" {
+		plain += fmt.Sprintf("\nSubject: %s\n", subject)
+	}
+	plain += fmt.Sprintf("Recipients: %d\n", len(msg.Recipients))
+
+	extraHeader := []headerField{
+		{"Received", formatReceived(msg, r.hostname)},
+		{"X-Echo-Too-Large", fmt.Sprintf("limit=%d", limit)},
+	}
+	extraHeader = append(extraHeader, tagHeaders(msg.Tag)...)
+	extraHeader = append(extraHeader, r.sequenceHeaders(msg)...)
+	extraHeader = append(extraHeader, dsnHeaders(msg.DSN)...)
+	extraHeader = append(extraHeader, traceHeaders(ctx)...)
+
+	identity := r.identityFor(msg.Recipients)
+	replyMessage, err := r.buildReplyMessage(identity, recipient, replyBody{Plain: plain}, meta, extraHeader, nil)
+	if err != nil {
+		return err
+	}
+	buildSpan.End()
+	return r.sendReply(ctx, msg, identity, recipient, replyMessage)
+}
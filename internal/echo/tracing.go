@@ -0,0 +1,45 @@
+package echo
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/danthegoodman1/smtp_echo/internal/echo")
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func traceHeaders(ctx context.Context) []headerField {
+	traceID := trace.SpanContextFromContext(ctx).TraceID()
+	if !traceID.IsValid() {
+		return nil
+	}
+	return []headerField{{"X-Echo-Trace-Id", traceID.String()}}
+}
+
+func messageAttributes(msg InboundMessage) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.Int64("smtp_echo.message_id", msg.ID),
+		attribute.String("smtp.mail_from", msg.EnvelopeFrom),
+		attribute.Int("smtp.recipients", len(msg.Recipients)),
+		attribute.Int64("smtp_echo.message_size", msg.Size()),
+	)
+}
+
+func recordAttempt(ctx context.Context, host string, err error) {
+	attributes := []attribute.KeyValue{attribute.String("smtp_echo.host", host)}
+	if err != nil {
+		attributes = append(attributes, attribute.String("error.message", err.Error()))
+	}
+	trace.SpanFromContext(ctx).AddEvent("delivery attempt", trace.WithAttributes(attributes...))
+}
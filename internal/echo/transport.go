@@ -0,0 +1,124 @@
+package echo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+type replyOutput struct {
+	mu  sync.Mutex
+	w   io.Writer
+	dir string
+	now func() time.Time
+}
+
+type replyRecord struct {
+	Time          time.Time `json:"time"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	Size          int       `json:"size"`
+	Message       string    `json:"message,omitempty"`
+	MessageBase64 []byte    `json:"message_base64,omitempty"`
+}
+
+func (r *Replier) configureTransport(cfg config.DeliveryConfig) error {
+	switch r.deliveryMode {
+	case config.DeliveryModeNone:
+		r.deliverFn = r.discardReply
+	case config.DeliveryModeStdout:
+		r.output = &replyOutput{w: os.Stdout, now: time.Now}
+		r.deliverFn = r.writeReplyRecord
+	case config.DeliveryModeFile:
+		if err := os.MkdirAll(cfg.OutputDir, 0o750); err != nil {
+			return fmt.Errorf("create delivery output dir: %w", err)
+		}
+		r.output = &replyOutput{dir: cfg.OutputDir, now: time.Now}
+		r.deliverFn = r.writeReplyFile
+	default:
+		r.deliverFn = r.deliverFrom
+		r.bounceFn = r.deliverNullSender
+		return nil
+	}
+	deliver := r.deliverFn
+	r.bounceFn = func(ctx context.Context, to string, message []byte) error {
+		return deliver(ctx, "", to, message)
+	}
+	return nil
+}
+
+func (r *Replier) sendsMail() bool {
+	return r.deliveryMode == "" || r.deliveryMode == config.DeliveryModeSMTP
+}
+
+func (r *Replier) discardsReplies() bool {
+	return r.deliveryMode == config.DeliveryModeNone
+}
+
+func (r *Replier) discardReply(_ context.Context, from string, to string, message []byte) error {
+	if r.logger != nil {
+		r.logger.Printf("delivery disabled, not sending reply from=%q to=%q bytes=%d", from, to, len(message))
+	}
+	return nil
+}
+
+func (r *Replier) writeReplyRecord(_ context.Context, from string, to string, message []byte) error {
+	record := replyRecord{Time: r.output.now().UTC(), From: from, To: to, Size: len(message)}
+	if utf8.Valid(message) {
+		record.Message = string(message)
+	} else {
+		record.MessageBase64 = message
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encode reply record: %w", err)
+	}
+
+	r.output.mu.Lock()
+	defer r.output.mu.Unlock()
+	if _, err := r.output.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write reply record: %w", err)
+	}
+	return nil
+}
+
+func (r *Replier) writeReplyFile(_ context.Context, from string, to string, message []byte) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("generate reply file name: %w", err)
+	}
+	name := r.output.now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	file, err := os.CreateTemp(r.output.dir, "."+name+"-*")
+	if err != nil {
+		return fmt.Errorf("create reply file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "Return-Path: <%s>\r\nDelivered-To: %s\r\n", from, to)
+	if err == nil {
+		_, err = file.Write(message)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(r.output.dir, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("write reply file %s: %w", name, err)
+	}
+	if r.logger != nil {
+		r.logger.Printf("wrote reply to=%q file=%s", to, name)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package echo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	defaultVERPSeparator = "+"
+	verpTagLength        = 12
+)
+
+type verpEncoding struct {
+	scheme    string
+	separator string
+	secret    []byte
+}
+
+type verpAddress struct {
+	recipient string
+	replyID   int64
+}
+
+func newVERPEncoding(cfg *config.VERPConfig) *verpEncoding {
+	if cfg == nil {
+		return nil
+	}
+	return &verpEncoding{scheme: cfg.Scheme, separator: cfg.Separator, secret: []byte(cfg.Secret)}
+}
+
+func (v *verpEncoding) envelopeSender(mailFrom string, recipient string, replyID int64) string {
+	if v == nil || mailFrom == "" {
+		return mailFrom
+	}
+	local, domain, ok := strings.Cut(mailFrom, "@")
+	if !ok {
+		return mailFrom
+	}
+	if v.scheme == config.VERPSchemeReplyID && replyID != 0 {
+		return local + v.separator + v.sign("r"+strconv.FormatInt(replyID, 10)) + "@" + domain
+	}
+	user, recipientDomain, ok := strings.Cut(normalizeRecipientAddress(recipient), "@")
+	if !ok || user == "" || strings.ContainsAny(user, "\" \\@") {
+		return mailFrom
+	}
+	return local + v.separator + v.sign(user+"="+recipientDomain) + "@" + domain
+}
+
+func (v *verpEncoding) sign(encoded string) string {
+	return encoded + "=" + v.tag(encoded)
+}
+
+func (v *verpEncoding) tag(encoded string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(strings.ToLower(encoded)))
+	return hex.EncodeToString(mac.Sum(nil))[:verpTagLength]
+}
+
+func (v *verpEncoding) decode(address string, bounceAddress string) (verpAddress, bool) {
+	separator := defaultVERPSeparator
+	if v != nil {
+		separator = v.separator
+	}
+	local, domain, ok := strings.Cut(address, "@")
+	bounceLocal, bounceDomain, bounceOK := strings.Cut(bounceAddress, "@")
+	if !ok || !bounceOK || domain != bounceDomain {
+		return verpAddress{}, false
+	}
+	if local == bounceLocal {
+		return verpAddress{}, true
+	}
+	signed, ok := strings.CutPrefix(local, bounceLocal+separator)
+	if !ok {
+		return verpAddress{}, false
+	}
+	if v == nil || len(v.secret) == 0 {
+		return verpAddress{}, true
+	}
+	at := strings.LastIndexByte(signed, '=')
+	if at < 0 || !hmac.Equal([]byte(signed[at+1:]), []byte(v.tag(signed[:at]))) {
+		return verpAddress{}, true
+	}
+	encoded := signed[:at]
+	if at := strings.LastIndexByte(encoded, '='); at > 0 && at < len(encoded)-1 {
+		return verpAddress{recipient: encoded[:at] + "@" + encoded[at+1:]}, true
+	}
+	if digits, ok := strings.CutPrefix(encoded, "r"); ok {
+		if id, err := strconv.ParseInt(digits, 10, 64); err == nil && id > 0 {
+			return verpAddress{replyID: id}, true
+		}
+	}
+	return verpAddress{}, true
+}
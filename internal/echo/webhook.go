@@ -0,0 +1,78 @@
+package echo
+
+import (
+	"crypto/tls"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/danthegoodman1/smtp_echo/internal/activity"
+	"github.com/danthegoodman1/smtp_echo/internal/webhook"
+)
+
+func (b *Backend) notifyWebhooks(msg InboundMessage, echoErr error) {
+	if !b.webhooks.Enabled() {
+		return
+	}
+	b.webhooks.Notify(buildWebhookPayload(msg, echoErr))
+}
+
+func buildWebhookPayload(msg InboundMessage, echoErr error) webhook.Payload {
+	payload := webhook.Payload{
+		Event:      webhook.EventMessageEchoed,
+		ID:         msg.ID,
+		ReceivedAt: msg.ReceivedAt,
+		Envelope: webhook.Envelope{
+			MailFrom:   msg.EnvelopeFrom,
+			RcptTo:     msg.Recipients,
+			Tag:        msg.Tag,
+			Sequence:   msg.Sequence,
+			RemoteAddr: addrString(msg.RemoteAddr),
+			LocalAddr:  addrString(msg.LocalAddr),
+			Helo:       msg.Helo,
+			AuthUser:   msg.AuthUser,
+			Size:       int(msg.Size()),
+		},
+		Headers:  map[string][]string{},
+		Delivery: webhook.Delivery{Status: activity.StatusEchoed},
+	}
+	if msg.TLS != nil {
+		payload.Envelope.TLS = &webhook.TLS{
+			Mode:        msg.TLSMode,
+			Version:     tlsVersionName(msg.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(msg.TLS.CipherSuite),
+			ServerName:  msg.TLS.ServerName,
+		}
+	}
+	if echoErr != nil {
+		payload.Event = webhook.EventMessageFailed
+		payload.Delivery = webhook.Delivery{Status: activity.StatusFailed, Error: echoErr.Error()}
+	}
+
+	data, err := msg.Open()
+	if err != nil {
+		return payload
+	}
+	defer data.Close()
+
+	reader, err := mail.CreateReader(data)
+	if err != nil {
+		payload.Body.Plain = msg.rawBody()
+		return payload
+	}
+	defer reader.Close()
+
+	fields := reader.Header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		payload.Headers[fields.Key()] = append(payload.Headers[fields.Key()], value)
+	}
+
+	body, err := readReplyBody(reader, msg, "")
+	if err == nil {
+		payload.Body = webhook.Body{Plain: body.Plain, HTML: body.HTML}
+	}
+	return payload
+}
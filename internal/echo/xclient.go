@@ -0,0 +1,38 @@
+package echo
+
+import (
+	"github.com/danthegoodman1/smtp_echo/internal/xclient"
+)
+
+func (s *session) applyForwarded(msg *InboundMessage) {
+	if s.conn == nil {
+		return
+	}
+	conn, ok := xclient.FromConn(s.conn.Conn())
+	if !ok {
+		return
+	}
+	attrs, ok := conn.Attributes()
+	if !ok {
+		return
+	}
+	msg.ForwardedBy = conn.ProxyAddr()
+	if attrs.Helo != "" {
+		msg.Helo = attrs.Helo
+	}
+	if msg.AuthUser == "" {
+		msg.AuthUser = attrs.Login
+	}
+}
+
+func (s *session) heloName() string {
+	if s.conn == nil {
+		return ""
+	}
+	if conn, ok := xclient.FromConn(s.conn.Conn()); ok {
+		if attrs, ok := conn.Attributes(); ok && attrs.Helo != "" {
+			return attrs.Helo
+		}
+	}
+	return s.conn.Hostname()
+}
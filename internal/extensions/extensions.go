@@ -0,0 +1,198 @@
+package extensions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var enhancedCode = regexp.MustCompile(`^([0-9]{3}[ -])[245]\.[0-9]{1,3}\.[0-9]{1,3} `)
+
+type Listener struct {
+	net.Listener
+	Disabled []string
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.Disabled), nil
+}
+
+type expectation int
+
+const (
+	expectNone expectation = iota
+	expectEHLO
+	expectData
+	expectTLS
+)
+
+type Conn struct {
+	net.Conn
+	disabled map[string]bool
+	reader   *bufio.Reader
+	pending  []byte
+	readErr  error
+	midLine  bool
+	data     bool
+	tls      bool
+	chunk    int64
+	expect   expectation
+	partial  []byte
+	ehlo     [][]byte
+}
+
+func NewConn(conn net.Conn, disabled []string) *Conn {
+	c := &Conn{Conn: conn, disabled: make(map[string]bool), reader: bufio.NewReader(conn)}
+	for _, extension := range disabled {
+		c.disabled[strings.ToUpper(extension)] = true
+	}
+	return c
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.tls {
+			return c.reader.Read(p)
+		}
+		if c.chunk > 0 {
+			return c.readChunk(p)
+		}
+
+		line, err := c.reader.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			c.readErr = err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		atLineStart := !c.midLine
+		c.midLine = line[len(line)-1] != '\n'
+		if atLineStart && !c.midLine {
+			c.handleLine(line)
+		}
+		c.pending = append(c.pending[:0], line...)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readChunk(p []byte) (int, error) {
+	if int64(len(p)) > c.chunk {
+		p = p[:c.chunk]
+	}
+	n, err := c.reader.Read(p)
+	c.chunk -= int64(n)
+	return n, err
+}
+
+func (c *Conn) handleLine(line []byte) {
+	if c.data {
+		if trimmed := bytes.TrimRight(line, "\r\n"); len(trimmed) == 1 && trimmed[0] == '.' {
+			c.data = false
+		}
+		return
+	}
+
+	command, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	switch strings.ToUpper(command) {
+	case "EHLO":
+		c.expect = expectEHLO
+	case "DATA":
+		c.expect = expectData
+	case "STARTTLS":
+		c.expect = expectTLS
+	case "BDAT":
+		fields := strings.Fields(arg)
+		if len(fields) > 0 {
+			if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && size >= 0 {
+				c.chunk = size
+			}
+		}
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.tls {
+		return c.Conn.Write(p)
+	}
+	c.partial = append(c.partial, p...)
+	var out bytes.Buffer
+	startTLS := false
+	for {
+		end := bytes.IndexByte(c.partial, '\n')
+		if end < 0 {
+			break
+		}
+		line := bytes.Clone(c.partial[:end+1])
+		c.partial = c.partial[end+1:]
+		startTLS = c.writeLine(&out, line) || startTLS
+	}
+	c.partial = bytes.Clone(c.partial)
+	if out.Len() > 0 {
+		if _, err := c.Conn.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	c.tls = startTLS
+	return len(p), nil
+}
+
+func (c *Conn) writeLine(out *bytes.Buffer, line []byte) bool {
+	expect := c.expect
+	if expect == expectEHLO && len(line) > 3 && bytes.HasPrefix(line, []byte("250")) {
+		c.ehlo = append(c.ehlo, line)
+		if line[3] == ' ' {
+			c.expect = expectNone
+			c.writeEHLO(out)
+		}
+		return false
+	}
+	c.expect = expectNone
+	if expect == expectData {
+		c.data = bytes.HasPrefix(line, []byte("354"))
+	}
+	if c.disabled["ENHANCEDSTATUSCODES"] {
+		line = enhancedCode.ReplaceAll(line, []byte("$1"))
+	}
+	out.Write(line)
+	return expect == expectTLS && bytes.HasPrefix(line, []byte("220"))
+}
+
+func (c *Conn) writeEHLO(out *bytes.Buffer) {
+	lines := [][]byte{c.ehlo[0]}
+	for _, line := range c.ehlo[1:] {
+		keyword, _, _ := strings.Cut(strings.TrimSpace(string(line[4:])), " ")
+		if !c.disabled[strings.ToUpper(keyword)] {
+			lines = append(lines, line)
+		}
+	}
+	c.ehlo = nil
+	for i, line := range lines {
+		separator := byte('-')
+		if i == len(lines)-1 {
+			separator = ' '
+		}
+		out.Write(line[:3])
+		out.WriteByte(separator)
+		out.Write(line[4:])
+	}
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
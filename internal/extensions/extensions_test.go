@@ -0,0 +1,133 @@
+package extensions
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+type capture struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (c *capture) NewSession(*smtp.Conn) (smtp.Session, error) {
+	return &captureSession{capture: c}, nil
+}
+
+type captureSession struct {
+	capture *capture
+}
+
+func (s *captureSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *captureSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (s *captureSession) Reset()                               {}
+func (s *captureSession) Logout() error                        { return nil }
+
+func (s *captureSession) Data(r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.capture.mu.Lock()
+	defer s.capture.mu.Unlock()
+	s.capture.bodies = append(s.capture.bodies, string(body))
+	return nil
+}
+
+func startServer(t *testing.T, disabled ...string) (*capture, *textproto.Conn) {
+	t.Helper()
+	backend := &capture{}
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	server.MaxMessageBytes = 1024
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(&Listener{Listener: listener, Disabled: disabled})
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("greeting error = %v", err)
+	}
+	return backend, conn
+}
+
+func command(t *testing.T, conn *textproto.Conn, expectCode int, format string, args ...any) string {
+	t.Helper()
+	id, err := conn.Cmd(format, args...)
+	if err != nil {
+		t.Fatalf("Cmd(%q) error = %v", format, err)
+	}
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+	_, message, err := conn.ReadResponse(expectCode)
+	if err != nil {
+		t.Fatalf("%s response error = %v", strings.Fields(format)[0], err)
+	}
+	return message
+}
+
+func TestConn_DisabledExtensions(t *testing.T) {
+	backend, conn := startServer(t, "pipelining", "SIZE", "ENHANCEDSTATUSCODES")
+
+	capabilities := strings.Split(command(t, conn, 250, "EHLO client.example.net"), "\n")
+	if capabilities[0] != "Hello client.example.net" {
+		t.Fatalf("EHLO greeting = %q, want the hello line first", capabilities[0])
+	}
+	for _, capability := range capabilities[1:] {
+		if capability == "PIPELINING" || capability == "ENHANCEDSTATUSCODES" || strings.HasPrefix(capability, "SIZE") {
+			t.Fatalf("EHLO capabilities = %q, want %s removed", capabilities, capability)
+		}
+	}
+	if !strings.Contains(strings.Join(capabilities, " "), "CHUNKING") {
+		t.Fatalf("EHLO capabilities = %q, want the remaining extensions intact", capabilities)
+	}
+
+	if message := command(t, conn, 250, "MAIL FROM:<sender@example.net>"); strings.HasPrefix(message, "2.") {
+		t.Fatalf("MAIL response = %q, want no enhanced status code", message)
+	}
+	command(t, conn, 250, "RCPT TO:<echo@example.com>")
+	command(t, conn, 354, "DATA")
+	writer := conn.DotWriter()
+	io.WriteString(writer, "Subject: hi\r\n\r\nEHLO inside data\r\n")
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("DATA response error = %v", err)
+	}
+
+	command(t, conn, 250, "MAIL FROM:<sender@example.net>")
+	command(t, conn, 250, "RCPT TO:<echo@example.com>")
+	chunk := "Subject: bdat\r\n\r\nEHLO\r\n"
+	fmt.Fprintf(conn.W, "BDAT %d LAST\r\n%s", len(chunk), chunk)
+	if err := conn.W.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if _, message, err := conn.ReadResponse(250); err != nil || strings.HasPrefix(message, "2.") {
+		t.Fatalf("BDAT response = %q, %v, want 250 without enhanced status code", message, err)
+	}
+	if message := command(t, conn, 250, "EHLO client.example.net"); strings.Contains(message, "PIPELINING") {
+		t.Fatalf("second EHLO capabilities = %q, want PIPELINING removed", message)
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	want := []string{"Subject: hi\r\n\r\nEHLO inside data\r\n", chunk}
+	if strings.Join(backend.bodies, "|") != strings.Join(want, "|") {
+		t.Fatalf("bodies = %q, want %q", backend.bodies, want)
+	}
+}
@@ -0,0 +1,89 @@
+package greylist
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const pruneThreshold = 4096
+
+type List struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	window  time.Duration
+	expiry  time.Duration
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+type entry struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	passed    bool
+}
+
+func New(delay time.Duration, window time.Duration, expiry time.Duration) *List {
+	return &List{
+		delay:   delay,
+		window:  window,
+		expiry:  expiry,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+func (l *List) Configure(delay time.Duration, window time.Duration, expiry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = delay
+	l.window = window
+	l.expiry = expiry
+}
+
+func (l *List) Allow(ip string, sender string, recipient string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	key := ip + "\x00" + strings.ToLower(sender) + "\x00" + strings.ToLower(recipient)
+	e, ok := l.entries[key]
+	if !ok || l.expired(e, now) {
+		if len(l.entries) >= pruneThreshold {
+			l.prune(now)
+		}
+		l.entries[key] = &entry{firstSeen: now, lastSeen: now}
+		return false
+	}
+
+	e.lastSeen = now
+	if e.passed {
+		return true
+	}
+	if now.Sub(e.firstSeen) < l.delay {
+		return false
+	}
+	e.passed = true
+	return true
+}
+
+func (l *List) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+func (l *List) expired(e *entry, now time.Time) bool {
+	if e.passed {
+		return now.Sub(e.lastSeen) > l.expiry
+	}
+	return now.Sub(e.firstSeen) > l.window
+}
+
+func (l *List) prune(now time.Time) {
+	for key, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, key)
+		}
+	}
+}
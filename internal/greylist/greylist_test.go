@@ -0,0 +1,37 @@
+package greylist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListAllow_AcceptsRetriesWithinWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := New(time.Minute, time.Hour, 24*time.Hour)
+	list.now = func() time.Time { return now }
+
+	if list.Allow("192.0.2.1", "sender@example.net", "echo@example.com") {
+		t.Fatalf("Allow() first attempt = true, want false")
+	}
+	now = now.Add(30 * time.Second)
+	if list.Allow("192.0.2.1", "sender@example.net", "echo@example.com") {
+		t.Fatalf("Allow() before delay = true, want false")
+	}
+	now = now.Add(time.Minute)
+	if !list.Allow("192.0.2.1", "Sender@Example.net", "echo@example.com") {
+		t.Fatalf("Allow() retry within window = false, want true")
+	}
+	if list.Allow("192.0.2.2", "sender@example.net", "echo@example.com") {
+		t.Fatalf("Allow() from a new ip = true, want false")
+	}
+
+	now = now.Add(12 * time.Hour)
+	if !list.Allow("192.0.2.1", "sender@example.net", "echo@example.com") {
+		t.Fatalf("Allow() for a passed triple = false, want true until expiry")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if list.Allow("192.0.2.2", "sender@example.net", "echo@example.com") {
+		t.Fatalf("Allow() retry after window = true, want false and a new first attempt")
+	}
+}
@@ -0,0 +1,320 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+const inboxName = "INBOX"
+
+var errReadOnly = errors.New("mailbox is read-only")
+
+type Server struct {
+	imap *server.Server
+}
+
+func NewServer(cfg config.IMAPConfig, st store.Store, tlsConfig *tls.Config, logger *log.Logger) *Server {
+	imapServer := server.New(&storeBackend{
+		username:    cfg.Username,
+		password:    cfg.Password,
+		store:       st,
+		uidValidity: uint32(time.Now().Unix()),
+	})
+	imapServer.Addr = cfg.ListenAddr
+	imapServer.AllowInsecureAuth = cfg.AllowInsecure
+	imapServer.TLSConfig = tlsConfig
+	if logger != nil {
+		imapServer.ErrorLog = logger
+	}
+	return &Server{imap: imapServer}
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.imap.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	err := s.imap.Serve(listener)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(_ context.Context) error {
+	return s.imap.Close()
+}
+
+type storeBackend struct {
+	username    string
+	password    string
+	store       store.Store
+	uidValidity uint32
+}
+
+func (b *storeBackend) Login(_ *imap.ConnInfo, username string, password string) (backend.User, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(b.username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(b.password)) == 1
+	if !userOK || !passwordOK {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &user{backend: b}, nil
+}
+
+type user struct {
+	backend *storeBackend
+}
+
+func (u *user) Username() string {
+	return u.backend.username
+}
+
+func (u *user) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	inbox, err := u.GetMailbox(inboxName)
+	if err != nil {
+		return nil, err
+	}
+	return []backend.Mailbox{inbox}, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, inboxName) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	messages, err := u.loadMessages()
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox{backend: u.backend, messages: messages}, nil
+}
+
+func (u *user) loadMessages() ([]store.Message, error) {
+	var messages []store.Message
+	for offset := 0; ; {
+		page, err := u.backend.store.SearchMessages(context.Background(), store.Query{Limit: 1000, Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, page...)
+		if len(page) < 1000 {
+			break
+		}
+		offset += len(page)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+func (u *user) CreateMailbox(string) error {
+	return errReadOnly
+}
+
+func (u *user) DeleteMailbox(string) error {
+	return errReadOnly
+}
+
+func (u *user) RenameMailbox(string, string) error {
+	return errReadOnly
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+type mailbox struct {
+	backend  *storeBackend
+	messages []store.Message
+}
+
+func (m *mailbox) Name() string {
+	return inboxName
+}
+
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: inboxName}, nil
+}
+
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(inboxName, items)
+	status.ReadOnly = true
+	status.Flags = []string{}
+	status.PermanentFlags = []string{}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = 1
+			if len(m.messages) > 0 {
+				status.UidNext = uint32(m.messages[len(m.messages)-1].ID) + 1
+			}
+		case imap.StatusUidValidity:
+			status.UidValidity = m.backend.uidValidity
+		case imap.StatusRecent, imap.StatusUnseen:
+		}
+	}
+	return status, nil
+}
+
+func (m *mailbox) SetSubscribed(bool) error {
+	return nil
+}
+
+func (m *mailbox) Check() error {
+	return nil
+}
+
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	for i, stored := range m.messages {
+		seqNum := uint32(i + 1)
+		if !m.contains(seqSet, uid, seqNum, stored) {
+			continue
+		}
+		fetched, err := m.fetch(seqNum, stored, items)
+		if err != nil {
+			return err
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	for i, stored := range m.messages {
+		seqNum := uint32(i + 1)
+		raw, err := m.raw(stored)
+		if err != nil {
+			return nil, err
+		}
+		entity, err := message.Read(bytes.NewReader(raw))
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			continue
+		}
+		ok, err := backendutil.Match(entity, seqNum, uint32(stored.ID), stored.ReceivedAt, nil, criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, uint32(stored.ID))
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (m *mailbox) CreateMessage([]string, time.Time, imap.Literal) error {
+	return errReadOnly
+}
+
+func (m *mailbox) UpdateMessagesFlags(bool, *imap.SeqSet, imap.FlagsOp, []string) error {
+	return errReadOnly
+}
+
+func (m *mailbox) CopyMessages(bool, *imap.SeqSet, string) error {
+	return errReadOnly
+}
+
+func (m *mailbox) Expunge() error {
+	return errReadOnly
+}
+
+func (m *mailbox) contains(seqSet *imap.SeqSet, uid bool, seqNum uint32, stored store.Message) bool {
+	id := seqNum
+	if uid {
+		id = uint32(stored.ID)
+	}
+	if seqSet.Contains(id) {
+		return true
+	}
+	return int(seqNum) == len(m.messages) && seqSet.Contains(0)
+}
+
+func (m *mailbox) fetch(seqNum uint32, stored store.Message, items []imap.FetchItem) (*imap.Message, error) {
+	var raw []byte
+	headerAndBody := func() (textproto.Header, *bufio.Reader, error) {
+		if raw == nil {
+			var err error
+			if raw, err = m.raw(stored); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(raw))
+		header, err := textproto.ReadHeader(body)
+		return header, body, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags:
+			fetched.Flags = []string{}
+		case imap.FetchInternalDate:
+			fetched.InternalDate = stored.ReceivedAt
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(stored.Size)
+		case imap.FetchUid:
+			fetched.Uid = uint32(stored.ID)
+		case imap.FetchEnvelope:
+			header, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			header, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			literal, _ := backendutil.FetchBodySection(header, body, section)
+			fetched.Body[section] = literal
+		}
+	}
+	return fetched, nil
+}
+
+func (m *mailbox) raw(stored store.Message) ([]byte, error) {
+	full, err := m.backend.store.GetMessage(context.Background(), stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	return full.Raw, nil
+}
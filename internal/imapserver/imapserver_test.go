@@ -0,0 +1,95 @@
+package imapserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+func TestServer_FetchStoredMessages(t *testing.T) {
+	st := store.NewMemory()
+	for _, subject := range []string{"first", "second"} {
+		raw := "From: sender@example.com\r\nTo: echo@example.com\r\nSubject: " + subject + "\r\n\r\nbody " + subject + "\r\n"
+		if _, err := st.SaveMessage(context.Background(), store.Message{
+			ReceivedAt:   time.Now(),
+			EnvelopeFrom: "sender@example.com",
+			Recipients:   []string{"echo@example.com"},
+			Subject:      subject,
+			Size:         len(raw),
+			Raw:          []byte(raw),
+		}); err != nil {
+			t.Fatalf("SaveMessage() error = %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	server := NewServer(config.IMAPConfig{Username: "tester", Password: "secret", AllowInsecure: true}, st, nil, nil)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	c, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login("tester", "wrong"); err == nil {
+		t.Fatalf("Login(wrong password) error = nil, want error")
+	}
+	if err := c.Login("tester", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	status, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if status.Messages != 2 || !status.ReadOnly {
+		t.Fatalf("Select() messages = %d read_only = %t, want 2 and true", status.Messages, status.ReadOnly)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 2)
+	section := &imap.BodySectionName{}
+	messages := make(chan *imap.Message, 2)
+	if err := c.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, section.FetchItem()}, messages); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	var subjects []string
+	for msg := range messages {
+		subjects = append(subjects, msg.Envelope.Subject)
+		body, err := io.ReadAll(msg.GetBody(section))
+		if err != nil || !strings.Contains(string(body), "body "+msg.Envelope.Subject) {
+			t.Fatalf("fetched body = %q, %v", body, err)
+		}
+	}
+	if strings.Join(subjects, ",") != "first,second" {
+		t.Fatalf("fetched subjects = %v, want [first second]", subjects)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "second")
+	ids, err := c.UidSearch(criteria)
+	if err != nil {
+		t.Fatalf("UidSearch() error = %v", err)
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("UidSearch() = %v, want [2]", ids)
+	}
+
+	if err := c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err == nil {
+		t.Fatalf("Store() error = nil, want read-only error")
+	}
+}
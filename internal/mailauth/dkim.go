@@ -0,0 +1,55 @@
+package mailauth
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+type DKIMResult struct {
+	Result     string
+	Domain     string
+	Identifier string
+	Reason     string
+}
+
+func VerifyDKIM(ctx context.Context, resolver Resolver, message io.Reader) []DKIMResult {
+	if message == nil {
+		return []DKIMResult{{Result: ResultNone, Reason: "no message"}}
+	}
+	verifications, err := dkim.VerifyWithOptions(message, &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(ctx, domain)
+		},
+		MaxVerifications: 5,
+	})
+	if err != nil && len(verifications) == 0 {
+		return []DKIMResult{{Result: ResultPermError, Reason: err.Error()}}
+	}
+	if len(verifications) == 0 {
+		return []DKIMResult{{Result: ResultNone, Reason: "no signatures"}}
+	}
+
+	results := make([]DKIMResult, 0, len(verifications))
+	for _, verification := range verifications {
+		result := DKIMResult{
+			Result:     ResultPass,
+			Domain:     verification.Domain,
+			Identifier: verification.Identifier,
+		}
+		if verification.Err != nil {
+			result.Reason = verification.Err.Error()
+			switch {
+			case dkim.IsTempFail(verification.Err):
+				result.Result = ResultTempError
+			case dkim.IsPermFail(verification.Err):
+				result.Result = ResultPermError
+			default:
+				result.Result = ResultFail
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,118 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+type DMARCResult struct {
+	Result      string
+	Domain      string
+	Policy      string
+	SPFAligned  bool
+	DKIMAligned bool
+	Reason      string
+}
+
+func EvaluateDMARC(ctx context.Context, resolver Resolver, fromDomain string, spf SPFResult, dkimResults []DKIMResult) DMARCResult {
+	if fromDomain == "" {
+		return DMARCResult{Result: ResultNone, Reason: "no header from domain"}
+	}
+
+	record, policy, err := lookupDMARCPolicy(ctx, resolver, fromDomain)
+	if err != nil {
+		switch {
+		case errors.Is(err, dmarc.ErrNoPolicy):
+			return DMARCResult{Result: ResultNone, Domain: fromDomain, Reason: "no dmarc record"}
+		case dmarc.IsTempFail(err):
+			return DMARCResult{Result: ResultTempError, Domain: fromDomain, Reason: err.Error()}
+		default:
+			return DMARCResult{Result: ResultPermError, Domain: fromDomain, Reason: err.Error()}
+		}
+	}
+
+	result := DMARCResult{
+		Result: ResultFail,
+		Domain: fromDomain,
+		Policy: policy,
+	}
+	result.SPFAligned = spf.Result == ResultPass && domainsAligned(record.SPFAlignment, spf.Domain, fromDomain)
+	var alignedDKIM string
+	for _, dkimResult := range dkimResults {
+		if dkimResult.Result == ResultPass && domainsAligned(record.DKIMAlignment, dkimResult.Domain, fromDomain) {
+			result.DKIMAligned = true
+			alignedDKIM = dkimResult.Domain
+			break
+		}
+	}
+
+	switch {
+	case result.DKIMAligned && result.SPFAligned:
+		result.Result = ResultPass
+		result.Reason = "aligned spf (" + spf.Domain + ") and dkim (d=" + alignedDKIM + ")"
+	case result.DKIMAligned:
+		result.Result = ResultPass
+		result.Reason = "aligned dkim (d=" + alignedDKIM + ")"
+	case result.SPFAligned:
+		result.Result = ResultPass
+		result.Reason = "aligned spf (" + spf.Domain + ")"
+	default:
+		result.Reason = "no aligned spf or dkim pass"
+	}
+	return result
+}
+
+func lookupDMARCPolicy(ctx context.Context, resolver Resolver, fromDomain string) (*dmarc.Record, string, error) {
+	options := &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return resolver.LookupTXT(ctx, name)
+		},
+	}
+
+	record, err := dmarc.LookupWithOptions(fromDomain, options)
+	if err == nil {
+		return record, string(record.Policy), nil
+	}
+
+	orgDomain := organizationalDomain(fromDomain)
+	if !errors.Is(err, dmarc.ErrNoPolicy) || orgDomain == fromDomain {
+		return nil, "", err
+	}
+
+	record, err = dmarc.LookupWithOptions(orgDomain, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.SubdomainPolicy != "" {
+		return record, string(record.SubdomainPolicy), nil
+	}
+	return record, string(record.Policy), nil
+}
+
+func domainsAligned(mode dmarc.AlignmentMode, authDomain string, fromDomain string) bool {
+	authDomain = strings.ToLower(strings.TrimSuffix(authDomain, "."))
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	if authDomain == "" || fromDomain == "" {
+		return false
+	}
+	if authDomain == fromDomain {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+	return organizationalDomain(authDomain) == organizationalDomain(fromDomain)
+}
+
+func organizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
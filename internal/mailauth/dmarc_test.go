@@ -0,0 +1,72 @@
+package mailauth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEvaluateDMARC(t *testing.T) {
+	resolver := fakeResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine; aspf=s"},
+			"_dmarc.example.org": {"v=DMARC1; p=none"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		fromDomain string
+		spf        SPFResult
+		dkim       []DKIMResult
+		wantResult string
+		wantPolicy string
+		wantSPF    bool
+		wantDKIM   bool
+	}{
+		{
+			name:       "relaxed dkim alignment with subdomain signer",
+			fromDomain: "example.com",
+			dkim:       []DKIMResult{{Result: ResultPass, Domain: "mail.example.com"}},
+			wantResult: ResultPass,
+			wantPolicy: "reject",
+			wantDKIM:   true,
+		},
+		{
+			name:       "strict spf alignment rejects subdomain",
+			fromDomain: "example.com",
+			spf:        SPFResult{Result: ResultPass, Domain: "bounce.example.com"},
+			wantResult: ResultFail,
+			wantPolicy: "reject",
+		},
+		{
+			name:       "subdomain uses organizational sp policy",
+			fromDomain: "news.example.com",
+			spf:        SPFResult{Result: ResultPass, Domain: "news.example.com"},
+			wantResult: ResultPass,
+			wantPolicy: "quarantine",
+			wantSPF:    true,
+		},
+		{
+			name:       "failing dkim does not align",
+			fromDomain: "example.org",
+			spf:        SPFResult{Result: ResultPass, Domain: "other.net"},
+			dkim:       []DKIMResult{{Result: ResultFail, Domain: "example.org"}},
+			wantResult: ResultFail,
+			wantPolicy: "none",
+		},
+		{
+			name:       "no record",
+			fromDomain: "example.net",
+			wantResult: ResultNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EvaluateDMARC(context.Background(), resolver, tt.fromDomain, tt.spf, tt.dkim)
+			if got.Result != tt.wantResult || got.Policy != tt.wantPolicy || got.SPFAligned != tt.wantSPF || got.DKIMAligned != tt.wantDKIM {
+				t.Fatalf("EvaluateDMARC() = %#v, want result=%s policy=%q spf=%v dkim=%v", got, tt.wantResult, tt.wantPolicy, tt.wantSPF, tt.wantDKIM)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package mailauth
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+)
+
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+type Input struct {
+	RemoteIP   net.IP
+	Helo       string
+	MailFrom   string
+	FromDomain string
+	Message    io.Reader
+}
+
+type Results struct {
+	SPF   SPFResult
+	DKIM  []DKIMResult
+	DMARC DMARCResult
+}
+
+func Check(ctx context.Context, resolver Resolver, input Input) Results {
+	results := Results{
+		DKIM: VerifyDKIM(ctx, resolver, input.Message),
+	}
+
+	if input.RemoteIP != nil {
+		results.SPF = CheckSPF(ctx, resolver, input.RemoteIP, input.Helo, input.MailFrom)
+	} else {
+		results.SPF = SPFResult{Result: ResultNone, Reason: "client ip unknown"}
+	}
+
+	results.DMARC = EvaluateDMARC(ctx, resolver, input.FromDomain, results.SPF, results.DKIM)
+	return results
+}
+
+const (
+	ResultNone      = "none"
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func isTemporary(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
+
+func domainOf(address string) string {
+	atIndex := strings.LastIndex(address, "@")
+	if atIndex < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(address[atIndex+1:], "."))
+}
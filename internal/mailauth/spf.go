@@ -0,0 +1,509 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	spfMaxDNSLookups  = 10
+	spfMaxVoidLookups = 2
+	spfMaxMXHosts     = 10
+)
+
+type SPFResult struct {
+	Result string
+	Domain string
+	Reason string
+}
+
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, helo string, mailFrom string) SPFResult {
+	sender := strings.TrimSpace(mailFrom)
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+
+	domain := domainOf(sender)
+	if domain == "" {
+		return SPFResult{Result: ResultNone, Reason: "no sender domain"}
+	}
+
+	checker := &spfChecker{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	result, reason := checker.checkHost(domain, 0)
+	return SPFResult{Result: result, Domain: domain, Reason: reason}
+}
+
+type spfChecker struct {
+	ctx         context.Context
+	resolver    Resolver
+	ip          net.IP
+	sender      string
+	helo        string
+	lookups     int
+	voidLookups int
+}
+
+var errSPFLookupLimit = errors.New("dns lookup limit exceeded")
+
+func (c *spfChecker) checkHost(domain string, depth int) (string, string) {
+	if depth > spfMaxDNSLookups {
+		return ResultPermError, "include depth exceeded"
+	}
+
+	record, err := c.fetchRecord(domain)
+	if err != nil {
+		if isTemporary(err) {
+			return ResultTempError, err.Error()
+		}
+		return ResultPermError, err.Error()
+	}
+	if record == "" {
+		return ResultNone, "no spf record for " + domain
+	}
+
+	terms := strings.Fields(record)[1:]
+	var redirect string
+	for _, term := range terms {
+		name, value, isModifier := strings.Cut(term, "=")
+		if isModifier && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := ResultPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = ResultFail
+			term = term[1:]
+		case '~':
+			qualifier = ResultSoftFail
+			term = term[1:]
+		case '?':
+			qualifier = ResultNeutral
+			term = term[1:]
+		}
+
+		matched, result, reason := c.matchMechanism(domain, term, depth)
+		if result != "" {
+			return result, reason
+		}
+		if matched {
+			return qualifier, "matched " + term
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return ResultPermError, err.Error()
+		}
+		if err := c.countLookup(); err != nil {
+			return ResultPermError, err.Error()
+		}
+		result, reason := c.checkHost(target, depth+1)
+		if result == ResultNone {
+			return ResultPermError, "redirect target has no spf record"
+		}
+		return result, reason
+	}
+
+	return ResultNeutral, "no mechanism matched"
+}
+
+func (c *spfChecker) fetchRecord(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	default:
+		return "", fmt.Errorf("multiple spf records for %s", domain)
+	}
+}
+
+func (c *spfChecker) matchMechanism(domain string, term string, depth int) (bool, string, string) {
+	name, arg, _ := strings.Cut(term, ":")
+	name, cidr, hasCIDR := strings.Cut(name, "/")
+	if hasCIDR {
+		cidr = "/" + cidr
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, "", ""
+	case "ip4", "ip6":
+		_, network, err := parseSPFNetwork(arg)
+		if err != nil {
+			return false, ResultPermError, err.Error()
+		}
+		return network.Contains(c.ip), "", ""
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, ResultPermError, err.Error()
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, ResultPermError, err.Error()
+		}
+		result, reason := c.checkHost(target, depth+1)
+		switch result {
+		case ResultPass:
+			return true, "", ""
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, "", ""
+		case ResultTempError:
+			return false, ResultTempError, reason
+		default:
+			return false, ResultPermError, "include " + target + ": " + reason
+		}
+	case "a", "mx", "exists", "ptr":
+		if err := c.countLookup(); err != nil {
+			return false, ResultPermError, err.Error()
+		}
+	default:
+		return false, ResultPermError, "unknown mechanism " + name
+	}
+
+	target := domain
+	if arg != "" {
+		argHost, argCIDR, found := strings.Cut(arg, "/")
+		if found {
+			cidr = "/" + argCIDR
+		}
+		expanded, err := c.expand(argHost, domain)
+		if err != nil {
+			return false, ResultPermError, err.Error()
+		}
+		target = expanded
+	}
+
+	var matched bool
+	var err error
+	switch name {
+	case "a":
+		matched, err = c.matchHostIPs(target, cidr)
+	case "mx":
+		matched, err = c.matchMX(target, cidr)
+	case "exists":
+		matched, err = c.matchExists(target)
+	case "ptr":
+		matched, err = c.matchPTR(target)
+	}
+	if err != nil {
+		if isTemporary(err) {
+			return false, ResultTempError, err.Error()
+		}
+		return false, ResultPermError, err.Error()
+	}
+	return matched, "", ""
+}
+
+func (c *spfChecker) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxDNSLookups {
+		return errSPFLookupLimit
+	}
+	return nil
+}
+
+func (c *spfChecker) lookupIPs(host string) ([]net.IPAddr, error) {
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		c.voidLookups++
+		if c.voidLookups > spfMaxVoidLookups {
+			return nil, errors.New("void lookup limit exceeded")
+		}
+	}
+	return addrs, nil
+}
+
+func (c *spfChecker) matchHostIPs(host string, cidr string) (bool, error) {
+	ip4Mask, ip6Mask, err := parseDualCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	addrs, err := c.lookupIPs(host)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipMatches(c.ip, addr.IP, ip4Mask, ip6Mask) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfChecker) matchMX(host string, cidr string) (bool, error) {
+	records, err := c.resolver.LookupMX(c.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	if len(records) > spfMaxMXHosts {
+		return false, errors.New("too many mx records")
+	}
+	for _, record := range records {
+		matched, err := c.matchHostIPs(strings.TrimSuffix(record.Host, "."), cidr)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfChecker) matchExists(host string) (bool, error) {
+	addrs, err := c.lookupIPs(host)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfChecker) matchPTR(domain string) (bool, error) {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	domain = strings.ToLower(domain)
+	for i, name := range names {
+		if i >= spfMaxMXHosts {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			continue
+		}
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(c.ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (c *spfChecker) expand(spec string, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errors.New("invalid macro: trailing %")
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", errors.New("invalid macro: unterminated %{")
+			}
+			expanded, err := c.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i += end
+		default:
+			return "", fmt.Errorf("invalid macro: %%%c", spec[i])
+		}
+	}
+	return out.String(), nil
+}
+
+func (c *spfChecker) expandMacro(macro string, domain string) (string, error) {
+	if macro == "" {
+		return "", errors.New("invalid macro: empty")
+	}
+
+	var value string
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	switch macro[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = local
+	case 'o', 'O':
+		value = senderDomain
+	case 'd', 'D':
+		value = domain
+	case 'h', 'H':
+		value = c.helo
+	case 'i', 'I':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			var nibbles []string
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0x0f), 16))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case 'v', 'V':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'p', 'P':
+		value = "unknown"
+	default:
+		return "", fmt.Errorf("invalid macro letter %q", macro[0])
+	}
+
+	rest := macro[1:]
+	digitsEnd := 0
+	for digitsEnd < len(rest) && rest[digitsEnd] >= '0' && rest[digitsEnd] <= '9' {
+		digitsEnd++
+	}
+	keep := 0
+	if digitsEnd > 0 {
+		keep, _ = strconv.Atoi(rest[:digitsEnd])
+	}
+	rest = rest[digitsEnd:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := rest
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func parseSPFNetwork(value string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid ip %q", value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cidr %q", value)
+	}
+	return ip, network, nil
+}
+
+func parseDualCIDR(cidr string) (int, int, error) {
+	ip4Mask, ip6Mask := 32, 128
+	if cidr == "" {
+		return ip4Mask, ip6Mask, nil
+	}
+
+	v4Part, v6Part, hasV6 := strings.Cut(strings.TrimPrefix(cidr, "/"), "//")
+	if strings.HasPrefix(cidr, "//") {
+		v4Part, v6Part, hasV6 = "", strings.TrimPrefix(cidr, "//"), true
+	}
+	if v4Part != "" {
+		mask, err := strconv.Atoi(v4Part)
+		if err != nil || mask < 0 || mask > 32 {
+			return 0, 0, fmt.Errorf("invalid ip4 cidr length %q", v4Part)
+		}
+		ip4Mask = mask
+	}
+	if hasV6 {
+		mask, err := strconv.Atoi(v6Part)
+		if err != nil || mask < 0 || mask > 128 {
+			return 0, 0, fmt.Errorf("invalid ip6 cidr length %q", v6Part)
+		}
+		ip6Mask = mask
+	}
+	return ip4Mask, ip6Mask, nil
+}
+
+func ipMatches(client net.IP, candidate net.IP, ip4Mask int, ip6Mask int) bool {
+	if client4, candidate4 := client.To4(), candidate.To4(); client4 != nil || candidate4 != nil {
+		if client4 == nil || candidate4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(ip4Mask, 32)
+		return client4.Mask(mask).Equal(candidate4.Mask(mask))
+	}
+	mask := net.CIDRMask(ip6Mask, 128)
+	return client.Mask(mask).Equal(candidate.Mask(mask))
+}
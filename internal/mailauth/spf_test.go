@@ -0,0 +1,102 @@
+package mailauth
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type fakeResolver struct {
+	txt  map[string][]string
+	ips  map[string][]string
+	mx   map[string][]string
+	ptrs map[string][]string
+}
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if records, ok := f.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	values, ok := f.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, 0, len(values))
+	for _, value := range values {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+	}
+	return addrs, nil
+}
+
+func (f fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := f.mx[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	records := make([]*net.MX, 0, len(hosts))
+	for i, host := range hosts {
+		records = append(records, &net.MX{Host: host, Pref: uint16(10 * (i + 1))})
+	}
+	return records, nil
+}
+
+func (f fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	names, ok := f.ptrs[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestCheckSPF(t *testing.T) {
+	resolver := fakeResolver{
+		txt: map[string][]string{
+			"example.net":          {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.org mx -all"},
+			"_spf.example.org":     {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example.net":     {"v=spf1 a:mail.example.net ~all"},
+			"redirect.example.net": {"v=spf1 redirect=example.net"},
+			"macro.example.net":    {"v=spf1 exists:%{i}._ip.%{d} -all"},
+			"double.example.net":   {"v=spf1 -all", "v=spf1 +all"},
+		},
+		ips: map[string][]string{
+			"mail.example.net":                   {"198.51.100.7"},
+			"mx1.example.net":                    {"203.0.113.9"},
+			"203.0.113.50._ip.macro.example.net": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.net": {"mx1.example.net."},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		mailFrom string
+		want     string
+	}{
+		{name: "ip4 match", ip: "192.0.2.10", mailFrom: "user@example.net", want: ResultPass},
+		{name: "include match", ip: "2001:db8::1", mailFrom: "user@example.net", want: ResultPass},
+		{name: "mx match", ip: "203.0.113.9", mailFrom: "user@example.net", want: ResultPass},
+		{name: "hard fail", ip: "198.51.100.200", mailFrom: "user@example.net", want: ResultFail},
+		{name: "a mechanism", ip: "198.51.100.7", mailFrom: "user@soft.example.net", want: ResultPass},
+		{name: "soft fail", ip: "198.51.100.8", mailFrom: "user@soft.example.net", want: ResultSoftFail},
+		{name: "redirect", ip: "192.0.2.99", mailFrom: "user@redirect.example.net", want: ResultPass},
+		{name: "exists macro", ip: "203.0.113.50", mailFrom: "user@macro.example.net", want: ResultPass},
+		{name: "no record", ip: "192.0.2.1", mailFrom: "user@missing.example.net", want: ResultNone},
+		{name: "multiple records", ip: "192.0.2.1", mailFrom: "user@double.example.net", want: ResultPermError},
+		{name: "null sender uses helo", ip: "198.51.100.7", mailFrom: "", want: ResultPass},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CheckSPF(context.Background(), resolver, net.ParseIP(tc.ip), "soft.example.net", tc.mailFrom)
+			if got.Result != tc.want {
+				t.Fatalf("CheckSPF() = %q (%s), want %q", got.Result, got.Reason, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package mtasts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+const maxPolicyBytes = 64 * 1024
+
+type Policy struct {
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	version := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, strings.ToLower(value))
+		case "max_age":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+			policy.MaxAge = time.Duration(seconds) * time.Second
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported policy version %q", version)
+	}
+	switch policy.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("policy has no mx patterns")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("invalid policy mode %q", policy.Mode)
+	}
+	return policy, nil
+}
+
+func (p *Policy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(host, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type Fetcher struct {
+	mu       sync.Mutex
+	resolver TXTResolver
+	client   *http.Client
+	cache    map[string]*Policy
+	expires  map[string]time.Time
+	now      func() time.Time
+}
+
+func NewFetcher(resolver TXTResolver) *Fetcher {
+	return &Fetcher{
+		resolver: resolver,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache:   make(map[string]*Policy),
+		expires: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func (f *Fetcher) Lookup(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	f.mu.Lock()
+	cached, cachedOK := f.cache[domain]
+	fresh := cachedOK && f.now().Before(f.expires[domain])
+	f.mu.Unlock()
+
+	id, err := f.lookupID(ctx, domain)
+	if err != nil || id == "" {
+		if fresh {
+			return cached, nil
+		}
+		return nil, err
+	}
+	if fresh && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := f.fetch(ctx, domain)
+	if err != nil {
+		if fresh {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+
+	f.mu.Lock()
+	f.cache[domain] = policy
+	f.expires[domain] = f.now().Add(policy.MaxAge)
+	f.mu.Unlock()
+	return policy, nil
+}
+
+func (f *Fetcher) lookupID(ctx context.Context, domain string) (string, error) {
+	records, err := f.resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", nil
+	}
+
+	var id string
+	found := 0
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		found++
+		for _, field := range strings.Split(record, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			if key == "id" {
+				id = value
+			}
+		}
+	}
+	if found > 1 {
+		return "", errors.New("multiple mta-sts records")
+	}
+	return id, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, domain string) (*Policy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build mta-sts request: %w", err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch mta-sts policy: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch mta-sts policy: unexpected status %s", resp.Status)
+	}
+	if mediaType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])); mediaType != "text/plain" {
+		return nil, fmt.Errorf("fetch mta-sts policy: unexpected content type %q", mediaType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("read mta-sts policy: %w", err)
+	}
+	policy, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse mta-sts policy: %w", err)
+	}
+	return policy, nil
+}
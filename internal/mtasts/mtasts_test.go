@@ -0,0 +1,43 @@
+package mtasts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	policy, err := Parse([]byte("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.mx.example.net\r\nmax_age: 86400\r\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if policy.Mode != ModeEnforce || policy.MaxAge != 24*time.Hour || len(policy.MX) != 2 {
+		t.Fatalf("Parse() = %#v, want enforce policy with two mx patterns", policy)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.example.com.", true},
+		{"a.mx.example.net", true},
+		{"a.b.mx.example.net", false},
+		{"mx.example.net", false},
+		{"other.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Matches(tt.host); got != tt.want {
+			t.Fatalf("Matches(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"mode: enforce\nmx: mail.example.com\nmax_age: 60\n",
+		"version: STSv1\nmode: enforce\nmax_age: 60\n",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\n",
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Fatalf("Parse(%q) error = nil, want error", invalid)
+		}
+	}
+}
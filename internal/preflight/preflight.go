@@ -0,0 +1,255 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/danthegoodman1/smtp_echo/internal/mailauth"
+)
+
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+type Input struct {
+	Hostname   string
+	MailFrom   string
+	FromDomain string
+	DKIMDomain string
+	EgressIPs  []net.IP
+	EHLOName   string
+	EHLONames  map[string]string
+}
+
+type Check struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string
+}
+
+type Report struct {
+	Checks []Check
+}
+
+func (r Report) Failed() bool {
+	for _, check := range r.Checks {
+		if check.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func Run(ctx context.Context, resolver mailauth.Resolver, input Input) Report {
+	var report Report
+	hostname := normalizeName(input.Hostname)
+
+	addrs, err := resolver.LookupIPAddr(ctx, hostname)
+	switch {
+	case err != nil:
+		report.add(Check{
+			Name:   "hostname",
+			Status: StatusFail,
+			Detail: fmt.Sprintf("%s does not resolve: %v", hostname, err),
+			Fix:    fmt.Sprintf("publish an A or AAAA record for %s pointing at the egress ip", hostname),
+		})
+	case len(addrs) == 0:
+		report.add(Check{
+			Name:   "hostname",
+			Status: StatusFail,
+			Detail: fmt.Sprintf("%s has no A or AAAA records", hostname),
+			Fix:    fmt.Sprintf("publish an A or AAAA record for %s pointing at the egress ip", hostname),
+		})
+	default:
+		report.add(Check{
+			Name:   "hostname",
+			Status: StatusPass,
+			Detail: fmt.Sprintf("%s resolves to %s", hostname, joinIPAddrs(addrs)),
+		})
+	}
+
+	egress := input.EgressIPs
+	if len(egress) == 0 {
+		for _, addr := range addrs {
+			egress = append(egress, addr.IP)
+		}
+	}
+	if len(egress) == 0 {
+		report.add(Check{
+			Name:   "egress",
+			Status: StatusFail,
+			Detail: "no egress ip to check PTR and SPF against",
+			Fix:    "set delivery.source_ipv4, delivery.source_ipv6, or delivery.source_pool, or pass --egress-ip",
+		})
+	}
+
+	var spf mailauth.SPFResult
+	for _, ip := range egress {
+		ehloName := hostname
+		if name, ok := input.EHLONames[ip.String()]; ok {
+			ehloName = normalizeName(name)
+		} else if input.EHLOName != "" {
+			ehloName = normalizeName(input.EHLOName)
+		}
+		report.add(checkPTR(ctx, resolver, ehloName, ip))
+
+		check, result := checkSPF(ctx, resolver, ehloName, input.MailFrom, ip)
+		report.add(check)
+		if spf.Result == "" || (spf.Result != mailauth.ResultPass && result.Result == mailauth.ResultPass) {
+			spf = result
+		}
+	}
+
+	report.add(checkDMARC(ctx, resolver, input, spf))
+	return report
+}
+
+func (r *Report) add(check Check) {
+	r.Checks = append(r.Checks, check)
+}
+
+func checkPTR(ctx context.Context, resolver mailauth.Resolver, hostname string, ip net.IP) Check {
+	check := Check{Name: "ptr " + ip.String()}
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("%s has no PTR record", ip)
+		if err != nil && !isNotFound(err) {
+			check.Detail = fmt.Sprintf("PTR lookup for %s failed: %v", ip, err)
+		}
+		check.Fix = fmt.Sprintf("ask the provider of %s to set its PTR record to %s", ip, hostname)
+		return check
+	}
+
+	var confirmed []string
+	for _, name := range names {
+		name = normalizeName(name)
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				confirmed = append(confirmed, name)
+				break
+			}
+		}
+	}
+	switch {
+	case len(confirmed) == 0:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("PTR %s does not resolve back to %s", strings.Join(names, ", "), ip)
+		check.Fix = fmt.Sprintf("point the PTR for %s at %s and publish an A or AAAA record for it", ip, hostname)
+	case !containsName(confirmed, hostname):
+		check.Status = StatusWarn
+		check.Detail = fmt.Sprintf("PTR %s is forward-confirmed but does not match EHLO name %s", confirmed[0], hostname)
+		check.Fix = fmt.Sprintf("send EHLO %s from %s or change its PTR to %s", confirmed[0], ip, hostname)
+	default:
+		check.Status = StatusPass
+		check.Detail = fmt.Sprintf("PTR %s resolves back to %s", hostname, ip)
+	}
+	return check
+}
+
+func checkSPF(ctx context.Context, resolver mailauth.Resolver, hostname string, mailFrom string, ip net.IP) (Check, mailauth.SPFResult) {
+	result := mailauth.CheckSPF(ctx, resolver, ip, hostname, mailFrom)
+	check := Check{Name: "spf " + ip.String()}
+	mechanism := "ip4:" + ip.String()
+	if ip.To4() == nil {
+		mechanism = "ip6:" + ip.String()
+	}
+
+	switch result.Result {
+	case mailauth.ResultPass:
+		check.Status = StatusPass
+		check.Detail = fmt.Sprintf("%s authorizes %s", result.Domain, ip)
+	case mailauth.ResultNone:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("%s publishes no SPF record", result.Domain)
+		if result.Domain == "" {
+			check.Detail = "mail_from has no domain"
+		}
+		check.Fix = fmt.Sprintf("publish a TXT record at %s: \"v=spf1 %s -all\"", result.Domain, mechanism)
+	case mailauth.ResultTempError:
+		check.Status = StatusWarn
+		check.Detail = fmt.Sprintf("SPF lookup for %s failed: %s", result.Domain, result.Reason)
+		check.Fix = "re-run preflight once DNS is reachable"
+	case mailauth.ResultPermError:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("SPF record at %s is invalid: %s", result.Domain, result.Reason)
+		check.Fix = fmt.Sprintf("fix the SPF record at %s and make sure it includes %s", result.Domain, mechanism)
+	default:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("SPF for %s returns %s for %s", result.Domain, result.Result, ip)
+		check.Fix = fmt.Sprintf("add %s to the SPF record at %s", mechanism, result.Domain)
+	}
+	return check, result
+}
+
+func checkDMARC(ctx context.Context, resolver mailauth.Resolver, input Input, spf mailauth.SPFResult) Check {
+	var dkim []mailauth.DKIMResult
+	if input.DKIMDomain != "" {
+		dkim = append(dkim, mailauth.DKIMResult{Result: mailauth.ResultPass, Domain: input.DKIMDomain})
+	}
+	result := mailauth.EvaluateDMARC(ctx, resolver, input.FromDomain, spf, dkim)
+	check := Check{Name: "dmarc"}
+	record := "_dmarc." + input.FromDomain
+
+	switch result.Result {
+	case mailauth.ResultPass:
+		check.Status = StatusPass
+		check.Detail = fmt.Sprintf("%s publishes p=%s; replies pass with %s", record, result.Policy, result.Reason)
+	case mailauth.ResultNone:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("%s: %s", input.FromDomain, result.Reason)
+		if input.FromDomain != "" {
+			check.Detail = fmt.Sprintf("no DMARC record at %s", record)
+		}
+		check.Fix = fmt.Sprintf("publish a TXT record at %s: \"v=DMARC1; p=none; rua=mailto:postmaster@%s\"", record, input.FromDomain)
+	case mailauth.ResultFail:
+		check.Status = StatusWarn
+		check.Detail = fmt.Sprintf("%s publishes p=%s but %s", record, result.Policy, result.Reason)
+		check.Fix = fmt.Sprintf("sign replies with a DKIM d= in %s or use a mail_from in %s covered by SPF", input.FromDomain, input.FromDomain)
+	case mailauth.ResultTempError:
+		check.Status = StatusWarn
+		check.Detail = fmt.Sprintf("DMARC lookup for %s failed: %s", record, result.Reason)
+		check.Fix = "re-run preflight once DNS is reachable"
+	default:
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("DMARC record at %s is invalid: %s", record, result.Reason)
+		check.Fix = fmt.Sprintf("fix the TXT record at %s", record)
+	}
+	return check
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func containsName(names []string, name string) bool {
+	for _, candidate := range names {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+func joinIPAddrs(addrs []net.IPAddr) string {
+	values := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		values = append(values, addr.IP.String())
+	}
+	return strings.Join(values, ", ")
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,151 @@
+package preflight
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeResolver struct {
+	txt  map[string][]string
+	ips  map[string][]string
+	ptrs map[string][]string
+}
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if records, ok := f.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	values, ok := f.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, 0, len(values))
+	for _, value := range values {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+	}
+	return addrs, nil
+}
+
+func (f fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	names, ok := f.ptrs[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestRun(t *testing.T) {
+	resolver := fakeResolver{
+		txt: map[string][]string{
+			"example.com":        {"v=spf1 ip4:192.0.2.10 -all"},
+			"_dmarc.example.com": {"v=DMARC1; p=reject"},
+			"other.example":      {"v=spf1 -all"},
+			"_dmarc.nodkim.test": {"v=DMARC1; p=quarantine"},
+		},
+		ips: map[string][]string{
+			"mx.example.com":    {"192.0.2.10"},
+			"host.provider.net": {"192.0.2.20"},
+		},
+		ptrs: map[string][]string{
+			"192.0.2.10": {"mx.example.com."},
+			"192.0.2.20": {"host.provider.net."},
+			"192.0.2.30": {"stale.provider.net."},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		input  Input
+		want   map[string]string
+		failed bool
+	}{
+		{
+			name: "healthy",
+			input: Input{
+				Hostname:   "mx.example.com",
+				MailFrom:   "bounce@example.com",
+				FromDomain: "example.com",
+			},
+			want: map[string]string{
+				"hostname":       StatusPass,
+				"ptr 192.0.2.10": StatusPass,
+				"spf 192.0.2.10": StatusPass,
+				"dmarc":          StatusPass,
+			},
+		},
+		{
+			name: "misconfigured egress",
+			input: Input{
+				Hostname:   "mx.example.com",
+				MailFrom:   "bounce@other.example",
+				FromDomain: "nodkim.test",
+				EgressIPs:  []net.IP{net.ParseIP("192.0.2.20"), net.ParseIP("192.0.2.30")},
+			},
+			want: map[string]string{
+				"hostname":       StatusPass,
+				"ptr 192.0.2.20": StatusWarn,
+				"spf 192.0.2.20": StatusFail,
+				"ptr 192.0.2.30": StatusFail,
+				"spf 192.0.2.30": StatusFail,
+				"dmarc":          StatusWarn,
+			},
+			failed: true,
+		},
+		{
+			name: "nothing published",
+			input: Input{
+				Hostname:   "missing.example",
+				MailFrom:   "bounce@missing.example",
+				FromDomain: "missing.example",
+				DKIMDomain: "missing.example",
+			},
+			want: map[string]string{
+				"hostname": StatusFail,
+				"egress":   StatusFail,
+				"dmarc":    StatusFail,
+			},
+			failed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := Run(context.Background(), resolver, test.input)
+			got := make(map[string]string, len(report.Checks))
+			for _, check := range report.Checks {
+				got[check.Name] = check.Status
+				if check.Status != StatusPass && check.Fix == "" {
+					t.Fatalf("check %s has status %s and no fix: %s", check.Name, check.Status, check.Detail)
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Run() checks = %v, want %v", got, test.want)
+			}
+			for name, status := range test.want {
+				if got[name] != status {
+					t.Fatalf("Run() check %s = %q, want %q (%v)", name, got[name], status, report.Checks)
+				}
+			}
+			if report.Failed() != test.failed {
+				t.Fatalf("Failed() = %t, want %t", report.Failed(), test.failed)
+			}
+		})
+	}
+
+	report := Run(context.Background(), resolver, Input{Hostname: "mx.example.com", MailFrom: "bounce@other.example", FromDomain: "example.com", EgressIPs: []net.IP{net.ParseIP("192.0.2.10")}})
+	for _, check := range report.Checks {
+		if check.Name == "spf 192.0.2.10" && !strings.Contains(check.Fix, "ip4:192.0.2.10") {
+			t.Fatalf("spf fix = %q, want ip4 mechanism", check.Fix)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package quarantine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+var ErrNotFound = errors.New("quarantined message not found")
+
+var idPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}-[0-9a-f]{8}$`)
+
+type Entry struct {
+	ID            string          `json:"id"`
+	QuarantinedAt time.Time       `json:"quarantined_at"`
+	Error         string          `json:"error"`
+	Status        string          `json:"status,omitempty"`
+	MessageID     int64           `json:"message_id,omitempty"`
+	EnvelopeFrom  string          `json:"envelope_from"`
+	Recipients    []string        `json:"recipients"`
+	Size          int64           `json:"size"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+}
+
+type Dir struct {
+	path string
+	now  func() time.Time
+}
+
+func Open(cfg config.QuarantineConfig) (*Dir, error) {
+	if err := os.MkdirAll(cfg.Path, 0o750); err != nil {
+		return nil, fmt.Errorf("create quarantine dir: %w", err)
+	}
+	return &Dir{path: cfg.Path, now: time.Now}, nil
+}
+
+func (d *Dir) Add(entry Entry, raw []byte) (Entry, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return Entry{}, fmt.Errorf("generate quarantine id: %w", err)
+	}
+	entry.QuarantinedAt = d.now().UTC()
+	entry.ID = entry.QuarantinedAt.Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+	entry.Size = int64(len(raw))
+
+	metadata, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return Entry{}, fmt.Errorf("encode quarantine metadata: %w", err)
+	}
+	if err := d.write(entry.ID+".eml", raw); err != nil {
+		return Entry{}, err
+	}
+	if err := d.write(entry.ID+".json", append(metadata, '\n')); err != nil {
+		os.Remove(filepath.Join(d.path, entry.ID+".eml"))
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+func (d *Dir) List() ([]Entry, error) {
+	files, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("read quarantine dir: %w", err)
+	}
+	var entries []Entry
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		entry, err := d.entry(id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (d *Dir) Get(id string) (Entry, []byte, error) {
+	if !idPattern.MatchString(id) {
+		return Entry{}, nil, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	entry, err := d.entry(id)
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	raw, err := os.ReadFile(filepath.Join(d.path, id+".eml"))
+	if err != nil {
+		return Entry{}, nil, fmt.Errorf("read quarantined message %s: %w", id, err)
+	}
+	return entry, raw, nil
+}
+
+func (d *Dir) Remove(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	if err := os.Remove(filepath.Join(d.path, id+".json")); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %q", ErrNotFound, id)
+		}
+		return fmt.Errorf("remove quarantined message %s: %w", id, err)
+	}
+	if err := os.Remove(filepath.Join(d.path, id+".eml")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove quarantined message %s: %w", id, err)
+	}
+	return nil
+}
+
+func (d *Dir) entry(id string) (Entry, error) {
+	data, err := os.ReadFile(filepath.Join(d.path, id+".json"))
+	if os.IsNotExist(err) {
+		return Entry{}, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("read quarantine metadata %s: %w", id, err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, fmt.Errorf("decode quarantine metadata %s: %w", id, err)
+	}
+	return entry, nil
+}
+
+func (d *Dir) write(name string, data []byte) error {
+	file, err := os.CreateTemp(d.path, "."+name+"-*")
+	if err != nil {
+		return fmt.Errorf("create quarantine file: %w", err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(d.path, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("write quarantine file %s: %w", name, err)
+	}
+	return nil
+}
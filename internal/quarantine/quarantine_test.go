@@ -0,0 +1,84 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func TestDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine")
+	dir, err := Open(config.QuarantineConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	now := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	dir.now = func() time.Time { return now }
+
+	raw := []byte("Subject: broken\r\n\r\nbody\r\n")
+	first, err := dir.Add(Entry{
+		Error:        "delivery failed for sender@example.net: mx.example.net: 550 5.1.1 no such user",
+		Status:       "5.1.1",
+		MessageID:    7,
+		EnvelopeFrom: "sender@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Metadata:     json.RawMessage(`{"tag":"run-1"}`),
+	}, raw)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if !idPattern.MatchString(first.ID) || first.Size != int64(len(raw)) || !first.QuarantinedAt.Equal(now) {
+		t.Fatalf("Add() = %+v, want generated id, size, and time", first)
+	}
+	now = now.Add(time.Minute)
+	second, err := dir.Add(Entry{Error: "parse failed", EnvelopeFrom: "other@example.net"}, []byte("garbage"))
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "notes.json"), []byte("{}"), 0o640); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	entries, err := dir.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != first.ID || entries[1].ID != second.ID {
+		t.Fatalf("List() = %+v, want both entries oldest first", entries)
+	}
+
+	entry, got, err := dir.Get(first.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	var metadata struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.Unmarshal(entry.Metadata, &metadata); err != nil {
+		t.Fatalf("Unmarshal() metadata error = %v", err)
+	}
+	if string(got) != string(raw) || entry.Status != "5.1.1" || entry.MessageID != 7 || metadata.Tag != "run-1" {
+		t.Fatalf("Get() = %+v, %q, want stored entry and message", entry, got)
+	}
+
+	if err := dir.Remove(first.ID); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, _, err := dir.Get(first.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() after Remove() error = %v, want ErrNotFound", err)
+	}
+	if err := dir.Remove(first.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Remove() twice error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := dir.Get("../config"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() with a path error = %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, first.ID+".eml")); !os.IsNotExist(err) {
+		t.Fatalf("removed message file still present: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS entries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at INTEGER NOT NULL,
+	due_at INTEGER NOT NULL,
+	claimed_at INTEGER NOT NULL DEFAULT 0,
+	message_id INTEGER NOT NULL DEFAULT 0,
+	envelope_from TEXT NOT NULL DEFAULT '',
+	recipients TEXT NOT NULL DEFAULT '[]',
+	metadata TEXT NOT NULL DEFAULT '{}',
+	raw BLOB
+);
+CREATE INDEX IF NOT EXISTS entries_due_at ON entries (due_at);
+`
+
+type Entry struct {
+	ID           int64           `json:"id"`
+	CreatedAt    time.Time       `json:"created_at"`
+	DueAt        time.Time       `json:"due_at"`
+	ClaimedAt    time.Time       `json:"claimed_at,omitzero"`
+	MessageID    int64           `json:"message_id"`
+	EnvelopeFrom string          `json:"envelope_from"`
+	Recipients   []string        `json:"recipients"`
+	Metadata     json.RawMessage `json:"metadata"`
+	Raw          []byte          `json:"-"`
+	Size         int64           `json:"size"`
+}
+
+type Journal struct {
+	db           *sql.DB
+	claimTimeout time.Duration
+}
+
+func Open(cfg config.QueueConfig) (*Journal, error) {
+	db, err := sql.Open("sqlite3", "file:"+cfg.Path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open queue journal: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate queue journal: %w", err)
+	}
+	return &Journal{db: db, claimTimeout: cfg.ClaimTimeout}, nil
+}
+
+func (j *Journal) Close() error {
+	return j.db.Close()
+}
+
+func (j *Journal) Add(ctx context.Context, entry Entry) (int64, error) {
+	recipients, err := json.Marshal(entry.Recipients)
+	if err != nil {
+		return 0, fmt.Errorf("encode recipients: %w", err)
+	}
+	metadata := entry.Metadata
+	if len(metadata) == 0 {
+		metadata = json.RawMessage("{}")
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	result, err := j.db.ExecContext(ctx,
+		`INSERT INTO entries (created_at, due_at, message_id, envelope_from, recipients, metadata, raw)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.CreatedAt.UnixNano(), entry.DueAt.UnixNano(), entry.MessageID, entry.EnvelopeFrom, string(recipients), string(metadata), entry.Raw,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert queue entry: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func (j *Journal) Claim(ctx context.Context, id int64, now time.Time) (bool, error) {
+	result, err := j.db.ExecContext(ctx,
+		`UPDATE entries SET claimed_at = ? WHERE id = ? AND (claimed_at = 0 OR claimed_at <= ?)`,
+		now.UnixNano(), id, now.Add(-j.claimTimeout).UnixNano(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("claim queue entry: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("claim queue entry: %w", err)
+	}
+	return affected == 1, nil
+}
+
+func (j *Journal) Remove(ctx context.Context, id int64) error {
+	if _, err := j.db.ExecContext(ctx, `DELETE FROM entries WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete queue entry: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) Entries(ctx context.Context) ([]Entry, error) {
+	rows, err := j.db.QueryContext(ctx,
+		`SELECT id, created_at, due_at, claimed_at, message_id, envelope_from, recipients, metadata, raw
+		FROM entries ORDER BY due_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("query queue entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var (
+			entry                       Entry
+			createdAt, dueAt, claimedAt int64
+			recipients, metadata        string
+		)
+		if err := rows.Scan(&entry.ID, &createdAt, &dueAt, &claimedAt, &entry.MessageID, &entry.EnvelopeFrom, &recipients, &metadata, &entry.Raw); err != nil {
+			return nil, fmt.Errorf("scan queue entry: %w", err)
+		}
+		if err := json.Unmarshal([]byte(recipients), &entry.Recipients); err != nil {
+			return nil, fmt.Errorf("decode recipients: %w", err)
+		}
+		entry.CreatedAt = time.Unix(0, createdAt).UTC()
+		entry.DueAt = time.Unix(0, dueAt).UTC()
+		if claimedAt != 0 {
+			entry.ClaimedAt = time.Unix(0, claimedAt).UTC()
+		}
+		entry.Metadata = json.RawMessage(metadata)
+		entry.Size = int64(len(entry.Raw))
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (j *Journal) ReadyAt(entry Entry) time.Time {
+	if entry.ClaimedAt.IsZero() {
+		return entry.DueAt
+	}
+	if reclaim := entry.ClaimedAt.Add(j.claimTimeout); reclaim.After(entry.DueAt) {
+		return reclaim
+	}
+	return entry.DueAt
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func TestJournal_ClaimAndRemove(t *testing.T) {
+	journal, err := Open(config.QueueConfig{Path: t.TempDir() + "/queue.db", ClaimTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer journal.Close()
+
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	id, err := journal.Add(ctx, Entry{DueAt: now.Add(time.Hour), MessageID: 7, EnvelopeFrom: "a@example.net", Recipients: []string{"echo@example.com"}, Raw: []byte("raw")})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	entries, err := journal.Entries(ctx)
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].MessageID != 7 || entries[0].Size != 3 || string(entries[0].Metadata) != "{}" || !entries[0].DueAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Entries() = %#v, want the added entry", entries)
+	}
+
+	if claimed, err := journal.Claim(ctx, id, now); err != nil || !claimed {
+		t.Fatalf("Claim() = %t, %v, want true", claimed, err)
+	}
+	if claimed, err := journal.Claim(ctx, id, now.Add(30*time.Second)); err != nil || claimed {
+		t.Fatalf("second Claim() = %t, %v, want false while the claim is fresh", claimed, err)
+	}
+
+	entries, _ = journal.Entries(ctx)
+	if ready := journal.ReadyAt(entries[0]); !ready.Equal(now.Add(time.Hour)) {
+		t.Fatalf("ReadyAt() = %s, want the due time", ready)
+	}
+	if claimed, err := journal.Claim(ctx, id, now.Add(2*time.Minute)); err != nil || !claimed {
+		t.Fatalf("Claim() after claim_timeout = %t, %v, want true", claimed, err)
+	}
+
+	if err := journal.Remove(ctx, id); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if claimed, err := journal.Claim(ctx, id, now.Add(time.Hour)); err != nil || claimed {
+		t.Fatalf("Claim() after Remove() = %t, %v, want false", claimed, err)
+	}
+}
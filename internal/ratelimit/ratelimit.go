@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	pruneThreshold = 4096
+	maxBuckets     = 65536
+)
+
+type Limiter struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	buckets    map[string]*list.Element
+	lru        *list.List
+	maxBuckets int
+	now        func() time.Time
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func New(rate int, per time.Duration, burst int) *Limiter {
+	if burst < rate {
+		burst = rate
+	}
+	return &Limiter{
+		rate:       float64(rate) / per.Seconds(),
+		burst:      float64(burst),
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxBuckets: maxBuckets,
+		now:        time.Now,
+	}
+}
+
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	element, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		if len(l.buckets) >= pruneThreshold {
+			l.prune(now)
+		}
+		element = l.lru.PushFront(&bucket{key: key, tokens: l.burst, updated: now})
+		l.buckets[key] = element
+	}
+
+	b := element.Value.(*bucket)
+	b.tokens = l.refill(b, now)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *Limiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	b := element.Value.(*bucket)
+	b.tokens++
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	tokens := b.tokens + elapsed*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+func (l *Limiter) prune(now time.Time) {
+	for key, element := range l.buckets {
+		if l.refill(element.Value.(*bucket), now) >= l.burst {
+			l.lru.Remove(element)
+			delete(l.buckets, key)
+		}
+	}
+	for len(l.buckets) >= l.maxBuckets {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*bucket).key)
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow_RefillsOverTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := New(2, time.Minute, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("192.0.2.1") {
+			t.Fatalf("Allow() #%d = false, want true within burst", i+1)
+		}
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() = true after burst exhausted, want false")
+	}
+	if !limiter.Allow("192.0.2.2") {
+		t.Fatalf("Allow() for a different key = false, want true")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() after refill = false, want true")
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() = true after consuming refilled token, want false")
+	}
+}
+
+func TestLimiterAllow_EvictsOldestBuckets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := New(1, time.Hour, 1)
+	limiter.now = func() time.Time { return now }
+	limiter.maxBuckets = pruneThreshold
+
+	for i := 0; i < 2*pruneThreshold; i++ {
+		now = now.Add(time.Millisecond)
+		if !limiter.Allow(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("Allow() for new key #%d = false, want true", i)
+		}
+	}
+	if len(limiter.buckets) > pruneThreshold || limiter.lru.Len() != len(limiter.buckets) {
+		t.Fatalf("buckets = %d (lru %d), want at most %d", len(limiter.buckets), limiter.lru.Len(), pruneThreshold)
+	}
+	last := fmt.Sprintf("key-%d", 2*pruneThreshold-1)
+	if limiter.Allow(last) {
+		t.Fatalf("Allow() for the newest exhausted key = true, want it kept and limited")
+	}
+	if !limiter.Allow("key-0") {
+		t.Fatalf("Allow() for the oldest key = false, want it evicted and reset")
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := New(1, time.Hour, 1)
+	limiter.now = func() time.Time { return now }
+
+	if !limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() = false, want true within burst")
+	}
+	limiter.Refund("192.0.2.1")
+	limiter.Refund("192.0.2.1")
+	limiter.Refund("192.0.2.2")
+	if !limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() after Refund() = false, want the token back")
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatalf("Allow() = true after a second use, want refunds capped at burst")
+	}
+}
@@ -0,0 +1,237 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+)
+
+const maxReportSize = 16 << 20
+
+var errNotReport = errors.New("not an aggregate report")
+
+type dmarcFeedback struct {
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		P      string `xml:"p"`
+	} `xml:"policy_published"`
+	Records []struct {
+		Row struct {
+			SourceIP  string `xml:"source_ip"`
+			Count     int64  `xml:"count"`
+			Evaluated struct {
+				DKIM string `xml:"dkim"`
+				SPF  string `xml:"spf"`
+			} `xml:"policy_evaluated"`
+		} `xml:"row"`
+	} `xml:"record"`
+}
+
+type tlsReport struct {
+	OrgName   string `json:"organization-name"`
+	ReportID  string `json:"report-id"`
+	DateRange struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	Policies []struct {
+		Policy struct {
+			Type   string `json:"policy-type"`
+			Domain string `json:"policy-domain"`
+		} `json:"policy"`
+		Summary struct {
+			Successful int64 `json:"total-successful-session-count"`
+			Failed     int64 `json:"total-failure-session-count"`
+		} `json:"summary"`
+		FailureDetails []struct {
+			ResultType string `json:"result-type"`
+			Count      int64  `json:"failed-session-count"`
+		} `json:"failure-details"`
+	} `json:"policies"`
+}
+
+func Parse(r io.Reader) ([]Report, error) {
+	entity, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, fmt.Errorf("read report message: %w", err)
+	}
+
+	var reports []Report
+	var errs []error
+	err = entity.Walk(func(_ []int, part *message.Entity, _ error) error {
+		if part.MultipartReader() != nil {
+			return nil
+		}
+		data, err := io.ReadAll(io.LimitReader(part.Body, maxReportSize))
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		for _, file := range unpack(data) {
+			report, err := parseReport(file)
+			switch {
+			case errors.Is(err, errNotReport):
+			case err != nil:
+				errs = append(errs, err)
+			default:
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(reports) == 0 && len(errs) == 0 {
+		errs = append(errs, errors.New("no dmarc or tls report found"))
+	}
+	return reports, errors.Join(errs...)
+}
+
+func unpack(data []byte) [][]byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		unpacked, err := io.ReadAll(io.LimitReader(reader, maxReportSize))
+		if err != nil {
+			return nil
+		}
+		return [][]byte{unpacked}
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil
+		}
+		var files [][]byte
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				continue
+			}
+			unpacked, err := io.ReadAll(io.LimitReader(reader, maxReportSize))
+			reader.Close()
+			if err == nil {
+				files = append(files, unpacked)
+			}
+		}
+		return files
+	default:
+		return [][]byte{data}
+	}
+}
+
+func parseReport(data []byte) (Report, error) {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("<")):
+		return parseDMARC(data)
+	case bytes.HasPrefix(data, []byte("{")):
+		return parseTLSRPT(data)
+	default:
+		return Report{}, errNotReport
+	}
+}
+
+func parseDMARC(data []byte) (Report, error) {
+	var feedback dmarcFeedback
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return Report{}, errNotReport
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "feedback" {
+			return Report{}, errNotReport
+		}
+		if err := decoder.DecodeElement(&feedback, &start); err != nil {
+			return Report{}, fmt.Errorf("parse dmarc report: %w", err)
+		}
+		break
+	}
+	report := Report{
+		Kind:     KindDMARC,
+		OrgName:  feedback.Metadata.OrgName,
+		ReportID: feedback.Metadata.ReportID,
+		Domain:   strings.ToLower(feedback.Policy.Domain),
+		Policy:   feedback.Policy.P,
+		Begin:    time.Unix(feedback.Metadata.DateRange.Begin, 0).UTC(),
+		End:      time.Unix(feedback.Metadata.DateRange.End, 0).UTC(),
+	}
+	for _, record := range feedback.Records {
+		row := record.Row
+		report.Total += row.Count
+		if strings.EqualFold(row.Evaluated.DKIM, "pass") || strings.EqualFold(row.Evaluated.SPF, "pass") {
+			report.Passed += row.Count
+			continue
+		}
+		report.Failed += row.Count
+		if report.Failures == nil {
+			report.Failures = make(map[string]int64)
+		}
+		report.Failures[row.SourceIP] += row.Count
+	}
+	return report, nil
+}
+
+func parseTLSRPT(data []byte) (Report, error) {
+	var tls tlsReport
+	if err := json.Unmarshal(data, &tls); err != nil {
+		return Report{}, fmt.Errorf("parse tls report: %w", err)
+	}
+	if tls.Policies == nil {
+		return Report{}, errNotReport
+	}
+	report := Report{
+		Kind:     KindTLSRPT,
+		OrgName:  tls.OrgName,
+		ReportID: tls.ReportID,
+		Begin:    tls.DateRange.Start.UTC(),
+		End:      tls.DateRange.End.UTC(),
+	}
+	var domains, policies []string
+	for _, policy := range tls.Policies {
+		if domain := strings.ToLower(policy.Policy.Domain); domain != "" && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+		if !slices.Contains(policies, policy.Policy.Type) {
+			policies = append(policies, policy.Policy.Type)
+		}
+		report.Passed += policy.Summary.Successful
+		report.Failed += policy.Summary.Failed
+		for _, detail := range policy.FailureDetails {
+			if report.Failures == nil {
+				report.Failures = make(map[string]int64)
+			}
+			report.Failures[detail.ResultType] += detail.Count
+		}
+	}
+	report.Total = report.Passed + report.Failed
+	report.Domain = strings.Join(domains, ",")
+	report.Policy = strings.Join(policies, ",")
+	return report, nil
+}
@@ -0,0 +1,163 @@
+package reports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	KindDMARC  = "dmarc"
+	KindTLSRPT = "tlsrpt"
+)
+
+type Report struct {
+	ID         int64            `json:"id"`
+	Kind       string           `json:"kind"`
+	ReceivedAt time.Time        `json:"received_at"`
+	MessageID  int64            `json:"message_id,omitempty"`
+	From       string           `json:"from,omitempty"`
+	OrgName    string           `json:"org_name,omitempty"`
+	ReportID   string           `json:"report_id,omitempty"`
+	Domain     string           `json:"domain,omitempty"`
+	Policy     string           `json:"policy,omitempty"`
+	Begin      time.Time        `json:"begin"`
+	End        time.Time        `json:"end"`
+	Total      int64            `json:"total"`
+	Passed     int64            `json:"passed"`
+	Failed     int64            `json:"failed"`
+	Failures   map[string]int64 `json:"failures,omitempty"`
+}
+
+type Query struct {
+	Kind   string
+	Domain string
+	Limit  int
+}
+
+type Collector struct {
+	mu         sync.Mutex
+	path       string
+	maxReports int
+	reports    []Report
+	nextID     int64
+	now        func() time.Time
+}
+
+type persisted struct {
+	Reports []Report `json:"reports"`
+}
+
+func Open(cfg config.ReportsConfig) (*Collector, error) {
+	c := &Collector{path: cfg.Path, maxReports: cfg.MaxReports, now: time.Now}
+	if c.path != "" {
+		data, err := os.ReadFile(c.path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("read reports: %w", err)
+		default:
+			var stored persisted
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("parse reports %s: %w", c.path, err)
+			}
+			c.reports = stored.Reports
+			for _, report := range c.reports {
+				c.nextID = max(c.nextID, report.ID)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Collector) Configure(cfg config.ReportsConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxReports = cfg.MaxReports
+}
+
+func (c *Collector) Add(report Report) (Report, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	report.ID = c.nextID
+	if report.ReceivedAt.IsZero() {
+		report.ReceivedAt = c.now().UTC()
+	}
+	c.reports = append(c.reports, report)
+	if c.maxReports > 0 && len(c.reports) > c.maxReports {
+		c.reports = slices.Delete(c.reports, 0, len(c.reports)-c.maxReports)
+	}
+	return report, c.save()
+}
+
+func (c *Collector) List(query Query) []Report {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	matched := []Report{}
+	for i := len(c.reports) - 1; i >= 0; i-- {
+		report := c.reports[i]
+		if query.Kind != "" && report.Kind != query.Kind {
+			continue
+		}
+		if query.Domain != "" && !slices.Contains(strings.Split(report.Domain, ","), strings.ToLower(query.Domain)) {
+			continue
+		}
+		matched = append(matched, report)
+		if query.Limit > 0 && len(matched) == query.Limit {
+			break
+		}
+	}
+	return matched
+}
+
+func (c *Collector) Get(id int64) (Report, bool) {
+	if c == nil {
+		return Report{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, report := range c.reports {
+		if report.ID == id {
+			return report, true
+		}
+	}
+	return Report{}, false
+}
+
+func (c *Collector) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(persisted{Reports: c.reports}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode reports: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".reports-*.json")
+	if err != nil {
+		return fmt.Errorf("write reports: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write reports: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write reports: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("write reports: %w", err)
+	}
+	return nil
+}
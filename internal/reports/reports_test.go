@@ -0,0 +1,129 @@
+package reports
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const testDMARC = `<?xml version="1.0" encoding="UTF-8"?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <report_id>1234</report_id>
+    <date_range><begin>1700000000</begin><end>1700086400</end></date_range>
+  </report_metadata>
+  <policy_published><domain>Example.com</domain><p>reject</p></policy_published>
+  <record>
+    <row><source_ip>192.0.2.1</source_ip><count>5</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated></row>
+  </record>
+  <record>
+    <row><source_ip>198.51.100.7</source_ip><count>2</count>
+      <policy_evaluated><disposition>reject</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated></row>
+  </record>
+</feedback>`
+
+const testTLSRPT = `{
+  "organization-name": "Company-X",
+  "date-range": {"start-datetime": "2024-04-01T00:00:00Z", "end-datetime": "2024-04-01T23:59:59Z"},
+  "report-id": "5065427c-23d3-47ca-b6e0-946ea0e8c4be",
+  "policies": [{
+    "policy": {"policy-type": "sts", "policy-domain": "example.com"},
+    "summary": {"total-successful-session-count": 5326, "total-failure-session-count": 303},
+    "failure-details": [
+      {"result-type": "certificate-expired", "failed-session-count": 100},
+      {"result-type": "starttls-not-supported", "failed-session-count": 203}
+    ]
+  }]
+}`
+
+func TestParse_DMARCAndTLSRPT(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(testDMARC))
+	writer.Close()
+
+	message := "From: noreply-dmarc-support@google.com\r\n" +
+		"Subject: Report domain: example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<html><body>This is an aggregate report.</body></html>\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/gzip; name=\"google.com!example.com!1700000000!1700086400.xml.gz\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(compressed.Bytes()) + "\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/tlsrpt+json\r\n" +
+		"\r\n" +
+		testTLSRPT + "\r\n" +
+		"--b--\r\n"
+
+	reports, err := Parse(strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Parse() = %d reports, want 2", len(reports))
+	}
+	dmarc := reports[0]
+	if dmarc.Kind != KindDMARC || dmarc.Domain != "example.com" || dmarc.Policy != "reject" || dmarc.Total != 7 || dmarc.Passed != 5 || dmarc.Failed != 2 || dmarc.Failures["198.51.100.7"] != 2 {
+		t.Fatalf("dmarc report = %+v", dmarc)
+	}
+	if dmarc.Begin.Unix() != 1700000000 {
+		t.Fatalf("dmarc begin = %s, want 1700000000", dmarc.Begin)
+	}
+	tls := reports[1]
+	if tls.Kind != KindTLSRPT || tls.OrgName != "Company-X" || tls.Domain != "example.com" || tls.Total != 5629 || tls.Failed != 303 || tls.Failures["starttls-not-supported"] != 203 {
+		t.Fatalf("tls report = %+v", tls)
+	}
+
+	if _, err := Parse(strings.NewReader("Subject: hello\r\n\r\nnot a report\r\n")); err == nil {
+		t.Fatalf("Parse() of a plain message error = nil, want error")
+	}
+}
+
+func TestCollector_PersistAndList(t *testing.T) {
+	cfg := config.ReportsConfig{Path: filepath.Join(t.TempDir(), "reports.json"), MaxReports: 2}
+	collector, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for _, report := range []Report{
+		{Kind: KindDMARC, Domain: "old.example"},
+		{Kind: KindDMARC, Domain: "example.com"},
+		{Kind: KindTLSRPT, Domain: "example.com,example.net"},
+	} {
+		if _, err := collector.Add(report); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	reopened, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if all := reopened.List(Query{}); len(all) != 2 || all[0].ID != 3 || all[1].ID != 2 {
+		t.Fatalf("List() = %+v, want reports 3 and 2, newest first", all)
+	}
+	if matched := reopened.List(Query{Domain: "example.net"}); len(matched) != 1 || matched[0].Kind != KindTLSRPT {
+		t.Fatalf("List(domain) = %+v, want the tls report", matched)
+	}
+	added, err := reopened.Add(Report{Kind: KindDMARC})
+	if err != nil || added.ID != 4 {
+		t.Fatalf("Add() = %+v, %v, want id 4", added, err)
+	}
+	if _, ok := reopened.Get(2); ok {
+		t.Fatalf("Get(2) found an evicted report")
+	}
+}
@@ -0,0 +1,273 @@
+package reputation
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+const (
+	TypeIP     = "ip"
+	TypeSender = "sender"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusTempfail = "tempfail"
+	StatusBlocked  = "blocked"
+)
+
+type Event int
+
+const (
+	EventMessage Event = iota
+	EventParseFailure
+	EventInvalidRecipient
+	EventAuthFailure
+)
+
+const pruneThreshold = 4096
+
+var ErrNotFound = errors.New("reputation: not found")
+
+type Entry struct {
+	store.Reputation
+	Score  int    `json:"score"`
+	Status string `json:"status"`
+}
+
+type Tracker struct {
+	mu      sync.Mutex
+	cfg     config.ReputationConfig
+	store   store.Store
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+func Open(ctx context.Context, cfg config.ReputationConfig, st store.Store) (*Tracker, error) {
+	t := &Tracker{
+		cfg:     cfg,
+		store:   st,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+	if st == nil {
+		return t, nil
+	}
+	reps, err := st.ListReputation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load reputation: %w", err)
+	}
+	sort.Slice(reps, func(i, j int) bool { return reps[i].LastSeen.Before(reps[j].LastSeen) })
+	for _, rep := range reps {
+		t.entries[key(rep.Type, rep.Value)] = t.lru.PushFront(&rep)
+	}
+	for _, rep := range t.evict(0) {
+		st.DeleteReputation(ctx, rep.Type, rep.Value)
+	}
+	return t, nil
+}
+
+func (t *Tracker) Configure(cfg config.ReputationConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg = cfg
+}
+
+func (t *Tracker) Record(ctx context.Context, repType string, value string, event Event) (Entry, bool, error) {
+	value = normalize(repType, value)
+	if value == "" {
+		return Entry{}, false, nil
+	}
+
+	entry, changed, saved, dropped := t.record(repType, value, event)
+	if t.store == nil {
+		return entry, changed, nil
+	}
+	for _, rep := range dropped {
+		t.store.DeleteReputation(ctx, rep.Type, rep.Value)
+	}
+	if err := t.store.SaveReputation(ctx, saved); err != nil {
+		return entry, changed, err
+	}
+	return entry, changed, nil
+}
+
+func (t *Tracker) record(repType string, value string, event Event) (Entry, bool, store.Reputation, []store.Reputation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now().UTC()
+	k := key(repType, value)
+	var dropped []store.Reputation
+	elem, ok := t.entries[k]
+	switch {
+	case !ok:
+		if len(t.entries) >= pruneThreshold {
+			dropped = t.prune(now)
+		}
+		dropped = append(dropped, t.evict(1)...)
+		elem = t.lru.PushFront(&store.Reputation{Type: repType, Value: value, FirstSeen: now})
+		t.entries[k] = elem
+	case t.expired(elem.Value.(*store.Reputation), now):
+		elem.Value = &store.Reputation{Type: repType, Value: value, FirstSeen: now}
+		t.lru.MoveToFront(elem)
+	default:
+		t.lru.MoveToFront(elem)
+	}
+	rep := elem.Value.(*store.Reputation)
+	previous := t.entry(*rep, now)
+
+	rep.LastSeen = now
+	switch event {
+	case EventMessage:
+		rep.Messages++
+	case EventParseFailure:
+		rep.ParseFailures++
+	case EventInvalidRecipient:
+		rep.InvalidRecipients++
+	case EventAuthFailure:
+		rep.AuthFailures++
+	}
+	entry := t.entry(*rep, now)
+	if entry.Status == StatusBlocked && rep.BlockedUntil.IsZero() {
+		rep.BlockedUntil = now.Add(t.cfg.BlockDuration)
+		entry.BlockedUntil = rep.BlockedUntil
+	}
+	return entry, entry.Status != previous.Status, *rep, dropped
+}
+
+func (t *Tracker) Check(repType string, value string) Entry {
+	value = normalize(repType, value)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now().UTC()
+	elem, ok := t.entries[key(repType, value)]
+	if !ok || t.expired(elem.Value.(*store.Reputation), now) {
+		return Entry{Reputation: store.Reputation{Type: repType, Value: value}, Score: 100, Status: StatusOK}
+	}
+	return t.entry(*elem.Value.(*store.Reputation), now)
+}
+
+func (t *Tracker) Entries() []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now().UTC()
+	entries := make([]Entry, 0, len(t.entries))
+	for _, elem := range t.entries {
+		if rep := elem.Value.(*store.Reputation); !t.expired(rep, now) {
+			entries = append(entries, t.entry(*rep, now))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score < entries[j].Score
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].Value < entries[j].Value
+	})
+	return entries
+}
+
+func (t *Tracker) Unblock(ctx context.Context, repType string, value string) error {
+	value = normalize(repType, value)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := key(repType, value)
+	elem, ok := t.entries[k]
+	if !ok {
+		return ErrNotFound
+	}
+	t.lru.Remove(elem)
+	delete(t.entries, k)
+	if t.store != nil {
+		if err := t.store.DeleteReputation(ctx, repType, value); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tracker) entry(rep store.Reputation, now time.Time) Entry {
+	entry := Entry{Reputation: rep, Score: score(rep), Status: StatusOK}
+	events := rep.Messages + rep.InvalidRecipients + rep.AuthFailures
+	switch {
+	case now.Before(rep.BlockedUntil):
+		entry.Status = StatusBlocked
+	case events < t.cfg.MinEvents:
+	case entry.Score < t.cfg.BlockScore:
+		entry.Status = StatusBlocked
+	case entry.Score < t.cfg.TempfailScore:
+		entry.Status = StatusTempfail
+	}
+	return entry
+}
+
+func score(rep store.Reputation) int {
+	events := rep.Messages + rep.InvalidRecipients + rep.AuthFailures
+	if events == 0 {
+		return 100
+	}
+	bad := rep.ParseFailures + rep.InvalidRecipients + rep.AuthFailures
+	return max(0, 100-100*bad/events)
+}
+
+func (t *Tracker) expired(rep *store.Reputation, now time.Time) bool {
+	if !rep.BlockedUntil.IsZero() {
+		return !now.Before(rep.BlockedUntil)
+	}
+	return now.Sub(rep.FirstSeen) > t.cfg.Window
+}
+
+func (t *Tracker) prune(now time.Time) []store.Reputation {
+	var dropped []store.Reputation
+	for k, elem := range t.entries {
+		rep := elem.Value.(*store.Reputation)
+		if !t.expired(rep, now) {
+			continue
+		}
+		t.lru.Remove(elem)
+		delete(t.entries, k)
+		dropped = append(dropped, *rep)
+	}
+	return dropped
+}
+
+func (t *Tracker) evict(adding int) []store.Reputation {
+	var dropped []store.Reputation
+	for t.cfg.MaxEntries > 0 && t.lru.Len()+adding > t.cfg.MaxEntries {
+		rep := t.lru.Remove(t.lru.Back()).(*store.Reputation)
+		delete(t.entries, key(rep.Type, rep.Value))
+		dropped = append(dropped, *rep)
+	}
+	return dropped
+}
+
+func key(repType string, value string) string {
+	return repType + "\x00" + value
+}
+
+func normalize(repType string, value string) string {
+	value = strings.TrimSpace(value)
+	if repType == TypeSender {
+		return strings.ToLower(value)
+	}
+	return value
+}
@@ -0,0 +1,131 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+)
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	cfg := config.ReputationConfig{Window: time.Hour, MinEvents: 4, TempfailScore: 60, BlockScore: 30, BlockDuration: 2 * time.Hour}
+	tracker, err := Open(ctx, cfg, st)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	record := func(repType string, value string, event Event) Entry {
+		t.Helper()
+		entry, _, err := tracker.Record(ctx, repType, value, event)
+		if err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+		return entry
+	}
+
+	for range 2 {
+		record(TypeSender, "Sender@Example.net", EventMessage)
+	}
+	if entry := record(TypeSender, "sender@example.net", EventInvalidRecipient); entry.Status != StatusOK || entry.Score != 67 {
+		t.Fatalf("Record() below min_events = %+v, want ok with score 67", entry)
+	}
+	entry, changed, err := tracker.Record(ctx, TypeSender, "sender@example.net", EventInvalidRecipient)
+	if err != nil || !changed || entry.Status != StatusTempfail || entry.Score != 50 {
+		t.Fatalf("Record() = %+v, %t, %v, want a change to tempfail with score 50", entry, changed, err)
+	}
+	if got := tracker.Check(TypeSender, "SENDER@example.net"); got.Status != StatusTempfail {
+		t.Fatalf("Check() = %+v, want tempfail", got)
+	}
+
+	for range 3 {
+		record(TypeIP, "192.0.2.1", EventAuthFailure)
+	}
+	if entry := record(TypeIP, "192.0.2.1", EventAuthFailure); entry.Status != StatusBlocked || !entry.BlockedUntil.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Record() = %+v, want blocked for block_duration", entry)
+	}
+
+	reopened, err := Open(ctx, cfg, st)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	reopened.now = tracker.now
+	entries := reopened.Entries()
+	if len(entries) != 2 || entries[0].Type != TypeIP || entries[0].Status != StatusBlocked || entries[1].Value != "sender@example.net" {
+		t.Fatalf("Entries() after reopen = %+v, want the stored ip and sender", entries)
+	}
+
+	now = now.Add(90 * time.Minute)
+	if got := reopened.Check(TypeSender, "sender@example.net"); got.Status != StatusOK || got.Messages != 0 {
+		t.Fatalf("Check() after window = %+v, want a fresh entry", got)
+	}
+	if got := reopened.Check(TypeIP, "192.0.2.1"); got.Status != StatusBlocked {
+		t.Fatalf("Check() during block = %+v, want blocked", got)
+	}
+
+	if err := reopened.Unblock(ctx, TypeIP, "192.0.2.1"); err != nil {
+		t.Fatalf("Unblock() error = %v", err)
+	}
+	if got := reopened.Check(TypeIP, "192.0.2.1"); got.Status != StatusOK {
+		t.Fatalf("Check() after Unblock() = %+v, want ok", got)
+	}
+	if err := reopened.Unblock(ctx, TypeIP, "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Unblock() twice error = %v, want ErrNotFound", err)
+	}
+	if reps, err := st.ListReputation(ctx); err != nil || len(reps) != 1 {
+		t.Fatalf("ListReputation() after Unblock() = %+v, %v, want only the sender", reps, err)
+	}
+}
+
+type checkingStore struct {
+	store.Store
+	tracker *Tracker
+}
+
+func (s *checkingStore) SaveReputation(ctx context.Context, rep store.Reputation) error {
+	s.tracker.Check(rep.Type, rep.Value)
+	return s.Store.SaveReputation(ctx, rep)
+}
+
+func TestTracker_MaxEntries(t *testing.T) {
+	ctx := context.Background()
+	st := &checkingStore{Store: store.NewMemory()}
+	cfg := config.ReputationConfig{Window: time.Hour, MinEvents: 4, TempfailScore: 60, BlockScore: 30, BlockDuration: time.Hour, MaxEntries: 2}
+	tracker, err := Open(ctx, cfg, st)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	st.tracker = tracker
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.3"} {
+		now = now.Add(time.Second)
+		if _, _, err := tracker.Record(ctx, TypeIP, ip, EventAuthFailure); err != nil {
+			t.Fatalf("Record(%s) error = %v", ip, err)
+		}
+	}
+	entries := tracker.Entries()
+	if len(entries) != 2 || entries[0].Value != "192.0.2.1" || entries[0].AuthFailures != 2 || entries[1].Value != "192.0.2.3" {
+		t.Fatalf("Entries() = %+v, want the two most recently seen ips", entries)
+	}
+	if reps, err := st.ListReputation(ctx); err != nil || len(reps) != 2 {
+		t.Fatalf("ListReputation() = %+v, %v, want the evicted ip deleted", reps, err)
+	}
+
+	cfg.MaxEntries = 1
+	reopened, err := Open(ctx, cfg, st.Store)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	reopened.now = tracker.now
+	if entries := reopened.Entries(); len(entries) != 1 || entries[0].Value != "192.0.2.3" {
+		t.Fatalf("Entries() after reopen = %+v, want only the most recently seen ip", entries)
+	}
+}
@@ -0,0 +1,323 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	negativeTTL    = time.Minute
+	ednsBufferSize = 1232
+)
+
+type Options struct {
+	Servers       []string
+	TLS           bool
+	TLSServerName string
+	Timeout       time.Duration
+	CacheSize     int
+	MaxTTL        time.Duration
+}
+
+type Stats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+type Resolver struct {
+	servers   []string
+	client    *dns.Client
+	tcpClient *dns.Client
+	cacheSize int
+	maxTTL    time.Duration
+	now       func() time.Time
+	exchange  func(ctx context.Context, query *dns.Msg, server string, tcp bool) (*dns.Msg, error)
+
+	mu     sync.Mutex
+	cache  map[cacheKey]cacheEntry
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	answer  []dns.RR
+	rcode   int
+	expires time.Time
+}
+
+func New(opts Options) *Resolver {
+	client := &dns.Client{Timeout: opts.Timeout}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: opts.Timeout}
+	port := "53"
+	if opts.TLS {
+		client.Net = "tcp-tls"
+		client.TLSConfig = &tls.Config{ServerName: opts.TLSServerName, MinVersion: tls.VersionTLS12}
+		tcpClient = client
+		port = "853"
+	}
+
+	servers := make([]string, 0, len(opts.Servers))
+	for _, server := range opts.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+		}
+		servers = append(servers, server)
+	}
+
+	r := &Resolver{
+		servers:   servers,
+		client:    client,
+		tcpClient: tcpClient,
+		cacheSize: opts.CacheSize,
+		maxTTL:    opts.MaxTTL,
+		now:       time.Now,
+		cache:     make(map[cacheKey]cacheEntry),
+	}
+	r.exchange = func(ctx context.Context, query *dns.Msg, server string, tcp bool) (*dns.Msg, error) {
+		client := r.client
+		if tcp {
+			client = r.tcpClient
+		}
+		response, _, err := client.ExchangeContext(ctx, query, server)
+		return response, err
+	}
+	return r
+}
+
+func (r *Resolver) Servers() []string {
+	return r.servers
+}
+
+func (r *Resolver) Client() *dns.Client {
+	return r.client
+}
+
+func (r *Resolver) Stats() Stats {
+	r.mu.Lock()
+	entries := len(r.cache)
+	r.mu.Unlock()
+	return Stats{Hits: r.hits.Load(), Misses: r.misses.Load(), Entries: entries}
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := r.lookup(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var records []*net.MX
+	for _, rr := range answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			records = append(records, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	if len(records) == 0 {
+		return nil, notFound(name)
+	}
+	return records, nil
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := r.lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, rr := range answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			records = append(records, strings.Join(txt.Txt, ""))
+		}
+	}
+	if len(records) == 0 {
+		return nil, notFound(name)
+	}
+	return records, nil
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	var addrs []net.IPAddr
+	var errs []error
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		answer, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: record.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: record.AAAA})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) > 0 {
+			return nil, errs[len(errs)-1]
+		}
+		return nil, notFound(host)
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+	answer, err := r.lookup(ctx, name, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, rr := range answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	if len(names) == 0 {
+		return nil, notFound(addr)
+	}
+	return names, nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	key := cacheKey{name: strings.ToLower(dns.Fqdn(name)), qtype: qtype}
+	if entry, ok := r.cached(key); ok {
+		r.hits.Add(1)
+		return entryResult(entry, name)
+	}
+	r.misses.Add(1)
+
+	query := new(dns.Msg)
+	query.SetQuestion(key.name, qtype)
+	query.RecursionDesired = true
+	query.SetEdns0(ednsBufferSize, false)
+
+	var lastErr error = errors.New("no dns servers configured")
+	for _, server := range r.servers {
+		response, err := r.exchange(ctx, query, server, false)
+		if err == nil && response.Truncated {
+			response, err = r.exchange(ctx, query, server, true)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Truncated {
+			lastErr = fmt.Errorf("%s lookup: truncated response", dns.TypeToString[qtype])
+			continue
+		}
+		switch response.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			lastErr = fmt.Errorf("%s lookup: %s", dns.TypeToString[qtype], dns.RcodeToString[response.Rcode])
+			continue
+		}
+
+		entry := cacheEntry{rcode: response.Rcode, expires: r.now().Add(r.ttl(response))}
+		for _, rr := range response.Answer {
+			if rr.Header().Rrtype == qtype {
+				entry.answer = append(entry.answer, rr)
+			}
+		}
+		r.store(key, entry)
+		return entryResult(entry, name)
+	}
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+func entryResult(entry cacheEntry, name string) ([]dns.RR, error) {
+	if entry.rcode == dns.RcodeNameError || len(entry.answer) == 0 {
+		return nil, notFound(name)
+	}
+	return entry.answer, nil
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *Resolver) ttl(response *dns.Msg) time.Duration {
+	ttl := time.Duration(-1)
+	for _, rr := range response.Answer {
+		if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; ttl < 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+	}
+	if ttl < 0 {
+		ttl = negativeTTL
+		for _, rr := range response.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = time.Duration(min(soa.Minttl, soa.Hdr.Ttl)) * time.Second
+			}
+		}
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+func (r *Resolver) cached(key cacheKey) (cacheEntry, bool) {
+	if r.cacheSize <= 0 {
+		return cacheEntry{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if !r.now().Before(entry.expires) {
+		delete(r.cache, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (r *Resolver) store(key cacheKey, entry cacheEntry) {
+	if r.cacheSize <= 0 || !entry.expires.After(r.now()) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.cacheSize {
+		r.prune()
+	}
+	r.cache[key] = entry
+}
+
+func (r *Resolver) prune() {
+	now := r.now()
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	for key := range r.cache {
+		if len(r.cache) < r.cacheSize {
+			return
+		}
+		delete(r.cache, key)
+	}
+}
@@ -0,0 +1,119 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolver_CachesRespectingTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := New(Options{Servers: []string{"192.0.2.53"}, Timeout: time.Second, CacheSize: 16, MaxTTL: time.Hour})
+	r.now = func() time.Time { return now }
+
+	var queries []string
+	r.exchange = func(_ context.Context, query *dns.Msg, server string, _ bool) (*dns.Msg, error) {
+		if server != "192.0.2.53:53" {
+			t.Fatalf("exchange() server = %q, want default port 53", server)
+		}
+		question := query.Question[0]
+		queries = append(queries, dns.TypeToString[question.Qtype]+" "+question.Name)
+
+		response := new(dns.Msg)
+		response.SetReply(query)
+		switch {
+		case question.Qtype == dns.TypeMX && question.Name == "example.com.":
+			mx, _ := dns.NewRR("example.com. 300 IN MX 10 mx.example.com.")
+			response.Answer = append(response.Answer, mx)
+		default:
+			response.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example.com. 900 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 30")
+			response.Ns = append(response.Ns, soa)
+		}
+		return response, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		records, err := r.LookupMX(context.Background(), "Example.com")
+		if err != nil || len(records) != 1 || records[0].Host != "mx.example.com." || records[0].Pref != 10 {
+			t.Fatalf("LookupMX() = %v, %v, want mx.example.com", records, err)
+		}
+	}
+	if len(queries) != 1 {
+		t.Fatalf("queries = %v, want the second lookup served from cache", queries)
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := r.LookupTXT(context.Background(), "missing.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("LookupTXT(missing) error = %v, want not found", err)
+	}
+	now = now.Add(20 * time.Second)
+	r.LookupTXT(context.Background(), "missing.example.com")
+	if len(queries) != 2 {
+		t.Fatalf("queries = %v, want the negative answer cached for the SOA minimum", queries)
+	}
+
+	now = now.Add(5 * time.Minute)
+	r.LookupMX(context.Background(), "example.com")
+	r.LookupTXT(context.Background(), "missing.example.com")
+	if len(queries) != 4 {
+		t.Fatalf("queries = %v, want both entries refreshed after their ttl", queries)
+	}
+
+	if stats := r.Stats(); stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 2 {
+		t.Fatalf("Stats() = %+v, want 2 hits, 4 misses, 2 entries", stats)
+	}
+}
+
+func TestResolver_RetriesTruncatedOverTCP(t *testing.T) {
+	r := New(Options{Servers: []string{"192.0.2.53"}, Timeout: time.Second, CacheSize: 16})
+
+	var queries []string
+	truncateTCP := false
+	r.exchange = func(_ context.Context, query *dns.Msg, _ string, tcp bool) (*dns.Msg, error) {
+		if opt := query.IsEdns0(); opt == nil || opt.UDPSize() != ednsBufferSize {
+			t.Fatalf("query EDNS0 = %v, want a %d byte buffer", opt, ednsBufferSize)
+		}
+		transport := "udp"
+		if tcp {
+			transport = "tcp"
+		}
+		queries = append(queries, transport)
+
+		response := new(dns.Msg)
+		response.SetReply(query)
+		first, _ := dns.NewRR(`example.com. 300 IN TXT "v=spf1 -all"`)
+		response.Answer = append(response.Answer, first)
+		if !tcp || truncateTCP {
+			response.Truncated = true
+			return response, nil
+		}
+		second, _ := dns.NewRR(`example.com. 300 IN TXT "verification=1"`)
+		response.Answer = append(response.Answer, second)
+		return response, nil
+	}
+
+	records, err := r.LookupTXT(context.Background(), "example.com")
+	if err != nil || len(records) != 2 {
+		t.Fatalf("LookupTXT() = %v, %v, want both records from the tcp retry", records, err)
+	}
+	if want := []string{"udp", "tcp"}; !slices.Equal(queries, want) {
+		t.Fatalf("queries = %v, want %v", queries, want)
+	}
+
+	truncateTCP = true
+	queries = nil
+	for range 2 {
+		if _, err := r.LookupTXT(context.Background(), "truncated.example.com"); err == nil {
+			t.Fatalf("LookupTXT(truncated) error = nil, want an error")
+		}
+	}
+	if len(queries) != 4 {
+		t.Fatalf("queries = %v, want the truncated answer never cached", queries)
+	}
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Memory struct {
+	mu          sync.Mutex
+	messages    map[int64]Message
+	replies     map[int64]Reply
+	reputation  map[string]Reputation
+	nextMessage int64
+	nextReply   int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		messages:   make(map[int64]Message),
+		replies:    make(map[int64]Reply),
+		reputation: make(map[string]Reputation),
+	}
+}
+
+func (m *Memory) SaveMessage(_ context.Context, msg Message) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextMessage++
+	msg.ID = m.nextMessage
+	msg.Recipients = append([]string(nil), msg.Recipients...)
+	msg.Raw = append([]byte(nil), msg.Raw...)
+	msg.Replies = nil
+	m.messages[msg.ID] = msg
+	return msg.ID, nil
+}
+
+func (m *Memory) SaveReply(_ context.Context, reply Reply) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	if reply.CreatedAt.IsZero() {
+		reply.CreatedAt = now
+	}
+	reply.UpdatedAt = now
+	if reply.Kind == "" {
+		reply.Kind = ReplyKindEcho
+	}
+
+	m.nextReply++
+	reply.ID = m.nextReply
+	reply.Raw = append([]byte(nil), reply.Raw...)
+	m.replies[reply.ID] = reply
+	return reply.ID, nil
+}
+
+func (m *Memory) UpdateReplyStatus(_ context.Context, id int64, update ReplyUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply, ok := m.replies[id]
+	if !ok {
+		return ErrNotFound
+	}
+	reply.Status = update.Status
+	reply.StatusCode = update.StatusCode
+	reply.RemoteHost = update.RemoteHost
+	reply.Error = update.Error
+	reply.UpdatedAt = time.Now().UTC()
+	m.replies[id] = reply
+	return nil
+}
+
+func (m *Memory) FindReply(_ context.Context, query ReplyQuery) (Reply, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if query.ID == 0 && query.HeaderMessageID == "" && query.Recipient == "" {
+		return Reply{}, ErrNotFound
+	}
+	var found Reply
+	for _, reply := range m.replies {
+		if query.ID != 0 && reply.ID != query.ID {
+			continue
+		}
+		if query.HeaderMessageID != "" && reply.HeaderMessageID != query.HeaderMessageID {
+			continue
+		}
+		if query.Recipient != "" && !strings.EqualFold(reply.Recipient, query.Recipient) {
+			continue
+		}
+		if reply.ID > found.ID {
+			found = reply
+		}
+	}
+	if found.ID == 0 {
+		return Reply{}, ErrNotFound
+	}
+	return found, nil
+}
+
+func (m *Memory) GetMessage(_ context.Context, id int64) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	for _, reply := range m.replies {
+		if reply.MessageID == id {
+			msg.Replies = append(msg.Replies, reply)
+		}
+	}
+	sort.Slice(msg.Replies, func(i, j int) bool {
+		return msg.Replies[i].ID < msg.Replies[j].ID
+	})
+	return msg, nil
+}
+
+func (m *Memory) SearchMessages(_ context.Context, query Query) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []Message
+	for _, msg := range m.messages {
+		if !matchesQuery(msg, query) {
+			continue
+		}
+		msg.Raw = nil
+		matches = append(matches, msg)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].ReceivedAt.Equal(matches[j].ReceivedAt) {
+			return matches[i].ReceivedAt.After(matches[j].ReceivedAt)
+		}
+		return matches[i].ID > matches[j].ID
+	})
+
+	if query.Offset >= len(matches) {
+		return nil, nil
+	}
+	matches = matches[query.Offset:]
+	if limit := applyLimit(query); len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+func (m *Memory) DeleteMessage(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.messages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.messages, id)
+	for replyID, reply := range m.replies {
+		if reply.MessageID == id {
+			delete(m.replies, replyID)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Prune(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pruned := 0
+	for id, msg := range m.messages {
+		if !msg.ReceivedAt.Before(before) {
+			continue
+		}
+		delete(m.messages, id)
+		pruned++
+		for replyID, reply := range m.replies {
+			if reply.MessageID == id {
+				delete(m.replies, replyID)
+			}
+		}
+	}
+	return pruned, nil
+}
+
+func (m *Memory) SaveReputation(_ context.Context, rep Reputation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reputation[rep.Type+"\x00"+rep.Value] = rep
+	return nil
+}
+
+func (m *Memory) ListReputation(_ context.Context) ([]Reputation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reps := make([]Reputation, 0, len(m.reputation))
+	for _, rep := range m.reputation {
+		reps = append(reps, rep)
+	}
+	sort.Slice(reps, func(i, j int) bool {
+		if reps[i].Type != reps[j].Type {
+			return reps[i].Type < reps[j].Type
+		}
+		return reps[i].Value < reps[j].Value
+	})
+	return reps, nil
+}
+
+func (m *Memory) DeleteReputation(_ context.Context, repType string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := repType + "\x00" + value
+	if _, ok := m.reputation[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.reputation, key)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func matchesQuery(msg Message, query Query) bool {
+	if query.From != "" && !containsFold(msg.EnvelopeFrom, query.From) {
+		return false
+	}
+	if query.Recipient != "" && !containsFold(strings.Join(msg.Recipients, ","), query.Recipient) {
+		return false
+	}
+	if query.Subject != "" && !containsFold(msg.Subject, query.Subject) {
+		return false
+	}
+	if !query.Since.IsZero() && msg.ReceivedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !msg.ReceivedAt.Before(query.Until) {
+		return false
+	}
+	return true
+}
+
+func containsFold(value string, substr string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(substr))
+}
@@ -0,0 +1,401 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	received_at INTEGER NOT NULL,
+	remote_addr TEXT NOT NULL DEFAULT '',
+	envelope_from TEXT NOT NULL DEFAULT '',
+	recipients TEXT NOT NULL DEFAULT '[]',
+	subject TEXT NOT NULL DEFAULT '',
+	message_id TEXT NOT NULL DEFAULT '',
+	size INTEGER NOT NULL DEFAULT 0,
+	raw BLOB
+);
+CREATE INDEX IF NOT EXISTS messages_received_at ON messages (received_at);
+
+CREATE TABLE IF NOT EXISTS replies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	recipient TEXT NOT NULL DEFAULT '',
+	size INTEGER NOT NULL DEFAULT 0,
+	raw BLOB,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS replies_message_id ON replies (message_id);
+
+CREATE TABLE IF NOT EXISTS reputation (
+	type TEXT NOT NULL,
+	value TEXT NOT NULL,
+	messages INTEGER NOT NULL DEFAULT 0,
+	parse_failures INTEGER NOT NULL DEFAULT 0,
+	invalid_recipients INTEGER NOT NULL DEFAULT 0,
+	auth_failures INTEGER NOT NULL DEFAULT 0,
+	first_seen INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	blocked_until INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (type, value)
+);
+`
+
+var sqliteMigrations = []string{
+	`ALTER TABLE replies ADD COLUMN kind TEXT NOT NULL DEFAULT 'echo'`,
+	`ALTER TABLE replies ADD COLUMN status_code TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE replies ADD COLUMN remote_host TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE replies ADD COLUMN header_message_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS replies_header_message_id ON replies (header_message_id)`,
+}
+
+type SQLite struct {
+	db *sql.DB
+}
+
+func OpenSQLite(path string) (*SQLite, error) {
+	dsn := url.URL{Scheme: "file", Path: path, RawQuery: "_busy_timeout=5000&_journal_mode=WAL"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite store: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate sqlite store: %w", err)
+	}
+	for _, migration := range sqliteMigrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, fmt.Errorf("migrate sqlite store: %w", err)
+		}
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) SaveMessage(ctx context.Context, msg Message) (int64, error) {
+	recipients, err := json.Marshal(nonNilStrings(msg.Recipients))
+	if err != nil {
+		return 0, fmt.Errorf("encode recipients: %w", err)
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO messages (received_at, remote_addr, envelope_from, recipients, subject, message_id, size, raw)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.ReceivedAt.UnixNano(), msg.RemoteAddr, msg.EnvelopeFrom, string(recipients), msg.Subject, msg.MessageID, msg.Size, msg.Raw,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert message: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func (s *SQLite) SaveReply(ctx context.Context, reply Reply) (int64, error) {
+	now := time.Now().UTC()
+	if reply.CreatedAt.IsZero() {
+		reply.CreatedAt = now
+	}
+	if reply.Kind == "" {
+		reply.Kind = ReplyKindEcho
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO replies (message_id, header_message_id, kind, created_at, updated_at, recipient, size, raw, status, status_code, remote_host, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		reply.MessageID, reply.HeaderMessageID, reply.Kind, reply.CreatedAt.UnixNano(), now.UnixNano(), reply.Recipient, reply.Size, reply.Raw, reply.Status, reply.StatusCode, reply.RemoteHost, reply.Error,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert reply: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func (s *SQLite) UpdateReplyStatus(ctx context.Context, id int64, update ReplyUpdate) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE replies SET status = ?, status_code = ?, remote_host = ?, error = ?, updated_at = ? WHERE id = ?`,
+		update.Status, update.StatusCode, update.RemoteHost, update.Error, time.Now().UTC().UnixNano(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("update reply status: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) GetMessage(ctx context.Context, id int64) (Message, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, received_at, remote_addr, envelope_from, recipients, subject, message_id, size, raw
+		FROM messages WHERE id = ?`, id)
+	msg, err := scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+replyColumns+` FROM replies WHERE message_id = ? ORDER BY id`, id)
+	if err != nil {
+		return Message{}, fmt.Errorf("query replies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reply, err := scanReply(rows)
+		if err != nil {
+			return Message{}, err
+		}
+		msg.Replies = append(msg.Replies, reply)
+	}
+	return msg, rows.Err()
+}
+
+func (s *SQLite) FindReply(ctx context.Context, query ReplyQuery) (Reply, error) {
+	var conditions []string
+	var args []any
+	if query.ID != 0 {
+		conditions = append(conditions, "id = ?")
+		args = append(args, query.ID)
+	}
+	if query.HeaderMessageID != "" {
+		conditions = append(conditions, "header_message_id = ?")
+		args = append(args, query.HeaderMessageID)
+	}
+	if query.Recipient != "" {
+		conditions = append(conditions, "recipient = ? COLLATE NOCASE")
+		args = append(args, query.Recipient)
+	}
+	if len(conditions) == 0 {
+		return Reply{}, ErrNotFound
+	}
+
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+replyColumns+` FROM replies WHERE `+strings.Join(conditions, " AND ")+` ORDER BY id DESC LIMIT 1`, args...)
+	reply, err := scanReply(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Reply{}, ErrNotFound
+	}
+	return reply, err
+}
+
+func (s *SQLite) SearchMessages(ctx context.Context, query Query) ([]Message, error) {
+	var conditions []string
+	var args []any
+	if query.From != "" {
+		conditions = append(conditions, `envelope_from LIKE ? ESCAPE '\'`)
+		args = append(args, likeContains(query.From))
+	}
+	if query.Recipient != "" {
+		conditions = append(conditions, `recipients LIKE ? ESCAPE '\'`)
+		args = append(args, likeContains(query.Recipient))
+	}
+	if query.Subject != "" {
+		conditions = append(conditions, `subject LIKE ? ESCAPE '\'`)
+		args = append(args, likeContains(query.Subject))
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "received_at >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "received_at < ?")
+		args = append(args, query.Until.UnixNano())
+	}
+
+	statement := `SELECT id, received_at, remote_addr, envelope_from, recipients, subject, message_id, size, NULL FROM messages`
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY received_at DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, applyLimit(query), query.Offset)
+
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func likeContains(value string) string {
+	return "%" + likeEscaper.Replace(value) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *SQLite) DeleteMessage(ctx context.Context, id int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin delete: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM replies WHERE message_id = ?`, id); err != nil {
+		return fmt.Errorf("delete replies: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete message: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit delete: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLite) Prune(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin prune: %w", err)
+	}
+	defer tx.Rollback()
+
+	cutoff := before.UnixNano()
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM replies WHERE message_id IN (SELECT id FROM messages WHERE received_at < ?)`, cutoff); err != nil {
+		return 0, fmt.Errorf("prune replies: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE received_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("prune messages: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit prune: %w", err)
+	}
+
+	pruned, _ := result.RowsAffected()
+	return int(pruned), nil
+}
+
+func (s *SQLite) SaveReputation(ctx context.Context, rep Reputation) error {
+	var blockedUntil int64
+	if !rep.BlockedUntil.IsZero() {
+		blockedUntil = rep.BlockedUntil.UnixNano()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO reputation (type, value, messages, parse_failures, invalid_recipients, auth_failures, first_seen, last_seen, blocked_until)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (type, value) DO UPDATE SET messages = excluded.messages, parse_failures = excluded.parse_failures,
+		invalid_recipients = excluded.invalid_recipients, auth_failures = excluded.auth_failures,
+		first_seen = excluded.first_seen, last_seen = excluded.last_seen, blocked_until = excluded.blocked_until`,
+		rep.Type, rep.Value, rep.Messages, rep.ParseFailures, rep.InvalidRecipients, rep.AuthFailures, rep.FirstSeen.UnixNano(), rep.LastSeen.UnixNano(), blockedUntil,
+	)
+	if err != nil {
+		return fmt.Errorf("save reputation: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLite) ListReputation(ctx context.Context) ([]Reputation, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT type, value, messages, parse_failures, invalid_recipients, auth_failures, first_seen, last_seen, blocked_until
+		FROM reputation ORDER BY type, value`)
+	if err != nil {
+		return nil, fmt.Errorf("query reputation: %w", err)
+	}
+	defer rows.Close()
+
+	var reps []Reputation
+	for rows.Next() {
+		var rep Reputation
+		var firstSeen, lastSeen, blockedUntil int64
+		if err := rows.Scan(&rep.Type, &rep.Value, &rep.Messages, &rep.ParseFailures, &rep.InvalidRecipients, &rep.AuthFailures, &firstSeen, &lastSeen, &blockedUntil); err != nil {
+			return nil, fmt.Errorf("scan reputation: %w", err)
+		}
+		rep.FirstSeen = time.Unix(0, firstSeen).UTC()
+		rep.LastSeen = time.Unix(0, lastSeen).UTC()
+		if blockedUntil != 0 {
+			rep.BlockedUntil = time.Unix(0, blockedUntil).UTC()
+		}
+		reps = append(reps, rep)
+	}
+	return reps, rows.Err()
+}
+
+func (s *SQLite) DeleteReputation(ctx context.Context, repType string, value string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM reputation WHERE type = ? AND value = ?`, repType, value)
+	if err != nil {
+		return fmt.Errorf("delete reputation: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const replyColumns = `id, message_id, header_message_id, kind, created_at, updated_at, recipient, size, raw, status, status_code, remote_host, error`
+
+func scanReply(row rowScanner) (Reply, error) {
+	var reply Reply
+	var createdAt, updatedAt int64
+	if err := row.Scan(&reply.ID, &reply.MessageID, &reply.HeaderMessageID, &reply.Kind, &createdAt, &updatedAt, &reply.Recipient, &reply.Size, &reply.Raw, &reply.Status, &reply.StatusCode, &reply.RemoteHost, &reply.Error); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Reply{}, err
+		}
+		return Reply{}, fmt.Errorf("scan reply: %w", err)
+	}
+	reply.CreatedAt = time.Unix(0, createdAt).UTC()
+	reply.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return reply, nil
+}
+
+func scanMessage(row rowScanner) (Message, error) {
+	var msg Message
+	var receivedAt int64
+	var recipients string
+	if err := row.Scan(&msg.ID, &receivedAt, &msg.RemoteAddr, &msg.EnvelopeFrom, &recipients, &msg.Subject, &msg.MessageID, &msg.Size, &msg.Raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Message{}, err
+		}
+		return Message{}, fmt.Errorf("scan message: %w", err)
+	}
+	msg.ReceivedAt = time.Unix(0, receivedAt).UTC()
+	if err := json.Unmarshal([]byte(recipients), &msg.Recipients); err != nil {
+		return Message{}, fmt.Errorf("decode recipients: %w", err)
+	}
+	return msg, nil
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
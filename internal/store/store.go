@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	ReplyStatusPending    = "pending"
+	ReplyStatusDelivered  = "delivered"
+	ReplyStatusFailed     = "failed"
+	ReplyStatusBounced    = "bounced"
+	ReplyStatusComplained = "complained"
+	ReplyStatusNotSent    = "not_sent"
+)
+
+const (
+	ReplyKindEcho     = "echo"
+	ReplyKindDSN      = "dsn"
+	ReplyKindCC       = "cc"
+	ReplyKindBCC      = "bcc"
+	ReplyKindDigest   = "digest"
+	ReplyKindReplyAll = "reply_all"
+	ReplyKindForward  = "forward"
+)
+
+var ErrNotFound = errors.New("store: not found")
+
+type Message struct {
+	ID           int64     `json:"id"`
+	ReceivedAt   time.Time `json:"received_at"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	EnvelopeFrom string    `json:"envelope_from"`
+	Recipients   []string  `json:"recipients"`
+	Subject      string    `json:"subject,omitempty"`
+	MessageID    string    `json:"message_id,omitempty"`
+	Size         int       `json:"size"`
+	Raw          []byte    `json:"-"`
+	Replies      []Reply   `json:"replies,omitempty"`
+}
+
+type Reply struct {
+	ID              int64     `json:"id"`
+	MessageID       int64     `json:"message_id"`
+	HeaderMessageID string    `json:"header_message_id,omitempty"`
+	Kind            string    `json:"kind"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Recipient       string    `json:"recipient"`
+	Size            int       `json:"size"`
+	Raw             []byte    `json:"-"`
+	Status          string    `json:"status"`
+	StatusCode      string    `json:"status_code,omitempty"`
+	RemoteHost      string    `json:"remote_host,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type ReplyUpdate struct {
+	Status     string
+	StatusCode string
+	RemoteHost string
+	Error      string
+}
+
+type ReplyQuery struct {
+	ID              int64
+	HeaderMessageID string
+	Recipient       string
+}
+
+type Query struct {
+	From      string
+	Recipient string
+	Subject   string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+type Reputation struct {
+	Type              string    `json:"type"`
+	Value             string    `json:"value"`
+	Messages          int       `json:"messages"`
+	ParseFailures     int       `json:"parse_failures"`
+	InvalidRecipients int       `json:"invalid_recipients"`
+	AuthFailures      int       `json:"auth_failures"`
+	FirstSeen         time.Time `json:"first_seen"`
+	LastSeen          time.Time `json:"last_seen"`
+	BlockedUntil      time.Time `json:"blocked_until,omitzero"`
+}
+
+type Store interface {
+	SaveMessage(ctx context.Context, msg Message) (int64, error)
+	SaveReply(ctx context.Context, reply Reply) (int64, error)
+	UpdateReplyStatus(ctx context.Context, id int64, update ReplyUpdate) error
+	FindReply(ctx context.Context, query ReplyQuery) (Reply, error)
+	GetMessage(ctx context.Context, id int64) (Message, error)
+	SearchMessages(ctx context.Context, query Query) ([]Message, error)
+	DeleteMessage(ctx context.Context, id int64) error
+	Prune(ctx context.Context, before time.Time) (int, error)
+	SaveReputation(ctx context.Context, rep Reputation) error
+	ListReputation(ctx context.Context) ([]Reputation, error)
+	DeleteReputation(ctx context.Context, repType string, value string) error
+	Close() error
+}
+
+const (
+	DriverSQLite = "sqlite"
+	DriverMemory = "memory"
+)
+
+func Open(cfg config.StoreConfig) (Store, error) {
+	switch cfg.Driver {
+	case DriverSQLite:
+		return OpenSQLite(cfg.Path)
+	case DriverMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported store driver %q", cfg.Driver)
+	}
+}
+
+func RunPruner(ctx context.Context, s Store, retention time.Duration, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := s.Prune(ctx, time.Now().Add(-retention))
+		if logger != nil {
+			switch {
+			case err != nil:
+				logger.Printf("prune message store: %v", err)
+			case pruned > 0:
+				logger.Printf("pruned %d stored messages older than %s", pruned, retention)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func applyLimit(query Query) int {
+	if query.Limit <= 0 || query.Limit > 1000 {
+		return 100
+	}
+	return query.Limit
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemory()
+		},
+		"sqlite": func(t *testing.T) Store {
+			s, err := OpenSQLite(filepath.Join(t.TempDir(), "messages.db"))
+			if err != nil {
+				t.Fatalf("OpenSQLite() error = %v", err)
+			}
+			return s
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			testStore(t, s)
+		})
+	}
+}
+
+func TestOpenSQLite_PathWithURICharacters(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "echo data?#%20")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	path := filepath.Join(dir, "messages.db")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer s.Close()
+	if _, err := s.SaveMessage(context.Background(), Message{ReceivedAt: time.Now(), EnvelopeFrom: "sender@example.net"}); err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Stat() error = %v, want the database at the configured path", err)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	oldID, err := s.SaveMessage(ctx, Message{
+		ReceivedAt:   base.Add(-48 * time.Hour),
+		EnvelopeFrom: "old@example.net",
+		Recipients:   []string{"echo@example.com"},
+		Subject:      "Old message",
+		Size:         10,
+		Raw:          []byte("old"),
+	})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+	newID, err := s.SaveMessage(ctx, Message{
+		ReceivedAt:   base,
+		RemoteAddr:   "192.0.2.1:4000",
+		EnvelopeFrom: "Sender@Example.net",
+		Recipients:   []string{"echo@example.com", "other@example.com"},
+		Subject:      "Hello world",
+		MessageID:    "abc@example.net",
+		Size:         42,
+		Raw:          []byte("raw message"),
+	})
+	if err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+
+	replyID, err := s.SaveReply(ctx, Reply{MessageID: newID, Recipient: "sender@example.net", Size: 5, Raw: []byte("reply"), Status: ReplyStatusPending})
+	if err != nil {
+		t.Fatalf("SaveReply() error = %v", err)
+	}
+	if err := s.UpdateReplyStatus(ctx, replyID, ReplyUpdate{Status: ReplyStatusDelivered, StatusCode: "2.0.0", RemoteHost: "mx.example.net"}); err != nil {
+		t.Fatalf("UpdateReplyStatus() error = %v", err)
+	}
+	if err := s.UpdateReplyStatus(ctx, replyID+100, ReplyUpdate{Status: ReplyStatusDelivered}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateReplyStatus() unknown id error = %v, want ErrNotFound", err)
+	}
+	msg, err := s.GetMessage(ctx, newID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if string(msg.Raw) != "raw message" || len(msg.Recipients) != 2 || !msg.ReceivedAt.Equal(base) {
+		t.Fatalf("GetMessage() = %#v, want stored message", msg)
+	}
+	if len(msg.Replies) != 1 || msg.Replies[0].Status != ReplyStatusDelivered || string(msg.Replies[0].Raw) != "reply" ||
+		msg.Replies[0].Kind != ReplyKindEcho || msg.Replies[0].RemoteHost != "mx.example.net" || msg.Replies[0].StatusCode != "2.0.0" {
+		t.Fatalf("GetMessage() replies = %#v, want one delivered reply", msg.Replies)
+	}
+
+	laterID, err := s.SaveReply(ctx, Reply{MessageID: newID, HeaderMessageID: "reply-2@echo.example.com", Recipient: "sender@example.net", Status: ReplyStatusPending})
+	if err != nil {
+		t.Fatalf("SaveReply() error = %v", err)
+	}
+	if found, err := s.FindReply(ctx, ReplyQuery{Recipient: "Sender@Example.net"}); err != nil || found.ID != laterID {
+		t.Fatalf("FindReply(recipient) = %#v, %v, want the latest reply", found, err)
+	}
+	if found, err := s.FindReply(ctx, ReplyQuery{HeaderMessageID: "reply-2@echo.example.com", Recipient: "sender@example.net"}); err != nil || found.ID != laterID {
+		t.Fatalf("FindReply(message id) = %#v, %v, want the matching reply", found, err)
+	}
+	if found, err := s.FindReply(ctx, ReplyQuery{ID: replyID}); err != nil || found.ID != replyID {
+		t.Fatalf("FindReply(id) = %#v, %v, want reply %d", found, err, replyID)
+	}
+	if _, err := s.FindReply(ctx, ReplyQuery{HeaderMessageID: "missing@echo.example.com"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("FindReply(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateReplyStatus(ctx, laterID, ReplyUpdate{Status: ReplyStatusBounced}); err != nil {
+		t.Fatalf("UpdateReplyStatus() error = %v", err)
+	}
+
+	results, err := s.SearchMessages(ctx, Query{Subject: "hello"})
+	if err != nil {
+		t.Fatalf("SearchMessages() error = %v", err)
+	}
+	if len(results) != 1 || results[0].ID != newID {
+		t.Fatalf("SearchMessages(subject) = %#v, want the new message", results)
+	}
+
+	results, err = s.SearchMessages(ctx, Query{Recipient: "echo@example.com"})
+	if err != nil {
+		t.Fatalf("SearchMessages() error = %v", err)
+	}
+	if len(results) != 2 || results[0].ID != newID || results[1].ID != oldID {
+		t.Fatalf("SearchMessages(recipient) = %#v, want newest first", results)
+	}
+
+	for _, query := range []Query{{Subject: "hello_world"}, {From: "%"}, {Recipient: `echo\`}} {
+		results, err = s.SearchMessages(ctx, query)
+		if err != nil {
+			t.Fatalf("SearchMessages() error = %v", err)
+		}
+		if len(results) != 0 {
+			t.Fatalf("SearchMessages(%+v) = %#v, want wildcards matched literally", query, results)
+		}
+	}
+
+	pruned, err := s.Prune(ctx, base.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if pruned != 1 {
+		t.Fatalf("Prune() = %d, want 1", pruned)
+	}
+	if _, err := s.GetMessage(ctx, oldID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetMessage() after prune error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteMessage(ctx, newID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if _, err := s.GetMessage(ctx, newID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetMessage() after delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteMessage(ctx, newID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteMessage() missing id error = %v, want ErrNotFound", err)
+	}
+
+	rep := Reputation{Type: "ip", Value: "192.0.2.1", Messages: 3, InvalidRecipients: 2, FirstSeen: base, LastSeen: base.Add(time.Minute)}
+	if err := s.SaveReputation(ctx, rep); err != nil {
+		t.Fatalf("SaveReputation() error = %v", err)
+	}
+	rep.AuthFailures = 4
+	rep.BlockedUntil = base.Add(time.Hour)
+	if err := s.SaveReputation(ctx, rep); err != nil {
+		t.Fatalf("SaveReputation() update error = %v", err)
+	}
+	if err := s.SaveReputation(ctx, Reputation{Type: "sender", Value: "sender@example.net", Messages: 1, FirstSeen: base, LastSeen: base}); err != nil {
+		t.Fatalf("SaveReputation() error = %v", err)
+	}
+	reps, err := s.ListReputation(ctx)
+	if err != nil {
+		t.Fatalf("ListReputation() error = %v", err)
+	}
+	if len(reps) != 2 || reps[0] != rep || reps[1].Value != "sender@example.net" || !reps[1].BlockedUntil.IsZero() {
+		t.Fatalf("ListReputation() = %#v, want the updated ip entry and the sender entry", reps)
+	}
+	if err := s.DeleteReputation(ctx, "ip", "192.0.2.1"); err != nil {
+		t.Fatalf("DeleteReputation() error = %v", err)
+	}
+	if err := s.DeleteReputation(ctx, "ip", "192.0.2.1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteReputation() missing entry error = %v, want ErrNotFound", err)
+	}
+}
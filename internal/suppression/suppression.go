@@ -0,0 +1,302 @@
+package suppression
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	TypeAddress = "address"
+	TypeDomain  = "domain"
+	TypeRegex   = "regex"
+)
+
+const (
+	SourceConfig      = "config"
+	SourceAdmin       = "admin"
+	SourceBounce      = "bounce"
+	SourceUnsubscribe = "unsubscribe"
+	SourceComplaint   = "complaint"
+)
+
+var (
+	ErrNotFound    = errors.New("suppression: not found")
+	ErrConfigEntry = errors.New("suppression: entry is defined in config")
+)
+
+type Entry struct {
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type List struct {
+	mu              sync.Mutex
+	path            string
+	bounceThreshold int
+	static          []Entry
+	dynamic         []Entry
+	patterns        map[string]*regexp.Regexp
+	bounces         map[string]int
+	now             func() time.Time
+}
+
+type persisted struct {
+	Entries []Entry `json:"entries"`
+}
+
+func Open(cfg config.SuppressionConfig) (*List, error) {
+	l := &List{
+		path:     cfg.Path,
+		patterns: make(map[string]*regexp.Regexp),
+		bounces:  make(map[string]int),
+		now:      time.Now,
+	}
+	if l.path != "" {
+		data, err := os.ReadFile(l.path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("read suppression list: %w", err)
+		default:
+			var stored persisted
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("parse suppression list %s: %w", l.path, err)
+			}
+			for _, entry := range stored.Entries {
+				entry, err := l.normalize(entry)
+				if err != nil {
+					return nil, fmt.Errorf("suppression list %s: %w", l.path, err)
+				}
+				l.dynamic = append(l.dynamic, entry)
+			}
+		}
+	}
+	if err := l.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *List) Configure(cfg config.SuppressionConfig) error {
+	var static []Entry
+	for _, group := range []struct {
+		kind   string
+		values []string
+	}{
+		{TypeAddress, cfg.Addresses},
+		{TypeDomain, cfg.Domains},
+		{TypeRegex, cfg.Patterns},
+	} {
+		for _, value := range group.values {
+			entry, err := l.normalize(Entry{Type: group.kind, Value: value, Source: SourceConfig})
+			if err != nil {
+				return err
+			}
+			static = append(static, entry)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.static = static
+	l.bounceThreshold = cfg.BounceThreshold
+	return nil
+}
+
+func (l *List) Match(address string) (Entry, bool) {
+	if l == nil {
+		return Entry{}, false
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	domain := address
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = address[at+1:]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entries := range [][]Entry{l.static, l.dynamic} {
+		for _, entry := range entries {
+			switch entry.Type {
+			case TypeAddress:
+				if entry.Value == address {
+					return entry, true
+				}
+			case TypeDomain:
+				if entry.Value == domain || strings.HasSuffix(domain, "."+entry.Value) {
+					return entry, true
+				}
+			case TypeRegex:
+				if l.patterns[entry.Value].MatchString(address) {
+					return entry, true
+				}
+			}
+		}
+	}
+	return Entry{}, false
+}
+
+func (l *List) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := append(append([]Entry(nil), l.static...), l.dynamic...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries
+}
+
+func (l *List) Add(entry Entry) (Entry, error) {
+	if entry.Source == "" {
+		entry.Source = SourceAdmin
+	}
+	entry, err := l.normalize(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, existing := range l.dynamic {
+		if existing.Type == entry.Type && existing.Value == entry.Value {
+			l.dynamic[i] = entry
+			return entry, l.save()
+		}
+	}
+	l.dynamic = append(l.dynamic, entry)
+	return entry, l.save()
+}
+
+func (l *List) Remove(kind string, value string) error {
+	value = normalizeValue(kind, value)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.static {
+		if entry.Type == kind && entry.Value == value {
+			return ErrConfigEntry
+		}
+	}
+	for i, entry := range l.dynamic {
+		if entry.Type == kind && entry.Value == value {
+			l.dynamic = append(l.dynamic[:i], l.dynamic[i+1:]...)
+			if kind == TypeAddress {
+				delete(l.bounces, value)
+			}
+			return l.save()
+		}
+	}
+	return ErrNotFound
+}
+
+func (l *List) RecordBounce(address string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	l.mu.Lock()
+	threshold := l.bounceThreshold
+	if threshold <= 0 {
+		l.mu.Unlock()
+		return false, nil
+	}
+	l.bounces[address]++
+	count := l.bounces[address]
+	l.mu.Unlock()
+	if count < threshold {
+		return false, nil
+	}
+
+	_, err := l.Add(Entry{
+		Type:   TypeAddress,
+		Value:  address,
+		Reason: fmt.Sprintf("%d consecutive hard bounces", count),
+		Source: SourceBounce,
+	})
+	return true, err
+}
+
+func (l *List) RecordDelivery(address string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.bounces, strings.ToLower(strings.TrimSpace(address)))
+}
+
+func (l *List) normalize(entry Entry) (Entry, error) {
+	switch entry.Type {
+	case TypeAddress, TypeDomain:
+	case TypeRegex:
+		pattern, err := regexp.Compile(entry.Value)
+		if err != nil {
+			return Entry{}, fmt.Errorf("suppression pattern %q is invalid: %w", entry.Value, err)
+		}
+		l.mu.Lock()
+		l.patterns[entry.Value] = pattern
+		l.mu.Unlock()
+	default:
+		return Entry{}, fmt.Errorf("suppression type must be one of %q, %q, or %q", TypeAddress, TypeDomain, TypeRegex)
+	}
+	entry.Value = normalizeValue(entry.Type, entry.Value)
+	if entry.Value == "" {
+		return Entry{}, errors.New("suppression value is required")
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = l.now().UTC()
+	}
+	return entry, nil
+}
+
+func normalizeValue(kind string, value string) string {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case TypeAddress:
+		return strings.ToLower(strings.Trim(value, "<>"))
+	case TypeDomain:
+		return strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(value, "."), "@"))
+	default:
+		return value
+	}
+}
+
+func (l *List) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(persisted{Entries: l.dynamic}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode suppression list: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".suppressions-*.json")
+	if err != nil {
+		return fmt.Errorf("write suppression list: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write suppression list: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write suppression list: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("write suppression list: %w", err)
+	}
+	return nil
+}
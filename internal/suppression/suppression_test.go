@@ -0,0 +1,73 @@
+package suppression
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func TestList_MatchPersistAndBounces(t *testing.T) {
+	cfg := config.SuppressionConfig{
+		Path:            filepath.Join(t.TempDir(), "suppressions.json"),
+		Domains:         []string{"blocked.example"},
+		Patterns:        []string{`^noreply-.*@`},
+		BounceThreshold: 2,
+	}
+	list, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	for address, want := range map[string]bool{
+		"user@blocked.example":     true,
+		"user@sub.blocked.example": true,
+		"noreply-x@example.net":    true,
+		"user@example.net":         false,
+	} {
+		if _, got := list.Match(address); got != want {
+			t.Fatalf("Match(%q) = %t, want %t", address, got, want)
+		}
+	}
+
+	if _, err := list.Add(Entry{Type: TypeAddress, Value: "<Admin@Example.net>"}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := list.Add(Entry{Type: "bogus", Value: "x"}); err == nil {
+		t.Fatalf("Add(bogus type) error = nil, want error")
+	}
+	if err := list.Remove(TypeDomain, "blocked.example"); !errors.Is(err, ErrConfigEntry) {
+		t.Fatalf("Remove(config entry) error = %v, want ErrConfigEntry", err)
+	}
+
+	if suppressed, _ := list.RecordBounce("bouncy@example.net"); suppressed {
+		t.Fatalf("RecordBounce() first bounce suppressed = true, want false")
+	}
+	list.RecordDelivery("bouncy@example.net")
+	list.RecordBounce("bouncy@example.net")
+	if suppressed, err := list.RecordBounce("bouncy@example.net"); !suppressed || err != nil {
+		t.Fatalf("RecordBounce() = %t, %v, want suppression after two consecutive bounces", suppressed, err)
+	}
+
+	reopened, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open() reopen error = %v", err)
+	}
+	if entry, ok := reopened.Match("admin@example.net"); !ok || entry.Source != SourceAdmin {
+		t.Fatalf("reopened Match(admin@) = %+v, %t, want persisted admin entry", entry, ok)
+	}
+	if entry, ok := reopened.Match("bouncy@example.net"); !ok || entry.Source != SourceBounce {
+		t.Fatalf("reopened Match(bouncy@) = %+v, %t, want persisted bounce entry", entry, ok)
+	}
+	if len(reopened.Entries()) != 4 {
+		t.Fatalf("Entries() = %d, want 2 config and 2 persisted entries", len(reopened.Entries()))
+	}
+
+	if err := reopened.Remove(TypeAddress, "admin@example.net"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, ok := reopened.Match("admin@example.net"); ok {
+		t.Fatalf("Match(admin@) after Remove() = true, want false")
+	}
+}
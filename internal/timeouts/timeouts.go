@@ -0,0 +1,164 @@
+package timeouts
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseBanner  = "banner"
+	PhaseCommand = "command"
+	PhaseData    = "data"
+	PhaseIdle    = "idle"
+	PhaseSession = "session"
+)
+
+type Limits struct {
+	Banner  time.Duration
+	Command time.Duration
+	Data    time.Duration
+	Session time.Duration
+}
+
+type Listener struct {
+	net.Listener
+	Limits    func() Limits
+	OnTimeout func(conn net.Conn, phase string)
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.Limits(), l.OnTimeout), nil
+}
+
+type Conn struct {
+	net.Conn
+	limits    Limits
+	onTimeout func(conn net.Conn, phase string)
+	started   time.Time
+
+	mu       sync.Mutex
+	phase    string
+	dataEnds time.Time
+	bound    string
+	expired  string
+}
+
+func NewConn(conn net.Conn, limits Limits, onTimeout func(conn net.Conn, phase string)) *Conn {
+	return &Conn{Conn: conn, limits: limits, onTimeout: onTimeout, started: time.Now(), phase: PhaseBanner}
+}
+
+func FromConn(conn net.Conn) (*Conn, bool) {
+	for {
+		if c, ok := conn.(*Conn); ok {
+			return c, true
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = wrapped.NetConn()
+	}
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 || err != nil {
+		c.mu.Lock()
+		if n > 0 && c.phase == PhaseBanner {
+			c.phase = PhaseCommand
+		}
+		var expired string
+		if isTimeout(err) && c.expired == "" {
+			c.expired = c.bound
+			expired = c.expired
+		}
+		c.mu.Unlock()
+		if expired != "" && c.onTimeout != nil {
+			c.onTimeout(c, expired)
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	deadline := c.deadline(t, time.Now())
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) BeginData() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = PhaseData
+	if c.limits.Data > 0 {
+		c.dataEnds = time.Now().Add(c.limits.Data)
+		c.Conn.SetReadDeadline(c.deadline(time.Time{}, time.Now()))
+	}
+}
+
+func (c *Conn) EndData() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = PhaseCommand
+	c.dataEnds = time.Time{}
+}
+
+func (c *Conn) Expired() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired
+}
+
+func (c *Conn) deadline(requested time.Time, now time.Time) time.Time {
+	if c.expired != "" {
+		return now
+	}
+	if !requested.IsZero() && !requested.After(now) {
+		c.bound = PhaseIdle
+		return requested
+	}
+
+	deadline, bound := requested, c.phase
+	switch {
+	case c.phase == PhaseBanner && c.limits.Banner > 0:
+		deadline = c.started.Add(c.limits.Banner)
+	case c.phase == PhaseCommand && c.limits.Command > 0:
+		deadline = now.Add(c.limits.Command)
+	case c.phase == PhaseData && !c.dataEnds.IsZero():
+		deadline = c.dataEnds
+	}
+	if c.limits.Session > 0 {
+		if ends := c.started.Add(c.limits.Session); deadline.IsZero() || ends.Before(deadline) {
+			deadline, bound = ends, PhaseSession
+		}
+	}
+	c.bound = bound
+	return deadline
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,119 @@
+package timeouts
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		run    func(conn *Conn, client net.Conn)
+		want   string
+	}{
+		{
+			name:   "banner",
+			limits: Limits{Banner: 20 * time.Millisecond, Command: time.Minute},
+			run:    func(conn *Conn, client net.Conn) {},
+			want:   PhaseBanner,
+		},
+		{
+			name:   "command",
+			limits: Limits{Banner: time.Minute, Command: 20 * time.Millisecond},
+			run: func(conn *Conn, client net.Conn) {
+				go client.Write([]byte("EHLO client.example\r\n"))
+				readLine(t, conn)
+			},
+			want: PhaseCommand,
+		},
+		{
+			name:   "data",
+			limits: Limits{Command: time.Minute, Data: 20 * time.Millisecond},
+			run: func(conn *Conn, client net.Conn) {
+				go client.Write([]byte("DATA\r\n"))
+				readLine(t, conn)
+				conn.BeginData()
+			},
+			want: PhaseData,
+		},
+		{
+			name:   "session",
+			limits: Limits{Banner: time.Minute, Session: 20 * time.Millisecond},
+			run:    func(conn *Conn, client net.Conn) {},
+			want:   PhaseSession,
+		},
+		{
+			name:   "idle",
+			limits: Limits{Banner: time.Minute},
+			run: func(conn *Conn, client net.Conn) {
+				time.AfterFunc(20*time.Millisecond, func() { conn.SetReadDeadline(time.Now()) })
+			},
+			want: PhaseIdle,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			expired := make(chan string, 1)
+			conn := NewConn(server, test.limits, func(_ net.Conn, phase string) { expired <- phase })
+			defer conn.Close()
+
+			test.run(conn, client)
+			conn.SetReadDeadline(time.Now().Add(time.Minute))
+			if _, err := conn.Read(make([]byte, 64)); !isTimeout(err) {
+				t.Fatalf("Read() error = %v, want timeout", err)
+			}
+			select {
+			case phase := <-expired:
+				if phase != test.want {
+					t.Fatalf("OnTimeout() phase = %q, want %q", phase, test.want)
+				}
+			default:
+				t.Fatalf("OnTimeout() was not called")
+			}
+			if conn.Expired() != test.want {
+				t.Fatalf("Expired() = %q, want %q", conn.Expired(), test.want)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Minute))
+			if _, err := conn.Read(make([]byte, 64)); !isTimeout(err) {
+				t.Fatalf("Read() after expiry error = %v, want timeout", err)
+			}
+		})
+	}
+}
+
+func TestFromConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, Limits{}, nil)
+	defer conn.Close()
+
+	if got, ok := FromConn(wrapper{conn}); !ok || got != conn {
+		t.Fatalf("FromConn() = %v, %t, want wrapped conn", got, ok)
+	}
+	if _, ok := FromConn(server); ok {
+		t.Fatalf("FromConn() found a timeout conn in a plain pipe")
+	}
+}
+
+type wrapper struct {
+	net.Conn
+}
+
+func (w wrapper) NetConn() net.Conn {
+	return w.Conn
+}
+
+func readLine(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	buf := make([]byte, 64)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+}
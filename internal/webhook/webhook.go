@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+const (
+	EventMessageEchoed = "message.echoed"
+	EventMessageFailed = "message.failed"
+
+	SignatureHeader = "X-Echo-Signature"
+	TimestampHeader = "X-Echo-Timestamp"
+	EventHeader     = "X-Echo-Event"
+)
+
+type Payload struct {
+	Event      string              `json:"event"`
+	ID         int64               `json:"id,omitempty"`
+	ReceivedAt time.Time           `json:"received_at"`
+	Envelope   Envelope            `json:"envelope"`
+	Headers    map[string][]string `json:"headers"`
+	Body       Body                `json:"body"`
+	Delivery   Delivery            `json:"delivery"`
+}
+
+type Envelope struct {
+	MailFrom   string   `json:"mail_from"`
+	RcptTo     []string `json:"rcpt_to"`
+	Tag        string   `json:"tag,omitempty"`
+	Sequence   int64    `json:"sequence,omitempty"`
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	LocalAddr  string   `json:"local_addr,omitempty"`
+	Helo       string   `json:"helo,omitempty"`
+	AuthUser   string   `json:"auth_user,omitempty"`
+	TLS        *TLS     `json:"tls,omitempty"`
+	Size       int      `json:"size"`
+}
+
+type TLS struct {
+	Mode        string `json:"mode,omitempty"`
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+type Body struct {
+	Plain string `json:"plain"`
+	HTML  string `json:"html,omitempty"`
+}
+
+type Delivery struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Notifier struct {
+	mu        sync.RWMutex
+	endpoints []config.WebhookConfig
+	client    *http.Client
+	logger    *log.Logger
+	pending   sync.WaitGroup
+	sleep     func(time.Duration)
+}
+
+func NewNotifier(endpoints []config.WebhookConfig, logger *log.Logger) *Notifier {
+	return &Notifier{
+		endpoints: endpoints,
+		client:    &http.Client{},
+		logger:    logger,
+		sleep:     time.Sleep,
+	}
+}
+
+func (n *Notifier) Configure(endpoints []config.WebhookConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.endpoints = endpoints
+}
+
+func (n *Notifier) Enabled() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.endpoints) > 0
+}
+
+func (n *Notifier) Notify(payload Payload) {
+	n.mu.RLock()
+	endpoints := append([]config.WebhookConfig(nil), n.endpoints...)
+	n.mu.RUnlock()
+	if len(endpoints) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		n.logf("encode webhook payload: %v", err)
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		n.pending.Add(1)
+		go func(endpoint config.WebhookConfig) {
+			defer n.pending.Done()
+			if err := n.deliver(endpoint, payload.Event, body); err != nil {
+				n.logf("webhook %s failed: %v", endpoint.URL, err)
+			}
+		}(endpoint)
+	}
+}
+
+func (n *Notifier) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Notifier) deliver(endpoint config.WebhookConfig, event string, body []byte) error {
+	attempts := endpoint.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var lastErr error
+	backoff := time.Second
+	for attempt := 1; attempt <= attempts; attempt++ {
+		retry, err := n.post(endpoint, event, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == attempts {
+			break
+		}
+		n.sleep(backoff)
+		backoff *= 2
+	}
+	return lastErr
+}
+
+func (n *Notifier) post(endpoint config.WebhookConfig, event string, body []byte) (bool, error) {
+	ctx := context.Background()
+	if endpoint.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, endpoint.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("build request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "smtp-echo-webhook")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(TimestampHeader, timestamp)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(endpoint.Secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifier) logf(format string, args ...any) {
+	if n.logger != nil {
+		n.logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+)
+
+func TestNotifier_SignsAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan Payload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + Sign("topsecret", r.Header.Get(TimestampHeader), body)
+		if got := r.Header.Get(SignatureHeader); got != want {
+			t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+		}
+
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		received <- payload
+	}))
+	defer server.Close()
+
+	notifier := NewNotifier([]config.WebhookConfig{{
+		URL:         server.URL,
+		Secret:      "topsecret",
+		MaxAttempts: 3,
+	}}, nil)
+	notifier.sleep = func(time.Duration) {}
+
+	notifier.Notify(Payload{
+		Event:    EventMessageEchoed,
+		Envelope: Envelope{MailFrom: "sender@example.net", RcptTo: []string{"echo@example.com"}},
+		Body:     Body{Plain: "hello"},
+		Delivery: Delivery{Status: "echoed"},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := notifier.Wait(ctx); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if calls.Load() != 2 {
+		t.Fatalf("webhook calls = %d, want 2 (one retry)", calls.Load())
+	}
+	payload := <-received
+	if payload.Envelope.MailFrom != "sender@example.net" || payload.Body.Plain != "hello" {
+		t.Fatalf("payload = %#v, want envelope and body", payload)
+	}
+}
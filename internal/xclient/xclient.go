@@ -0,0 +1,361 @@
+package xclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	xclientCapability  = "XCLIENT NAME ADDR PORT PROTO HELO LOGIN"
+	xforwardCapability = "XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE"
+)
+
+type Attributes struct {
+	Name  string
+	Addr  net.IP
+	Port  int
+	Proto string
+	Helo  string
+	Login string
+}
+
+func (a Attributes) merge(other Attributes) Attributes {
+	if other.Name != "" {
+		a.Name = other.Name
+	}
+	if other.Addr != nil {
+		a.Addr = other.Addr
+		a.Port = other.Port
+	}
+	if other.Port != 0 {
+		a.Port = other.Port
+	}
+	if other.Proto != "" {
+		a.Proto = other.Proto
+	}
+	if other.Helo != "" {
+		a.Helo = other.Helo
+	}
+	if other.Login != "" {
+		a.Login = other.Login
+	}
+	return a
+}
+
+func (a Attributes) empty() bool {
+	return a.Name == "" && a.Addr == nil && a.Port == 0 && a.Proto == "" && a.Helo == "" && a.Login == ""
+}
+
+type Listener struct {
+	net.Listener
+	Greeting string
+	Trusted  func(net.Addr) bool
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.Trusted != nil && !l.Trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return NewConn(conn, l.Greeting), nil
+}
+
+type expectation int
+
+const (
+	expectNone expectation = iota
+	expectEHLO
+	expectData
+	expectTLS
+)
+
+type Conn struct {
+	net.Conn
+	greeting string
+	reader   *bufio.Reader
+	pending  []byte
+	readErr  error
+	midLine  bool
+	data     bool
+	tls      bool
+	chunk    int64
+	last     bool
+	expect   expectation
+
+	mu           sync.Mutex
+	client       Attributes
+	forward      Attributes
+	resetForward bool
+}
+
+func NewConn(conn net.Conn, greeting string) *Conn {
+	return &Conn{Conn: conn, greeting: greeting, reader: bufio.NewReader(conn)}
+}
+
+func FromConn(conn net.Conn) (*Conn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	xconn, ok := conn.(*Conn)
+	return xconn, ok
+}
+
+func (c *Conn) Attributes() (Attributes, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	attrs := c.client.merge(c.forward)
+	return attrs, !attrs.empty()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	attrs, _ := c.Attributes()
+	if attrs.Addr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return &net.TCPAddr{IP: attrs.Addr, Port: attrs.Port}
+}
+
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.tls {
+			return c.reader.Read(p)
+		}
+		if c.chunk > 0 {
+			return c.readChunk(p)
+		}
+
+		line, err := c.reader.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			c.readErr = err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		atLineStart := !c.midLine
+		c.midLine = line[len(line)-1] != '\n'
+		if atLineStart && !c.midLine && c.handleLine(line) {
+			continue
+		}
+		c.pending = append(c.pending[:0], line...)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readChunk(p []byte) (int, error) {
+	if int64(len(p)) > c.chunk {
+		p = p[:c.chunk]
+	}
+	n, err := c.reader.Read(p)
+	c.chunk -= int64(n)
+	if c.chunk == 0 && c.last {
+		c.endTransaction()
+	}
+	return n, err
+}
+
+func (c *Conn) handleLine(line []byte) bool {
+	if c.data {
+		if trimmed := bytes.TrimRight(line, "\r\n"); len(trimmed) == 1 && trimmed[0] == '.' {
+			c.data = false
+			c.endTransaction()
+		}
+		return false
+	}
+
+	c.mu.Lock()
+	if c.resetForward {
+		c.forward = Attributes{}
+		c.resetForward = false
+	}
+	c.mu.Unlock()
+
+	command, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	switch strings.ToUpper(command) {
+	case "XCLIENT":
+		attrs, err := parseAttributes(arg, "NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR", "DESTPORT")
+		if err != nil {
+			c.reply("501 5.5.4 Bad XCLIENT attribute: " + err.Error())
+			return true
+		}
+		c.mu.Lock()
+		c.client = c.client.merge(attrs)
+		c.forward = Attributes{}
+		c.mu.Unlock()
+		c.reply("220 " + c.greeting + " ESMTP Service Ready")
+		return true
+	case "XFORWARD":
+		attrs, err := parseAttributes(arg, "NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE")
+		if err != nil {
+			c.reply("501 5.5.4 Bad XFORWARD attribute: " + err.Error())
+			return true
+		}
+		c.mu.Lock()
+		c.forward = c.forward.merge(attrs)
+		c.mu.Unlock()
+		c.reply("250 2.0.0 Ok")
+		return true
+	case "EHLO":
+		c.expect = expectEHLO
+	case "DATA":
+		c.expect = expectData
+	case "STARTTLS":
+		c.expect = expectTLS
+	case "BDAT":
+		fields := strings.Fields(arg)
+		if len(fields) > 0 {
+			if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && size >= 0 {
+				c.chunk = size
+				c.last = len(fields) > 1 && strings.EqualFold(fields[1], "LAST")
+				if size == 0 && c.last {
+					c.endTransaction()
+				}
+			}
+		}
+	case "RSET":
+		c.mu.Lock()
+		c.forward = Attributes{}
+		c.mu.Unlock()
+	}
+	return false
+}
+
+func (c *Conn) endTransaction() {
+	c.mu.Lock()
+	c.resetForward = true
+	c.mu.Unlock()
+}
+
+func (c *Conn) reply(line string) {
+	io.WriteString(c.Conn, line+"\r\n")
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	expect := c.expect
+	c.expect = expectNone
+	switch expect {
+	case expectData:
+		c.data = bytes.HasPrefix(p, []byte("354"))
+	case expectTLS:
+		c.tls = bytes.HasPrefix(p, []byte("220"))
+	case expectEHLO:
+		if bytes.HasPrefix(p, []byte("250")) && len(p) > 3 {
+			return c.writeEHLO(p)
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *Conn) writeEHLO(p []byte) (int, error) {
+	final := p[3] == ' '
+	var response bytes.Buffer
+	response.WriteString("250-")
+	response.Write(p[4:])
+	response.WriteString("250-" + xclientCapability + "\r\n")
+	if final {
+		response.WriteString("250 " + xforwardCapability + "\r\n")
+	} else {
+		response.WriteString("250-" + xforwardCapability + "\r\n")
+	}
+	if _, err := c.Conn.Write(response.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func parseAttributes(arg string, allowed ...string) (Attributes, error) {
+	var attrs Attributes
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return attrs, errors.New("no attributes")
+	}
+	for _, field := range fields {
+		name, encoded, ok := strings.Cut(field, "=")
+		name = strings.ToUpper(name)
+		if !ok || !slices.Contains(allowed, name) {
+			return attrs, fmt.Errorf("unknown attribute %q", field)
+		}
+		value, err := decodeXText(encoded)
+		if err != nil {
+			return attrs, fmt.Errorf("%s: %w", name, err)
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+		switch name {
+		case "NAME":
+			attrs.Name = value
+		case "ADDR":
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			attrs.Addr = net.ParseIP(value)
+			if attrs.Addr == nil {
+				return attrs, fmt.Errorf("ADDR %q is not an ip address", value)
+			}
+		case "PORT":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return attrs, fmt.Errorf("PORT %q is not a port number", value)
+			}
+			attrs.Port = port
+		case "PROTO":
+			attrs.Proto = value
+		case "HELO":
+			attrs.Helo = value
+		case "LOGIN":
+			attrs.Login = value
+		}
+	}
+	return attrs, nil
+}
+
+func decodeXText(value string) (string, error) {
+	if !strings.Contains(value, "+") {
+		return value, nil
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '+' {
+			decoded.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", errors.New("truncated xtext escape")
+		}
+		b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext escape %q", value[i:i+3])
+		}
+		decoded.WriteByte(byte(b))
+		i += 2
+	}
+	return decoded.String(), nil
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,168 @@
+package xclient
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+type capture struct {
+	mu      sync.Mutex
+	remotes []string
+	helos   []string
+	bodies  []string
+}
+
+func (c *capture) NewSession(conn *smtp.Conn) (smtp.Session, error) {
+	return &captureSession{capture: c, conn: conn}, nil
+}
+
+type captureSession struct {
+	capture *capture
+	conn    *smtp.Conn
+}
+
+func (s *captureSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *captureSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (s *captureSession) Reset()                               {}
+func (s *captureSession) Logout() error                        { return nil }
+
+func (s *captureSession) Data(r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	helo := s.conn.Hostname()
+	if xconn, ok := FromConn(s.conn.Conn()); ok {
+		if attrs, ok := xconn.Attributes(); ok && attrs.Helo != "" {
+			helo = attrs.Helo
+		}
+	}
+	s.capture.mu.Lock()
+	defer s.capture.mu.Unlock()
+	s.capture.remotes = append(s.capture.remotes, s.conn.Conn().RemoteAddr().String())
+	s.capture.helos = append(s.capture.helos, helo)
+	s.capture.bodies = append(s.capture.bodies, string(body))
+	return nil
+}
+
+func startServer(t *testing.T, trusted func(net.Addr) bool) (*capture, *textproto.Conn) {
+	t.Helper()
+	backend := &capture{}
+	server := smtp.NewServer(backend)
+	server.Domain = "mail.example.com"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	go server.Serve(&Listener{Listener: listener, Greeting: server.Domain, Trusted: trusted})
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("textproto.Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("greeting error = %v", err)
+	}
+	return backend, conn
+}
+
+func command(t *testing.T, conn *textproto.Conn, expectCode int, format string, args ...any) string {
+	t.Helper()
+	id, err := conn.Cmd(format, args...)
+	if err != nil {
+		t.Fatalf("Cmd(%q) error = %v", format, err)
+	}
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+	_, message, err := conn.ReadResponse(expectCode)
+	if err != nil {
+		t.Fatalf("%s response error = %v", strings.Fields(format)[0], err)
+	}
+	return message
+}
+
+func sendMessage(t *testing.T, conn *textproto.Conn, body string) {
+	t.Helper()
+	command(t, conn, 250, "MAIL FROM:<sender@example.net>")
+	command(t, conn, 250, "RCPT TO:<echo@example.com>")
+	command(t, conn, 354, "DATA")
+	writer := conn.DotWriter()
+	if _, err := io.WriteString(writer, body); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("DATA response error = %v", err)
+	}
+}
+
+func TestConn_XCLIENT(t *testing.T) {
+	backend, conn := startServer(t, nil)
+
+	capabilities := command(t, conn, 250, "EHLO proxy.example.com")
+	if !strings.Contains(capabilities, xclientCapability) || !strings.Contains(capabilities, xforwardCapability) {
+		t.Fatalf("EHLO capabilities = %q, want XCLIENT and XFORWARD", capabilities)
+	}
+	if message := command(t, conn, 501, "XCLIENT ADDR=not-an-ip"); !strings.Contains(message, "ADDR") {
+		t.Fatalf("bad XCLIENT response = %q", message)
+	}
+	command(t, conn, 220, "XCLIENT ADDR=203.0.113.7 PORT=4321 HELO=client+2Eexample.net NAME=[UNAVAILABLE]")
+	command(t, conn, 250, "EHLO proxy.example.com")
+	sendMessage(t, conn, "Subject: hi\r\n\r\nXCLIENT ADDR=198.51.100.1\r\n")
+
+	command(t, conn, 250, "XFORWARD ADDR=IPV6:2001:db8::1 HELO=forwarded.example.net")
+	sendMessage(t, conn, "Subject: forwarded\r\n\r\nbody\r\n")
+	sendMessage(t, conn, "Subject: after\r\n\r\nbody\r\n")
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	wantRemotes := []string{"203.0.113.7:4321", "[2001:db8::1]:0", "203.0.113.7:4321"}
+	wantHelos := []string{"client.example.net", "forwarded.example.net", "client.example.net"}
+	if strings.Join(backend.remotes, ",") != strings.Join(wantRemotes, ",") {
+		t.Fatalf("remotes = %v, want %v", backend.remotes, wantRemotes)
+	}
+	if strings.Join(backend.helos, ",") != strings.Join(wantHelos, ",") {
+		t.Fatalf("helos = %v, want %v", backend.helos, wantHelos)
+	}
+	if !strings.Contains(backend.bodies[0], "XCLIENT ADDR=198.51.100.1") {
+		t.Fatalf("body = %q, want XCLIENT line inside DATA passed through", backend.bodies[0])
+	}
+}
+
+func TestConn_UntrustedClient(t *testing.T) {
+	_, conn := startServer(t, func(net.Addr) bool { return false })
+
+	if capabilities := command(t, conn, 250, "EHLO proxy.example.com"); strings.Contains(capabilities, "XCLIENT") {
+		t.Fatalf("EHLO capabilities = %q, want no XCLIENT for untrusted clients", capabilities)
+	}
+	command(t, conn, 5, "XCLIENT ADDR=203.0.113.7")
+}
+
+func TestDecodeXText(t *testing.T) {
+	tests := map[string]string{
+		"plain":         "plain",
+		"a+2Bb":         "a+b",
+		"host+20name":   "host name",
+		"+3Dequals+3D":  "=equals=",
+		"user+40domain": "user@domain",
+	}
+	for input, want := range tests {
+		got, err := decodeXText(input)
+		if err != nil || got != want {
+			t.Fatalf("decodeXText(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+	if _, err := decodeXText("bad+2"); err == nil {
+		t.Fatal("decodeXText() error = nil, want truncated escape error")
+	}
+}
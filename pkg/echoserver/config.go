@@ -0,0 +1,51 @@
+package echoserver
+
+import "github.com/danthegoodman1/smtp_echo/internal/config"
+
+type (
+	Config              = config.Config
+	ListenerConfig      = config.ListenerConfig
+	ReplyConfig         = config.ReplyConfig
+	ReplyIdentityConfig = config.ReplyIdentityConfig
+	SanitizeHTMLConfig  = config.SanitizeHTMLConfig
+	VERPConfig          = config.VERPConfig
+	DigestConfig        = config.DigestConfig
+	ReplyTemplateConfig = config.ReplyTemplateConfig
+	ReplyScriptConfig   = config.ReplyScriptConfig
+	DeliveryConfig      = config.DeliveryConfig
+	PoolConfig          = config.PoolConfig
+	RetryConfig         = config.RetryConfig
+	DKIMConfig          = config.DKIMConfig
+	DKIMKeyConfig       = config.DKIMKeyConfig
+	RateLimitConfig     = config.RateLimitConfig
+	RateLimit           = config.RateLimit
+	LimitsConfig        = config.LimitsConfig
+	RecipientsConfig    = config.RecipientsConfig
+	GreylistConfig      = config.GreylistConfig
+	SenderVerifyConfig  = config.SenderVerifyConfig
+	ChaosConfig         = config.ChaosConfig
+	DNSConfig           = config.DNSConfig
+	SuppressionConfig   = config.SuppressionConfig
+	AdminConfig         = config.AdminConfig
+	StoreConfig         = config.StoreConfig
+	QueueConfig         = config.QueueConfig
+	TracingConfig       = config.TracingConfig
+	ResponsesConfig     = config.ResponsesConfig
+	ArchiveConfig       = config.ArchiveConfig
+	GRPCConfig          = config.GRPCConfig
+	IMAPConfig          = config.IMAPConfig
+	RuleConfig          = config.RuleConfig
+	FilterConfig        = config.FilterConfig
+	WebhookConfig       = config.WebhookConfig
+	TLSConfig           = config.TLSConfig
+	AuthConfig          = config.AuthConfig
+	AuthUser            = config.AuthUser
+)
+
+func DefaultConfig() Config {
+	return config.Default()
+}
+
+func LoadConfig(path string) (Config, error) {
+	return config.Load(path, nil)
+}
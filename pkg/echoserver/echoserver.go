@@ -0,0 +1,295 @@
+package echoserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/internal/archive"
+	"github.com/danthegoodman1/smtp_echo/internal/config"
+	"github.com/danthegoodman1/smtp_echo/internal/echo"
+	"github.com/danthegoodman1/smtp_echo/internal/store"
+	"github.com/danthegoodman1/smtp_echo/internal/suppression"
+)
+
+type (
+	InboundMessage = echo.InboundMessage
+	Processor      = echo.Processor
+	ProcessorFunc  = echo.ProcessorFunc
+	Middleware     = echo.Middleware
+	Replier        = echo.Replier
+)
+
+type DeliveryFn func(ctx context.Context, from string, to string, message []byte) error
+
+type Option func(*Server) error
+
+func WithConfig(cfg Config) Option {
+	return func(s *Server) error {
+		s.cfg = cfg
+		return nil
+	}
+}
+
+func WithConfigFile(path string) Option {
+	return func(s *Server) error {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			return err
+		}
+		s.cfg = cfg
+		return nil
+	}
+}
+
+func WithListenAddr(addr string) Option {
+	return func(s *Server) error {
+		s.cfg.ListenAddr = addr
+		s.cfg.Listeners = nil
+		return nil
+	}
+}
+
+func WithHostname(hostname string) Option {
+	return func(s *Server) error {
+		s.cfg.Hostname = hostname
+		return nil
+	}
+}
+
+func WithReplyFrom(fromAddress string, mailFrom string) Option {
+	return func(s *Server) error {
+		s.cfg.Reply.FromAddress = fromAddress
+		s.cfg.Reply.MailFrom = mailFrom
+		return nil
+	}
+}
+
+func WithDelivery(deliver DeliveryFn) Option {
+	return func(s *Server) error {
+		s.deliver = deliver
+		return nil
+	}
+}
+
+func WithProcessor(processor Processor) Option {
+	return func(s *Server) error {
+		s.processor = processor
+		return nil
+	}
+}
+
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, middleware...)
+		return nil
+	}
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+type Server struct {
+	cfg        Config
+	logger     *log.Logger
+	deliver    DeliveryFn
+	processor  Processor
+	middleware []Middleware
+
+	replier *Replier
+	backend *echo.Backend
+	store   store.Store
+	servers []*smtp.Server
+	addrs   []net.Addr
+	mu      sync.Mutex
+	started bool
+}
+
+func New(opts ...Option) (*Server, error) {
+	s := &Server{cfg: DefaultConfig()}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.logger == nil {
+		s.logger = log.New(io.Discard, "", 0)
+	}
+	if err := s.cfg.Prepare(); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.Store != nil {
+		st, err := store.Open(*s.cfg.Store)
+		if err != nil {
+			return nil, err
+		}
+		s.store = st
+	}
+	var suppressionCfg config.SuppressionConfig
+	if s.cfg.Suppression != nil {
+		suppressionCfg = *s.cfg.Suppression
+	}
+	suppressions, err := suppression.Open(suppressionCfg)
+	if err != nil {
+		s.closeStore()
+		return nil, err
+	}
+	var archiveWriter *archive.Writer
+	if s.cfg.Archive != nil {
+		archiveWriter, err = archive.Open(*s.cfg.Archive)
+		if err != nil {
+			s.closeStore()
+			return nil, err
+		}
+	}
+
+	s.replier, err = echo.NewReplier(s.cfg, s.store, s.logger)
+	if err != nil {
+		s.closeStore()
+		return nil, err
+	}
+	s.replier.UseSuppressions(suppressions)
+	s.replier.UseArchive(archiveWriter)
+	if s.deliver != nil {
+		s.replier.UseDelivery(s.deliver)
+	}
+
+	processor := s.processor
+	if processor == nil {
+		processor, err = echo.NewProcessor(s.cfg, s.replier)
+		if err != nil {
+			s.closeStore()
+			return nil, err
+		}
+	}
+	s.backend = echo.NewBackend(s.cfg, processor, s.store, s.logger)
+	s.backend.UseArchive(archiveWriter)
+	s.backend.Use(s.middleware...)
+	return s, nil
+}
+
+func (s *Server) Config() Config {
+	return s.cfg
+}
+
+func (s *Server) Replier() *Replier {
+	return s.replier
+}
+
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("echo server already started")
+	}
+
+	var tlsConfig *tls.Config
+	if s.cfg.TLS != nil {
+		var err error
+		tlsConfig, err = echo.NewTLSConfig(*s.cfg.TLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	sockets := make([]net.Listener, 0, len(s.cfg.Listeners))
+	closeSockets := func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+		s.servers, s.addrs = nil, nil
+	}
+	for _, listener := range s.cfg.Listeners {
+		socket, err := net.Listen("tcp", listener.Addr)
+		if err != nil {
+			closeSockets()
+			return fmt.Errorf("listen on %s: %w", listener.Addr, err)
+		}
+		server := echo.NewSMTPServer(s.cfg, listener, s.backend, tlsConfig, s.logger)
+		wrapped, err := echo.WrapListener(listener, socket, tlsConfig, server)
+		if err != nil {
+			closeSockets()
+			return err
+		}
+		sockets = append(sockets, wrapped)
+		s.servers = append(s.servers, server)
+		s.addrs = append(s.addrs, socket.Addr())
+	}
+
+	for i, server := range s.servers {
+		go func(server *smtp.Server, socket net.Listener) {
+			if err := server.Serve(socket); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+				s.logger.Printf("smtp server on %s: %v", socket.Addr(), err)
+			}
+		}(server, sockets[i])
+	}
+	s.started = true
+	return nil
+}
+
+func (s *Server) Addr() string {
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+func (s *Server) Addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers, s.started = nil, false
+	s.mu.Unlock()
+
+	var errs []error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := s.backend.Drain(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if s.processor != nil {
+		if err := s.replier.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.closeStore()
+	return errors.Join(errs...)
+}
+
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) closeStore() {
+	if s.store != nil {
+		s.store.Close()
+		s.store = nil
+	}
+}
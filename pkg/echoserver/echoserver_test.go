@@ -0,0 +1,118 @@
+package echoserver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestServer_EchoesThroughDeliveryFn(t *testing.T) {
+	var mu sync.Mutex
+	delivered := make(chan []byte, 1)
+	var envelope []string
+	server, err := New(
+		WithHostname("echo.example.com"),
+		WithListenAddr("127.0.0.1:0"),
+		WithReplyFrom("echo@example.com", "bounce@example.com"),
+		WithDelivery(func(_ context.Context, from string, to string, message []byte) error {
+			mu.Lock()
+			envelope = []string{from, to}
+			mu.Unlock()
+			delivered <- message
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Close()
+	if err := server.Start(); err == nil {
+		t.Fatal("Start() twice error = nil, want already started")
+	}
+
+	client, err := smtp.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	message := "From: sender@example.net\r\nTo: echo@example.com\r\nSubject: embedded\r\nMessage-ID: <embedded@example.net>\r\n\r\nhello from a test\r\n"
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader(message)); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	select {
+	case reply := <-delivered:
+		for _, want := range []string{"Subject: Re: embedded", "In-Reply-To: <embedded@example.net>", "hello from a test"} {
+			if !bytes.Contains(reply, []byte(want)) {
+				t.Fatalf("reply missing %q, got:\n%s", want, reply)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reply")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if envelope[0] != "bounce@example.com" || envelope[1] != "sender@example.net" {
+		t.Fatalf("envelope = %v, want bounce@example.com -> sender@example.net", envelope)
+	}
+}
+
+func TestServer_ProcessorAndMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	server, err := New(
+		WithHostname("echo.example.com"),
+		WithListenAddr("127.0.0.1:0"),
+		WithReplyFrom("echo@example.com", "bounce@example.com"),
+		WithProcessor(ProcessorFunc(func(_ context.Context, msg InboundMessage) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, "processor:"+msg.EnvelopeFrom)
+			return nil
+		})),
+		WithMiddleware(func(next Processor) Processor {
+			return ProcessorFunc(func(ctx context.Context, msg InboundMessage) error {
+				mu.Lock()
+				seen = append(seen, "middleware")
+				mu.Unlock()
+				return next.Echo(ctx, msg)
+			})
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Close()
+
+	client, err := smtp.Dial(server.Addr())
+	if err != nil {
+		t.Fatalf("smtp.Dial() error = %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMail("sender@example.net", []string{"echo@example.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "middleware" || seen[1] != "processor:sender@example.net" {
+		t.Fatalf("calls = %v, want middleware then processor", seen)
+	}
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	if _, err := New(WithListenAddr("127.0.0.1:0")); err == nil {
+		t.Fatal("New() error = nil, want missing hostname error")
+	}
+}
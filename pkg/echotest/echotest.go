@@ -0,0 +1,192 @@
+package echotest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+
+	"github.com/danthegoodman1/smtp_echo/pkg/echoserver"
+)
+
+const (
+	Hostname     = "echo.test"
+	FromAddress  = "echo@echo.test"
+	MailFrom     = "bounce@echo.test"
+	DefaultWait  = 5 * time.Second
+	defaultLocal = "127.0.0.1:0"
+)
+
+type Message struct {
+	From       string
+	To         []string
+	Data       []byte
+	ReceivedAt time.Time
+}
+
+func (m Message) Header(name string) string {
+	header, _ := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(m.Data)))
+	return header.Get(name)
+}
+
+func (m Message) Body() string {
+	data := string(m.Data)
+	if _, body, ok := strings.Cut(data, "\r\n\r\n"); ok {
+		return body
+	}
+	if _, body, ok := strings.Cut(data, "\n\n"); ok {
+		return body
+	}
+	return ""
+}
+
+type Harness struct {
+	Server *echoserver.Server
+	Wait   time.Duration
+
+	t        testing.TB
+	mu       sync.Mutex
+	inbound  []Message
+	outbound []Message
+	returned map[int]bool
+	changed  chan struct{}
+}
+
+func Start(t testing.TB, opts ...echoserver.Option) *Harness {
+	t.Helper()
+	h := &Harness{
+		Wait:     DefaultWait,
+		t:        t,
+		returned: map[int]bool{},
+		changed:  make(chan struct{}),
+	}
+	options := []echoserver.Option{
+		echoserver.WithHostname(Hostname),
+		echoserver.WithListenAddr(defaultLocal),
+		echoserver.WithReplyFrom(FromAddress, MailFrom),
+		echoserver.WithMiddleware(h.captureInbound),
+	}
+	options = append(options, opts...)
+	options = append(options, echoserver.WithDelivery(h.captureOutbound))
+
+	server, err := echoserver.New(options...)
+	if err != nil {
+		t.Fatalf("echotest: New() error = %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("echotest: Start() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := server.Close(); err != nil {
+			t.Errorf("echotest: Close() error = %v", err)
+		}
+	})
+	h.Server = server
+	return h
+}
+
+func (h *Harness) Addr() string {
+	return h.Server.Addr()
+}
+
+func (h *Harness) Send(from string, to []string, message string) error {
+	client, err := smtp.Dial(h.Addr())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.SendMail(from, to, strings.NewReader(message)); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (h *Harness) Inbound() []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Message(nil), h.inbound...)
+}
+
+func (h *Harness) Outbound() []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Message(nil), h.outbound...)
+}
+
+func (h *Harness) LastInbound() Message {
+	h.t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.inbound) == 0 {
+		h.t.Fatalf("echotest: no inbound messages received")
+		return Message{}
+	}
+	return h.inbound[len(h.inbound)-1]
+}
+
+func (h *Harness) WaitForReply(to string) Message {
+	h.t.Helper()
+	deadline := time.NewTimer(h.Wait)
+	defer deadline.Stop()
+	for {
+		h.mu.Lock()
+		changed := h.changed
+		for i, message := range h.outbound {
+			if h.returned[i] || (to != "" && !strings.EqualFold(message.To[0], to)) {
+				continue
+			}
+			h.returned[i] = true
+			h.mu.Unlock()
+			return message
+		}
+		count := len(h.outbound)
+		h.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			h.t.Fatalf("echotest: no reply to %q within %s (%d outbound messages captured)", to, h.Wait, count)
+			return Message{}
+		}
+	}
+}
+
+func (h *Harness) captureInbound(next echoserver.Processor) echoserver.Processor {
+	return echoserver.ProcessorFunc(func(ctx context.Context, msg echoserver.InboundMessage) error {
+		data, err := msg.Bytes()
+		if err != nil {
+			return err
+		}
+		h.record(&h.inbound, Message{
+			From:       msg.EnvelopeFrom,
+			To:         append([]string(nil), msg.Recipients...),
+			Data:       append([]byte(nil), data...),
+			ReceivedAt: msg.ReceivedAt,
+		})
+		return next.Echo(ctx, msg)
+	})
+}
+
+func (h *Harness) captureOutbound(_ context.Context, from string, to string, message []byte) error {
+	h.record(&h.outbound, Message{
+		From:       from,
+		To:         []string{to},
+		Data:       append([]byte(nil), message...),
+		ReceivedAt: time.Now(),
+	})
+	return nil
+}
+
+func (h *Harness) record(messages *[]Message, message Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*messages = append(*messages, message)
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
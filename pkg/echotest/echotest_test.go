@@ -0,0 +1,66 @@
+package echotest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/danthegoodman1/smtp_echo/pkg/echoserver"
+)
+
+func TestHarness_WaitForReply(t *testing.T) {
+	h := Start(t)
+
+	for _, subject := range []string{"first", "second"} {
+		message := "From: sender@example.net\r\nTo: " + FromAddress + "\r\nSubject: " + subject + "\r\nMessage-ID: <" + subject + "@example.net>\r\n\r\nbody " + subject + "\r\n"
+		if err := h.Send("sender@example.net", []string{FromAddress}, message); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+
+	for _, subject := range []string{"first", "second"} {
+		reply := h.WaitForReply("Sender@example.net")
+		if got := reply.Header("Subject"); got != "Re: "+subject {
+			t.Fatalf("reply Subject = %q, want %q", got, "Re: "+subject)
+		}
+		if reply.From != MailFrom {
+			t.Fatalf("reply envelope from = %q, want %q", reply.From, MailFrom)
+		}
+		if !strings.Contains(reply.Body(), "body "+subject) {
+			t.Fatalf("reply body = %q, want it to echo %q", reply.Body(), "body "+subject)
+		}
+	}
+
+	inbound := h.LastInbound()
+	if inbound.From != "sender@example.net" || len(inbound.To) != 1 || inbound.To[0] != FromAddress {
+		t.Fatalf("LastInbound() = %+v, want sender@example.net -> %s", inbound, FromAddress)
+	}
+	if got := inbound.Header("Subject"); got != "second" {
+		t.Fatalf("LastInbound() Subject = %q, want second", got)
+	}
+	if got := len(h.Inbound()); got != 2 {
+		t.Fatalf("Inbound() = %d messages, want 2", got)
+	}
+	if got := len(h.Outbound()); got != 2 {
+		t.Fatalf("Outbound() = %d messages, want 2", got)
+	}
+}
+
+func TestHarness_CapturesRejectedInbound(t *testing.T) {
+	h := Start(t, echoserver.WithMiddleware(func(next echoserver.Processor) echoserver.Processor {
+		return echoserver.ProcessorFunc(func(ctx context.Context, msg echoserver.InboundMessage) error {
+			return errors.New("rejected by test")
+		})
+	}))
+
+	if err := h.Send("sender@example.net", []string{FromAddress}, "Subject: nope\r\n\r\nbody\r\n"); err == nil {
+		t.Fatal("Send() error = nil, want rejection")
+	}
+	if got := h.LastInbound().Header("Subject"); got != "nope" {
+		t.Fatalf("LastInbound() Subject = %q, want nope", got)
+	}
+	if got := len(h.Outbound()); got != 0 {
+		t.Fatalf("Outbound() = %d messages, want 0", got)
+	}
+}